@@ -0,0 +1,204 @@
+// Command swim-smoketest runs one lab through provision, availability, extension and
+// decommission against a SWIM deployment and exits non-zero if a step fails, as a gate
+// after a deploy. With --fake it runs SWIM's workers in-process against a fake provider.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector/hcloud"
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+	"github.com/alex-sviridov/swim/internal/signing"
+	"github.com/alex-sviridov/swim/internal/smoketest"
+)
+
+func main() {
+	// Load .env file if it exists (ignore error if file doesn't exist)
+	_ = godotenv.Load()
+
+	// Runs against the deployment in the same key namespace as the service
+	if err := config.SetKeyNamespace(config.GetKeyNamespace()); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid REDIS_KEY_NAMESPACE:", err)
+		os.Exit(1)
+	}
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "smoke test failed:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	defaults := smoketest.DefaultConfig()
+	redisAddr := flag.String("redis", "", "Redis connection string of the deployment (default: REDIS_CONNECTION_STRING)")
+	redisDB := flag.Int("redis-db", 0, "Redis database of the deployment")
+	fake := flag.Bool("fake", false, "Run the workers in-process against a fake provider, with an in-memory Redis unless --redis points to a disposable one")
+	userPrefix := flag.String("user-prefix", "smoketest-", "Prefix of the web user ID the cycle runs as; a random suffix is added")
+	verbose := flag.Bool("verbose", false, "Log each step, and the workers with --fake")
+	cfg := defaults
+	flag.IntVar(&cfg.LabID, "lab", defaults.LabID, "Lab to provision")
+	flag.StringVar(&cfg.Tenant, "tenant", defaults.Tenant, "Tenant of the smoke test user")
+	flag.IntVar(&cfg.ExtendMinutes, "extend-minutes", defaults.ExtendMinutes, "Minutes requested on the extension queue")
+	flag.DurationVar(&cfg.ReadyTimeout, "ready-timeout", defaults.ReadyTimeout, "Longest the server may take to become available")
+	flag.DurationVar(&cfg.StepTimeout, "timeout", defaults.StepTimeout, "Longest each of the other steps may take")
+	flag.DurationVar(&cfg.PollInterval, "poll-interval", defaults.PollInterval, "Time between reads of the cache entry")
+	flag.Parse()
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	cfg.WebUserID = *userPrefix + hex.EncodeToString(suffix)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	level := slog.LevelError
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if *redisAddr == "" {
+		*redisAddr = os.Getenv("REDIS_CONNECTION_STRING")
+	}
+	var store smoketest.Store
+	switch {
+	case *redisAddr != "":
+		redisClient, err := redisClientFromEnv(log, *redisAddr, *redisDB)
+		if err != nil {
+			return err
+		}
+		defer redisClient.Close()
+		store = redisClient
+	case *fake:
+		store = redistest.New()
+	default:
+		return fmt.Errorf("--redis flag or REDIS_CONNECTION_STRING environment variable is required without --fake")
+	}
+
+	// Requests are signed like LabMan's if the deployment verifies signatures;
+	// the in-process workers of --fake don't
+	var client redis.ClientInterface = store
+	signer, err := signerFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid payload signing configuration: %w", err)
+	}
+	if signer != nil && !*fake {
+		client = signing.Wrap(log, store, signer)
+	}
+
+	runner := smoketest.New(log, client, cfg)
+	if *fake {
+		service := smoketest.StartFake(log, store, 2*time.Second, time.Second)
+		defer service.Stop()
+		runner.WithProvider(service.Conn)
+	} else if token, err := credentials.FromEnv("HCLOUD_TOKEN"); err != nil {
+		return err
+	} else if token != "" {
+		runner.WithProvider(hcloud.NewConnectorWithToken(log, token, false))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "running lab %d as %s...\n", cfg.LabID, cfg.WebUserID)
+	report, err := runner.Run(ctx)
+	if report != nil {
+		printReport(report)
+	}
+	return err
+}
+
+// redisClientFromEnv connects to the deployment's Redis with REDIS_PASSWORD, decrypting
+// cached fields with CACHE_ENCRYPTION_KEY like the service does
+func redisClientFromEnv(log *slog.Logger, addr string, db int) (*redis.Client, error) {
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	redisClient, err := redis.NewClient(redis.Config{
+		Address:  addr,
+		Password: redisPassword,
+		DB:       db,
+		Logger:   log,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	encoded, err := credentials.FromEnv("CACHE_ENCRYPTION_KEY")
+	if err != nil || encoded == "" {
+		return redisClient, err
+	}
+	key, err := redis.ParseEncryptionKey(encoded)
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	var fields []string
+	for _, field := range strings.Split(os.Getenv("CACHE_ENCRYPTED_FIELDS"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	cipher, err := redis.NewFieldCipher(key, fields)
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	redisClient.WithEncryption(cipher)
+	return redisClient, nil
+}
+
+// signerFromEnv creates the payload signer for PAYLOAD_SIGNING_SECRET (or PAYLOAD_SIGNING_SECRET_FILE).
+// Returns nil if no secret is set.
+func signerFromEnv() (*signing.Signer, error) {
+	secret, err := credentials.FromEnv("PAYLOAD_SIGNING_SECRET")
+	if err != nil || secret == "" {
+		return nil, err
+	}
+	var maxAge time.Duration
+	if seconds := os.Getenv("PAYLOAD_SIGNATURE_MAX_AGE_SECONDS"); seconds != "" {
+		value, err := strconv.Atoi(seconds)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid PAYLOAD_SIGNATURE_MAX_AGE_SECONDS %q", seconds)
+		}
+		maxAge = time.Duration(value) * time.Second
+	}
+	return signing.NewSigner([]byte(secret), maxAge), nil
+}
+
+// printReport writes the outcome of each step as a table
+func printReport(report *smoketest.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tRESULT\tDURATION")
+	for _, step := range report.Steps {
+		result := "ok"
+		if step.Err != nil {
+			result = "FAILED: " + step.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", step.Name, result, step.Duration.Round(time.Millisecond))
+	}
+	w.Flush()
+	if report.ServerID != "" {
+		fmt.Printf("\nserver %s\n", report.ServerID)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/export"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+)
+
+// runExport implements `swim export`: it writes the server inventory to stdout or a file
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	redisAddr := flags.String("redis", "", "Redis connection string (default: REDIS_CONNECTION_STRING)")
+	format := flags.String("format", export.FormatJSON, "Output format: json or csv")
+	output := flags.String("output", "", "Output file (default: stdout)")
+	flags.Parse(args)
+
+	if *redisAddr == "" {
+		*redisAddr = os.Getenv("REDIS_CONNECTION_STRING")
+		if *redisAddr == "" {
+			return fmt.Errorf("--redis flag or REDIS_CONNECTION_STRING environment variable is required")
+		}
+	}
+	if *format != export.FormatJSON && *format != export.FormatCSV {
+		return fmt.Errorf("unknown format %q (want json or csv)", *format)
+	}
+
+	// Log to stderr so the inventory on stdout stays parseable
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	vault, err := vaultClientFromEnv()
+	if err != nil {
+		return err
+	}
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		return err
+	}
+	redisClient, err := redis.NewClient(redis.Config{
+		Address:  *redisAddr,
+		Password: redisPassword,
+		DB:       0,
+		Logger:   log,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	defer redisClient.Close()
+	cacheCipher, err := cacheCipherFromEnv()
+	if err != nil {
+		return err
+	}
+	if cacheCipher != nil {
+		redisClient.WithEncryption(cacheCipher)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hcloudConn, err := newHCloudConnector(ctx, log, hcloudTokenSource(redisClient, vault), false)
+	if err != nil {
+		return fmt.Errorf("connecting to hetzner cloud: %w", err)
+	}
+	tenants, err := tenant.Load(os.Getenv("TENANT_REGISTRY_FILE"))
+	if err != nil {
+		return err
+	}
+	conn, err := withTenantAccounts(ctx, log, hcloudConn, tenants, redisClient, vault, nil, nil, nil, false)
+	if err != nil {
+		return err
+	}
+
+	records, err := export.Collect(ctx, redisClient, conn, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return export.Write(os.Stdout, *format, records)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := export.Write(f, *format, records); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// runHistory implements `swim history <webuserid>`: it prints the recent lifecycle events
+// of a user, newest first
+func runHistory(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	redisAddr := flags.String("redis", "", "Redis connection string (default: REDIS_CONNECTION_STRING)")
+	tenantID := flags.String("tenant", "", "Tenant of the user (default: the default tenant)")
+	limit := flags.Int("limit", config.MaxHistory, "Maximum number of events to print")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: swim history [flags] <webuserid>")
+	}
+	if *redisAddr == "" {
+		*redisAddr = os.Getenv("REDIS_CONNECTION_STRING")
+		if *redisAddr == "" {
+			return fmt.Errorf("--redis flag or REDIS_CONNECTION_STRING environment variable is required")
+		}
+	}
+	if *limit <= 0 {
+		return fmt.Errorf("--limit must be positive")
+	}
+
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		return err
+	}
+	redisClient, err := redis.NewClient(redis.Config{
+		Address:  *redisAddr,
+		Password: redisPassword,
+		DB:       0,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	defer redisClient.Close()
+
+	events, err := redisClient.UserHistory(context.Background(), redis.TenantUserID(*tenantID, flags.Arg(0)), *limit)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(os.Stderr, "no history recorded")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tOPERATION\tLAB\tSERVER\tMESSAGE")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", event.At.Local().Format(time.DateTime), event.Type, event.Operation,
+			event.LabID, event.ServerID, strings.ReplaceAll(event.Message, "\n", " "))
+	}
+	return w.Flush()
+}
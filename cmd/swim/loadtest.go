@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/loadtest"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+// runLoadtest implements `swim loadtest`: it simulates students against a fake provider and prints latencies
+func runLoadtest(args []string) error {
+	defaults := loadtest.DefaultConfig()
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	redisAddr := flags.String("redis", "", "Redis connection string of a disposable Redis (default: in-memory)")
+	redisDB := flags.Int("redis-db", 15, "Redis database to use with --redis")
+	verbose := flags.Bool("verbose", false, "Log the provisioner, decommissioner and cleanup worker")
+	cfg := defaults
+	flags.IntVar(&cfg.Users, "users", defaults.Users, "Simulated students")
+	flags.IntVar(&cfg.Labs, "labs", defaults.Labs, "Labs students pick from")
+	flags.DurationVar(&cfg.Duration, "duration", defaults.Duration, "How long active students work after their first lab is up")
+	flags.Float64Var(&cfg.SwitchRate, "switch-rate", defaults.SwitchRate, "Lab switches per student per hour")
+	flags.Float64Var(&cfg.ReconnectRate, "reconnect-rate", defaults.ReconnectRate, "Reconnects per student per hour")
+	flags.Float64Var(&cfg.IdleFraction, "idle-fraction", defaults.IdleFraction, "Share of students who go idle after their first lab")
+	flags.DurationVar(&cfg.IdleTimeout, "idle-timeout", defaults.IdleTimeout, "Idle expiry of the cleanup worker (0 = fixed TTL)")
+	flags.DurationVar(&cfg.BootDelay, "boot-delay", defaults.BootDelay, "Time a fake server takes to boot")
+	flags.DurationVar(&cfg.DeleteDelay, "delete-delay", defaults.DeleteDelay, "Time a fake server takes to delete")
+	flags.DurationVar(&cfg.PollInterval, "poll-interval", defaults.PollInterval, "Provisioner poll interval")
+	flags.DurationVar(&cfg.CleanupInterval, "cleanup-interval", defaults.CleanupInterval, "Time between cleanup runs")
+	flags.DurationVar(&cfg.ReadyTimeout, "ready-timeout", defaults.ReadyTimeout, "Longest a student waits before counting a failure")
+	flags.Uint64Var(&cfg.Seed, "seed", defaults.Seed, "Seed of the students' random behavior")
+	flags.Parse(args)
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	level := slog.LevelError
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	var store loadtest.Store = redistest.New()
+	if *redisAddr != "" {
+		redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+		if err != nil {
+			return err
+		}
+		redisClient, err := redis.NewClient(redis.Config{
+			Address:  *redisAddr,
+			Password: redisPassword,
+			DB:       *redisDB,
+			Logger:   log,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to connect to redis: %w", err)
+		}
+		defer redisClient.Close()
+		store = redisClient
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "simulating %d students for %s...\n", cfg.Users, cfg.Duration)
+	report, err := loadtest.Run(ctx, log, cfg, store)
+	if report != nil {
+		printLoadtestReport(report)
+	}
+	return err
+}
+
+// printLoadtestReport writes the latency percentiles and failure counts as a table
+func printLoadtestReport(report *loadtest.Report) {
+	ops := []string{loadtest.OpProvision, loadtest.OpSwitch, loadtest.OpReconnect, loadtest.OpIdleExpiry, loadtest.OpDecommission, loadtest.OpActivity}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATION\tCOUNT\tFAILED\tP50\tP90\tP99\tMAX")
+	for _, op := range ops {
+		stats := report.Operations[op]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", op, stats.Count, report.Failures[op], stats.P50, stats.P90, stats.P99, stats.Max)
+	}
+	w.Flush()
+	fmt.Printf("\nelapsed %s, %d servers created, %d left over\n", report.Elapsed.Round(time.Second), report.ServersCreated, report.ServersLeft)
+}
@@ -1,29 +1,124 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/joho/godotenv"
 
+	"github.com/alex-sviridov/swim/internal/admin"
+	"github.com/alex-sviridov/swim/internal/archive"
+	"github.com/alex-sviridov/swim/internal/chaos"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
 	"github.com/alex-sviridov/swim/internal/connector/hcloud"
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/dns"
+	"github.com/alex-sviridov/swim/internal/hooks"
+	"github.com/alex-sviridov/swim/internal/ingest"
+	"github.com/alex-sviridov/swim/internal/inventory"
+	"github.com/alex-sviridov/swim/internal/loadtest"
 	"github.com/alex-sviridov/swim/internal/logger"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/queue"
+	"github.com/alex-sviridov/swim/internal/readiness"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/shard"
+	"github.com/alex-sviridov/swim/internal/signing"
+	"github.com/alex-sviridov/swim/internal/statecache"
+	"github.com/alex-sviridov/swim/internal/statushook"
+	"github.com/alex-sviridov/swim/internal/statusstream"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/warmup"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// provider is the cloud provider this build provisions on
+const provider = "hcloud"
+
+const (
+	adminReadHeaderTimeout = 10 * time.Second
+	vaultTimeout           = 10 * time.Second
 )
 
 func main() {
 	// Load .env file if it exists (ignore error if file doesn't exist)
 	_ = godotenv.Load()
 
+	// Every Redis key, queue and channel lives in the namespace, for subcommands too, so a
+	// staging namespace can share a Redis with production
+	if err := config.SetKeyNamespace(config.GetKeyNamespace()); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid REDIS_KEY_NAMESPACE:", err)
+		os.Exit(1)
+	}
+
+	// Subcommands run once and exit; everything else starts the service
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "export failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := runLoadtest(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "loadtest failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := runHistory(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "history failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-keys" {
+		if err := runMigrateKeys(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate-keys failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		if err := runStats(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "stats failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Define CLI flags
 	redisAddr := flag.String("redis", "", "Redis connection string (required)")
 	silent := flag.Bool("silent", false, "Suppress verbose logging (info level)")
 	dryrun := flag.Bool("dry-run", false, "Dry-run without creating a real instance")
+	rehearsal := flag.Bool("rehearsal", false, "Rehearse against Redis with a simulated provider, in the REDIS_KEY_NAMESPACE namespace")
+	chaosMode := flag.Bool("chaos", false, "Inject failures configured by CHAOS_* variables (development only)")
+	listInstances := flag.Bool("list-instances", false, "Print the SWIM instances with a live heartbeat and exit")
 	flag.Parse()
 
 	// Initialize logger
 	log := logger.New(!*silent)
 
+	// A rehearsal writes to Redis like production does, so it must not share production's keys
+	if *rehearsal && config.KeyNamespace() == config.DefaultKeyNamespace {
+		log.Error("--rehearsal requires REDIS_KEY_NAMESPACE other than the default", "default", config.DefaultKeyNamespace)
+		os.Exit(1)
+	}
+
 	// Validate redis address
 	if *redisAddr == "" {
 		*redisAddr = os.Getenv("REDIS_CONNECTION_STRING")
@@ -33,27 +128,882 @@ func main() {
 		}
 	}
 
-	// Create Hetzner Cloud connector
-	conn, err := hcloud.NewConnector(log, *dryrun)
+	if *listInstances {
+		if err := printInstances(*redisAddr); err != nil {
+			log.Error("failed to list instances", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Create Redis client
+	// Secrets can come from files and Vault instead of the environment
+	vault, err := vaultClientFromEnv()
 	if err != nil {
-		log.Error("connecting to hetzner cloud", "error", err)
+		log.Error("invalid vault configuration", "error", err)
+		os.Exit(1)
+	}
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		log.Error("failed to read redis password", "error", err)
 		os.Exit(1)
 	}
 
-	// Create Redis client
 	redisClient, err := redis.NewClient(redis.Config{
 		Address:  *redisAddr,
-		Password: os.Getenv("REDIS_PASSWORD"),
+		Password: redisPassword,
 		DB:       0,
+		Logger:   log,
 	})
 	if err != nil {
 		log.Error("failed to connect to redis", "error", err)
 		os.Exit(1)
 	}
 	defer redisClient.Close()
+	redisClient.WithCallHook(redis.RecordCallMetrics)
+
+	// Optional encryption of the sensitive fields of cached server states
+	cacheCipher, err := cacheCipherFromEnv()
+	if err != nil {
+		log.Error("invalid cache encryption configuration", "error", err)
+		os.Exit(1)
+	}
+	if cacheCipher != nil {
+		redisClient.WithEncryption(cacheCipher)
+		log.Info("cache field encryption enabled")
+	}
+
+	// The remaining time derived for LabMan follows the expiry the cleanup worker applies
+	redisClient.WithExpiryPolicy(expiryPolicyFromEnv())
+
+	// Read the whole cache once, so the indexes are complete and operators see the platform's
+	// state right after a restart
+	primed, err := redisClient.PrimeServerCache(context.Background(), time.Now())
+	if err != nil {
+		log.Error("failed to prime server cache", "error", err)
+		os.Exit(1)
+	}
+	log.Info("cache primed",
+		"entries", len(primed.States),
+		"running", primed.Count(config.StatusRunning),
+		"provisioning", primed.Count(config.StatusQueued, config.StatusProvisioning),
+		"stopping", primed.Count(config.StatusStopping, config.StatusDeleting),
+		"failed", primed.Count(config.StatusFailed),
+		"expired_pending_cleanup", primed.Expired,
+		"stale_index_entries", primed.Pruned,
+		"scanned", primed.Scanned)
+
+	// Optional tenants, each with its own quota, rate limits, lab catalog and provider account
+	tenants, err := tenant.Load(os.Getenv("TENANT_REGISTRY_FILE"))
+	if err != nil {
+		log.Error("invalid tenant registry", "error", err)
+		os.Exit(1)
+	}
+
+	id := instanceID()
+	var conn connector.Connector
+	var labNodes func(labID int) ([]string, error)
+	var checks *readiness.Checks
+	var journal connector.CreateJournal
+	if *rehearsal {
+		// Rehearsals create nothing at the provider and need no token; every state written is marked dryRun
+		conn = loadtest.NewRehearsalConnector()
+		redisClient.WithDryRun()
+		log.Warn("REHEARSAL MODE - servers are simulated, every state is marked dryRun", "namespace", config.KeyNamespace())
+	} else {
+		// Server defaults are read once; the lab catalog overrides them per request
+		hcloudConfig, err := hcloud.GetHCloudConfigFromEnv()
+		if err != nil {
+			log.Error("invalid hetzner cloud configuration", "error", err)
+			os.Exit(1)
+		}
+
+		// Create Hetzner Cloud connector; tokens from files or Redis are reloaded until exit
+		tokenCtx, stopTokens := context.WithCancel(context.Background())
+		defer stopTokens()
+		hcloudConn, err := newHCloudConnector(tokenCtx, log, hcloudTokenSource(redisClient, vault), *dryrun)
+		if err != nil {
+			log.Error("connecting to hetzner cloud", "error", err)
+			os.Exit(1)
+		}
+		hcloudConn.WithConfig(hcloudConfig)
+
+		// Optional lab catalog synced from a URL, e.g. a file in the curriculum's Git repository
+		labs, err := labCatalogSyncFromEnv(tokenCtx, log)
+		if err != nil {
+			log.Error("invalid lab catalog source", "error", err)
+			os.Exit(1)
+		}
+		if labs != nil {
+			hcloudConn.WithLabCatalog(labs)
+			log.Info("lab catalog synced", "url", os.Getenv("HCLOUD_LAB_CATALOG_URL"), "labs", len(labs.Catalog()))
+		}
+		if !*dryrun {
+			validateHCloudConfig(tokenCtx, log, hcloudConn)
+		}
+
+		// Journal every server name before it is created, so half-created servers can be found later
+		journal = createJournal{client: redisClient, instanceID: id}
+		conn = hcloudConn.WithCreateJournal(journal)
+		labNodes = hcloudConn.LabNodes
+		checks = readiness.NewChecks(hcloudConn.LabReadiness, redisClient)
+		if conn, err = withTenantAccounts(tokenCtx, log, conn, tenants, redisClient, vault, journal, hcloudConfig, labs, *dryrun); err != nil {
+			log.Error("invalid tenant registry", "error", err)
+			os.Exit(1)
+		}
+	}
+	if tenants != nil {
+		log.Info("tenant registry loaded", "tenants", len(tenants.All()))
+	}
 
 	log.Info("connected to redis, starting service")
 
+	var client redis.ClientInterface = redisClient
+
+	// Optional in-memory server states, written to Redis in batches
+	if flushInterval := config.GetStateCacheFlushInterval(); flushInterval > 0 {
+		stateCache := statecache.Wrap(log, redisClient, statecache.Config{
+			FlushInterval: flushInterval,
+			MaxAge:        config.GetStateCacheMaxAge(),
+		})
+		cacheCtx, stopCache := context.WithCancel(context.Background())
+		cacheDone := make(chan struct{})
+		go func() {
+			stateCache.Run(cacheCtx)
+			close(cacheDone)
+		}()
+		// Runs before the Redis client is closed, so pending writes are flushed first
+		defer func() {
+			stopCache()
+			<-cacheDone
+		}()
+		client = stateCache
+		log.Info("in-memory state cache enabled", "flush_interval", flushInterval, "max_age", config.GetStateCacheMaxAge())
+	}
+
+	// Queues can come from NATS or Kafka; the server state cache always stays in Redis
+	queueBackend, err := queue.New(context.Background(), queueConfigFromEnv())
+	if err != nil {
+		log.Error("failed to connect to queue backend", "error", err)
+		os.Exit(1)
+	}
+	if queueBackend != nil {
+		defer queueBackend.Close()
+		client = queue.WithBackend(client, queueBackend)
+		log.Info("using external queue backend", "backend", os.Getenv("QUEUE_BACKEND"))
+	}
+
+	// Optional HMAC signatures on queue payloads; rejected messages go to the dead-letter queues
+	signer, err := signerFromEnv()
+	if err != nil {
+		log.Error("invalid payload signing configuration", "error", err)
+		os.Exit(1)
+	}
+	signedPayloads := false
+	if signer != nil {
+		signed := signing.Wrap(log, client, signer).WithEvents(redisClient)
+		allowUnsigned, _ := strconv.ParseBool(os.Getenv("PAYLOAD_SIGNING_ALLOW_UNSIGNED"))
+		if allowUnsigned {
+			signed.AllowUnsigned()
+		}
+		signedPayloads = !allowUnsigned
+		client = signed
+		log.Info("payload signing enabled", "allow_unsigned", allowUnsigned)
+	}
+
+	// Optional push of every state change to LabMan, signed like the queue payloads
+	statusHook, err := statusHookFromEnv(log)
+	if err != nil {
+		log.Error("invalid status webhook configuration", "error", err)
+		os.Exit(1)
+	}
+	if statusHook != nil {
+		hookCtx, stopHook := context.WithCancel(context.Background())
+		defer stopHook()
+		go statusHook.Run(hookCtx)
+		client = statushook.Wrap(client, statusHook)
+		log.Info("status webhook enabled", "url", os.Getenv("STATUS_WEBHOOK_URL"))
+	}
+
+	// Announce every state change on the status channel, for the status streams of all instances
+	statusPublisher := statusstream.NewPublisher(log, redisClient)
+	publishCtx, stopPublisher := context.WithCancel(context.Background())
+	defer stopPublisher()
+	go statusPublisher.Run(publishCtx)
+	client = statushook.Wrap(client, statusPublisher)
+
+	// Optional user sharding: this replica only consumes the queues of its shards.
+	// Wraps the signing client, so payloads are routed by their unsigned content.
+	shards, err := shardsFromEnv()
+	if err != nil {
+		log.Error("invalid sharding configuration", "error", err)
+		os.Exit(1)
+	}
+	if shards != nil {
+		client = shard.Wrap(client, shards)
+		log.Info("user sharding enabled", "shards", shards.String())
+	}
+
+	// Chaos mode wraps the connector and the client last so every failure path is exercised
+	if *chaosMode {
+		chaosConfig, err := chaos.ConfigFromEnv()
+		if err != nil {
+			log.Error("invalid chaos configuration", "error", err)
+			os.Exit(1)
+		}
+		log.Warn("CHAOS MODE ENABLED - failures are injected on purpose, never run this in production",
+			"create_error_rate", chaosConfig.CreateErrorRate,
+			"state_delay", chaosConfig.StateDelay,
+			"redis_timeout_rate", chaosConfig.RedisTimeoutRate,
+			"delete_drop_rate", chaosConfig.DeleteDropRate)
+		injector := chaos.NewInjector(chaosConfig)
+		conn = chaos.WrapConnector(conn, injector)
+		client = chaos.WrapClient(client, injector)
+	}
+
 	// Run the queue processor
-	runQueueProcessor(log, conn, redisClient)
+	instance := redis.InstanceInfo{
+		ID:       id,
+		Version:  version,
+		Provider: provider,
+	}
+	log.Info("instance identity", "instance_id", instance.ID, "version", instance.Version)
+	// Optional stable hostnames for lab servers
+	registrar, err := dns.New(dnsConfigFromEnv())
+	if err != nil {
+		log.Error("invalid dns configuration", "error", err)
+		os.Exit(1)
+	}
+	if registrar != nil {
+		log.Info("dns registration enabled", "provider", os.Getenv("DNS_PROVIDER"), "zone", os.Getenv("DNS_ZONE"))
+	}
+
+	// Optional lifecycle hooks for grading systems and monitoring
+	hookRunner := hooks.New(hooksConfigFromEnv())
+	if hookRunner != nil {
+		log.Info("lifecycle hooks enabled", "webhook", os.Getenv("HOOK_WEBHOOK_URL") != "", "command", os.Getenv("HOOK_COMMAND"))
+	}
+
+	// Optional registration of every server in an external inventory such as a CMDB
+	inventoryConfig, err := inventoryConfigFromEnv()
+	if err != nil {
+		log.Error("invalid inventory configuration", "error", err)
+		os.Exit(1)
+	}
+	inventoryHook, err := inventory.New(log, inventoryConfig)
+	if err != nil {
+		log.Error("invalid inventory configuration", "error", err)
+		os.Exit(1)
+	}
+	if inventoryHook != nil {
+		inventoryCtx, stopInventory := context.WithCancel(context.Background())
+		defer stopInventory()
+		go inventoryHook.Run(inventoryCtx)
+		log.Info("inventory registration enabled", "register_url", os.Getenv("INVENTORY_REGISTER_URL"))
+	}
+
+	// Optional per-lab warm-up commands run over SSH before a server is available
+	warmupConfig, err := warmupConfigFromEnv(context.Background(), vault)
+	if err != nil {
+		log.Error("invalid warm-up configuration", "error", err)
+		os.Exit(1)
+	}
+	warmUp, err := warmup.New(warmupConfig)
+	if err != nil {
+		log.Error("invalid warm-up configuration", "error", err)
+		os.Exit(1)
+	}
+	if warmUp != nil {
+		log.Info("lab warm-up enabled", "catalog", os.Getenv("WARMUP_CATALOG_FILE"))
+	}
+
+	// Optional operator notifications about failures and queue backlogs
+	notifyConfig, err := notifyConfigFromEnv()
+	if err != nil {
+		log.Error("invalid notification configuration", "error", err)
+		os.Exit(1)
+	}
+	notifier, err := notify.New(notifyConfig)
+	if err != nil {
+		log.Error("invalid notification configuration", "error", err)
+		os.Exit(1)
+	}
+	if notifier != nil {
+		log.Info("operator notifications enabled",
+			"slack", notifyConfig.SlackWebhookURL != "",
+			"webhook", notifyConfig.WebhookURL != "",
+			"email", notifyConfig.SMTPAddr != "")
+	}
+
+	// Optional read-only admin API and status dashboard
+	if addr := os.Getenv("ADMIN_LISTEN_ADDR"); addr != "" {
+		// Streams read states through the client, so they see the writes not yet flushed by
+		// the state cache of this instance
+		broker := statusstream.NewBroker(log, redisClient, client)
+		brokerCtx, stopBroker := context.WithCancel(context.Background())
+		defer stopBroker()
+		go broker.Run(brokerCtx)
+
+		adminServer := &http.Server{
+			Addr:              addr,
+			Handler:           admin.New(log, redisClient, os.Getenv("ADMIN_TOKEN")).WithConsole(conn).WithHealth(redisClient).WithStatusStream(broker).Handler(),
+			ReadHeaderTimeout: adminReadHeaderTimeout,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("admin server failed", "error", err)
+			}
+		}()
+		defer adminServer.Close()
+		log.Info("admin server listening", "addr", addr)
+	}
+
+	// Optional HTTP API queueing requests for producers without access to Redis
+	ingestAPI, err := ingestFromEnv(log, client, tenants)
+	if err != nil {
+		log.Error("invalid ingestion API configuration", "error", err)
+		os.Exit(1)
+	}
+	if ingestAPI != nil {
+		addr := os.Getenv("INGEST_LISTEN_ADDR")
+		ingestServer := &http.Server{
+			Addr:              addr,
+			Handler:           ingestAPI.Handler(),
+			ReadHeaderTimeout: adminReadHeaderTimeout,
+		}
+		go func() {
+			if err := ingestServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("ingestion API failed", "error", err)
+			}
+		}()
+		defer ingestServer.Close()
+		log.Info("ingestion API listening", "addr", addr)
+	}
+
+	// Optional admin overrides that let instructor tooling skip rate limits and quotas
+	overrides, err := overridesFromEnv()
+	if err != nil {
+		log.Error("invalid admin override configuration", "error", err)
+		os.Exit(1)
+	}
+	if overrides != nil {
+		// Without an override secret only signed payloads vouch for the actor they name
+		if signedPayloads {
+			overrides.WithSignedPayloads()
+		}
+		log.Info("admin overrides enabled", "signed_payloads", signedPayloads)
+	}
+
+	// Optional archive of completed sessions, for course analytics
+	sessions, sessionFile, err := sessionArchiveFromEnv(redisClient)
+	if err != nil {
+		log.Error("invalid session archive configuration", "error", err)
+		os.Exit(1)
+	}
+	if sessionFile != nil {
+		defer sessionFile.Close()
+	}
+	if sessions != nil {
+		stream, _ := strconv.ParseBool(os.Getenv("SESSION_ARCHIVE_STREAM"))
+		log.Info("session archive enabled", "stream", stream, "file", os.Getenv("SESSION_ARCHIVE_FILE"))
+	}
+
+	// Simulated servers can't be reached, so they get no hostname, warm-up, hooks or inventory record
+	if *rehearsal {
+		registrar, hookRunner, inventoryHook, warmUp = nil, nil, nil, nil
+	}
+
+	runQueueProcessor(log, conn, client, redisClient, instance, registrar, hookRunner, inventoryHook, warmUp, notifier, tenants, overrides, labNodes, checks, journal, primed.States, sessions)
+}
+
+// printInstances writes the live SWIM instances to stdout
+func printInstances(redisAddr string) error {
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		return err
+	}
+	redisClient, err := redis.NewClient(redis.Config{
+		Address:  redisAddr,
+		Password: redisPassword,
+		DB:       0,
+	})
+	if err != nil {
+		return err
+	}
+	defer redisClient.Close()
+
+	instances, err := redisClient.ListInstances(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tVERSION\tPROVIDER\tSTARTED\tLAST HEARTBEAT")
+	for _, info := range instances {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, info.Status, info.Version, info.Provider,
+			info.StartedAt.Format(time.RFC3339), info.UpdatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// instanceID identifies this SWIM replica in heartbeats and handoff entries.
+// Reads SWIM_INSTANCE_ID, defaults to hostname-pid.
+func instanceID() string {
+	if id := os.Getenv("SWIM_INSTANCE_ID"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "swim"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// createJournal keeps the pending-create journal in Redis, tagged with this instance's ID
+type createJournal struct {
+	client     *redis.Client
+	instanceID string
+}
+
+// RecordPendingCreate implements connector.CreateJournal
+func (j createJournal) RecordPendingCreate(name, tenant, webUserID string, labID int, correlationID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), journalTimeout)
+	defer cancel()
+
+	return j.client.RecordPendingCreate(ctx, redis.PendingCreate{
+		Name:          name,
+		WebUserID:     webUserID,
+		LabID:         labID,
+		Tenant:        tenant,
+		CorrelationID: correlationID,
+		InstanceID:    j.instanceID,
+		CreatedAt:     time.Now().UTC(),
+	})
+}
+
+// ClearPendingCreate implements connector.CreateJournal
+func (j createJournal) ClearPendingCreate(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), journalTimeout)
+	defer cancel()
+
+	return j.client.ClearPendingCreate(ctx, name)
+}
+
+// queueConfigFromEnv reads the queue backend settings from the environment
+func queueConfigFromEnv() queue.Config {
+	cfg := queue.Config{
+		Backend:      os.Getenv("QUEUE_BACKEND"),
+		NATSURL:      os.Getenv("NATS_URL"),
+		NATSStream:   os.Getenv("NATS_STREAM"),
+		KafkaGroupID: os.Getenv("KAFKA_GROUP_ID"),
+	}
+	if brokers := os.Getenv("KAFKA_BROKERS"); brokers != "" {
+		cfg.KafkaBrokers = strings.Split(brokers, ",")
+	}
+	if cfg.NATSStream == "" {
+		cfg.NATSStream = "VMMANAGER"
+	}
+	if cfg.KafkaGroupID == "" {
+		cfg.KafkaGroupID = "swim"
+	}
+	return cfg
+}
+
+// dnsConfigFromEnv reads the DNS registration settings from the environment
+func dnsConfigFromEnv() dns.Config {
+	cfg := dns.Config{
+		Provider: os.Getenv("DNS_PROVIDER"),
+		Zone:     os.Getenv("DNS_ZONE"),
+		ZoneID:   os.Getenv("DNS_ZONE_ID"),
+		APIToken: os.Getenv("DNS_API_TOKEN"),
+	}
+	if ttl, err := strconv.Atoi(os.Getenv("DNS_RECORD_TTL")); err == nil {
+		cfg.TTL = ttl
+	}
+	return cfg
+}
+
+// hooksConfigFromEnv reads the lifecycle hook settings from the environment
+func hooksConfigFromEnv() hooks.Config {
+	cfg := hooks.Config{
+		WebhookURL: os.Getenv("HOOK_WEBHOOK_URL"),
+		Command:    os.Getenv("HOOK_COMMAND"),
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("HOOK_TIMEOUT_SECONDS")); err == nil {
+		cfg.Timeout = time.Duration(seconds) * time.Second
+	}
+	return cfg
+}
+
+// inventoryConfigFromEnv reads the inventory settings from the environment. The body
+// templates can be given inline or, being long, in a file named by the _FILE variable.
+func inventoryConfigFromEnv() (inventory.Config, error) {
+	cfg := inventory.Config{
+		Register: inventory.Call{
+			Method: os.Getenv("INVENTORY_REGISTER_METHOD"),
+			URL:    os.Getenv("INVENTORY_REGISTER_URL"),
+		},
+		Deregister: inventory.Call{
+			Method: os.Getenv("INVENTORY_DEREGISTER_METHOD"),
+			URL:    os.Getenv("INVENTORY_DEREGISTER_URL"),
+		},
+		ContentType: os.Getenv("INVENTORY_CONTENT_TYPE"),
+	}
+	var err error
+	if cfg.Register.Body, err = credentials.FromEnv("INVENTORY_REGISTER_BODY"); err != nil {
+		return inventory.Config{}, err
+	}
+	if cfg.Deregister.Body, err = credentials.FromEnv("INVENTORY_DEREGISTER_BODY"); err != nil {
+		return inventory.Config{}, err
+	}
+	if cfg.Token, err = credentials.FromEnv("INVENTORY_API_TOKEN"); err != nil {
+		return inventory.Config{}, err
+	}
+	return cfg, nil
+}
+
+// warmupConfigFromEnv reads the lab warm-up settings from the environment, fetching the
+// SSH key from Vault if WARMUP_SSH_KEY_VAULT is set
+func warmupConfigFromEnv(ctx context.Context, vault *credentials.VaultClient) (warmup.Config, error) {
+	cfg := warmup.Config{
+		CatalogFile: os.Getenv("WARMUP_CATALOG_FILE"),
+		KeyFile:     os.Getenv("WARMUP_SSH_KEY_FILE"),
+		User:        os.Getenv("WARMUP_SSH_USER"),
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("WARMUP_TIMEOUT_SECONDS")); err == nil {
+		cfg.Timeout = time.Duration(seconds) * time.Second
+	}
+	if ref := os.Getenv("WARMUP_SSH_KEY_VAULT"); ref != "" && cfg.CatalogFile != "" {
+		key, err := vault.Secret(ctx, ref)
+		if err != nil {
+			return cfg, fmt.Errorf("fetch warm-up SSH key: %w", err)
+		}
+		cfg.Key = []byte(key)
+	}
+	return cfg, nil
+}
+
+// expiryPolicyFromEnv returns the idle timeout and maximum lifetime servers expire by. The
+// maximum lifetime only bounds servers with idle expiry or TTL refresh; otherwise it is 0.
+func expiryPolicyFromEnv() (time.Duration, time.Duration) {
+	idleTimeout := config.GetIdleTimeout()
+	if idleTimeout <= 0 && config.GetTTLRefreshExtension() <= 0 {
+		return idleTimeout, 0
+	}
+	return idleTimeout, config.GetMaxLifetime()
+}
+
+// cacheCipherFromEnv creates the cipher for CACHE_ENCRYPTION_KEY (or CACHE_ENCRYPTION_KEY_FILE)
+// and CACHE_ENCRYPTED_FIELDS. Returns nil if no key is set.
+func cacheCipherFromEnv() (*redis.FieldCipher, error) {
+	encoded, err := credentials.FromEnv("CACHE_ENCRYPTION_KEY")
+	if err != nil || encoded == "" {
+		return nil, err
+	}
+	key, err := redis.ParseEncryptionKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for _, field := range strings.Split(os.Getenv("CACHE_ENCRYPTED_FIELDS"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return redis.NewFieldCipher(key, fields)
+}
+
+// signerFromEnv creates the payload signer for PAYLOAD_SIGNING_SECRET (or PAYLOAD_SIGNING_SECRET_FILE).
+// Returns nil if no secret is set.
+func signerFromEnv() (*signing.Signer, error) {
+	secret, err := credentials.FromEnv("PAYLOAD_SIGNING_SECRET")
+	if err != nil || secret == "" {
+		return nil, err
+	}
+	var maxAge time.Duration
+	if seconds := os.Getenv("PAYLOAD_SIGNATURE_MAX_AGE_SECONDS"); seconds != "" {
+		value, err := strconv.Atoi(seconds)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid PAYLOAD_SIGNATURE_MAX_AGE_SECONDS %q", seconds)
+		}
+		maxAge = time.Duration(value) * time.Second
+	}
+	return signing.NewSigner([]byte(secret), maxAge), nil
+}
+
+// overridesFromEnv creates the admin override verifier for ADMIN_OVERRIDE_SECRET (or
+// ADMIN_OVERRIDE_SECRET_FILE) and ADMIN_OVERRIDE_ACTORS. Returns nil if neither is set.
+func overridesFromEnv() (*override.Verifier, error) {
+	secret, err := credentials.FromEnv("ADMIN_OVERRIDE_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	var actors []string
+	for _, actor := range strings.Split(os.Getenv("ADMIN_OVERRIDE_ACTORS"), ",") {
+		if actor = strings.TrimSpace(actor); actor != "" {
+			actors = append(actors, actor)
+		}
+	}
+	if secret == "" && len(actors) == 0 {
+		return nil, nil
+	}
+	maxAge := 5 * time.Minute
+	if seconds := os.Getenv("ADMIN_OVERRIDE_MAX_AGE_SECONDS"); seconds != "" {
+		value, err := strconv.Atoi(seconds)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid ADMIN_OVERRIDE_MAX_AGE_SECONDS %q", seconds)
+		}
+		maxAge = time.Duration(value) * time.Second
+	}
+	return override.NewVerifier([]byte(secret), actors, maxAge), nil
+}
+
+// statusHookFromEnv creates the status webhook for STATUS_WEBHOOK_URL, signed with
+// STATUS_WEBHOOK_SECRET (or STATUS_WEBHOOK_SECRET_FILE). Returns nil if no URL is set.
+func statusHookFromEnv(log *slog.Logger) (*statushook.Hook, error) {
+	url := os.Getenv("STATUS_WEBHOOK_URL")
+	if url == "" {
+		return nil, nil
+	}
+	secret, err := credentials.FromEnv("STATUS_WEBHOOK_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("STATUS_WEBHOOK_URL is set but STATUS_WEBHOOK_SECRET is empty")
+	}
+	return statushook.New(log, url, signing.NewSigner([]byte(secret), 0)), nil
+}
+
+// ingestFromEnv creates the ingestion API for INGEST_LISTEN_ADDR, accepting the clients in
+// INGEST_CLIENTS (or INGEST_CLIENTS_FILE). Returns nil if no address is set.
+func ingestFromEnv(log *slog.Logger, queue ingest.Queue, tenants *tenant.Registry) (*ingest.Server, error) {
+	if os.Getenv("INGEST_LISTEN_ADDR") == "" {
+		return nil, nil
+	}
+	value, err := credentials.FromEnv("INGEST_CLIENTS")
+	if err != nil {
+		return nil, err
+	}
+	clients, err := ingest.ParseClients(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INGEST_CLIENTS: %w", err)
+	}
+	server := ingest.New(log, queue, clients).WithTenants(tenants)
+	rate, burst := float64(ingest.DefaultRate), ingest.DefaultBurst
+	if value := os.Getenv("INGEST_RATE_LIMIT"); value != "" {
+		if rate, err = strconv.ParseFloat(value, 64); err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid INGEST_RATE_LIMIT %q", value)
+		}
+	}
+	if value := os.Getenv("INGEST_BURST"); value != "" {
+		if burst, err = strconv.Atoi(value); err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid INGEST_BURST %q", value)
+		}
+	}
+	return server.WithRateLimit(rate, burst), nil
+}
+
+// sessionArchiveFromEnv builds the session archive: the vmmanager:sessions stream with
+// SESSION_ARCHIVE_STREAM, and the file SESSION_ARCHIVE_FILE. Returns nil if neither is set;
+// the file, if any, must be closed.
+func sessionArchiveFromEnv(stream redis.SessionStream) (archive.Archiver, *archive.File, error) {
+	var archivers archive.Multi
+	if enabled, _ := strconv.ParseBool(os.Getenv("SESSION_ARCHIVE_STREAM")); enabled {
+		maxLen := int64(archive.DefaultStreamMaxLen)
+		if value := os.Getenv("SESSION_ARCHIVE_STREAM_MAXLEN"); value != "" {
+			var err error
+			if maxLen, err = strconv.ParseInt(value, 10, 64); err != nil || maxLen < 0 {
+				return nil, nil, fmt.Errorf("invalid SESSION_ARCHIVE_STREAM_MAXLEN %q", value)
+			}
+		}
+		archivers = append(archivers, archive.NewStream(stream, maxLen))
+	}
+
+	var file *archive.File
+	if path := os.Getenv("SESSION_ARCHIVE_FILE"); path != "" {
+		maxSize, maxFiles := int64(archive.DefaultFileMaxSize), archive.DefaultFileMaxFiles
+		if value := os.Getenv("SESSION_ARCHIVE_FILE_MAX_MB"); value != "" {
+			megabytes, err := strconv.Atoi(value)
+			if err != nil || megabytes < 1 {
+				return nil, nil, fmt.Errorf("invalid SESSION_ARCHIVE_FILE_MAX_MB %q", value)
+			}
+			maxSize = int64(megabytes) << 20
+		}
+		if value := os.Getenv("SESSION_ARCHIVE_FILE_MAX_FILES"); value != "" {
+			var err error
+			if maxFiles, err = strconv.Atoi(value); err != nil || maxFiles < 0 {
+				return nil, nil, fmt.Errorf("invalid SESSION_ARCHIVE_FILE_MAX_FILES %q", value)
+			}
+		}
+		var err error
+		if file, err = archive.OpenFile(path, maxSize, maxFiles); err != nil {
+			return nil, nil, err
+		}
+		archivers = append(archivers, file)
+	}
+
+	switch len(archivers) {
+	case 0:
+		return nil, nil, nil
+	case 1:
+		return archivers[0], file, nil
+	}
+	return archivers, file, nil
+}
+
+// shardsFromEnv reads the shards this replica owns from SHARDS out of SHARD_COUNT.
+// Returns nil if SHARD_COUNT is not set.
+func shardsFromEnv() (*shard.Set, error) {
+	value := os.Getenv("SHARD_COUNT")
+	if value == "" {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHARD_COUNT %q", value)
+	}
+	shards, err := shard.Parse(count, os.Getenv("SHARDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHARDS: %w", err)
+	}
+	return shards, nil
+}
+
+// vaultClientFromEnv creates the Vault client for VAULT_ADDR, authenticated with VAULT_TOKEN
+// (or VAULT_TOKEN_FILE). Returns nil if VAULT_ADDR is not set.
+func vaultClientFromEnv() (*credentials.VaultClient, error) {
+	token, err := credentials.FromEnv("VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr != "" && token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is set but VAULT_TOKEN is empty")
+	}
+	return credentials.NewVaultClient(addr, token, os.Getenv("VAULT_NAMESPACE"), &http.Client{Timeout: vaultTimeout}), nil
+}
+
+// notifyConfigFromEnv reads the operator notification settings from the environment
+func notifyConfigFromEnv() (notify.Config, error) {
+	cfg := notify.Config{
+		SlackWebhookURL: os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"),
+		WebhookURL:      os.Getenv("NOTIFY_WEBHOOK_URL"),
+		SMTPAddr:        os.Getenv("NOTIFY_SMTP_ADDR"),
+		SMTPUsername:    os.Getenv("NOTIFY_SMTP_USERNAME"),
+		SMTPPassword:    os.Getenv("NOTIFY_SMTP_PASSWORD"),
+		EmailFrom:       os.Getenv("NOTIFY_EMAIL_FROM"),
+	}
+	for _, to := range strings.Split(os.Getenv("NOTIFY_EMAIL_TO"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			cfg.EmailTo = append(cfg.EmailTo, to)
+		}
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("NOTIFY_RATE_LIMIT_SECONDS")); err == nil {
+		cfg.RateLimit = time.Duration(seconds) * time.Second
+	}
+
+	routes, err := notify.ParseRoutes(os.Getenv("NOTIFY_EVENTS"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Routes = routes
+	return cfg, nil
+}
+
+// hcloudTokenSource returns where the global Hetzner token is read from: HCLOUD_TOKEN_FILE,
+// HCLOUD_TOKEN_VAULT, HCLOUD_TOKEN_REDIS_KEY or HCLOUD_TOKEN, in that order
+func hcloudTokenSource(secrets credentials.SecretReader, vault *credentials.VaultClient) credentials.Source {
+	if path := os.Getenv("HCLOUD_TOKEN_FILE"); path != "" {
+		return credentials.File(path)
+	}
+	if ref := os.Getenv("HCLOUD_TOKEN_VAULT"); ref != "" {
+		return credentials.Vault(vault, ref)
+	}
+	if key := os.Getenv("HCLOUD_TOKEN_REDIS_KEY"); key != "" {
+		return credentials.RedisKey(secrets, key)
+	}
+	return credentials.Env("HCLOUD_TOKEN")
+}
+
+// newHCloudConnector creates a connector for the token from source. The token is reloaded
+// every HCLOUD_TOKEN_REFRESH_SECONDS until ctx is cancelled, and whenever the API rejects it.
+func newHCloudConnector(ctx context.Context, log *slog.Logger, source credentials.Source, dryrun bool) (*hcloud.Connector, error) {
+	token, err := credentials.NewToken(ctx, log, source)
+	if err != nil {
+		return nil, err
+	}
+	go token.Run(ctx, config.GetTokenRefreshInterval())
+	return hcloud.NewConnectorWithTokens(log, token, dryrun), nil
+}
+
+// labCatalogSyncFromEnv fetches the lab catalog at HCLOUD_LAB_CATALOG_URL and again every
+// HCLOUD_LAB_CATALOG_SYNC_SECONDS until ctx is cancelled. Returns nil if no URL is set.
+func labCatalogSyncFromEnv(ctx context.Context, log *slog.Logger) (*hcloud.LabCatalogSync, error) {
+	url := os.Getenv("HCLOUD_LAB_CATALOG_URL")
+	if url == "" {
+		return nil, nil
+	}
+	if os.Getenv("HCLOUD_LAB_CATALOG_FILE") != "" {
+		return nil, fmt.Errorf("HCLOUD_LAB_CATALOG_URL and HCLOUD_LAB_CATALOG_FILE are mutually exclusive")
+	}
+	token, err := credentials.FromEnv("HCLOUD_LAB_CATALOG_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	labs, err := hcloud.NewLabCatalogSync(ctx, log, url, token)
+	if err != nil {
+		return nil, err
+	}
+	go labs.Run(ctx, config.GetLabCatalogSyncInterval())
+	return labs, nil
+}
+
+// validateHCloudConfig exits with a report if the configured server types, locations or images
+// don't exist or don't fit together. An unreachable API is only logged, so an outage doesn't
+// keep the service from starting.
+func validateHCloudConfig(ctx context.Context, log *slog.Logger, conn *hcloud.Connector) {
+	problems, err := conn.Validate(ctx)
+	if err != nil {
+		log.Warn("could not validate hetzner cloud configuration, continuing", "error", err)
+		return
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Error("invalid hetzner cloud configuration", "problem", problem)
+		}
+		log.Error("hetzner cloud configuration has problems, exiting", "count", len(problems))
+		os.Exit(1)
+	}
+	log.Info("hetzner cloud configuration validated")
+}
+
+// withTenantAccounts routes provider calls of tenants with their own Hetzner token to
+// a connector for that account, creating servers with cfg. Returns conn unchanged if no
+// tenant has its own token.
+func withTenantAccounts(ctx context.Context, log *slog.Logger, conn connector.Connector, tenants *tenant.Registry, secrets credentials.SecretReader, vault *credentials.VaultClient, journal connector.CreateJournal, cfg *hcloud.HCloudConfig, labs *hcloud.LabCatalogSync, dryrun bool) (connector.Connector, error) {
+	byTenant := make(map[string]connector.Connector)
+	for _, t := range tenants.All() {
+		source := t.HCloudTokenSource(secrets, vault)
+		if source == nil {
+			continue
+		}
+		tenantLog := log.With("tenant", t.ID)
+		tenantConn, err := newHCloudConnector(ctx, tenantLog, source, dryrun)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+		tenantConn = tenantConn.WithConfig(cfg)
+		if journal != nil {
+			tenantConn = tenantConn.WithCreateJournal(journal)
+		}
+		if labs != nil {
+			tenantConn = tenantConn.WithLabCatalog(labs)
+		}
+		byTenant[t.ID] = tenantConn
+	}
+	if len(byTenant) == 0 {
+		return conn, nil
+	}
+	return tenant.NewConnector(conn, byTenant), nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// runMigrateKeys implements `swim migrate-keys`: it moves the cache entries, queues and
+// indexes of an install from one key namespace to another
+func runMigrateKeys(args []string) error {
+	flags := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+	redisAddr := flags.String("redis", "", "Redis connection string (default: REDIS_CONNECTION_STRING)")
+	from := flags.String("from", config.KeyNamespace(), "Namespace to move the keys from, e.g. vmmanager or vmmanager:")
+	to := flags.String("to", "", "Namespace to move the keys to, e.g. labs-prod or labs-prod: (required)")
+	keep := flags.Bool("copy", false, "Copy the keys and keep the originals, for a rollback, instead of renaming them")
+	dryRun := flags.Bool("dry-run", false, "Only count the keys that would be moved")
+	force := flags.Bool("force", false, "Migrate even while SWIM instances in the source namespace have a live heartbeat")
+	flags.Parse(args)
+
+	source := strings.TrimSuffix(*from, ":")
+	target := strings.TrimSuffix(*to, ":")
+	if target == "" {
+		return fmt.Errorf("--to is required")
+	}
+	if err := config.ValidateKeyNamespace(source); err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	if err := config.ValidateKeyNamespace(target); err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	if *redisAddr == "" {
+		*redisAddr = os.Getenv("REDIS_CONNECTION_STRING")
+		if *redisAddr == "" {
+			return fmt.Errorf("--redis flag or REDIS_CONNECTION_STRING environment variable is required")
+		}
+	}
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		return err
+	}
+	redisClient, err := redis.NewClient(redis.Config{
+		Address:  *redisAddr,
+		Password: redisPassword,
+		DB:       0,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	defer redisClient.Close()
+
+	result, err := redisClient.MigrateKeys(context.Background(), source, target, redis.KeyMigrationOptions{
+		Copy:   *keep,
+		DryRun: *dryRun,
+		Force:  *force,
+	})
+	if result != nil {
+		verb := "moved"
+		if *dryRun {
+			verb = "would move"
+		}
+		fmt.Printf("%s %d keys from %s to %s, %d already there, %d index members rewritten\n", verb, result.Moved, source, target, result.Skipped, result.Members)
+		for _, key := range result.Conflicts {
+			fmt.Fprintf(os.Stderr, "kept %s: %s has another value\n", key, target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(result.Conflicts) > 0 {
+		return fmt.Errorf("%d keys not moved because %s has them with another value; resolve them and run again", len(result.Conflicts), target)
+	}
+	if !*dryRun {
+		fmt.Printf("start SWIM and LabMan with REDIS_KEY_NAMESPACE=%s\n", target)
+	}
+	return nil
+}
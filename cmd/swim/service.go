@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -9,20 +10,70 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/abuse"
+	"github.com/alex-sviridov/swim/internal/archive"
 	"github.com/alex-sviridov/swim/internal/cleanup"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
 	"github.com/alex-sviridov/swim/internal/decommissioner"
+	"github.com/alex-sviridov/swim/internal/dispatch"
+	"github.com/alex-sviridov/swim/internal/dns"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/extend"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/heartbeat"
+	"github.com/alex-sviridov/swim/internal/hooks"
+	"github.com/alex-sviridov/swim/internal/inventory"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/override"
 	"github.com/alex-sviridov/swim/internal/provisioner"
+	"github.com/alex-sviridov/swim/internal/readiness"
+	"github.com/alex-sviridov/swim/internal/rebuild"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/resize"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/undo"
+	"github.com/alex-sviridov/swim/internal/warmup"
 )
 
 const (
-	queueTimeout = 30 * time.Second
+	handoffTimeout = 10 * time.Second
+	journalTimeout = 5 * time.Second
+
+	// handoffPollInterval is how often a running instance checks for provisions handed off by another one
+	handoffPollInterval = 30 * time.Second
+
+	// popRetryDelay is the pause after a failed queue pop, so an unreachable queue isn't polled in a tight loop
+	popRetryDelay = 1 * time.Second
 )
 
+// instanceStore keeps the instance heartbeat, carries in-flight provisions
+// from a draining instance to its replacement, holds the pending-create journal,
+// records events for the status dashboard and each user's history, reports queue depths,
+// reads user activity, keeps the tombstones of decommissioned labs and the shared bucket
+// server creations take from, orders each user's requests, holds the runtime feature flags,
+// and reports whether Redis is reachable
+type instanceStore interface {
+	heartbeat.Publisher
+	PushHandoffEntries(ctx context.Context, entries []redis.HandoffEntry) error
+	PopHandoffEntries(ctx context.Context) ([]redis.HandoffEntry, error)
+	IsInstanceAlive(ctx context.Context, instanceID string) (bool, error)
+	ListPendingCreates(ctx context.Context) ([]redis.PendingCreate, error)
+	ClearPendingCreate(ctx context.Context, name string) error
+	redis.EventRecorder
+	redis.HistoryRecorder
+	redis.CreateLimiter
+	notify.DepthReader
+	redis.ActivityReader
+	redis.TombstoneStore
+	redis.HealthReporter
+	redis.ExtensionCounter
+	redis.Sequencer
+	redis.FlagReader
+}
+
 // runQueueProcessor orchestrates the queue processing and cleanup workers
-func runQueueProcessor(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface) {
+func runQueueProcessor(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface, store instanceStore, instance redis.InstanceInfo, registrar *dns.Registrar, hookRunner *hooks.Runner, inventoryHook *inventory.Hook, warmUp *warmup.Runner, notifier *notify.Notifier, tenants *tenant.Registry, overrides *override.Verifier, labNodes func(labID int) ([]string, error), checks *readiness.Checks, journal connector.CreateJournal, primed []redis.ServerState, sessions archive.Archiver) {
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -32,63 +83,393 @@ func runQueueProcessor(log *slog.Logger, conn connector.Connector, redisClient r
 
 	var wg sync.WaitGroup
 
+	// Register this instance and keep its heartbeat alive
+	heartbeatWorker := heartbeat.New(log, store, instance)
+	go heartbeatWorker.Run(ctx)
+
+	// Operators flip feature flags in Redis to change behavior mid-incident without a redeploy
+	featureFlags := flags.New(log, store)
+
 	// Start cleanup worker
-	cleanupWorker := cleanup.New(log, conn, redisClient)
+	cleanupWorker := cleanup.New(log, conn, redisClient).WithHistory(store).WithSequencer(store).WithFlags(featureFlags)
+	if idleTimeout := config.GetIdleTimeout(); idleTimeout > 0 {
+		cleanupWorker.WithIdleExpiry(store, idleTimeout, config.GetMaxLifetime())
+		log.Info("idle-based expiry enabled", "idle_timeout", idleTimeout, "max_lifetime", config.GetMaxLifetime())
+	}
+	if extension := config.GetTTLRefreshExtension(); extension > 0 {
+		go cleanup.NewRefresher(log, redisClient, store, extension, config.GetMaxLifetime()).Run(ctx)
+	}
 	go cleanupWorker.Run(ctx)
 
+	// Flag servers that look like cryptominers or attack sources
+	if interval := config.GetAbuseCheckInterval(); interval > 0 {
+		monitor := abuse.New(log, conn, redisClient, abuse.Config{
+			Interval:    interval,
+			Window:      config.GetAbuseWindow(),
+			CPUPercent:  config.GetAbuseCPUPercent(),
+			EgressBytes: config.GetAbuseEgressBytes(),
+		})
+		go monitor.WithRemediation(config.GetAbuseRemediation()).WithActivity(store).WithNotifier(notifier).WithEvents(store).Run(ctx)
+	}
+
+	// Alert operators when requests pile up in the queues
+	if threshold := config.GetQueueDepthAlertThreshold(); notifier != nil && threshold > 0 {
+		go notify.NewQueueMonitor(log, store, notifier, threshold).Run(ctx)
+	}
+
+	// Blocking pops wait longer the longer the queues stay empty, and briefly once draining
+	popTimer := dispatch.NewPopTimer(config.GetQueuePopMinTimeout(), config.GetQueuePopMaxTimeout())
+
 	// Start shutdown handler
 	go func() {
 		<-sigChan
-		log.Info("shutdown signal received, stopping gracefully")
+		log.Info("shutdown signal received, draining")
+		popTimer.Drain()
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), handoffTimeout)
+		heartbeatWorker.Drain(drainCtx)
+		drainCancel()
 		cancel()
 	}()
 
 	// Create provisioner and decommissioner
-	prov := provisioner.New(log, conn, redisClient)
-	decomm := decommissioner.New(log, conn, redisClient)
+	prov := provisioner.New(log, conn, redisClient).WithDNS(registrar).WithHooks(hookRunner).WithInventory(inventoryHook).WithWarmUp(warmUp).WithEvents(store).WithHistory(store).WithNotifier(notifier).WithTenants(tenants).WithLabNodes(labNodes).
+		WithReadiness(checks).WithCreateJournal(journal).WithOverrides(overrides).WithSequencer(store).WithFlags(featureFlags).
+		WithMaxRequestAge(config.GetMaxRequestAge()).
+		WithCreateLimit(store, float64(config.GetProviderCreateRate()), config.GetProviderCreateBurst())
+	// Deletions run in the background so a slow provider delete doesn't hold up the decommission queue
+	decomm := decommissioner.New(log, conn, redisClient).WithAsyncDeletes().WithDNS(registrar).WithHooks(hookRunner).WithInventory(inventoryHook).WithEvents(store).WithHistory(store).WithTenants(tenants).
+		WithNotifier(notifier).WithOverrides(overrides).WithSequencer(store).WithFlags(featureFlags)
+	if sessions != nil {
+		prov.WithArchive(sessions, instance.Provider)
+		decomm.WithArchive(sessions, instance.Provider)
+	}
+	// Deleted labs can be restored within the tombstone window
+	tombstoneTTL := config.GetTombstoneTTL()
+	if tombstoneTTL > 0 {
+		decomm.WithTombstones(store, tombstoneTTL)
+	}
 
-	// Start provision queue processor
-	go processQueue(ctx, &wg, log, redisClient, config.ProvisionQueueKey, "provision", func(payload string) {
-		prov.ProcessRequest(ctx, payload)
-	})
+	// Report entries left provisioning or stopping, e.g. by a crashed instance, and remediate them if configured
+	watchdog := cleanup.NewWatchdog(log, redisClient, config.GetStuckProvisioningThreshold(), config.GetStuckStoppingThreshold()).
+		WithRemediation(config.GetStuckRemediation(), prov.Resume).WithNotifier(notifier).WithFlags(featureFlags)
+	// Entries in flight at startup are timed from now rather than from the first check
+	watchdog.Prime(primed)
+	go watchdog.Run(ctx)
+
+	// Adopt provisions a previous instance left behind during a deploy, and those other instances hand off later
+	resumeHandedOff(ctx, &wg, log, prov, store)
+
+	// Find servers whose creation was interrupted by a crash or failed half-way
+	reconcilePendingCreates(ctx, &wg, log, prov, store, instance.ID)
 
-	// Start decommission queue processor
-	go processQueue(ctx, &wg, log, redisClient, config.DecommissionQueueKey, "decommission", func(payload string) {
-		decomm.ProcessRequest(ctx, payload)
+	// Provisions run at most one per user so a user spamming retries can't starve the others
+	// and, with MAX_INFLIGHT_PROVISIONS set, the provision queue isn't popped while at capacity
+	provisions := dispatch.NewFairDispatcher(log, prov.ProcessRequest).WithCapacity(config.GetMaxInflightProvisions())
+
+	// All queues are read by one consumer, in priority order: a student's own stop comes
+	// first, and expired servers only take deletion capacity that is left over, so a mass
+	// expiry can't hold up anyone's request
+	cleanupDeleteLimit := config.GetCleanupDeleteLimit()
+	queues := []queueConsumer{
+		{
+			queueKey:  config.DecommissionQueueKey,
+			queueType: "decommission",
+			handler:   func(payload string) { decomm.ProcessRequest(ctx, payload) },
+		},
+		{
+			queueKey:  config.ProvisionQueueKey,
+			queueType: "provision",
+			ready:     provisions.HasCapacity,
+			handler:   func(payload string) { provisions.Submit(ctx, payload) },
+		},
+	}
+	// Rebuilt and resized servers are polled like provisions until they are available again
+	rebuilds := rebuild.New(log, conn, redisClient, prov.Resume).WithTenants(tenants).WithEvents(store).WithHistory(store).WithOverrides(overrides)
+	resizes := resize.New(log, conn, redisClient, prov.Resume).WithTenants(tenants).WithEvents(store).WithHistory(store).WithOverrides(overrides)
+	queues = append(queues, queueConsumer{
+		queueKey:  config.RebuildQueueKey,
+		queueType: "rebuild",
+		handler:   func(payload string) { rebuilds.ProcessRequest(ctx, payload) },
+	}, queueConsumer{
+		queueKey:  config.ResizeQueueKey,
+		queueType: "resize",
+		handler:   func(payload string) { resizes.ProcessRequest(ctx, payload) },
+	})
+	extensions := extend.New(log, redisClient, store, extend.Limits{
+		MaxSession: config.GetMaxSessionLength(),
+		PerDay:     config.GetMaxExtensionsPerDay(),
+	}).WithTenants(tenants).WithHistory(store)
+	queues = append(queues, queueConsumer{
+		queueKey:  config.ExtendQueueKey,
+		queueType: "extend",
+		handler:   func(payload string) { extensions.ProcessRequest(ctx, payload) },
 	})
+	if tombstoneTTL > 0 {
+		undoHandler := undo.New(log, store, func(payload string) {
+			provisions.Submit(ctx, payload)
+		}).WithTenants(tenants)
+		queues = append(queues, queueConsumer{
+			queueKey:  config.UndoQueueKey,
+			queueType: "undo",
+			handler:   func(payload string) { undoHandler.ProcessRequest(ctx, payload) },
+		})
+	}
+	queues = append(queues, queueConsumer{
+		queueKey:  config.CleanupQueueKey,
+		queueType: "cleanup",
+		ready:     func() bool { return decomm.TakesCleanup(ctx, cleanupDeleteLimit) },
+		handler:   func(payload string) { decomm.ProcessRequest(ctx, payload) },
+	})
+	go consumeQueues(ctx, &wg, log, redisClient, store, popTimer, queues)
 
 	// Wait for shutdown signal
 	<-ctx.Done()
 	log.Info("waiting for active tasks to complete")
 	wg.Wait()
+	provisions.Wait()
+	decomm.Wait()
+	watchdog.Wait()
+	requeuePending(log, redisClient, provisions)
+	handOffInFlight(log, prov, store, instance.ID)
 	log.Info("all tasks completed, shutting down")
 }
 
-// processQueue processes requests from a Redis queue
-func processQueue(ctx context.Context, wg *sync.WaitGroup, log *slog.Logger, redisClient redis.ClientInterface, queueKey string, queueType string, handler func(string)) {
+// requeuePending returns the provision requests that were still waiting for their user's slot
+func requeuePending(log *slog.Logger, redisClient redis.ClientInterface, provisions *dispatch.FairDispatcher) {
+	pending := provisions.Pending()
+	if len(pending) == 0 {
+		return
+	}
+
+	// The service context is already cancelled at this point
+	ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer cancel()
+
+	if err := redisClient.PushPayloads(ctx, config.ProvisionQueueKey, pending); err != nil {
+		log.Error("failed to requeue waiting provision requests", "count", len(pending), "error", err)
+		return
+	}
+	log.Info("requeued waiting provision requests", "count", len(pending))
+}
+
+// handOffInFlight pushes the provisions interrupted by shutdown to Redis for the next instance
+func handOffInFlight(log *slog.Logger, prov *provisioner.Provisioner, store instanceStore, instanceID string) {
+	entries := prov.InFlight()
+	if len(entries) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range entries {
+		entries[i].InstanceID = instanceID
+		entries[i].HandedOffAt = now
+	}
+
+	// The service context is already cancelled at this point
+	ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer cancel()
+
+	if err := store.PushHandoffEntries(ctx, entries); err != nil {
+		log.Error("failed to hand off in-flight provisions", "count", len(entries), "error", err)
+		return
+	}
+	log.Info("handed off in-flight provisions", "count", len(entries))
+}
+
+// resumeHandedOff adopts the provisions handed off by draining instances and polls them to completion.
+// The handoff list is checked at startup and then every handoffPollInterval until ctx is done, so
+// provisions an instance hands off while this one is already running, e.g. in a rolling deploy, are adopted too.
+func resumeHandedOff(ctx context.Context, wg *sync.WaitGroup, log *slog.Logger, prov *provisioner.Provisioner, store instanceStore) {
+	adoptHandedOff(ctx, wg, log, prov, store)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(handoffPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				adoptHandedOff(ctx, wg, log, prov, store)
+			}
+		}
+	}()
+}
+
+// adoptHandedOff takes every entry from the handoff list and resumes polling its server
+func adoptHandedOff(ctx context.Context, wg *sync.WaitGroup, log *slog.Logger, prov *provisioner.Provisioner, store instanceStore) {
+	entries, err := store.PopHandoffEntries(ctx)
+	if err != nil {
+		log.Error("failed to read handed-off provisions", "error", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	log.Info("adopting handed-off provisions", "count", len(entries))
+	for _, entry := range entries {
+		wg.Add(1)
+		go func(entry redis.HandoffEntry) {
+			defer wg.Done()
+			prov.Resume(ctx, entry)
+		}(entry)
+	}
+}
+
+// reconcilePendingCreates adopts or deletes the servers journaled by instances that are gone.
+// Entries of live instances are left alone, their creations may still be running.
+func reconcilePendingCreates(ctx context.Context, wg *sync.WaitGroup, log *slog.Logger, prov *provisioner.Provisioner, store instanceStore, instanceID string) {
+	pending, err := store.ListPendingCreates(ctx)
+	if err != nil {
+		log.Error("failed to read pending creates", "error", err)
+		return
+	}
+
+	for _, entry := range pending {
+		// A previous run with the same SWIM_INSTANCE_ID is gone even if its heartbeat hasn't expired
+		if entry.InstanceID != instanceID {
+			alive, err := store.IsInstanceAlive(ctx, entry.InstanceID)
+			if err != nil {
+				log.Error("failed to check instance heartbeat", "instance_id", entry.InstanceID, "error", err)
+				continue
+			}
+			if alive {
+				continue
+			}
+		}
+
+		adopted, err := prov.ReconcilePendingCreate(ctx, entry)
+		if err != nil {
+			log.Error("failed to reconcile pending create, keeping it for the next startup", "server_name", entry.Name, "error", err)
+			continue
+		}
+		if err := store.ClearPendingCreate(ctx, entry.Name); err != nil {
+			log.Error("failed to clear pending create", "server_name", entry.Name, "error", err)
+		}
+
+		if adopted != nil {
+			wg.Add(1)
+			go func(adopted redis.HandoffEntry) {
+				defer wg.Done()
+				prov.Resume(ctx, adopted)
+			}(*adopted)
+		}
+	}
+}
+
+// queueConsumer handles the requests of one queue
+type queueConsumer struct {
+	queueKey  string
+	queueType string
+	ready     func() bool // if set, the queue is only popped while it returns true
+	handler   func(payload string)
+}
+
+// consumeQueues processes requests from several Redis queues with a single blocking pop.
+// Queues earlier in the list are served first whenever more than one holds requests.
+// A queue whose ready function returns false is left out of the pop until it is ready again.
+// While the Redis circuit breaker is open, no pop is attempted until its cooldown is over.
+// timer picks each pop's timeout and reports the loop's state.
+func consumeQueues(ctx context.Context, wg *sync.WaitGroup, log *slog.Logger, redisClient redis.ClientInterface, health redis.HealthReporter, timer *dispatch.PopTimer, queues []queueConsumer) {
+	consumers := make(map[string]queueConsumer, len(queues))
+	for _, q := range queues {
+		consumers[q.queueKey] = q
+	}
+
+	paused := false
 	for {
 		// Check if shutdown was requested
 		select {
 		case <-ctx.Done():
-			log.Info("queue processor stopping", "queue_type", queueType)
+			log.Info("queue consumer stopping")
 			return
 		default:
 		}
 
-		// Pop payload from Redis queue (blocking)
-		payload, err := redisClient.PopPayload(ctx, queueKey, queueTimeout)
+		if wait := time.Until(health.Health().RetryAt); wait > 0 {
+			if !paused {
+				log.Warn("redis unavailable, pausing queue consumption", "retry_in", wait.Round(time.Second))
+				paused = true
+			}
+			timer.Pause()
+			sleepCtx(ctx, wait)
+			continue
+		}
+		if paused {
+			log.Info("resuming queue consumption")
+			paused = false
+		}
+
+		keys := make([]string, 0, len(queues))
+		for _, q := range queues {
+			if q.ready == nil || q.ready() {
+				keys = append(keys, q.queueKey)
+			}
+		}
+
+		// Held back queues are checked again soon rather than after a full pop timeout
+		timeout := timer.Next(len(keys) < len(queues))
+		if len(keys) == 0 {
+			sleepCtx(ctx, timeout)
+			continue
+		}
+
+		// Pop payload from the first non-empty queue (blocking)
+		queueKey, payload, err := redisClient.PopAnyPayload(ctx, keys, timeout)
+		if errors.Is(err, errs.ErrNotFound) {
+			timer.Done(dispatch.PopEmpty)
+			continue
+		}
 		if err != nil {
-			log.Debug("failed to pop payload from queue", "queue_type", queueType, "error", err)
+			timer.Done(dispatch.PopError)
+			log.Debug("failed to pop payload from queues", "queues", keys, "error", err)
+			sleepCtx(ctx, popRetryDelay)
+			continue
+		}
+		timer.Done(dispatch.PopRequest)
+		q, ok := consumers[queueKey]
+		if !ok {
+			log.Error("popped payload from unknown queue", "queue", queueKey)
+			continue
+		}
+
+		// A pop can't be cancelled, so it may return after the shutdown; the request goes back
+		// to its queue rather than to a handler that would stop at once
+		if ctx.Err() != nil {
+			requeuePopped(log, redisClient, queueKey, payload)
 			continue
 		}
 
-		log.Info("received request", "queue_type", queueType, "payload_length", len(payload))
+		log.Info("received request", "queue_type", q.queueType, "payload_length", len(payload))
 
 		// Process in a goroutine
 		wg.Add(1)
 		go func(payload string) {
 			defer wg.Done()
-			handler(payload)
+			q.handler(payload)
 		}(payload)
 	}
 }
+
+// requeuePopped pushes a request popped after the shutdown back to its queue
+func requeuePopped(log *slog.Logger, redisClient redis.ClientInterface, queueKey, payload string) {
+	// The service context is already cancelled at this point
+	ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer cancel()
+	if err := redisClient.PushPayload(ctx, queueKey, payload); err != nil {
+		log.Error("failed to requeue request popped during shutdown", "queue", queueKey, "error", err)
+		return
+	}
+	log.Info("requeued request popped during shutdown", "queue", queueKey)
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/archive"
+	"github.com/alex-sviridov/swim/internal/credentials"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// runStats implements `swim stats`: it sums up the archived sessions of the last period per
+// lab, from the session stream or an archive file
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	redisAddr := flags.String("redis", "", "Redis connection string (default: REDIS_CONNECTION_STRING)")
+	file := flags.String("file", "", "Read the session archive file at this path and its rotated files instead of Redis")
+	maxFiles := flags.Int("max-files", archive.DefaultFileMaxFiles, "Number of rotated archive files to read with --file")
+	period := flags.String("period", "7d", "Sessions ended within this period are summed up, e.g. 7d or 12h")
+	tenantID := flags.String("tenant", "", "Only sum up the sessions of this tenant (default: all tenants)")
+	format := flags.String("format", "table", "Output format: table or json")
+	flags.Parse(args)
+
+	window, err := parsePeriod(*period)
+	if err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("--format must be table or json, got %q", *format)
+	}
+	since := time.Now().Add(-window)
+
+	var records []redis.SessionRecord
+	if *file != "" {
+		if records, err = archive.ReadFile(*file, *maxFiles, since); err != nil {
+			return err
+		}
+	} else {
+		if records, err = readSessionStream(*redisAddr, since); err != nil {
+			return err
+		}
+	}
+	if *tenantID != "" {
+		var filtered []redis.SessionRecord
+		for _, record := range records {
+			if record.Tenant == *tenantID {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
+
+	summary := archive.Summarize(records)
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(os.Stderr, "no sessions archived in the period")
+		return nil
+	}
+	return printStats(os.Stdout, summary)
+}
+
+// readSessionStream reads the records of the session stream that ended at or after since
+func readSessionStream(redisAddr string, since time.Time) ([]redis.SessionRecord, error) {
+	if redisAddr == "" {
+		redisAddr = os.Getenv("REDIS_CONNECTION_STRING")
+		if redisAddr == "" {
+			return nil, fmt.Errorf("--redis or --file flag or REDIS_CONNECTION_STRING environment variable is required")
+		}
+	}
+	redisPassword, err := credentials.FromEnv("REDIS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	redisClient, err := redis.NewClient(redis.Config{
+		Address:  redisAddr,
+		Password: redisPassword,
+		DB:       0,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	defer redisClient.Close()
+
+	return redisClient.ReadSessions(context.Background(), since)
+}
+
+// parsePeriod parses a duration that may also be given in days, e.g. "7d"
+func parsePeriod(value string) (time.Duration, error) {
+	var period time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid --period %q", value)
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if period, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid --period %q", value)
+		}
+	}
+	if period <= 0 {
+		return 0, fmt.Errorf("--period must be positive, got %q", value)
+	}
+	return period, nil
+}
+
+// printStats writes summary as a table, one row per lab and a total row
+func printStats(out io.Writer, summary archive.Summary) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LAB\tSESSIONS\tFAILED\tFAILURE RATE\tMEDIAN DURATION\tAVG PROVISIONING")
+	row := func(lab string, stats archive.LabStats) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%s\t%s\n", lab, stats.Sessions, stats.Failed, stats.FailureRate*100,
+			time.Duration(stats.MedianDurationSeconds)*time.Second,
+			time.Duration(stats.AvgProvisionSeconds*float64(time.Second)).Round(time.Second))
+	}
+	for _, stats := range summary.Labs {
+		row(strconv.Itoa(stats.LabID), stats)
+	}
+	row("total", summary.Total)
+	return w.Flush()
+}
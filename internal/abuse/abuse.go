@@ -0,0 +1,369 @@
+// Package abuse samples the CPU and network usage of running lab servers at the provider and
+// flags servers whose usage looks like a cryptominer or an attack, e.g. a server at full CPU
+// for an hour while its user is idle.
+package abuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// pageSize is the number of running server states read from the cache at a time
+const pageSize = 500
+
+// Rules a server can be flagged by
+const (
+	RuleCPU    = "cpu"    // sustained CPU usage while the user is idle
+	RuleEgress = "egress" // sustained outgoing traffic
+)
+
+// CloudStatusQuarantined is the cloud status cached for a server the monitor powered off
+const CloudStatusQuarantined = config.CloudStatusQuarantined
+
+// errEntryMoved aborts the cache update of an entry that belongs to another server by now
+var errEntryMoved = errors.New("cache entry changed since the server was flagged")
+
+var suspected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "swim_abuse_suspected_total",
+	Help: "Servers the abuse monitor flagged, by rule.",
+}, []string{"rule"})
+
+func init() {
+	prometheus.MustRegister(suspected)
+}
+
+// usageServer is implemented by servers whose provider reports their resource usage
+type usageServer interface {
+	GetUsage(ctx context.Context, start, end time.Time) (connector.Usage, error)
+}
+
+// poweredServer is implemented by servers that can be powered off without deleting them
+type poweredServer interface {
+	PowerOff(ctx context.Context) error
+}
+
+// Config holds the thresholds of the abuse monitor
+type Config struct {
+	Interval    time.Duration // time between checks
+	Window      time.Duration // period a server's usage is averaged over
+	CPUPercent  float64       // average CPU usage flagged on the servers of idle users
+	EgressBytes float64       // average outgoing traffic flagged on any server, in bytes per second
+}
+
+// Monitor checks the usage of running servers over the last window and reports the servers
+// above a threshold. Each server is reported once across instances; servers that haven't run
+// for a whole window yet are left for a later check.
+type Monitor struct {
+	log         *slog.Logger
+	conn        connector.Connector
+	redisClient redis.ClientInterface
+	cfg         Config
+	remediation string
+	activity    redis.ActivityReader
+	notifier    *notify.Notifier
+	events      redis.EventRecorder
+	now         func() time.Time
+
+	flagged map[string]bool // server IDs reported already
+}
+
+// New creates a Monitor that only reports until a remediation is set
+func New(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface, cfg Config) *Monitor {
+	return &Monitor{
+		log:         log,
+		conn:        conn,
+		redisClient: redisClient,
+		cfg:         cfg,
+		remediation: config.AbuseRemediationNone,
+		now:         time.Now,
+		flagged:     make(map[string]bool),
+	}
+}
+
+// WithRemediation sets what is done with flagged servers, one of the config.AbuseRemediation values
+func (m *Monitor) WithRemediation(remediation string) *Monitor {
+	m.remediation = remediation
+	return m
+}
+
+// WithActivity limits the CPU rule to servers whose user had no activity during the window.
+// Without it the CPU rule applies to every server.
+func (m *Monitor) WithActivity(activity redis.ActivityReader) *Monitor {
+	m.activity = activity
+	return m
+}
+
+// WithNotifier alerts operators about flagged servers
+func (m *Monitor) WithNotifier(notifier *notify.Notifier) *Monitor {
+	m.notifier = notifier
+	return m
+}
+
+// WithEvents records flagged servers for the status dashboard
+func (m *Monitor) WithEvents(recorder redis.EventRecorder) *Monitor {
+	m.events = recorder
+	return m
+}
+
+// Run checks the running servers every interval until ctx is cancelled
+func (m *Monitor) Run(ctx context.Context) {
+	m.log.Info("abuse monitor started",
+		"interval", m.cfg.Interval,
+		"window", m.cfg.Window,
+		"cpu_percent", m.cfg.CPUPercent,
+		"egress_bytes", m.cfg.EgressBytes,
+		"remediation", m.remediation)
+
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.log.Info("abuse monitor stopping")
+			return
+		case <-ticker.C:
+			m.check(ctx)
+		}
+	}
+}
+
+// check inspects every running server, a page of cache entries at a time
+func (m *Monitor) check(ctx context.Context) {
+	now := m.now()
+	seen := make(map[string]bool)
+	filter := redis.StateFilter{Status: config.StatusRunning, Limit: pageSize}
+	for {
+		page, err := m.redisClient.QueryServerStates(ctx, filter)
+		if err != nil {
+			m.log.Error("failed to get server states for abuse check", "error", err)
+			return
+		}
+		m.checkPage(ctx, now, page.States, seen)
+		if ctx.Err() != nil {
+			return
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	// Servers that are no longer running may be reported again if they ever are
+	for serverID := range m.flagged {
+		if !seen[serverID] {
+			delete(m.flagged, serverID)
+		}
+	}
+}
+
+// checkPage inspects the servers of one page of states, adding their IDs to seen
+func (m *Monitor) checkPage(ctx context.Context, now time.Time, states []redis.ServerState, seen map[string]bool) {
+	idle := m.idleUsers(ctx, now, states)
+	for _, state := range states {
+		if ctx.Err() != nil {
+			return
+		}
+		if state.ServerID == "" || !state.Available {
+			continue
+		}
+		seen[state.ServerID] = true
+		if m.flagged[state.ServerID] || (!state.CreatedAt.IsZero() && now.Sub(state.CreatedAt) < m.cfg.Window) {
+			continue
+		}
+
+		server, err := m.conn.GetServerByID(ctx, state.ServerID)
+		if err != nil {
+			if !errors.Is(err, errs.ErrNotFound) {
+				m.log.Warn("failed to get server for abuse check", "server_id", state.ServerID, "error", err)
+			}
+			continue
+		}
+		userIdle := idle == nil || idle[redis.TenantUserID(state.Tenant, state.WebUserID)]
+		for _, node := range nodes(server) {
+			rule, usage, err := m.inspect(ctx, node, now, userIdle)
+			if err != nil {
+				m.log.Warn("failed to get server usage", "server_id", node.GetID(), "error", err)
+				continue
+			}
+			if rule != "" {
+				m.flag(ctx, state, node, rule, usage)
+				break
+			}
+		}
+	}
+}
+
+// idleUsers returns whether each user of states, by tenant-scoped user ID, had no activity
+// during the window. Returns nil without an activity reader, so every user counts as idle;
+// if activity can't be read, nobody does, so an outage doesn't quarantine working students.
+func (m *Monitor) idleUsers(ctx context.Context, now time.Time, states []redis.ServerState) map[string]bool {
+	if m.activity == nil {
+		return nil
+	}
+	idle := make(map[string]bool, len(states))
+	userIDs := make([]string, len(states))
+	for i, state := range states {
+		userIDs[i] = redis.TenantUserID(state.Tenant, state.WebUserID)
+	}
+	activity, err := m.activity.LastActivity(ctx, userIDs)
+	if err != nil {
+		m.log.Warn("failed to read user activity, skipping the cpu rule", "error", err)
+		return idle
+	}
+	for _, userID := range userIDs {
+		lastActive, ok := activity[userID]
+		idle[userID] = !ok || now.Sub(lastActive) >= m.cfg.Window
+	}
+	return idle
+}
+
+// inspect returns the rule server breaks over the window ending at now, "" for none, and its usage
+func (m *Monitor) inspect(ctx context.Context, server connector.Server, now time.Time, userIdle bool) (string, connector.Usage, error) {
+	reporter, ok := server.(usageServer)
+	if !ok {
+		return "", connector.Usage{}, nil
+	}
+	usage, err := reporter.GetUsage(ctx, now.Add(-m.cfg.Window), now)
+	if err != nil {
+		return "", usage, err
+	}
+	switch {
+	case usage.Samples == 0:
+		return "", usage, nil
+	case usage.EgressBytes >= m.cfg.EgressBytes:
+		return RuleEgress, usage, nil
+	case userIdle && usage.CPUPercent >= m.cfg.CPUPercent:
+		return RuleCPU, usage, nil
+	}
+	return "", usage, nil
+}
+
+// flag reports server, a node of the lab cached as state, and quarantines it if configured
+func (m *Monitor) flag(ctx context.Context, state redis.ServerState, server connector.Server, rule string, usage connector.Usage) {
+	m.flagged[state.ServerID] = true
+	serverLog := m.log.With("server_id", server.GetID(), "webuserid", state.WebUserID, "labid", state.LabID)
+
+	// Every instance runs a monitor, but only one reports a lab
+	userID := redis.TenantUserID(state.Tenant, state.WebUserID)
+	allowed, err := m.redisClient.TryAcquireRateLimit(ctx, userID, "abuse:"+state.ServerID, config.ServerCacheTTL)
+	if err != nil {
+		serverLog.Error("failed to check abuse rate limit, skipping report", "error", err)
+		delete(m.flagged, state.ServerID)
+		return
+	}
+	if !allowed {
+		return
+	}
+
+	suspected.WithLabelValues(rule).Inc()
+	serverLog.Warn("suspicious server usage",
+		"rule", rule,
+		"cpu_percent", usage.CPUPercent,
+		"egress_bytes", usage.EgressBytes,
+		"window", m.cfg.Window)
+
+	finding := m.describe(rule, usage)
+	outcome := "reported"
+	if m.remediation == config.AbuseRemediationQuarantine {
+		if err := m.quarantine(ctx, state, server); err != nil {
+			serverLog.Error("failed to quarantine server", "error", err)
+			outcome = fmt.Sprintf("could not be quarantined: %v", err)
+		} else {
+			serverLog.Warn("server quarantined")
+			outcome = "powered off"
+		}
+	}
+
+	m.recordEvent(ctx, redis.Event{Type: redis.EventAbuseSuspected, WebUserID: state.WebUserID, Tenant: state.Tenant,
+		LabID: state.LabID, ServerID: server.GetID(), Message: finding + ", " + outcome})
+	m.notify(ctx, notify.Notification{
+		Event: notify.EventAbuseSuspected,
+		Title: "Suspicious server usage",
+		Message: fmt.Sprintf("server %s (%s) of user %s, lab %d: %s, %s",
+			server.GetID(), server.GetName(), state.WebUserID, state.LabID, finding, outcome),
+	})
+}
+
+// describe explains a rule broken with usage
+func (m *Monitor) describe(rule string, usage connector.Usage) string {
+	if rule == RuleEgress {
+		return fmt.Sprintf("average outgoing traffic of %.1f Mbit/s over %s", usage.EgressBytes*8/1e6, m.cfg.Window)
+	}
+	return fmt.Sprintf("average CPU usage of %.0f%% over %s while the user was idle", usage.CPUPercent, m.cfg.Window)
+}
+
+// quarantine powers server off and marks the cache entry of its lab unavailable. The entry
+// keeps its expiry, after which the lab is decommissioned like any other. Protected servers
+// are only reported.
+func (m *Monitor) quarantine(ctx context.Context, state redis.ServerState, server connector.Server) error {
+	if connector.Protected(server) {
+		return fmt.Errorf("server is labelled %s=true", connector.LabelProtected)
+	}
+	powered, ok := server.(poweredServer)
+	if !ok {
+		return errors.New("server can't be powered off")
+	}
+	if err := powered.PowerOff(ctx); err != nil {
+		return err
+	}
+
+	_, err := redis.UpdateServerState(ctx, m.redisClient, state.CacheKey(), config.ServerCacheTTL, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != state.ServerID {
+			return errEntryMoved
+		}
+		fresh.Available = false
+		fresh.CloudStatus = CloudStatusQuarantined
+		return nil
+	})
+	if errors.Is(err, errEntryMoved) || errors.Is(err, errs.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// recordEvent keeps an event for the status dashboard. Events are informational, so a
+// failure is only logged.
+func (m *Monitor) recordEvent(ctx context.Context, event redis.Event) {
+	if m.events == nil {
+		return
+	}
+	event.Operation = "abuse"
+	if err := m.events.RecordEvent(ctx, event); err != nil {
+		m.log.Warn("failed to record event", "type", event.Type, "error", err)
+	}
+}
+
+// notify alerts operators. Notifications are best-effort, so a failure is only logged.
+func (m *Monitor) notify(ctx context.Context, notification notify.Notification) {
+	if m.notifier == nil {
+		return
+	}
+	if err := m.notifier.Notify(ctx, notification); err != nil {
+		m.log.Warn("failed to send notification", "event", notification.Event, "error", err)
+	}
+}
+
+// nodes returns the servers of a composite lab, or server itself
+func nodes(server connector.Server) []connector.Server {
+	group, ok := server.(*connector.Group)
+	if !ok {
+		return []connector.Server{server}
+	}
+	servers := make([]connector.Server, 0, len(group.Nodes()))
+	for _, node := range group.Nodes() {
+		servers = append(servers, node)
+	}
+	return servers
+}
@@ -0,0 +1,214 @@
+package abuse
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeServer reports a fixed usage and remembers whether it was powered off
+type fakeServer struct {
+	connector.Server
+	id         string
+	labels     map[string]string
+	usage      connector.Usage
+	poweredOff bool
+}
+
+func (s *fakeServer) GetID() string                { return s.id }
+func (s *fakeServer) GetName() string              { return "lab-" + s.id }
+func (s *fakeServer) GetLabels() map[string]string { return s.labels }
+
+func (s *fakeServer) GetUsage(ctx context.Context, start, end time.Time) (connector.Usage, error) {
+	return s.usage, nil
+}
+
+func (s *fakeServer) PowerOff(ctx context.Context) error {
+	s.poweredOff = true
+	return nil
+}
+
+// fakeConnector looks servers up in a map
+type fakeConnector struct {
+	connector.Connector
+	servers map[string]*fakeServer
+}
+
+func (c *fakeConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	server, ok := c.servers[id]
+	if !ok {
+		return nil, connector.NotFound("server %s not found", id)
+	}
+	return server, nil
+}
+
+// fakeRedis serves the running states from a map of cache keys
+type fakeRedis struct {
+	redis.ClientInterface
+	states map[string]redis.ServerState
+}
+
+func (r *fakeRedis) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	page := &redis.StatePage{}
+	for _, state := range r.states {
+		if state.Status == filter.Status {
+			page.States = append(page.States, state)
+		}
+	}
+	return page, nil
+}
+
+func (r *fakeRedis) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	state, ok := r.states[cacheKey]
+	if !ok {
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
+	}
+	return &state, nil
+}
+
+func (r *fakeRedis) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	r.states[cacheKey] = state
+	return nil
+}
+
+func (r *fakeRedis) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+// fixedActivity reports the same activity on every call
+type fixedActivity map[string]time.Time
+
+func (a fixedActivity) LastActivity(ctx context.Context, userIDs []string) (map[string]time.Time, error) {
+	return a, nil
+}
+
+// recordingChannel remembers the notifications sent
+type recordingChannel struct {
+	sent []notify.Notification
+}
+
+func (c *recordingChannel) Send(ctx context.Context, n notify.Notification) error {
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+func TestMonitor_Check(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	running := func(user, serverID string, createdAt time.Time) redis.ServerState {
+		return redis.ServerState{WebUserID: user, LabID: 7, ServerID: serverID, Status: config.StatusRunning, Available: true, CreatedAt: createdAt}
+	}
+	old := now.Add(-2 * time.Hour)
+
+	tests := []struct {
+		name        string
+		state       redis.ServerState
+		usage       connector.Usage
+		labels      map[string]string
+		remediation string
+		wantRule    string
+		wantOff     bool
+	}{
+		{
+			name:     "busy cpu of an idle user",
+			state:    running("idle", "1", old),
+			usage:    connector.Usage{CPUPercent: 99, Samples: 60},
+			wantRule: RuleCPU,
+		},
+		{
+			name:  "busy cpu of an active user",
+			state: running("active", "2", old),
+			usage: connector.Usage{CPUPercent: 99, Samples: 60},
+		},
+		{
+			name:     "heavy egress of an active user",
+			state:    running("active", "3", old),
+			usage:    connector.Usage{EgressBytes: 50e6, Samples: 60},
+			wantRule: RuleEgress,
+		},
+		{
+			name:  "server younger than the window",
+			state: running("idle", "4", now.Add(-10*time.Minute)),
+			usage: connector.Usage{CPUPercent: 99, Samples: 60},
+		},
+		{
+			name:        "quarantined",
+			state:       running("idle", "5", old),
+			usage:       connector.Usage{CPUPercent: 99, Samples: 60},
+			remediation: config.AbuseRemediationQuarantine,
+			wantRule:    RuleCPU,
+			wantOff:     true,
+		},
+		{
+			name:        "protected server is only reported",
+			state:       running("idle", "6", old),
+			usage:       connector.Usage{CPUPercent: 99, Samples: 60},
+			labels:      map[string]string{connector.LabelProtected: "true"},
+			remediation: config.AbuseRemediationQuarantine,
+			wantRule:    RuleCPU,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &fakeServer{id: tt.state.ServerID, labels: tt.labels, usage: tt.usage}
+			cacheKey := tt.state.CacheKey()
+			redisClient := &fakeRedis{states: map[string]redis.ServerState{cacheKey: tt.state}}
+			channel := &recordingChannel{}
+			notifier := notify.NewNotifier(map[string]notify.Channel{"test": channel}, nil, 0, 0)
+
+			monitor := New(slog.Default(), &fakeConnector{servers: map[string]*fakeServer{server.id: server}}, redisClient,
+				Config{Interval: time.Minute, Window: time.Hour, CPUPercent: 90, EgressBytes: 12.5e6}).
+				WithActivity(fixedActivity{"active": now.Add(-5 * time.Minute)}).
+				WithNotifier(notifier)
+			if tt.remediation != "" {
+				monitor.WithRemediation(tt.remediation)
+			}
+			monitor.now = func() time.Time { return now }
+
+			var before float64
+			if tt.wantRule != "" {
+				before = testutil.ToFloat64(suspected.WithLabelValues(tt.wantRule))
+			}
+			monitor.check(context.Background())
+
+			if tt.wantRule == "" {
+				if len(channel.sent) != 0 {
+					t.Fatalf("expected no notification, got %+v", channel.sent)
+				}
+				return
+			}
+			if got := testutil.ToFloat64(suspected.WithLabelValues(tt.wantRule)) - before; got != 1 {
+				t.Errorf("expected the %s rule to be counted once, got %v", tt.wantRule, got)
+			}
+			if len(channel.sent) != 1 || channel.sent[0].Event != notify.EventAbuseSuspected || !strings.Contains(channel.sent[0].Message, "server "+server.id) {
+				t.Fatalf("expected one abuse notification for server %s, got %+v", server.id, channel.sent)
+			}
+			if server.poweredOff != tt.wantOff {
+				t.Errorf("expected powered off %v, got %v", tt.wantOff, server.poweredOff)
+			}
+			state := redisClient.states[cacheKey]
+			if tt.wantOff && (state.Available || state.CloudStatus != CloudStatusQuarantined) {
+				t.Errorf("expected the entry to be quarantined, got %+v", state)
+			}
+			if !tt.wantOff && !state.Available {
+				t.Errorf("expected the entry to stay available, got %+v", state)
+			}
+
+			// A server is reported once while it keeps running
+			monitor.check(context.Background())
+			if got := testutil.ToFloat64(suspected.WithLabelValues(tt.wantRule)) - before; got != 1 {
+				t.Errorf("expected the server not to be flagged again, got %v", got)
+			}
+		})
+	}
+}
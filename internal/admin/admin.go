@@ -0,0 +1,339 @@
+// Package admin serves a read-only HTTP API and status dashboard for operators.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	maxPageSize       = 1000
+	defaultEventLimit = 50
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// Store is the part of the Redis client the admin API reads
+type Store interface {
+	QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error)
+	QueueDepths(ctx context.Context, queueKeys ...string) (map[string]int64, error)
+	RecentEvents(ctx context.Context, limit int) ([]redis.Event, error)
+	UserHistory(ctx context.Context, userID string, limit int) ([]redis.Event, error)
+}
+
+// ConsoleOpener requests remote consoles of servers, see connector.Connector
+type ConsoleOpener interface {
+	GetConsoleURL(ctx context.Context, id string) (*connector.Console, error)
+}
+
+// StatusStreamer streams the state changes of a cache entry, see statusstream.Broker
+type StatusStreamer interface {
+	Stream(w http.ResponseWriter, r *http.Request, cacheKey string)
+}
+
+// Server serves the admin API and the dashboard
+type Server struct {
+	log     *slog.Logger
+	store   Store
+	token   string
+	console ConsoleOpener
+	health  redis.HealthReporter
+	streams StatusStreamer
+}
+
+// New creates the admin server. A non-empty token is required on every request,
+// either as a bearer token or as the token query parameter.
+func New(log *slog.Logger, store Store, token string) *Server {
+	return &Server{log: log, store: store, token: token}
+}
+
+// WithConsole serves time-limited console URLs of servers from opener. Consoles are only
+// served with a token, since they give root access to the server.
+func (s *Server) WithConsole(opener ConsoleOpener) *Server {
+	s.console = opener
+	return s
+}
+
+// WithStatusStream serves the state changes of each user's server from streamer. Streams
+// are only served with a token, since states carry the credentials of the servers.
+func (s *Server) WithStatusStream(streamer StatusStreamer) *Server {
+	s.streams = streamer
+	return s
+}
+
+// WithHealth reports the state of the connection to Redis in /healthz
+func (s *Server) WithHealth(health redis.HealthReporter) *Server {
+	s.health = health
+	return s
+}
+
+// Handler returns the HTTP handler with all admin routes. /healthz is served without the
+// token, for load balancer and orchestrator probes.
+func (s *Server) Handler() http.Handler {
+	root := http.NewServeMux()
+	root.HandleFunc("GET /healthz", s.handleHealth)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleDashboard)
+	mux.HandleFunc("GET /api/servers", s.handleServers)
+	mux.HandleFunc("GET /api/queues", s.handleQueues)
+	mux.HandleFunc("GET /api/events", s.handleEvents)
+	mux.HandleFunc("GET /api/users/{webuserid}/history", s.handleHistory)
+	mux.HandleFunc("POST /api/servers/{id}/console", s.handleConsole)
+	mux.HandleFunc("GET /v1/users/{webuserid}/status/stream", s.handleStatusStream)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	root.Handle("/", s.authorize(mux))
+	return root
+}
+
+// authorize rejects requests without the admin token, if one is configured
+func (s *Server) authorize(next http.Handler) http.Handler {
+	if s.token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// healthResponse is the health of this instance
+type healthResponse struct {
+	Status string        `json:"status"` // "ok" or "degraded"
+	Redis  *redis.Health `json:"redis,omitempty"`
+}
+
+// handleHealth reports whether this instance can reach Redis: 200 while it can, 503 while
+// the circuit breaker is open or half open
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: "ok"}
+	if s.health != nil {
+		health := s.health.Health()
+		resp.Redis = &health
+		if health.Degraded() {
+			resp.Status = "degraded"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// serversResponse is a page of server states
+type serversResponse struct {
+	Servers    []redis.ServerState `json:"servers"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+// handleServers lists cached servers. Query parameters: status, labId, tenant,
+// expiresFrom and expiresUntil (RFC 3339), cursor and limit.
+func (s *Server) handleServers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := redis.StateFilter{
+		Status: query.Get("status"),
+		Tenant: query.Get("tenant"),
+		Cursor: query.Get("cursor"),
+	}
+
+	var err error
+	if filter.LabID, err = intParam(query.Get("labId")); err != nil {
+		http.Error(w, "invalid labId", http.StatusBadRequest)
+		return
+	}
+	if filter.Limit, err = intParam(query.Get("limit")); err != nil || filter.Limit < 0 || filter.Limit > maxPageSize {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if filter.ExpiresFrom, err = timeParam(query.Get("expiresFrom")); err != nil {
+		http.Error(w, "invalid expiresFrom", http.StatusBadRequest)
+		return
+	}
+	if filter.ExpiresUntil, err = timeParam(query.Get("expiresUntil")); err != nil {
+		http.Error(w, "invalid expiresUntil", http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.store.QueryServerStates(r.Context(), filter)
+	if err != nil {
+		s.fail(w, "failed to query server states", err)
+		return
+	}
+
+	// Windows administrator passwords are for the student only
+	for i := range page.States {
+		page.States[i].Password = ""
+		for name, node := range page.States[i].Nodes {
+			node.Password = ""
+			page.States[i].Nodes[name] = node
+		}
+	}
+
+	resp := serversResponse{Servers: page.States, NextCursor: page.NextCursor}
+	if resp.Servers == nil {
+		resp.Servers = []redis.ServerState{}
+	}
+	writeJSON(w, resp)
+}
+
+// handleQueues reports the number of messages waiting in the Redis queues and their dead-letter queues
+func (s *Server) handleQueues(w http.ResponseWriter, r *http.Request) {
+	depths, err := s.store.QueueDepths(r.Context(), config.ProvisionQueueKey, config.DecommissionQueueKey, config.CleanupQueueKey,
+		config.DeadLetterQueueKey(config.ProvisionQueueKey), config.DeadLetterQueueKey(config.DecommissionQueueKey),
+		config.DeadLetterQueueKey(config.CleanupQueueKey))
+	if err != nil {
+		s.fail(w, "failed to read queue depths", err)
+		return
+	}
+	writeJSON(w, depths)
+}
+
+// eventsResponse holds recent events, newest first
+type eventsResponse struct {
+	Events []redis.Event `json:"events"`
+}
+
+// handleEvents lists recent failures and dropped requests. Query parameters: type and limit.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r.URL.Query().Get("limit"))
+	if err != nil || limit < 0 || limit > config.MaxEvents {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = defaultEventLimit
+	}
+
+	events, err := s.store.RecentEvents(r.Context(), config.MaxEvents)
+	if err != nil {
+		s.fail(w, "failed to read events", err)
+		return
+	}
+
+	eventType := r.URL.Query().Get("type")
+	resp := eventsResponse{Events: []redis.Event{}}
+	for _, event := range events {
+		if eventType != "" && event.Type != eventType {
+			continue
+		}
+		resp.Events = append(resp.Events, event)
+		if len(resp.Events) == limit {
+			break
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// handleHistory lists the recent lifecycle events of the user in the path, newest first.
+// Query parameters: tenant and limit.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := intParam(query.Get("limit"))
+	if err != nil || limit < 0 || limit > config.MaxHistory {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = config.MaxHistory
+	}
+
+	userID := redis.TenantUserID(query.Get("tenant"), r.PathValue("webuserid"))
+	events, err := s.store.UserHistory(r.Context(), userID, limit)
+	if err != nil {
+		s.fail(w, "failed to read history", err)
+		return
+	}
+
+	resp := eventsResponse{Events: events}
+	if resp.Events == nil {
+		resp.Events = []redis.Event{}
+	}
+	writeJSON(w, resp)
+}
+
+// handleConsole requests a remote console for the server with the ID in the path, for
+// instructors helping students whose SSH access is broken
+func (s *Server) handleConsole(w http.ResponseWriter, r *http.Request) {
+	if s.console == nil || s.token == "" {
+		http.Error(w, "consoles require ADMIN_TOKEN", http.StatusForbidden)
+		return
+	}
+	serverID := r.PathValue("id")
+	console, err := s.console.GetConsoleURL(r.Context(), serverID)
+	switch {
+	case errors.Is(err, errs.ErrNotFound):
+		http.Error(w, "server not found", http.StatusNotFound)
+		return
+	case err != nil:
+		s.fail(w, "failed to request console", err)
+		return
+	}
+
+	s.log.Info("console requested", "server_id", serverID, "remote_addr", r.RemoteAddr, "expires_at", console.ExpiresAt)
+	writeJSON(w, console)
+}
+
+// handleStatusStream streams the state changes of a user's server as server-sent events,
+// so LabMan can follow them instead of polling the cache
+func (s *Server) handleStatusStream(w http.ResponseWriter, r *http.Request) {
+	if s.streams == nil || s.token == "" {
+		http.Error(w, "status streams require ADMIN_TOKEN", http.StatusForbidden)
+		return
+	}
+	userID := redis.TenantUserID(r.URL.Query().Get("tenant"), r.PathValue("webuserid"))
+	s.streams.Stream(w, r, redis.ServerCacheKey(userID))
+}
+
+func (s *Server) fail(w http.ResponseWriter, msg string, err error) {
+	s.log.Error(msg, "error", err)
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// intParam parses an optional integer query parameter
+func intParam(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// timeParam parses an optional RFC 3339 query parameter
+func timeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,326 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+type fakeStore struct {
+	filter redis.StateFilter
+	states []redis.ServerState
+	depths map[string]int64
+	events []redis.Event
+
+	history      map[string][]redis.Event // by tenant-scoped user ID
+	historyLimit int
+}
+
+func (f *fakeStore) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	f.filter = filter
+	return &redis.StatePage{States: f.states, NextCursor: "next"}, nil
+}
+
+func (f *fakeStore) QueueDepths(ctx context.Context, queueKeys ...string) (map[string]int64, error) {
+	return f.depths, nil
+}
+
+func (f *fakeStore) RecentEvents(ctx context.Context, limit int) ([]redis.Event, error) {
+	return f.events, nil
+}
+
+func (f *fakeStore) UserHistory(ctx context.Context, userID string, limit int) ([]redis.Event, error) {
+	f.historyLimit = limit
+	return f.history[userID], nil
+}
+
+func newTestHandler(store Store, token string) http.Handler {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(log, store, token).Handler()
+}
+
+func get(t *testing.T, handler http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServers(t *testing.T) {
+	store := &fakeStore{states: []redis.ServerState{{ServerID: "1", WebUserID: "alice", LabID: 12, Status: "running"}}}
+	handler := newTestHandler(store, "")
+
+	rec := get(t, handler, "/api/servers?status=running&labId=12&expiresUntil=2026-03-01T12:00:00Z&cursor=c&limit=10", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	want := redis.StateFilter{
+		Status:       "running",
+		LabID:        12,
+		ExpiresUntil: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		Cursor:       "c",
+		Limit:        10,
+	}
+	if !store.filter.ExpiresUntil.Equal(want.ExpiresUntil) || store.filter.Status != want.Status ||
+		store.filter.LabID != want.LabID || store.filter.Cursor != want.Cursor || store.filter.Limit != want.Limit {
+		t.Errorf("expected filter %+v, got %+v", want, store.filter)
+	}
+
+	var resp serversResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Servers) != 1 || resp.Servers[0].WebUserID != "alice" || resp.NextCursor != "next" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestServers_InvalidParams(t *testing.T) {
+	handler := newTestHandler(&fakeStore{}, "")
+	for _, query := range []string{"labId=x", "limit=-1", "limit=5000", "expiresFrom=yesterday", "expiresUntil=1"} {
+		if rec := get(t, handler, "/api/servers?"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestQueues(t *testing.T) {
+	store := &fakeStore{depths: map[string]int64{config.ProvisionQueueKey: 3, config.DecommissionQueueKey: 1}}
+	rec := get(t, newTestHandler(store, ""), "/api/queues", nil)
+
+	var depths map[string]int64
+	if err := json.Unmarshal(rec.Body.Bytes(), &depths); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if depths[config.ProvisionQueueKey] != 3 || depths[config.DecommissionQueueKey] != 1 {
+		t.Errorf("unexpected depths: %v", depths)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store := &fakeStore{events: []redis.Event{
+		{Type: redis.EventProvisionFailed, WebUserID: "alice"},
+		{Type: redis.EventRateLimited, WebUserID: "bob"},
+		{Type: redis.EventProvisionFailed, WebUserID: "carol"},
+	}}
+	handler := newTestHandler(store, "")
+
+	rec := get(t, handler, "/api/events?type=provision_failed&limit=1", nil)
+	var resp eventsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].WebUserID != "alice" {
+		t.Errorf("expected alice's failure only, got %+v", resp.Events)
+	}
+
+	if rec := get(t, handler, "/api/events?limit=1000", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for limit above %d, got %d", config.MaxEvents, rec.Code)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	store := &fakeStore{history: map[string][]redis.Event{
+		"acme:alice": {
+			{Type: redis.EventExpired, WebUserID: "alice", Tenant: "acme", LabID: 5, Message: "ttl"},
+			{Type: redis.EventProvisionStarted, WebUserID: "alice", Tenant: "acme", LabID: 5},
+		},
+	}}
+	handler := newTestHandler(store, "")
+
+	rec := get(t, handler, "/api/users/alice/history?tenant=acme&limit=10", nil)
+	var resp eventsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Events) != 2 || resp.Events[0].Type != redis.EventExpired || store.historyLimit != 10 {
+		t.Errorf("expected alice's history newest first, got %+v (limit %d)", resp.Events, store.historyLimit)
+	}
+
+	// Without a tenant the default tenant's user is read, who has no history
+	rec = get(t, handler, "/api/users/alice/history", nil)
+	if strings.TrimSpace(rec.Body.String()) != `{"events":[]}` || store.historyLimit != config.MaxHistory {
+		t.Errorf("expected an empty history, got %s (limit %d)", rec.Body.String(), store.historyLimit)
+	}
+
+	if rec := get(t, handler, "/api/users/alice/history?limit=1000", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for limit above %d, got %d", config.MaxHistory, rec.Code)
+	}
+}
+
+// fakeConsoles opens consoles for server "1" only
+type fakeConsoles struct{}
+
+func (fakeConsoles) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	if id != "1" {
+		return nil, connector.NotFound("server %s not found", id)
+	}
+	return &connector.Console{URL: "wss://console.example/1", Password: "pw", ExpiresAt: time.Date(2026, 3, 1, 12, 1, 0, 0, time.UTC)}, nil
+}
+
+func TestConsole(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := New(log, &fakeStore{}, "secret").WithConsole(fakeConsoles{}).Handler()
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+
+	post := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(handler, "/api/servers/1/console")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var console connector.Console
+	if err := json.NewDecoder(rec.Body).Decode(&console); err != nil || console.URL != "wss://console.example/1" || console.Password != "pw" {
+		t.Errorf("unexpected console %+v (%v)", console, err)
+	}
+
+	if rec := post(handler, "/api/servers/2/console"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown server, got %d", rec.Code)
+	}
+	if rec := get(t, handler, "/api/servers/1/console", auth); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+
+	// Without a token, nobody may open a console
+	open := New(log, &fakeStore{}, "").WithConsole(fakeConsoles{}).Handler()
+	if rec := post(open, "/api/servers/1/console"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without ADMIN_TOKEN, got %d", rec.Code)
+	}
+}
+
+// fakeStreamer records the cache key of each stream
+type fakeStreamer struct {
+	cacheKeys []string
+}
+
+func (f *fakeStreamer) Stream(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	f.cacheKeys = append(f.cacheKeys, cacheKey)
+	w.Header().Set("Content-Type", "text/event-stream")
+}
+
+func TestStatusStream(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	streamer := &fakeStreamer{}
+	handler := New(log, &fakeStore{}, "secret").WithStatusStream(streamer).Handler()
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+
+	if rec := get(t, handler, "/v1/users/student-1/status/stream", auth); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get(t, handler, "/v1/users/student-1/status/stream?tenant=acme", auth); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	want := []string{
+		redis.ServerCacheKey("student-1"),
+		redis.ServerCacheKey(redis.TenantUserID("acme", "student-1")),
+	}
+	if strings.Join(streamer.cacheKeys, " ") != strings.Join(want, " ") {
+		t.Errorf("expected streams of %v, got %v", want, streamer.cacheKeys)
+	}
+
+	if rec := get(t, handler, "/v1/users/student-1/status/stream", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the token, got %d", rec.Code)
+	}
+
+	// Without a token, nobody may follow the states, which carry server passwords
+	open := New(log, &fakeStore{}, "").WithStatusStream(streamer).Handler()
+	if rec := get(t, open, "/v1/users/student-1/status/stream", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without ADMIN_TOKEN, got %d", rec.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rec := get(t, newTestHandler(&fakeStore{}, ""), "/metrics", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "go_goroutines") {
+		t.Errorf("expected Prometheus metrics, got %s", rec.Body)
+	}
+}
+
+type fakeHealth redis.Health
+
+func (f fakeHealth) Health() redis.Health {
+	return redis.Health(f)
+}
+
+func TestHealth(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	retryAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		health     *fakeHealth
+		wantCode   int
+		wantStatus string
+	}{
+		{name: "no health reporter", wantCode: http.StatusOK, wantStatus: "ok"},
+		{name: "redis reachable", health: &fakeHealth{Circuit: redis.CircuitClosed}, wantCode: http.StatusOK, wantStatus: "ok"},
+		{name: "circuit open", health: &fakeHealth{Circuit: redis.CircuitOpen, Failures: 5, RetryAt: retryAt},
+			wantCode: http.StatusServiceUnavailable, wantStatus: "degraded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Probes don't send the admin token
+			server := New(log, &fakeStore{}, "secret")
+			if tt.health != nil {
+				server.WithHealth(*tt.health)
+			}
+			rec := get(t, server.Handler(), "/healthz", nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body)
+			}
+			var resp healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if resp.Status != tt.wantStatus {
+				t.Errorf("expected status %s, got %s", tt.wantStatus, resp.Status)
+			}
+			if tt.health != nil && (resp.Redis == nil || resp.Redis.Circuit != tt.health.Circuit || !resp.Redis.RetryAt.Equal(tt.health.RetryAt)) {
+				t.Errorf("expected redis health %+v, got %+v", *tt.health, resp.Redis)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	handler := newTestHandler(&fakeStore{}, "secret")
+
+	if rec := get(t, handler, "/api/queues", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", rec.Code)
+	}
+	if rec := get(t, handler, "/api/queues?token=wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with wrong token, got %d", rec.Code)
+	}
+	if rec := get(t, handler, "/api/queues", http.Header{"Authorization": {"Bearer secret"}}); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with bearer token, got %d", rec.Code)
+	}
+
+	rec := get(t, handler, "/?token=secret", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "SWIM status") {
+		t.Errorf("expected dashboard with query token, got %d", rec.Code)
+	}
+}
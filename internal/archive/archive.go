@@ -0,0 +1,248 @@
+// Package archive keeps a compact, immutable record of every completed lab session, in a
+// Redis stream or a rotated JSON Lines file, for course analytics. Records outlive the
+// cache entries and user histories, which only cover running labs and recent events.
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Defaults of the stream length and of the file rotation
+const (
+	DefaultStreamMaxLen = 100000
+	DefaultFileMaxSize  = 100 << 20 // bytes
+	DefaultFileMaxFiles = 10
+)
+
+// Archiver keeps the records of completed sessions
+type Archiver interface {
+	Archive(ctx context.Context, record redis.SessionRecord) error
+}
+
+// Record returns the record of the session of state, which ended at endedAt for reason
+func Record(state redis.ServerState, provider, reason string, endedAt time.Time) redis.SessionRecord {
+	record := redis.SessionRecord{
+		WebUserID:     state.WebUserID,
+		Tenant:        state.Tenant,
+		LabID:         state.LabID,
+		ServerID:      state.ServerID,
+		ServerType:    state.ServerType,
+		Provider:      provider,
+		StartedAt:     state.CreatedAt,
+		EndedAt:       endedAt,
+		ExitReason:    reason,
+		CorrelationID: state.CorrelationID,
+	}
+	if !record.StartedAt.IsZero() {
+		record.DurationSeconds = int64(endedAt.Sub(record.StartedAt).Seconds())
+		if !state.AvailableAt.IsZero() {
+			record.ProvisionSeconds = int64(state.AvailableAt.Sub(record.StartedAt).Seconds())
+		}
+	}
+	return record
+}
+
+// Stream archives records in the config.SessionsKey Redis stream
+type Stream struct {
+	stream redis.SessionStream
+	maxLen int64
+}
+
+// NewStream archives records in stream, trimmed to about maxLen records (0 keeps all)
+func NewStream(stream redis.SessionStream, maxLen int64) *Stream {
+	return &Stream{stream: stream, maxLen: maxLen}
+}
+
+// Archive appends record to the stream
+func (s *Stream) Archive(ctx context.Context, record redis.SessionRecord) error {
+	return s.stream.AppendSession(ctx, record, s.maxLen)
+}
+
+// File archives records as JSON Lines. Once a write would take the file past its maximum
+// size, it is renamed to path.1, older files move up one number and the oldest is removed.
+type File struct {
+	path     string
+	maxSize  int64 // bytes
+	maxFiles int   // rotated files kept next to the current one
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenFile archives records in the file at path, appending to it if it exists. The file is
+// rotated at maxSize bytes, keeping maxFiles rotated files.
+func OpenFile(path string, maxSize int64, maxFiles int) (*File, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maximum size must be positive, got %d", maxSize)
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("maximum rotated files must not be negative, got %d", maxFiles)
+	}
+	f := &File{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current file for appending. Must be called with f.mu held or before f is shared.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("open session archive: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("open session archive: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Archive appends record as one line, rotating the file first if the line doesn't fit
+func (f *File) Archive(ctx context.Context, record redis.SessionRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal session record: %w", err)
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return errors.New("session archive closed")
+	}
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write session archive: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the current file to path.1 and opens a new one. If the files can't be moved,
+// writing goes on in the current file. Must be called with f.mu held.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("close session archive: %w", err)
+	}
+	f.file = nil
+
+	moveErr := f.moveFiles()
+	if err := f.open(); err != nil {
+		return err
+	}
+	if moveErr != nil {
+		return fmt.Errorf("rotate session archive: %w", moveErr)
+	}
+	return nil
+}
+
+// moveFiles moves every file one number up, removing the oldest
+func (f *File) moveFiles() error {
+	if f.maxFiles == 0 {
+		return removeIfExists(f.path)
+	}
+	if err := removeIfExists(f.rotated(f.maxFiles)); err != nil {
+		return err
+	}
+	for n := f.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(f.rotated(n), f.rotated(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.rotated(1))
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// rotated returns the path of the nth rotated file, 1 being the newest
+func (f *File) rotated(n int) string {
+	return rotatedPath(f.path, n)
+}
+
+func rotatedPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// Close closes the current file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// ReadFile returns the records of the archive file at path and its rotated files that ended
+// at or after since, oldest first. maxFiles is the number of rotated files to look for.
+func ReadFile(path string, maxFiles int, since time.Time) ([]redis.SessionRecord, error) {
+	var records []redis.SessionRecord
+	// Rotated files are read from the oldest one down to the current file
+	for n := maxFiles; n >= 0; n-- {
+		name := path
+		if n > 0 {
+			name = rotatedPath(path, n)
+		}
+		data, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read session archive: %w", err)
+		}
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var record redis.SessionRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, fmt.Errorf("read session archive %s line %d: %w", name, i+1, err)
+			}
+			if !record.EndedAt.Before(since) {
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
+
+// Multi archives every record with each of its archivers
+type Multi []Archiver
+
+// Archive archives record with every archiver, returning the errors of those that failed
+func (m Multi) Archive(ctx context.Context, record redis.SessionRecord) error {
+	var failed []error
+	for _, archiver := range m {
+		if err := archiver.Archive(ctx, record); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+// readRecords returns the records in the JSON Lines file at path
+func readRecords(t *testing.T, path string) []redis.SessionRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []redis.SessionRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record redis.SessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestFile_Rotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	line, _ := json.Marshal(redis.SessionRecord{WebUserID: "user-0", ServerID: "1", ExitReason: redis.ExitUser})
+	// Room for two records per file
+	file, err := OpenFile(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	for _, user := range []string{"user-0", "user-1", "user-2", "user-3", "user-4", "user-5", "user-6"} {
+		if err := file.Archive(ctx, redis.SessionRecord{WebUserID: user, ServerID: "1", ExitReason: redis.ExitUser}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path  string
+		users []string
+	}{
+		{path, []string{"user-6"}},
+		{path + ".1", []string{"user-4", "user-5"}},
+		{path + ".2", []string{"user-2", "user-3"}},
+	} {
+		records := readRecords(t, tt.path)
+		if len(records) != len(tt.users) {
+			t.Fatalf("expected %d records in %s, got %+v", len(tt.users), tt.path, records)
+		}
+		for i, record := range records {
+			if record.WebUserID != tt.users[i] {
+				t.Errorf("expected %s in %s, got %s", tt.users[i], tt.path, record.WebUserID)
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the oldest file removed, got %v", err)
+	}
+}
+
+func TestFile_AppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	ctx := context.Background()
+	for _, user := range []string{"user-0", "user-1"} {
+		file, err := OpenFile(path, DefaultFileMaxSize, DefaultFileMaxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Archive(ctx, redis.SessionRecord{WebUserID: user}); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	if records := readRecords(t, path); len(records) != 2 {
+		t.Errorf("expected the records of both runs, got %+v", records)
+	}
+}
+
+func TestOpenFile_InvalidLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	if _, err := OpenFile(path, 0, 1); err == nil {
+		t.Error("expected an error for a zero maximum size")
+	}
+	if _, err := OpenFile(path, 1024, -1); err == nil {
+		t.Error("expected an error for a negative number of files")
+	}
+}
+
+type failingArchiver struct{}
+
+func (failingArchiver) Archive(ctx context.Context, record redis.SessionRecord) error {
+	return errors.New("disk full")
+}
+
+func TestMulti(t *testing.T) {
+	store := redistest.New()
+	multi := Multi{failingArchiver{}, NewStream(store, 2)}
+
+	ctx := context.Background()
+	for _, user := range []string{"user-0", "user-1", "user-2"} {
+		if err := multi.Archive(ctx, redis.SessionRecord{WebUserID: user}); err == nil {
+			t.Error("expected the failure of one archiver reported")
+		}
+	}
+	// The stream keeps archiving despite the failing archiver, trimmed to its length
+	sessions := store.Sessions()
+	if len(sessions) != 2 || sessions[0].WebUserID != "user-1" || sessions[1].WebUserID != "user-2" {
+		t.Errorf("expected the last 2 records in the stream, got %+v", sessions)
+	}
+}
+
+func TestReadFile_RotatedOldestFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	ended := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	line, _ := json.Marshal(redis.SessionRecord{WebUserID: "user-0", ServerID: "1", EndedAt: ended, ExitReason: redis.ExitUser})
+	file, err := OpenFile(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	ctx := context.Background()
+	for i, user := range []string{"user-0", "user-1", "user-2", "user-3", "user-4"} {
+		record := redis.SessionRecord{WebUserID: user, ServerID: "1", EndedAt: ended.Add(time.Duration(i) * time.Hour), ExitReason: redis.ExitUser}
+		if err := file.Archive(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := ReadFile(path, 2, ended.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"user-1", "user-2", "user-3", "user-4"}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %+v", len(want), records)
+	}
+	for i, record := range records {
+		if record.WebUserID != want[i] {
+			t.Errorf("expected %s at %d, got %s", want[i], i, record.WebUserID)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	created := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	state := redis.ServerState{WebUserID: "alice", LabID: 7, ServerID: "42", CreatedAt: created, AvailableAt: created.Add(90 * time.Second)}
+
+	record := Record(state, "hetzner", redis.ExitUser, created.Add(time.Hour))
+	if record.DurationSeconds != 3600 || record.ProvisionSeconds != 90 {
+		t.Errorf("expected 3600s duration and 90s provisioning, got %+v", record)
+	}
+	if record.Provider != "hetzner" || record.ExitReason != redis.ExitUser || record.LabID != 7 {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	state.CreatedAt = time.Time{}
+	if record := Record(state, "hetzner", redis.ExitUser, created.Add(time.Hour)); record.DurationSeconds != 0 || record.ProvisionSeconds != 0 {
+		t.Errorf("expected no durations without a start time, got %+v", record)
+	}
+}
@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// LabStats sums up the archived sessions of a lab
+type LabStats struct {
+	LabID    int `json:"labId"`
+	Sessions int `json:"sessions"`
+	Failed   int `json:"failed"` // sessions whose provision failed
+
+	FailureRate           float64 `json:"failureRate"`           // Failed / Sessions
+	MedianDurationSeconds int64   `json:"medianDurationSeconds"` // of the sessions that didn't fail
+	AvgProvisionSeconds   float64 `json:"avgProvisionSeconds"`   // of the sessions that recorded a provisioning time
+}
+
+// Summary sums up archived sessions per lab, ordered by lab ID, and over all labs
+type Summary struct {
+	Labs  []LabStats `json:"labs"`
+	Total LabStats   `json:"total"`
+}
+
+// Summarize sums up records per lab. Records without a start time count as sessions but not
+// toward the median duration, since their duration is unknown.
+func Summarize(records []redis.SessionRecord) Summary {
+	byLab := make(map[int][]redis.SessionRecord)
+	for _, record := range records {
+		byLab[record.LabID] = append(byLab[record.LabID], record)
+	}
+
+	summary := Summary{Labs: make([]LabStats, 0, len(byLab)), Total: summarizeLab(records)}
+	for labID, labRecords := range byLab {
+		stats := summarizeLab(labRecords)
+		stats.LabID = labID
+		summary.Labs = append(summary.Labs, stats)
+	}
+	slices.SortFunc(summary.Labs, func(a, b LabStats) int { return cmp.Compare(a.LabID, b.LabID) })
+	return summary
+}
+
+func summarizeLab(records []redis.SessionRecord) LabStats {
+	stats := LabStats{Sessions: len(records)}
+	var durations []int64
+	var provisionTotal int64
+	provisioned := 0
+	for _, record := range records {
+		if record.ExitReason == redis.ExitProvisionFailed {
+			stats.Failed++
+			continue
+		}
+		if !record.StartedAt.IsZero() {
+			durations = append(durations, record.DurationSeconds)
+		}
+		if record.ProvisionSeconds > 0 {
+			provisionTotal += record.ProvisionSeconds
+			provisioned++
+		}
+	}
+	if stats.Sessions > 0 {
+		stats.FailureRate = float64(stats.Failed) / float64(stats.Sessions)
+	}
+	stats.MedianDurationSeconds = median(durations)
+	if provisioned > 0 {
+		stats.AvgProvisionSeconds = float64(provisionTotal) / float64(provisioned)
+	}
+	return stats
+}
+
+// median returns the median of values, 0 if there are none. values is sorted in place.
+func median(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	slices.Sort(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
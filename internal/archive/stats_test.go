@@ -0,0 +1,44 @@
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+func TestSummarize(t *testing.T) {
+	started := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	session := func(labID int, duration, provision int64, reason string) redis.SessionRecord {
+		return redis.SessionRecord{LabID: labID, StartedAt: started, DurationSeconds: duration, ProvisionSeconds: provision, ExitReason: reason}
+	}
+	summary := Summarize([]redis.SessionRecord{
+		session(2, 600, 0, redis.ExitProvisionFailed),
+		session(1, 100, 30, redis.ExitUser),
+		session(1, 300, 60, "ttl"),
+		session(1, 200, 0, redis.ExitSwitch),
+		session(2, 1000, 40, redis.ExitUser),
+		// Without a start time the duration is unknown
+		{LabID: 2, ExitReason: redis.ExitUser},
+	})
+
+	if len(summary.Labs) != 2 || summary.Labs[0].LabID != 1 || summary.Labs[1].LabID != 2 {
+		t.Fatalf("expected labs 1 and 2 in order, got %+v", summary.Labs)
+	}
+	if lab := summary.Labs[0]; lab.Sessions != 3 || lab.Failed != 0 || lab.MedianDurationSeconds != 200 || lab.AvgProvisionSeconds != 45 {
+		t.Errorf("unexpected stats of lab 1: %+v", lab)
+	}
+	if lab := summary.Labs[1]; lab.Sessions != 3 || lab.Failed != 1 || lab.FailureRate != 1.0/3 || lab.MedianDurationSeconds != 1000 || lab.AvgProvisionSeconds != 40 {
+		t.Errorf("unexpected stats of lab 2: %+v", lab)
+	}
+	if total := summary.Total; total.Sessions != 6 || total.Failed != 1 || total.MedianDurationSeconds != 250 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+}
+
+func TestSummarize_Empty(t *testing.T) {
+	summary := Summarize(nil)
+	if len(summary.Labs) != 0 || summary.Total.Sessions != 0 || summary.Total.FailureRate != 0 {
+		t.Errorf("expected an empty summary, got %+v", summary)
+	}
+}
@@ -0,0 +1,117 @@
+// Package chaos injects failures into the connector and Redis client for testing
+// retry and recovery behaviour. It must never be enabled in production.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// ErrInjected marks every failure produced by chaos mode
+var ErrInjected = fmt.Errorf("chaos: injected failure")
+
+// Config controls which failures are injected and how often
+type Config struct {
+	CreateErrorRate  float64       // probability that CreateServer fails
+	StateDelay       time.Duration // how long servers stay "initializing" before reporting their real state
+	RedisTimeoutRate float64       // probability that a Redis call times out
+	RedisTimeout     time.Duration // how long an injected Redis timeout blocks
+	DeleteDropRate   float64       // probability that Delete reports success without deleting
+	Seed             uint64        // random seed, 0 picks a random one
+}
+
+// ConfigFromEnv reads the chaos settings from CHAOS_* environment variables
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		RedisTimeout: 2 * time.Second,
+	}
+
+	var err error
+	if cfg.CreateErrorRate, err = rateFromEnv("CHAOS_CREATE_ERROR_RATE"); err != nil {
+		return cfg, err
+	}
+	if cfg.RedisTimeoutRate, err = rateFromEnv("CHAOS_REDIS_TIMEOUT_RATE"); err != nil {
+		return cfg, err
+	}
+	if cfg.DeleteDropRate, err = rateFromEnv("CHAOS_DELETE_DROP_RATE"); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("CHAOS_STATE_DELAY"); v != "" {
+		if cfg.StateDelay, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid CHAOS_STATE_DELAY: %w", err)
+		}
+	}
+	if v := os.Getenv("CHAOS_REDIS_TIMEOUT"); v != "" {
+		if cfg.RedisTimeout, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid CHAOS_REDIS_TIMEOUT: %w", err)
+		}
+	}
+	if v := os.Getenv("CHAOS_SEED"); v != "" {
+		if cfg.Seed, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("invalid CHAOS_SEED: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// rateFromEnv parses a probability between 0 and 1
+func rateFromEnv(name string) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid %s: must be a number between 0 and 1", name)
+	}
+	return rate, nil
+}
+
+// Injector decides when to inject failures. It is safe for concurrent use.
+type Injector struct {
+	cfg Config
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewInjector creates an Injector for cfg
+func NewInjector(cfg Config) *Injector {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &Injector{
+		cfg: cfg,
+		rng: rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// roll returns true with the given probability
+func (i *Injector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rng.Float64() < rate
+}
+
+// redisTimeout blocks for the configured timeout (or until ctx is done) and returns a timeout error
+func (i *Injector) redisTimeout(ctx context.Context, op string) error {
+	timer := time.NewTimer(i.cfg.RedisTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return errs.Mark(fmt.Errorf("%s: %w: %w", op, ErrInjected, context.DeadlineExceeded), errs.ErrTransient)
+}
@@ -0,0 +1,153 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+type mockServer struct {
+	connector.Server
+	deleted int
+}
+
+func (m *mockServer) GetState(ctx context.Context) (string, error) { return "running", nil }
+func (m *mockServer) Delete(ctx context.Context) error             { m.deleted++; return nil }
+func (m *mockServer) Rebuild(ctx context.Context) error            { return nil }
+func (m *mockServer) Resize(ctx context.Context, t string) error   { return nil }
+
+type mockConnector struct {
+	connector.Connector
+	server  *mockServer
+	creates int
+}
+
+func (m *mockConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
+	m.creates++
+	return m.server, nil
+}
+
+func (m *mockConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	return m.server, nil
+}
+
+type mockClient struct {
+	redis.ClientInterface
+	gets int
+}
+
+func (m *mockClient) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	m.gets++
+	return &redis.ServerState{}, nil
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("CHAOS_CREATE_ERROR_RATE", "0.25")
+	t.Setenv("CHAOS_STATE_DELAY", "30s")
+	t.Setenv("CHAOS_REDIS_TIMEOUT_RATE", "0.1")
+	t.Setenv("CHAOS_DELETE_DROP_RATE", "1")
+	t.Setenv("CHAOS_SEED", "42")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv failed: %v", err)
+	}
+	want := Config{CreateErrorRate: 0.25, StateDelay: 30 * time.Second, RedisTimeoutRate: 0.1, RedisTimeout: 2 * time.Second, DeleteDropRate: 1, Seed: 42}
+	if cfg != want {
+		t.Errorf("expected %+v, got %+v", want, cfg)
+	}
+
+	for _, bad := range []string{"1.5", "-0.1", "often"} {
+		t.Setenv("CHAOS_CREATE_ERROR_RATE", bad)
+		if _, err := ConfigFromEnv(); err == nil {
+			t.Errorf("expected error for rate %q", bad)
+		}
+	}
+}
+
+func TestWrapConnector_CreateErrors(t *testing.T) {
+	inner := &mockConnector{server: &mockServer{}}
+
+	conn := WrapConnector(inner, NewInjector(Config{CreateErrorRate: 1, Seed: 1}))
+	if _, err := conn.CreateServer(context.Background(), "{}"); !errors.Is(err, ErrInjected) {
+		t.Errorf("expected injected error, got %v", err)
+	}
+	if inner.creates != 0 {
+		t.Error("expected the real CreateServer not to be called")
+	}
+
+	conn = WrapConnector(inner, NewInjector(Config{Seed: 1}))
+	if _, err := conn.CreateServer(context.Background(), "{}"); err != nil {
+		t.Errorf("expected no error with zero rate, got %v", err)
+	}
+}
+
+func TestWrapConnector_DelayedState(t *testing.T) {
+	inner := &mockConnector{server: &mockServer{}}
+	conn := WrapConnector(inner, NewInjector(Config{StateDelay: 30 * time.Millisecond, Seed: 1}))
+
+	server, err := conn.CreateServer(context.Background(), "{}")
+	if err != nil {
+		t.Fatalf("CreateServer failed: %v", err)
+	}
+	if state, _ := server.GetState(context.Background()); state != "initializing" {
+		t.Errorf("expected initializing during delay, got %s", state)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if state, _ := server.GetState(context.Background()); state != "running" {
+		t.Errorf("expected real state after delay, got %s", state)
+	}
+}
+
+func TestWrapConnector_DroppedDeletes(t *testing.T) {
+	inner := &mockConnector{server: &mockServer{}}
+	conn := WrapConnector(inner, NewInjector(Config{DeleteDropRate: 1, Seed: 1}))
+
+	server, _ := conn.GetServerByID(context.Background(), "1")
+	if err := server.Delete(context.Background()); err != nil {
+		t.Errorf("expected dropped delete to report success, got %v", err)
+	}
+	if inner.server.deleted != 0 {
+		t.Error("expected the real Delete not to be called")
+	}
+}
+
+func TestWrapClient_Timeouts(t *testing.T) {
+	inner := &mockClient{}
+	client := WrapClient(inner, NewInjector(Config{RedisTimeoutRate: 1, RedisTimeout: time.Millisecond, Seed: 1}))
+
+	_, err := client.GetServerState(context.Background(), "key")
+	if !errors.Is(err, ErrInjected) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected injected timeout, got %v", err)
+	}
+	if inner.gets != 0 {
+		t.Error("expected the real call not to be made")
+	}
+
+	client = WrapClient(inner, NewInjector(Config{Seed: 1}))
+	if _, err := client.GetServerState(context.Background(), "key"); err != nil {
+		t.Errorf("expected no error with zero rate, got %v", err)
+	}
+}
+
+func TestInjector_RateIsApproximate(t *testing.T) {
+	injector := NewInjector(Config{Seed: 7})
+
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if injector.roll(0.3) {
+			hits++
+		}
+	}
+	if hits < 200 || hits > 400 {
+		t.Errorf("expected roughly 300 hits, got %d", hits)
+	}
+	if injector.roll(0) {
+		t.Error("expected zero rate never to hit")
+	}
+}
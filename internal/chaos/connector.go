@@ -0,0 +1,112 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+)
+
+// WrapConnector returns a connector that fails CreateServer, delays state transitions
+// and drops deletes according to the injector's configuration
+func WrapConnector(conn connector.Connector, injector *Injector) connector.Connector {
+	return &chaosConnector{Connector: conn, injector: injector}
+}
+
+type chaosConnector struct {
+	connector.Connector
+	injector *Injector
+}
+
+func (c *chaosConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
+	if c.injector.roll(c.injector.cfg.CreateErrorRate) {
+		return nil, fmt.Errorf("create server: %w", ErrInjected)
+	}
+	server, err := c.Connector.CreateServer(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapServer(server), nil
+}
+
+func (c *chaosConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	server, err := c.Connector.GetServerByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapServer(server), nil
+}
+
+func (c *chaosConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	server, err := c.Connector.GetServerByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapServer(server), nil
+}
+
+func (c *chaosConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	servers, err := c.Connector.GetServersByLabel(ctx, key, value)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapServers(servers), nil
+}
+
+func (c *chaosConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
+	servers, err := c.Connector.ListServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrapServers(servers), nil
+}
+
+func (c *chaosConnector) ProvisionFailed(cloudState string) bool {
+	return connector.ProvisionFailed(c.Connector, cloudState)
+}
+
+func (c *chaosConnector) LabServerTypes(labID int) []string {
+	if types, ok := c.Connector.(connector.ServerTypes); ok {
+		return types.LabServerTypes(labID)
+	}
+	return nil
+}
+
+func (c *chaosConnector) wrapServers(servers []connector.Server) []connector.Server {
+	wrapped := make([]connector.Server, len(servers))
+	for i, server := range servers {
+		wrapped[i] = c.wrapServer(server)
+	}
+	return wrapped
+}
+
+func (c *chaosConnector) wrapServer(server connector.Server) connector.Server {
+	return &chaosServer{
+		Server:     server,
+		injector:   c.injector,
+		delayUntil: time.Now().Add(c.injector.cfg.StateDelay),
+	}
+}
+
+// chaosServer reports "initializing" until delayUntil and may drop deletes
+type chaosServer struct {
+	connector.Server
+	injector   *Injector
+	delayUntil time.Time
+}
+
+func (s *chaosServer) GetState(ctx context.Context) (string, error) {
+	if time.Now().Before(s.delayUntil) {
+		return "initializing", nil
+	}
+	return s.Server.GetState(ctx)
+}
+
+func (s *chaosServer) Delete(ctx context.Context) error {
+	if s.injector.roll(s.injector.cfg.DeleteDropRate) {
+		// Report success without deleting, like a provider that silently lost the request
+		return nil
+	}
+	return s.Server.Delete(ctx)
+}
@@ -0,0 +1,90 @@
+package chaos
+
+import (
+	"context"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// WrapClient returns a Redis client whose cache, rate limit and queue push operations
+// time out according to the injector's configuration. Blocking pops are left alone.
+func WrapClient(client redis.ClientInterface, injector *Injector) redis.ClientInterface {
+	return &chaosClient{ClientInterface: client, injector: injector}
+}
+
+type chaosClient struct {
+	redis.ClientInterface
+	injector *Injector
+}
+
+// timeout returns an injected timeout error, or nil to let the call through
+func (c *chaosClient) timeout(ctx context.Context, op string) error {
+	if !c.injector.roll(c.injector.cfg.RedisTimeoutRate) {
+		return nil
+	}
+	return c.injector.redisTimeout(ctx, op)
+}
+
+func (c *chaosClient) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	if err := c.timeout(ctx, "push payload"); err != nil {
+		return err
+	}
+	return c.ClientInterface.PushPayload(ctx, queueKey, payload)
+}
+
+func (c *chaosClient) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	if err := c.timeout(ctx, "push payloads"); err != nil {
+		return err
+	}
+	return c.ClientInterface.PushPayloads(ctx, queueKey, payloads)
+}
+
+func (c *chaosClient) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	if err := c.timeout(ctx, "push server state"); err != nil {
+		return err
+	}
+	return c.ClientInterface.PushServerState(ctx, cacheKey, state, ttl)
+}
+
+func (c *chaosClient) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	if err := c.timeout(ctx, "get server state"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.GetServerState(ctx, cacheKey)
+}
+
+func (c *chaosClient) GetExpiredServerStates(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+	if err := c.timeout(ctx, "get expired server states"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.GetExpiredServerStates(ctx, now)
+}
+
+func (c *chaosClient) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	if err := c.timeout(ctx, "query server states"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.QueryServerStates(ctx, filter)
+}
+
+func (c *chaosClient) DeleteServerState(ctx context.Context, cacheKey string) error {
+	if err := c.timeout(ctx, "delete server state"); err != nil {
+		return err
+	}
+	return c.ClientInterface.DeleteServerState(ctx, cacheKey)
+}
+
+func (c *chaosClient) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
+	if err := c.timeout(ctx, "acquire rate limit"); err != nil {
+		return false, err
+	}
+	return c.ClientInterface.TryAcquireRateLimit(ctx, webUserID, operation, ttl)
+}
+
+func (c *chaosClient) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	if err := c.timeout(ctx, "admit provision"); err != nil {
+		return nil, err
+	}
+	return c.ClientInterface.AdmitProvision(ctx, cacheKey, state, limits, cacheTTL)
+}
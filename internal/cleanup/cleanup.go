@@ -3,16 +3,24 @@ package cleanup
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/clock"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/flags"
 	"github.com/alex-sviridov/swim/internal/redis"
 )
 
 const (
 	cleanupInterval = 5 * time.Minute
+
+	// cleanupPageSize is the number of expired states read from the cache at a time
+	cleanupPageSize = 500
 )
 
 // Worker handles periodic cleanup of expired servers
@@ -20,6 +28,18 @@ type Worker struct {
 	log         *slog.Logger
 	conn        connector.Connector
 	redisClient redis.ClientInterface
+	workers     int           // pages processed at once
+	interval    time.Duration // time between cleanup runs
+	clock       clock.Clock   // tells which servers expired
+
+	// activity, when set, replaces the fixed TTL with idle-based expiry
+	activity    redis.ActivityReader
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	history   redis.HistoryRecorder
+	sequencer redis.Sequencer
+	flags     *flags.Reader
 }
 
 // New creates a new cleanup Worker
@@ -28,7 +48,60 @@ func New(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInt
 		log:         log,
 		conn:        conn,
 		redisClient: redisClient,
+		workers:     config.GetCleanupWorkers(),
+		interval:    cleanupInterval,
+		clock:       clock.Real,
+	}
+}
+
+// WithInterval sets the time between cleanup runs (default: 5 minutes)
+func (w *Worker) WithInterval(interval time.Duration) *Worker {
+	w.interval = interval
+	return w
+}
+
+// WithClock expires servers by c instead of the system clock
+func (w *Worker) WithClock(c clock.Clock) *Worker {
+	w.clock = c
+	return w
+}
+
+// WithWorkers sets how many pages of states are processed at once (default: CLEANUP_WORKERS)
+func (w *Worker) WithWorkers(workers int) *Worker {
+	if workers > 0 {
+		w.workers = workers
 	}
+	return w
+}
+
+// WithIdleExpiry decommissions servers whose user has not been active for idleTimeout,
+// instead of at their fixed expiry, so active users keep their server and idle ones lose
+// it sooner. A server counts as active from its creation, and runs for maxLifetime at most.
+// Entries from before creation times were cached keep the fixed TTL.
+func (w *Worker) WithIdleExpiry(activity redis.ActivityReader, idleTimeout, maxLifetime time.Duration) *Worker {
+	w.activity = activity
+	w.idleTimeout = idleTimeout
+	w.maxLifetime = maxLifetime
+	return w
+}
+
+// WithHistory records in each user's history why their server expired
+func (w *Worker) WithHistory(recorder redis.HistoryRecorder) *Worker {
+	w.history = recorder
+	return w
+}
+
+// WithSequencer numbers each decommission request in the user's operation sequence, so a
+// provision the user queued before it can't be served after it, see redis.Sequencer
+func (w *Worker) WithSequencer(sequencer redis.Sequencer) *Worker {
+	w.sequencer = sequencer
+	return w
+}
+
+// WithFlags reads runtime feature flags from reader; runs are skipped while pause-cleanup is on
+func (w *Worker) WithFlags(reader *flags.Reader) *Worker {
+	w.flags = reader
+	return w
 }
 
 // Run starts the cleanup worker, running until context is cancelled
@@ -38,7 +111,7 @@ func (w *Worker) Run(ctx context.Context) {
 	// Run cleanup immediately on startup
 	w.cleanupExpiredServers(ctx)
 
-	ticker := time.NewTicker(cleanupInterval)
+	ticker := time.NewTicker(w.interval)
 	defer ticker.Stop()
 
 	for {
@@ -52,65 +125,269 @@ func (w *Worker) Run(ctx context.Context) {
 	}
 }
 
-// cleanupExpiredServers finds expired servers and pushes decommission requests to queue
+// cleanupExpiredServers finds expired servers and pushes decommission requests to queue.
+// Expired states are read from the expiry index a page at a time, so a large backlog
+// of expired servers is never loaded at once. With idle expiry every state is read,
+// since any server may have gone idle. While the next page is read, up to w.workers
+// pages are checked and pushed, each in a single round trip.
 func (w *Worker) cleanupExpiredServers(ctx context.Context) {
-	// Get all server states
-	servers, err := w.redisClient.GetAllServerStates(ctx, config.ServerCachePrefix)
-	if err != nil {
-		w.log.Error("failed to get server states", "error", err)
+	if w.flags.Enabled(ctx, flags.PauseCleanup) {
+		w.log.Warn("cleanup paused by feature flag, skipping run", "flag", flags.PauseCleanup)
 		return
 	}
+	now := w.clock.Now()
 
-	if len(servers) == 0 {
-		return
+	// A failed push stops the run: the queue is likely unavailable for the other pages too
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	pages := make(chan []redis.ServerState)
+	var queued atomic.Int64
+	var wg sync.WaitGroup
+	for range w.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for states := range pages {
+				count, ok := w.queueDecommissions(ctx, now, states)
+				queued.Add(int64(count))
+				if !ok {
+					stop()
+				}
+			}
+		}()
 	}
 
-	now := time.Now()
-	expiredCount := 0
+	filter := redis.StateFilter{ExpiresUntil: now, Limit: cleanupPageSize}
+	if w.activity != nil {
+		filter.ExpiresUntil = time.Time{}
+	}
+read:
+	for {
+		page, err := w.redisClient.QueryServerStates(ctx, filter)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.log.Error("failed to get expired server states", "error", err)
+			}
+			break
+		}
+
+		select {
+		case pages <- page.States:
+		case <-ctx.Done():
+			break read
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	close(pages)
+	wg.Wait()
+
+	if count := queued.Load(); count > 0 {
+		w.log.Info("found expired servers, pushed decommission requests", "count", count)
+	}
+}
+
+// queueDecommissions pushes a decommission request for every expired server in states and
+// records the idle expiry of the others, each in a single round trip.
+// Returns the number of requests pushed and false if cleanup should stop.
+func (w *Worker) queueDecommissions(ctx context.Context, now time.Time, states []redis.ServerState) (int, bool) {
+	var payloads []string
+	var expired []redis.Event
+	idle := make(map[string]redis.ServerState)
 
-	for _, state := range servers {
+	activity := w.lastActivity(ctx, states)
+	for _, state := range states {
 		// Check if context was cancelled
 		select {
 		case <-ctx.Done():
 			w.log.Info("cleanup interrupted, stopping")
-			return
+			return 0, false
 		default:
 		}
 
-		// Check if server is expired
+		// Re-check expiry: the state may have been extended after the index was read
+		reason := w.expiryReason(state, now, activity)
+		if reason == "" {
+			if idleExpiresAt, ok := w.idleExpiry(state, activity); ok {
+				state.IdleExpiresAt = idleExpiresAt
+				idle[state.CacheKey()] = state
+			}
+			continue
+		}
+
+		payload, err := decommissionPayload(state, w.nextSequence(ctx, state), reason)
+		if err != nil {
+			w.log.Error("failed to marshal decommission request", "error", err)
+			continue
+		}
+		payloads = append(payloads, payload)
+		// Failed deletions are queued again on every run and are in the history already
+		if reason != "failed" {
+			expired = append(expired, redis.Event{Type: redis.EventExpired, WebUserID: state.WebUserID, Tenant: state.Tenant,
+				LabID: state.LabID, ServerID: state.ServerID, Message: reason, CorrelationID: state.CorrelationID})
+		}
+
+		w.log.Info("queueing decommission request for expired server",
+			"reason", reason,
+			"server_id", state.ServerID,
+			"webuserid", state.WebUserID,
+			"labid", state.LabID)
+	}
+	w.recordIdleExpiries(ctx, idle)
+
+	if len(payloads) == 0 {
+		return 0, true
+	}
+
+	// Push the page's requests in a single round trip
+	if err := w.redisClient.PushPayloads(ctx, config.CleanupQueueKey, payloads); err != nil {
+		w.log.Error("failed to push decommission requests", "count", len(payloads), "error", err)
+		return 0, false
+	}
+	for _, event := range expired {
+		w.recordHistory(ctx, event)
+	}
+	return len(payloads), true
+}
+
+// recordHistory keeps an event in the history of its user.
+// History is informational, so a failure is only logged.
+func (w *Worker) recordHistory(ctx context.Context, event redis.Event) {
+	if w.history == nil {
+		return
+	}
+	event.Operation = "cleanup"
+	if err := w.history.RecordHistory(ctx, redis.TenantUserID(event.Tenant, event.WebUserID), event); err != nil {
+		w.log.Warn("failed to record history", "webuserid", event.WebUserID, "type", event.Type, "error", err)
+	}
+}
+
+// lastActivity returns the last activity of the users of states, keyed by tenant-scoped
+// user ID. Without idle expiry, or if activity can't be read, it returns nil.
+func (w *Worker) lastActivity(ctx context.Context, states []redis.ServerState) map[string]time.Time {
+	if w.activity == nil || len(states) == 0 {
+		return nil
+	}
+	userIDs := make([]string, len(states))
+	for i, state := range states {
+		userIDs[i] = redis.TenantUserID(state.Tenant, state.WebUserID)
+	}
+	activity, err := w.activity.LastActivity(ctx, userIDs)
+	if err != nil {
+		// Without activity servers look idle since creation, which would cut off active users
+		w.log.Warn("failed to read user activity, using fixed expiry", "error", err)
+		return nil
+	}
+	return activity
+}
+
+// expiryReason returns why a server is due for decommissioning, or "" if it isn't.
+// A nil activity map falls back to the fixed TTL.
+func (w *Worker) expiryReason(state redis.ServerState, now time.Time, activity map[string]time.Time) string {
+	// A failed deletion is retried on every run until the server is gone
+	if state.Status == config.StatusFailed {
+		return "failed"
+	}
+	if activity == nil || state.CreatedAt.IsZero() {
 		if state.ExpiresAt.Before(now) {
-			expiredCount++
-			w.pushDecommissionRequest(ctx, state)
+			return "ttl"
+		}
+		return ""
+	}
+
+	switch {
+	case now.Sub(lastActive(state, activity)) >= w.idleTimeout:
+		return "idle"
+	case w.maxLifetime > 0 && now.Sub(state.CreatedAt) >= w.maxLifetime:
+		return "max lifetime"
+	}
+	return ""
+}
+
+// idleExpiry returns the idle expiry LabMan should show for state: its user's last activity
+// plus the idle timeout. Only moves of at least minExtension are returned, so an active user
+// costs one write per run at most. A nil activity map leaves the entry alone.
+func (w *Worker) idleExpiry(state redis.ServerState, activity map[string]time.Time) (time.Time, bool) {
+	if activity == nil || state.CreatedAt.IsZero() || state.Status != config.StatusRunning {
+		return time.Time{}, false
+	}
+	idleExpiresAt := lastActive(state, activity).Add(w.idleTimeout)
+	if idleExpiresAt.Sub(state.IdleExpiresAt) < minExtension {
+		return time.Time{}, false
+	}
+	return idleExpiresAt, true
+}
+
+// recordIdleExpiries writes the states with their moved idle expiry in one batch. The writes
+// are versioned, so an entry changed since the page was read, e.g. for a new server, conflicts
+// and is left alone until the next run.
+func (w *Worker) recordIdleExpiries(ctx context.Context, states map[string]redis.ServerState) {
+	if len(states) == 0 {
+		return
+	}
+	err := w.redisClient.PushServerStates(ctx, states, config.ServerCacheTTL)
+	if err == nil {
+		return
+	}
+	failed := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		failed = joined.Unwrap()
+	}
+	for _, err := range failed {
+		if !errors.Is(err, redis.ErrVersionConflict) {
+			w.log.Warn("failed to record idle expiry", "error", err)
 		}
 	}
+}
+
+// lastActive returns when the user of state was last active, counting the server's creation
+// as activity. Activity from before the creation belongs to an earlier server.
+func lastActive(state redis.ServerState, activity map[string]time.Time) time.Time {
+	lastActive := state.CreatedAt
+	if at, ok := activity[redis.TenantUserID(state.Tenant, state.WebUserID)]; ok && at.After(lastActive) {
+		lastActive = at
+	}
+	return lastActive
+}
 
-	if expiredCount > 0 {
-		w.log.Info("found expired servers, pushed decommission requests", "count", expiredCount)
+// nextSequence issues the sequence number of the decommission of state. The request is
+// queued without one if that fails, and then served whatever the user queued before it.
+func (w *Worker) nextSequence(ctx context.Context, state redis.ServerState) int64 {
+	if w.sequencer == nil {
+		return 0
+	}
+	seq, err := w.sequencer.NextSequence(ctx, redis.TenantUserID(state.Tenant, state.WebUserID))
+	if err != nil {
+		w.log.Warn("failed to issue sequence number, queueing decommission without one", "webuserid", state.WebUserID, "error", err)
+		return 0
 	}
+	return seq
 }
 
-// pushDecommissionRequest pushes a decommission request to the queue for an expired server
-func (w *Worker) pushDecommissionRequest(ctx context.Context, state redis.ServerState) {
-	// Create decommission request payload
+// decommissionPayload builds the decommission request for an expired server, numbered seq
+// in the user's operation sequence unless it is 0. The reason ends up in the session archive.
+func decommissionPayload(state redis.ServerState, seq int64, reason string) (string, error) {
 	decomReq := map[string]interface{}{
 		"webuserid": state.WebUserID,
 		"labId":     state.LabID,
+		"reason":    reason,
+	}
+	if state.CorrelationID != "" {
+		decomReq["correlationId"] = state.CorrelationID
+	}
+	if state.Tenant != "" {
+		decomReq["tenant"] = state.Tenant
+	}
+	if seq > 0 {
+		decomReq["seq"] = seq
 	}
 
 	payload, err := json.Marshal(decomReq)
 	if err != nil {
-		w.log.Error("failed to marshal decommission request", "error", err)
-		return
+		return "", err
 	}
-
-	// Push to decommission queue
-	if err := w.redisClient.PushPayload(ctx, config.DecommissionQueueKey, string(payload)); err != nil {
-		w.log.Error("failed to push decommission request", "error", err)
-		return
-	}
-
-	w.log.Info("pushed decommission request for expired server",
-		"server_id", state.ServerID,
-		"webuserid", state.WebUserID,
-		"labid", state.LabID)
+	return string(payload), nil
 }
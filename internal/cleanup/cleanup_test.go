@@ -3,24 +3,35 @@ package cleanup
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/clock"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/flags"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
 )
 
 // mockRedisClient is a mock implementation of redis.ClientInterface
 type mockRedisClient struct {
-	getAllServerStatesFunc func(ctx context.Context, prefix string) ([]redis.ServerState, error)
-	pushPayloadFunc        func(ctx context.Context, queueKey string, payload string) error
-	getServerStateFunc     func(ctx context.Context, cacheKey string) (*redis.ServerState, error)
-	deleteServerStateFunc  func(ctx context.Context, cacheKey string) error
-	popPayloadFunc         func(ctx context.Context, queueKey string, timeout time.Duration) (string, error)
-	pushServerStateFunc    func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error
-	closeFunc              func() error
+	getAllServerStatesFunc     func(ctx context.Context, prefix string) ([]redis.ServerState, error)
+	getExpiredServerStatesFunc func(ctx context.Context, now time.Time) ([]redis.ServerState, error)
+	pushPayloadFunc            func(ctx context.Context, queueKey string, payload string) error
+	pushPayloadsFunc           func(ctx context.Context, queueKey string, payloads []string) error
+	getServerStateFunc         func(ctx context.Context, cacheKey string) (*redis.ServerState, error)
+	deleteServerStateFunc      func(ctx context.Context, cacheKey string) error
+	popPayloadFunc             func(ctx context.Context, queueKey string, timeout time.Duration) (string, error)
+	pushServerStateFunc        func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error
+	pushServerStatesFunc       func(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error
+	closeFunc                  func() error
+	queryCalls                 int
 }
 
 func (m *mockRedisClient) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
@@ -30,6 +41,52 @@ func (m *mockRedisClient) GetAllServerStates(ctx context.Context, prefix string)
 	return []redis.ServerState{}, nil
 }
 
+func (m *mockRedisClient) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	if m.pushPayloadsFunc != nil {
+		return m.pushPayloadsFunc(ctx, queueKey, payloads)
+	}
+	return nil
+}
+
+func (m *mockRedisClient) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	if m.pushServerStatesFunc != nil {
+		return m.pushServerStatesFunc(ctx, states, ttl)
+	}
+	return nil
+}
+
+func (m *mockRedisClient) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	return nil
+}
+
+func (m *mockRedisClient) GetExpiredServerStates(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+	if m.getExpiredServerStatesFunc != nil {
+		return m.getExpiredServerStatesFunc(ctx, now)
+	}
+	return []redis.ServerState{}, nil
+}
+
+// QueryServerStates pages through the states returned by GetExpiredServerStates;
+// the cursor is the index of the next state
+func (m *mockRedisClient) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	m.queryCalls++
+	states, err := m.GetExpiredServerStates(ctx, filter.ExpiresUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if filter.Cursor != "" {
+		start, _ = strconv.Atoi(filter.Cursor)
+	}
+	end := min(start+filter.Limit, len(states))
+	page := &redis.StatePage{States: states[start:end]}
+	if end < len(states) {
+		page.NextCursor = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
 func (m *mockRedisClient) PushPayload(ctx context.Context, queueKey string, payload string) error {
 	if m.pushPayloadFunc != nil {
 		return m.pushPayloadFunc(ctx, queueKey, payload)
@@ -58,6 +115,10 @@ func (m *mockRedisClient) PopPayload(ctx context.Context, queueKey string, timeo
 	return "", nil
 }
 
+func (m *mockRedisClient) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	return "", "", nil
+}
+
 func (m *mockRedisClient) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
 	if m.pushServerStateFunc != nil {
 		return m.pushServerStateFunc(ctx, cacheKey, state, ttl)
@@ -65,11 +126,23 @@ func (m *mockRedisClient) PushServerState(ctx context.Context, cacheKey string,
 	return nil
 }
 
+func (m *mockRedisClient) PushUserHash(ctx context.Context, hash string, webUserID string, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockRedisClient) GetUserByHash(ctx context.Context, hash string) (string, error) {
+	return "", errors.New("user hash not found")
+}
+
 func (m *mockRedisClient) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
 	// Allow by default in tests (not rate limited)
 	return true, nil
 }
 
+func (m *mockRedisClient) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	return &redis.AdmissionResult{Decision: redis.AdmissionAccepted}, nil
+}
+
 func (m *mockRedisClient) Close() error {
 	if m.closeFunc != nil {
 		return m.closeFunc()
@@ -83,22 +156,45 @@ type mockConnector struct{}
 // mockServer is a mock implementation of connector.Server
 type mockServer struct{}
 
-func (m *mockServer) GetID() string             { return "" }
-func (m *mockServer) GetName() string           { return "" }
-func (m *mockServer) GetIPv6Address() string    { return "" }
-func (m *mockServer) GetState() (string, error) { return "", nil }
-func (m *mockServer) Delete() error             { return nil }
-func (m *mockServer) String() string            { return "" }
-
-func (m *mockConnector) ListServers() ([]connector.Server, error) {
+func (m *mockServer) GetID() string                                { return "" }
+func (m *mockServer) GetName() string                              { return "" }
+func (m *mockServer) GetIPv6Address() string                       { return "" }
+func (m *mockServer) GetLabels() map[string]string                 { return nil }
+func (m *mockServer) GetServerType() string                        { return "" }
+func (m *mockServer) GetSSHHostKey() string                        { return "" }
+func (m *mockServer) GetState(ctx context.Context) (string, error) { return "", nil }
+func (m *mockServer) Delete(ctx context.Context) error             { return nil }
+func (m *mockServer) Rebuild(ctx context.Context) error            { return nil }
+func (m *mockServer) Resize(ctx context.Context, t string) error   { return nil }
+func (m *mockServer) String() string                               { return "" }
+
+func (m *mockConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
 	return []connector.Server{}, nil
 }
 
-func (m *mockConnector) GetServerByID(id string) (connector.Server, error) {
+// GetConsoleURL implements connector.Connector.GetConsoleURL
+func (m *mockConnector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return nil, errors.New("not implemented")
+}
+
+// MapState implements connector.Connector.MapState
+func (m *mockConnector) MapState(cloudState string) (string, bool) {
+	return cloudState, cloudState == "running"
+}
+
+func (m *mockConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	return &mockServer{}, nil
+}
+
+func (m *mockConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
 	return &mockServer{}, nil
 }
 
-func (m *mockConnector) CreateServer(payload string) (connector.Server, error) {
+func (m *mockConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	return []connector.Server{}, nil
+}
+
+func (m *mockConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
 	return &mockServer{}, nil
 }
 
@@ -130,10 +226,10 @@ func TestRun_ContextCancellation(t *testing.T) {
 	log := slog.Default()
 	conn := &mockConnector{}
 
-	getAllCalled := false
+	getExpiredCalled := false
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
-			getAllCalled = true
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			getExpiredCalled = true
 			return []redis.ServerState{}, nil
 		},
 	}
@@ -149,8 +245,8 @@ func TestRun_ContextCancellation(t *testing.T) {
 	worker.Run(ctx)
 
 	// Verify initial cleanup was called
-	if !getAllCalled {
-		t.Error("expected GetAllServerStates to be called during startup cleanup")
+	if !getExpiredCalled {
+		t.Error("expected GetExpiredServerStates to be called during startup cleanup")
 	}
 }
 
@@ -160,7 +256,7 @@ func TestRun_PeriodicCleanup(t *testing.T) {
 
 	callCount := 0
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
 			callCount++
 			return []redis.ServerState{}, nil
 		},
@@ -175,7 +271,7 @@ func TestRun_PeriodicCleanup(t *testing.T) {
 
 	// Should be called at least once (initial cleanup)
 	if callCount < 1 {
-		t.Errorf("expected at least 1 call to GetAllServerStates, got %d", callCount)
+		t.Errorf("expected at least 1 call to GetExpiredServerStates, got %d", callCount)
 	}
 }
 
@@ -183,12 +279,12 @@ func TestCleanupExpiredServers_NoServers(t *testing.T) {
 	log := slog.Default()
 	conn := &mockConnector{}
 
-	getAllCalled := false
+	getExpiredCalled := false
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
-			getAllCalled = true
-			if prefix != config.ServerCachePrefix {
-				t.Errorf("expected prefix %s, got %s", config.ServerCachePrefix, prefix)
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			getExpiredCalled = true
+			if now.IsZero() {
+				t.Error("expected current time to be passed")
 			}
 			return []redis.ServerState{}, nil
 		},
@@ -199,8 +295,8 @@ func TestCleanupExpiredServers_NoServers(t *testing.T) {
 	ctx := context.Background()
 	worker.cleanupExpiredServers(ctx)
 
-	if !getAllCalled {
-		t.Error("expected GetAllServerStates to be called")
+	if !getExpiredCalled {
+		t.Error("expected GetExpiredServerStates to be called")
 	}
 }
 
@@ -211,7 +307,7 @@ func TestCleanupExpiredServers_NoExpiredServers(t *testing.T) {
 	futureTime := time.Now().Add(1 * time.Hour)
 
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
 			return []redis.ServerState{
 				{
 					ServerID:  "server1",
@@ -227,8 +323,8 @@ func TestCleanupExpiredServers_NoExpiredServers(t *testing.T) {
 				},
 			}, nil
 		},
-		pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
-			t.Error("expected PushPayload not to be called for non-expired servers")
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			t.Error("expected PushPayloads not to be called for non-expired servers")
 			return nil
 		},
 	}
@@ -247,9 +343,10 @@ func TestCleanupExpiredServers_WithExpiredServers(t *testing.T) {
 	futureTime := time.Now().Add(1 * time.Hour)
 
 	pushedPayloads := []string{}
+	pushCalls := 0
 
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
 			return []redis.ServerState{
 				{
 					ServerID:  "server1",
@@ -271,11 +368,12 @@ func TestCleanupExpiredServers_WithExpiredServers(t *testing.T) {
 				},
 			}, nil
 		},
-		pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
-			if queueKey != config.DecommissionQueueKey {
-				t.Errorf("expected queue key %s, got %s", config.DecommissionQueueKey, queueKey)
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			if queueKey != config.CleanupQueueKey {
+				t.Errorf("expected queue key %s, got %s", config.CleanupQueueKey, queueKey)
 			}
-			pushedPayloads = append(pushedPayloads, payload)
+			pushCalls++
+			pushedPayloads = append(pushedPayloads, payloads...)
 			return nil
 		},
 	}
@@ -285,6 +383,11 @@ func TestCleanupExpiredServers_WithExpiredServers(t *testing.T) {
 	ctx := context.Background()
 	worker.cleanupExpiredServers(ctx)
 
+	// Verify both requests went out in a single batch
+	if pushCalls != 1 {
+		t.Errorf("expected 1 batched push, got %d", pushCalls)
+	}
+
 	// Verify 2 expired servers were pushed
 	if len(pushedPayloads) != 2 {
 		t.Errorf("expected 2 decommission requests, got %d", len(pushedPayloads))
@@ -306,16 +409,204 @@ func TestCleanupExpiredServers_WithExpiredServers(t *testing.T) {
 	}
 }
 
-func TestCleanupExpiredServers_GetAllServerStatesError(t *testing.T) {
+func TestCleanupExpiredServers_Paged(t *testing.T) {
+	pastTime := time.Now().Add(-1 * time.Hour)
+	expired := make([]redis.ServerState, cleanupPageSize*2+1)
+	for i := range expired {
+		expired[i] = redis.ServerState{ServerID: strconv.Itoa(i), WebUserID: "user" + strconv.Itoa(i), ExpiresAt: pastTime}
+	}
+
+	var pushed, pushCalls atomic.Int64
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return expired, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			pushCalls.Add(1)
+			pushed.Add(int64(len(payloads)))
+			return nil
+		},
+	}
+
+	New(slog.Default(), &mockConnector{}, redisClient).cleanupExpiredServers(context.Background())
+
+	if redisClient.queryCalls != 3 || pushCalls.Load() != 3 {
+		t.Errorf("expected 3 pages read and pushed, got %d queries and %d pushes", redisClient.queryCalls, pushCalls.Load())
+	}
+	if pushed.Load() != int64(len(expired)) {
+		t.Errorf("expected %d decommission requests, got %d", len(expired), pushed.Load())
+	}
+}
+
+func TestCleanupExpiredServers_Clock(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := clock.NewFake(start)
+	state := redis.ServerState{ServerID: "server1", WebUserID: "user1", LabID: 1, ExpiresAt: start.Add(10 * time.Minute)}
+
+	var queried []time.Time
+	var pushed []string
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+			queried = append(queried, until)
+			return []redis.ServerState{state}, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			pushed = append(pushed, payloads...)
+			return nil
+		},
+	}
+	worker := New(slog.Default(), &mockConnector{}, redisClient).WithClock(now)
+
+	worker.cleanupExpiredServers(context.Background())
+	if len(pushed) != 0 {
+		t.Fatalf("expected no decommission before the expiry, got %v", pushed)
+	}
+
+	now.Advance(11 * time.Minute)
+	worker.cleanupExpiredServers(context.Background())
+	if len(pushed) != 1 {
+		t.Fatalf("expected one decommission after the expiry, got %v", pushed)
+	}
+	if len(queried) != 2 || !queried[0].Equal(start) || !queried[1].Equal(start.Add(11*time.Minute)) {
+		t.Errorf("expected expiry queries at the clock's times, got %v", queried)
+	}
+}
+
+// fakeSequencer issues sequence numbers per user, failing for the users in fail
+type fakeSequencer struct {
+	issued map[string]int64
+	fail   map[string]bool
+}
+
+func (f *fakeSequencer) NextSequence(ctx context.Context, userID string) (int64, error) {
+	if f.fail[userID] {
+		return 0, errors.New("redis down")
+	}
+	f.issued[userID]++
+	return f.issued[userID], nil
+}
+
+func (f *fakeSequencer) ApplySequence(ctx context.Context, userID string, seq int64) (bool, int64, error) {
+	return true, seq, nil
+}
+
+func TestCleanupExpiredServers_Sequenced(t *testing.T) {
+	pastTime := time.Now().Add(-1 * time.Hour)
+	var pushed []string
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return []redis.ServerState{
+				{ServerID: "server1", WebUserID: "user1", LabID: 1, Tenant: "cs101", ExpiresAt: pastTime},
+				{ServerID: "server2", WebUserID: "user2", LabID: 2, ExpiresAt: pastTime},
+			}, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			pushed = append(pushed, payloads...)
+			return nil
+		},
+	}
+	sequencer := &fakeSequencer{issued: map[string]int64{"cs101:user1": 4}, fail: map[string]bool{"user2": true}}
+	worker := New(slog.Default(), &mockConnector{}, redisClient).WithSequencer(sequencer)
+
+	worker.cleanupExpiredServers(context.Background())
+	if len(pushed) != 2 {
+		t.Fatalf("expected 2 decommission requests, got %v", pushed)
+	}
+	// A failed sequence number doesn't hold up the decommission
+	if !strings.Contains(pushed[0], `"seq":5`) || strings.Contains(pushed[1], `"seq"`) {
+		t.Errorf("expected only the first request numbered 5, got %v", pushed)
+	}
+}
+
+func TestCleanupExpiredServers_Paused(t *testing.T) {
+	queried := false
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			queried = true
+			return nil, nil
+		},
+	}
+	store := redistest.New()
+	store.SetFlag(flags.PauseCleanup, "on")
+	worker := New(slog.Default(), &mockConnector{}, redisClient).WithFlags(flags.New(slog.Default(), store))
+
+	worker.cleanupExpiredServers(context.Background())
+	if queried {
+		t.Error("expected no expired servers to be read while cleanup is paused")
+	}
+}
+
+func TestCleanupExpiredServers_BoundedWorkers(t *testing.T) {
+	pastTime := time.Now().Add(-1 * time.Hour)
+	expired := make([]redis.ServerState, cleanupPageSize*6)
+	for i := range expired {
+		expired[i] = redis.ServerState{ServerID: strconv.Itoa(i), WebUserID: "user" + strconv.Itoa(i), ExpiresAt: pastTime}
+	}
+
+	var inFlight, maxInFlight, pushed atomic.Int64
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return expired, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				peak := maxInFlight.Load()
+				if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			pushed.Add(int64(len(payloads)))
+			return nil
+		},
+	}
+
+	New(slog.Default(), &mockConnector{}, redisClient).WithWorkers(2).cleanupExpiredServers(context.Background())
+
+	if peak := maxInFlight.Load(); peak > 2 {
+		t.Errorf("expected at most 2 pages pushed at once, got %d", peak)
+	}
+	if pushed.Load() != int64(len(expired)) {
+		t.Errorf("expected %d decommission requests, got %d", len(expired), pushed.Load())
+	}
+}
+
+func TestCleanupExpiredServers_PushErrorStopsPaging(t *testing.T) {
+	pastTime := time.Now().Add(-1 * time.Hour)
+	expired := make([]redis.ServerState, cleanupPageSize*10)
+	for i := range expired {
+		expired[i] = redis.ServerState{ServerID: strconv.Itoa(i), WebUserID: "user" + strconv.Itoa(i), ExpiresAt: pastTime}
+	}
+
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return expired, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			return context.DeadlineExceeded
+		},
+	}
+
+	New(slog.Default(), &mockConnector{}, redisClient).WithWorkers(1).cleanupExpiredServers(context.Background())
+
+	// The failing push cancels the run; at most the pages already read are handed over
+	if redisClient.queryCalls >= 10 {
+		t.Errorf("expected paging to stop after a failed push, got %d queries", redisClient.queryCalls)
+	}
+}
+
+func TestCleanupExpiredServers_GetExpiredServerStatesError(t *testing.T) {
 	log := slog.Default()
 	conn := &mockConnector{}
 
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
 			return nil, context.DeadlineExceeded
 		},
-		pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
-			t.Error("expected PushPayload not to be called when GetAllServerStates fails")
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			t.Error("expected PushPayloads not to be called when GetExpiredServerStates fails")
 			return nil
 		},
 	}
@@ -335,7 +626,7 @@ func TestCleanupExpiredServers_ContextCancellation(t *testing.T) {
 
 	pushCount := 0
 	redisClient := &mockRedisClient{
-		getAllServerStatesFunc: func(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
 			// Return many expired servers
 			servers := make([]redis.ServerState, 100)
 			for i := 0; i < 100; i++ {
@@ -348,8 +639,8 @@ func TestCleanupExpiredServers_ContextCancellation(t *testing.T) {
 			}
 			return servers, nil
 		},
-		pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
-			pushCount++
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			pushCount += len(payloads)
 			return nil
 		},
 	}
@@ -373,23 +664,225 @@ func TestCleanupExpiredServers_ContextCancellation(t *testing.T) {
 	}
 }
 
-func TestPushDecommissionRequest_Success(t *testing.T) {
+func TestCleanupExpiredServers_PushPayloadsError(t *testing.T) {
 	log := slog.Default()
 	conn := &mockConnector{}
 
-	var capturedPayload string
-	var capturedQueueKey string
+	pushCalled := false
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return []redis.ServerState{
+				{ServerID: "server1", WebUserID: "user1", LabID: 1, ExpiresAt: time.Now().Add(-1 * time.Hour)},
+			}, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			pushCalled = true
+			return context.DeadlineExceeded
+		},
+	}
+
+	worker := New(log, conn, redisClient)
 
+	ctx := context.Background()
+	// Should not panic
+	worker.cleanupExpiredServers(ctx)
+
+	if !pushCalled {
+		t.Error("expected PushPayloads to be called")
+	}
+}
+
+// fakeActivity serves last activity times by tenant-scoped user ID
+type fakeActivity struct {
+	lastActive map[string]time.Time
+	err        error
+}
+
+func (f *fakeActivity) LastActivity(ctx context.Context, userIDs []string) (map[string]time.Time, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	activity := make(map[string]time.Time)
+	for _, id := range userIDs {
+		if at, ok := f.lastActive[id]; ok {
+			activity[id] = at
+		}
+	}
+	return activity, nil
+}
+
+func TestCleanupExpiredServers_IdleExpiry(t *testing.T) {
+	now := time.Now()
+	states := []redis.ServerState{
+		// Past its TTL, but the user is active: kept
+		{WebUserID: "active", LabID: 1, CreatedAt: now.Add(-90 * time.Minute), ExpiresAt: now.Add(-time.Hour)},
+		// Before its TTL, but idle for longer than the timeout: queued
+		{WebUserID: "idle", LabID: 1, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+		// Never active, created recently: kept
+		{WebUserID: "new", LabID: 1, CreatedAt: now.Add(-10 * time.Minute), ExpiresAt: now.Add(time.Hour)},
+		// Never active since creation: queued
+		{WebUserID: "unused", LabID: 1, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+		// Active, but running longer than the max lifetime: queued
+		{WebUserID: "marathon", LabID: 1, CreatedAt: now.Add(-5 * time.Hour), ExpiresAt: now.Add(-4 * time.Hour)},
+		// Activity from before this server was created doesn't count
+		{WebUserID: "returning", LabID: 1, CreatedAt: now.Add(-40 * time.Minute), ExpiresAt: now.Add(time.Hour)},
+		// Tenant users are looked up by their scoped ID
+		{WebUserID: "student", Tenant: "cs101", LabID: 1, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		// Entries without a creation time keep the fixed TTL
+		{WebUserID: "legacy-expired", LabID: 1, ExpiresAt: now.Add(-time.Minute)},
+		{WebUserID: "legacy-valid", LabID: 1, ExpiresAt: now.Add(time.Hour)},
+		// A failed deletion is retried whatever the user's activity
+		{WebUserID: "stuck", LabID: 1, Status: config.StatusFailed, CreatedAt: now.Add(-10 * time.Minute), ExpiresAt: now.Add(-time.Second)},
+	}
+	activity := &fakeActivity{lastActive: map[string]time.Time{
+		"active":        now.Add(-5 * time.Minute),
+		"idle":          now.Add(-time.Hour),
+		"marathon":      now.Add(-time.Minute),
+		"returning":     now.Add(-3 * time.Hour),
+		"cs101:student": now.Add(-time.Minute),
+		"student":       now.Add(-3 * time.Hour),
+	}}
+
+	var queued []string
 	redisClient := &mockRedisClient{
-		pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
-			capturedQueueKey = queueKey
-			capturedPayload = payload
+		getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+			if !until.IsZero() {
+				t.Errorf("expected idle expiry to read every state, got expiry filter %v", until)
+			}
+			return states, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			for _, payload := range payloads {
+				var req map[string]interface{}
+				if err := json.Unmarshal([]byte(payload), &req); err != nil {
+					t.Fatal(err)
+				}
+				queued = append(queued, req["webuserid"].(string))
+			}
 			return nil
 		},
 	}
 
-	worker := New(log, conn, redisClient)
+	worker := New(slog.Default(), &mockConnector{}, redisClient).WithIdleExpiry(activity, 30*time.Minute, 4*time.Hour)
+	worker.cleanupExpiredServers(context.Background())
 
+	expected := []string{"idle", "unused", "marathon", "returning", "legacy-expired", "stuck"}
+	if strings.Join(queued, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be queued, got %v", expected, queued)
+	}
+}
+
+func TestCleanupExpiredServers_IdleExpiryActivityError(t *testing.T) {
+	now := time.Now()
+	states := []redis.ServerState{
+		{WebUserID: "expired", LabID: 1, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Minute)},
+		{WebUserID: "valid", LabID: 1, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+	}
+
+	var queued []string
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+			return states, nil
+		},
+		pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+			queued = append(queued, payloads...)
+			return nil
+		},
+	}
+
+	// Unreadable activity falls back to the fixed TTL instead of treating everyone as idle
+	worker := New(slog.Default(), &mockConnector{}, redisClient).
+		WithIdleExpiry(&fakeActivity{err: errors.New("connection refused")}, 30*time.Minute, 4*time.Hour)
+	worker.cleanupExpiredServers(context.Background())
+
+	if len(queued) != 1 || !strings.Contains(queued[0], `"webuserid":"expired"`) {
+		t.Errorf("expected only the expired server to be queued, got %v", queued)
+	}
+}
+
+func TestCleanupExpiredServers_RecordsIdleExpiry(t *testing.T) {
+	now := time.Now()
+	active := redis.ServerState{WebUserID: "active", LabID: 1, ServerID: "1", Status: config.StatusRunning,
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), IdleExpiresAt: now.Add(-30 * time.Minute)}
+	recorded := redis.ServerState{WebUserID: "recorded", LabID: 1, ServerID: "2", Status: config.StatusRunning,
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), IdleExpiresAt: now.Add(25 * time.Minute)}
+
+	var written []redis.ServerState
+	batches := 0
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+			return []redis.ServerState{active, recorded}, nil
+		},
+		pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+			t.Errorf("expected idle expiries to be written in a batch, got a write of %s", cacheKey)
+			return nil
+		},
+		pushServerStatesFunc: func(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+			batches++
+			for _, state := range states {
+				written = append(written, state)
+			}
+			return nil
+		},
+	}
+	activity := &fakeActivity{lastActive: map[string]time.Time{
+		"active":   now.Add(-5 * time.Minute),
+		"recorded": now.Add(-5 * time.Minute),
+	}}
+
+	worker := New(slog.Default(), &mockConnector{}, redisClient).WithIdleExpiry(activity, 30*time.Minute, 4*time.Hour)
+	worker.cleanupExpiredServers(context.Background())
+
+	// The recorded idle expiry is less than a minute off, so only the other entry is written
+	if len(written) != 1 || written[0].WebUserID != "active" || !written[0].IdleExpiresAt.Equal(now.Add(25*time.Minute)) {
+		t.Errorf("expected the idle expiry of the active server to move 30 minutes past its activity, got %+v", written)
+	}
+	if batches != 1 {
+		t.Errorf("expected 1 batch write, got %d", batches)
+	}
+}
+
+func TestCleanupExpiredServers_IdleExpiryConflict(t *testing.T) {
+	now := time.Now()
+	store := redistest.New()
+	ctx := context.Background()
+	active := redis.ServerState{WebUserID: "active", LabID: 1, ServerID: "1", Status: config.StatusRunning,
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}
+	replaced := redis.ServerState{WebUserID: "replaced", LabID: 1, ServerID: "2", Status: config.StatusRunning,
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}
+	for _, state := range []redis.ServerState{active, replaced} {
+		if err := store.PushServerState(ctx, state.CacheKey(), state, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := store.QueryServerStates(ctx, redis.StateFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new server replaced one entry after the page was read
+	fresh, _ := store.GetServerState(ctx, replaced.CacheKey())
+	fresh.ServerID = "3"
+	if err := store.PushServerState(ctx, replaced.CacheKey(), *fresh, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	activity := &fakeActivity{lastActive: map[string]time.Time{
+		"active":   now.Add(-5 * time.Minute),
+		"replaced": now.Add(-5 * time.Minute),
+	}}
+	worker := New(slog.Default(), &mockConnector{}, store).WithIdleExpiry(activity, 30*time.Minute, 4*time.Hour)
+	worker.queueDecommissions(ctx, now, page.States)
+
+	if state, _ := store.GetServerState(ctx, active.CacheKey()); !state.IdleExpiresAt.Equal(now.Add(25 * time.Minute)) {
+		t.Errorf("expected the idle expiry to be recorded, got %v", state.IdleExpiresAt)
+	}
+	if state, _ := store.GetServerState(ctx, replaced.CacheKey()); state.ServerID != "3" || !state.IdleExpiresAt.IsZero() {
+		t.Errorf("expected the replaced entry to be left alone, got %+v", state)
+	}
+}
+
+func TestDecommissionPayload(t *testing.T) {
 	state := redis.ServerState{
 		ServerID:  "test-server-123",
 		WebUserID: "test-user",
@@ -397,17 +890,14 @@ func TestPushDecommissionRequest_Success(t *testing.T) {
 		ExpiresAt: time.Now().Add(-1 * time.Hour),
 	}
 
-	ctx := context.Background()
-	worker.pushDecommissionRequest(ctx, state)
-
-	// Verify queue key
-	if capturedQueueKey != config.DecommissionQueueKey {
-		t.Errorf("expected queue key %s, got %s", config.DecommissionQueueKey, capturedQueueKey)
+	payload, err := decommissionPayload(state, 0, "ttl")
+	if err != nil {
+		t.Fatalf("decommissionPayload failed: %v", err)
 	}
 
 	// Verify payload structure
 	var decomReq map[string]interface{}
-	if err := json.Unmarshal([]byte(capturedPayload), &decomReq); err != nil {
+	if err := json.Unmarshal([]byte(payload), &decomReq); err != nil {
 		t.Fatalf("failed to unmarshal payload: %v", err)
 	}
 
@@ -419,34 +909,40 @@ func TestPushDecommissionRequest_Success(t *testing.T) {
 	if decomReq["labId"] != float64(42) {
 		t.Errorf("expected labId 42, got %v", decomReq["labId"])
 	}
+	if decomReq["reason"] != "ttl" {
+		t.Errorf("expected reason 'ttl', got %v", decomReq["reason"])
+	}
 }
 
-func TestPushDecommissionRequest_PushPayloadError(t *testing.T) {
-	log := slog.Default()
-	conn := &mockConnector{}
-
-	pushCalled := false
-	redisClient := &mockRedisClient{
-		pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
-			pushCalled = true
-			return context.DeadlineExceeded
-		},
+func TestDecommissionPayload_CorrelationID(t *testing.T) {
+	untraced, err := decommissionPayload(redis.ServerState{WebUserID: "test-user", LabID: 42}, 0, "ttl")
+	if err != nil {
+		t.Fatalf("decommissionPayload failed: %v", err)
+	}
+	if strings.Contains(untraced, "correlationId") {
+		t.Errorf("expected no correlationId without a traced state, got %s", untraced)
 	}
 
-	worker := New(log, conn, redisClient)
-
-	state := redis.ServerState{
-		ServerID:  "test-server-123",
-		WebUserID: "test-user",
-		LabID:     42,
-		ExpiresAt: time.Now().Add(-1 * time.Hour),
+	traced, err := decommissionPayload(redis.ServerState{WebUserID: "test-user", LabID: 42, CorrelationID: "req-42"}, 0, "ttl")
+	if err != nil {
+		t.Fatalf("decommissionPayload failed: %v", err)
 	}
 
-	ctx := context.Background()
-	// Should not panic
-	worker.pushDecommissionRequest(ctx, state)
+	var decomReq map[string]interface{}
+	if err := json.Unmarshal([]byte(traced), &decomReq); err != nil {
+		t.Fatalf("failed to unmarshal payload: %v", err)
+	}
+	if decomReq["correlationId"] != "req-42" {
+		t.Errorf("expected correlationId req-42, got %v", decomReq["correlationId"])
+	}
+}
 
-	if !pushCalled {
-		t.Error("expected PushPayload to be called")
+func TestDecommissionPayload_Tenant(t *testing.T) {
+	payload, err := decommissionPayload(redis.ServerState{WebUserID: "test-user", LabID: 42, Tenant: "cs101"}, 0, "ttl")
+	if err != nil {
+		t.Fatalf("decommissionPayload failed: %v", err)
+	}
+	if !strings.Contains(payload, `"tenant":"cs101"`) {
+		t.Errorf("expected tenant in payload, got %s", payload)
 	}
 }
@@ -0,0 +1,150 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+const (
+	refreshInterval = 1 * time.Minute
+
+	// minExtension is the smallest expiry extension worth a cache write
+	minExtension = 1 * time.Minute
+)
+
+// errNotExtended aborts a state update that would not move the expiry
+var errNotExtended = errors.New("expiry not extended")
+
+// Refresher extends the expiry of servers whose user is active, so a student working
+// in their lab is not cut off by the fixed TTL
+type Refresher struct {
+	log         *slog.Logger
+	redisClient redis.ClientInterface
+	activity    redis.ActivityReader
+	extension   time.Duration
+	maxLifetime time.Duration
+}
+
+// NewRefresher creates a Refresher that moves a server's expiry to extension after its
+// user's last activity, but never past maxLifetime after the server's creation
+func NewRefresher(log *slog.Logger, redisClient redis.ClientInterface, activity redis.ActivityReader, extension, maxLifetime time.Duration) *Refresher {
+	return &Refresher{
+		log:         log,
+		redisClient: redisClient,
+		activity:    activity,
+		extension:   extension,
+		maxLifetime: maxLifetime,
+	}
+}
+
+// Run refreshes expiries every minute until ctx is cancelled
+func (r *Refresher) Run(ctx context.Context) {
+	r.log.Info("ttl refresher started", "extension", r.extension, "max_lifetime", r.maxLifetime)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.log.Info("ttl refresher stopping")
+			return
+		case <-ticker.C:
+			r.refresh(ctx)
+		}
+	}
+}
+
+// refresh extends the expiry of every available server with recent activity, a page at a time
+func (r *Refresher) refresh(ctx context.Context) {
+	filter := redis.StateFilter{Status: config.StatusRunning, Limit: cleanupPageSize}
+	extended := 0
+	for {
+		page, err := r.redisClient.QueryServerStates(ctx, filter)
+		if err != nil {
+			r.log.Error("failed to get server states for ttl refresh", "error", err)
+			break
+		}
+		extended += r.refreshPage(ctx, page.States)
+		if ctx.Err() != nil || page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	if extended > 0 {
+		r.log.Info("extended expiry of active servers", "count", extended)
+	}
+}
+
+// refreshPage extends the expiries of one page of states. Returns the number extended.
+func (r *Refresher) refreshPage(ctx context.Context, states []redis.ServerState) int {
+	if len(states) == 0 {
+		return 0
+	}
+	userIDs := make([]string, len(states))
+	for i, state := range states {
+		userIDs[i] = redis.TenantUserID(state.Tenant, state.WebUserID)
+	}
+	activity, err := r.activity.LastActivity(ctx, userIDs)
+	if err != nil {
+		r.log.Warn("failed to read user activity, skipping ttl refresh", "error", err)
+		return 0
+	}
+
+	extended := 0
+	for i, state := range states {
+		lastActive, ok := activity[userIDs[i]]
+		if !ok || ctx.Err() != nil {
+			continue
+		}
+		if _, ok := r.extendedExpiry(state, lastActive); !ok {
+			continue
+		}
+
+		// Re-check on the fresh entry, which may be a new server or already being decommissioned
+		updated, err := redis.UpdateServerState(ctx, r.redisClient, state.CacheKey(), config.ServerCacheTTL, func(fresh *redis.ServerState) error {
+			if fresh.ServerID != state.ServerID || !fresh.Available {
+				return errNotExtended
+			}
+			expiresAt, ok := r.extendedExpiry(*fresh, lastActive)
+			if !ok {
+				return errNotExtended
+			}
+			fresh.ExpiresAt = expiresAt
+			return nil
+		})
+		switch {
+		case errors.Is(err, errNotExtended):
+		case err != nil:
+			r.log.Warn("failed to extend server expiry", "server_id", state.ServerID, "webuserid", state.WebUserID, "error", err)
+		default:
+			extended++
+			r.log.Debug("extended server expiry", "server_id", state.ServerID, "webuserid", state.WebUserID, "expires_at", updated.ExpiresAt)
+		}
+	}
+	return extended
+}
+
+// extendedExpiry returns the expiry of state after activity at lastActive, and whether it
+// moves the current expiry by at least minExtension. Entries without a creation time can't
+// be bounded by maxLifetime and are never extended; activity from before the server was
+// created belongs to an earlier server and doesn't count.
+func (r *Refresher) extendedExpiry(state redis.ServerState, lastActive time.Time) (time.Time, bool) {
+	if state.CreatedAt.IsZero() || lastActive.Before(state.CreatedAt) {
+		return time.Time{}, false
+	}
+	expiresAt := lastActive.Add(r.extension)
+	if limit := state.CreatedAt.Add(r.maxLifetime); r.maxLifetime > 0 && expiresAt.After(limit) {
+		expiresAt = limit
+	}
+	if expiresAt.Sub(state.ExpiresAt) < minExtension {
+		return time.Time{}, false
+	}
+	return expiresAt, true
+}
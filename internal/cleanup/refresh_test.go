@@ -0,0 +1,124 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+func TestRefresher_ExtendsActiveServers(t *testing.T) {
+	now := time.Now()
+	states := []redis.ServerState{
+		// Active: expiry moves to 30 minutes after the last activity
+		{WebUserID: "active", ServerID: "1", Status: config.StatusRunning, Available: true, CreatedAt: now.Add(-30 * time.Minute), ExpiresAt: now.Add(5 * time.Minute)},
+		// No activity key: unchanged
+		{WebUserID: "quiet", ServerID: "2", Status: config.StatusRunning, Available: true, CreatedAt: now.Add(-30 * time.Minute), ExpiresAt: now.Add(5 * time.Minute)},
+		// Already at the max lifetime: unchanged
+		{WebUserID: "marathon", ServerID: "3", Status: config.StatusRunning, Available: true, CreatedAt: now.Add(-230 * time.Minute), ExpiresAt: now.Add(10 * time.Minute)},
+		// Near the max lifetime: capped at it
+		{WebUserID: "late", ServerID: "4", Status: config.StatusRunning, Available: true, CreatedAt: now.Add(-220 * time.Minute), ExpiresAt: now.Add(5 * time.Minute)},
+		// Activity from before this server was created: unchanged
+		{WebUserID: "returning", ServerID: "5", Status: config.StatusRunning, Available: true, CreatedAt: now.Add(-10 * time.Minute), ExpiresAt: now.Add(5 * time.Minute)},
+		// Entry without a creation time: unchanged
+		{WebUserID: "legacy", ServerID: "6", Status: config.StatusRunning, Available: true, ExpiresAt: now.Add(5 * time.Minute)},
+		// Tenant user: looked up by the scoped ID
+		{WebUserID: "student", Tenant: "cs101", ServerID: "7", Status: config.StatusRunning, Available: true, CreatedAt: now.Add(-30 * time.Minute), ExpiresAt: now.Add(5 * time.Minute)},
+	}
+	lastActive := now.Add(-time.Minute)
+	activity := &fakeActivity{lastActive: map[string]time.Time{
+		"active":        lastActive,
+		"marathon":      lastActive,
+		"late":          lastActive,
+		"returning":     now.Add(-20 * time.Minute),
+		"legacy":        lastActive,
+		"cs101:student": lastActive,
+	}}
+
+	byKey := make(map[string]redis.ServerState)
+	for _, state := range states {
+		byKey[state.CacheKey()] = state
+	}
+	pushed := make(map[string]time.Time)
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return states, nil
+		},
+		getServerStateFunc: func(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+			state := byKey[cacheKey]
+			return &state, nil
+		},
+		pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+			pushed[state.WebUserID] = state.ExpiresAt
+			return nil
+		},
+	}
+
+	NewRefresher(slog.Default(), redisClient, activity, 30*time.Minute, 4*time.Hour).refresh(context.Background())
+
+	expected := map[string]time.Time{
+		"active":  lastActive.Add(30 * time.Minute),
+		"late":    states[3].CreatedAt.Add(4 * time.Hour),
+		"student": lastActive.Add(30 * time.Minute),
+	}
+	if len(pushed) != len(expected) {
+		t.Errorf("expected %d extended servers, got %v", len(expected), pushed)
+	}
+	for user, expiresAt := range expected {
+		if !pushed[user].Equal(expiresAt) {
+			t.Errorf("expected %s to expire at %v, got %v", user, expiresAt, pushed[user])
+		}
+	}
+}
+
+func TestRefresher_SkipsChangedEntries(t *testing.T) {
+	now := time.Now()
+	listed := redis.ServerState{WebUserID: "user-1", ServerID: "1", Status: config.StatusRunning, Available: true,
+		CreatedAt: now.Add(-30 * time.Minute), ExpiresAt: now.Add(5 * time.Minute)}
+	activity := &fakeActivity{lastActive: map[string]time.Time{"user-1": now}}
+
+	tests := []struct {
+		name  string
+		fresh redis.ServerState
+	}{
+		{"decommission started", func() redis.ServerState { s := listed; s.Status, s.Available = config.StatusStopping, false; return s }()},
+		{"replaced by a new server", func() redis.ServerState { s := listed; s.ServerID = "2"; return s }()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redisClient := &mockRedisClient{
+				getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+					return []redis.ServerState{listed}, nil
+				},
+				getServerStateFunc: func(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+					fresh := tt.fresh
+					return &fresh, nil
+				},
+				pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+					t.Errorf("expected no write, got %+v", state)
+					return nil
+				},
+			}
+			NewRefresher(slog.Default(), redisClient, activity, 30*time.Minute, 4*time.Hour).refresh(context.Background())
+		})
+	}
+}
+
+func TestRefresher_ActivityError(t *testing.T) {
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+			return []redis.ServerState{{WebUserID: "user-1", CreatedAt: time.Now(), ExpiresAt: time.Now()}}, nil
+		},
+		pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+			t.Errorf("expected no write, got %+v", state)
+			return nil
+		},
+	}
+	activity := &fakeActivity{err: errors.New("connection refused")}
+
+	NewRefresher(slog.Default(), redisClient, activity, 30*time.Minute, 4*time.Hour).refresh(context.Background())
+}
@@ -0,0 +1,359 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+const (
+	watchdogInterval = 5 * time.Minute
+
+	// maxStuckListed is the number of stuck entries named in one notification
+	maxStuckListed = 10
+)
+
+// CloudStatusStuck is the cloud status cached with a failed status when the watchdog
+// marks a stuck entry failed
+const CloudStatusStuck = "stuck"
+
+// errEntryMoved aborts a remediation of an entry that changed since it was found stuck
+var errEntryMoved = errors.New("cache entry changed since it was found stuck")
+
+var (
+	stuckEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "swim_stuck_entries",
+		Help: "Cache entries in a status for longer than the watchdog threshold, by status.",
+	}, []string{"status"})
+
+	stuckRemediations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swim_stuck_remediations_total",
+		Help: "Remediations the watchdog applied to stuck cache entries, by remediation and result.",
+	}, []string{"remediation", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(stuckEntries, stuckRemediations)
+}
+
+// sighting is when the watchdog first saw a cache entry in its current status
+type sighting struct {
+	status   string
+	serverID string
+	since    time.Time
+}
+
+// Watchdog reports cache entries that stay queued, provisioning, stopping or deleting for
+// longer than a threshold, e.g. because the instance polling them crashed, and optionally
+// remediates them. Time in a status is counted from when this instance first saw the entry
+// in it, so a restart starts the clock again.
+type Watchdog struct {
+	log         *slog.Logger
+	redisClient redis.ClientInterface
+	thresholds  map[string]time.Duration // by status
+	remediation string
+	resume      func(ctx context.Context, entry redis.HandoffEntry)
+	notifier    *notify.Notifier
+	flags       *flags.Reader
+	interval    time.Duration
+	clock       clock.Clock
+
+	seen    map[string]sighting // by cache key
+	resumes sync.WaitGroup
+}
+
+// NewWatchdog creates a Watchdog that reports entries queued or provisioning for longer than
+// provisioning, and entries stopping or deleting for longer than stopping. It only reports
+// until a remediation is set.
+func NewWatchdog(log *slog.Logger, redisClient redis.ClientInterface, provisioning, stopping time.Duration) *Watchdog {
+	return &Watchdog{
+		log:         log,
+		redisClient: redisClient,
+		thresholds: map[string]time.Duration{
+			config.StatusQueued:       provisioning,
+			config.StatusProvisioning: provisioning,
+			config.StatusStopping:     stopping,
+			config.StatusDeleting:     stopping,
+		},
+		remediation: config.StuckRemediationNone,
+		interval:    watchdogInterval,
+		clock:       clock.Real,
+		seen:        make(map[string]sighting),
+	}
+}
+
+// WithRemediation sets what is done with stuck entries, one of the config.StuckRemediation
+// values. With requeue, stuck provisions are passed to resume, which polls them again.
+func (w *Watchdog) WithRemediation(remediation string, resume func(ctx context.Context, entry redis.HandoffEntry)) *Watchdog {
+	w.remediation = remediation
+	w.resume = resume
+	return w
+}
+
+// WithClock counts time in a status with c instead of the system clock
+func (w *Watchdog) WithClock(c clock.Clock) *Watchdog {
+	w.clock = c
+	return w
+}
+
+// WithNotifier alerts operators about stuck entries
+func (w *Watchdog) WithNotifier(notifier *notify.Notifier) *Watchdog {
+	w.notifier = notifier
+	return w
+}
+
+// WithFlags reads runtime feature flags from reader; stuck entries are only reported while
+// reconciler-auto-fix is off
+func (w *Watchdog) WithFlags(reader *flags.Reader) *Watchdog {
+	w.flags = reader
+	return w
+}
+
+// Run checks for stuck entries every five minutes until ctx is cancelled
+func (w *Watchdog) Run(ctx context.Context) {
+	w.log.Info("stuck-state watchdog started",
+		"provisioning_threshold", w.thresholds[config.StatusProvisioning],
+		"stopping_threshold", w.thresholds[config.StatusStopping],
+		"remediation", w.remediation)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.log.Info("stuck-state watchdog stopping")
+			return
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+// Prime records the entries in a watched status among states, read from the cache at
+// startup, as first seen now. Must be called before Run.
+func (w *Watchdog) Prime(states []redis.ServerState) {
+	now := w.clock.Now()
+	for _, state := range states {
+		if _, watched := w.thresholds[state.Status]; watched {
+			w.seen[state.CacheKey()] = sighting{status: state.Status, serverID: state.ServerID, since: now}
+		}
+	}
+}
+
+// Wait blocks until the provisions resumed by the watchdog have finished
+func (w *Watchdog) Wait() {
+	w.resumes.Wait()
+}
+
+// check reads every cache entry, reports the stuck ones and remediates them
+func (w *Watchdog) check(ctx context.Context) {
+	now := w.clock.Now()
+	seen := make(map[string]sighting, len(w.seen))
+	var stuck []redis.ServerState
+
+	filter := redis.StateFilter{Limit: cleanupPageSize}
+	for {
+		page, err := w.redisClient.QueryServerStates(ctx, filter)
+		if err != nil {
+			// Keep the sightings, an unreadable cache says nothing about the entries
+			w.log.Error("failed to get server states for stuck-state check", "error", err)
+			return
+		}
+		for _, state := range page.States {
+			threshold, watched := w.thresholds[state.Status]
+			if !watched {
+				continue
+			}
+			key := state.CacheKey()
+			s, ok := w.seen[key]
+			if !ok || s.status != state.Status || s.serverID != state.ServerID {
+				s = sighting{status: state.Status, serverID: state.ServerID, since: now}
+			}
+			seen[key] = s
+			if now.Sub(s.since) >= threshold {
+				stuck = append(stuck, state)
+			}
+		}
+		if ctx.Err() != nil || page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	w.seen = seen
+
+	counts := make(map[string]int)
+	for _, state := range stuck {
+		counts[state.Status]++
+	}
+	for status := range w.thresholds {
+		stuckEntries.WithLabelValues(status).Set(float64(counts[status]))
+	}
+	if len(stuck) == 0 {
+		return
+	}
+
+	var listed []string
+	for _, state := range stuck {
+		key := state.CacheKey()
+		stuckFor := now.Sub(seen[key].since).Round(time.Minute)
+		w.log.Warn("cache entry stuck",
+			"cache_key", key,
+			"status", state.Status,
+			"server_id", state.ServerID,
+			"stuck_for", stuckFor)
+		if len(listed) < maxStuckListed {
+			listed = append(listed, fmt.Sprintf("user %s, lab %d: %s for %s", state.WebUserID, state.LabID, state.Status, stuckFor))
+		}
+
+		if w.remediate(ctx, state) {
+			// Give the remediation a full threshold before the entry counts as stuck again
+			seen[key] = sighting{status: state.Status, serverID: state.ServerID, since: now}
+		}
+	}
+	w.notify(ctx, len(stuck), listed)
+}
+
+// remediate applies the configured remediation to a stuck entry.
+// Returns true if a remediation was applied.
+func (w *Watchdog) remediate(ctx context.Context, state redis.ServerState) bool {
+	if w.remediation == config.StuckRemediationNone {
+		return false
+	}
+	if !w.flags.Enabled(ctx, flags.ReconcilerAutoFix) {
+		w.log.Info("stuck entry not remediated, auto-fix is off", "cache_key", state.CacheKey(), "flag", flags.ReconcilerAutoFix)
+		return false
+	}
+	entryLog := w.log.With("cache_key", state.CacheKey(), "status", state.Status, "server_id", state.ServerID, "remediation", w.remediation)
+
+	// Every instance runs a watchdog, but only one remediates an entry per threshold
+	userID := redis.TenantUserID(state.Tenant, state.WebUserID)
+	allowed, err := w.redisClient.TryAcquireRateLimit(ctx, userID, "watchdog", w.thresholds[state.Status])
+	if err != nil {
+		entryLog.Error("failed to check watchdog rate limit, skipping remediation", "error", err)
+		return false
+	}
+	if !allowed {
+		return false
+	}
+
+	err = w.apply(ctx, state)
+	result := "success"
+	switch {
+	case errors.Is(err, errEntryMoved) || errors.Is(err, errs.ErrNotFound):
+		result = "skipped"
+		entryLog.Info("stuck entry changed, nothing to remediate", "error", err)
+	case err != nil:
+		result = "error"
+		entryLog.Error("failed to remediate stuck entry", "error", err)
+	default:
+		entryLog.Info("remediated stuck entry")
+	}
+	stuckRemediations.WithLabelValues(w.remediation, result).Inc()
+	return err == nil
+}
+
+// apply carries out the remediation for one stuck entry. An entry without a server has
+// nothing to poll or delete, so requeue and delete remove it.
+func (w *Watchdog) apply(ctx context.Context, state redis.ServerState) error {
+	switch w.remediation {
+	case config.StuckRemediationRequeue, config.StuckRemediationDelete:
+		switch {
+		case state.ServerID == "":
+			return w.removeEntry(ctx, state)
+		case w.remediation == config.StuckRemediationRequeue && state.Status == config.StatusProvisioning:
+			return w.resumeProvision(ctx, state)
+		}
+		return w.queueDecommission(ctx, state)
+	case config.StuckRemediationFail:
+		return w.markFailed(ctx, state)
+	}
+	return fmt.Errorf("unknown remediation %q", w.remediation)
+}
+
+// resumeProvision polls a stuck provision again in the background
+func (w *Watchdog) resumeProvision(ctx context.Context, state redis.ServerState) error {
+	if w.resume == nil {
+		return errors.New("no provisioner to resume polling")
+	}
+	entry := redis.HandoffEntry{
+		CacheKey:    state.CacheKey(),
+		ServerID:    state.ServerID,
+		CloudStatus: state.CloudStatus,
+		State:       state,
+	}
+	w.resumes.Add(1)
+	go func() {
+		defer w.resumes.Done()
+		w.resume(ctx, entry)
+	}()
+	return nil
+}
+
+// queueDecommission pushes a decommission request for the entry to the cleanup queue
+func (w *Watchdog) queueDecommission(ctx context.Context, state redis.ServerState) error {
+	payload, err := decommissionPayload(state, 0, "stuck")
+	if err != nil {
+		return fmt.Errorf("marshal decommission request: %w", err)
+	}
+	return w.redisClient.PushPayloads(ctx, config.CleanupQueueKey, []string{payload})
+}
+
+// removeEntry removes an entry without a server, unless it changed since it was found stuck
+func (w *Watchdog) removeEntry(ctx context.Context, state redis.ServerState) error {
+	current, err := w.redisClient.GetServerState(ctx, state.CacheKey())
+	if err != nil {
+		return err
+	}
+	if current.Status != state.Status || current.ServerID != state.ServerID {
+		return errEntryMoved
+	}
+	return w.redisClient.DeleteServerState(ctx, state.CacheKey())
+}
+
+// markFailed marks the entry failed and due, so the cleanup worker decommissions it on its next run
+func (w *Watchdog) markFailed(ctx context.Context, state redis.ServerState) error {
+	_, err := lifecycle.Transition(ctx, w.redisClient, state.CacheKey(), config.StatusFailed, func(fresh *redis.ServerState) error {
+		if fresh.Status != state.Status || fresh.ServerID != state.ServerID {
+			return errEntryMoved
+		}
+		fresh.Available = false
+		fresh.CloudStatus = CloudStatusStuck
+		fresh.ExpiresAt = w.clock.Now()
+		return nil
+	})
+	return err
+}
+
+// notify alerts operators about stuck entries. Notifications are best-effort, so a failure is only logged.
+func (w *Watchdog) notify(ctx context.Context, count int, listed []string) {
+	if w.notifier == nil {
+		return
+	}
+	message := strings.Join(listed, "\n")
+	if count > len(listed) {
+		message += fmt.Sprintf("\n(and %d more)", count-len(listed))
+	}
+	err := w.notifier.Notify(ctx, notify.Notification{
+		Event:   notify.EventStuckState,
+		Title:   fmt.Sprintf("%d stuck cache entries", count),
+		Message: message,
+	})
+	if err != nil {
+		w.log.Warn("failed to send notification", "event", notify.EventStuckState, "error", err)
+	}
+}
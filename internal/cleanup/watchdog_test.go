@@ -0,0 +1,204 @@
+package cleanup
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+// recordingChannel remembers the notifications sent
+type recordingChannel struct {
+	sent []notify.Notification
+}
+
+func (c *recordingChannel) Send(ctx context.Context, n notify.Notification) error {
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+func TestWatchdog_ReportsStuckEntries(t *testing.T) {
+	now := clock.NewFake(time.Now())
+	states := []redis.ServerState{
+		{WebUserID: "stuck", LabID: 1, ServerID: "1", Status: config.StatusProvisioning},
+		{WebUserID: "busy", LabID: 1, ServerID: "2", Status: config.StatusStopping},
+		{WebUserID: "fine", LabID: 1, ServerID: "3", Status: config.StatusRunning},
+	}
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+			return states, nil
+		},
+	}
+	channel := &recordingChannel{}
+	notifier := notify.NewNotifier(map[string]notify.Channel{"test": channel}, nil, 0, 0)
+
+	watchdog := NewWatchdog(slog.Default(), redisClient, 30*time.Minute, 30*time.Minute).WithNotifier(notifier).WithClock(now)
+
+	// First sighting starts the clock
+	watchdog.check(context.Background())
+	if len(channel.sent) != 0 {
+		t.Fatalf("expected no notification on first sight, got %+v", channel.sent)
+	}
+
+	// The deletion moved on, so only the provision is still stuck
+	states[1].Status = config.StatusDeleting
+	now.Advance(31 * time.Minute)
+	watchdog.check(context.Background())
+
+	if got := testutil.ToFloat64(stuckEntries.WithLabelValues(config.StatusProvisioning)); got != 1 {
+		t.Errorf("expected 1 stuck provisioning entry, got %v", got)
+	}
+	if got := testutil.ToFloat64(stuckEntries.WithLabelValues(config.StatusDeleting)); got != 0 {
+		t.Errorf("expected no stuck deleting entries, got %v", got)
+	}
+	if len(channel.sent) != 1 {
+		t.Fatalf("expected one notification, got %+v", channel.sent)
+	}
+	n := channel.sent[0]
+	if n.Event != notify.EventStuckState || !strings.Contains(n.Message, "user stuck, lab 1: provisioning for 31m") || strings.Contains(n.Message, "busy") {
+		t.Errorf("unexpected notification %+v", n)
+	}
+}
+
+func TestWatchdog_Remediation(t *testing.T) {
+	provisioning := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", Status: config.StatusProvisioning, CloudStatus: "starting"}
+	stopping := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", Status: config.StatusStopping}
+	uncreated := redis.ServerState{WebUserID: "user-1", LabID: 5, Status: config.StatusQueued}
+
+	tests := []struct {
+		name        string
+		remediation string
+		state       redis.ServerState
+		resumed     bool
+		queued      bool
+		removed     bool
+		failed      bool
+		autoFixOff  bool
+	}{
+		{name: "report only", remediation: config.StuckRemediationNone, state: provisioning},
+		{name: "requeue provision", remediation: config.StuckRemediationRequeue, state: provisioning, resumed: true},
+		{name: "requeue deletion", remediation: config.StuckRemediationRequeue, state: stopping, queued: true},
+		{name: "requeue without server", remediation: config.StuckRemediationRequeue, state: uncreated, removed: true},
+		{name: "delete provision", remediation: config.StuckRemediationDelete, state: provisioning, queued: true},
+		{name: "delete without server", remediation: config.StuckRemediationDelete, state: uncreated, removed: true},
+		{name: "fail", remediation: config.StuckRemediationFail, state: stopping, failed: true},
+		{name: "auto-fix flag off", remediation: config.StuckRemediationRequeue, state: provisioning, autoFixOff: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cached := tt.state
+			var queued []string
+			var removed bool
+			var pushed *redis.ServerState
+			redisClient := &mockRedisClient{
+				getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+					return []redis.ServerState{tt.state}, nil
+				},
+				getServerStateFunc: func(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+					state := cached
+					return &state, nil
+				},
+				pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+					pushed = &state
+					return nil
+				},
+				deleteServerStateFunc: func(ctx context.Context, cacheKey string) error {
+					removed = true
+					return nil
+				},
+				pushPayloadsFunc: func(ctx context.Context, queueKey string, payloads []string) error {
+					if queueKey != config.CleanupQueueKey {
+						t.Errorf("expected decommission on %s, got %s", config.CleanupQueueKey, queueKey)
+					}
+					queued = append(queued, payloads...)
+					return nil
+				},
+			}
+
+			var mu sync.Mutex
+			var resumed []redis.HandoffEntry
+			now := clock.NewFake(time.Now())
+			watchdog := NewWatchdog(slog.Default(), redisClient, 30*time.Minute, 30*time.Minute).
+				WithRemediation(tt.remediation, func(ctx context.Context, entry redis.HandoffEntry) {
+					mu.Lock()
+					defer mu.Unlock()
+					resumed = append(resumed, entry)
+				})
+			watchdog.WithClock(now)
+			if tt.autoFixOff {
+				store := redistest.New()
+				store.SetFlag(flags.ReconcilerAutoFix, "off")
+				watchdog.WithFlags(flags.New(slog.Default(), store))
+			}
+
+			watchdog.check(context.Background())
+			now.Advance(time.Hour)
+			watchdog.check(context.Background())
+			watchdog.Wait()
+
+			if (len(resumed) == 1) != tt.resumed {
+				t.Errorf("expected resumed=%v, got %+v", tt.resumed, resumed)
+			}
+			if tt.resumed && (resumed[0].ServerID != "42" || resumed[0].CacheKey != tt.state.CacheKey() || resumed[0].CloudStatus != "starting") {
+				t.Errorf("unexpected handoff entry %+v", resumed[0])
+			}
+			if (len(queued) == 1) != tt.queued {
+				t.Errorf("expected queued=%v, got %v", tt.queued, queued)
+			}
+			if tt.queued {
+				var req map[string]interface{}
+				if err := json.Unmarshal([]byte(queued[0]), &req); err != nil || req["webuserid"] != "user-1" {
+					t.Errorf("unexpected decommission request %s", queued[0])
+				}
+			}
+			if removed != tt.removed {
+				t.Errorf("expected removed=%v", tt.removed)
+			}
+			if (pushed != nil) != tt.failed {
+				t.Fatalf("expected failed=%v, got %+v", tt.failed, pushed)
+			}
+			if tt.failed && (pushed.Status != config.StatusFailed || pushed.CloudStatus != CloudStatusStuck || !pushed.ExpiresAt.Equal(now.Now())) {
+				t.Errorf("expected a failed entry due for cleanup, got %+v", pushed)
+			}
+		})
+	}
+}
+
+func TestWatchdog_Prime(t *testing.T) {
+	now := clock.NewFake(time.Now())
+	states := []redis.ServerState{
+		{WebUserID: "stuck", LabID: 1, ServerID: "1", Status: config.StatusProvisioning},
+		{WebUserID: "fine", LabID: 1, ServerID: "2", Status: config.StatusRunning},
+	}
+	redisClient := &mockRedisClient{
+		getExpiredServerStatesFunc: func(ctx context.Context, until time.Time) ([]redis.ServerState, error) {
+			return states, nil
+		},
+	}
+	channel := &recordingChannel{}
+	notifier := notify.NewNotifier(map[string]notify.Channel{"test": channel}, nil, 0, 0)
+
+	watchdog := NewWatchdog(slog.Default(), redisClient, 30*time.Minute, 30*time.Minute).WithNotifier(notifier).WithClock(now)
+	watchdog.Prime(states)
+
+	// The first check already counts from startup
+	now.Advance(31 * time.Minute)
+	watchdog.check(context.Background())
+
+	if len(channel.sent) != 1 || !strings.Contains(channel.sent[0].Message, "user stuck, lab 1: provisioning for 31m") {
+		t.Fatalf("expected the primed entry reported on the first check, got %+v", channel.sent)
+	}
+}
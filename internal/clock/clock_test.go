@@ -0,0 +1,23 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	if !c.Now().Equal(start) {
+		t.Fatalf("expected %v, got %v", start, c.Now())
+	}
+	c.Advance(90 * time.Second)
+	if want := start.Add(90 * time.Second); !c.Now().Equal(want) {
+		t.Errorf("expected %v after advancing, got %v", want, c.Now())
+	}
+	c.Set(start)
+	if !c.Now().Equal(start) {
+		t.Errorf("expected %v after setting, got %v", start, c.Now())
+	}
+}
@@ -1,46 +1,163 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Redis queue keys
-const (
+// DefaultKeyNamespace is the first segment of every Redis key, queue and channel
+const DefaultKeyNamespace = "vmmanager"
+
+// Redis queue keys, moved by SetKeyNamespace
+var (
 	ProvisionQueueKey    = "vmmanager:provision"
 	DecommissionQueueKey = "vmmanager:decommission"
+	CleanupQueueKey      = "vmmanager:decommission:cleanup" // decommissions of expired servers, taken after DecommissionQueueKey
+	UndoQueueKey         = "vmmanager:undo"                 // restores a lab decommissioned within the tombstone window
+	RebuildQueueKey      = "vmmanager:rebuild:queue"        // reinstalls a user's server from its image, keeping its address
+	ResizeQueueKey       = "vmmanager:resize"               // changes the server type of a user's server in place
+	ExtendQueueKey       = "vmmanager:extend"               // moves the expiry of a user's server on their request
 )
 
-// Redis cache keys
-const (
+// DeadLetterQueueKey returns the queue rejected messages of queueKey are moved to
+func DeadLetterQueueKey(queueKey string) string {
+	return queueKey + ":dlq"
+}
+
+// ShardQueueKey returns the queue holding the messages of queueKey for the users of one shard
+func ShardQueueKey(queueKey string, shard int) string {
+	return queueKey + ":shard:" + strconv.Itoa(shard)
+}
+
+// Redis cache keys, moved by SetKeyNamespace
+var (
 	ServerCachePrefix = "vmmanager:servers:"
+	ServerIndexKey    = "vmmanager:index:servers"   // SET of all server cache keys
+	IndexVersionKey   = "vmmanager:index:version"   // version of the server and expiry indexes, set once a scan has built them
+	ExpiryIndexKey    = "vmmanager:expiry"          // ZSET of server cache keys scored by ExpiresAt (unix ms)
+	UserHashPrefix    = "vmmanager:userhash:"       // label hash -> webuserid, never written to the provider
+	HandoffKey        = "vmmanager:handoff"         // LIST of in-flight provisions left behind by a draining instance
+	InstancePrefix    = "vmmanager:instances:"      // per-instance heartbeat
+	InstanceIndexKey  = "vmmanager:index:instances" // SET of instance IDs that have sent a heartbeat
+	PendingCreatesKey = "vmmanager:pending-creates" // HASH of server name -> creation that hasn't finished yet
+	EventsKey         = "vmmanager:events"          // LIST of recent failures and dropped requests, newest first
+	ActivityPrefix    = "vmmanager:activity:"       // per-user last activity (unix seconds), refreshed by LabMan or the SSH proxy
+	TombstonePrefix   = "vmmanager:tombstones:"     // per-user record of the last decommissioned lab, kept for the undo window
+	HistoryPrefix     = "vmmanager:history:"        // per-user LIST of recent lifecycle events, newest first
+	CreateBucketKey   = "vmmanager:create-bucket"   // HASH token bucket all instances take from before creating a server
+	ExtensionsPrefix  = "vmmanager:extensions:"     // per-user count of extensions granted on a UTC day, suffixed with the date
+	SequencePrefix    = "vmmanager:sequence:"       // per-user HASH of the last issued and the last applied operation sequence number
+	FlagPrefix        = "vmmanager:flags:"          // per-flag runtime toggle set by operators, e.g. vmmanager:flags:pause-cleanup
+	StatusChannel     = "vmmanager:status"          // pub/sub channel announcing every server state change to the instances
+	SessionsKey       = "vmmanager:sessions"        // STREAM of completed lab sessions, for course analytics
+	RateLimitPrefix   = "vmmanager:ratelimit:"      // per-user and operation rate limit window
+	PhoneHomePrefix   = "vmmanager:phonehome:"      // per-server key set once the server is ready, for phone-home readiness checks
 )
 
-// Server statuses for VMManager
+// keyNamespace is the namespace the keys above currently live in
+var keyNamespace = DefaultKeyNamespace
+
+var validKeyNamespace = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// KeyNamespace returns the first segment of every Redis key, queue and channel
+func KeyNamespace() string {
+	return keyNamespace
+}
+
+// SetKeyNamespace moves every Redis key, queue and channel into namespace, e.g. "staging"
+// makes the provision queue "staging:provision". It must be called before any key is used.
+func SetKeyNamespace(namespace string) error {
+	if err := ValidateKeyNamespace(namespace); err != nil {
+		return err
+	}
+	keys := []*string{
+		&ProvisionQueueKey, &DecommissionQueueKey, &CleanupQueueKey, &UndoQueueKey, &RebuildQueueKey, &ResizeQueueKey, &ExtendQueueKey,
+		&ServerCachePrefix, &ServerIndexKey, &IndexVersionKey, &ExpiryIndexKey, &UserHashPrefix, &HandoffKey, &InstancePrefix, &InstanceIndexKey,
+		&PendingCreatesKey, &EventsKey, &ActivityPrefix, &TombstonePrefix, &HistoryPrefix, &CreateBucketKey, &ExtensionsPrefix,
+		&SequencePrefix, &FlagPrefix, &StatusChannel, &SessionsKey, &RateLimitPrefix,
+		&PhoneHomePrefix,
+	}
+	for _, key := range keys {
+		*key = namespace + ":" + strings.TrimPrefix(*key, keyNamespace+":")
+	}
+	keyNamespace = namespace
+	return nil
+}
+
+// ValidateKeyNamespace returns an error if namespace can't be used as a key namespace
+func ValidateKeyNamespace(namespace string) error {
+	if !validKeyNamespace.MatchString(namespace) {
+		return fmt.Errorf("namespace must be 1 to 64 letters, digits, _ and -, got %q", namespace)
+	}
+	return nil
+}
+
+// GetKeyNamespace returns the namespace of the Redis keys, queues and channels
+// Reads from REDIS_KEY_NAMESPACE environment variable, defaults to "vmmanager"
+func GetKeyNamespace() string {
+	if namespace := os.Getenv("REDIS_KEY_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return DefaultKeyNamespace // default
+}
+
+// MaxEvents is the number of recent events kept in EventsKey
+const MaxEvents = 200
+
+// MaxHistory is the number of lifecycle events kept per user under HistoryPrefix
+const MaxHistory = 50
+
+// Server statuses for VMManager. See internal/lifecycle for the transitions between them.
 const (
+	StatusQueued       = "queued" // request accepted, server not created yet
 	StatusProvisioning = "provisioning"
 	StatusRunning      = "running"
+	StatusExpired      = "expired" // past its expiry, waiting for decommission
 	StatusStopping     = "stopping"
+	StatusDeleting     = "deleting" // server deletion at the provider is in progress
+	StatusDeleted      = "deleted"  // server is gone; the cache entry is removed rather than written with it
+	StatusFailed       = "failed"   // provisioning or deletion failed
 )
 
-// Cache TTL
+// CloudStatusQuarantined is the cloud status of a running server powered off for suspected
+// abuse. It stays off until decommissioned, so in-place operations and extensions refuse it.
+const CloudStatusQuarantined = "quarantined"
+
+// Remediations the stuck-state watchdog applies to entries stuck beyond their threshold
 const (
-	ServerCacheTTL = 24 * time.Hour
+	StuckRemediationNone    = "none"    // only report stuck entries
+	StuckRemediationRequeue = "requeue" // poll a stuck provision again, queue the decommission of a stuck deletion again
+	StuckRemediationDelete  = "delete"  // queue a decommission
+	StuckRemediationFail    = "fail"    // mark the entry failed, which the cleanup worker decommissions
+)
+
+// Remediations the abuse monitor applies to servers with suspicious usage
+const (
+	AbuseRemediationNone       = "none"       // only report the server
+	AbuseRemediationQuarantine = "quarantine" // power the server off, keeping its disk for investigation
 )
 
-// Retry configuration for cloud provider operations
+// Instance statuses published in the heartbeat
 const (
-	MaxRetryAttempts     = 5
-	InitialRetryDelay    = 5 * time.Second
-	MaxRetryDelay        = 60 * time.Second
-	RetryBackoffMultiple = 2
+	InstanceRunning  = "running"
+	InstanceDraining = "draining"
 )
 
-// Retry configuration for cache read operations
+// Cache TTL
+const (
+	ServerCacheTTL = 24 * time.Hour
+	HandoffTTL     = 1 * time.Hour      // a replacement instance is expected well within this window
+	HistoryTTL     = 7 * 24 * time.Hour // a user's history is dropped after a week without events
+)
+
+// Instance heartbeat: an instance is considered dead once its key expires
 const (
-	CacheReadRetryAttempts = 3
-	CacheReadRetryTimeout  = 2 * time.Second
+	HeartbeatInterval = 10 * time.Second
+	HeartbeatTTL      = 3 * HeartbeatInterval
 )
 
 // GetProvisionRateLimitDuration returns the rate limit duration for provision operations
@@ -64,3 +181,382 @@ func GetDecommissionRateLimitDuration() time.Duration {
 	}
 	return 15 * time.Second // default
 }
+
+// GetSwitchRateLimitDuration returns the rate limit duration for lab switches
+// Reads from SWITCH_RATE_LIMIT_SECONDS environment variable, defaults to 0 (the provision window)
+func GetSwitchRateLimitDuration() time.Duration {
+	if seconds := os.Getenv("SWITCH_RATE_LIMIT_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 0 // default
+}
+
+// GetExtendRateLimitDuration returns the rate limit duration for session extensions
+// Reads from EXTEND_RATE_LIMIT_SECONDS environment variable, defaults to 15 seconds
+func GetExtendRateLimitDuration() time.Duration {
+	if seconds := os.Getenv("EXTEND_RATE_LIMIT_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 15 * time.Second // default
+}
+
+// GetMaxRequestAge returns how long after its enqueuedAt a provision request is dropped as stale
+// Reads from MAX_REQUEST_AGE_MINUTES environment variable, defaults to 0 (no limit)
+func GetMaxRequestAge() time.Duration {
+	if minutes := os.Getenv("MAX_REQUEST_AGE_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 0 // default
+}
+
+// GetProviderCreateRate returns how many servers all instances together create per second
+// Reads from PROVIDER_CREATE_RATE environment variable, defaults to 5
+func GetProviderCreateRate() int {
+	if rate := os.Getenv("PROVIDER_CREATE_RATE"); rate != "" {
+		if val, err := strconv.Atoi(rate); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 5 // default
+}
+
+// GetProviderCreateBurst returns how many server creations may start at once before PROVIDER_CREATE_RATE applies
+// Reads from PROVIDER_CREATE_BURST environment variable, defaults to 10
+func GetProviderCreateBurst() int {
+	if burst := os.Getenv("PROVIDER_CREATE_BURST"); burst != "" {
+		if val, err := strconv.Atoi(burst); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 10 // default
+}
+
+// GetMaxInflightProvisions returns the cap on provisions running at once
+// Reads from MAX_INFLIGHT_PROVISIONS environment variable, defaults to 0 (unlimited)
+func GetMaxInflightProvisions() int {
+	if limit := os.Getenv("MAX_INFLIGHT_PROVISIONS"); limit != "" {
+		if val, err := strconv.Atoi(limit); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 0 // default
+}
+
+// GetQueueDepthAlertThreshold returns the queue depth above which operators are notified
+// Reads from NOTIFY_QUEUE_DEPTH_THRESHOLD environment variable, defaults to 0 (no alert)
+func GetQueueDepthAlertThreshold() int64 {
+	if threshold := os.Getenv("NOTIFY_QUEUE_DEPTH_THRESHOLD"); threshold != "" {
+		if val, err := strconv.ParseInt(threshold, 10, 64); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 0 // default
+}
+
+// GetDeleteTimeout returns how long one provider delete, including shutdown and retries, may take
+// Reads from DELETE_TIMEOUT_SECONDS environment variable, defaults to 10 minutes
+func GetDeleteTimeout() time.Duration {
+	if seconds := os.Getenv("DELETE_TIMEOUT_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 10 * time.Minute // default
+}
+
+// GetWindowsStateTimeout returns how long a new Windows server is polled until it accepts RDP connections
+// Reads from WINDOWS_STATE_TIMEOUT_MINUTES environment variable, defaults to 25 minutes
+func GetWindowsStateTimeout() time.Duration {
+	if minutes := os.Getenv("WINDOWS_STATE_TIMEOUT_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 25 * time.Minute // default
+}
+
+// GetTokenRefreshInterval returns how often provider tokens are reloaded from their files or Redis keys
+// Reads from HCLOUD_TOKEN_REFRESH_SECONDS environment variable, defaults to 60 seconds
+func GetTokenRefreshInterval() time.Duration {
+	if seconds := os.Getenv("HCLOUD_TOKEN_REFRESH_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 60 * time.Second // default
+}
+
+// GetLabCatalogSyncInterval returns how often the lab catalog is fetched from HCLOUD_LAB_CATALOG_URL
+// Reads from HCLOUD_LAB_CATALOG_SYNC_SECONDS environment variable, defaults to 300 seconds
+func GetLabCatalogSyncInterval() time.Duration {
+	if seconds := os.Getenv("HCLOUD_LAB_CATALOG_SYNC_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 300 * time.Second // default
+}
+
+// GetIdleTimeout returns how long a server may go without user activity before it is decommissioned
+// Reads from IDLE_TIMEOUT_MINUTES environment variable, defaults to 0 (idle expiry off, fixed TTL only)
+func GetIdleTimeout() time.Duration {
+	if minutes := os.Getenv("IDLE_TIMEOUT_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 0 // default
+}
+
+// GetMaxLifetime returns how long an active server may run at most when idle expiry or TTL refresh is on
+// Reads from MAX_LIFETIME_MINUTES environment variable, defaults to 4 hours
+func GetMaxLifetime() time.Duration {
+	if minutes := os.Getenv("MAX_LIFETIME_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 4 * time.Hour // default
+}
+
+// GetTTLRefreshExtension returns how long past a user's last activity their server's expiry is moved
+// Reads from TTL_REFRESH_MINUTES environment variable, defaults to 0 (expiry is never extended)
+func GetTTLRefreshExtension() time.Duration {
+	if minutes := os.Getenv("TTL_REFRESH_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 0 // default
+}
+
+// GetMaxSessionLength returns how long after its creation a server may run at most with extensions
+// Reads from EXTEND_MAX_SESSION_MINUTES environment variable, defaults to 4 hours
+func GetMaxSessionLength() time.Duration {
+	if minutes := os.Getenv("EXTEND_MAX_SESSION_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 4 * time.Hour // default
+}
+
+// GetMaxExtensionsPerDay returns how many extensions a user is granted per UTC day
+// Reads from EXTEND_MAX_PER_DAY environment variable, defaults to 3
+func GetMaxExtensionsPerDay() int {
+	if count := os.Getenv("EXTEND_MAX_PER_DAY"); count != "" {
+		if val, err := strconv.Atoi(count); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 3 // default
+}
+
+// GetTombstoneTTL returns how long a decommissioned lab can be restored with an undo request
+// Reads from TOMBSTONE_MINUTES environment variable, defaults to 0 (no tombstones, undo off)
+func GetTombstoneTTL() time.Duration {
+	if minutes := os.Getenv("TOMBSTONE_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 0 // default
+}
+
+// GetCleanupWorkers returns how many pages of server states the cleanup worker processes at once
+// Reads from CLEANUP_WORKERS environment variable, defaults to 4
+func GetCleanupWorkers() int {
+	if workers := os.Getenv("CLEANUP_WORKERS"); workers != "" {
+		if val, err := strconv.Atoi(workers); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 4 // default
+}
+
+// GetCleanupDeleteLimit returns how many deletions may be in progress before expired servers
+// stop being taken from the cleanup queue. User-initiated decommissions are never held back.
+// Reads from CLEANUP_DELETE_LIMIT environment variable, defaults to 20
+func GetCleanupDeleteLimit() int {
+	if limit := os.Getenv("CLEANUP_DELETE_LIMIT"); limit != "" {
+		if val, err := strconv.Atoi(limit); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 20 // default
+}
+
+// GetStuckProvisioningThreshold returns how long an entry may stay queued or provisioning before
+// the watchdog reports it as stuck
+// Reads from STUCK_PROVISIONING_MINUTES environment variable, defaults to 30 minutes
+func GetStuckProvisioningThreshold() time.Duration {
+	if minutes := os.Getenv("STUCK_PROVISIONING_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 30 * time.Minute // default
+}
+
+// GetStuckStoppingThreshold returns how long an entry may stay stopping or deleting before
+// the watchdog reports it as stuck
+// Reads from STUCK_STOPPING_MINUTES environment variable, defaults to 30 minutes
+func GetStuckStoppingThreshold() time.Duration {
+	if minutes := os.Getenv("STUCK_STOPPING_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 30 * time.Minute // default
+}
+
+// GetStuckRemediation returns what the watchdog does with stuck entries
+// Reads from STUCK_REMEDIATION environment variable, defaults to "none" (report only)
+func GetStuckRemediation() string {
+	switch remediation := os.Getenv("STUCK_REMEDIATION"); remediation {
+	case StuckRemediationRequeue, StuckRemediationDelete, StuckRemediationFail:
+		return remediation
+	}
+	return StuckRemediationNone // default
+}
+
+// GetRedisOperationTimeout returns how long one Redis call, including its retries, may take.
+// Blocking queue pops wait for their own timeout on top.
+// Reads from REDIS_OPERATION_TIMEOUT_SECONDS environment variable, defaults to 5 seconds
+func GetRedisOperationTimeout() time.Duration {
+	if seconds := os.Getenv("REDIS_OPERATION_TIMEOUT_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 5 * time.Second // default
+}
+
+// GetQueuePopMinTimeout returns how long a blocking queue pop waits right after a request,
+// while queues are held back and while the instance drains
+// Reads from QUEUE_POP_MIN_SECONDS environment variable, defaults to 1 second
+func GetQueuePopMinTimeout() time.Duration {
+	if seconds := os.Getenv("QUEUE_POP_MIN_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 1 * time.Second // default
+}
+
+// GetQueuePopMaxTimeout returns how long a blocking queue pop waits at most once the queues are idle
+// Reads from QUEUE_POP_MAX_SECONDS environment variable, defaults to 30 seconds
+func GetQueuePopMaxTimeout() time.Duration {
+	if seconds := os.Getenv("QUEUE_POP_MAX_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 30 * time.Second // default
+}
+
+// GetRedisBreakerFailures returns how many Redis calls in a row must fail to open the circuit breaker
+// Reads from REDIS_BREAKER_FAILURES environment variable, defaults to 5
+func GetRedisBreakerFailures() int {
+	if failures := os.Getenv("REDIS_BREAKER_FAILURES"); failures != "" {
+		if val, err := strconv.Atoi(failures); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 5 // default
+}
+
+// GetRedisBreakerCooldown returns how long an open circuit breaker fails Redis calls before letting them through again
+// Reads from REDIS_BREAKER_COOLDOWN_SECONDS environment variable, defaults to 10 seconds
+func GetRedisBreakerCooldown() time.Duration {
+	if seconds := os.Getenv("REDIS_BREAKER_COOLDOWN_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 10 * time.Second // default
+}
+
+// GetStateCacheFlushInterval returns how often server states cached in memory are written to Redis
+// Reads from STATE_CACHE_FLUSH_SECONDS environment variable, defaults to 0 (no in-memory cache)
+func GetStateCacheFlushInterval() time.Duration {
+	if seconds := os.Getenv("STATE_CACHE_FLUSH_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 0 // default
+}
+
+// GetStateCacheMaxAge returns how long a server state read from Redis is served from memory
+// Reads from STATE_CACHE_MAX_AGE_SECONDS environment variable, defaults to 10 seconds
+func GetStateCacheMaxAge() time.Duration {
+	if seconds := os.Getenv("STATE_CACHE_MAX_AGE_SECONDS"); seconds != "" {
+		if val, err := strconv.Atoi(seconds); err == nil && val > 0 {
+			return time.Duration(val) * time.Second
+		}
+	}
+	return 10 * time.Second // default
+}
+
+// GetAbuseCheckInterval returns how often the usage of running servers is checked for abuse
+// Reads from ABUSE_CHECK_MINUTES environment variable, defaults to 0 (abuse monitor off)
+func GetAbuseCheckInterval() time.Duration {
+	if minutes := os.Getenv("ABUSE_CHECK_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 0 // default
+}
+
+// GetAbuseWindow returns the period the abuse monitor averages a server's usage over
+// Reads from ABUSE_WINDOW_MINUTES environment variable, defaults to 60 minutes
+func GetAbuseWindow() time.Duration {
+	if minutes := os.Getenv("ABUSE_WINDOW_MINUTES"); minutes != "" {
+		if val, err := strconv.Atoi(minutes); err == nil && val > 0 {
+			return time.Duration(val) * time.Minute
+		}
+	}
+	return 60 * time.Minute // default
+}
+
+// GetAbuseCPUPercent returns the average CPU usage over the window the abuse monitor flags
+// on servers of idle users
+// Reads from ABUSE_CPU_PERCENT environment variable, defaults to 90
+func GetAbuseCPUPercent() float64 {
+	if percent := os.Getenv("ABUSE_CPU_PERCENT"); percent != "" {
+		if val, err := strconv.ParseFloat(percent, 64); err == nil && val > 0 {
+			return val
+		}
+	}
+	return 90 // default
+}
+
+// GetAbuseEgressBytes returns the average outgoing traffic over the window, in bytes per
+// second, the abuse monitor flags on any server
+// Reads from ABUSE_EGRESS_MBITS environment variable (megabits per second), defaults to 100
+func GetAbuseEgressBytes() float64 {
+	if mbits := os.Getenv("ABUSE_EGRESS_MBITS"); mbits != "" {
+		if val, err := strconv.ParseFloat(mbits, 64); err == nil && val > 0 {
+			return val * 1e6 / 8
+		}
+	}
+	return 100 * 1e6 / 8 // default
+}
+
+// GetAbuseRemediation returns what the abuse monitor does with flagged servers
+// Reads from ABUSE_REMEDIATION environment variable, defaults to "none" (report only)
+func GetAbuseRemediation() string {
+	switch remediation := os.Getenv("ABUSE_REMEDIATION"); remediation {
+	case AbuseRemediationQuarantine:
+		return remediation
+	}
+	return AbuseRemediationNone // default
+}
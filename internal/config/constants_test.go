@@ -0,0 +1,30 @@
+package config
+
+import "testing"
+
+func TestSetKeyNamespace(t *testing.T) {
+	t.Cleanup(func() { SetKeyNamespace(DefaultKeyNamespace) })
+
+	if err := SetKeyNamespace("staging"); err != nil {
+		t.Fatal(err)
+	}
+	if ProvisionQueueKey != "staging:provision" || ServerCachePrefix != "staging:servers:" || RateLimitPrefix != "staging:ratelimit:" {
+		t.Errorf("expected keys in the staging namespace, got %s, %s and %s", ProvisionQueueKey, ServerCachePrefix, RateLimitPrefix)
+	}
+	// Moving again starts from the current namespace, not the default
+	if err := SetKeyNamespace("rehearsal"); err != nil {
+		t.Fatal(err)
+	}
+	if CleanupQueueKey != "rehearsal:decommission:cleanup" || KeyNamespace() != "rehearsal" {
+		t.Errorf("expected keys in the rehearsal namespace, got %s in %s", CleanupQueueKey, KeyNamespace())
+	}
+
+	for _, invalid := range []string{"", "staging:swim", "a.b"} {
+		if err := SetKeyNamespace(invalid); err == nil {
+			t.Errorf("expected namespace %q to be rejected", invalid)
+		}
+	}
+	if KeyNamespace() != "rehearsal" {
+		t.Errorf("expected a rejected namespace to keep the keys where they were, got %s", KeyNamespace())
+	}
+}
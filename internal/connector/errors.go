@@ -0,0 +1,68 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// ErrorCode classifies provider errors, so callers can branch on them without knowing
+// the provider's own error codes or messages. Each code matches an errs kind with errors.Is.
+type ErrorCode string
+
+const (
+	CodeNotFound    ErrorCode = "not_found"    // the server does not exist (anymore)
+	CodeRateLimited ErrorCode = "rate_limited" // the provider throttled the call, retry later
+	CodeCapacity    ErrorCode = "capacity"     // no capacity for the requested server type or location
+	CodeLocked      ErrorCode = "locked"       // another action holds the resource, retry shortly
+)
+
+// Error is a provider error with a code
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+// NewError wraps err with code
+func NewError(code ErrorCode, err error) *Error {
+	return &Error{Code: code, Err: err}
+}
+
+// NotFound returns a CodeNotFound error with a formatted message
+func NotFound(format string, args ...any) *Error {
+	return NewError(CodeNotFound, fmt.Errorf(format, args...))
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the errs kind of the code: errors.Is(err, errs.ErrNotFound) is true for
+// CodeNotFound, and rate limits and locks are also errs.ErrTransient
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case CodeNotFound:
+		return target == errs.ErrNotFound
+	case CodeRateLimited:
+		return target == errs.ErrRateLimited || target == errs.ErrTransient
+	case CodeCapacity:
+		return target == errs.ErrCapacity
+	case CodeLocked:
+		return target == errs.ErrLocked || target == errs.ErrTransient
+	}
+	return false
+}
+
+// CodeOf returns the code of the first connector error in err's chain, or "" if err is not classified
+func CodeOf(err error) ErrorCode {
+	var connErr *Error
+	if errors.As(err, &connErr) {
+		return connErr.Code
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+func TestError_Is(t *testing.T) {
+	tests := []struct {
+		code ErrorCode
+		is   []error
+		not  []error
+	}{
+		{code: CodeNotFound, is: []error{errs.ErrNotFound}, not: []error{errs.ErrTransient}},
+		{code: CodeRateLimited, is: []error{errs.ErrRateLimited, errs.ErrTransient}, not: []error{errs.ErrNotFound}},
+		{code: CodeCapacity, is: []error{errs.ErrCapacity}, not: []error{errs.ErrTransient}},
+		{code: CodeLocked, is: []error{errs.ErrLocked, errs.ErrTransient}, not: []error{errs.ErrCapacity}},
+	}
+	for _, tt := range tests {
+		err := fmt.Errorf("delete server: %w", NewError(tt.code, errors.New("provider said no")))
+		for _, kind := range tt.is {
+			if !errors.Is(err, kind) {
+				t.Errorf("%s: expected errors.Is(err, %v)", tt.code, kind)
+			}
+		}
+		for _, kind := range tt.not {
+			if errors.Is(err, kind) {
+				t.Errorf("%s: expected !errors.Is(err, %v)", tt.code, kind)
+			}
+		}
+		if CodeOf(err) != tt.code {
+			t.Errorf("expected code %s, got %s", tt.code, CodeOf(err))
+		}
+	}
+
+	if err := NotFound("server with ID %s not found", "42"); err.Error() != "server with ID 42 not found" || !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("unexpected not found error: %v", err)
+	}
+	if CodeOf(errors.New("plain")) != "" {
+		t.Error("expected unclassified error to have no code")
+	}
+}
@@ -0,0 +1,158 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// Group stands for the servers of a composite lab, e.g. an attacker and a target. It acts as
+// its primary node, except that its state is that of the least ready node and that deleting
+// or rebuilding it acts on every node.
+type Group struct {
+	primary string
+	nodes   map[string]Server
+	ready   func(cloudState string) bool
+}
+
+// NewGroup groups nodes by node name. ready reports whether a provider status counts as
+// ready, e.g. from Connector.MapState; the group is ready once every node is.
+func NewGroup(primary string, nodes map[string]Server, ready func(cloudState string) bool) *Group {
+	return &Group{primary: primary, nodes: nodes, ready: ready}
+}
+
+// Nodes returns the servers of the group by node name
+func (g *Group) Nodes() map[string]Server {
+	return g.nodes
+}
+
+// Primary returns the name of the node the group acts as
+func (g *Group) Primary() string {
+	return g.primary
+}
+
+func (g *Group) GetID() string {
+	return g.nodes[g.primary].GetID()
+}
+
+func (g *Group) GetName() string {
+	return g.nodes[g.primary].GetName()
+}
+
+func (g *Group) GetIPv6Address() string {
+	return g.nodes[g.primary].GetIPv6Address()
+}
+
+func (g *Group) GetLabels() map[string]string {
+	return g.nodes[g.primary].GetLabels()
+}
+
+func (g *Group) GetServerType() string {
+	return g.nodes[g.primary].GetServerType()
+}
+
+func (g *Group) GetSSHHostKey() string {
+	return g.nodes[g.primary].GetSSHHostKey()
+}
+
+// Resize fails, the nodes of a lab may well need different server types
+func (g *Group) Resize(ctx context.Context, serverType string) error {
+	return fmt.Errorf("resizing a lab of %d servers is not supported", len(g.nodes))
+}
+
+// GetState returns the status of the first node that isn't ready yet, starting with the
+// primary, or the primary's status once all are
+func (g *Group) GetState(ctx context.Context) (string, error) {
+	var primaryState string
+	for _, name := range g.names() {
+		state, err := g.nodes[name].GetState(ctx)
+		if err != nil {
+			return "", fmt.Errorf("node %s: %w", name, err)
+		}
+		if !g.ready(state) {
+			return state, nil
+		}
+		if name == g.primary {
+			primaryState = state
+		}
+	}
+	return primaryState, nil
+}
+
+// Delete deletes the other nodes in parallel and the primary last, so a group whose primary
+// is gone has no nodes left. Nodes that are already gone count as deleted.
+func (g *Group) Delete(ctx context.Context) error {
+	others := make([]string, 0, len(g.nodes)-1)
+	for _, name := range g.names() {
+		if name != g.primary {
+			others = append(others, name)
+		}
+	}
+	if err := g.each(others, func(server Server) error {
+		if err := server.Delete(ctx); err != nil && !errors.Is(err, errs.ErrNotFound) {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return g.nodes[g.primary].Delete(ctx)
+}
+
+// Rebuild reinstalls every node in parallel
+func (g *Group) Rebuild(ctx context.Context) error {
+	return g.each(g.names(), func(server Server) error {
+		return server.Rebuild(ctx)
+	})
+}
+
+func (g *Group) String() string {
+	var nodes []string
+	for _, name := range g.names() {
+		nodes = append(nodes, name+"="+g.nodes[name].String())
+	}
+	return fmt.Sprintf("Group(%s)", strings.Join(nodes, ", "))
+}
+
+// names returns the node names, primary first and the others sorted
+func (g *Group) names() []string {
+	names := make([]string, 0, len(g.nodes))
+	for name := range g.nodes {
+		if name != g.primary {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{g.primary}, names...)
+}
+
+// each calls op on the named nodes in parallel. Returns the errors of all failed nodes
+// joined, so errors.Is still tells e.g. a locked node.
+func (g *Group) each(names []string, op func(Server) error) error {
+	errCh := make(chan error, len(names))
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := op(g.nodes[name]); err != nil {
+				errCh <- fmt.Errorf("node %s: %w", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+	close(errCh)
+
+	var failed []error
+	for err := range errCh {
+		failed = append(failed, err)
+	}
+	return errors.Join(failed...)
+}
+
+var _ Server = (*Group)(nil)
@@ -0,0 +1,95 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// fakeNode is a server of a group that records its deletion
+type fakeNode struct {
+	Server
+	id        string
+	state     string
+	deleteErr error
+
+	mu      *sync.Mutex
+	deleted *[]string
+}
+
+func (n *fakeNode) GetID() string {
+	return n.id
+}
+
+func (n *fakeNode) GetState(ctx context.Context) (string, error) {
+	return n.state, nil
+}
+
+func (n *fakeNode) Delete(ctx context.Context) error {
+	if n.deleteErr != nil {
+		return n.deleteErr
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	*n.deleted = append(*n.deleted, n.id)
+	return nil
+}
+
+func newTestGroup(states map[string]string, deleteErrs map[string]error) (*Group, *[]string) {
+	var mu sync.Mutex
+	var deleted []string
+	nodes := make(map[string]Server)
+	for name, state := range states {
+		nodes[name] = &fakeNode{id: name, state: state, deleteErr: deleteErrs[name], mu: &mu, deleted: &deleted}
+	}
+	return NewGroup("attacker", nodes, func(state string) bool { return state == "running" }), &deleted
+}
+
+func TestGroup_GetState(t *testing.T) {
+	tests := []struct {
+		name   string
+		states map[string]string
+		want   string
+	}{
+		{name: "all running", states: map[string]string{"attacker": "running", "target": "running"}, want: "running"},
+		{name: "primary starting", states: map[string]string{"attacker": "starting", "target": "running"}, want: "starting"},
+		{name: "other node initializing", states: map[string]string{"attacker": "running", "target": "initializing"}, want: "initializing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, _ := newTestGroup(tt.states, nil)
+			state, err := group.GetState(context.Background())
+			if err != nil || state != tt.want {
+				t.Errorf("expected %q, got %q, %v", tt.want, state, err)
+			}
+		})
+	}
+}
+
+func TestGroup_Delete(t *testing.T) {
+	states := map[string]string{"attacker": "running", "target": "running", "router": "running"}
+
+	group, deleted := newTestGroup(states, map[string]error{"router": NotFound("server router not found")})
+	if err := group.Delete(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*deleted) != 2 || (*deleted)[1] != "attacker" {
+		t.Errorf("expected the target and then the primary to be deleted, got %v", *deleted)
+	}
+
+	// The primary outlives a node that couldn't be deleted, so the group can be found again
+	group, deleted = newTestGroup(states, map[string]error{"target": NewError(CodeLocked, errors.New("locked"))})
+	err := group.Delete(context.Background())
+	if !errors.Is(err, errs.ErrLocked) {
+		t.Errorf("expected the node's lock error, got %v", err)
+	}
+	for _, id := range *deleted {
+		if id == "attacker" {
+			t.Errorf("expected the primary to be kept, got %v", *deleted)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package hcloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/alex-sviridov/swim/internal/readiness"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// maxLabNodes bounds the servers of a composite lab, which are all created at once
+const maxLabNodes = 5
+
+// errIncompatibleServerType signals that a server type can't boot the configured image,
+// e.g. an ARM (CAX) server type with an x86 snapshot
+var errIncompatibleServerType = errors.New("server type can't run the image")
+
+// LabSpec holds the server settings of one lab that differ from the HCLOUD_DEFAULT_* ones
+type LabSpec struct {
+	ServerTypes    []string  `json:"serverTypes"`    // e.g. ["cax11", "cax21"] for ARM labs, most preferred first
+	Image          string    `json:"image"`          // image name or ID, e.g. an ARM snapshot
+	PlacementGroup string    `json:"placementGroup"` // name or ID of the placement group the lab's servers join
+	Nodes          []LabNode `json:"nodes"`          // servers of a composite lab, the first is the primary; none for one server
+	OS             string    `json:"os"`             // "windows" for Windows images, "" or "linux" otherwise
+	Protected      bool      `json:"protected"`      // label the lab's servers protected, so SWIM never deletes them
+	EgressPolicy   string    `json:"egressPolicy"`   // lab class whose egress policy the lab's servers get, "none" for open egress
+
+	// Readiness, when set, must pass before a running server of the lab is available
+	Readiness *readiness.Spec `json:"readiness"`
+}
+
+// LabNode is one server of a composite lab, e.g. the attacker of an attacker and target lab.
+// Unset fields fall back to the lab's.
+type LabNode struct {
+	Name        string   `json:"name"`
+	ServerTypes []string `json:"serverTypes"`
+	Image       string   `json:"image"`
+	OS          string   `json:"os"`
+}
+
+// LabCatalog holds the server settings of labs by lab ID
+type LabCatalog map[int]LabSpec
+
+// loadLabCatalog reads a catalog such as {"12": {"serverTypes": ["cax11"], "image": "ubuntu-24.04"}}
+func loadLabCatalog(path string) (LabCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read lab catalog: %w", err)
+	}
+	return parseLabCatalog(data)
+}
+
+// parseLabCatalog parses and validates a JSON lab catalog. Unknown fields are rejected,
+// so a misspelled setting doesn't silently fall back to the default.
+func parseLabCatalog(data []byte) (LabCatalog, error) {
+	var catalog LabCatalog
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("parse lab catalog: %w", err)
+	}
+	for labID, spec := range catalog {
+		if labID <= 0 {
+			return nil, fmt.Errorf("lab %d: lab IDs must be positive", labID)
+		}
+		if spec.ServerTypes != nil {
+			serverTypes, err := parseServerTypes(strings.Join(spec.ServerTypes, ","))
+			if err != nil {
+				return nil, fmt.Errorf("lab %d: %w", labID, err)
+			}
+			spec.ServerTypes = serverTypes
+		}
+		if err := validateOS(spec.OS); err != nil {
+			return nil, fmt.Errorf("lab %d: %w", labID, err)
+		}
+		if err := parseLabNodes(spec.Nodes); err != nil {
+			return nil, fmt.Errorf("lab %d: %w", labID, err)
+		}
+		if spec.Readiness != nil {
+			if err := spec.Readiness.Validate(); err != nil {
+				return nil, fmt.Errorf("lab %d: %w", labID, err)
+			}
+		}
+		if spec.EgressPolicy != "" && spec.EgressPolicy != egressPolicyNone {
+			if err := validateEgressPolicyName(spec.EgressPolicy); err != nil {
+				return nil, fmt.Errorf("lab %d: %w", labID, err)
+			}
+		}
+		catalog[labID] = spec
+	}
+	return catalog, nil
+}
+
+// parseLabNodes validates the nodes of a composite lab, normalizing their server types in place
+func parseLabNodes(nodes []LabNode) error {
+	if nodes == nil {
+		return nil
+	}
+	if len(nodes) < 2 || len(nodes) > maxLabNodes {
+		return fmt.Errorf("a composite lab needs 2 to %d nodes, got %d", maxLabNodes, len(nodes))
+	}
+	seen := make(map[string]bool)
+	for i, node := range nodes {
+		if err := validate.NodeName(node.Name); err != nil {
+			return err
+		}
+		if seen[node.Name] {
+			return fmt.Errorf("node %q listed twice", node.Name)
+		}
+		seen[node.Name] = true
+		if err := validateOS(node.OS); err != nil {
+			return fmt.Errorf("node %s: %w", node.Name, err)
+		}
+		if node.ServerTypes != nil {
+			serverTypes, err := parseServerTypes(strings.Join(node.ServerTypes, ","))
+			if err != nil {
+				return fmt.Errorf("node %s: %w", node.Name, err)
+			}
+			nodes[i].ServerTypes = serverTypes
+		}
+	}
+	return nil
+}
+
+// ForLab returns the configuration for servers of labID, with the lab's catalog entry applied
+func (c HCloudConfig) ForLab(labID int) HCloudConfig {
+	spec, ok := c.Labs[labID]
+	if !ok {
+		return c
+	}
+	if len(spec.ServerTypes) > 0 {
+		c.ServerTypes = spec.ServerTypes
+		c.ServerType = spec.ServerTypes[0]
+	}
+	if spec.Image != "" {
+		c.ImageID = spec.Image
+	}
+	if spec.PlacementGroup != "" {
+		c.PlacementGroup = spec.PlacementGroup
+	}
+	if spec.OS != "" {
+		c.OS = spec.OS
+	}
+	c.Protected = spec.Protected
+	switch spec.EgressPolicy {
+	case "":
+	case egressPolicyNone:
+		c.EgressPolicy = ""
+	default:
+		c.EgressPolicy = spec.EgressPolicy
+	}
+	return c
+}
+
+// ForNode returns the configuration for the node of a composite lab, with the lab's and the
+// node's catalog entries applied. An empty node is the same as ForLab.
+func (c HCloudConfig) ForNode(labID int, node string) HCloudConfig {
+	c = c.ForLab(labID)
+	for _, n := range c.Labs[labID].Nodes {
+		if n.Name != node {
+			continue
+		}
+		if len(n.ServerTypes) > 0 {
+			c.ServerTypes = n.ServerTypes
+			c.ServerType = n.ServerTypes[0]
+		}
+		if n.Image != "" {
+			c.ImageID = n.Image
+		}
+		if n.OS != "" {
+			c.OS = n.OS
+		}
+	}
+	return c
+}
+
+// LabNodes returns the node names of a composite lab, primary first, or nil for a lab of one server
+func (c *Connector) LabNodes(labID int) ([]string, error) {
+	cfg, err := c.serverConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, node := range cfg.Labs[labID].Nodes {
+		names = append(names, node.Name)
+	}
+	return names, nil
+}
+
+// LabReadiness returns the readiness check of a lab, or nil for a lab that is available as
+// soon as it runs
+func (c *Connector) LabReadiness(labID int) (*readiness.Spec, error) {
+	cfg, err := c.serverConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Labs[labID].Readiness, nil
+}
+
+// architectures caches the CPU architecture of server types, which never changes
+type architectures struct {
+	mu     sync.Mutex
+	byType map[string]hcloud.Architecture
+}
+
+// imageFor resolves image for serverType before anything is created. An image name resolves
+// to its build for the server type's architecture; an image ID must already match it.
+// Returns an errIncompatibleServerType error if the server type can't boot the image.
+func (c *Connector) imageFor(ctx context.Context, image string, serverType string) (*hcloud.Image, error) {
+	arch, err := c.architecture(ctx, serverType)
+	if err != nil {
+		return nil, err
+	}
+	resolved, _, err := c.client.Image.GetForArchitecture(ctx, image, arch)
+	if err != nil {
+		return nil, fmt.Errorf("get image: %w", classify(err))
+	}
+	if resolved == nil {
+		return nil, fmt.Errorf("%w: no %s build of image %q for server type %s", errIncompatibleServerType, arch, image, serverType)
+	}
+	if resolved.Architecture != arch {
+		return nil, fmt.Errorf("%w: image %q is built for %s, server type %s is %s",
+			errIncompatibleServerType, image, resolved.Architecture, serverType, arch)
+	}
+	return resolved, nil
+}
+
+// architecture returns the CPU architecture of serverType
+func (c *Connector) architecture(ctx context.Context, serverType string) (hcloud.Architecture, error) {
+	c.arch.mu.Lock()
+	arch, ok := c.arch.byType[serverType]
+	c.arch.mu.Unlock()
+	if ok {
+		return arch, nil
+	}
+
+	st, _, err := c.client.ServerType.GetByName(ctx, serverType)
+	if err != nil {
+		return "", fmt.Errorf("get server type: %w", classify(err))
+	}
+	if st == nil {
+		return "", fmt.Errorf("%w: server type %s does not exist", errIncompatibleServerType, serverType)
+	}
+
+	c.arch.mu.Lock()
+	defer c.arch.mu.Unlock()
+	if c.arch.byType == nil {
+		c.arch.byType = make(map[string]hcloud.Architecture)
+	}
+	c.arch.byType[serverType] = st.Architecture
+	return st.Architecture, nil
+}
+
+// placementGroup looks up the placement group new servers join
+func (c *Connector) placementGroup(ctx context.Context, idOrName string) (*hcloud.PlacementGroup, error) {
+	group, _, err := c.client.PlacementGroup.Get(ctx, idOrName)
+	if err != nil {
+		return nil, fmt.Errorf("get placement group: %w", classify(err))
+	}
+	if group == nil {
+		return nil, fmt.Errorf("placement group '%s' not found", idOrName)
+	}
+	return group, nil
+}
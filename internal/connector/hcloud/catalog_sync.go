@@ -0,0 +1,126 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCatalogSize bounds the lab catalog read from a URL
+	maxCatalogSize = 1 << 20
+
+	catalogFetchTimeout = 30 * time.Second
+)
+
+// LabCatalogSync keeps a lab catalog fetched from a URL, e.g. the raw URL of a file in the Git
+// repository of the curriculum, so lab specs change without touching the SWIM deployment.
+// Fetches are conditional on the ETag of the last one; a catalog that can't be fetched or
+// fails validation keeps the current one in use.
+type LabCatalogSync struct {
+	log        *slog.Logger
+	url        string
+	token      string // bearer token for private repositories, "" for none
+	httpClient *http.Client
+
+	mu      sync.RWMutex
+	catalog LabCatalog
+	etag    string
+}
+
+// NewLabCatalogSync fetches the catalog at url. A catalog that can't be fetched or is invalid is an error.
+func NewLabCatalogSync(ctx context.Context, log *slog.Logger, url, token string) (*LabCatalogSync, error) {
+	s := &LabCatalogSync{
+		log:        log,
+		url:        url,
+		token:      token,
+		httpClient: &http.Client{Timeout: catalogFetchTimeout},
+	}
+	if _, err := s.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Catalog returns the current catalog
+func (s *LabCatalogSync) Catalog() LabCatalog {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.catalog
+}
+
+// Refresh fetches the catalog unless it is unchanged since the last fetch, and reports
+// whether a new catalog was loaded. On error the current catalog is kept.
+func (s *LabCatalogSync) Refresh(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return false, fmt.Errorf("build lab catalog request: %w", err)
+	}
+	s.mu.RLock()
+	etag := s.etag
+	s.mu.RUnlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("fetch lab catalog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("fetch lab catalog: unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCatalogSize+1))
+	if err != nil {
+		return false, fmt.Errorf("read lab catalog: %w", err)
+	}
+	if len(data) > maxCatalogSize {
+		return false, fmt.Errorf("lab catalog is larger than %d bytes", maxCatalogSize)
+	}
+	catalog, err := parseLabCatalog(data)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catalog = catalog
+	s.etag = resp.Header.Get("ETag")
+	return true, nil
+}
+
+// Run fetches the catalog every interval until ctx is cancelled
+func (s *LabCatalogSync) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := s.Refresh(ctx)
+			if err != nil {
+				s.log.Warn("failed to sync lab catalog, keeping the current one", "url", s.url, "error", err)
+				continue
+			}
+			if changed {
+				s.log.Info("lab catalog updated", "url", s.url, "labs", len(s.Catalog()))
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package hcloud
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLabCatalogSync(t *testing.T) {
+	body := `{"12": {"serverTypes": ["cax11"]}}`
+	etag := `"v1"`
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := NewLabCatalogSync(ctx, log, srv.URL, "wrong"); err == nil {
+		t.Fatal("expected an error for a rejected token")
+	}
+
+	labs, err := NewLabCatalogSync(ctx, log, srv.URL, "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if labs.Catalog()[12].ServerTypes[0] != "cax11" {
+		t.Fatalf("unexpected catalog %+v", labs.Catalog())
+	}
+
+	// Unchanged catalogs are not downloaded again
+	if changed, err := labs.Refresh(ctx); err != nil || changed {
+		t.Errorf("expected an unchanged catalog, got changed=%v, err=%v", changed, err)
+	}
+
+	// An invalid catalog keeps the current one
+	body, etag = `{"12": {"serverType": "cx22"}}`, `"v2"`
+	if _, err := labs.Refresh(ctx); err == nil {
+		t.Error("expected an invalid catalog to be rejected")
+	}
+	if labs.Catalog()[12].ServerTypes[0] != "cax11" {
+		t.Errorf("expected the current catalog to be kept, got %+v", labs.Catalog())
+	}
+
+	body, etag = `{"12": {"serverTypes": ["cax21"]}, "13": {"image": "debian-12"}}`, `"v3"`
+	if changed, err := labs.Refresh(ctx); err != nil || !changed {
+		t.Fatalf("expected a new catalog, got changed=%v, err=%v", changed, err)
+	}
+	if len(labs.Catalog()) != 2 || labs.Catalog()[12].ServerTypes[0] != "cax21" {
+		t.Errorf("unexpected catalog %+v", labs.Catalog())
+	}
+	if fetches != 5 {
+		t.Errorf("expected 5 fetches, got %d", fetches)
+	}
+}
@@ -0,0 +1,217 @@
+package hcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/readiness"
+)
+
+func TestLoadLabCatalog(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    LabCatalog
+		wantErr bool
+	}{
+		{
+			name:    "arm lab",
+			content: `{"12": {"serverTypes": ["cax11", " cax21"], "image": "ubuntu-24.04", "placementGroup": "lab12"}}`,
+			want:    LabCatalog{12: {ServerTypes: []string{"cax11", "cax21"}, Image: "ubuntu-24.04", PlacementGroup: "lab12"}},
+		},
+		{name: "image only", content: `{"3": {"image": "123"}}`, want: LabCatalog{3: {Image: "123"}}},
+		{name: "duplicate server type", content: `{"3": {"serverTypes": ["cax11", "cax11"]}}`, wantErr: true},
+		{name: "non-numeric lab", content: `{"lab": {"image": "123"}}`, wantErr: true},
+		{name: "misspelled field", content: `{"3": {"images": "123"}}`, wantErr: true},
+		{name: "zero lab ID", content: `{"0": {"image": "123"}}`, wantErr: true},
+		{
+			name:    "composite lab",
+			content: `{"7": {"nodes": [{"name": "attacker", "image": "kali"}, {"name": "target", "serverTypes": ["cx32"]}]}}`,
+			want: LabCatalog{7: {Nodes: []LabNode{
+				{Name: "attacker", Image: "kali"},
+				{Name: "target", ServerTypes: []string{"cx32"}},
+			}}},
+		},
+		{name: "single node", content: `{"7": {"nodes": [{"name": "attacker"}]}}`, wantErr: true},
+		{name: "duplicate node", content: `{"7": {"nodes": [{"name": "box"}, {"name": "box"}]}}`, wantErr: true},
+		{name: "windows lab", content: `{"9": {"image": "win2022", "os": "windows"}}`, want: LabCatalog{9: {Image: "win2022", OS: "windows"}}},
+		{name: "unknown os", content: `{"9": {"os": "macos"}}`, wantErr: true},
+		{name: "invalid node name", content: `{"7": {"nodes": [{"name": "Attacker"}, {"name": "target"}]}}`, wantErr: true},
+		{
+			name:    "readiness check",
+			content: `{"5": {"readiness": {"type": "http", "port": 8080, "path": "/healthz", "timeoutSeconds": 900}}}`,
+			want:    LabCatalog{5: {Readiness: &readiness.Spec{Type: "http", Port: 8080, Path: "/healthz", TimeoutSeconds: 900}}},
+		},
+		{name: "unknown readiness check", content: `{"5": {"readiness": {"type": "icmp"}}}`, wantErr: true},
+		{name: "misspelled readiness field", content: `{"5": {"readiness": {"type": "tcp", "prot": 22}}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "labs.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			catalog, err := loadLabCatalog(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", catalog)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(catalog, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, catalog)
+			}
+		})
+	}
+}
+
+func TestHCloudConfig_ForLab(t *testing.T) {
+	cfg := HCloudConfig{
+		ServerType:     "cx22",
+		ServerTypes:    []string{"cx22", "cx32"},
+		ImageID:        "ubuntu-24.04",
+		PlacementGroup: "default",
+		Labs: LabCatalog{
+			12: {ServerTypes: []string{"cax11"}, Image: "arm-snapshot"},
+			7: {Image: "lab7", Nodes: []LabNode{
+				{Name: "attacker", Image: "kali"},
+				{Name: "target", ServerTypes: []string{"cx32"}},
+			}},
+		},
+	}
+
+	arm := cfg.ForLab(12)
+	if arm.ServerType != "cax11" || len(arm.ServerTypes) != 1 || arm.ImageID != "arm-snapshot" || arm.PlacementGroup != "default" {
+		t.Errorf("expected the lab's server types and image, got %+v", arm)
+	}
+	other := cfg.ForLab(5)
+	if other.ServerType != "cx22" || len(other.ServerTypes) != 2 || other.ImageID != "ubuntu-24.04" {
+		t.Errorf("expected the defaults for a lab without an entry, got %+v", other)
+	}
+	if cfg.ServerType != "cx22" {
+		t.Errorf("expected the defaults to be left alone, got %+v", cfg)
+	}
+
+	attacker := cfg.ForNode(7, "attacker")
+	if attacker.ImageID != "kali" || attacker.ServerType != "cx22" {
+		t.Errorf("expected the node's image on the default server types, got %+v", attacker)
+	}
+	target := cfg.ForNode(7, "target")
+	if target.ImageID != "lab7" || target.ServerType != "cx32" || len(target.ServerTypes) != 1 {
+		t.Errorf("expected the node's server types with the lab's image, got %+v", target)
+	}
+}
+
+// newFakeAPIConnector returns a connector for a fake API with the x86 type cx22 (fsn1, nbg1),
+// the ARM type cax11 (fsn1), the image ubuntu-24.04 for both and the x86 snapshot 77
+func newFakeAPIConnector(t *testing.T) *Connector {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		cx22 := `{"id": 1, "name": "cx22", "architecture": "x86", "locations": [{"id": 1, "name": "fsn1"}, {"id": 2, "name": "nbg1"}]}`
+		cax11 := `{"id": 2, "name": "cax11", "architecture": "arm", "locations": [{"id": 1, "name": "fsn1"}]}`
+		switch r.URL.Path {
+		case "/server_types":
+			switch r.URL.Query().Get("name") {
+			case "":
+				fmt.Fprintf(w, `{"server_types": [%s, %s]}`, cx22, cax11)
+			case "cx22":
+				fmt.Fprintf(w, `{"server_types": [%s]}`, cx22)
+			case "cax11":
+				fmt.Fprintf(w, `{"server_types": [%s]}`, cax11)
+			default:
+				fmt.Fprint(w, `{"server_types": []}`)
+			}
+		case "/locations":
+			fmt.Fprint(w, `{"locations": [{"id": 1, "name": "fsn1"}, {"id": 2, "name": "nbg1"}]}`)
+		case "/images":
+			// Only ubuntu-24.04 is built for both architectures
+			if r.URL.Query().Get("name") != "ubuntu-24.04" {
+				fmt.Fprint(w, `{"images": []}`)
+				return
+			}
+			arch := r.URL.Query().Get("architecture")
+			fmt.Fprintf(w, `{"images": [{"id": 10, "name": "ubuntu-24.04", "architecture": %q}]}`, arch)
+		case "/images/77":
+			fmt.Fprint(w, `{"image": {"id": 77, "type": "snapshot", "architecture": "x86"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": "not_found", "message": "not found"}}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Connector{
+		client: hcloud.NewClient(hcloud.WithEndpoint(srv.URL), hcloud.WithToken("token")),
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestConnector_imageFor(t *testing.T) {
+	c := newFakeAPIConnector(t)
+
+	tests := []struct {
+		name         string
+		image        string
+		serverType   string
+		wantArch     hcloud.Architecture
+		incompatible bool
+	}{
+		{name: "name resolves to the x86 build", image: "ubuntu-24.04", serverType: "cx22", wantArch: hcloud.ArchitectureX86},
+		{name: "name resolves to the arm build", image: "ubuntu-24.04", serverType: "cax11", wantArch: hcloud.ArchitectureARM},
+		{name: "x86 snapshot on x86", image: "77", serverType: "cx22", wantArch: hcloud.ArchitectureX86},
+		{name: "x86 snapshot on arm", image: "77", serverType: "cax11", incompatible: true},
+		{name: "no build for the architecture", image: "x86-only", serverType: "cax11", incompatible: true},
+		{name: "unknown server type", image: "ubuntu-24.04", serverType: "cx999", incompatible: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := c.imageFor(context.Background(), tt.image, tt.serverType)
+			if tt.incompatible {
+				if !errors.Is(err, errIncompatibleServerType) {
+					t.Fatalf("expected an incompatible server type, got %v, %+v", err, image)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if image.Architecture != tt.wantArch {
+				t.Errorf("expected a %s image, got %+v", tt.wantArch, image)
+			}
+		})
+	}
+}
+
+func TestConnector_LabServerTypes(t *testing.T) {
+	c := (&Connector{}).WithConfig(&HCloudConfig{
+		ServerTypes: []string{"cx22", "cx32"},
+		Labs:        LabCatalog{12: {ServerTypes: []string{"cax11", "cax21"}}},
+	})
+
+	if !connector.AllowsServerType(c, 12, "cax21") || connector.AllowsServerType(c, 12, "cx32") {
+		t.Error("expected only the lab's server types to be allowed")
+	}
+	if !connector.AllowsServerType(c, 5, "cx32") || connector.AllowsServerType(c, 5, "ccx63") {
+		t.Error("expected the default server types for a lab without an entry")
+	}
+	if !connector.AllowsServerType(&Connector{}, 5, "ccx63") {
+		t.Error("expected a connector without configuration to allow any type")
+	}
+}
@@ -0,0 +1,107 @@
+package hcloud
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// maxUserDataSize is the largest user data Hetzner Cloud accepts
+const maxUserDataSize = 32 * 1024
+
+// baselineMergeType makes cloud-init append the lists of the lab's cloud-config (packages,
+// runcmd, write_files, ...) to the baseline's, and keep the baseline's value of any other
+// key both set, so a lab can add to the baseline but not switch parts of it off
+const baselineMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+// multipartHeader marks user data that already is a MIME multi-part archive
+const multipartHeader = "content-type: multipart/"
+
+// loadCloudInitBaseline reads the cloud-config merged into the user data of every Linux server
+func loadCloudInitBaseline(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read cloud-init baseline: %w", err)
+	}
+	baseline := string(data)
+	if !strings.HasPrefix(strings.TrimSpace(baseline), cloudConfigHeader) {
+		return "", fmt.Errorf("cloud-init baseline must be %s", cloudConfigHeader)
+	}
+	// The baseline's keys win, so its host keys would replace the one SWIM publishes
+	if sshKeysSection.MatchString(baseline) {
+		return "", fmt.Errorf("cloud-init baseline must not set ssh_keys")
+	}
+	return baseline, nil
+}
+
+// isMultipart reports whether userData is a MIME multi-part archive, which can't be nested
+func isMultipart(userData string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(userData)), multipartHeader)
+}
+
+// mergeCloudInit combines the baseline and a server's user data into a MIME multi-part
+// archive, which cloud-init merges with baselineMergeType. User data that isn't
+// cloud-config, e.g. a shell script, runs after the baseline is applied.
+// Returns userData unchanged if there is no baseline.
+func mergeCloudInit(baseline, userData string) (string, error) {
+	if baseline == "" {
+		return userData, nil
+	}
+	if isMultipart(userData) {
+		return "", fmt.Errorf("user data is a multi-part archive, the cloud-init baseline can't be merged into it")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		name, content string
+		header        textproto.MIMEHeader
+	}{
+		{name: "baseline.cfg", content: baseline},
+		{name: "lab", content: userData, header: textproto.MIMEHeader{"X-Merge-Type": {baselineMergeType}}},
+	}
+	for _, p := range parts {
+		header := textproto.MIMEHeader{
+			"Content-Type":        {userDataContentType(p.content)},
+			"Content-Disposition": {fmt.Sprintf(`attachment; filename="%s"`, p.name)},
+		}
+		for key, values := range p.header {
+			header[key] = values
+		}
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return "", fmt.Errorf("merge cloud-init baseline: %w", err)
+		}
+		if _, err := part.Write([]byte(p.content)); err != nil {
+			return "", fmt.Errorf("merge cloud-init baseline: %w", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("merge cloud-init baseline: %w", err)
+	}
+
+	merged := fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n%s", writer.Boundary(), body.String())
+	if len(merged) > maxUserDataSize {
+		return "", fmt.Errorf("user data with the cloud-init baseline is %d bytes, Hetzner Cloud accepts %d", len(merged), maxUserDataSize)
+	}
+	return merged, nil
+}
+
+// userDataContentType returns the MIME type cloud-init handles userData as, by its first line
+func userDataContentType(userData string) string {
+	switch trimmed := strings.TrimSpace(userData); {
+	case strings.HasPrefix(trimmed, cloudConfigHeader):
+		return "text/cloud-config"
+	case strings.HasPrefix(trimmed, "#!"):
+		return "text/x-shellscript"
+	case strings.HasPrefix(trimmed, "#include"):
+		return "text/x-include-url"
+	case strings.HasPrefix(trimmed, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	default:
+		return "text/plain"
+	}
+}
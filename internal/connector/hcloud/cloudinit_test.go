@@ -0,0 +1,104 @@
+package hcloud
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeCloudInit(t *testing.T) {
+	baseline := "#cloud-config\npackages:\n  - unattended-upgrades\n  - auditd\nssh_pwauth: false\n"
+	userData := "#cloud-config\npackages:\n  - git\n"
+
+	merged, err := mergeCloudInit(baseline, userData)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	header, body, ok := strings.Cut(merged, "\n\n")
+	if !ok {
+		t.Fatalf("expected MIME headers, got %q", merged)
+	}
+	mediaType, params, err := mime.ParseMediaType(strings.TrimPrefix(strings.Split(header, "\n")[0], "Content-Type: "))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected a multipart/mixed archive, got %q, %v", header, err)
+	}
+
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var contents, mergeTypes []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		if part.Header.Get("Content-Type") != "text/cloud-config" {
+			t.Errorf("expected a cloud-config part, got %q", part.Header.Get("Content-Type"))
+		}
+		content, _ := io.ReadAll(part)
+		contents = append(contents, string(content))
+		mergeTypes = append(mergeTypes, part.Header.Get("X-Merge-Type"))
+	}
+	if len(contents) != 2 || contents[0] != baseline || contents[1] != userData {
+		t.Fatalf("expected the baseline followed by the user data, got %q", contents)
+	}
+	// The lab's part is merged into the baseline, whose settings win
+	if mergeTypes[0] != "" || mergeTypes[1] != baselineMergeType {
+		t.Errorf("expected the merge type on the lab's part, got %q", mergeTypes)
+	}
+}
+
+func TestMergeCloudInit_Edges(t *testing.T) {
+	baseline := "#cloud-config\npackages:\n  - auditd\n"
+
+	if merged, err := mergeCloudInit("", "#!/bin/sh\necho hi\n"); err != nil || merged != "#!/bin/sh\necho hi\n" {
+		t.Errorf("expected user data unchanged without a baseline, got %q, %v", merged, err)
+	}
+	merged, err := mergeCloudInit(baseline, "#!/bin/sh\necho hi\n")
+	if err != nil || !strings.Contains(merged, "Content-Type: text/x-shellscript") {
+		t.Errorf("expected a shell script part, got %q, %v", merged, err)
+	}
+	if _, err := mergeCloudInit(baseline, "Content-Type: multipart/mixed; boundary=x\n\n--x--\n"); err == nil {
+		t.Error("expected a multi-part archive to be rejected")
+	}
+	if _, err := mergeCloudInit(baseline, "#cloud-config\n"+strings.Repeat("#", maxUserDataSize)); err == nil {
+		t.Error("expected user data over the size limit to be rejected")
+	}
+}
+
+func TestLoadCloudInitBaseline(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "cloud-config", content: "#cloud-config\npackage_upgrade: true\n"},
+		{name: "shell script", content: "#!/bin/sh\napt-get upgrade -y\n", wantErr: true},
+		{name: "sets host keys", content: "#cloud-config\nssh_keys:\n  ed25519_public: x\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "baseline.yml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			baseline, err := loadCloudInitBaseline(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %q", baseline)
+				}
+				return
+			}
+			if err != nil || baseline != tt.content {
+				t.Errorf("expected the file's content, got %q, %v", baseline, err)
+			}
+		})
+	}
+}
@@ -2,38 +2,118 @@ package hcloud
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/retry"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
 
+// consoleValidity is how long Hetzner Cloud accepts a requested console URL
+const consoleValidity = 1 * time.Minute
+
 type Connector struct {
-	client *hcloud.Client
-	dryrun bool
-	log    *slog.Logger
+	client    *hcloud.Client
+	dryrun    bool
+	log       *slog.Logger
+	journal   connector.CreateJournal
+	locations *locationSelector
+	arch      architectures
+	labs      *LabCatalogSync
+
+	// cfg holds the server defaults and lab catalog new servers are created with
+	cfg *HCloudConfig
+
+	// lockedRetry paces the retries of calls on a server another action holds
+	lockedRetry retry.Policy
 }
 
+// NewConnector creates a connector for HCLOUD_TOKEN with the server configuration read from
+// the environment, see GetHCloudConfigFromEnv
 func NewConnector(log *slog.Logger, dryrun bool) (*Connector, error) {
 	token := os.Getenv("HCLOUD_TOKEN")
 	if token == "" {
 		return nil, fmt.Errorf("missing required environment variable: HCLOUD_TOKEN")
 	}
+	cfg, err := GetHCloudConfigFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("get hcloud config: %w", err)
+	}
+	return NewConnectorWithToken(log, token, dryrun).WithConfig(cfg), nil
+}
 
+// NewConnectorWithToken creates a connector for the Hetzner Cloud project token belongs to
+func NewConnectorWithToken(log *slog.Logger, token string, dryrun bool) *Connector {
 	return &Connector{
-		client: hcloud.NewClient(hcloud.WithToken(token)),
-		dryrun: dryrun,
-		log:    log,
-	}, nil
+		client:      hcloud.NewClient(hcloud.WithToken(token), hcloud.WithHTTPClient(newInstrumentedClient(http.DefaultTransport))),
+		dryrun:      dryrun,
+		log:         log,
+		locations:   newLocationSelector(),
+		lockedRetry: retry.Get(retry.ProviderCall),
+	}
+}
+
+// NewConnectorWithTokens creates a connector that authenticates with the current token of
+// tokens, so a rotated token is used without recreating the connector
+func NewConnectorWithTokens(log *slog.Logger, tokens TokenProvider, dryrun bool) *Connector {
+	// Each attempt of a call retried after a rotation is counted separately
+	httpClient := &http.Client{Transport: &rotatingTransport{tokens: tokens, base: &instrumentedTransport{base: http.DefaultTransport}}}
+	return &Connector{
+		client:      hcloud.NewClient(hcloud.WithHTTPClient(httpClient)),
+		dryrun:      dryrun,
+		log:         log,
+		locations:   newLocationSelector(),
+		lockedRetry: retry.Get(retry.ProviderCall),
+	}
+}
+
+// WithCreateJournal records every server name before the create call, so servers left behind
+// by a failed creation can be found later. The entry is cleared here only if the creation
+// failed and the server is gone; otherwise the caller clears it once the server is cached.
+func (c *Connector) WithCreateJournal(journal connector.CreateJournal) *Connector {
+	c.journal = journal
+	return c
+}
+
+// WithConfig creates servers with cfg, which is read once instead of on every request.
+// The lab catalog of cfg overrides it per lab; see WithLabCatalog for a synced one.
+func (c *Connector) WithConfig(cfg *HCloudConfig) *Connector {
+	c.cfg = cfg
+	return c
+}
+
+// WithLabCatalog uses the lab catalog kept by labs instead of HCLOUD_LAB_CATALOG_FILE
+func (c *Connector) WithLabCatalog(labs *LabCatalogSync) *Connector {
+	c.labs = labs
+	return c
 }
 
-func (c *Connector) ListServers() (servers []connector.Server, err error) {
-	ctx := context.Background()
+// serverConfig returns a copy of the configuration set with WithConfig, with the synced lab
+// catalog if there is one
+func (c *Connector) serverConfig() (HCloudConfig, error) {
+	if c.cfg == nil {
+		return HCloudConfig{}, errNoConfig
+	}
+	cfg := *c.cfg
+	if c.labs != nil {
+		cfg.Labs = c.labs.Catalog()
+	}
+	return cfg, nil
+}
+
+// errNoConfig is returned by calls that need the server configuration of a connector without one
+var errNoConfig = errors.New("connector has no server configuration")
+
+func (c *Connector) ListServers(ctx context.Context) (servers []connector.Server, err error) {
 	hcloudServers, err := c.client.Server.All(ctx)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 	for _, server := range hcloudServers {
 		s := newServer(server, c, c.log)
@@ -42,21 +122,137 @@ func (c *Connector) ListServers() (servers []connector.Server, err error) {
 	return servers, nil
 }
 
-func (c *Connector) GetServerByID(id string) (connector.Server, error) {
-	ctx := context.Background()
+func (c *Connector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
 	idInt, err := parseServerID(id)
 	if err != nil {
 		return nil, err
 	}
 
 	server, _, err := c.client.Server.GetByID(ctx, idInt)
+	if err != nil {
+		return nil, classify(err)
+	}
+	if server == nil {
+		return nil, connector.NotFound("server with ID %s not found", id)
+	}
+	if group := server.Labels[connector.LabelNodeGroup]; group != "" {
+		return c.nodeGroup(ctx, newServer(server, c, c.log), group)
+	}
+	return newServer(server, c, c.log), nil
+}
+
+// nodeGroup returns the group of the composite lab node belongs to, acting as node
+func (c *Connector) nodeGroup(ctx context.Context, node connector.Server, group string) (*connector.Group, error) {
+	servers, err := c.GetServersByLabel(ctx, connector.LabelNodeGroup, group)
 	if err != nil {
 		return nil, err
 	}
+	nodes := map[string]connector.Server{node.GetLabels()[connector.LabelNode]: node}
+	for _, server := range servers {
+		if server.GetID() != node.GetID() {
+			nodes[server.GetLabels()[connector.LabelNode]] = server
+		}
+	}
+	return connector.NewGroup(node.GetLabels()[connector.LabelNode], nodes, func(cloudState string) bool {
+		_, available := c.MapState(cloudState)
+		return available
+	}), nil
+}
+
+func (c *Connector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	server, _, err := c.client.Server.GetByName(ctx, name)
+	if err != nil {
+		return nil, classify(err)
+	}
 	if server == nil {
-		return nil, fmt.Errorf("server with ID %s not found", id)
+		return nil, connector.NotFound("server with name %s not found", name)
 	}
 	return newServer(server, c, c.log), nil
 }
 
-var _ connector.Connector = (*Connector)(nil)
+// GetServersByLabel returns the servers whose label key equals value, filtered by the API
+func (c *Connector) GetServersByLabel(ctx context.Context, key, value string) (servers []connector.Server, err error) {
+	hcloudServers, err := c.client.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: key + "==" + value},
+	})
+	if err != nil {
+		return nil, classify(err)
+	}
+	for _, server := range hcloudServers {
+		servers = append(servers, newServer(server, c, c.log))
+	}
+	return servers, nil
+}
+
+// GetConsoleURL requests a VNC console for the server with id. The URL is a websocket for a
+// VNC client such as noVNC and can only be used within consoleValidity.
+func (c *Connector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	idInt, err := parseServerID(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.dryrun {
+		c.log.Info("[DRY-RUN] Would request console", "server_id", id)
+		return &connector.Console{URL: "wss://console.invalid/dry-run", Password: "dry-run", ExpiresAt: time.Now().Add(consoleValidity)}, nil
+	}
+
+	result, _, err := c.client.Server.RequestConsole(ctx, &hcloud.Server{ID: idInt})
+	if err != nil {
+		return nil, classify(err)
+	}
+	return &connector.Console{URL: result.WSSURL, Password: result.Password, ExpiresAt: time.Now().Add(consoleValidity)}, nil
+}
+
+// MapState maps a Hetzner server status to a SWIM status. Only a running server accepts SSH
+// connections; migrating and rebuilding servers come back, so they count as provisioning.
+func (c *Connector) MapState(cloudState string) (status string, available bool) {
+	switch hcloud.ServerStatus(cloudState) {
+	case hcloud.ServerStatusRunning:
+		return config.StatusRunning, true
+	case hcloud.ServerStatusStopping, hcloud.ServerStatusOff, hcloud.ServerStatusDeleting:
+		return config.StatusStopping, false
+	}
+	return config.StatusProvisioning, false
+}
+
+// ProvisionFailed reports whether a Hetzner server status ends a provision: a new server only
+// goes from initializing and starting to running, so one that is stopping, off or being
+// deleted was stopped by something else
+func (c *Connector) ProvisionFailed(cloudState string) bool {
+	switch hcloud.ServerStatus(cloudState) {
+	case hcloud.ServerStatusStopping, hcloud.ServerStatusOff, hcloud.ServerStatusDeleting:
+		return true
+	}
+	return false
+}
+
+// LabServerTypes returns the server types of labID in the lab catalog, or the default ones
+func (c *Connector) LabServerTypes(labID int) []string {
+	cfg, err := c.serverConfig()
+	if err != nil {
+		return nil
+	}
+	return cfg.ForLab(labID).ServerTypes
+}
+
+// classify wraps the Hetzner API errors callers act on in a connector error with their code
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case hcloud.IsError(err, hcloud.ErrorCodeNotFound):
+		return connector.NewError(connector.CodeNotFound, err)
+	case hcloud.IsError(err, hcloud.ErrorCodeRateLimitExceeded):
+		return connector.NewError(connector.CodeRateLimited, err)
+	case isCapacityError(err):
+		return connector.NewError(connector.CodeCapacity, err)
+	case isResourceLockedError(err):
+		return connector.NewError(connector.CodeLocked, err)
+	}
+	return err
+}
+
+var (
+	_ connector.Connector     = (*Connector)(nil)
+	_ connector.FailureStates = (*Connector)(nil)
+)
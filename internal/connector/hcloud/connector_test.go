@@ -1,10 +1,13 @@
 package hcloud
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/alex-sviridov/swim/internal/config"
 )
 
 func TestNewConnector(t *testing.T) {
@@ -36,6 +39,7 @@ func TestNewConnector(t *testing.T) {
 	})
 
 	t.Run("valid token non-dryrun", func(t *testing.T) {
+		setupTestEnvironment(t)
 		os.Setenv("HCLOUD_TOKEN", "test-token-123")
 
 		conn, err := NewConnector(logger, false)
@@ -57,6 +61,7 @@ func TestNewConnector(t *testing.T) {
 	})
 
 	t.Run("valid token with dryrun", func(t *testing.T) {
+		setupTestEnvironment(t)
 		os.Setenv("HCLOUD_TOKEN", "test-token-123")
 
 		conn, err := NewConnector(logger, true)
@@ -91,13 +96,54 @@ func TestConnectorInterface(t *testing.T) {
 		var c *Connector
 		if c != nil {
 			// These calls verify the methods exist with correct signatures
-			_, _ = c.ListServers()
-			_, _ = c.GetServerByID("")
-			_, _ = c.CreateServer("")
+			_, _ = c.ListServers(context.Background())
+			_, _ = c.GetServerByID(context.Background(), "")
+			_, _ = c.CreateServer(context.Background(), "")
 		}
 	})
 }
 
+func TestMapState(t *testing.T) {
+	tests := []struct {
+		cloudState      string
+		expectedStatus  string
+		expectAvailable bool
+	}{
+		{"running", config.StatusRunning, true},
+		{"starting", config.StatusProvisioning, false},
+		{"initializing", config.StatusProvisioning, false},
+		{"migrating", config.StatusProvisioning, false},
+		{"rebuilding", config.StatusProvisioning, false},
+		{"stopping", config.StatusStopping, false},
+		{"off", config.StatusStopping, false},
+		{"deleting", config.StatusStopping, false},
+		{"unknown", config.StatusProvisioning, false},
+		{"", config.StatusProvisioning, false},
+	}
+
+	c := NewConnectorWithToken(slog.Default(), "test-token", true)
+	for _, tt := range tests {
+		t.Run(tt.cloudState, func(t *testing.T) {
+			status, available := c.MapState(tt.cloudState)
+			if status != tt.expectedStatus || available != tt.expectAvailable {
+				t.Errorf("MapState(%q) = (%q, %v), want (%q, %v)", tt.cloudState, status, available, tt.expectedStatus, tt.expectAvailable)
+			}
+		})
+	}
+}
+
+func TestProvisionFailed(t *testing.T) {
+	c := NewConnectorWithToken(slog.Default(), "test-token", true)
+	for state, failed := range map[string]bool{
+		"running": false, "starting": false, "initializing": false, "unknown": false, "": false,
+		"stopping": true, "off": true, "deleting": true,
+	} {
+		if got := c.ProvisionFailed(state); got != failed {
+			t.Errorf("ProvisionFailed(%q) = %v, want %v", state, got, failed)
+		}
+	}
+}
+
 // TestConnector_ListServers and TestConnector_GetServerByID would require
 // mocking the hcloud client or using integration tests.
 // Here we document the expected behavior:
@@ -150,7 +196,7 @@ func TestConnector_Integration(t *testing.T) {
 			t.Fatalf("failed to create connector: %v", err)
 		}
 
-		servers, err := conn.ListServers()
+		servers, err := conn.ListServers(context.Background())
 		if err != nil {
 			t.Fatalf("failed to list servers: %v", err)
 		}
@@ -186,7 +232,7 @@ func TestConnector_Integration(t *testing.T) {
 		}
 
 		// Use a very high ID that's unlikely to exist
-		server, err := conn.GetServerByID("999999999")
+		server, err := conn.GetServerByID(context.Background(), "999999999")
 		if err == nil {
 			t.Error("expected error for non-existent server, got nil")
 		}
@@ -201,7 +247,7 @@ func TestConnector_Integration(t *testing.T) {
 			t.Fatalf("failed to create connector: %v", err)
 		}
 
-		server, err := conn.GetServerByID("invalid-id")
+		server, err := conn.GetServerByID(context.Background(), "invalid-id")
 		if err == nil {
 			t.Error("expected error for invalid server ID, got nil")
 		}
@@ -2,82 +2,238 @@ package hcloud
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"text/template"
 
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/userhash"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
 
+// maxServerNameAttempts bounds the retries when a generated name collides
+const maxServerNameAttempts = 5
+
 // CreateServer is the internal implementation that creates a new Hetzner Cloud server
 // This method uses hcloud-specific types and has no knowledge of the connector interface
-func (c *Connector) CreateServer(payload string) (connector.Server, error) {
+func (c *Connector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
 	// Unmarshal and validate the minimal request
 	req, err := UnmarshalAndValidate(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get Hetzner Cloud configuration from environment
-	hcloudConfig, err := GetHCloudConfigFromEnv()
+	// The connector's configuration with the lab's catalog entries applied
+	baseConfig, err := c.serverConfig()
 	if err != nil {
 		return nil, fmt.Errorf("get hcloud config: %w", err)
 	}
+	labConfig := baseConfig.ForNode(req.LabID, req.Node)
+	hcloudConfig := &labConfig
+
+	// Render the configured name; dry-run skips the collision check against the API
+	var name string
+	if c.dryrun {
+		name, err = generateServerName(hcloudConfig.NameTemplate, hcloudConfig.UID, *req)
+	} else {
+		name, err = c.uniqueServerName(ctx, *req, hcloudConfig.NameTemplate, hcloudConfig.UID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generate server name: %w", err)
+	}
+	req.generatedName = name
 
 	if c.dryrun {
 		// Return a mock server for dry-run mode
 		dryRunServer := &Server{
-			id:        999999,
-			name:      req.ServerName(),
-			ipv6:      "2001:db8::1",
-			connector: c,
-			log:       c.log,
+			id:         999999,
+			name:       req.ServerName(),
+			ipv6:       "2001:db8::1",
+			serverType: hcloudConfig.ServerType,
+			connector:  c,
+			log:        c.log,
 		}
 		c.log.Info("[DRY-RUN] Would create server",
 			"name", req.ServerName(),
 			"type", hcloudConfig.ServerType,
 			"firewall_id", hcloudConfig.FirewallID,
+			"egress_policy", hcloudConfig.EgressPolicy,
 			"location", hcloudConfig.Location)
 		return dryRunServer, nil
 	}
 
-	// Create the server
-	serverID, err := c.createServer(*req, *hcloudConfig)
+	// Servers of a lab class with an egress policy only reach the destinations it allows
+	egress, err := c.egressFirewall(ctx, *hcloudConfig)
+	if err != nil {
+		return nil, fmt.Errorf("set up egress firewall: %w", err)
+	}
+
+	// The nodes of a composite lab share a private network
+	var network *hcloud.Network
+	if req.Node != "" {
+		if network, err = c.labNetwork(ctx, *req, hcloudConfig); err != nil {
+			return nil, fmt.Errorf("set up lab network: %w", err)
+		}
+	}
+
+	// Journal the name first; if anything below fails half-way the entry stays
+	// behind and the server can be found by name on the next startup
+	if c.journal != nil {
+		if err := c.journal.RecordPendingCreate(req.ServerName(), req.Tenant, req.WebUserID, req.LabID, req.CorrelationID); err != nil {
+			return nil, fmt.Errorf("record pending create: %w", err)
+		}
+	}
+
+	var hostKeyPublic, adminPassword string
+	if hcloudConfig.OS == connector.OSWindows {
+		// Windows has no cloud-init; the student logs in over RDP with a password of their own
+		if adminPassword, err = windowsAdminPassword(); err != nil {
+			return nil, err
+		}
+		hcloudConfig.CloudInitContent = windowsUserData(adminPassword)
+	} else {
+		// Pre-seed the SSH host key so LabMan can verify it instead of trusting on first use
+		key, err := generateHostKey()
+		if err != nil {
+			return nil, fmt.Errorf("generate host key: %w", err)
+		}
+		if userData, ok := injectHostKey(hcloudConfig.CloudInitContent, key); ok {
+			hcloudConfig.CloudInitContent = userData
+			hostKeyPublic = key.public
+		} else {
+			c.log.Warn("cloud-init file is not cloud-config or sets ssh_keys itself, host key will not be published",
+				"cloud_init_file", hcloudConfig.CloudInitFile)
+		}
+		// The operator's security baseline applies to every Linux lab on top of its own user data
+		if hcloudConfig.CloudInitContent, err = mergeCloudInit(hcloudConfig.CloudInitBaseline, hcloudConfig.CloudInitContent); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the server. The name was free when it was checked, but another instance may
+	// have taken it since; then the server is created under a new name.
+	var serverID int64
+	for attempt := 1; ; attempt++ {
+		serverID, err = c.createServer(ctx, *req, *hcloudConfig, network, egress)
+		if !isNameTakenError(err) || attempt == maxServerNameAttempts {
+			break
+		}
+		c.log.Warn("server name taken at creation, regenerating",
+			"name", req.ServerName(),
+			"attempt", attempt,
+			tracing.LogKey, req.CorrelationID)
+		if err = c.renameRequest(ctx, req, hcloudConfig.NameTemplate, hcloudConfig.UID); err != nil {
+			break
+		}
+	}
 	if err != nil {
+		if network != nil {
+			// Nothing deletes the network of a lab none of whose nodes was created
+			if cleanupErr := c.deleteLabNetwork(context.WithoutCancel(ctx), req.NodeGroup, 0); cleanupErr != nil {
+				c.log.Warn("failed to delete lab network", "node_group", req.NodeGroup, "error", cleanupErr)
+			}
+		}
 		return nil, fmt.Errorf("create server: %w", err)
 	}
 
 	// Get server instance with IP information
-	server, err := c.getServer(serverID)
+	server, err := c.getServer(ctx, serverID)
 	if err != nil {
-		c.cleanupServer(serverID)
+		// Clean up even if ctx was cancelled, the server would otherwise be left behind
+		if cleanupErr := c.cleanupServer(context.WithoutCancel(ctx), serverID); cleanupErr == nil {
+			c.clearPendingCreate(req.ServerName())
+		}
 		return nil, fmt.Errorf("get server: %w", err)
 	}
 
+	// The journal entry stays until the provisioner has cached the server's ID
+	server.sshHostKey = hostKeyPublic
+	server.adminPassword = adminPassword
 	return server, nil
 }
 
-// createServer creates a new server instance
-func (c *Connector) createServer(req ProvisionRequest, hcloudConfig HCloudConfig) (int64, error) {
-	ctx := context.Background()
+// renameRequest gives req a new server name that is not taken yet, moving its journal entry along
+func (c *Connector) renameRequest(ctx context.Context, req *ProvisionRequest, tmpl *template.Template, uid UIDSpec) error {
+	name, err := c.uniqueServerName(ctx, *req, tmpl, uid)
+	if err != nil {
+		return fmt.Errorf("generate server name: %w", err)
+	}
+	c.clearPendingCreate(req.ServerName())
+	req.generatedName = name
+	if c.journal != nil {
+		if err := c.journal.RecordPendingCreate(req.ServerName(), req.Tenant, req.WebUserID, req.LabID, req.CorrelationID); err != nil {
+			return fmt.Errorf("record pending create: %w", err)
+		}
+	}
+	return nil
+}
+
+// isNameTakenError checks if a server couldn't be created because its name is already in use
+func isNameTakenError(err error) bool {
+	return hcloud.IsError(err, hcloud.ErrorCodeUniquenessError)
+}
+
+// clearPendingCreate removes a creation from the journal once its server is known or deleted
+func (c *Connector) clearPendingCreate(name string) {
+	if c.journal == nil {
+		return
+	}
+	if err := c.journal.ClearPendingCreate(name); err != nil {
+		c.log.Warn("failed to clear pending create", "name", name, "error", err)
+	}
+}
+
+// uniqueServerName renders server names until one is not already taken in the project.
+// Each attempt gets a new UID, so templates without {{.UID}} fail on the first collision.
+func (c *Connector) uniqueServerName(ctx context.Context, req ProvisionRequest, tmpl *template.Template, uid UIDSpec) (string, error) {
+	var name string
+	for attempt := 1; attempt <= maxServerNameAttempts; attempt++ {
+		var err error
+		name, err = generateServerName(tmpl, uid, req)
+		if err != nil {
+			return "", err
+		}
 
+		existing, _, err := c.client.Server.GetByName(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("check server name: %w", classify(err))
+		}
+		if existing == nil {
+			return name, nil
+		}
+
+		c.log.Warn("server name already in use, regenerating",
+			"name", name,
+			"attempt", attempt)
+	}
+
+	return "", fmt.Errorf("server name %s already in use after %d attempts", name, maxServerNameAttempts)
+}
+
+// createServer creates a new server instance
+func (c *Connector) createServer(ctx context.Context, req ProvisionRequest, hcloudConfig HCloudConfig, network *hcloud.Network, egress *hcloud.Firewall) (int64, error) {
 	// Get firewall if provided
 	var firewalls []*hcloud.ServerCreateFirewall
 	if hcloudConfig.FirewallID != "" {
 		firewall, _, err := c.client.Firewall.Get(ctx, hcloudConfig.FirewallID)
 		if err != nil {
-			return 0, fmt.Errorf("get firewall: %w", err)
+			return 0, fmt.Errorf("get firewall: %w", classify(err))
 		}
 		if firewall == nil {
 			return 0, fmt.Errorf("firewall '%s' not found", hcloudConfig.FirewallID)
 		}
 		firewalls = []*hcloud.ServerCreateFirewall{{Firewall: *firewall}}
 	}
+	if egress != nil {
+		firewalls = append(firewalls, &hcloud.ServerCreateFirewall{Firewall: *egress})
+	}
 
 	// Get SSH key
 	sshKey, _, err := c.client.SSHKey.Get(ctx, hcloudConfig.SSHKey)
 	if err != nil {
-		return 0, fmt.Errorf("get ssh key: %w", err)
+		return 0, fmt.Errorf("get ssh key: %w", classify(err))
 	}
 	if sshKey == nil {
 		return 0, fmt.Errorf("ssh key '%s' not found", hcloudConfig.SSHKey)
@@ -86,70 +242,173 @@ func (c *Connector) createServer(req ProvisionRequest, hcloudConfig HCloudConfig
 	// Prepare server create options
 	createOpts := hcloud.ServerCreateOpts{
 		Name:             req.ServerName(),
-		ServerType:       &hcloud.ServerType{Name: hcloudConfig.ServerType},
-		Image:            &hcloud.Image{Name: hcloudConfig.ImageID},
-		Location:         &hcloud.Location{Name: hcloudConfig.Location},
 		StartAfterCreate: hcloud.Ptr(true),
 		PublicNet:        &hcloud.ServerCreatePublicNet{EnableIPv6: true},
 		UserData:         hcloudConfig.CloudInitContent,
 		SSHKeys:          []*hcloud.SSHKey{sshKey},
-		Labels: map[string]string{
-			"type":      "ephymerical-lab-host",
-			"webuserid": req.WebUserID,
-			"labid":     strconv.Itoa(req.LabID),
-			"ttl":       strconv.Itoa(hcloudConfig.TTLMinutes),
-		},
-		Firewalls: firewalls,
-	}
-
-	c.log.Info("creating server",
-		"name", req.ServerName(),
-		"type", hcloudConfig.ServerType,
-		"image", hcloudConfig.ImageID,
-		"location", hcloudConfig.Location,
-		"webuserid", req.WebUserID,
-		"labid", req.LabID)
-
-	result, _, err := c.client.Server.Create(ctx, createOpts)
-	if err != nil {
-		return 0, fmt.Errorf("create server: %w", err)
+		Labels:           serverLabels(req, hcloudConfig, userhash.SecretFromEnv()),
+		Firewalls:        firewalls,
+	}
+	if network != nil {
+		createOpts.Networks = []*hcloud.Network{network}
+	}
+	if hcloudConfig.PlacementGroup != "" {
+		if createOpts.PlacementGroup, err = c.placementGroup(ctx, hcloudConfig.PlacementGroup); err != nil {
+			return 0, err
+		}
+	}
+
+	// Walk the server type ladder; within a type try each location at most once,
+	// moving on when a location has no capacity left for it
+	var lastErr, incompatible error
+	for _, serverType := range hcloudConfig.ServerTypes {
+		// Skip types the image wasn't built for, e.g. ARM types in a ladder with x86 fallbacks
+		image, err := c.imageFor(ctx, hcloudConfig.ImageID, serverType)
+		if errors.Is(err, errIncompatibleServerType) {
+			c.log.Warn("image does not fit server type, trying next server type",
+				"type", serverType,
+				"error", err,
+				tracing.LogKey, req.CorrelationID)
+			incompatible = err
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		createOpts.Image = image
+		createOpts.ServerType = &hcloud.ServerType{Name: serverType}
+		serverID, err := c.createServerWithType(ctx, req, hcloudConfig, createOpts)
+		if err == nil {
+			return serverID, nil
+		}
+		if !isCapacityError(err) && !isServerTypeUnavailableError(err) {
+			return 0, fmt.Errorf("create server: %w", classify(err))
+		}
+
+		c.log.Warn("server type unavailable, trying next server type",
+			"type", serverType,
+			"error", err,
+			tracing.LogKey, req.CorrelationID)
+		lastErr = err
 	}
 
-	c.log.Info("server created successfully",
-		"server_id", result.Server.ID,
-		"server_name", result.Server.Name)
+	if lastErr == nil {
+		return 0, fmt.Errorf("create server: no server type can run image %q: %w", hcloudConfig.ImageID, incompatible)
+	}
+	return 0, fmt.Errorf("create server: no server type has capacity: %w", connector.NewError(connector.CodeCapacity, lastErr))
+}
+
+// createServerWithType creates the server with the type set in createOpts, trying the
+// configured locations by health. Returns the last capacity or server type error if none worked.
+func (c *Connector) createServerWithType(ctx context.Context, req ProvisionRequest, hcloudConfig HCloudConfig, createOpts hcloud.ServerCreateOpts) (int64, error) {
+	serverType := createOpts.ServerType.Name
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		location, ok := c.locations.pick(serverType, hcloudConfig.Locations, tried)
+		if !ok {
+			return 0, lastErr
+		}
+		tried[location] = true
+		createOpts.Location = &hcloud.Location{Name: location}
+
+		c.log.Info("creating server",
+			"name", req.ServerName(),
+			"type", serverType,
+			"image", hcloudConfig.ImageID,
+			"location", location,
+			"webuserid", req.WebUserID,
+			"labid", req.LabID,
+			tracing.LogKey, req.CorrelationID)
+
+		result, _, err := c.client.Server.Create(ctx, createOpts)
+		if err != nil {
+			if isServerTypeUnavailableError(err) {
+				// No other location will accept the type either
+				return 0, err
+			}
+			if !isCapacityError(err) {
+				return 0, err
+			}
+			c.log.Warn("location out of capacity, trying next location",
+				"type", serverType,
+				"location", location,
+				"cooldown", hcloudConfig.LocationCooldown,
+				"error", err,
+				tracing.LogKey, req.CorrelationID)
+			c.locations.reportUnavailable(serverType, location, hcloudConfig.LocationCooldown)
+			lastErr = err
+			continue
+		}
+		c.locations.reportSuccess(serverType, location)
+
+		c.log.Info("server created successfully",
+			"server_id", result.Server.ID,
+			"server_name", result.Server.Name,
+			"type", serverType,
+			"location", location,
+			tracing.LogKey, req.CorrelationID)
+
+		return result.Server.ID, nil
+	}
+}
 
-	return result.Server.ID, nil
+// serverLabels builds the provider labels for a new server.
+// With a user hash secret the web user ID is replaced by its HMAC.
+func serverLabels(req ProvisionRequest, hcloudConfig HCloudConfig, userHashSecret string) map[string]string {
+	userKey, userValue := userhash.Label(userHashSecret, req.WebUserID)
+	labels := map[string]string{
+		connector.LabelType:  connector.LabelTypeLabHost,
+		userKey:              userValue,
+		connector.LabelLabID: strconv.Itoa(req.LabID),
+		"ttl":                strconv.Itoa(hcloudConfig.TTLMinutes),
+	}
+	if tracing.Valid(req.CorrelationID) {
+		labels[connector.LabelCorrelationID] = req.CorrelationID
+	}
+	if req.Tenant != "" {
+		labels[connector.LabelTenant] = req.Tenant
+	}
+	if req.Node != "" {
+		labels[connector.LabelNodeGroup] = req.NodeGroup
+		labels[connector.LabelNode] = req.Node
+	}
+	if hcloudConfig.OS == connector.OSWindows {
+		labels[connector.LabelOS] = connector.OSWindows
+	}
+	if hcloudConfig.Protected {
+		labels[connector.LabelProtected] = "true"
+	}
+	return labels
 }
 
 // getServer retrieves the server with full details
-func (c *Connector) getServer(serverID int64) (*Server, error) {
-	ctx := context.Background()
-
+func (c *Connector) getServer(ctx context.Context, serverID int64) (*Server, error) {
 	server, _, err := c.client.Server.GetByID(ctx, serverID)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 
 	if server == nil {
-		return nil, fmt.Errorf("server with ID %d not found", serverID)
+		return nil, connector.NotFound("server with ID %d not found", serverID)
 	}
 
 	return newServer(server, c, c.log), nil
 }
 
 // cleanupServer deletes a server (used for error cleanup)
-func (c *Connector) cleanupServer(serverID int64) {
-	ctx := context.Background()
+func (c *Connector) cleanupServer(ctx context.Context, serverID int64) error {
 	server, _, err := c.client.Server.GetByID(ctx, serverID)
 	if err != nil {
 		c.log.Error("failed to get server for cleanup", "server_id", serverID, "error", err)
-		return
+		return err
 	}
 	if server != nil {
 		_, _, err = c.client.Server.DeleteWithResult(ctx, server)
 		if err != nil {
 			c.log.Error("failed to cleanup server", "server_id", serverID, "error", err)
+			return err
 		}
 	}
+	return nil
 }
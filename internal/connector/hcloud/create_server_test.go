@@ -1,10 +1,20 @@
 package hcloud
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/alex-sviridov/swim/internal/userhash"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
 
 func TestConnector_CreateServer_DryRun(t *testing.T) {
@@ -31,7 +41,7 @@ func TestConnector_CreateServer_DryRun(t *testing.T) {
 		}
 
 		payload := `{"webuserid": "user-123", "labId": 42}`
-		server, err := conn.CreateServer(payload)
+		server, err := conn.CreateServer(context.Background(), payload)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -63,7 +73,7 @@ func TestConnector_CreateServer_DryRun(t *testing.T) {
 		}
 
 		payload := `{"invalid": "payload"}`
-		server, err := conn.CreateServer(payload)
+		server, err := conn.CreateServer(context.Background(), payload)
 		if err == nil {
 			t.Error("expected error for invalid payload, got nil")
 		}
@@ -82,22 +92,46 @@ func TestConnector_CreateServer_DryRun(t *testing.T) {
 		os.Unsetenv("HCLOUD_DEFAULT_CLOUD_INIT_FILE")
 
 		conn, err := NewConnector(logger, true)
-		if err != nil {
-			t.Fatalf("failed to create connector: %v", err)
-		}
-
-		payload := `{"webuserid": "user-123", "labId": 42}`
-		server, err := conn.CreateServer(payload)
 		if err == nil {
 			t.Error("expected error for missing config, got nil")
 		}
-		if server != nil {
-			t.Error("expected nil server on error")
+		if conn != nil {
+			t.Error("expected nil connector on error")
 		}
 		if !strings.Contains(err.Error(), "get hcloud config") {
 			t.Errorf("expected error about config, got: %v", err)
 		}
 	})
+
+	t.Run("dry-run mode reads config once", func(t *testing.T) {
+		setupTestEnvironment(t)
+
+		conn, err := NewConnector(logger, true)
+		if err != nil {
+			t.Fatalf("failed to create connector: %v", err)
+		}
+		// Changes after construction don't reach requests
+		os.Setenv("HCLOUD_DEFAULT_SERVER_TYPE", "")
+
+		server, err := conn.CreateServer(context.Background(), `{"webuserid": "user-123", "labId": 42}`)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := server.(*Server).serverType; got != "cx11" {
+			t.Errorf("expected the server type read at construction, got %q", got)
+		}
+	})
+
+	t.Run("without config", func(t *testing.T) {
+		conn := NewConnectorWithToken(logger, "test-token", true)
+
+		if _, err := conn.CreateServer(context.Background(), `{"webuserid": "user-123", "labId": 42}`); !errors.Is(err, errNoConfig) {
+			t.Errorf("expected errNoConfig, got %v", err)
+		}
+		if _, err := conn.Validate(context.Background()); !errors.Is(err, errNoConfig) {
+			t.Errorf("expected errNoConfig from Validate, got %v", err)
+		}
+	})
 }
 
 func TestConnector_CreateServer_ExpectedBehavior(t *testing.T) {
@@ -169,7 +203,7 @@ func TestConnector_cleanupServer_ExpectedBehavior(t *testing.T) {
 		// Expected behavior:
 		// 1. Get server by ID
 		// 2. If found, delete server
-		// 3. Log errors but don't return them (best effort cleanup)
+		// 3. Log and return errors, so a failed cleanup keeps its pending create entry
 
 		// With proper mocks, we would test:
 		// - Server found and deleted successfully
@@ -216,6 +250,94 @@ func setupTestEnvironment(t *testing.T) {
 	})
 }
 
+func TestConnector_CreateServer_NameTaken(t *testing.T) {
+	setupTestEnvironment(t)
+	cfg, err := GetHCloudConfigFromEnv()
+	if err != nil {
+		t.Fatalf("get config: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		collisions int // creations rejected because the name was taken meanwhile
+		wantErr    bool
+	}{
+		{name: "created under a new name", collisions: 2},
+		{name: "gives up after the attempts", collisions: maxServerNameAttempts, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/servers" && r.Method == http.MethodPost:
+					var body struct {
+						Name string `json:"name"`
+					}
+					json.NewDecoder(r.Body).Decode(&body)
+					names = append(names, body.Name)
+					if len(names) <= tt.collisions {
+						w.WriteHeader(http.StatusConflict)
+						fmt.Fprint(w, `{"error": {"code": "uniqueness_error", "message": "server name is already used"}}`)
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprintf(w, `{"server": {"id": 42, "name": %q}, "action": {"id": 1, "status": "running"}}`, body.Name)
+				case r.URL.Path == "/servers/42":
+					fmt.Fprint(w, `{"server": {"id": 42, "name": "lab42", "public_net": {"ipv6": {"ip": "2001:db8::/64"}}}}`)
+				case r.URL.Path == "/servers":
+					// Every name is free when checked
+					fmt.Fprint(w, `{"servers": []}`)
+				case r.URL.Path == "/firewalls":
+					fmt.Fprint(w, `{"firewalls": [{"id": 1, "name": "fw-test"}]}`)
+				case r.URL.Path == "/ssh_keys":
+					fmt.Fprint(w, `{"ssh_keys": [{"id": 1, "name": "key-test"}]}`)
+				case r.URL.Path == "/server_types":
+					fmt.Fprint(w, `{"server_types": [{"id": 1, "name": "cx11", "architecture": "x86"}]}`)
+				case r.URL.Path == "/images":
+					fmt.Fprint(w, `{"images": [{"id": 10, "name": "ubuntu-22.04", "architecture": "x86"}]}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error": {"code": "not_found", "message": "not found"}}`)
+				}
+			}))
+			defer srv.Close()
+
+			c := &Connector{
+				client:    hcloud.NewClient(hcloud.WithEndpoint(srv.URL), hcloud.WithToken("token")),
+				log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+				locations: newLocationSelector(),
+				cfg:       cfg,
+			}
+			server, err := c.CreateServer(context.Background(), `{"webuserid":"user-123","labId":42}`)
+			if tt.wantErr {
+				if !isNameTakenError(err) {
+					t.Fatalf("expected the name collision error, got %v, %v", err, server)
+				}
+				if len(names) != maxServerNameAttempts {
+					t.Errorf("expected %d attempts, got %v", maxServerNameAttempts, names)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if server.GetID() != "42" || len(names) != tt.collisions+1 {
+				t.Errorf("expected server 42 after %d collisions, got %v with names %v", tt.collisions, server, names)
+			}
+			seen := make(map[string]bool)
+			for _, name := range names {
+				if seen[name] {
+					t.Errorf("expected a new name for every attempt, got %v", names)
+				}
+				seen[name] = true
+			}
+		})
+	}
+}
+
 // Integration tests (only run when HCLOUD_TOKEN is set)
 func TestConnector_CreateServer_Integration(t *testing.T) {
 	if os.Getenv("HCLOUD_TOKEN") == "" {
@@ -248,7 +370,7 @@ func TestConnector_CreateServer_Integration(t *testing.T) {
 
 		// Create server
 		payload := `{"webuserid": "test-user", "labId": 999}`
-		server, err := conn.CreateServer(payload)
+		server, err := conn.CreateServer(context.Background(), payload)
 		if err != nil {
 			t.Fatalf("failed to create server: %v", err)
 		}
@@ -258,7 +380,7 @@ func TestConnector_CreateServer_Integration(t *testing.T) {
 
 		// Ensure cleanup
 		defer func() {
-			if err := server.Delete(); err != nil {
+			if err := server.Delete(context.Background()); err != nil {
 				t.Logf("Warning: failed to cleanup server: %v", err)
 			}
 		}()
@@ -272,7 +394,7 @@ func TestConnector_CreateServer_Integration(t *testing.T) {
 		}
 
 		// Try to get server by ID
-		retrievedServer, err := conn.GetServerByID(server.GetID())
+		retrievedServer, err := conn.GetServerByID(context.Background(), server.GetID())
 		if err != nil {
 			t.Fatalf("failed to get server by ID: %v", err)
 		}
@@ -349,9 +471,90 @@ func BenchmarkConnector_CreateServer_DryRun(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := conn.CreateServer(payload)
+		_, err := conn.CreateServer(context.Background(), payload)
 		if err != nil {
 			b.Fatalf("unexpected error: %v", err)
 		}
 	}
 }
+
+func TestServerLabels(t *testing.T) {
+	req := ProvisionRequest{WebUserID: "user-123", LabID: 42}
+	cfg := HCloudConfig{TTLMinutes: 30}
+
+	t.Run("raw web user ID without secret", func(t *testing.T) {
+		labels := serverLabels(req, cfg, "")
+		if labels["webuserid"] != "user-123" {
+			t.Errorf("expected webuserid label 'user-123', got %q", labels["webuserid"])
+		}
+		if _, ok := labels["webuserhash"]; ok {
+			t.Error("expected no webuserhash label without secret")
+		}
+		if labels["labid"] != "42" || labels["ttl"] != "30" {
+			t.Errorf("unexpected labels: %v", labels)
+		}
+	})
+
+	t.Run("hashed web user ID with secret", func(t *testing.T) {
+		labels := serverLabels(req, cfg, "secret")
+		if _, ok := labels["webuserid"]; ok {
+			t.Error("expected raw webuserid label to be omitted")
+		}
+		if labels["webuserhash"] != userhash.Hash("secret", "user-123") {
+			t.Errorf("expected webuserhash label, got %v", labels)
+		}
+	})
+
+	t.Run("correlation ID", func(t *testing.T) {
+		if _, ok := serverLabels(req, cfg, "")["correlation-id"]; ok {
+			t.Error("expected no correlation-id label without a correlation ID")
+		}
+
+		traced := req
+		traced.CorrelationID = "req-123"
+		if got := serverLabels(traced, cfg, "")["correlation-id"]; got != "req-123" {
+			t.Errorf("expected correlation-id label req-123, got %q", got)
+		}
+
+		traced.CorrelationID = "not a valid label"
+		if _, ok := serverLabels(traced, cfg, "")["correlation-id"]; ok {
+			t.Error("expected invalid correlation ID to be left off the labels")
+		}
+	})
+
+	t.Run("tenant", func(t *testing.T) {
+		if _, ok := serverLabels(req, cfg, "")["tenant"]; ok {
+			t.Error("expected no tenant label for the default tenant")
+		}
+
+		scoped := req
+		scoped.Tenant = "cs101"
+		if got := serverLabels(scoped, cfg, "")["tenant"]; got != "cs101" {
+			t.Errorf("expected tenant label cs101, got %q", got)
+		}
+	})
+
+	t.Run("windows", func(t *testing.T) {
+		if _, ok := serverLabels(req, cfg, "")["os"]; ok {
+			t.Error("expected no os label on Linux servers")
+		}
+
+		windows := cfg
+		windows.OS = "windows"
+		if got := serverLabels(req, windows, "")["os"]; got != "windows" {
+			t.Errorf("expected os label windows, got %q", got)
+		}
+	})
+
+	t.Run("protected", func(t *testing.T) {
+		if _, ok := serverLabels(req, cfg, "")["protected"]; ok {
+			t.Error("expected no protected label by default")
+		}
+
+		protected := cfg
+		protected.Protected = true
+		if got := serverLabels(req, protected, "")["protected"]; got != "true" {
+			t.Errorf("expected protected label true, got %q", got)
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package hcloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// labelTypeEgressFirewall marks the egress firewalls SWIM creates for lab classes
+const labelTypeEgressFirewall = "ephymerical-egress-firewall"
+
+// labelEgressPolicy holds the lab class an egress firewall enforces
+const labelEgressPolicy = "egress-policy"
+
+// egressPolicyNone lets the servers of a lab in the catalog reach anything despite
+// HCLOUD_DEFAULT_EGRESS_POLICY
+const egressPolicyNone = "none"
+
+// maxEgressPolicyNameLength keeps swim-egress-{name} a valid firewall name and label value
+const maxEgressPolicyNameLength = 40
+
+var validEgressPolicyName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// EgressRule allows outgoing traffic of one protocol and port range to some destinations
+type EgressRule struct {
+	Description  string   `json:"description"`  // e.g. "Debian mirrors"
+	Protocol     string   `json:"protocol"`     // tcp, udp or icmp
+	Port         string   `json:"port"`         // port or range such as "80" or "8000-8100"; empty for icmp
+	Destinations []string `json:"destinations"` // IPv6 ranges such as "2a01:4f8::/32"
+}
+
+// EgressPolicies holds the outgoing traffic each lab class is allowed, by class name. Servers
+// of a class with a policy can only reach the destinations its rules list.
+type EgressPolicies map[string][]EgressRule
+
+// egressFirewallName returns the name of the firewall enforcing the egress policy of class
+func egressFirewallName(class string) string {
+	return "swim-egress-" + class
+}
+
+// loadEgressPolicies reads policies such as {"linux": [{"protocol": "tcp", "port": "443", "destinations": ["2a01:4f8::/32"]}]}
+func loadEgressPolicies(path string) (EgressPolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read egress policies: %w", err)
+	}
+	return parseEgressPolicies(data)
+}
+
+// parseEgressPolicies parses and validates JSON egress policies. Unknown fields are rejected,
+// so a misspelled setting doesn't silently open or close a port.
+func parseEgressPolicies(data []byte) (EgressPolicies, error) {
+	var policies EgressPolicies
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policies); err != nil {
+		return nil, fmt.Errorf("parse egress policies: %w", err)
+	}
+	for class, rules := range policies {
+		if err := validateEgressPolicyName(class); err != nil {
+			return nil, err
+		}
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("egress policy %s: no rules; leave the policy out for open egress", class)
+		}
+		for i, rule := range rules {
+			if _, err := rule.firewallRule(); err != nil {
+				return nil, fmt.Errorf("egress policy %s rule %d: %w", class, i+1, err)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// validateEgressPolicyName checks the name of a lab class, which is part of its firewall's name
+func validateEgressPolicyName(class string) error {
+	if class == egressPolicyNone {
+		return fmt.Errorf("egress policy name %q is reserved for open egress", class)
+	}
+	if len(class) > maxEgressPolicyNameLength || !validEgressPolicyName.MatchString(class) {
+		return fmt.Errorf("egress policy name %q must be up to %d lowercase letters, digits and '-', starting with a letter",
+			class, maxEgressPolicyNameLength)
+	}
+	return nil
+}
+
+// firewallRule converts r to an outgoing firewall rule. Lab servers have no public IPv4
+// address, so only IPv6 destinations are accepted.
+func (r EgressRule) firewallRule() (hcloud.FirewallRule, error) {
+	rule := hcloud.FirewallRule{Direction: hcloud.FirewallRuleDirectionOut}
+	switch protocol := hcloud.FirewallRuleProtocol(strings.ToLower(r.Protocol)); protocol {
+	case hcloud.FirewallRuleProtocolTCP, hcloud.FirewallRuleProtocolUDP:
+		if err := validatePortRange(r.Port); err != nil {
+			return hcloud.FirewallRule{}, err
+		}
+		rule.Protocol = protocol
+		rule.Port = hcloud.Ptr(r.Port)
+	case hcloud.FirewallRuleProtocolICMP:
+		if r.Port != "" {
+			return hcloud.FirewallRule{}, fmt.Errorf("icmp rules have no port")
+		}
+		rule.Protocol = protocol
+	default:
+		return hcloud.FirewallRule{}, fmt.Errorf("protocol must be tcp, udp or icmp, got %q", r.Protocol)
+	}
+
+	if len(r.Destinations) == 0 {
+		return hcloud.FirewallRule{}, fmt.Errorf("no destinations")
+	}
+	for _, destination := range r.Destinations {
+		ip, ipRange, err := net.ParseCIDR(destination)
+		if err != nil {
+			return hcloud.FirewallRule{}, fmt.Errorf("destination %q: %w", destination, err)
+		}
+		if ip.To4() != nil {
+			return hcloud.FirewallRule{}, fmt.Errorf("destination %s is IPv4, lab servers only have IPv6", destination)
+		}
+		rule.DestinationIPs = append(rule.DestinationIPs, *ipRange)
+	}
+	if r.Description != "" {
+		rule.Description = hcloud.Ptr(r.Description)
+	}
+	return rule, nil
+}
+
+// validatePortRange checks a port such as "443" or a range such as "8000-8100"
+func validatePortRange(port string) error {
+	low, high, isRange := strings.Cut(port, "-")
+	if !isRange {
+		high = low
+	}
+	first, err := strconv.Atoi(low)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	last, err := strconv.Atoi(high)
+	if err != nil || first < 1 || last > 65535 || first > last {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// firewallRules converts the rules of a validated egress policy
+func (p EgressPolicies) firewallRules(class string) ([]hcloud.FirewallRule, error) {
+	rules, ok := p[class]
+	if !ok {
+		return nil, fmt.Errorf("egress policy %q is not defined", class)
+	}
+	converted := make([]hcloud.FirewallRule, 0, len(rules))
+	for _, rule := range rules {
+		firewallRule, err := rule.firewallRule()
+		if err != nil {
+			return nil, fmt.Errorf("egress policy %s: %w", class, err)
+		}
+		converted = append(converted, firewallRule)
+	}
+	return converted, nil
+}
+
+// egressFirewall returns the firewall enforcing the egress policy of cfg, creating it for the
+// first server of its class and updating its rules if the policy changed since. Returns nil
+// if cfg has no egress policy. Hetzner Cloud allows all outgoing traffic of a server until
+// one of its firewalls has an outgoing rule, so the server firewall must not have any.
+func (c *Connector) egressFirewall(ctx context.Context, cfg HCloudConfig) (*hcloud.Firewall, error) {
+	if cfg.EgressPolicy == "" {
+		return nil, nil
+	}
+	rules, err := cfg.EgressPolicies.firewallRules(cfg.EgressPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	name := egressFirewallName(cfg.EgressPolicy)
+	firewall, _, err := c.client.Firewall.GetByName(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("get firewall: %w", classify(err))
+	}
+	if firewall == nil {
+		c.log.Info("creating egress firewall", "name", name, "rules", len(rules))
+		result, _, err := c.client.Firewall.Create(ctx, hcloud.FirewallCreateOpts{
+			Name:  name,
+			Rules: rules,
+			Labels: map[string]string{
+				connector.LabelType: labelTypeEgressFirewall,
+				labelEgressPolicy:   cfg.EgressPolicy,
+			},
+		})
+		if !hcloud.IsError(err, hcloud.ErrorCodeUniquenessError) {
+			if err != nil {
+				return nil, fmt.Errorf("create firewall: %w", classify(err))
+			}
+			return result.Firewall, nil
+		}
+		// Another server of the class created it first
+		firewall, _, err = c.client.Firewall.GetByName(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("get firewall: %w", classify(err))
+		}
+		if firewall == nil {
+			return nil, fmt.Errorf("firewall %s not found after name collision", name)
+		}
+	}
+
+	if !sameRules(firewall.Rules, rules) {
+		c.log.Info("updating egress firewall rules", "name", name, "rules", len(rules))
+		if _, _, err := c.client.Firewall.SetRules(ctx, firewall, hcloud.FirewallSetRulesOpts{Rules: rules}); err != nil {
+			return nil, fmt.Errorf("set firewall rules: %w", classify(err))
+		}
+	}
+	return firewall, nil
+}
+
+// sameRules reports whether two sets of firewall rules allow the same traffic, in any order
+// and regardless of their descriptions
+func sameRules(a, b []hcloud.FirewallRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := func(rules []hcloud.FirewallRule) []string {
+		out := make([]string, 0, len(rules))
+		for _, rule := range rules {
+			out = append(out, ruleKey(rule))
+		}
+		sort.Strings(out)
+		return out
+	}
+	return slices.Equal(keys(a), keys(b))
+}
+
+// ruleKey describes the traffic a firewall rule allows
+func ruleKey(rule hcloud.FirewallRule) string {
+	var port string
+	if rule.Port != nil {
+		port = *rule.Port
+	}
+	ranges := func(ipNets []net.IPNet) string {
+		out := make([]string, 0, len(ipNets))
+		for _, ipNet := range ipNets {
+			out = append(out, ipNet.String())
+		}
+		sort.Strings(out)
+		return strings.Join(out, ",")
+	}
+	return strings.Join([]string{string(rule.Direction), string(rule.Protocol), port,
+		ranges(rule.SourceIPs), ranges(rule.DestinationIPs)}, " ")
+}
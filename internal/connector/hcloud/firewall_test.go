@@ -0,0 +1,197 @@
+package hcloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestParseEgressPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "mirrors and git", data: `{"linux": [
+			{"description": "mirrors", "protocol": "tcp", "port": "80", "destinations": ["2a01:4f8::/32", "2001:67c:1562::/48"]},
+			{"protocol": "TCP", "port": "9418", "destinations": ["2606:50c0::/32"]},
+			{"protocol": "icmp", "destinations": ["::/0"]}]}`},
+		{name: "port range", data: `{"linux": [{"protocol": "udp", "port": "8000-8100", "destinations": ["::/0"]}]}`},
+		{name: "IPv4 destination", data: `{"linux": [{"protocol": "tcp", "port": "443", "destinations": ["1.1.1.0/24"]}]}`, wantErr: true},
+		{name: "no destinations", data: `{"linux": [{"protocol": "tcp", "port": "443"}]}`, wantErr: true},
+		{name: "tcp without port", data: `{"linux": [{"protocol": "tcp", "destinations": ["::/0"]}]}`, wantErr: true},
+		{name: "icmp with port", data: `{"linux": [{"protocol": "icmp", "port": "1", "destinations": ["::/0"]}]}`, wantErr: true},
+		{name: "inverted range", data: `{"linux": [{"protocol": "tcp", "port": "90-80", "destinations": ["::/0"]}]}`, wantErr: true},
+		{name: "unknown protocol", data: `{"linux": [{"protocol": "gre", "destinations": ["::/0"]}]}`, wantErr: true},
+		{name: "no rules", data: `{"linux": []}`, wantErr: true},
+		{name: "reserved name", data: `{"none": [{"protocol": "icmp", "destinations": ["::/0"]}]}`, wantErr: true},
+		{name: "invalid name", data: `{"Linux_1": [{"protocol": "icmp", "destinations": ["::/0"]}]}`, wantErr: true},
+		{name: "unknown field", data: `{"linux": [{"protocol": "icmp", "destination": ["::/0"]}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies, err := parseEgressPolicies([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", policies)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := policies.firewallRules("linux"); err != nil {
+				t.Errorf("unexpected error converting rules: %v", err)
+			}
+		})
+	}
+}
+
+func TestHCloudConfig_ForLabEgressPolicy(t *testing.T) {
+	cfg := HCloudConfig{
+		EgressPolicy: "linux",
+		Labs: LabCatalog{
+			1: {EgressPolicy: "docker"},
+			2: {EgressPolicy: egressPolicyNone},
+		},
+	}
+
+	if got := cfg.ForLab(1).EgressPolicy; got != "docker" {
+		t.Errorf("expected the lab's policy, got %q", got)
+	}
+	if got := cfg.ForLab(2).EgressPolicy; got != "" {
+		t.Errorf("expected open egress, got %q", got)
+	}
+	if got := cfg.ForLab(3).EgressPolicy; got != "linux" {
+		t.Errorf("expected the default policy, got %q", got)
+	}
+}
+
+func TestSameRules(t *testing.T) {
+	policies, err := parseEgressPolicies([]byte(`{"linux": [
+		{"description": "http", "protocol": "tcp", "port": "80", "destinations": ["2a01:4f8::/32", "2001:db8::/32"]},
+		{"protocol": "tcp", "port": "443", "destinations": ["2a01:4f8::/32"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := policies.firewallRules("linux")
+
+	// Order and descriptions don't matter
+	reordered := []hcloud.FirewallRule{rules[1], rules[0]}
+	reordered[1].Description = nil
+	reordered[1].DestinationIPs = []net.IPNet{rules[0].DestinationIPs[1], rules[0].DestinationIPs[0]}
+	if !sameRules(rules, reordered) {
+		t.Error("expected reordered rules to be the same")
+	}
+
+	changed := []hcloud.FirewallRule{rules[0], rules[1]}
+	changed[1].Port = hcloud.Ptr("8443")
+	if sameRules(rules, changed) {
+		t.Error("expected a changed port to differ")
+	}
+	if sameRules(rules, rules[:1]) {
+		t.Error("expected a missing rule to differ")
+	}
+}
+
+func TestConnector_egressFirewall(t *testing.T) {
+	current := `[{"direction": "out", "protocol": "tcp", "port": "443", "destination_ips": ["2a01:4f8::/32"], "source_ips": []}]`
+	tests := []struct {
+		name         string
+		existing     string // rules of the existing firewall, "" for none
+		collision    bool   // another server creates the firewall first
+		wantCreates  int
+		wantSetRules int
+	}{
+		{name: "first server creates the firewall", wantCreates: 1},
+		{name: "name collision uses the other server's firewall", collision: true, wantCreates: 1},
+		{name: "existing firewall is reused", existing: current},
+		{name: "changed policy updates the rules", existing: `[]`, wantSetRules: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var creates []string
+			setRules := 0
+			existing := tt.existing
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/firewalls" && r.Method == http.MethodGet:
+					if existing == "" {
+						fmt.Fprint(w, `{"firewalls": []}`)
+						return
+					}
+					fmt.Fprintf(w, `{"firewalls": [{"id": 7, "name": "swim-egress-linux", "rules": %s}]}`, existing)
+				case r.URL.Path == "/firewalls" && r.Method == http.MethodPost:
+					var body struct {
+						Name   string            `json:"name"`
+						Labels map[string]string `json:"labels"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						t.Errorf("decode create request: %v", err)
+					}
+					if body.Labels[labelEgressPolicy] != "linux" {
+						t.Errorf("expected the firewall labelled with its policy, got %v", body.Labels)
+					}
+					creates = append(creates, body.Name)
+					existing = current
+					if tt.collision {
+						w.WriteHeader(http.StatusConflict)
+						fmt.Fprint(w, `{"error": {"code": "uniqueness_error", "message": "name is already used"}}`)
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprintf(w, `{"firewall": {"id": 7, "name": "swim-egress-linux", "rules": %s}, "actions": []}`, current)
+				case r.URL.Path == "/firewalls/7/actions/set_rules":
+					setRules++
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprint(w, `{"actions": []}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error": {"code": "not_found", "message": "not found"}}`)
+				}
+			}))
+			defer srv.Close()
+
+			c := &Connector{
+				client: hcloud.NewClient(hcloud.WithEndpoint(srv.URL), hcloud.WithToken("token")),
+				log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			policies, _ := parseEgressPolicies([]byte(`{"linux": [{"protocol": "tcp", "port": "443", "destinations": ["2a01:4f8::/32"]}]}`))
+			cfg := HCloudConfig{EgressPolicies: policies, EgressPolicy: "linux"}
+
+			firewall, err := c.egressFirewall(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if firewall.ID != 7 {
+				t.Errorf("expected firewall 7, got %+v", firewall)
+			}
+			if len(creates) != tt.wantCreates || (tt.wantCreates > 0 && creates[0] != "swim-egress-linux") {
+				t.Errorf("expected %d creates of swim-egress-linux, got %v", tt.wantCreates, creates)
+			}
+			if setRules != tt.wantSetRules {
+				t.Errorf("expected %d rule updates, got %d", tt.wantSetRules, setRules)
+			}
+		})
+	}
+
+	// Without a policy no firewall is attached, and an undefined policy fails the creation
+	c := &Connector{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if firewall, err := c.egressFirewall(context.Background(), HCloudConfig{}); firewall != nil || err != nil {
+		t.Errorf("expected no firewall without a policy, got %v, %v", firewall, err)
+	}
+	if _, err := c.egressFirewall(context.Background(), HCloudConfig{EgressPolicy: "docker"}); err == nil {
+		t.Error("expected an undefined policy to fail")
+	}
+}
@@ -0,0 +1,68 @@
+package hcloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// cloudConfigHeader marks user data that cloud-init parses as YAML cloud-config
+const cloudConfigHeader = "#cloud-config"
+
+// sshKeysSection matches a top-level ssh_keys key in a cloud-config document
+var sshKeysSection = regexp.MustCompile(`(?m)^ssh_keys\s*:`)
+
+// hostKey is an SSH host key SWIM generates for a server, so the key LabMan has to
+// trust is known before the server boots instead of being accepted on first use
+type hostKey struct {
+	privatePEM string // OpenSSH private key, written to the server by cloud-init
+	public     string // authorized_keys format, published in the server state
+}
+
+// generateHostKey creates a new ed25519 SSH host key
+func generateHostKey() (*hostKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate ed25519 key: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, fmt.Errorf("marshal host private key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("marshal host public key: %w", err)
+	}
+
+	return &hostKey{
+		privatePEM: string(pem.EncodeToMemory(block)),
+		public:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))),
+	}, nil
+}
+
+// injectHostKey appends an ssh_keys section installing key as the server's ed25519 host key.
+// Returns false and leaves the user data unchanged if it isn't cloud-config or already sets ssh_keys.
+func injectHostKey(userData string, key *hostKey) (string, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(userData), cloudConfigHeader) || sshKeysSection.MatchString(userData) {
+		return userData, false
+	}
+
+	var b strings.Builder
+	b.WriteString(userData)
+	if !strings.HasSuffix(userData, "\n") {
+		b.WriteString("\n")
+	}
+	b.WriteString("ssh_keys:\n")
+	b.WriteString("  ed25519_private: |\n")
+	for _, line := range strings.Split(strings.TrimSpace(key.privatePEM), "\n") {
+		b.WriteString("    " + line + "\n")
+	}
+	b.WriteString("  ed25519_public: " + key.public + "\n")
+	return b.String(), true
+}
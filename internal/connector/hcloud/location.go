@@ -0,0 +1,170 @@
+package hcloud
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// defaultLocationCooldown keeps a location out of rotation after it ran out of capacity
+const defaultLocationCooldown = 10 * time.Minute
+
+// WeightedLocation is a location from HCLOUD_DEFAULT_LOCATION with its share of new servers
+type WeightedLocation struct {
+	Name   string
+	Weight int
+}
+
+// parseLocations parses a comma-separated location list where each entry may carry
+// a weight, e.g. "fsn1:3,nbg1,hel1". Entries without a weight get weight 1.
+func parseLocations(value string) ([]WeightedLocation, error) {
+	var locations []WeightedLocation
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, weightStr, hasWeight := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		weight := 1
+		if hasWeight {
+			w, err := strconv.Atoi(strings.TrimSpace(weightStr))
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight for location %q: %q", name, weightStr)
+			}
+			weight = w
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty location name in %q", value)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("location %q listed twice", name)
+		}
+		seen[name] = true
+
+		locations = append(locations, WeightedLocation{Name: name, Weight: weight})
+	}
+
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("no locations in %q", value)
+	}
+	return locations, nil
+}
+
+// locationSelector spreads server creation over the configured locations by weight
+// and keeps locations that recently ran out of capacity for a server type out of rotation
+// for a cooldown
+type locationSelector struct {
+	mu        sync.Mutex
+	current   map[string]int       // smooth weighted round-robin counters, keyed by location
+	coolUntil map[string]time.Time // end of the cooldown after a capacity failure, keyed by cooldownKey
+	now       func() time.Time
+}
+
+// cooldownKey identifies a server type in a location; capacity runs out per type
+func cooldownKey(serverType, location string) string {
+	return serverType + "@" + location
+}
+
+func newLocationSelector() *locationSelector {
+	return &locationSelector{
+		current:   make(map[string]int),
+		coolUntil: make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// pick returns the healthiest location for serverType not in tried. Locations outside their
+// cooldown are rotated by weight; if every location is cooling down, the one that recovers
+// first is used. Returns false once every location has been tried.
+func (s *locationSelector) pick(serverType string, locations []WeightedLocation, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var healthy []WeightedLocation
+	var coolest string
+	var coolestUntil time.Time
+	for _, loc := range locations {
+		if tried[loc.Name] {
+			continue
+		}
+		until := s.coolUntil[cooldownKey(serverType, loc.Name)]
+		if !until.After(now) {
+			healthy = append(healthy, loc)
+			continue
+		}
+		if coolest == "" || until.Before(coolestUntil) {
+			coolest, coolestUntil = loc.Name, until
+		}
+	}
+
+	if len(healthy) == 0 {
+		return coolest, coolest != ""
+	}
+
+	// Smooth weighted round-robin: every candidate gains its weight, the leader pays the total
+	total := 0
+	best := ""
+	for _, loc := range healthy {
+		s.current[loc.Name] += loc.Weight
+		total += loc.Weight
+		if best == "" || s.current[loc.Name] > s.current[best] {
+			best = loc.Name
+		}
+	}
+	s.current[best] -= total
+	return best, true
+}
+
+// reportUnavailable puts a location into cooldown for serverType after a capacity failure
+func (s *locationSelector) reportUnavailable(serverType, location string, cooldown time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.coolUntil[cooldownKey(serverType, location)] = s.now().Add(cooldown)
+}
+
+// reportSuccess ends a location's cooldown for serverType once a server was created there
+func (s *locationSelector) reportSuccess(serverType, location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.coolUntil, cooldownKey(serverType, location))
+}
+
+// isCapacityError reports whether a create failed because the location had no capacity left
+func isCapacityError(err error) bool {
+	return hcloud.IsError(err, hcloud.ErrorCodeResourceUnavailable, hcloud.ErrorCodePlacementError)
+}
+
+// isServerTypeUnavailableError reports whether a create failed because the server type
+// can't be used at all (deprecated, unknown or rejected as input), so other locations won't help
+func isServerTypeUnavailableError(err error) bool {
+	if hcloud.IsError(err, hcloud.ErrorCodeInvalidServerType) {
+		return true
+	}
+
+	var apiErr hcloud.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != hcloud.ErrorCodeInvalidInput {
+		return false
+	}
+	details, ok := apiErr.Details.(hcloud.ErrorDetailsInvalidInput)
+	if !ok {
+		return false
+	}
+	for _, field := range details.Fields {
+		if field.Name == "server_type" {
+			return true
+		}
+	}
+	return false
+}
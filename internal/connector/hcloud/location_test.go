@@ -0,0 +1,167 @@
+package hcloud
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestParseLocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []WeightedLocation
+		wantErr  bool
+	}{
+		{name: "single location", value: "nbg1", expected: []WeightedLocation{{"nbg1", 1}}},
+		{name: "weighted list", value: "fsn1:3, nbg1 ,hel1:2", expected: []WeightedLocation{{"fsn1", 3}, {"nbg1", 1}, {"hel1", 2}}},
+		{name: "trailing comma", value: "fsn1,", expected: []WeightedLocation{{"fsn1", 1}}},
+		{name: "zero weight", value: "fsn1:0", wantErr: true},
+		{name: "invalid weight", value: "fsn1:x", wantErr: true},
+		{name: "duplicate location", value: "fsn1,fsn1:2", wantErr: true},
+		{name: "missing name", value: ":2", wantErr: true},
+		{name: "empty", value: " , ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locations, err := parseLocations(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", locations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(locations) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, locations)
+			}
+			for i := range locations {
+				if locations[i] != tt.expected[i] {
+					t.Errorf("expected %v, got %v", tt.expected, locations)
+				}
+			}
+		})
+	}
+}
+
+func TestLocationSelector_RotatesByWeight(t *testing.T) {
+	s := newLocationSelector()
+	locations := []WeightedLocation{{"fsn1", 2}, {"nbg1", 1}}
+
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		location, ok := s.pick("cx22", locations, nil)
+		if !ok {
+			t.Fatal("expected a location")
+		}
+		counts[location]++
+	}
+
+	if counts["fsn1"] != 4 || counts["nbg1"] != 2 {
+		t.Errorf("expected 4/2 split, got %v", counts)
+	}
+}
+
+func TestLocationSelector_Cooldown(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newLocationSelector()
+	s.now = func() time.Time { return now }
+	locations := []WeightedLocation{{"fsn1", 1}, {"nbg1", 1}, {"hel1", 1}}
+
+	s.reportUnavailable("cx22", "fsn1", 10*time.Minute)
+	for i := 0; i < 4; i++ {
+		if location, _ := s.pick("cx22", locations, nil); location == "fsn1" {
+			t.Fatal("location in cooldown should not be picked while others are healthy")
+		}
+	}
+
+	// Every location cooling down: the one recovering first is still tried
+	s.reportUnavailable("cx22", "nbg1", 5*time.Minute)
+	s.reportUnavailable("cx22", "hel1", 20*time.Minute)
+	if location, ok := s.pick("cx22", locations, nil); !ok || location != "nbg1" {
+		t.Errorf("expected nbg1 (shortest cooldown), got %q", location)
+	}
+
+	// Cooldown over
+	now = now.Add(11 * time.Minute)
+	if location, ok := s.pick("cx22", locations, map[string]bool{"nbg1": true}); !ok || location != "fsn1" {
+		t.Errorf("expected fsn1 after its cooldown, got %q", location)
+	}
+
+	// A success ends the cooldown immediately
+	s.reportSuccess("cx22", "hel1")
+	if location, ok := s.pick("cx22", locations, map[string]bool{"fsn1": true, "nbg1": true}); !ok || location != "hel1" {
+		t.Errorf("expected hel1 after success, got %q", location)
+	}
+}
+
+func TestLocationSelector_CooldownPerServerType(t *testing.T) {
+	s := newLocationSelector()
+	locations := []WeightedLocation{{"fsn1", 1}, {"nbg1", 1}}
+
+	// fsn1 is out of cx22 but other types are still created there
+	s.reportUnavailable("cx22", "fsn1", 10*time.Minute)
+
+	picked := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		location, _ := s.pick("cpx21", locations, nil)
+		picked[location] = true
+	}
+	if !picked["fsn1"] {
+		t.Error("cooldown of cx22 should not keep cpx21 out of fsn1")
+	}
+}
+
+func TestLocationSelector_AllTried(t *testing.T) {
+	s := newLocationSelector()
+	locations := []WeightedLocation{{"fsn1", 1}, {"nbg1", 1}}
+
+	if _, ok := s.pick("cx22", locations, map[string]bool{"fsn1": true, "nbg1": true}); ok {
+		t.Error("expected no location once all were tried")
+	}
+}
+
+func TestIsCapacityError(t *testing.T) {
+	if !isCapacityError(hcloud.Error{Code: hcloud.ErrorCodeResourceUnavailable}) {
+		t.Error("resource_unavailable should be a capacity error")
+	}
+	if !isCapacityError(hcloud.Error{Code: hcloud.ErrorCodePlacementError}) {
+		t.Error("placement_error should be a capacity error")
+	}
+	if isCapacityError(hcloud.Error{Code: hcloud.ErrorCodeInvalidInput}) {
+		t.Error("invalid_input should not be a capacity error")
+	}
+	if isCapacityError(errors.New("network down")) {
+		t.Error("non-API errors should not be capacity errors")
+	}
+}
+
+func TestIsServerTypeUnavailableError(t *testing.T) {
+	typeField := hcloud.ErrorDetailsInvalidInput{Fields: []hcloud.ErrorDetailsInvalidInputField{{Name: "server_type"}}}
+	nameField := hcloud.ErrorDetailsInvalidInput{Fields: []hcloud.ErrorDetailsInvalidInputField{{Name: "name"}}}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "invalid server type", err: hcloud.Error{Code: hcloud.ErrorCodeInvalidServerType}, expected: true},
+		{name: "invalid server_type input", err: hcloud.Error{Code: hcloud.ErrorCodeInvalidInput, Details: typeField}, expected: true},
+		{name: "invalid name input", err: hcloud.Error{Code: hcloud.ErrorCodeInvalidInput, Details: nameField}},
+		{name: "capacity error", err: hcloud.Error{Code: hcloud.ErrorCodeResourceUnavailable}},
+		{name: "non-API error", err: errors.New("network down")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isServerTypeUnavailableError(tt.err); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package hcloud
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of a Hetzner Cloud API call
+const (
+	ResultSuccess      = "success"
+	ResultNotFound     = "not_found"
+	ResultLocked       = "locked"
+	ResultRateLimited  = "rate_limited"
+	ResultServerError  = "5xx"
+	ResultClientError  = "4xx"
+	ResultNetworkError = "network_error"
+)
+
+var (
+	apiCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swim_hcloud_api_calls_total",
+		Help: "Hetzner Cloud API calls by operation and result.",
+	}, []string{"operation", "result"})
+
+	apiCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "swim_hcloud_api_call_duration_seconds",
+		Help:    "Latency of Hetzner Cloud API calls by operation.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(apiCalls, apiCallDuration)
+}
+
+// instrumentedTransport counts every Hetzner Cloud API call by operation and result and
+// records its latency, so provider slowness can be told apart from SWIM's own
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+// newInstrumentedClient returns an HTTP client whose calls through base are instrumented
+func newInstrumentedClient(base http.RoundTripper) *http.Client {
+	return &http.Client{Transport: &instrumentedTransport{base: base}}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := operationName(req.Method, req.URL.Path)
+	started := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	apiCallDuration.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+
+	result := ResultNetworkError
+	if err == nil {
+		result = resultOf(resp.StatusCode)
+	}
+	apiCalls.WithLabelValues(operation, result).Inc()
+	return resp, err
+}
+
+// operationName names an API call after its method and path, with IDs replaced by {id}
+// to keep the number of label values bounded, e.g. "POST /servers/{id}/actions/poweroff"
+func operationName(method, path string) string {
+	path = strings.TrimPrefix(path, "/v1")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		if _, err := strconv.ParseInt(segment, 10, 64); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return method + " /" + strings.Join(segments, "/")
+}
+
+// resultOf classifies an HTTP status code. Hetzner Cloud answers "locked" with 423 and
+// "conflict" with 409; both mean another action holds the resource.
+func resultOf(status int) string {
+	switch {
+	case status < 400:
+		return ResultSuccess
+	case status == http.StatusNotFound:
+		return ResultNotFound
+	case status == http.StatusLocked, status == http.StatusConflict:
+		return ResultLocked
+	case status == http.StatusTooManyRequests:
+		return ResultRateLimited
+	case status >= 500:
+		return ResultServerError
+	}
+	return ResultClientError
+}
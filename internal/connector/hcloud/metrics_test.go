@@ -0,0 +1,92 @@
+package hcloud
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOperationName(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/v1/servers", "GET /servers"},
+		{"GET", "/v1/servers/42", "GET /servers/{id}"},
+		{"POST", "/v1/servers/42/actions/poweroff", "POST /servers/{id}/actions/poweroff"},
+		{"GET", "/v1/actions/7", "GET /actions/{id}"},
+		{"DELETE", "/servers/42", "DELETE /servers/{id}"},
+	}
+	for _, tt := range tests {
+		if got := operationName(tt.method, tt.path); got != tt.want {
+			t.Errorf("operationName(%q, %q) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestResultOf(t *testing.T) {
+	tests := map[int]string{
+		http.StatusOK:                  ResultSuccess,
+		http.StatusCreated:             ResultSuccess,
+		http.StatusNotFound:            ResultNotFound,
+		http.StatusLocked:              ResultLocked,
+		http.StatusConflict:            ResultLocked,
+		http.StatusTooManyRequests:     ResultRateLimited,
+		http.StatusServiceUnavailable:  ResultServerError,
+		http.StatusUnprocessableEntity: ResultClientError,
+	}
+	for status, want := range tests {
+		if got := resultOf(status); got != want {
+			t.Errorf("resultOf(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestInstrumentedTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/servers/404" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	const operation = "GET /servers/{id}"
+	notFound := testutil.ToFloat64(apiCalls.WithLabelValues(operation, ResultNotFound))
+	rateLimited := testutil.ToFloat64(apiCalls.WithLabelValues(operation, ResultRateLimited))
+	networkErrors := testutil.ToFloat64(apiCalls.WithLabelValues(operation, ResultNetworkError))
+
+	client := newInstrumentedClient(http.DefaultTransport)
+	for _, path := range []string{"/v1/servers/404", "/v1/servers/1", "/v1/servers/2"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := newInstrumentedClient(failingTransport{}).Get(srv.URL + "/v1/servers/3"); err == nil {
+		t.Fatal("expected the failing transport's error")
+	}
+
+	if got := testutil.ToFloat64(apiCalls.WithLabelValues(operation, ResultNotFound)) - notFound; got != 1 {
+		t.Errorf("expected 1 not found call, got %v", got)
+	}
+	if got := testutil.ToFloat64(apiCalls.WithLabelValues(operation, ResultRateLimited)) - rateLimited; got != 2 {
+		t.Errorf("expected 2 rate limited calls, got %v", got)
+	}
+	if got := testutil.ToFloat64(apiCalls.WithLabelValues(operation, ResultNetworkError)) - networkErrors; got != 1 {
+		t.Errorf("expected 1 network error, got %v", got)
+	}
+	if got := testutil.CollectAndCount(apiCallDuration, "swim_hcloud_api_call_duration_seconds"); got == 0 {
+		t.Error("expected latency observations")
+	}
+}
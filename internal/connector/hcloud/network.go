@@ -0,0 +1,136 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// defaultLabNetworkIPRange is the address range of the private network of a composite lab.
+// Every lab gets its own network, so all of them can use the same range.
+const defaultLabNetworkIPRange = "10.0.0.0/24"
+
+// labelTypeLabNetwork marks the private networks SWIM creates for composite labs
+const labelTypeLabNetwork = "ephymerical-lab-network"
+
+// labNetworkName returns the name of the private network of the node group group
+func labNetworkName(group string) string {
+	return "swim-lab-" + group
+}
+
+// labNetwork returns the private network of the composite lab of req, creating it for its
+// first node, and narrows cfg.Locations to the network's zone: a server can only join a
+// network of its own zone. The zone is that of the first configured location.
+func (c *Connector) labNetwork(ctx context.Context, req ProvisionRequest, cfg *HCloudConfig) (*hcloud.Network, error) {
+	locations, err := c.client.Location.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list locations: %w", classify(err))
+	}
+	zones := make(map[string]hcloud.NetworkZone, len(locations))
+	for _, location := range locations {
+		zones[location.Name] = location.NetworkZone
+	}
+	zone, ok := zones[cfg.Location]
+	if !ok {
+		return nil, fmt.Errorf("location %s does not exist", cfg.Location)
+	}
+	var inZone []WeightedLocation
+	for _, location := range cfg.Locations {
+		if zones[location.Name] == zone {
+			inZone = append(inZone, location)
+		}
+	}
+	cfg.Locations = inZone
+
+	name := labNetworkName(req.NodeGroup)
+	network, _, err := c.client.Network.GetByName(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("get network: %w", classify(err))
+	}
+	if network != nil {
+		return network, nil
+	}
+
+	c.log.Info("creating lab network", "name", name, "ip_range", cfg.LabNetwork.String(), "network_zone", zone)
+	network, _, err = c.client.Network.Create(ctx, hcloud.NetworkCreateOpts{
+		Name:    name,
+		IPRange: cfg.LabNetwork,
+		Subnets: []hcloud.NetworkSubnet{{
+			Type:        hcloud.NetworkSubnetTypeCloud,
+			IPRange:     cfg.LabNetwork,
+			NetworkZone: zone,
+		}},
+		Labels: map[string]string{
+			connector.LabelType:      labelTypeLabNetwork,
+			connector.LabelNodeGroup: req.NodeGroup,
+		},
+	})
+	if hcloud.IsError(err, hcloud.ErrorCodeUniquenessError) {
+		// Another node of the lab created it first
+		network, _, err = c.client.Network.GetByName(ctx, name)
+		if err == nil && network == nil {
+			return nil, fmt.Errorf("network %s not found after name collision", name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create network: %w", classify(err))
+	}
+	return network, nil
+}
+
+// deleteLabNetwork deletes the private network of the node group group once no node other
+// than except is left. A network that is already gone counts as deleted.
+func (c *Connector) deleteLabNetwork(ctx context.Context, group string, except int64) error {
+	servers, err := c.client.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: connector.LabelNodeGroup + "=" + group},
+	})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", classify(err))
+	}
+	for _, server := range servers {
+		if server.ID != except {
+			return nil
+		}
+	}
+
+	network, _, err := c.client.Network.GetByName(ctx, labNetworkName(group))
+	if err != nil {
+		return fmt.Errorf("get network: %w", classify(err))
+	}
+	if network == nil {
+		return nil
+	}
+	if _, err := c.client.Network.Delete(ctx, network); err != nil && !hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+		return fmt.Errorf("delete network: %w", classify(err))
+	}
+	c.log.Info("lab network deleted", "name", network.Name, "node_group", group)
+	return nil
+}
+
+// privateAddress returns the address of server in its first private network, "" for none
+func privateAddress(server *hcloud.Server) string {
+	for _, private := range server.PrivateNet {
+		if private.IP != nil {
+			return private.IP.String()
+		}
+	}
+	return ""
+}
+
+// parseLabNetwork parses the address range of lab networks, which must be a private IPv4 range
+func parseLabNetwork(value string) (*net.IPNet, error) {
+	ip, ipRange, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil || !ip.IsPrivate() {
+		return nil, fmt.Errorf("%s is not a private IPv4 range", value)
+	}
+	if ones, _ := ipRange.Mask.Size(); ones > 30 {
+		return nil, fmt.Errorf("%s has no room for servers", value)
+	}
+	return ipRange, nil
+}
@@ -0,0 +1,130 @@
+package hcloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestParseLabNetwork(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "10.0.0.0/24", want: "10.0.0.0/24"},
+		{value: "192.168.5.0/26", want: "192.168.5.0/26"},
+		{value: "10.0.0.7/16", want: "10.0.0.0/16"},
+		{value: "8.8.8.0/24", wantErr: true},
+		{value: "fd00::/64", wantErr: true},
+		{value: "10.0.0.0/31", wantErr: true},
+		{value: "10.0.0.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ipRange, err := parseLabNetwork(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", ipRange)
+				}
+				return
+			}
+			if err != nil || ipRange.String() != tt.want {
+				t.Errorf("expected %s, got %v, %v", tt.want, ipRange, err)
+			}
+		})
+	}
+}
+
+func TestConnector_labNetwork(t *testing.T) {
+	tests := []struct {
+		name        string
+		collision   bool // another node creates the network first
+		wantCreates int
+	}{
+		{name: "first node creates the network", wantCreates: 1},
+		{name: "name collision uses the other node's network", collision: true, wantCreates: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var creates []hcloud.NetworkCreateOpts
+			exists := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				network := `{"id": 5, "name": "swim-lab-abc", "ip_range": "10.0.0.0/24"}`
+				switch {
+				case r.URL.Path == "/locations":
+					fmt.Fprint(w, `{"locations": [
+						{"id": 1, "name": "fsn1", "network_zone": "eu-central"},
+						{"id": 2, "name": "ash", "network_zone": "us-east"},
+						{"id": 3, "name": "nbg1", "network_zone": "eu-central"}]}`)
+				case r.URL.Path == "/networks" && r.Method == http.MethodGet:
+					if exists {
+						fmt.Fprintf(w, `{"networks": [%s]}`, network)
+						return
+					}
+					fmt.Fprint(w, `{"networks": []}`)
+				case r.URL.Path == "/networks" && r.Method == http.MethodPost:
+					var body struct {
+						Name    string `json:"name"`
+						Subnets []struct {
+							NetworkZone string `json:"network_zone"`
+						} `json:"subnets"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						t.Errorf("decode create request: %v", err)
+					}
+					creates = append(creates, hcloud.NetworkCreateOpts{Name: body.Name, Subnets: []hcloud.NetworkSubnet{
+						{NetworkZone: hcloud.NetworkZone(body.Subnets[0].NetworkZone)},
+					}})
+					exists = true
+					if tt.collision {
+						w.WriteHeader(http.StatusConflict)
+						fmt.Fprint(w, `{"error": {"code": "uniqueness_error", "message": "name is already used"}}`)
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprintf(w, `{"network": %s}`, network)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"error": {"code": "not_found", "message": "not found"}}`)
+				}
+			}))
+			defer srv.Close()
+
+			c := &Connector{
+				client: hcloud.NewClient(hcloud.WithEndpoint(srv.URL), hcloud.WithToken("token")),
+				log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			ipRange, _ := parseLabNetwork(defaultLabNetworkIPRange)
+			cfg := HCloudConfig{
+				Location:   "fsn1",
+				Locations:  []WeightedLocation{{Name: "fsn1", Weight: 1}, {Name: "ash", Weight: 1}, {Name: "nbg1", Weight: 2}},
+				LabNetwork: ipRange,
+			}
+
+			network, err := c.labNetwork(context.Background(), ProvisionRequest{Node: "target", NodeGroup: "abc"}, &cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if network.ID != 5 {
+				t.Errorf("expected network 5, got %+v", network)
+			}
+			if len(creates) != tt.wantCreates || creates[0].Name != "swim-lab-abc" || creates[0].Subnets[0].NetworkZone != hcloud.NetworkZoneEUCentral {
+				t.Errorf("expected one network in eu-central, got %+v", creates)
+			}
+			if len(cfg.Locations) != 2 || cfg.Locations[0].Name != "fsn1" || cfg.Locations[1].Name != "nbg1" {
+				t.Errorf("expected the locations of the network's zone, got %+v", cfg.Locations)
+			}
+		})
+	}
+}
@@ -4,16 +4,103 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"text/template"
 	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// defaultServerNameTemplate reproduces the lab{num}-{8 letters UID} pattern
+const defaultServerNameTemplate = "lab{{.LabID}}-{{.UID}}"
+
+// defaultTenant is the tenant ID that stands for no tenant at all
+const defaultTenant = "default"
+
+// maxServerNameLength is the hostname label limit enforced by Hetzner Cloud
+const maxServerNameLength = 63
+
+const (
+	defaultUIDLength   = 8
+	defaultUIDAlphabet = "abcdefghijklmnopqrstuvwxyz"
+
+	// minUIDLength and minUIDAlphabet keep UIDs from being guessed by trying them all
+	minUIDLength   = 6
+	maxUIDLength   = 32
+	minUIDAlphabet = 10
 )
 
+// defaultNameTemplate is used when SERVER_NAME_TEMPLATE is not set
+var defaultNameTemplate = template.Must(template.New("server-name").Parse(defaultServerNameTemplate))
+
+// ServerNameData is the data available to SERVER_NAME_TEMPLATE
+type ServerNameData struct {
+	LabID          int
+	WebUserID      string
+	WebUserIDShort string // first 8 characters of the web user ID
+	UID            string // random characters (default: 8 lowercase letters), regenerated on collision
+}
+
+// UIDSpec is the length and alphabet of the random UID in server names. The zero value
+// stands for 8 lowercase letters.
+type UIDSpec struct {
+	Length   int
+	Alphabet string
+}
+
+// parseUIDSpec validates a UID length and alphabet, "" or 0 keeping the default. Only
+// lowercase letters and digits survive in a hostname, and each character may appear once.
+func parseUIDSpec(length int, alphabet string) (UIDSpec, error) {
+	spec := UIDSpec{Length: defaultUIDLength, Alphabet: defaultUIDAlphabet}
+	if length != 0 {
+		if length < minUIDLength || length > maxUIDLength {
+			return UIDSpec{}, fmt.Errorf("UID length must be between %d and %d, got %d", minUIDLength, maxUIDLength, length)
+		}
+		spec.Length = length
+	}
+	if alphabet != "" {
+		seen := make(map[rune]bool)
+		for _, r := range alphabet {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+				return UIDSpec{}, fmt.Errorf("UID alphabet may only hold lowercase letters and digits, got %q", r)
+			}
+			if seen[r] {
+				return UIDSpec{}, fmt.Errorf("UID alphabet lists %q twice", r)
+			}
+			seen[r] = true
+		}
+		if len(alphabet) < minUIDAlphabet {
+			return UIDSpec{}, fmt.Errorf("UID alphabet needs at least %d characters, got %d", minUIDAlphabet, len(alphabet))
+		}
+		spec.Alphabet = alphabet
+	}
+	return spec, nil
+}
+
+func (s UIDSpec) orDefault() UIDSpec {
+	if s.Length == 0 {
+		s.Length = defaultUIDLength
+	}
+	if s.Alphabet == "" {
+		s.Alphabet = defaultUIDAlphabet
+	}
+	return s
+}
+
 // ProvisionRequest contains parameters for provisioning a new server
 // This is the minimal request format from LabMan
 type ProvisionRequest struct {
-	WebUserID     string `json:"webuserid"` // Keycloak user ID
-	LabID         int    `json:"labId"`     // Lab ID
+	WebUserID     string `json:"webuserid"`               // Keycloak user ID
+	LabID         int    `json:"labId"`                   // Lab ID
+	Tenant        string `json:"tenant,omitempty"`        // Optional: course or organization, validated by the tenant registry
+	CorrelationID string `json:"correlationId,omitempty"` // Optional: request tracing ID
+	Node          string `json:"node,omitempty"`          // Set by the provisioner: node of a composite lab this server is
+	NodeGroup     string `json:"nodeGroup,omitempty"`     // Set by the provisioner: ID shared by the nodes of one composite lab
 	generatedName string // generated server name (not from JSON)
 }
 
@@ -38,23 +125,56 @@ func UnmarshalAndValidate(payload string) (*ProvisionRequest, error) {
 	if len(missing) > 0 {
 		return nil, fmt.Errorf("missing required fields: %v", missing)
 	}
+	if err := validate.First(validate.WebUserID(req.WebUserID), validate.LabID(req.LabID)); err != nil {
+		return nil, err
+	}
+	if req.Node != "" {
+		if err := validate.First(validate.NodeName(req.Node), validate.ServerID(req.NodeGroup)); err != nil {
+			return nil, fmt.Errorf("invalid node: %w", err)
+		}
+	}
+
+	// The default tenant's servers carry no tenant label and journal entries no tenant
+	if req.Tenant == defaultTenant {
+		req.Tenant = ""
+	}
 
 	// Generate server name
-	req.generatedName = generateServerName(req.LabID)
+	name, err := generateServerName(defaultNameTemplate, UIDSpec{}, req)
+	if err != nil {
+		return nil, err
+	}
+	req.generatedName = name
 
 	return &req, nil
 }
 
 // GetHCloudConfig returns Hetzner Cloud configuration from environment
 type HCloudConfig struct {
-	ServerType       string
-	FirewallID       string
-	ImageID          string
-	Location         string
-	SSHKey           string
-	CloudInitFile    string
-	CloudInitContent string
-	TTLMinutes       int
+	ServerType        string   // first configured server type
+	ServerTypes       []string // acceptable server types, most preferred first
+	FirewallID        string
+	ImageID           string
+	PlacementGroup    string             // placement group new servers join, "" for none
+	Location          string             // first configured location
+	Locations         []WeightedLocation // locations new servers are spread over
+	LocationCooldown  time.Duration      // how long a location without capacity is skipped
+	SSHKey            string
+	CloudInitFile     string
+	CloudInitContent  string
+	CloudInitBaseline string // cloud-config merged into the user data of Linux servers, "" for none
+	TTLMinutes        int
+	NameTemplate      *template.Template
+	UID               UIDSpec        // length and alphabet of {{.UID}} in NameTemplate
+	Labs              LabCatalog     // per-lab server types, image and placement group
+	LabNetwork        *net.IPNet     // address range of the private network of each composite lab
+	OS                string         // connector.OSWindows for Windows images, "" or "linux" otherwise
+	Protected         bool           // label new servers connector.LabelProtected, set per lab by the catalog
+	EgressPolicies    EgressPolicies // outgoing traffic allowed per lab class
+	EgressPolicy      string         // lab class whose egress firewall new servers get, "" for open egress
+
+	// Clock is the time source of GetExpiresAt, nil for the system clock
+	Clock clock.Clock
 }
 
 // GetHCloudConfigFromEnv reads Hetzner Cloud configuration from environment
@@ -109,38 +229,243 @@ func GetHCloudConfigFromEnv() (*HCloudConfig, error) {
 		}
 	}
 
+	// HCLOUD_DEFAULT_SERVER_TYPE may list fallback types in order of preference
+	serverTypes, err := parseServerTypes(serverType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HCLOUD_DEFAULT_SERVER_TYPE: %w", err)
+	}
+
+	// HCLOUD_DEFAULT_LOCATION may list several locations, optionally weighted
+	locations, err := parseLocations(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HCLOUD_DEFAULT_LOCATION: %w", err)
+	}
+
+	locationCooldown := defaultLocationCooldown
+	if cooldownStr := os.Getenv("HCLOUD_LOCATION_COOLDOWN"); cooldownStr != "" {
+		locationCooldown, err = time.ParseDuration(cooldownStr)
+		if err != nil || locationCooldown < 0 {
+			return nil, fmt.Errorf("invalid HCLOUD_LOCATION_COOLDOWN: %q", cooldownStr)
+		}
+	}
+
+	var labs LabCatalog
+	if catalogFile := os.Getenv("HCLOUD_LAB_CATALOG_FILE"); catalogFile != "" {
+		labs, err = loadLabCatalog(catalogFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HCLOUD_LAB_CATALOG_FILE: %w", err)
+		}
+	}
+
+	labNetwork, err := parseLabNetwork(defaultLabNetworkIPRange)
+	if err != nil {
+		return nil, err
+	}
+	if rangeStr := os.Getenv("HCLOUD_LAB_NETWORK_IP_RANGE"); rangeStr != "" {
+		labNetwork, err = parseLabNetwork(rangeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HCLOUD_LAB_NETWORK_IP_RANGE: %w", err)
+		}
+	}
+
+	var cloudInitBaseline string
+	if baselineFile := os.Getenv("HCLOUD_CLOUD_INIT_BASELINE_FILE"); baselineFile != "" {
+		cloudInitBaseline, err = loadCloudInitBaseline(baselineFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HCLOUD_CLOUD_INIT_BASELINE_FILE: %w", err)
+		}
+		if isMultipart(string(cloudInitContent)) {
+			return nil, fmt.Errorf("invalid HCLOUD_DEFAULT_CLOUD_INIT_FILE: a multi-part archive can't be merged with HCLOUD_CLOUD_INIT_BASELINE_FILE")
+		}
+	}
+
+	var egressPolicies EgressPolicies
+	if policyFile := os.Getenv("HCLOUD_EGRESS_POLICY_FILE"); policyFile != "" {
+		egressPolicies, err = loadEgressPolicies(policyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HCLOUD_EGRESS_POLICY_FILE: %w", err)
+		}
+	}
+	egressPolicy := os.Getenv("HCLOUD_DEFAULT_EGRESS_POLICY")
+	if egressPolicy != "" {
+		if _, ok := egressPolicies[egressPolicy]; !ok {
+			return nil, fmt.Errorf("invalid HCLOUD_DEFAULT_EGRESS_POLICY: %q is not defined in HCLOUD_EGRESS_POLICY_FILE", egressPolicy)
+		}
+	}
+
+	var uidLength int
+	if lengthStr := os.Getenv("SERVER_NAME_UID_LENGTH"); lengthStr != "" {
+		if uidLength, err = strconv.Atoi(lengthStr); err != nil {
+			return nil, fmt.Errorf("invalid SERVER_NAME_UID_LENGTH: %q", lengthStr)
+		}
+	}
+	uid, err := parseUIDSpec(uidLength, os.Getenv("SERVER_NAME_UID_ALPHABET"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server name UID: %w", err)
+	}
+
+	// Get server naming template with default
+	nameTemplate := defaultNameTemplate
+	if tmplStr := os.Getenv("SERVER_NAME_TEMPLATE"); tmplStr != "" {
+		nameTemplate, err = template.New("server-name").Option("missingkey=error").Parse(tmplStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SERVER_NAME_TEMPLATE: %w", err)
+		}
+	}
+
 	return &HCloudConfig{
-		ServerType:       serverType,
-		FirewallID:       firewallID,
-		ImageID:          imageID,
-		Location:         location,
-		SSHKey:           sshKey,
-		CloudInitFile:    cloudInitFile,
-		CloudInitContent: string(cloudInitContent),
-		TTLMinutes:       ttlMinutes,
+		ServerType:        serverTypes[0],
+		ServerTypes:       serverTypes,
+		FirewallID:        firewallID,
+		ImageID:           imageID,
+		PlacementGroup:    os.Getenv("HCLOUD_DEFAULT_PLACEMENT_GROUP"),
+		Location:          locations[0].Name,
+		Locations:         locations,
+		LocationCooldown:  locationCooldown,
+		SSHKey:            sshKey,
+		CloudInitFile:     cloudInitFile,
+		CloudInitContent:  string(cloudInitContent),
+		CloudInitBaseline: cloudInitBaseline,
+		TTLMinutes:        ttlMinutes,
+		NameTemplate:      nameTemplate,
+		UID:               uid,
+		Labs:              labs,
+		LabNetwork:        labNetwork,
+		EgressPolicies:    egressPolicies,
+		EgressPolicy:      egressPolicy,
 	}, nil
 }
 
+// parseServerTypes parses a comma-separated, ordered list of server types such as "cx22,cpx21,cx32"
+func parseServerTypes(value string) ([]string, error) {
+	var serverTypes []string
+	seen := make(map[string]bool)
+
+	for _, serverType := range strings.Split(value, ",") {
+		serverType = strings.TrimSpace(serverType)
+		if serverType == "" {
+			continue
+		}
+		if seen[serverType] {
+			return nil, fmt.Errorf("server type %q listed twice", serverType)
+		}
+		seen[serverType] = true
+		serverTypes = append(serverTypes, serverType)
+	}
+
+	if len(serverTypes) == 0 {
+		return nil, fmt.Errorf("no server types in %q", value)
+	}
+	return serverTypes, nil
+}
+
 // GetExpiresAt calculates expiration time based on TTL
 func (c *HCloudConfig) GetExpiresAt() time.Time {
-	return time.Now().Add(time.Duration(c.TTLMinutes) * time.Minute)
+	now := clock.Real.Now()
+	if c.Clock != nil {
+		now = c.Clock.Now()
+	}
+	return now.Add(time.Duration(c.TTLMinutes) * time.Minute)
 }
 
-// generateServerName creates a server name with pattern lab{num}-{8 letters UID}
-func generateServerName(labID int) string {
-	uid := generateUID(8)
-	return fmt.Sprintf("lab%d-%s", labID, uid)
+// generateServerName renders the naming template for a request with a fresh UID.
+// The result is lowercased and reduced to characters valid in a hostname.
+func generateServerName(tmpl *template.Template, uid UIDSpec, req ProvisionRequest) (string, error) {
+	if tmpl == nil {
+		tmpl = defaultNameTemplate
+	}
+	uidValue, err := generateUID(uid)
+	if err != nil {
+		return "", err
+	}
+
+	short := req.WebUserID
+	if len(short) > 8 {
+		short = short[:8]
+	}
+
+	var b strings.Builder
+	err = tmpl.Execute(&b, ServerNameData{
+		LabID:          req.LabID,
+		WebUserID:      req.WebUserID,
+		WebUserIDShort: short,
+		UID:            uidValue,
+	})
+	if err != nil {
+		return "", fmt.Errorf("render server name: %w", err)
+	}
+
+	name := sanitizeServerName(b.String())
+	if name == "" {
+		return "", fmt.Errorf("server name template produced an empty name")
+	}
+
+	// The nodes of a composite lab are told apart by a suffix
+	if req.Node != "" {
+		return truncateServerName(name, uidValue, maxServerNameLength-len(req.Node)-1) + "-" + req.Node, nil
+	}
+	return truncateServerName(name, uidValue, maxServerNameLength), nil
 }
 
-// generateUID generates a random string of n lowercase letters
-func generateUID(n int) string {
-	const letters = "abcdefghijklmnopqrstuvwxyz"
-	b := make([]byte, n)
-	rand.Read(b)
+// truncateServerName cuts name to at most limit characters. The UID is what tells names
+// apart, so the text in front of it is cut first, keeping the separator before the UID;
+// the text after it only once nothing is left in front.
+func truncateServerName(name, uid string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	at := strings.LastIndex(name, uid)
+	if at < 0 {
+		return strings.TrimRight(name[:limit], "-")
+	}
+
+	prefix, rest := name[:at], name[at:]
+	if len(rest) > limit {
+		rest = strings.TrimRight(rest[:limit], "-")
+	}
+	sep := ""
+	if strings.HasSuffix(prefix, "-") {
+		sep = "-"
+		prefix = prefix[:len(prefix)-1]
+	}
+	keep := max(limit-len(rest)-len(sep), 0)
+	prefix = strings.TrimRight(prefix[:min(keep, len(prefix))], "-")
+	if prefix == "" {
+		return rest
+	}
+	return prefix + sep + rest
+}
+
+// sanitizeServerName lowercases the name and replaces characters not allowed in
+// hostnames with '-'
+func sanitizeServerName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return '-'
+		}
+	}, name)
+	return strings.Trim(name, "-")
+}
+
+// generateUID generates a random UID from crypto/rand. Every character of the alphabet is
+// equally likely, so names can't be guessed any faster than by trying all of them.
+func generateUID(spec UIDSpec) (string, error) {
+	spec = spec.orDefault()
+	alphabetSize := big.NewInt(int64(len(spec.Alphabet)))
+	b := make([]byte, spec.Length)
 	for i := range b {
-		b[i] = letters[b[i]%26]
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", fmt.Errorf("generate UID: %w", err)
+		}
+		b[i] = spec.Alphabet[n.Int64()]
 	}
-	return string(b)
+	return string(b), nil
 }
 
 // ServerName returns the generated server name
@@ -4,7 +4,10 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"text/template"
 	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
 )
 
 func TestUnmarshalAndValidate(t *testing.T) {
@@ -34,6 +37,15 @@ func TestUnmarshalAndValidate(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "default tenant is no tenant",
+			payload: `{"webuserid": "user-123", "labId": 42, "tenant": "default"}`,
+			checkFields: func(t *testing.T, req *ProvisionRequest) {
+				if req.Tenant != "" {
+					t.Errorf("expected default tenant to be cleared, got %q", req.Tenant)
+				}
+			},
+		},
 		{
 			name:        "invalid JSON",
 			payload:     `{invalid json`,
@@ -63,6 +75,18 @@ func TestUnmarshalAndValidate(t *testing.T) {
 			payload: `{"webuserid": "user-123", "labId": 0}`,
 			wantErr: true,
 		},
+		{
+			name:        "webuserid with key separator",
+			payload:     `{"webuserid": "tenant:other-user", "labId": 42}`,
+			wantErr:     true,
+			errContains: "webuserid may only contain",
+		},
+		{
+			name:        "negative labId",
+			payload:     `{"webuserid": "user-123", "labId": -1}`,
+			wantErr:     true,
+			errContains: "out of range",
+		},
 	}
 
 	for _, tt := range tests {
@@ -106,6 +130,8 @@ func TestGetHCloudConfigFromEnv(t *testing.T) {
 		"HCLOUD_DEFAULT_SSH_KEY":         os.Getenv("HCLOUD_DEFAULT_SSH_KEY"),
 		"HCLOUD_DEFAULT_CLOUD_INIT_FILE": os.Getenv("HCLOUD_DEFAULT_CLOUD_INIT_FILE"),
 		"DEFAULT_TTL_MINUTES":            os.Getenv("DEFAULT_TTL_MINUTES"),
+		"SERVER_NAME_TEMPLATE":           os.Getenv("SERVER_NAME_TEMPLATE"),
+		"HCLOUD_LOCATION_COOLDOWN":       os.Getenv("HCLOUD_LOCATION_COOLDOWN"),
 	}
 	defer func() {
 		// Restore original environment
@@ -256,22 +282,92 @@ func TestGetHCloudConfigFromEnv(t *testing.T) {
 			t.Errorf("expected default TTLMinutes 30 for invalid input, got %d", config.TTLMinutes)
 		}
 	})
+
+	t.Run("weighted location list and server type ladder", func(t *testing.T) {
+		tmpFile, err := os.CreateTemp("", "cloud-init-*.yaml")
+		if err != nil {
+			t.Fatalf("failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		tmpFile.Close()
+
+		os.Setenv("HCLOUD_DEFAULT_SERVER_TYPE", "cx11")
+		os.Setenv("HCLOUD_DEFAULT_FIREWALL", "fw-123")
+		os.Setenv("HCLOUD_DEFAULT_IMAGE", "ubuntu-22.04")
+		os.Setenv("HCLOUD_DEFAULT_LOCATION", "fsn1:3,nbg1")
+		os.Setenv("HCLOUD_DEFAULT_SERVER_TYPE", "cx22, cpx21,cx32")
+		os.Setenv("HCLOUD_DEFAULT_SSH_KEY", "key-123")
+		os.Setenv("HCLOUD_DEFAULT_CLOUD_INIT_FILE", tmpFile.Name())
+		os.Setenv("HCLOUD_LOCATION_COOLDOWN", "2m")
+		defer os.Unsetenv("HCLOUD_LOCATION_COOLDOWN")
+
+		config, err := GetHCloudConfigFromEnv()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if config.Location != "fsn1" {
+			t.Errorf("expected Location 'fsn1', got '%s'", config.Location)
+		}
+		if len(config.Locations) != 2 || config.Locations[0].Weight != 3 || config.Locations[1].Name != "nbg1" {
+			t.Errorf("unexpected Locations: %v", config.Locations)
+		}
+		if config.ServerType != "cx22" || len(config.ServerTypes) != 3 || config.ServerTypes[1] != "cpx21" {
+			t.Errorf("unexpected server types: %q %v", config.ServerType, config.ServerTypes)
+		}
+		if config.LocationCooldown != 2*time.Minute {
+			t.Errorf("expected LocationCooldown 2m, got %v", config.LocationCooldown)
+		}
+
+		os.Setenv("HCLOUD_LOCATION_COOLDOWN", "soon")
+		if _, err := GetHCloudConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "HCLOUD_LOCATION_COOLDOWN") {
+			t.Errorf("expected error about HCLOUD_LOCATION_COOLDOWN, got: %v", err)
+		}
+	})
+
+	t.Run("invalid name template", func(t *testing.T) {
+		// Create temporary cloud-init file
+		tmpFile, err := os.CreateTemp("", "cloud-init-*.yaml")
+		if err != nil {
+			t.Fatalf("failed to create temp file: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		tmpFile.Close()
+
+		os.Setenv("HCLOUD_DEFAULT_SERVER_TYPE", "cx11")
+		os.Setenv("HCLOUD_DEFAULT_FIREWALL", "fw-123")
+		os.Setenv("HCLOUD_DEFAULT_IMAGE", "ubuntu-22.04")
+		os.Setenv("HCLOUD_DEFAULT_LOCATION", "nbg1")
+		os.Setenv("HCLOUD_DEFAULT_SSH_KEY", "key-123")
+		os.Setenv("HCLOUD_DEFAULT_CLOUD_INIT_FILE", tmpFile.Name())
+		os.Setenv("SERVER_NAME_TEMPLATE", "lab{{.LabID")
+		defer os.Unsetenv("SERVER_NAME_TEMPLATE")
+
+		_, err = GetHCloudConfigFromEnv()
+		if err == nil {
+			t.Fatal("expected error for invalid template, got nil")
+		}
+		if !strings.Contains(err.Error(), "invalid SERVER_NAME_TEMPLATE") {
+			t.Errorf("expected error about SERVER_NAME_TEMPLATE, got: %v", err)
+		}
+	})
 }
 
 func TestHCloudConfig_GetExpiresAt(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
 	config := &HCloudConfig{
 		TTLMinutes: 15,
+		Clock:      clock.NewFake(now),
 	}
 
-	before := time.Now()
-	expiresAt := config.GetExpiresAt()
-	after := time.Now()
-
-	expectedMin := before.Add(15 * time.Minute)
-	expectedMax := after.Add(15 * time.Minute)
+	if expiresAt := config.GetExpiresAt(); !expiresAt.Equal(now.Add(15 * time.Minute)) {
+		t.Errorf("GetExpiresAt() = %v, expected %v", expiresAt, now.Add(15*time.Minute))
+	}
 
-	if expiresAt.Before(expectedMin) || expiresAt.After(expectedMax) {
-		t.Errorf("GetExpiresAt() = %v, expected between %v and %v", expiresAt, expectedMin, expectedMax)
+	// Without a clock the expiry counts from the system time
+	config.Clock = nil
+	if expiresAt := config.GetExpiresAt(); time.Until(expiresAt) < 14*time.Minute || time.Until(expiresAt) > 15*time.Minute {
+		t.Errorf("GetExpiresAt() = %v, expected 15 minutes from now", expiresAt)
 	}
 }
 
@@ -287,7 +383,10 @@ func TestGenerateServerName(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			name := generateServerName(tt.labID)
+			name, err := generateServerName(defaultNameTemplate, UIDSpec{}, ProvisionRequest{WebUserID: "user-123", LabID: tt.labID})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
 			// Simpler check: just verify it starts with "lab{num}-"
 			if !strings.HasPrefix(name, "lab") {
@@ -318,29 +417,156 @@ func TestGenerateServerName(t *testing.T) {
 	}
 }
 
+func TestGenerateServerName_CustomTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		req       ProvisionRequest
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "course and environment prefix",
+			template: "cs101-prod-lab{{.LabID}}-{{.WebUserIDShort}}",
+			req:      ProvisionRequest{WebUserID: "3f2a9c1e-7b44-4c1d", LabID: 7},
+			expected: "cs101-prod-lab7-3f2a9c1e",
+		},
+		{
+			name:     "short web user ID kept whole",
+			template: "lab{{.LabID}}-{{.WebUserIDShort}}",
+			req:      ProvisionRequest{WebUserID: "bob", LabID: 1},
+			expected: "lab1-bob",
+		},
+		{
+			name:     "invalid hostname characters replaced",
+			template: "Lab_{{.LabID}}.{{.WebUserID}}",
+			req:      ProvisionRequest{WebUserID: "Alice@Uni", LabID: 2},
+			expected: "lab-2-alice-uni",
+		},
+		{
+			name:     "truncated to hostname limit",
+			template: "{{.WebUserID}}",
+			req:      ProvisionRequest{WebUserID: strings.Repeat("a", 80), LabID: 1},
+			expected: strings.Repeat("a", maxServerNameLength),
+		},
+		{
+			name:     "node of a composite lab",
+			template: "lab{{.LabID}}-{{.WebUserIDShort}}",
+			req:      ProvisionRequest{WebUserID: "bob", LabID: 7, Node: "target"},
+			expected: "lab7-bob-target",
+		},
+		{
+			name:     "node suffix kept when truncated",
+			template: "{{.WebUserID}}",
+			req:      ProvisionRequest{WebUserID: strings.Repeat("a", 80), LabID: 1, Node: "target"},
+			expected: strings.Repeat("a", maxServerNameLength-7) + "-target",
+		},
+		{
+			name:      "empty result",
+			template:  "---",
+			req:       ProvisionRequest{WebUserID: "user", LabID: 1},
+			expectErr: true,
+		},
+		{
+			name:      "unknown field",
+			template:  "{{.Course}}",
+			req:       ProvisionRequest{WebUserID: "user", LabID: 1},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := template.Must(template.New("test").Parse(tt.template))
+			name, err := generateServerName(tmpl, UIDSpec{}, tt.req)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got name %q", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != tt.expected {
+				t.Errorf("generateServerName() = %q, expected %q", name, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateServerName_TruncatedKeepsUID(t *testing.T) {
+	tmpl := template.Must(template.New("test").Parse("{{.WebUserID}}-lab{{.LabID}}-{{.UID}}"))
+	req := ProvisionRequest{WebUserID: strings.Repeat("a", 80), LabID: 7}
+	for _, node := range []string{"", "target"} {
+		req.Node = node
+		name, err := generateServerName(tmpl, UIDSpec{}, req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(name) != maxServerNameLength {
+			t.Errorf("expected %d characters, got %q", maxServerNameLength, name)
+		}
+		uid := strings.TrimSuffix(name, "-"+node)
+		uid = uid[strings.LastIndex(uid, "-")+1:]
+		if len(uid) != defaultUIDLength {
+			t.Errorf("expected the whole UID at the end of %q, got %q", name, uid)
+		}
+	}
+}
+
+func TestTruncateServerName(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	tests := []struct {
+		name     string
+		input    string
+		uid      string
+		limit    int
+		expected string
+	}{
+		{"fits", "lab1-abcdefgh", "abcdefgh", 63, "lab1-abcdefgh"},
+		{"prefix cut before the UID", long + "-abcdefgh", "abcdefgh", 20, strings.Repeat("a", 11) + "-abcdefgh"},
+		{"text after the UID kept", long + "-abcdefgh-x", "abcdefgh", 20, strings.Repeat("a", 9) + "-abcdefgh-x"},
+		{"text after the UID cut last", "abcdefgh-" + long, "abcdefgh", 20, "abcdefgh-" + strings.Repeat("a", 11)},
+		{"no separator dangling", "lab-" + long + "-abcdefgh", "abcdefgh", 13, "lab-abcdefgh"},
+		{"without a UID", long + "-x", "abcdefgh", 20, strings.Repeat("a", 20)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateServerName(tt.input, tt.uid, tt.limit); got != tt.expected {
+				t.Errorf("truncateServerName() = %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
 func TestGenerateUID(t *testing.T) {
 	tests := []struct {
-		name   string
-		length int
+		name     string
+		spec     UIDSpec
+		length   int
+		alphabet string
 	}{
-		{"length 1", 1},
-		{"length 8", 8},
-		{"length 16", 16},
+		{"default", UIDSpec{}, 8, defaultUIDAlphabet},
+		{"length 16", UIDSpec{Length: 16}, 16, defaultUIDAlphabet},
+		{"digits and letters", UIDSpec{Length: 12, Alphabet: "0123456789abcdef"}, 12, "0123456789abcdef"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			uid := generateUID(tt.length)
+			uid, err := generateUID(tt.spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
 			if len(uid) != tt.length {
 				t.Errorf("expected length %d, got %d", tt.length, len(uid))
 			}
 
-			// Check all characters are lowercase letters
-			for _, c := range uid {
-				if c < 'a' || c > 'z' {
-					t.Errorf("expected only lowercase letters, got '%c' in '%s'", c, uid)
-				}
+			// Check all characters are from the alphabet
+			if strings.Trim(uid, tt.alphabet) != "" {
+				t.Errorf("expected only characters of %q, got '%s'", tt.alphabet, uid)
 			}
 		})
 	}
@@ -349,11 +575,63 @@ func TestGenerateUID(t *testing.T) {
 	t.Run("generates unique UIDs", func(t *testing.T) {
 		uids := make(map[string]bool)
 		for i := 0; i < 100; i++ {
-			uid := generateUID(8)
+			uid, _ := generateUID(UIDSpec{})
 			if uids[uid] {
 				t.Errorf("generateUID produced duplicate: '%s'", uid)
 			}
 			uids[uid] = true
 		}
 	})
+
+	// A modulo over random bytes would favour the first 22 letters
+	t.Run("characters equally likely", func(t *testing.T) {
+		counts := make(map[rune]int)
+		for i := 0; i < 50000; i++ {
+			uid, _ := generateUID(UIDSpec{})
+			for _, c := range uid {
+				counts[c]++
+			}
+		}
+		// 400000 characters give 15385 per letter, give or take 121; a modulo would give 14063 of z
+		for _, c := range defaultUIDAlphabet {
+			if counts[c] < 14800 || counts[c] > 16000 {
+				t.Errorf("expected about 15385 of %c, got %d", c, counts[c])
+			}
+		}
+	})
+}
+
+func TestParseUIDSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   int
+		alphabet string
+		want     UIDSpec
+		wantErr  bool
+	}{
+		{name: "defaults", want: UIDSpec{Length: 8, Alphabet: defaultUIDAlphabet}},
+		{name: "longer", length: 12, want: UIDSpec{Length: 12, Alphabet: defaultUIDAlphabet}},
+		{name: "hex", alphabet: "0123456789abcdef", want: UIDSpec{Length: 8, Alphabet: "0123456789abcdef"}},
+		{name: "too short", length: 4, wantErr: true},
+		{name: "too long", length: 40, wantErr: true},
+		{name: "upper case", alphabet: "ABCDEFGHIJKL", wantErr: true},
+		{name: "hyphen", alphabet: "abcdefghij-", wantErr: true},
+		{name: "duplicate character", alphabet: "aabcdefghij", wantErr: true},
+		{name: "too few characters", alphabet: "abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseUIDSpec(tt.length, tt.alphabet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %+v", spec)
+				}
+				return
+			}
+			if err != nil || spec != tt.want {
+				t.Errorf("expected %+v, got %+v, %v", tt.want, spec, err)
+			}
+		})
+	}
 }
@@ -5,20 +5,27 @@ import (
 	"fmt"
 	"log/slog"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
 
 type Server struct {
-	id        int64
-	name      string
-	ipv6      string
-	connector *Connector
-	log       *slog.Logger
+	id         int64
+	name       string
+	ipv6       string
+	privateIP  string // address in the private network of a composite lab, "" for none
+	labels     map[string]string
+	serverType string
+	sshHostKey string // only known for servers created by this connector
+	// adminPassword is the Administrator password of a Windows server, only known for
+	// servers created by this connector
+	adminPassword string
+	created       time.Time
+	hourlyNet     float64 // net hourly price in the server's location, 0 if unknown
+	connector     *Connector
+	log           *slog.Logger
 }
 
 func newServer(server *hcloud.Server, conn *Connector, log *slog.Logger) *Server {
@@ -27,13 +34,40 @@ func newServer(server *hcloud.Server, conn *Connector, log *slog.Logger) *Server
 		// Hetzner provides IPv6 as /64 subnet, append ::1 for the actual host address
 		ipv6 = server.PublicNet.IPv6.IP.String() + "1"
 	}
+	var serverType string
+	if server.ServerType != nil {
+		serverType = server.ServerType.Name
+	}
 	return &Server{
-		id:        server.ID,
-		name:      server.Name,
-		ipv6:      ipv6,
-		connector: conn,
-		log:       log,
+		id:         server.ID,
+		name:       server.Name,
+		ipv6:       ipv6,
+		privateIP:  privateAddress(server),
+		labels:     server.Labels,
+		serverType: serverType,
+		created:    server.Created,
+		hourlyNet:  hourlyPrice(server),
+		connector:  conn,
+		log:        log,
+	}
+}
+
+// hourlyPrice returns the net hourly price of the server's type in its location
+func hourlyPrice(server *hcloud.Server) float64 {
+	if server.ServerType == nil || server.Datacenter == nil || server.Datacenter.Location == nil {
+		return 0
+	}
+	for _, pricing := range server.ServerType.Pricings {
+		if pricing.Location == nil || pricing.Location.Name != server.Datacenter.Location.Name {
+			continue
+		}
+		price, err := strconv.ParseFloat(pricing.Hourly.Net, 64)
+		if err != nil {
+			return 0
+		}
+		return price
 	}
+	return 0
 }
 
 func (s *Server) GetID() string {
@@ -48,136 +82,287 @@ func (s *Server) GetIPv6Address() string {
 	return s.ipv6
 }
 
-// isResourceLockedError checks if an error is due to a locked resource
+// GetPrivateAddress returns the server's address in the private network of its composite lab,
+// or "" if it is in none
+func (s *Server) GetPrivateAddress() string {
+	return s.privateIP
+}
+
+func (s *Server) GetLabels() map[string]string {
+	return s.labels
+}
+
+// GetSSHHostKey returns the ed25519 host key SWIM installed on the server, in authorized_keys
+// format. It is empty for servers looked up from the API, whose key SWIM never saw.
+func (s *Server) GetSSHHostKey() string {
+	return s.sshHostKey
+}
+
+// GetAdminPassword returns the Administrator password SWIM set on a Windows server. It is
+// empty for Linux servers and for servers looked up from the API.
+func (s *Server) GetAdminPassword() string {
+	return s.adminPassword
+}
+
+// GetServerType returns the server type the server was created with
+func (s *Server) GetServerType() string {
+	return s.serverType
+}
+
+// GetCreated returns when the server was created at the provider
+func (s *Server) GetCreated() time.Time {
+	return s.created
+}
+
+// GetHourlyPrice returns the net hourly price of the server, or 0 if the provider didn't report it
+func (s *Server) GetHourlyPrice() float64 {
+	return s.hourlyNet
+}
+
+// isResourceLockedError checks if an error is due to another action holding the resource
 func isResourceLockedError(err error) bool {
-	if err == nil {
-		return false
-	}
-	errMsg := strings.ToLower(err.Error())
-	return strings.Contains(errMsg, "locked") || strings.Contains(errMsg, "resource is locked")
+	return hcloud.IsError(err, hcloud.ErrorCodeLocked, hcloud.ErrorCodeConflict)
 }
 
-func (s *Server) GetState() (string, error) {
-	ctx := context.Background()
+func (s *Server) GetState(ctx context.Context) (string, error) {
 	server, _, err := s.connector.client.Server.GetByID(ctx, s.id)
 	if err != nil {
-		return "", err
+		return "", classify(err)
 	}
 	if server == nil {
-		return "", fmt.Errorf("server with ID %d not found", s.id)
+		return "", connector.NotFound("server with ID %d not found", s.id)
 	}
 	return string(server.Status), nil
 }
 
-func (s *Server) Delete() error {
-	ctx := context.Background()
+// Delete shuts the server down and deletes it. Cancelling ctx aborts the shutdown wait
+// and the retries on locked resources.
+func (s *Server) Delete(ctx context.Context) error {
 	s.log.Info("deleting server", "server_id", s.id, "server_name", s.name)
 
 	server, _, err := s.connector.client.Server.GetByID(ctx, s.id)
 	if err != nil {
-		return fmt.Errorf("get server: %w", err)
+		return fmt.Errorf("get server: %w", classify(err))
 	}
 	if server == nil {
-		return fmt.Errorf("server with ID %d not found", s.id)
+		return connector.NotFound("server with ID %d not found", s.id)
 	}
 
-	// Shutdown if running
-	if server.Status == hcloud.ServerStatusRunning {
-		s.log.Info("shutting down server", "server_id", s.id)
+	if err := s.shutdown(ctx, &server); err != nil {
+		return err
+	}
 
-		// Retry shutdown with exponential backoff if resource is locked
-		retryDelay := config.InitialRetryDelay
-		var shutdownErr error
-		for attempt := 1; attempt <= config.MaxRetryAttempts; attempt++ {
-			_, _, shutdownErr = s.connector.client.Server.Shutdown(ctx, server)
-			if shutdownErr == nil {
-				break
-			}
+	// Delete the server with retry logic
+	s.log.Info("deleting server from hetzner cloud", "server_id", s.id)
+	err = s.retryWhileLocked(ctx, "delete", &server, func() error {
+		_, _, err := s.connector.client.Server.DeleteWithResult(ctx, server)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("delete server: %w", err)
+	}
 
-			if isResourceLockedError(shutdownErr) {
-				s.log.Warn("server is locked, retrying shutdown",
-					"server_id", s.id,
-					"attempt", attempt,
-					"max_attempts", config.MaxRetryAttempts,
-					"retry_delay", retryDelay,
-					"error", shutdownErr)
-
-				if attempt < config.MaxRetryAttempts {
-					time.Sleep(retryDelay)
-					// Exponential backoff with max delay cap
-					retryDelay = retryDelay * config.RetryBackoffMultiple
-					if retryDelay > config.MaxRetryDelay {
-						retryDelay = config.MaxRetryDelay
-					}
-					// Refresh server state before retry
-					server, _, err = s.connector.client.Server.GetByID(ctx, s.id)
-					if err != nil {
-						return fmt.Errorf("refresh server state: %w", err)
-					}
-					if server == nil {
-						return fmt.Errorf("server with ID %d not found during retry", s.id)
-					}
-					continue
-				}
-			}
+	s.log.Info("server deleted successfully", "server_id", s.id, "server_name", s.name)
 
-			return fmt.Errorf("shutdown server: %w", shutdownErr)
+	// The last node of a composite lab takes the lab's network with it
+	if group := s.labels[connector.LabelNodeGroup]; group != "" {
+		if err := s.connector.deleteLabNetwork(ctx, group, s.id); err != nil {
+			s.log.Warn("failed to delete lab network", "node_group", group, "error", err)
 		}
+	}
+	return nil
+}
 
-		// Wait for server to stop
-		s.log.Info("waiting for server to stop", "server_id", s.id)
-		if err := s.waitForStatus(ctx, hcloud.ServerStatusOff, 2*time.Minute); err != nil {
-			return err
-		}
-		s.log.Info("server stopped", "server_id", s.id)
-	} else {
-		s.log.Info("server already stopped", "server_id", s.id, "status", server.Status)
+// Rebuild reinstalls the server from the image it was created with, keeping its ID, addresses
+// and user data, and returns once the provider has finished. If that image is gone, the
+// server is rebuilt from HCLOUD_DEFAULT_IMAGE.
+func (s *Server) Rebuild(ctx context.Context) error {
+	if s.connector.dryrun {
+		s.log.Info("[DRY-RUN] Would rebuild server", "server_id", s.id, "server_name", s.name)
+		return nil
 	}
+	s.log.Info("rebuilding server", "server_id", s.id, "server_name", s.name)
 
-	// Delete the server with retry logic
-	s.log.Info("deleting server from hetzner cloud", "server_id", s.id)
-	retryDelay := config.InitialRetryDelay
-	var deleteErr error
-	for attempt := 1; attempt <= config.MaxRetryAttempts; attempt++ {
-		_, _, deleteErr = s.connector.client.Server.DeleteWithResult(ctx, server)
-		if deleteErr == nil {
-			break
+	server, _, err := s.connector.client.Server.GetByID(ctx, s.id)
+	if err != nil {
+		return fmt.Errorf("get server: %w", classify(err))
+	}
+	if server == nil {
+		return connector.NotFound("server with ID %d not found", s.id)
+	}
+
+	image := server.Image
+	if image == nil {
+		if s.connector.cfg == nil {
+			return fmt.Errorf("server %d has no image to rebuild from: %w", s.id, errNoConfig)
 		}
+		image = &hcloud.Image{Name: s.connector.cfg.ImageID}
+	}
 
-		if isResourceLockedError(deleteErr) {
-			s.log.Warn("server is locked, retrying delete",
-				"server_id", s.id,
-				"attempt", attempt,
-				"max_attempts", config.MaxRetryAttempts,
-				"retry_delay", retryDelay,
-				"error", deleteErr)
-
-			if attempt < config.MaxRetryAttempts {
-				time.Sleep(retryDelay)
-				// Exponential backoff with max delay cap
-				retryDelay = retryDelay * config.RetryBackoffMultiple
-				if retryDelay > config.MaxRetryDelay {
-					retryDelay = config.MaxRetryDelay
-				}
-				// Refresh server state before retry
-				server, _, err = s.connector.client.Server.GetByID(ctx, s.id)
-				if err != nil {
-					return fmt.Errorf("refresh server state: %w", err)
-				}
-				if server == nil {
-					return fmt.Errorf("server with ID %d not found during retry", s.id)
-				}
-				continue
-			}
+	var action *hcloud.Action
+	err = s.retryWhileLocked(ctx, "rebuild", &server, func() error {
+		result, _, err := s.connector.client.Server.RebuildWithResult(ctx, server, hcloud.ServerRebuildOpts{Image: image})
+		action = result.Action
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("rebuild server: %w", err)
+	}
+	if err := s.connector.client.Action.WaitFor(ctx, action); err != nil {
+		return fmt.Errorf("wait for rebuild: %w", classify(err))
+	}
+
+	s.log.Info("server rebuilt successfully", "server_id", s.id, "server_name", s.name)
+	return nil
+}
+
+// Resize changes the server to serverType, keeping its disk so it can be resized back, and
+// returns once it is powered on again. A running server is shut down first; if the change
+// fails, it is powered back on before the error is returned.
+func (s *Server) Resize(ctx context.Context, serverType string) error {
+	if s.connector.dryrun {
+		s.log.Info("[DRY-RUN] Would resize server", "server_id", s.id, "server_name", s.name, "server_type", serverType)
+		s.serverType = serverType
+		return nil
+	}
+	s.log.Info("resizing server", "server_id", s.id, "server_name", s.name, "from", s.serverType, "to", serverType)
+
+	server, _, err := s.connector.client.Server.GetByID(ctx, s.id)
+	if err != nil {
+		return fmt.Errorf("get server: %w", classify(err))
+	}
+	if server == nil {
+		return connector.NotFound("server with ID %d not found", s.id)
+	}
+
+	if err := s.shutdown(ctx, &server); err != nil {
+		return err
+	}
+
+	var action *hcloud.Action
+	err = s.retryWhileLocked(ctx, "change type", &server, func() error {
+		var err error
+		action, _, err = s.connector.client.Server.ChangeType(ctx, server, hcloud.ServerChangeTypeOpts{
+			ServerType: &hcloud.ServerType{Name: serverType},
+		})
+		return err
+	})
+	if err == nil {
+		err = classify(s.connector.client.Action.WaitFor(ctx, action))
+	}
+	if err != nil {
+		// Leave the server running in its old type rather than switched off
+		if powerErr := s.powerOn(ctx, &server); powerErr != nil {
+			s.log.Error("failed to power server back on after failed resize", "server_id", s.id, "error", powerErr)
 		}
+		return fmt.Errorf("change server type: %w", err)
+	}
+	s.serverType = serverType
 
-		return fmt.Errorf("delete server: %w", deleteErr)
+	if err := s.powerOn(ctx, &server); err != nil {
+		return err
 	}
+	s.log.Info("server resized successfully", "server_id", s.id, "server_name", s.name, "server_type", serverType)
+	return nil
+}
 
-	s.log.Info("server deleted successfully", "server_id", s.id, "server_name", s.name)
+// PowerOn starts the server, e.g. after a failed resize left it off, and waits for the provider to finish
+func (s *Server) PowerOn(ctx context.Context) error {
+	if s.connector.dryrun {
+		s.log.Info("[DRY-RUN] Would power on server", "server_id", s.id, "server_name", s.name)
+		return nil
+	}
+	server, _, err := s.connector.client.Server.GetByID(ctx, s.id)
+	if err != nil {
+		return fmt.Errorf("get server: %w", classify(err))
+	}
+	if server == nil {
+		return connector.NotFound("server with ID %d not found", s.id)
+	}
+	return s.powerOn(ctx, &server)
+}
+
+// shutdown shuts the server down gracefully and waits until it is off, unless it isn't running
+func (s *Server) shutdown(ctx context.Context, server **hcloud.Server) error {
+	if (*server).Status != hcloud.ServerStatusRunning {
+		s.log.Info("server already stopped", "server_id", s.id, "status", (*server).Status)
+		return nil
+	}
+	s.log.Info("shutting down server", "server_id", s.id)
+
+	// Retry shutdown with backoff while another action holds the server
+	err := s.retryWhileLocked(ctx, "shutdown", server, func() error {
+		_, _, err := s.connector.client.Server.Shutdown(ctx, *server)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("shutdown server: %w", err)
+	}
+
+	// Wait for server to stop
+	s.log.Info("waiting for server to stop", "server_id", s.id)
+	if err := s.waitForStatus(ctx, hcloud.ServerStatusOff, 2*time.Minute); err != nil {
+		return err
+	}
+	s.log.Info("server stopped", "server_id", s.id)
 	return nil
 }
 
+// powerOn starts the server and waits for the provider to finish
+func (s *Server) powerOn(ctx context.Context, server **hcloud.Server) error {
+	var action *hcloud.Action
+	err := s.retryWhileLocked(ctx, "power on", server, func() error {
+		var err error
+		action, _, err = s.connector.client.Server.Poweron(ctx, *server)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("power on server: %w", err)
+	}
+	if err := s.connector.client.Action.WaitFor(ctx, action); err != nil {
+		return fmt.Errorf("wait for power on: %w", classify(err))
+	}
+	return nil
+}
+
+// retryWhileLocked calls op under the provider-call retry policy while it fails because
+// another action holds the server, refreshing *server before each retry. Returns op's
+// last error, classified, or the error of the refresh.
+func (s *Server) retryWhileLocked(ctx context.Context, action string, server **hcloud.Server, op func() error) error {
+	policy := s.connector.lockedRetry
+	var refreshErr error
+	attempt := 0
+	err := policy.Do(ctx, func() error {
+		attempt++
+		if attempt > 1 {
+			refreshed, _, err := s.connector.client.Server.GetByID(ctx, s.id)
+			switch {
+			case err != nil:
+				refreshErr = fmt.Errorf("refresh server state: %w", classify(err))
+				return refreshErr
+			case refreshed == nil:
+				refreshErr = connector.NotFound("server with ID %d not found during retry", s.id)
+				return refreshErr
+			}
+			*server = refreshed
+		}
+		return op()
+	}, func(err error) bool {
+		return refreshErr == nil && isResourceLockedError(err)
+	}, func(attempt int, delay time.Duration, err error) {
+		s.log.Warn("server is locked, retrying "+action,
+			"server_id", s.id,
+			"attempt", attempt,
+			"max_attempts", policy.MaxAttempts,
+			"retry_delay", delay,
+			"error", err)
+	})
+	if refreshErr != nil {
+		return refreshErr
+	}
+	return classify(err)
+}
+
 // waitForStatus waits for the server to reach the expected status
 func (s *Server) waitForStatus(ctx context.Context, expectedStatus hcloud.ServerStatus, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
@@ -185,14 +370,18 @@ func (s *Server) waitForStatus(ctx context.Context, expectedStatus hcloud.Server
 	defer ticker.Stop()
 
 	for time.Now().Before(deadline) {
-		state, err := s.GetState()
+		state, err := s.GetState(ctx)
 		if err != nil {
 			return fmt.Errorf("get server state: %w", err)
 		}
 		if state == string(expectedStatus) {
 			return nil
 		}
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for status %s: %w", expectedStatus, ctx.Err())
+		case <-ticker.C:
+		}
 	}
 	return fmt.Errorf("timeout waiting for server to reach status %s", expectedStatus)
 }
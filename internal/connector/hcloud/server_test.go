@@ -3,12 +3,15 @@ package hcloud
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/alex-sviridov/swim/internal/connector"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
 
@@ -22,8 +25,9 @@ func TestNewServer(t *testing.T) {
 
 	t.Run("with IPv6", func(t *testing.T) {
 		hcloudServer := &hcloud.Server{
-			ID:   12345,
-			Name: "test-server",
+			ID:         12345,
+			Name:       "test-server",
+			ServerType: &hcloud.ServerType{Name: "cpx21"},
 			PublicNet: hcloud.ServerPublicNet{
 				IPv6: hcloud.ServerPublicNetIPv6{
 					IP: mustParseIP(t, "2001:db8::"),
@@ -42,6 +46,9 @@ func TestNewServer(t *testing.T) {
 		if server.ipv6 != "2001:db8::1" {
 			t.Errorf("expected ipv6 '2001:db8::1', got '%s'", server.ipv6)
 		}
+		if server.GetServerType() != "cpx21" {
+			t.Errorf("expected server type 'cpx21', got '%s'", server.GetServerType())
+		}
 		if server.connector != connector {
 			t.Error("connector not set correctly")
 		}
@@ -67,6 +74,29 @@ func TestNewServer(t *testing.T) {
 			t.Errorf("expected empty ipv6, got '%s'", server.ipv6)
 		}
 	})
+
+	t.Run("created and hourly price", func(t *testing.T) {
+		created := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+		hcloudServer := &hcloud.Server{
+			ID:         12345,
+			Name:       "test-server",
+			Created:    created,
+			Datacenter: &hcloud.Datacenter{Location: &hcloud.Location{Name: "nbg1"}},
+			ServerType: &hcloud.ServerType{Name: "cpx21", Pricings: []hcloud.ServerTypeLocationPricing{
+				{Location: &hcloud.Location{Name: "fsn1"}, Hourly: hcloud.Price{Net: "0.0100"}},
+				{Location: &hcloud.Location{Name: "nbg1"}, Hourly: hcloud.Price{Net: "0.0125"}},
+			}},
+		}
+
+		server := newServer(hcloudServer, connector, logger)
+
+		if !server.GetCreated().Equal(created) {
+			t.Errorf("expected created %v, got %v", created, server.GetCreated())
+		}
+		if server.GetHourlyPrice() != 0.0125 {
+			t.Errorf("expected hourly price 0.0125 for nbg1, got %v", server.GetHourlyPrice())
+		}
+	})
 }
 
 func TestServer_GetID(t *testing.T) {
@@ -101,61 +131,44 @@ func TestServer_String(t *testing.T) {
 	}
 }
 
-func TestIsResourceLockedError(t *testing.T) {
+func TestClassify(t *testing.T) {
+	apiErr := func(code hcloud.ErrorCode) error {
+		return fmt.Errorf("delete server: %w", hcloud.Error{Code: code, Message: string(code)})
+	}
 	tests := []struct {
-		name     string
-		err      error
-		expected bool
+		name string
+		err  error
+		want connector.ErrorCode
 	}{
-		{
-			name:     "nil error",
-			err:      nil,
-			expected: false,
-		},
-		{
-			name:     "locked error lowercase",
-			err:      errors.New("resource is locked"),
-			expected: true,
-		},
-		{
-			name:     "locked error uppercase",
-			err:      errors.New("Resource is LOCKED"),
-			expected: true,
-		},
-		{
-			name:     "locked keyword alone",
-			err:      errors.New("locked"),
-			expected: true,
-		},
-		{
-			name:     "locked in message",
-			err:      errors.New("operation failed: server locked by another process"),
-			expected: true,
-		},
-		{
-			name:     "resource is locked phrase",
-			err:      errors.New("cannot proceed: resource is locked"),
-			expected: true,
-		},
-		{
-			name:     "non-locked error",
-			err:      errors.New("server not found"),
-			expected: false,
-		},
-		{
-			name:     "empty error",
-			err:      errors.New(""),
-			expected: false,
-		},
+		{name: "not found", err: apiErr(hcloud.ErrorCodeNotFound), want: connector.CodeNotFound},
+		{name: "rate limited", err: apiErr(hcloud.ErrorCodeRateLimitExceeded), want: connector.CodeRateLimited},
+		{name: "resource unavailable", err: apiErr(hcloud.ErrorCodeResourceUnavailable), want: connector.CodeCapacity},
+		{name: "placement error", err: apiErr(hcloud.ErrorCodePlacementError), want: connector.CodeCapacity},
+		{name: "locked", err: apiErr(hcloud.ErrorCodeLocked), want: connector.CodeLocked},
+		{name: "conflict", err: apiErr(hcloud.ErrorCodeConflict), want: connector.CodeLocked},
+		{name: "other API error", err: apiErr(hcloud.ErrorCodeForbidden)},
+		// Messages alone are not trusted, whatever they say
+		{name: "plain message", err: errors.New("resource is locked")},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isResourceLockedError(tt.err); got != tt.expected {
-				t.Errorf("isResourceLockedError() = %v, want %v for error: %v", got, tt.expected, tt.err)
+			err := classify(tt.err)
+			if got := connector.CodeOf(err); got != tt.want {
+				t.Errorf("CodeOf(classify(%v)) = %q, want %q", tt.err, got, tt.want)
+			}
+			if err.Error() != tt.err.Error() {
+				t.Errorf("expected message %q to be kept, got %q", tt.err, err)
 			}
 		})
 	}
+
+	if classify(nil) != nil {
+		t.Error("expected nil error to stay nil")
+	}
+	if got := isResourceLockedError(apiErr(hcloud.ErrorCodeLocked)); !got {
+		t.Error("expected locked API error to be detected")
+	}
 }
 
 func TestParseServerID(t *testing.T) {
@@ -239,8 +252,8 @@ func TestServerInterface(t *testing.T) {
 		GetID() string
 		GetName() string
 		GetIPv6Address() string
-		GetState() (string, error)
-		Delete() error
+		GetState(ctx context.Context) (string, error)
+		Delete(ctx context.Context) error
 		String() string
 	} = (*Server)(nil)
 }
@@ -0,0 +1,56 @@
+package hcloud
+
+import (
+	"context"
+	"net/http"
+)
+
+// TokenProvider supplies the API token and reloads it when the API rejects it
+type TokenProvider interface {
+	Value() string
+	Refresh(ctx context.Context) (bool, error)
+}
+
+// rotatingTransport authenticates every request with the provider's current token.
+// A request rejected with 401 is retried once if reloading the token yields a new one,
+// so calls in flight during a rotation succeed under the new token.
+type rotatingTransport struct {
+	tokens TokenProvider
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Requests with a body can only be retried if it can be read again
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	changed, refreshErr := t.tokens.Refresh(req.Context())
+	if refreshErr != nil || !changed {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+	return t.send(retry)
+}
+
+// send sends a copy of req carrying the current token
+func (t *rotatingTransport) send(req *http.Request) (*http.Response, error) {
+	authed := req.Clone(req.Context())
+	authed.Header.Set("Authorization", "Bearer "+t.tokens.Value())
+	return t.base.RoundTrip(authed)
+}
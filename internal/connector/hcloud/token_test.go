@@ -0,0 +1,76 @@
+package hcloud
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeTokens rotates to next on the first refresh
+type fakeTokens struct {
+	value     string
+	next      string
+	refreshes int
+}
+
+func (f *fakeTokens) Value() string { return f.value }
+
+func (f *fakeTokens) Refresh(ctx context.Context) (bool, error) {
+	f.refreshes++
+	if f.next == "" || f.next == f.value {
+		return false, nil
+	}
+	f.value = f.next
+	return true, nil
+}
+
+func TestRotatingTransport(t *testing.T) {
+	var valid string
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if r.Header.Get("Authorization") != "Bearer "+valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	t.Run("retries under the rotated token", func(t *testing.T) {
+		valid, bodies = "new-token", nil
+		tokens := &fakeTokens{value: "old-token", next: "new-token"}
+		client := &http.Client{Transport: &rotatingTransport{tokens: tokens, base: http.DefaultTransport}}
+
+		resp, err := client.Post(srv.URL, "application/json", strings.NewReader(`{"name":"lab1"}`))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || tokens.refreshes != 1 {
+			t.Errorf("expected success after one refresh, got %d after %d", resp.StatusCode, tokens.refreshes)
+		}
+		if len(bodies) != 2 || bodies[1] != `{"name":"lab1"}` {
+			t.Errorf("expected the body to be sent again, got %q", bodies)
+		}
+	})
+
+	t.Run("no retry without a new token", func(t *testing.T) {
+		valid, bodies = "other-token", nil
+		tokens := &fakeTokens{value: "old-token"}
+		client := &http.Client{Transport: &rotatingTransport{tokens: tokens, base: http.DefaultTransport}}
+
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || len(bodies) != 1 {
+			t.Errorf("expected a single rejected request, got %d after %d requests", resp.StatusCode, len(bodies))
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// Time series of the server metrics API the usage is taken from
+const (
+	metricCPU    = "cpu"
+	metricEgress = "network.0.bandwidth.out" // bytes per second sent on the public interface
+)
+
+// GetUsage returns the average CPU usage and outgoing traffic of the server between start and end
+func (s *Server) GetUsage(ctx context.Context, start, end time.Time) (connector.Usage, error) {
+	if s.connector.dryrun {
+		return connector.Usage{}, nil
+	}
+	metrics, _, err := s.connector.client.Server.GetMetrics(ctx, &hcloud.Server{ID: s.id}, hcloud.ServerGetMetricsOpts{
+		Types: []hcloud.ServerMetricType{hcloud.ServerMetricCPU, hcloud.ServerMetricNetwork},
+		Start: start,
+		End:   end,
+	})
+	if err != nil {
+		return connector.Usage{}, fmt.Errorf("get server metrics: %w", classify(err))
+	}
+
+	cpu, samples := average(metrics.TimeSeries[metricCPU])
+	egress, _ := average(metrics.TimeSeries[metricEgress])
+	return connector.Usage{CPUPercent: cpu, EgressBytes: egress, Samples: samples}, nil
+}
+
+// average returns the mean of the values of series and their number. Gaps, which the API
+// reports as "NaN", are skipped.
+func average(series []hcloud.ServerMetricsValue) (float64, int) {
+	var sum float64
+	count := 0
+	for _, sample := range series {
+		value, err := strconv.ParseFloat(sample.Value, 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+		sum += value
+		count++
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return sum / float64(count), count
+}
+
+// PowerOff cuts the power of the server without deleting it, e.g. to quarantine it, and
+// returns once it is off
+func (s *Server) PowerOff(ctx context.Context) error {
+	if s.connector.dryrun {
+		s.log.Info("[DRY-RUN] Would power off server", "server_id", s.id, "server_name", s.name)
+		return nil
+	}
+	s.log.Info("powering off server", "server_id", s.id, "server_name", s.name)
+
+	server := &hcloud.Server{ID: s.id}
+	var action *hcloud.Action
+	err := s.retryWhileLocked(ctx, "power off", &server, func() error {
+		var err error
+		action, _, err = s.connector.client.Server.Poweroff(ctx, server)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("power off server: %w", err)
+	}
+	if err := s.connector.client.Action.WaitFor(ctx, action); err != nil {
+		return fmt.Errorf("wait for power off: %w", classify(err))
+	}
+	return nil
+}
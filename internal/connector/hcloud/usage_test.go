@@ -0,0 +1,54 @@
+package hcloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestServer_GetUsage(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/servers/42/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": "not_found", "message": "not found"}}`)
+			return
+		}
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"metrics": {"start": "2026-01-01T10:00:00Z", "end": "2026-01-01T11:00:00Z", "step": 60, "time_series": {
+			"cpu": {"values": [[1767261600, "100"], [1767261660, "NaN"], [1767261720, "80"]]},
+			"network.0.bandwidth.out": {"values": [[1767261600, "1000"], [1767261660, "3000"]]}
+		}}}`)
+	}))
+	defer srv.Close()
+
+	c := &Connector{
+		client: hcloud.NewClient(hcloud.WithEndpoint(srv.URL), hcloud.WithToken("token")),
+		log:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	server := &Server{id: 42, connector: c, log: c.log}
+
+	end := time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)
+	usage, err := server.GetUsage(context.Background(), end.Add(-time.Hour), end)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if usage.CPUPercent != 90 || usage.Samples != 2 || usage.EgressBytes != 2000 {
+		t.Errorf("expected 90%% CPU over 2 samples and 2000 bytes/s, got %+v", usage)
+	}
+	if query != "end=2026-01-01T11%3A00%3A00Z&start=2026-01-01T10%3A00%3A00Z&type=cpu&type=network" {
+		t.Errorf("unexpected query %q", query)
+	}
+
+	if _, err := (&Server{id: 7, connector: c, log: c.log}).GetUsage(context.Background(), end.Add(-time.Hour), end); err == nil {
+		t.Error("expected an error for a missing server")
+	}
+}
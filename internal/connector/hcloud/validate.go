@@ -0,0 +1,175 @@
+package hcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// Validate checks the configuration set with WithConfig, see ValidateConfig
+func (c *Connector) Validate(ctx context.Context) ([]string, error) {
+	if c.cfg == nil {
+		return nil, errNoConfig
+	}
+	return c.ValidateConfig(ctx, c.cfg)
+}
+
+// ValidateConfig checks the server types, locations and images of cfg and of every lab in
+// its catalog (or the synced one, see WithLabCatalog) against the Hetzner Cloud API, so a typo
+// or an image without a build for a server type's architecture shows at startup instead of
+// at the first student's provision.
+// Returns one line per problem found; an error means the API couldn't be asked.
+func (c *Connector) ValidateConfig(ctx context.Context, cfg *HCloudConfig) ([]string, error) {
+	if c.labs != nil {
+		synced := *cfg
+		synced.Labs = c.labs.Catalog()
+		cfg = &synced
+	}
+
+	serverTypes, err := c.client.ServerType.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list server types: %w", classify(err))
+	}
+	locations, err := c.client.Location.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list locations: %w", classify(err))
+	}
+
+	typesByName := make(map[string]*hcloud.ServerType, len(serverTypes))
+	c.arch.mu.Lock()
+	if c.arch.byType == nil {
+		c.arch.byType = make(map[string]hcloud.Architecture)
+	}
+	for _, st := range serverTypes {
+		typesByName[st.Name] = st
+		c.arch.byType[st.Name] = st.Architecture
+	}
+	c.arch.mu.Unlock()
+
+	var problems []string
+	known := make(map[string]bool, len(locations))
+	for _, location := range locations {
+		known[location.Name] = true
+	}
+	for _, location := range cfg.Locations {
+		if !known[location.Name] {
+			problems = append(problems, fmt.Sprintf("location %s does not exist", location.Name))
+		}
+	}
+
+	labIDs := make([]int, 0, len(cfg.Labs))
+	for labID := range cfg.Labs {
+		labIDs = append(labIDs, labID)
+	}
+	sort.Ints(labIDs)
+
+	for _, labID := range labIDs {
+		if class := cfg.ForLab(labID).EgressPolicy; class != "" {
+			if _, ok := cfg.EgressPolicies[class]; !ok {
+				problems = append(problems, fmt.Sprintf("lab %d: egress policy %s is not defined", labID, class))
+			}
+		}
+	}
+
+	labProblems, err := c.validateLadder(ctx, "default", *cfg, typesByName)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, labProblems...)
+	for _, labID := range labIDs {
+		labProblems, err := c.validateLadder(ctx, fmt.Sprintf("lab %d", labID), cfg.ForLab(labID), typesByName)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, labProblems...)
+		for _, node := range cfg.Labs[labID].Nodes {
+			nodeProblems, err := c.validateLadder(ctx, fmt.Sprintf("lab %d node %s", labID, node.Name), cfg.ForNode(labID, node.Name), typesByName)
+			if err != nil {
+				return nil, err
+			}
+			problems = append(problems, nodeProblems...)
+		}
+	}
+	return problems, nil
+}
+
+// validateLadder checks the server types of one configuration and that at least one of them
+// can run its image. Types the image can't boot are only logged while another type can.
+func (c *Connector) validateLadder(ctx context.Context, scope string, cfg HCloudConfig, typesByName map[string]*hcloud.ServerType) ([]string, error) {
+	var problems, incompatible []string
+	usable := 0
+	for _, serverType := range cfg.ServerTypes {
+		st, ok := typesByName[serverType]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: server type %s does not exist", scope, serverType))
+			continue
+		}
+		if !offeredIn(st, cfg.Locations) {
+			problems = append(problems, fmt.Sprintf("%s: server type %s is not offered in any of %s",
+				scope, serverType, locationNames(cfg.Locations)))
+			continue
+		}
+		if st.IsDeprecated() {
+			c.log.Warn("configured server type is deprecated",
+				"scope", scope,
+				"type", serverType,
+				"unavailable_after", st.UnavailableAfter())
+		}
+
+		_, err := c.imageFor(ctx, cfg.ImageID, serverType)
+		if errors.Is(err, errIncompatibleServerType) {
+			incompatible = append(incompatible, err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		usable++
+	}
+
+	switch {
+	case usable == 0 && len(incompatible) > 0:
+		problems = append(problems, fmt.Sprintf("%s: no server type can run image %q (%s)",
+			scope, cfg.ImageID, strings.Join(incompatible, "; ")))
+	case len(incompatible) > 0:
+		c.log.Warn("image does not fit some configured server types, they will be skipped",
+			"scope", scope,
+			"image", cfg.ImageID,
+			"skipped", strings.Join(incompatible, "; "))
+	}
+	return problems, nil
+}
+
+// offeredIn reports whether serverType can still be created in one of locations.
+// Types listing no locations are assumed to be offered everywhere.
+func offeredIn(serverType *hcloud.ServerType, locations []WeightedLocation) bool {
+	if len(serverType.Locations) == 0 {
+		return true
+	}
+	now := time.Now()
+	for _, offered := range serverType.Locations {
+		if offered.Location == nil || (offered.IsDeprecated() && offered.UnavailableAfter().Before(now)) {
+			continue
+		}
+		for _, location := range locations {
+			if offered.Location.Name == location.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// locationNames lists the names of locations, e.g. "fsn1,nbg1"
+func locationNames(locations []WeightedLocation) string {
+	names := make([]string, len(locations))
+	for i, location := range locations {
+		names[i] = location.Name
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,76 @@
+package hcloud
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestConnector_ValidateConfig(t *testing.T) {
+	fsn1 := []WeightedLocation{{"fsn1", 1}}
+
+	tests := []struct {
+		name     string
+		cfg      HCloudConfig
+		problems []string // substrings of the expected problems, in order
+	}{
+		{
+			name: "valid with an arm lab",
+			cfg: HCloudConfig{
+				ServerTypes: []string{"cx22"},
+				ImageID:     "ubuntu-24.04",
+				Locations:   []WeightedLocation{{"fsn1", 1}, {"nbg1", 1}},
+				Labs:        LabCatalog{12: {ServerTypes: []string{"cax11"}}},
+			},
+		},
+		{
+			name: "snapshot skips the arm fallback",
+			cfg:  HCloudConfig{ServerTypes: []string{"cax11", "cx22"}, ImageID: "77", Locations: fsn1},
+		},
+		{
+			name: "unknown location and server type",
+			cfg:  HCloudConfig{ServerTypes: []string{"cx999", "cx22"}, ImageID: "ubuntu-24.04", Locations: []WeightedLocation{{"fsn1", 1}, {"ash9", 1}}},
+			problems: []string{
+				"location ash9 does not exist",
+				"default: server type cx999 does not exist",
+			},
+		},
+		{
+			name:     "server type not offered in the locations",
+			cfg:      HCloudConfig{ServerTypes: []string{"cax11"}, ImageID: "ubuntu-24.04", Locations: []WeightedLocation{{"nbg1", 1}}},
+			problems: []string{"default: server type cax11 is not offered in any of nbg1"},
+		},
+		{
+			name: "lab image fits none of its server types",
+			cfg: HCloudConfig{
+				ServerTypes: []string{"cx22"},
+				ImageID:     "ubuntu-24.04",
+				Locations:   fsn1,
+				Labs:        LabCatalog{12: {ServerTypes: []string{"cax11"}, Image: "77"}},
+			},
+			problems: []string{`lab 12: no server type can run image "77"`},
+		},
+		{
+			name:     "unknown image",
+			cfg:      HCloudConfig{ServerTypes: []string{"cx22"}, ImageID: "debian-99", Locations: fsn1},
+			problems: []string{`default: no server type can run image "debian-99"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := newFakeAPIConnector(t).ValidateConfig(context.Background(), &tt.cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("expected %d problems, got %q", len(tt.problems), problems)
+			}
+			for i, want := range tt.problems {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("expected problem %q, got %q", want, problems[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package hcloud
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+)
+
+const (
+	// windowsPasswordLength is long enough that the password can't be guessed over RDP
+	windowsPasswordLength = 20
+
+	windowsPasswordAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+)
+
+// validateOS checks the os of a lab catalog entry
+func validateOS(os string) error {
+	switch os {
+	case "", "linux", connector.OSWindows:
+		return nil
+	}
+	return fmt.Errorf("unknown os %q (supported: linux, windows)", os)
+}
+
+// windowsAdminPassword returns a random Administrator password. It always holds upper and
+// lower case letters and digits, as Windows' password complexity rules require, and no
+// characters that need quoting in a script.
+func windowsAdminPassword() (string, error) {
+	alphabetSize := big.NewInt(int64(len(windowsPasswordAlphabet)))
+	for {
+		b := make([]byte, windowsPasswordLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, alphabetSize)
+			if err != nil {
+				return "", fmt.Errorf("generate administrator password: %w", err)
+			}
+			b[i] = windowsPasswordAlphabet[n.Int64()]
+		}
+		password := string(b)
+		if strings.ContainsAny(password, "ABCDEFGHJKLMNPQRSTUVWXYZ") &&
+			strings.ContainsAny(password, "abcdefghijkmnopqrstuvwxyz") &&
+			strings.ContainsAny(password, "23456789") {
+			return password, nil
+		}
+	}
+}
+
+// windowsUserData returns user data that makes cloudbase-init, the Windows counterpart of
+// cloud-init, set the Administrator password on first boot
+func windowsUserData(password string) string {
+	return "#ps1_sysnative\nnet user Administrator '" + password + "'\n"
+}
@@ -0,0 +1,30 @@
+package hcloud
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWindowsAdminPassword(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		password, err := windowsAdminPassword()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(password) != windowsPasswordLength {
+			t.Errorf("expected %d characters, got %q", windowsPasswordLength, password)
+		}
+		if strings.Trim(password, windowsPasswordAlphabet) != "" {
+			t.Errorf("expected only characters of the alphabet, got %q", password)
+		}
+		if !strings.ContainsAny(password, "ABCDEFGHJKLMNPQRSTUVWXYZ") || !strings.ContainsAny(password, "abcdefghijkmnopqrstuvwxyz") ||
+			!strings.ContainsAny(password, "23456789") {
+			t.Errorf("expected upper and lower case letters and digits, got %q", password)
+		}
+		if seen[password] {
+			t.Errorf("password %q generated twice", password)
+		}
+		seen[password] = true
+	}
+}
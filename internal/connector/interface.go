@@ -1,16 +1,129 @@
 package connector
 
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Labels every SWIM-managed server carries, so bulk operations never touch other resources
+const (
+	LabelType        = "type"
+	LabelTypeLabHost = "ephymerical-lab-host"
+	LabelLabID       = "labid"
+	LabelTenant      = "tenant"     // set on servers of a named tenant only
+	LabelNodeGroup   = "node-group" // shared by the servers of one composite lab
+	LabelNode        = "node"       // node name of a server of a composite lab, e.g. "attacker"
+	LabelOS          = "os"         // set to OSWindows on Windows servers, absent on Linux ones
+	OSWindows        = "windows"
+
+	// LabelCorrelationID carries the correlation ID of the provision request, when it is a valid label value
+	LabelCorrelationID = "correlation-id"
+
+	// LabelProtected set to "true", by hand or through the lab catalog, keeps SWIM from deleting
+	// the server, e.g. a demo machine an admin stood up under the SWIM labels
+	LabelProtected = "protected"
+)
+
+// Protected reports whether server, or any node of a Group, is labelled LabelProtected=true
+func Protected(server Server) bool {
+	if group, ok := server.(*Group); ok {
+		for _, node := range group.nodes {
+			if Protected(node) {
+				return true
+			}
+		}
+		return false
+	}
+	return server.GetLabels()[LabelProtected] == "true"
+}
+
+// Connector manages servers at a cloud provider. Every call is bounded by ctx, and errors
+// the caller can act on carry an ErrorCode: lookups of missing servers return CodeNotFound.
 type Connector interface {
-	ListServers() ([]Server, error)
-	GetServerByID(id string) (Server, error)
-	CreateServer(payload string) (Server, error)
+	ListServers(ctx context.Context) ([]Server, error)
+	GetServerByID(ctx context.Context, id string) (Server, error)
+	GetServerByName(ctx context.Context, name string) (Server, error)
+	GetServersByLabel(ctx context.Context, key, value string) ([]Server, error)
+	CreateServer(ctx context.Context, payload string) (Server, error)
+	// MapState maps a status from Server.GetState to a SWIM status (config.StatusRunning,
+	// StatusProvisioning or StatusStopping) and whether the server accepts SSH connections
+	MapState(cloudState string) (status string, available bool)
+	// GetConsoleURL requests a time-limited remote console for the server with id, for
+	// when SSH access is broken
+	GetConsoleURL(ctx context.Context, id string) (*Console, error)
+}
+
+// FailureStates is implemented by connectors that know the provider statuses a server being
+// provisioned doesn't recover from, e.g. a server that was switched off or is being deleted
+type FailureStates interface {
+	// ProvisionFailed reports whether a server in cloudState, a status from Server.GetState,
+	// won't become available while it is being provisioned
+	ProvisionFailed(cloudState string) bool
+}
+
+// Starter is implemented by servers that can be powered on again, e.g. after a failed resize
+// left them switched off
+type Starter interface {
+	PowerOn(ctx context.Context) error // starts the server and waits for the provider to finish
+}
+
+// ProvisionFailed reports whether conn knows cloudState as a status a server being provisioned
+// doesn't recover from; false for connectors that don't implement FailureStates
+func ProvisionFailed(conn Connector, cloudState string) bool {
+	states, ok := conn.(FailureStates)
+	return ok && states.ProvisionFailed(cloudState)
+}
+
+// ServerTypes is implemented by connectors that know the server types each lab may run on
+type ServerTypes interface {
+	// LabServerTypes returns the server types the servers of labID may have, nil if any
+	LabServerTypes(labID int) []string
+}
+
+// AllowsServerType reports whether the servers of labID may have serverType; true for
+// connectors that don't implement ServerTypes
+func AllowsServerType(conn Connector, labID int, serverType string) bool {
+	types, ok := conn.(ServerTypes)
+	if !ok {
+		return true
+	}
+	allowed := types.LabServerTypes(labID)
+	return allowed == nil || slices.Contains(allowed, serverType)
+}
+
+// Console is a remote console session of a server
+type Console struct {
+	URL       string    `json:"url"`      // where a console client connects, e.g. a VNC websocket
+	Password  string    `json:"password"` // password of the session
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Usage is the average resource usage of a server over a period, as the provider reports it
+type Usage struct {
+	CPUPercent  float64 // CPU usage in percent
+	EgressBytes float64 // outgoing network traffic in bytes per second
+	Samples     int     // number of CPU samples the averages are taken over, 0 if none were reported
+}
+
+// CreateJournal records a server name before the server is created, so a server whose
+// creation failed half-way can still be found by name and cleaned up
+type CreateJournal interface {
+	RecordPendingCreate(name, tenant, webUserID string, labID int, correlationID string) error
+	ClearPendingCreate(name string) error
 }
 
 type Server interface {
 	GetID() string
 	GetName() string
 	GetIPv6Address() string
-	GetState() (string, error)
-	Delete() error
+	GetLabels() map[string]string
+	GetServerType() string
+	GetSSHHostKey() string
+	GetState(ctx context.Context) (string, error) // current provider status, e.g. "running"
+	Delete(ctx context.Context) error             // shuts the server down and deletes it; bounded by ctx
+	Rebuild(ctx context.Context) error            // reinstalls the server from its image, keeping its ID and addresses
+	// Resize changes the server to serverType, switching it off for the change and on again
+	Resize(ctx context.Context, serverType string) error
 	String() string
 }
@@ -0,0 +1,174 @@
+// Package credentials loads provider tokens and other secrets from the environment, files,
+// Redis or Vault, and keeps tokens current, so a rotated token is picked up without a restart.
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source loads the current value of a token
+type Source interface {
+	Load(ctx context.Context) (string, error)
+	String() string // describes the source for logs, without the token
+}
+
+// SecretReader reads secrets stored in Redis
+type SecretReader interface {
+	GetSecret(ctx context.Context, key string) (string, error)
+}
+
+type envSource struct {
+	name string
+}
+
+// Env reads the token from an environment variable. The environment of a running
+// process doesn't change, so this source never rotates.
+func Env(name string) Source {
+	return envSource{name: name}
+}
+
+func (s envSource) Load(ctx context.Context) (string, error) {
+	return os.Getenv(s.name), nil
+}
+
+func (s envSource) String() string {
+	return "environment variable " + s.name
+}
+
+type fileSource struct {
+	path string
+}
+
+// File reads the token from a file, e.g. a mounted Kubernetes secret that is updated in place.
+// Surrounding whitespace is ignored.
+func File(path string) Source {
+	return fileSource{path: path}
+}
+
+func (s fileSource) Load(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (s fileSource) String() string {
+	return "file " + s.path
+}
+
+type redisSource struct {
+	reader SecretReader
+	key    string
+}
+
+// RedisKey reads the token from a Redis string key
+func RedisKey(reader SecretReader, key string) Source {
+	return redisSource{reader: reader, key: key}
+}
+
+func (s redisSource) Load(ctx context.Context) (string, error) {
+	value, err := s.reader.GetSecret(ctx, s.key)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(value), nil
+}
+
+func (s redisSource) String() string {
+	return "redis key " + s.key
+}
+
+// FromEnv returns the secret in environment variable name, or the contents of the file named
+// by name+"_FILE" if that is set, so secrets can come from mounted files rather than the
+// environment, which ends up in process listings and crash dumps
+func FromEnv(name string) (string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read %s_FILE: %w", name, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return os.Getenv(name), nil
+}
+
+// Token holds the current value of a token and reloads it from its source
+type Token struct {
+	log    *slog.Logger
+	source Source
+
+	mu    sync.RWMutex
+	value string
+}
+
+// NewToken loads the token from source. An empty token is an error.
+func NewToken(ctx context.Context, log *slog.Logger, source Source) (*Token, error) {
+	value, err := load(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{log: log, source: source, value: value}, nil
+}
+
+// Value returns the current token
+func (t *Token) Value() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.value
+}
+
+// Refresh reloads the token and reports whether it changed. On error, or if the
+// source is empty, the current token is kept.
+func (t *Token) Refresh(ctx context.Context) (bool, error) {
+	value, err := load(ctx, t.source)
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if value == t.value {
+		return false, nil
+	}
+	t.value = value
+	if t.log != nil {
+		t.log.Info("token rotated", "source", t.source.String())
+	}
+	return true, nil
+}
+
+// Run reloads the token every interval until ctx is cancelled
+func (t *Token) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := t.Refresh(ctx); err != nil && t.log != nil {
+				t.log.Warn("failed to reload token, keeping the current one", "source", t.source.String(), "error", err)
+			}
+		}
+	}
+}
+
+// load reads a token from source, rejecting empty values
+func load(ctx context.Context, source Source) (string, error) {
+	value, err := source.Load(ctx)
+	if err != nil {
+		return "", fmt.Errorf("load token from %s: %w", source, err)
+	}
+	if value == "" {
+		return "", fmt.Errorf("token from %s is empty", source)
+	}
+	return value, nil
+}
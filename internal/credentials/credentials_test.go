@@ -0,0 +1,102 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeSecrets map[string]string
+
+func (f fakeSecrets) GetSecret(ctx context.Context, key string) (string, error) {
+	value, ok := f[key]
+	if !ok {
+		return "", errors.New("secret not found")
+	}
+	return value, nil
+}
+
+func TestSources(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("TEST_HCLOUD_TOKEN", "from-env")
+	if value, _ := Env("TEST_HCLOUD_TOKEN").Load(ctx); value != "from-env" {
+		t.Errorf("expected token from environment, got %q", value)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := File(path).Load(ctx); err != nil || value != "from-file" {
+		t.Errorf("expected trimmed token from file, got %q, %v", value, err)
+	}
+
+	secrets := fakeSecrets{"swim:hcloud-token": "from-redis"}
+	if value, err := RedisKey(secrets, "swim:hcloud-token").Load(ctx); err != nil || value != "from-redis" {
+		t.Errorf("expected token from redis, got %q, %v", value, err)
+	}
+	if _, err := RedisKey(secrets, "missing").Load(ctx); err == nil {
+		t.Error("expected error for a missing redis key")
+	}
+}
+
+func TestNewToken_Empty(t *testing.T) {
+	t.Setenv("TEST_HCLOUD_TOKEN", "")
+	_, err := NewToken(context.Background(), nil, Env("TEST_HCLOUD_TOKEN"))
+	if err == nil || !strings.Contains(err.Error(), "environment variable TEST_HCLOUD_TOKEN") {
+		t.Errorf("expected empty token error naming the source, got %v", err)
+	}
+}
+
+func TestToken_Refresh(t *testing.T) {
+	ctx := context.Background()
+	secrets := fakeSecrets{"token": "first"}
+	token, err := NewToken(ctx, nil, RedisKey(secrets, "token"))
+	if err != nil {
+		t.Fatalf("NewToken returned error: %v", err)
+	}
+
+	if changed, err := token.Refresh(ctx); changed || err != nil {
+		t.Errorf("expected no change, got %v, %v", changed, err)
+	}
+
+	secrets["token"] = "second"
+	if changed, err := token.Refresh(ctx); !changed || err != nil || token.Value() != "second" {
+		t.Errorf("expected rotation to second, got %v, %v, %q", changed, err, token.Value())
+	}
+
+	// A missing or empty token never replaces a working one
+	secrets["token"] = ""
+	if _, err := token.Refresh(ctx); err == nil || token.Value() != "second" {
+		t.Errorf("expected error and the current token kept, got %v, %q", err, token.Value())
+	}
+	delete(secrets, "token")
+	if _, err := token.Refresh(ctx); err == nil || token.Value() != "second" {
+		t.Errorf("expected error and the current token kept, got %v, %q", err, token.Value())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TEST_REDIS_PASSWORD", "from-env")
+	if value, err := FromEnv("TEST_REDIS_PASSWORD"); err != nil || value != "from-env" {
+		t.Errorf("expected secret from environment, got %q, %v", value, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_REDIS_PASSWORD_FILE", path)
+	if value, err := FromEnv("TEST_REDIS_PASSWORD"); err != nil || value != "from-file" {
+		t.Errorf("expected the file to take precedence, got %q, %v", value, err)
+	}
+
+	t.Setenv("TEST_REDIS_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := FromEnv("TEST_REDIS_PASSWORD"); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
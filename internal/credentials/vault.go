@@ -0,0 +1,108 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// VaultClient reads secrets from the HashiCorp Vault HTTP API
+type VaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// NewVaultClient creates a client for the Vault server at addr, authenticated with token.
+// Returns nil if addr is empty.
+func NewVaultClient(addr, token, namespace string, client *http.Client) *VaultClient {
+	if addr == "" {
+		return nil
+	}
+	return &VaultClient{addr: strings.TrimRight(addr, "/"), token: token, namespace: namespace, client: client}
+}
+
+// Secret reads one field of a secret. ref is "path#field", e.g. "secret/data/swim#hcloud_token".
+// Both KV version 1 and version 2 paths are supported.
+func (v *VaultClient) Secret(ctx context.Context, ref string) (string, error) {
+	if v == nil {
+		return "", fmt.Errorf("vault is not configured, set VAULT_ADDR")
+	}
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid vault reference %q (want path#field)", ref)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("read vault secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("read vault secret %s: unexpected status %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("parse vault secret %s: %w", path, err)
+	}
+
+	// KV version 2 nests the fields under data.data, next to data.metadata
+	data := body.Data
+	if nested, ok := data["data"]; ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nil
+			if err := json.Unmarshal(nested, &data); err != nil {
+				return "", fmt.Errorf("parse vault secret %s: %w", path, err)
+			}
+		}
+	}
+
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("vault secret %s field %s is not a string", path, field)
+	}
+	return value, nil
+}
+
+type vaultSource struct {
+	client *VaultClient
+	ref    string
+}
+
+// Vault reads the token from a field of a Vault secret, see VaultClient.Secret
+func Vault(client *VaultClient, ref string) Source {
+	return vaultSource{client: client, ref: ref}
+}
+
+func (s vaultSource) Load(ctx context.Context) (string, error) {
+	value, err := s.client.Secret(ctx, s.ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(value), nil
+}
+
+func (s vaultSource) String() string {
+	return "vault secret " + s.ref
+}
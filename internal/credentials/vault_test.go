@@ -0,0 +1,55 @@
+package credentials
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVaultClient_Secret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.Header.Get("X-Vault-Namespace") != "labs" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/swim":
+			w.Write([]byte(`{"data": {"data": {"hcloud_token": "kv2-token"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/swim":
+			w.Write([]byte(`{"data": {"hcloud_token": "kv1-token", "port": 22}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	vault := NewVaultClient(srv.URL+"/", "root", "labs", srv.Client())
+	if value, err := vault.Secret(ctx, "secret/data/swim#hcloud_token"); err != nil || value != "kv2-token" {
+		t.Errorf("expected KV v2 secret, got %q, %v", value, err)
+	}
+	if value, err := Vault(vault, "kv/swim#hcloud_token").Load(ctx); err != nil || value != "kv1-token" {
+		t.Errorf("expected KV v1 secret, got %q, %v", value, err)
+	}
+
+	for ref, want := range map[string]string{
+		"secret/data/swim":             "invalid vault reference",
+		"secret/data/swim#ssh_key":     "has no field ssh_key",
+		"kv/swim#port":                 "is not a string",
+		"secret/data/missing#anything": "404",
+	} {
+		if _, err := vault.Secret(ctx, ref); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error containing %q, got %v", ref, want, err)
+		}
+	}
+
+	if NewVaultClient("", "root", "", nil) != nil {
+		t.Error("expected nil client without an address")
+	}
+	var unconfigured *VaultClient
+	if _, err := Vault(unconfigured, "kv/swim#hcloud_token").Load(ctx); err == nil || !strings.Contains(err.Error(), "VAULT_ADDR") {
+		t.Errorf("expected error naming VAULT_ADDR, got %v", err)
+	}
+}
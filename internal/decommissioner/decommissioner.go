@@ -3,36 +3,281 @@ package decommissioner
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/archive"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/dns"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/hooks"
+	"github.com/alex-sviridov/swim/internal/inventory"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/override"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/retry"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/userhash"
+	"github.com/alex-sviridov/swim/internal/validate"
 )
 
+// labPageSize is the number of cache entries loaded at once when decommissioning a whole lab
+const labPageSize = 500
+
+// failureRecordTimeout bounds recording a failed deletion, which may run after shutdown
+// cancelled the deletion itself
+const failureRecordTimeout = 5 * time.Second
+
+// CloudStatusDeleteFailed is the cloud status cached with a failed status when a server could not
+// be deleted. The entry is due for the cleanup worker at once, which retries the deletion.
+const CloudStatusDeleteFailed = "delete_failed"
+
+// errProtected is returned instead of deleting a server labelled connector.LabelProtected
+var errProtected = errors.New("server is labelled protected")
+
+// errNotOwned is returned instead of deleting a server by ID that isn't a lab server of the requesting user
+var errNotOwned = errors.New("server does not belong to the user")
+
 // Decommissioner handles server decommissioning workflows
 type Decommissioner struct {
-	log         *slog.Logger
-	conn        connector.Connector
-	redisClient redis.ClientInterface
+	log           *slog.Logger
+	conn          connector.Connector
+	redisClient   redis.ClientInterface
+	async         bool
+	deleteTimeout time.Duration
+	dns           *dns.Registrar
+	hooks         *hooks.Runner
+	inventory     *inventory.Hook
+	events        redis.EventRecorder
+	history       redis.HistoryRecorder
+	tenants       *tenant.Registry
+	tombstones    redis.TombstoneStore
+	tombstoneTTL  time.Duration
+	notifier      *notify.Notifier
+	overrides     *override.Verifier
+	sequencer     redis.Sequencer
+	flags         *flags.Reader
+	archive       archive.Archiver
+	provider      string       // recorded in the session archive
+	redisRetry    retry.Policy // retries of the rate limit check
+	recheckRetry  retry.Policy // retries of server lookups and deletions the provider reports locked
+
+	// deleting tracks servers with a deletion in progress, keyed by server ID
+	mu        sync.Mutex
+	deleting  map[string]bool
+	deletions sync.WaitGroup
 }
 
 // New creates a new Decommissioner
 func New(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface) *Decommissioner {
 	return &Decommissioner{
-		log:         log,
-		conn:        conn,
-		redisClient: redisClient,
+		log:           log,
+		conn:          conn,
+		redisClient:   redisClient,
+		deleteTimeout: config.GetDeleteTimeout(),
+		redisRetry:    retry.Get(retry.RedisCall),
+		recheckRetry:  retry.Get(retry.DeleteRecheck),
+		deleting:      make(map[string]bool),
 	}
 }
 
+// WithDeleteTimeout bounds each provider delete (default: DELETE_TIMEOUT_SECONDS)
+func (d *Decommissioner) WithDeleteTimeout(timeout time.Duration) *Decommissioner {
+	d.deleteTimeout = timeout
+	return d
+}
+
+// WithAsyncDeletes makes cached servers be deleted in the background, so ProcessRequest
+// returns once the entry is marked "stopping". Use Wait to let running deletions finish.
+func (d *Decommissioner) WithAsyncDeletes() *Decommissioner {
+	d.async = true
+	return d
+}
+
+// WithDNS removes the hostname registered for a server once the server is deleted
+func (d *Decommissioner) WithDNS(registrar *dns.Registrar) *Decommissioner {
+	d.dns = registrar
+	return d
+}
+
+// WithHooks runs the "decommission" hooks before a cached server is deleted,
+// while it is still reachable
+func (d *Decommissioner) WithHooks(runner *hooks.Runner) *Decommissioner {
+	d.hooks = runner
+	return d
+}
+
+// WithInventory deregisters every server it deletes from the external inventory
+func (d *Decommissioner) WithInventory(hook *inventory.Hook) *Decommissioner {
+	d.inventory = hook
+	return d
+}
+
+// WithEvents records failed deletions and rate-limited requests for the status dashboard
+func (d *Decommissioner) WithEvents(recorder redis.EventRecorder) *Decommissioner {
+	d.events = recorder
+	return d
+}
+
+// WithHistory keeps completed and failed decommissions in the history of each user
+func (d *Decommissioner) WithHistory(recorder redis.HistoryRecorder) *Decommissioner {
+	d.history = recorder
+	return d
+}
+
+// WithTenants resolves the tenant of each request for its cache namespace and rate limit.
+// Without a registry only requests for the default tenant are accepted.
+func (d *Decommissioner) WithTenants(registry *tenant.Registry) *Decommissioner {
+	d.tenants = registry
+	return d
+}
+
+// WithTombstones records a tombstone for ttl after each cached server is deleted,
+// so an undo request can restore the lab
+func (d *Decommissioner) WithTombstones(store redis.TombstoneStore, ttl time.Duration) *Decommissioner {
+	d.tombstones = store
+	d.tombstoneTTL = ttl
+	return d
+}
+
+// WithOverrides lets requests whose admin override verifier grants skip the decommission
+// rate limit. Without a verifier admin overrides are refused.
+func (d *Decommissioner) WithOverrides(verifier *override.Verifier) *Decommissioner {
+	d.overrides = verifier
+	return d
+}
+
+// WithSequencer drops per-user requests whose sequence number a later provision or
+// decommission of the same user has overtaken. Requests without one are always served.
+func (d *Decommissioner) WithSequencer(sequencer redis.Sequencer) *Decommissioner {
+	d.sequencer = sequencer
+	return d
+}
+
+// WithNotifier alerts operators about protected servers that were kept instead of deleted
+func (d *Decommissioner) WithNotifier(notifier *notify.Notifier) *Decommissioner {
+	d.notifier = notifier
+	return d
+}
+
+// WithFlags reads runtime feature flags from reader, see TakesCleanup
+func (d *Decommissioner) WithFlags(reader *flags.Reader) *Decommissioner {
+	d.flags = reader
+	return d
+}
+
+// WithArchive keeps a session record of every server it deletes from the cache, naming
+// provider as the server's cloud provider
+func (d *Decommissioner) WithArchive(archiver archive.Archiver, provider string) *Decommissioner {
+	d.archive = archiver
+	d.provider = provider
+	return d
+}
+
+// TakesCleanup reports whether the decommissions of expired servers should be taken from
+// the cleanup queue: while fewer than limit deletions are in progress and the pause-cleanup
+// flag is off. Students' own decommissions are served regardless.
+func (d *Decommissioner) TakesCleanup(ctx context.Context, limit int) bool {
+	return d.InProgress() < limit && !d.flags.Enabled(ctx, flags.PauseCleanup)
+}
+
+// Wait blocks until every background deletion has finished
+func (d *Decommissioner) Wait() {
+	d.deletions.Wait()
+}
+
+// InProgress returns the number of servers currently being deleted
+func (d *Decommissioner) InProgress() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.deleting)
+}
+
 // DecommissionRequest represents a decommission request payload
 type DecommissionRequest struct {
 	WebUserID string `json:"webuserid"`
 	LabID     *int   `json:"labId,omitempty"`    // Optional: if provided, validates against cached labId to prevent stale requests
 	ServerID  string `json:"serverId,omitempty"` // Optional: if provided, allows deletion even when cache entry is missing
+
+	// Ops targeting: delete by server name and/or label selector instead of by user
+	ServerName    string            `json:"serverName,omitempty"`
+	LabelSelector map[string]string `json:"labelSelector,omitempty"`
+	AllUsers      bool              `json:"allUsers,omitempty"` // with labId: delete every user's server of that lab
+
+	Tenant string `json:"tenant,omitempty"` // Optional: course or organization the user belongs to
+
+	CorrelationID string `json:"correlationId,omitempty"` // Optional: traces the request through logs
+
+	// Set by SWIM on the decommission of the server a lab switch replaced, which the switch
+	// window covers instead of the stop window
+	Switch bool `json:"switch,omitempty"`
+
+	// Set by SWIM on the decommissions the cleanup worker and watchdog queue: why the server
+	// was due, e.g. "ttl", "idle" or "stuck". Recorded as the exit reason of the session.
+	Reason string `json:"reason,omitempty"`
+
+	// Optional: operation sequence number of the user, see redis.Sequencer
+	Seq int64 `json:"seq,omitempty"`
+
+	// Optional: instructor tooling skips the rate limit with a granted admin override
+	override.Fields
+}
+
+// validate rejects malformed fields before they reach cache keys, provider lookups and logs.
+// Only fields that are set are checked; which ones are required depends on the request kind.
+func (req *DecommissionRequest) validate() error {
+	errs := []error{
+		validate.CorrelationID(req.CorrelationID),
+		validate.Text("tenant", req.Tenant, validate.MaxLabelLength),
+		validate.Text("serverName", req.ServerName, validate.MaxLabelLength),
+		validate.Text("reason", req.Reason, validate.MaxLabelLength),
+		validate.Labels("labelSelector", req.LabelSelector),
+	}
+	if req.WebUserID != "" {
+		errs = append(errs, validate.WebUserID(req.WebUserID))
+	}
+	if req.LabID != nil {
+		errs = append(errs, validate.LabID(*req.LabID))
+	}
+	if req.ServerID != "" {
+		errs = append(errs, validate.ServerID(req.ServerID))
+	}
+	return validate.First(errs...)
+}
+
+// exitReason returns the exit reason recorded for the sessions the request ends
+func (req *DecommissionRequest) exitReason() string {
+	switch {
+	case req.Reason != "":
+		return req.Reason
+	case req.ServerName != "" || len(req.LabelSelector) > 0:
+		return redis.ExitOps
+	case req.AllUsers:
+		return redis.ExitLabReset
+	case req.Switch:
+		return redis.ExitSwitch
+	}
+	return redis.ExitUser
+}
+
+// exitReasonKey carries the exit reason of a request to the deletions it starts
+type exitReasonKey struct{}
+
+// exitReason returns the exit reason of the request ctx belongs to
+func exitReason(ctx context.Context) string {
+	if reason, ok := ctx.Value(exitReasonKey{}).(string); ok {
+		return reason
+	}
+	return redis.ExitUser
 }
 
 // ProcessRequest handles a single decommission request from the queue
@@ -43,52 +288,116 @@ func (d *Decommissioner) ProcessRequest(ctx context.Context, payload string) {
 		d.log.Error("failed to parse decommission payload", "error", err)
 		return
 	}
+	if err := req.validate(); err != nil {
+		d.log.Error("rejecting invalid decommission request", "error", err)
+		d.recordEvent(ctx, redis.Event{Type: redis.EventDecommissionFailed, Message: err.Error()})
+		return
+	}
+
+	ctx = tracing.WithCorrelationID(ctx, req.CorrelationID)
+	ctx = context.WithValue(ctx, exitReasonKey{}, req.exitReason())
+
+	t, err := d.tenants.Get(req.Tenant)
+	if err != nil {
+		d.logger(ctx).Error("rejecting decommission request", "webuserid", req.WebUserID, "error", err)
+		return
+	}
+	req.Tenant = t.ID
+
+	// Ops requests target servers directly and bypass the per-user flow
+	if req.ServerName != "" || len(req.LabelSelector) > 0 {
+		d.processTargetedRequest(ctx, req)
+		return
+	}
+	if req.AllUsers {
+		if req.LabID == nil {
+			d.logger(ctx).Error("labId is required in decommission request for all users")
+			return
+		}
+		d.processLabRequest(ctx, *req.LabID, req.Tenant)
+		return
+	}
 
 	// Validate required fields
 	if req.WebUserID == "" {
-		d.log.Error("webuserid is required in decommission request")
+		d.logger(ctx).Error("webuserid is required in decommission request")
 		return
 	}
 
 	if req.LabID != nil {
-		d.log.Info("processing decommission request with labId validation", "webuserid", req.WebUserID, "labid", *req.LabID)
+		d.logger(ctx).Info("processing decommission request with labId validation", "webuserid", req.WebUserID, "labid", *req.LabID)
 	} else {
-		d.log.Info("processing decommission request without labId", "webuserid", req.WebUserID)
+		d.logger(ctx).Info("processing decommission request without labId", "webuserid", req.WebUserID)
 	}
 
-	// Check rate limit with retry logic
-	rateLimitTTL := config.GetDecommissionRateLimitDuration()
-	allowed, err := d.tryAcquireRateLimitWithRetry(ctx, req.WebUserID, "decommission", rateLimitTTL)
-	if err != nil {
-		d.log.Error("failed to check rate limit after retries, dropping message", "webuserid", req.WebUserID, "error", err)
+	if !d.inSequence(ctx, req) {
 		return
 	}
+
+	// Check the stop window with retry logic, unless the request is part of a lab switch or
+	// an admin override skips it
+	allowed := req.Switch || d.overrideGranted(ctx, req)
+	if !allowed {
+		rateLimitTTL := t.DecommissionRateLimit()
+		allowed, err = d.tryAcquireRateLimitWithRetry(ctx, redis.TenantUserID(t.ID, req.WebUserID), redis.RateLimitStop, rateLimitTTL)
+		if err != nil {
+			d.logger(ctx).Error("failed to check rate limit after retries, dropping message", "webuserid", req.WebUserID, "error", err)
+			return
+		}
+	}
 	if !allowed {
+		event := redis.Event{Type: redis.EventRateLimited, WebUserID: req.WebUserID, Tenant: t.ID, ServerID: req.ServerID}
+		if req.LabID != nil {
+			event.LabID = *req.LabID
+		}
+		d.recordEvent(ctx, event)
 		if req.LabID != nil {
-			d.log.Warn("decommission rate limit hit, dropping message", "webuserid", req.WebUserID, "labid", *req.LabID)
+			d.logger(ctx).Warn("decommission rate limit hit, dropping message", "webuserid", req.WebUserID, "labid", *req.LabID)
 		} else {
-			d.log.Warn("decommission rate limit hit, dropping message", "webuserid", req.WebUserID)
+			d.logger(ctx).Warn("decommission rate limit hit, dropping message", "webuserid", req.WebUserID)
 		}
 		return
 	}
 
 	// Build cache key (note: labId is stored in the state, not the key)
-	cacheKey := redis.ServerCacheKey(req.WebUserID)
+	cacheKey := redis.ServerCacheKey(redis.TenantUserID(t.ID, req.WebUserID))
 
 	// Get server state from cache
 	serverState, err := d.redisClient.GetServerState(ctx, cacheKey)
+	if err != nil && !errors.Is(err, errs.ErrNotFound) {
+		// Redis failed, not a cache miss: falling back to the provider labels could delete the wrong server
+		d.logger(ctx).Error("failed to read server state, dropping message", "webuserid", req.WebUserID, "error", err)
+		d.recordEvent(ctx, redis.Event{Type: redis.EventDecommissionFailed, WebUserID: req.WebUserID, Tenant: t.ID,
+			ServerID: req.ServerID, Message: err.Error()})
+		return
+	}
 	if err != nil {
 		// Cache miss - check if we have serverID in the request payload
 		if req.ServerID != "" {
-			d.log.Info("server not found in cache but serverID provided in request, proceeding with deletion",
+			d.logger(ctx).Info("server not found in cache but serverID provided in request, proceeding with deletion",
 				"webuserid", req.WebUserID,
 				"server_id", req.ServerID)
 			// Delete directly using serverID from request
-			d.deleteServerByID(ctx, req.ServerID)
-			d.log.Info("decommission request completed (cache-less deletion)", "webuserid", req.WebUserID, "server_id", req.ServerID)
+			d.deleteServerByID(ctx, req, d.requestHostname(req))
+			d.logger(ctx).Info("decommission request completed (cache-less deletion)", "webuserid", req.WebUserID, "server_id", req.ServerID)
+			return
+		}
+		// No serverID either - fall back to the provider labels, but only to signed ones: a raw
+		// webuserid label proves nothing, anyone with provider access can set it
+		if userhash.SecretFromEnv() == "" {
+			d.logger(ctx).Warn("server not found in cache and no serverID provided, cannot proceed", "webuserid", req.WebUserID, "error", err)
+			return
+		}
+		deleted, listErr := d.deleteServersByUserLabel(ctx, req)
+		if listErr != nil {
+			d.logger(ctx).Error("server not found in cache and failed to look up servers by label", "webuserid", req.WebUserID, "error", listErr)
+			return
+		}
+		if deleted == 0 {
+			d.logger(ctx).Warn("server not found in cache or by label, cannot proceed", "webuserid", req.WebUserID, "error", err)
 			return
 		}
-		d.log.Warn("server not found in cache and no serverID provided, cannot proceed", "webuserid", req.WebUserID, "error", err)
+		d.logger(ctx).Info("decommission request completed (label lookup)", "webuserid", req.WebUserID, "deleted", deleted)
 		return
 	}
 
@@ -97,16 +406,16 @@ func (d *Decommissioner) ProcessRequest(ctx context.Context, payload string) {
 		// LabID mismatch - this means cache was replaced by new provision
 		// If we have serverID in request, use cache-less deletion for the old server
 		if req.ServerID != "" {
-			d.log.Info("labId mismatch but serverID provided, using cache-less deletion for old server",
+			d.logger(ctx).Info("labId mismatch but serverID provided, using cache-less deletion for old server",
 				"webuserid", req.WebUserID,
 				"requested_labid", *req.LabID,
 				"current_labid", serverState.LabID,
 				"server_id", req.ServerID)
-			d.deleteServerByID(ctx, req.ServerID)
-			d.log.Info("decommission request completed (cache-less deletion due to labId mismatch)", "webuserid", req.WebUserID, "server_id", req.ServerID)
+			d.deleteServerByID(ctx, req, d.requestHostname(req))
+			d.logger(ctx).Info("decommission request completed (cache-less deletion due to labId mismatch)", "webuserid", req.WebUserID, "server_id", req.ServerID)
 			return
 		}
-		d.log.Warn("labId mismatch, ignoring stale decommission request",
+		d.logger(ctx).Warn("labId mismatch, ignoring stale decommission request",
 			"webuserid", req.WebUserID,
 			"requested_labid", *req.LabID,
 			"current_labid", serverState.LabID)
@@ -117,99 +426,863 @@ func (d *Decommissioner) ProcessRequest(ctx context.Context, payload string) {
 	d.deleteServer(ctx, cacheKey, *serverState)
 
 	if req.LabID != nil {
-		d.log.Info("decommission request completed", "webuserid", req.WebUserID, "labid", *req.LabID)
+		d.logger(ctx).Info("decommission request completed", "webuserid", req.WebUserID, "labid", *req.LabID)
 	} else {
-		d.log.Info("decommission request completed", "webuserid", req.WebUserID, "labid", serverState.LabID)
+		d.logger(ctx).Info("decommission request completed", "webuserid", req.WebUserID, "labid", serverState.LabID)
 	}
 }
 
-// deleteServer deletes a single server and removes from cache
+// logger returns the decommissioner logger tagged with the request's correlation ID
+func (d *Decommissioner) logger(ctx context.Context) *slog.Logger {
+	return tracing.Logger(ctx, d.log)
+}
+
+// deleteServer deletes a single server and removes from cache.
+// The cache entry moves through "stopping" and "deleting" before it is removed.
 func (d *Decommissioner) deleteServer(ctx context.Context, cacheKey string, serverState redis.ServerState) {
-	serverLog := d.log.With("server_id", serverState.ServerID, "address", serverState.Address)
+	serverLog := d.logger(ctx).With("server_id", serverState.ServerID, "address", serverState.Address)
+
+	// A failed entry has no provision in progress, so without a server there is nothing left to delete
+	if serverState.ServerID == "" && serverState.Status == config.StatusFailed {
+		d.finishDeletion(ctx, cacheKey, serverState)
+		return
+	}
+
+	// Repeated requests (e.g. from the cleanup worker) must not start a second deletion
+	if !d.trackDeletion(serverState.ServerID) {
+		serverLog.Info("deletion already in progress, skipping")
+		return
+	}
 
 	// Update status to "stopping"
-	serverState.Status = config.StatusStopping
-	serverState.Available = false
-	serverState.CloudStatus = "stopping"
-	if err := d.redisClient.PushServerState(ctx, cacheKey, serverState, config.ServerCacheTTL); err != nil {
+	if err := d.markStatus(ctx, cacheKey, &serverState, config.StatusStopping, "stopping"); err != nil {
+		if errors.Is(err, lifecycle.ErrSuperseded) {
+			serverLog.Warn("cache entry replaced by another lab before decommission, skipping")
+			d.untrackDeletion(serverState.ServerID)
+			return
+		}
 		serverLog.Error("failed to update server status to stopping", "error", err)
 	}
 
+	if !d.async {
+		d.runDeletion(ctx, cacheKey, serverState)
+		return
+	}
+
+	d.deletions.Add(1)
+	go func() {
+		defer d.deletions.Done()
+		d.runDeletion(ctx, cacheKey, serverState)
+	}()
+	serverLog.Info("server deletion continues in the background")
+}
+
+// deleteAtProvider deletes server at the provider, giving up after the delete timeout or once ctx is done,
+// and deregisters it from the inventory. A protected server is reported and kept, returning errProtected.
+func (d *Decommissioner) deleteAtProvider(ctx context.Context, server connector.Server) error {
+	if connector.Protected(server) {
+		d.refuseProtected(ctx, server)
+		return errProtected
+	}
+	deleteCtx, cancel := context.WithTimeout(ctx, d.deleteTimeout)
+	defer cancel()
+	if err := server.Delete(deleteCtx); err != nil {
+		return err
+	}
+	d.inventory.Deregister(server)
+	return nil
+}
+
+// runDeletion deletes the server at the provider and removes its cache entry. If the server
+// can't be looked up or deleted, even after rechecking, the entry is marked failed for the
+// cleanup worker instead of being left in "stopping" or "deleting".
+func (d *Decommissioner) runDeletion(ctx context.Context, cacheKey string, serverState redis.ServerState) {
+	defer d.untrackDeletion(serverState.ServerID)
+	serverLog := d.logger(ctx).With("server_id", serverState.ServerID, "address", serverState.Address)
+
+	if serverState.ServerID == "" {
+		// The provisioner deletes the server it is creating once it finds the entry stopping
+		serverLog.Warn("server not created yet, leaving its deletion to the provisioner")
+		return
+	}
+
 	// Get server from connector using the ServerID
-	server, err := d.conn.GetServerByID(serverState.ServerID)
+	server, err := d.lookupServer(ctx, serverState.ServerID)
+	if err != nil && !errors.Is(err, errs.ErrNotFound) {
+		// The provider failed, the server may still exist: keep the entry for the cleanup worker
+		serverLog.Error("failed to get server for decommissioning", "error", err)
+		d.recordDeleteFailure(ctx, serverState.Tenant, serverState.WebUserID, serverState.LabID, serverState.ServerID, err)
+		d.markDeleteFailed(ctx, cacheKey, serverState)
+		return
+	}
 	if err != nil {
-		serverLog.Warn("failed to get server for decommissioning (may already be deleted)", "error", err)
-		// Remove from cache if server not found (already deleted)
-		if err := d.redisClient.DeleteServerState(ctx, cacheKey); err != nil {
-			serverLog.Error("failed to remove non-existent server from cache", "error", err)
-		} else {
-			serverLog.Info("removed non-existent server from cache")
+		serverLog.Warn("server to decommission not found, already deleted", "error", err)
+		if err := d.deleteLeftoverNodes(ctx, serverState); err != nil {
+			serverLog.Error("failed to delete remaining nodes of lab", "error", err)
+			d.recordDeleteFailure(ctx, serverState.Tenant, serverState.WebUserID, serverState.LabID, serverState.ServerID, err)
+			d.markDeleteFailed(ctx, cacheKey, serverState)
+			return
 		}
+		d.finishDeletion(ctx, cacheKey, serverState)
 		return
 	}
 
+	// Decide before the hooks run, the server stays in use
+	if connector.Protected(server) {
+		d.refuseProtected(ctx, server)
+		d.releaseProtected(ctx, cacheKey, serverState)
+		return
+	}
+
+	d.runDecommissionHooks(ctx, serverState)
+
+	// Update status to "deleting" while the provider shuts the server down and deletes it
+	if err := d.markStatus(ctx, cacheKey, &serverState, config.StatusDeleting, "deleting"); err != nil {
+		if errors.Is(err, lifecycle.ErrSuperseded) {
+			serverLog.Warn("cache entry replaced by another lab during decommission, deleting server only")
+			if err := d.deleteUntilGone(ctx, server); err != nil {
+				if !errors.Is(err, errProtected) {
+					serverLog.Error("failed to delete server", "error", err)
+					d.recordDeleteFailure(ctx, serverState.Tenant, serverState.WebUserID, serverState.LabID, serverState.ServerID, err)
+				}
+				return
+			}
+			d.unregisterDNS(ctx, d.hostname(serverState))
+			d.recordDecommissioned(ctx, serverState)
+			return
+		}
+		serverLog.Error("failed to update server status to deleting", "error", err)
+	}
+
 	// Delete the server
-	if err := server.Delete(); err != nil {
+	if err := d.deleteUntilGone(ctx, server); err != nil {
+		if errors.Is(err, errProtected) {
+			// Labelled while the deletion was retried
+			d.releaseProtected(ctx, cacheKey, serverState)
+			return
+		}
 		serverLog.Error("failed to delete server", "error", err)
+		d.recordDeleteFailure(ctx, serverState.Tenant, serverState.WebUserID, serverState.LabID, serverState.ServerID, err)
+		d.markDeleteFailed(ctx, cacheKey, serverState)
+		return
+	}
+	d.finishDeletion(ctx, cacheKey, serverState)
+	d.recordTombstone(ctx, serverState)
+}
+
+// deleteLeftoverNodes deletes the nodes of a composite lab whose primary node is gone already,
+// e.g. deleted by hand from the provider console. Nodes that are gone too count as deleted.
+func (d *Decommissioner) deleteLeftoverNodes(ctx context.Context, serverState redis.ServerState) error {
+	for name, node := range serverState.Nodes {
+		if node.ServerID == serverState.ServerID {
+			continue
+		}
+		server, err := d.lookupServer(ctx, node.ServerID)
+		if errors.Is(err, errs.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("node %s: %w", name, err)
+		}
+		if err := d.deleteUntilGone(ctx, server); err != nil && !errors.Is(err, errProtected) {
+			return fmt.Errorf("node %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lookupServer gets the server to delete, retrying under the delete-recheck policy while
+// the provider reports it locked or rate limited
+func (d *Decommissioner) lookupServer(ctx context.Context, serverID string) (connector.Server, error) {
+	var server connector.Server
+	err := d.recheck(ctx, serverID, "lookup", func() (err error) {
+		server, err = d.conn.GetServerByID(ctx, serverID)
+		return err
+	})
+	return server, err
+}
+
+// deleteUntilGone deletes server at the provider, retrying under the delete-recheck policy
+// while the provider reports it locked or rate limited. Each retry looks the server up again,
+// so a server deleted by hand in the meantime, e.g. from the provider console, counts as
+// deleted rather than failed.
+func (d *Decommissioner) deleteUntilGone(ctx context.Context, server connector.Server) error {
+	serverID := server.GetID()
+	attempt := 0
+	err := d.recheck(ctx, serverID, "delete", func() error {
+		attempt++
+		if attempt > 1 {
+			fresh, err := d.conn.GetServerByID(ctx, serverID)
+			if err != nil {
+				return err
+			}
+			server = fresh
+		}
+		return d.deleteAtProvider(ctx, server)
+	})
+	if errors.Is(err, errs.ErrNotFound) {
+		d.logger(ctx).Info("server vanished during deletion, treating it as deleted", "server_id", serverID, "error", err)
+		d.inventory.Deregister(server)
+		return nil
+	}
+	return err
+}
+
+// recheck calls op under the delete-recheck policy while it fails with a transient error,
+// such as a locked server or a provider rate limit
+func (d *Decommissioner) recheck(ctx context.Context, serverID string, action string, op func() error) error {
+	return d.recheckRetry.Do(ctx, op, func(err error) bool {
+		return errors.Is(err, errs.ErrTransient)
+	}, func(attempt int, delay time.Duration, err error) {
+		d.logger(ctx).Warn("provider busy, rechecking server "+action,
+			"server_id", serverID,
+			"attempt", attempt,
+			"max_attempts", d.recheckRetry.MaxAttempts,
+			"retry_delay", delay,
+			"error", err)
+	})
+}
+
+// finishDeletion removes DNS and the cache entry of a server that is gone at the provider.
+// It re-reads the entry first, so finishing the same deletion twice is harmless and an entry
+// a newer provision wrote for another server is kept, along with its DNS record.
+func (d *Decommissioner) finishDeletion(ctx context.Context, cacheKey string, serverState redis.ServerState) {
+	serverLog := d.logger(ctx).With("server_id", serverState.ServerID, "address", serverState.Address)
+
+	current, err := d.redisClient.GetServerState(ctx, cacheKey)
+	switch {
+	case errors.Is(err, errs.ErrNotFound):
+		d.unregisterDNS(ctx, d.hostname(serverState))
+		d.recordDecommissioned(ctx, serverState)
+		serverLog.Info("server decommissioned, cache entry already removed")
+		return
+	case err != nil:
+		// The entry expires on its own; the cleanup worker then finds the server gone
+		serverLog.Error("failed to read server state after deletion", "error", err)
+		return
+	case current.ServerID != serverState.ServerID:
+		serverLog.Warn("cache entry replaced by another server during decommission, keeping it", "current_server_id", current.ServerID)
 		return
 	}
 
-	// Remove from Redis cache after successful deletion
+	d.unregisterDNS(ctx, d.hostname(serverState))
 	if err := d.redisClient.DeleteServerState(ctx, cacheKey); err != nil {
 		serverLog.Error("failed to remove server from cache after deletion", "error", err)
-	} else {
-		serverLog.Info("server decommissioned and removed from cache")
+		return
+	}
+	d.recordDecommissioned(ctx, serverState)
+	serverLog.Info("server decommissioned and removed from cache")
+}
+
+// releaseProtected removes the cache entry of a protected server that was kept, so its user
+// can provision again and the cleanup worker doesn't queue the deletion on every run. The
+// server and its DNS record are left to the operators. An entry that now belongs to another
+// server is left alone.
+func (d *Decommissioner) releaseProtected(ctx context.Context, cacheKey string, serverState redis.ServerState) {
+	serverLog := d.logger(ctx).With("server_id", serverState.ServerID)
+
+	current, err := d.redisClient.GetServerState(ctx, cacheKey)
+	if err != nil {
+		if !errors.Is(err, errs.ErrNotFound) {
+			serverLog.Error("failed to read state of protected server", "error", err)
+		}
+		return
+	}
+	if current.ServerID != serverState.ServerID {
+		return
+	}
+	if err := d.redisClient.DeleteServerState(ctx, cacheKey); err != nil {
+		serverLog.Error("failed to remove protected server from cache", "error", err)
+		return
+	}
+	serverLog.Info("protected server kept and removed from cache")
+}
+
+// refuseProtected reports a deletion refused because server is labelled protected
+func (d *Decommissioner) refuseProtected(ctx context.Context, server connector.Server) {
+	d.logger(ctx).Warn("server is labelled protected, refusing to delete it",
+		"server_id", server.GetID(),
+		"server_name", server.GetName())
+	d.notify(ctx, notify.Notification{
+		Event: notify.EventProtectedServer,
+		Title: "Protected server kept",
+		Message: fmt.Sprintf("server %s (%s) is labelled %s=true and was not deleted; remove the label to let SWIM delete it",
+			server.GetID(), server.GetName(), connector.LabelProtected),
+	})
+}
+
+// notify alerts operators. Notifications are best-effort, so a failure is only logged.
+func (d *Decommissioner) notify(ctx context.Context, notification notify.Notification) {
+	if d.notifier == nil {
+		return
+	}
+	if err := d.notifier.Notify(ctx, notification); err != nil {
+		d.logger(ctx).Warn("failed to send notification", "event", notification.Event, "error", err)
+	}
+}
+
+// markDeleteFailed marks the entry of a server that could not be deleted as failed and due
+// for the cleanup worker, which queues the deletion again on its next run. An entry that
+// now belongs to another server is left alone.
+func (d *Decommissioner) markDeleteFailed(ctx context.Context, cacheKey string, serverState redis.ServerState) {
+	ctx, cancel := detached(ctx)
+	defer cancel()
+	serverID := serverState.ServerID
+	_, err := lifecycle.Transition(ctx, d.redisClient, cacheKey, config.StatusFailed, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != serverID {
+			return lifecycle.ErrSuperseded
+		}
+		fresh.Available = false
+		fresh.CloudStatus = CloudStatusDeleteFailed
+		fresh.ExpiresAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		d.logger(ctx).Warn("failed to mark server deletion as failed", "server_id", serverID, "error", err)
+	}
+}
+
+// recordTombstone remembers a lab the user deleted for the undo window. Labs deleted for any
+// other reason, e.g. expiry, a lab switch or an ops request, can't be undone: restoring them
+// would outlive their session limit or replace the lab running now. Undo is best-effort,
+// so a failure is only logged.
+func (d *Decommissioner) recordTombstone(ctx context.Context, serverState redis.ServerState) {
+	if d.tombstones == nil || exitReason(ctx) != redis.ExitUser {
+		return
+	}
+	tombstone := redis.Tombstone{
+		WebUserID:     serverState.WebUserID,
+		LabID:         serverState.LabID,
+		Tenant:        serverState.Tenant,
+		ServerID:      serverState.ServerID,
+		CorrelationID: serverState.CorrelationID,
+		DeletedAt:     time.Now().UTC(),
+	}
+	if err := d.tombstones.PushTombstone(ctx, tombstone, d.tombstoneTTL); err != nil {
+		d.logger(ctx).Warn("failed to record tombstone", "server_id", serverState.ServerID, "error", err)
+	}
+}
+
+// runDecommissionHooks tells integrations that a server is about to be deleted.
+// Hooks are best-effort, so a failure is only logged and the deletion goes ahead.
+func (d *Decommissioner) runDecommissionHooks(ctx context.Context, serverState redis.ServerState) {
+	if d.hooks == nil {
+		return
+	}
+	if err := d.hooks.Run(ctx, hooks.EventDecommission, serverState); err != nil {
+		d.logger(ctx).Warn("decommission hook failed", "server_id", serverState.ServerID, "error", err)
+	}
+}
+
+// recordDeleteFailure keeps a failed server deletion for the status dashboard
+func (d *Decommissioner) recordDeleteFailure(ctx context.Context, tenantID, webUserID string, labID int, serverID string, err error) {
+	ctx, cancel := detached(ctx)
+	defer cancel()
+	d.recordEvent(ctx, redis.Event{Type: redis.EventDecommissionFailed, WebUserID: webUserID, Tenant: tenantID,
+		LabID: labID, ServerID: serverID, Message: err.Error()})
+}
+
+// detached returns a context for recording the outcome of a deletion that lives on after ctx
+// is cancelled, e.g. by shutdown, so an interrupted deletion is still recorded as failed
+func detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), failureRecordTimeout)
+}
+
+// recordDecommissioned keeps a completed decommission in the user's history and the session archive
+func (d *Decommissioner) recordDecommissioned(ctx context.Context, serverState redis.ServerState) {
+	d.recordHistory(ctx, redis.Event{Type: redis.EventDecommissioned, WebUserID: serverState.WebUserID,
+		Tenant: serverState.Tenant, LabID: serverState.LabID, ServerID: serverState.ServerID})
+	d.archiveSession(ctx, serverState)
+}
+
+// archiveSession keeps the record of the session of a deleted server. The archive is for
+// analytics, so a failure is only logged.
+func (d *Decommissioner) archiveSession(ctx context.Context, serverState redis.ServerState) {
+	// An entry whose server was never created had no session
+	if d.archive == nil || serverState.ServerID == "" {
+		return
+	}
+	record := archive.Record(serverState, d.provider, exitReason(ctx), time.Now().UTC())
+	if err := d.archive.Archive(ctx, record); err != nil {
+		d.logger(ctx).Warn("failed to archive session", "server_id", serverState.ServerID, "error", err)
+	}
+}
+
+// recordEvent keeps an event for the status dashboard and the user's history. Events are
+// informational, so a failure is only logged.
+func (d *Decommissioner) recordEvent(ctx context.Context, event redis.Event) {
+	d.recordHistory(ctx, event)
+	if d.events == nil {
+		return
+	}
+	event.Operation = "decommission"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := d.events.RecordEvent(ctx, event); err != nil {
+		d.logger(ctx).Warn("failed to record event", "type", event.Type, "error", err)
+	}
+}
+
+// recordHistory keeps an event in the history of its user, if it names one.
+// History is informational, so a failure is only logged.
+func (d *Decommissioner) recordHistory(ctx context.Context, event redis.Event) {
+	if d.history == nil || event.WebUserID == "" {
+		return
+	}
+	event.Operation = "decommission"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := d.history.RecordHistory(ctx, redis.TenantUserID(event.Tenant, event.WebUserID), event); err != nil {
+		d.logger(ctx).Warn("failed to record history", "type", event.Type, "error", err)
+	}
+}
+
+// hostname returns the DNS name registered for a cached server
+func (d *Decommissioner) hostname(serverState redis.ServerState) string {
+	if serverState.Hostname != "" || d.dns == nil || serverState.WebUserID == "" {
+		return serverState.Hostname
 	}
+	return d.dns.Hostname(serverState.WebUserID, serverState.LabID)
 }
 
-// deleteServerByID deletes a server by its ID without using cache
-// This is used when cache entry is missing but we have serverID from the decommission request
-func (d *Decommissioner) deleteServerByID(ctx context.Context, serverID string) {
-	serverLog := d.log.With("server_id", serverID)
+// requestHostname returns the DNS name of the lab a request names, or "" without a labId
+func (d *Decommissioner) requestHostname(req DecommissionRequest) string {
+	if d.dns == nil || req.LabID == nil {
+		return ""
+	}
+	return d.dns.Hostname(req.WebUserID, *req.LabID)
+}
+
+// unregisterDNS removes a deleted server's hostname, if DNS registration is enabled
+func (d *Decommissioner) unregisterDNS(ctx context.Context, hostname string) {
+	if d.dns == nil || hostname == "" {
+		return
+	}
+	if err := d.dns.Unregister(ctx, hostname); err != nil {
+		d.logger(ctx).Warn("failed to remove dns record", "hostname", hostname, "error", err)
+		return
+	}
+	d.logger(ctx).Info("dns record removed", "hostname", hostname)
+}
+
+// trackDeletion records that serverID is being deleted.
+// Returns false if a deletion for it is already in progress.
+func (d *Decommissioner) trackDeletion(serverID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.deleting[serverID] {
+		return false
+	}
+	d.deleting[serverID] = true
+	return true
+}
+
+// untrackDeletion forgets a finished deletion
+func (d *Decommissioner) untrackDeletion(serverID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.deleting, serverID)
+}
+
+// markStatus writes a decommission status for serverState. If the poller or another writer
+// changed the entry since it was read, the status is re-applied to the fresh entry and
+// serverState is refreshed. Returns lifecycle.ErrSuperseded if the entry now holds another lab,
+// or a lifecycle.ErrIllegalTransition error if its status can't move to status.
+func (d *Decommissioner) markStatus(ctx context.Context, cacheKey string, serverState *redis.ServerState, status string, cloudStatus string) error {
+	if err := lifecycle.Check(serverState.Status, status); err != nil {
+		return err
+	}
+	serverState.Status = status
+	serverState.Available = false
+	serverState.CloudStatus = cloudStatus
+
+	err := d.redisClient.PushServerState(ctx, cacheKey, *serverState, config.ServerCacheTTL)
+	if !errors.Is(err, redis.ErrVersionConflict) {
+		return err
+	}
+
+	labID := serverState.LabID
+	updated, err := lifecycle.Transition(ctx, d.redisClient, cacheKey, status, func(fresh *redis.ServerState) error {
+		if fresh.LabID != labID {
+			return lifecycle.ErrSuperseded
+		}
+		fresh.Available = false
+		fresh.CloudStatus = cloudStatus
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	*serverState = *updated
+	return nil
+}
+
+// deleteServerByID deletes the server req.ServerID names without using cache
+// This is used when cache entry is missing but we have serverID from the decommission request.
+// Only a lab server labelled with the request's user is deleted.
+func (d *Decommissioner) deleteServerByID(ctx context.Context, req DecommissionRequest, hostname string) {
+	serverID := req.ServerID
+	serverLog := d.logger(ctx).With("server_id", serverID)
 
 	// Get server from connector using the ServerID
-	server, err := d.conn.GetServerByID(serverID)
+	server, err := d.conn.GetServerByID(ctx, serverID)
 	if err != nil {
 		serverLog.Warn("failed to get server for decommissioning (may already be deleted)", "error", err)
 		return
 	}
 
+	// Nothing in the cache vouches for the ID, so the server's own labels must
+	if err := ownedBy(server, req); err != nil {
+		serverLog.Error("refusing cache-less deletion", "webuserid", req.WebUserID, "error", err)
+		d.recordDeleteFailure(ctx, req.Tenant, req.WebUserID, 0, serverID, err)
+		return
+	}
+
 	// Delete the server
-	if err := server.Delete(); err != nil {
-		serverLog.Error("failed to delete server", "error", err)
+	if err := d.deleteAtProvider(ctx, server); err != nil {
+		if !errors.Is(err, errProtected) {
+			serverLog.Error("failed to delete server", "error", err)
+			d.recordDeleteFailure(ctx, req.Tenant, req.WebUserID, 0, serverID, err)
+		}
 		return
 	}
 
 	serverLog.Info("server decommissioned successfully (cache-less deletion)")
+	d.unregisterDNS(ctx, hostname)
 }
 
-// tryAcquireRateLimitWithRetry attempts to acquire rate limit with retry logic
-// Returns (true, nil) if rate limit acquired successfully
-// Returns (false, nil) if rate limited (another request within TTL window)
-// Returns (false, error) if all retries exhausted with Redis errors
-func (d *Decommissioner) tryAcquireRateLimitWithRetry(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
-	var lastErr error
+// ownedBy returns an errNotOwned error unless server is a lab server labelled with the user,
+// tenant and, if set, lab of req. The user label may be the raw web user ID or its hash, so
+// servers created before LABEL_USER_HMAC_SECRET was set or changed still match.
+func ownedBy(server connector.Server, req DecommissionRequest) error {
+	labels := server.GetLabels()
+	if labels[connector.LabelType] != connector.LabelTypeLabHost {
+		return fmt.Errorf("%w: not a lab server", errNotOwned)
+	}
+	secret := userhash.SecretFromEnv()
+	if labels[userhash.LabelWebUserID] != req.WebUserID &&
+		(secret == "" || labels[userhash.LabelWebUserHash] != userhash.Hash(secret, req.WebUserID)) {
+		return fmt.Errorf("%w: labelled with another user", errNotOwned)
+	}
+	if labels[connector.LabelTenant] != req.Tenant {
+		return fmt.Errorf("%w: labelled with another tenant", errNotOwned)
+	}
+	if req.LabID != nil && labels[connector.LabelLabID] != strconv.Itoa(*req.LabID) {
+		return fmt.Errorf("%w: labelled with another lab", errNotOwned)
+	}
+	return nil
+}
+
+// deleteServersByUserLabel deletes the servers labelled with the HMAC of the request's user,
+// restricted to the requested lab if labId is set. Returns the number of servers deleted.
+// Must only be called with LABEL_USER_HMAC_SECRET set.
+func (d *Decommissioner) deleteServersByUserLabel(ctx context.Context, req DecommissionRequest) (int, error) {
+	servers, err := d.conn.GetServersByLabel(ctx, userhash.LabelWebUserHash, userhash.Hash(userhash.SecretFromEnv(), req.WebUserID))
+	if err != nil {
+		return 0, fmt.Errorf("get servers by label: %w", err)
+	}
+
+	deleted := 0
+	for _, server := range servers {
+		labels := server.GetLabels()
+		if labels[connector.LabelType] != connector.LabelTypeLabHost {
+			continue
+		}
+		if req.LabID != nil && labels[connector.LabelLabID] != strconv.Itoa(*req.LabID) {
+			continue
+		}
+		if labels[connector.LabelTenant] != req.Tenant {
+			continue
+		}
 
-	for attempt := 1; attempt <= config.CacheReadRetryAttempts; attempt++ {
-		allowed, err := d.redisClient.TryAcquireRateLimit(ctx, webUserID, operation, ttl)
-		if err == nil {
-			// Success - return whether rate limit was acquired
-			return allowed, nil
+		serverLog := d.logger(ctx).With("server_id", server.GetID(), "server_name", server.GetName())
+		err := d.deleteAtProvider(ctx, server)
+		if errors.Is(err, errProtected) {
+			continue
+		}
+		if err != nil {
+			serverLog.Error("failed to delete server found by label", "error", err)
+			d.recordDeleteFailure(ctx, req.Tenant, req.WebUserID, 0, server.GetID(), err)
+			continue
 		}
+		serverLog.Info("server decommissioned successfully (label lookup)")
+		if labID, err := strconv.Atoi(labels[connector.LabelLabID]); err == nil && d.dns != nil {
+			d.unregisterDNS(ctx, d.dns.Hostname(req.WebUserID, labID))
+		}
+		deleted++
+	}
 
-		// It's a real error (Redis connection issue, etc.)
-		lastErr = err
-		d.log.Warn("failed to check rate limit, retrying",
-			"attempt", attempt,
-			"max_attempts", config.CacheReadRetryAttempts,
-			"error", err)
+	return deleted, nil
+}
+
+// processTargetedRequest deletes the servers matched by serverName and/or labelSelector
+// and drops the cache entries that pointed at them. Only SWIM-managed servers are touched.
+func (d *Decommissioner) processTargetedRequest(ctx context.Context, req DecommissionRequest) {
+	targetLog := d.logger(ctx).With("server_name", req.ServerName, "label_selector", req.LabelSelector)
 
-		// Don't sleep after the last attempt
-		if attempt < config.CacheReadRetryAttempts {
-			time.Sleep(config.CacheReadRetryTimeout)
+	servers, err := d.findTargetServers(ctx, req)
+	if err != nil {
+		targetLog.Error("failed to look up servers for decommission", "error", err)
+		return
+	}
+	if len(servers) == 0 {
+		targetLog.Warn("no managed servers matched decommission request")
+		return
+	}
+
+	deletedIDs := make(map[string]bool)
+	for _, server := range servers {
+		serverLog := targetLog.With("server_id", server.GetID())
+		err := d.deleteAtProvider(ctx, server)
+		if errors.Is(err, errProtected) {
+			continue
+		}
+		if err != nil {
+			serverLog.Error("failed to delete server", "error", err)
+			d.recordDeleteFailure(ctx, "", "", 0, server.GetID(), err)
+			continue
+		}
+		serverLog.Info("server decommissioned successfully (targeted)")
+		deletedIDs[server.GetID()] = true
+	}
+
+	d.removeCacheEntries(ctx, deletedIDs)
+
+	targetLog.Info("decommission request completed (targeted)", "matched", len(servers), "deleted", len(deletedIDs))
+}
+
+// processLabRequest decommissions every server of a lab across all users, e.g. to reset
+// a class after a broken lab image. Cached servers go through the regular deletion flow;
+// managed servers of the lab without a cache entry are deleted afterwards.
+// A tenant restricts the request to its users; without one every tenant's lab is reset.
+func (d *Decommissioner) processLabRequest(ctx context.Context, labID int, tenantID string) {
+	labLog := d.logger(ctx).With("labid", labID, "tenant", tenantID)
+	labLog.Info("processing decommission request for all users of lab")
+
+	// Servers handled through the cache, so the provider sweep leaves them alone
+	handled := make(map[string]bool)
+	cached := 0
+	filter := redis.StateFilter{LabID: labID, Tenant: tenantID, Limit: labPageSize}
+	for {
+		page, err := d.redisClient.QueryServerStates(ctx, filter)
+		if err != nil {
+			labLog.Error("failed to load server states of lab", "error", err)
+			return
+		}
+		for _, state := range page.States {
+			if state.ServerID == "" {
+				// Still being created; the provider sweep below catches the server if it exists by now
+				continue
+			}
+			handled[state.ServerID] = true
+			d.deleteServer(ctx, state.CacheKey(), state)
+			cached++
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	swept, err := d.deleteUncachedLabServers(ctx, labID, tenantID, handled)
+	if err != nil {
+		labLog.Error("failed to look up servers of lab by label", "error", err)
+	}
+
+	labLog.Info("decommission request completed (all users)", "cached", cached, "uncached_deleted", swept)
+}
+
+// deleteUncachedLabServers deletes the managed servers labelled with labID, and with tenantID
+// if set, whose ID is not in skip. Returns the number of servers deleted.
+func (d *Decommissioner) deleteUncachedLabServers(ctx context.Context, labID int, tenantID string, skip map[string]bool) (int, error) {
+	servers, err := d.conn.GetServersByLabel(ctx, connector.LabelLabID, strconv.Itoa(labID))
+	if err != nil {
+		return 0, fmt.Errorf("get servers by label: %w", err)
+	}
+
+	deleted := 0
+	for _, server := range servers {
+		labels := server.GetLabels()
+		if labels[connector.LabelType] != connector.LabelTypeLabHost || skip[server.GetID()] {
+			continue
+		}
+		if tenantID != "" && labels[connector.LabelTenant] != tenantID {
+			continue
+		}
+		if !d.trackDeletion(server.GetID()) {
+			continue
+		}
+
+		serverLog := d.logger(ctx).With("server_id", server.GetID(), "server_name", server.GetName())
+		err := d.deleteAtProvider(ctx, server)
+		d.untrackDeletion(server.GetID())
+		if errors.Is(err, errProtected) {
+			continue
+		}
+		if err != nil {
+			serverLog.Error("failed to delete uncached server of lab", "error", err)
+			d.recordDeleteFailure(ctx, tenantID, labels[userhash.LabelWebUserID], labID, server.GetID(), err)
+			continue
+		}
+		serverLog.Info("server decommissioned successfully (lab sweep)")
+		if webUserID := labels[userhash.LabelWebUserID]; webUserID != "" && d.dns != nil {
+			d.unregisterDNS(ctx, d.dns.Hostname(webUserID, labID))
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// findTargetServers resolves a targeted request to the managed servers matching every given criterion
+func (d *Decommissioner) findTargetServers(ctx context.Context, req DecommissionRequest) ([]connector.Server, error) {
+	var candidates []connector.Server
+
+	if req.ServerName != "" {
+		server, err := d.conn.GetServerByName(ctx, req.ServerName)
+		if errors.Is(err, errs.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get server by name: %w", err)
+		}
+		candidates = []connector.Server{server}
+	} else {
+		// Let the provider filter by one pair, check the rest locally
+		keys := make([]string, 0, len(req.LabelSelector))
+		for key := range req.LabelSelector {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		servers, err := d.conn.GetServersByLabel(ctx, keys[0], req.LabelSelector[keys[0]])
+		if err != nil {
+			return nil, fmt.Errorf("get servers by label: %w", err)
+		}
+		candidates = servers
+	}
+
+	var matched []connector.Server
+	for _, server := range candidates {
+		labels := server.GetLabels()
+		if labels[connector.LabelType] != connector.LabelTypeLabHost {
+			continue
 		}
+		if !matchesSelector(labels, req.LabelSelector) {
+			continue
+		}
+		matched = append(matched, server)
+	}
+	return matched, nil
+}
+
+// matchesSelector reports whether labels contain every key/value pair of selector
+func matchesSelector(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// removeCacheEntries deletes the cache entries whose serverId is in serverIDs
+func (d *Decommissioner) removeCacheEntries(ctx context.Context, serverIDs map[string]bool) {
+	if len(serverIDs) == 0 {
+		return
 	}
 
-	// All retries exhausted
-	return false, fmt.Errorf("failed to check rate limit after %d attempts: %w", config.CacheReadRetryAttempts, lastErr)
+	states, err := d.redisClient.GetAllServerStates(ctx, config.ServerCachePrefix)
+	if err != nil {
+		d.logger(ctx).Error("failed to load server states for cache cleanup", "error", err)
+		return
+	}
+
+	var cacheKeys []string
+	var removed []redis.ServerState
+	for _, state := range states {
+		if serverIDs[state.ServerID] {
+			cacheKeys = append(cacheKeys, state.CacheKey())
+			removed = append(removed, state)
+		}
+	}
+
+	if err := d.redisClient.DeleteServerStates(ctx, cacheKeys); err != nil {
+		d.logger(ctx).Error("failed to remove decommissioned servers from cache", "error", err)
+		return
+	}
+	for _, state := range removed {
+		d.archiveSession(ctx, state)
+	}
+	if len(cacheKeys) > 0 {
+		d.logger(ctx).Info("removed decommissioned servers from cache", "count", len(cacheKeys))
+	}
+}
+
+// inSequence reports whether the request should be served, false if a later request of the
+// user has overtaken its sequence number or the number couldn't be checked
+func (d *Decommissioner) inSequence(ctx context.Context, req DecommissionRequest) bool {
+	if d.sequencer == nil || req.Seq <= 0 {
+		return true
+	}
+	applied, last, err := d.sequencer.ApplySequence(ctx, redis.TenantUserID(req.Tenant, req.WebUserID), req.Seq)
+	if err != nil {
+		d.logger(ctx).Error("failed to check sequence number, dropping message", "webuserid", req.WebUserID, "seq", req.Seq, "error", err)
+		return false
+	}
+	if !applied {
+		d.logger(ctx).Warn("dropping out-of-order decommission request", "webuserid", req.WebUserID, "seq", req.Seq, "applied_seq", last)
+		event := redis.Event{Type: redis.EventOutOfOrder, WebUserID: req.WebUserID, Tenant: req.Tenant, ServerID: req.ServerID,
+			Message: fmt.Sprintf("sequence %d overtaken by %d", req.Seq, last)}
+		if req.LabID != nil {
+			event.LabID = *req.LabID
+		}
+		d.recordEvent(ctx, event)
+		return false
+	}
+	return true
+}
+
+// overrideGranted reports whether the admin override of a user's request is granted. The
+// override is recorded either way; a refused one leaves the request under the usual limits.
+func (d *Decommissioner) overrideGranted(ctx context.Context, req DecommissionRequest) bool {
+	event := redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: req.Tenant, ServerID: req.ServerID}
+	if req.LabID != nil {
+		event.LabID = *req.LabID
+	}
+	granted, err := d.overrides.Check(override.OperationDecommission, req.WebUserID, event.LabID, req.Fields)
+	if err != nil {
+		d.logger(ctx).Warn("refusing admin override", "webuserid", req.WebUserID, "admin_actor", req.Actor, "error", err)
+		event.Message = fmt.Sprintf("override by %q refused: %v", req.Actor, err)
+		d.recordEvent(ctx, event)
+		return false
+	}
+	if granted {
+		d.logger(ctx).Info("admin override granted, skipping rate limit", "webuserid", req.WebUserID, "admin_actor", req.Actor)
+		event.Message = fmt.Sprintf("override by %q", req.Actor)
+		d.recordEvent(ctx, event)
+	}
+	return granted
+}
+
+// tryAcquireRateLimitWithRetry attempts to acquire rate limit under the redis-call retry policy
+// Returns (true, nil) if rate limit acquired successfully
+// Returns (false, nil) if rate limited (another request within TTL window)
+// Returns (false, error) if all retries exhausted with Redis errors
+func (d *Decommissioner) tryAcquireRateLimitWithRetry(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
+	var allowed bool
+	err := d.redisRetry.Do(ctx, func() (err error) {
+		allowed, err = d.redisClient.TryAcquireRateLimit(ctx, webUserID, operation, ttl)
+		return err
+	}, nil, func(attempt int, delay time.Duration, err error) {
+		d.logger(ctx).Warn("failed to check rate limit, retrying",
+			"attempt", attempt,
+			"max_attempts", d.redisRetry.MaxAttempts,
+			"retry_delay", delay,
+			"error", err)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check rate limit after %d attempts: %w", d.redisRetry.MaxAttempts, err)
+	}
+	return allowed, nil
 }
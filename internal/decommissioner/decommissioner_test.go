@@ -6,12 +6,29 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/dns"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/hooks"
+	"github.com/alex-sviridov/swim/internal/inventory"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/override"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+	"github.com/alex-sviridov/swim/internal/retry"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/userhash"
 )
 
 // mockConnectorServer implements the connector.Server interface for testing.
@@ -20,8 +37,18 @@ type mockConnectorServer struct {
 	name        string // Added to satisfy connector.Server interface
 	ipv6        string // Added to satisfy connector.Server interface
 	state       string // Added to satisfy connector.Server interface
+	labels      map[string]string
 	deleteErr   error
 	deleteCalls int
+	// deleteStarted and deleteRelease, when set, let a test hold Delete mid-flight
+	deleteStarted chan struct{}
+	deleteRelease chan struct{}
+	// deleteBlocks makes Delete wait until its context is done, like a hung provider call
+	deleteBlocks bool
+	// deleteFailures, when set, limits deleteErr to the first calls of Delete
+	deleteFailures int
+	// onDelete, when set, runs on each call of Delete, e.g. to remove the server by hand
+	onDelete func()
 }
 
 func (m *mockConnectorServer) GetID() string {
@@ -38,8 +65,23 @@ func (m *mockConnectorServer) GetIPv6Address() string {
 	return m.ipv6
 }
 
+// GetLabels implements connector.Server.GetLabels
+func (m *mockConnectorServer) GetLabels() map[string]string {
+	return m.labels
+}
+
+// GetServerType implements connector.Server.GetServerType
+func (m *mockConnectorServer) GetServerType() string {
+	return ""
+}
+
+// GetSSHHostKey implements connector.Server.GetSSHHostKey
+func (m *mockConnectorServer) GetSSHHostKey() string {
+	return ""
+}
+
 // GetState implements connector.Server.GetState
-func (m *mockConnectorServer) GetState() (string, error) {
+func (m *mockConnectorServer) GetState(ctx context.Context) (string, error) {
 	return m.state, nil // Simple mock state
 }
 
@@ -48,11 +90,29 @@ func (m *mockConnectorServer) String() string {
 	return "MockServer{id=" + m.id + ", name=" + m.name + ", ipv6=" + m.ipv6 + ", state=" + m.state + "}"
 }
 
-func (m *mockConnectorServer) Delete() error {
+func (m *mockConnectorServer) Delete(ctx context.Context) error {
 	m.deleteCalls++
+	if m.deleteStarted != nil {
+		close(m.deleteStarted)
+		<-m.deleteRelease
+	}
+	if m.onDelete != nil {
+		m.onDelete()
+	}
+	if m.deleteBlocks {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if m.deleteFailures > 0 && m.deleteCalls > m.deleteFailures {
+		return nil
+	}
 	return m.deleteErr
 }
 
+func (m *mockConnectorServer) Rebuild(ctx context.Context) error { return nil }
+
+func (m *mockConnectorServer) Resize(ctx context.Context, serverType string) error { return nil }
+
 // mockConnector implements the connector.Connector interface for testing.
 type mockConnector struct {
 	servers   map[string]*mockConnectorServer
@@ -68,7 +128,7 @@ func newMockConnector() *mockConnector {
 	}
 }
 
-func (m *mockConnector) GetServerByID(id string) (connector.Server, error) {
+func (m *mockConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
 	m.getCalls[id]++
 	m.lastGetID = id
 	if m.getErr != nil {
@@ -76,13 +136,13 @@ func (m *mockConnector) GetServerByID(id string) (connector.Server, error) {
 	}
 	server, ok := m.servers[id]
 	if !ok {
-		return nil, errors.New("server not found")
+		return nil, connector.NotFound("server %s not found", id)
 	}
 	return server, nil
 }
 
 // CreateServer implements connector.Connector.CreateServer
-func (m *mockConnector) CreateServer(payload string) (connector.Server, error) {
+func (m *mockConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
 	// For decommissioning tests, we typically don't call CreateServer,
 	// but it needs to be implemented to satisfy the interface.
 	// We can return a dummy server or an error if we want to explicitly test
@@ -92,8 +152,29 @@ func (m *mockConnector) CreateServer(payload string) (connector.Server, error) {
 	return server, nil
 }
 
+// GetServerByName implements connector.Connector.GetServerByName
+func (m *mockConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	for _, s := range m.servers {
+		if s.name == name {
+			return s, nil
+		}
+	}
+	return nil, connector.NotFound("server %s not found", name)
+}
+
+// GetServersByLabel implements connector.Connector.GetServersByLabel
+func (m *mockConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	servers := make([]connector.Server, 0)
+	for _, s := range m.servers {
+		if s.labels[key] == value {
+			servers = append(servers, s)
+		}
+	}
+	return servers, nil
+}
+
 // ListServers implements connector.Connector.ListServers
-func (m *mockConnector) ListServers() ([]connector.Server, error) {
+func (m *mockConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
 	servers := make([]connector.Server, 0, len(m.servers))
 	for _, s := range m.servers {
 		servers = append(servers, s)
@@ -101,6 +182,16 @@ func (m *mockConnector) ListServers() ([]connector.Server, error) {
 	return servers, nil
 }
 
+// GetConsoleURL implements connector.Connector.GetConsoleURL
+func (m *mockConnector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return nil, errors.New("not implemented")
+}
+
+// MapState implements connector.Connector.MapState
+func (m *mockConnector) MapState(cloudState string) (string, bool) {
+	return cloudState, cloudState == "running"
+}
+
 func (m *mockConnector) addServer(id string, deleteErr error) *mockConnectorServer {
 	server := &mockConnectorServer{
 		id:        id,
@@ -121,6 +212,7 @@ type mockRedisClient struct {
 	deleteErr    error
 	pushedStates map[string]redis.ServerState
 	deletedKeys  []string
+	rateLimited  bool
 }
 
 func newMockRedisClient() *mockRedisClient {
@@ -136,7 +228,7 @@ func (m *mockRedisClient) GetServerState(ctx context.Context, key string) (*redi
 	}
 	state, ok := m.states[key]
 	if !ok {
-		return nil, errors.New("not found")
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
 	}
 	return &state, nil
 }
@@ -164,6 +256,30 @@ func (m *mockRedisClient) PushPayload(ctx context.Context, key string, payload s
 	return nil
 }
 
+// PushPayloads implements redis.ClientInterface.PushPayloads
+func (m *mockRedisClient) PushPayloads(ctx context.Context, key string, payloads []string) error {
+	return nil
+}
+
+// PushServerStates implements redis.ClientInterface.PushServerStates
+func (m *mockRedisClient) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	for key, state := range states {
+		if err := m.PushServerState(ctx, key, state, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteServerStates implements redis.ClientInterface.DeleteServerStates
+func (m *mockRedisClient) DeleteServerStates(ctx context.Context, keys []string) error {
+	if m.deleteErr != nil {
+		return m.deleteErr
+	}
+	m.deletedKeys = append(m.deletedKeys, keys...)
+	return nil
+}
+
 // PopPayload implements redis.ClientInterface.PopPayload
 func (m *mockRedisClient) PopPayload(ctx context.Context, key string, timeout time.Duration) (string, error) {
 	// This method is not directly used by the Decommissioner's ProcessRequest,
@@ -171,6 +287,11 @@ func (m *mockRedisClient) PopPayload(ctx context.Context, key string, timeout ti
 	return "", nil
 }
 
+// PopAnyPayload implements redis.ClientInterface.PopAnyPayload
+func (m *mockRedisClient) PopAnyPayload(ctx context.Context, keys []string, timeout time.Duration) (string, string, error) {
+	return "", "", nil
+}
+
 // GetAllServerStates implements redis.ClientInterface.GetAllServerStates
 func (m *mockRedisClient) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
 	states := make([]redis.ServerState, 0, len(m.states))
@@ -180,9 +301,47 @@ func (m *mockRedisClient) GetAllServerStates(ctx context.Context, prefix string)
 	return states, nil
 }
 
+// GetExpiredServerStates implements redis.ClientInterface.GetExpiredServerStates
+func (m *mockRedisClient) GetExpiredServerStates(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+	states := make([]redis.ServerState, 0, len(m.states))
+	for _, s := range m.states {
+		if !s.ExpiresAt.After(now) {
+			states = append(states, s)
+		}
+	}
+	return states, nil
+}
+
+// QueryServerStates implements redis.ClientInterface.QueryServerStates
+func (m *mockRedisClient) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	page := &redis.StatePage{}
+	for _, s := range m.states {
+		if filter.Matches(s) {
+			page.States = append(page.States, s)
+		}
+	}
+	return page, nil
+}
+
+// PushUserHash implements redis.ClientInterface.PushUserHash
+func (m *mockRedisClient) PushUserHash(ctx context.Context, hash string, webUserID string, ttl time.Duration) error {
+	return nil
+}
+
+// GetUserByHash implements redis.ClientInterface.GetUserByHash
+func (m *mockRedisClient) GetUserByHash(ctx context.Context, hash string) (string, error) {
+	return "", errors.New("user hash not found")
+}
+
 func (m *mockRedisClient) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
 	// Allow by default in tests (not rate limited)
-	return true, nil
+	return !m.rateLimited, nil
+}
+
+// AdmitProvision implements redis.ClientInterface.AdmitProvision
+func (m *mockRedisClient) AdmitProvision(ctx context.Context, key string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	// Provision admission is not used by the Decommissioner.
+	return &redis.AdmissionResult{Decision: redis.AdmissionAccepted}, nil
 }
 
 // Close implements redis.ClientInterface.Close
@@ -224,7 +383,7 @@ func TestProcessRequest(t *testing.T) {
 			expectDeleteCall:   true,
 			expectRedisDelete:  true,
 			expectRedisPush:    true,
-			expectedPushStatus: config.StatusStopping,
+			expectedPushStatus: config.StatusDeleting,
 		},
 		{
 			name:               "happy path without labId",
@@ -234,7 +393,7 @@ func TestProcessRequest(t *testing.T) {
 			expectDeleteCall:   true,
 			expectRedisDelete:  true,
 			expectRedisPush:    true,
-			expectedPushStatus: config.StatusStopping,
+			expectedPushStatus: config.StatusDeleting,
 		},
 		{
 			name:              "labId mismatch should ignore request",
@@ -272,7 +431,7 @@ func TestProcessRequest(t *testing.T) {
 			expectDeleteCall:   true,
 			expectRedisDelete:  false, // Should not delete from cache if provider fails
 			expectRedisPush:    true,
-			expectedPushStatus: config.StatusStopping,
+			expectedPushStatus: config.StatusFailed, // due for the cleanup worker
 		},
 		{
 			name:              "invalid json payload",
@@ -303,7 +462,7 @@ func TestProcessRequest(t *testing.T) {
 			expectDeleteCall:   true,
 			expectRedisDelete:  true,
 			expectRedisPush:    true, // Push is attempted
-			expectedPushStatus: config.StatusStopping,
+			expectedPushStatus: config.StatusDeleting,
 		},
 		{
 			name:    "redis delete fails after provider delete",
@@ -316,7 +475,7 @@ func TestProcessRequest(t *testing.T) {
 			expectDeleteCall:   true,
 			expectRedisDelete:  false, // Delete is attempted but fails
 			expectRedisPush:    true,
-			expectedPushStatus: config.StatusStopping,
+			expectedPushStatus: config.StatusDeleting,
 		},
 		{
 			name:    "cache-less deletion with serverID in payload",
@@ -325,8 +484,9 @@ func TestProcessRequest(t *testing.T) {
 				// No state in cache - simulates cache entry being replaced
 			},
 			setupConnector: func(c *mockConnector) {
-				// But server exists in cloud provider
-				c.addServer("orphaned-server-999", nil)
+				// But server exists in cloud provider, labelled with the user
+				c.addServer("orphaned-server-999", nil).labels = map[string]string{
+					connector.LabelType: connector.LabelTypeLabHost, userhash.LabelWebUserID: "user-xyz"}
 			},
 			expectDeleteCall:  true,
 			expectRedisDelete: false, // No cache entry to delete
@@ -433,3 +593,1061 @@ func TestProcessRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessRequest_AsyncDelete(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	cacheKey := redis.ServerCacheKey("user-abc")
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(cacheKey, redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", Status: config.StatusRunning})
+
+	mockConn := newMockConnector()
+	server := mockConn.addServer("server-123", nil)
+	server.deleteStarted = make(chan struct{})
+	server.deleteRelease = make(chan struct{})
+
+	decomm := New(log, mockConn, mockRedis).WithAsyncDeletes()
+	decomm.ProcessRequest(ctx, `{"webuserid":"user-abc"}`)
+
+	// ProcessRequest returns while the provider deletion is still running
+	<-server.deleteStarted
+	if got := mockRedis.pushedStates[cacheKey].Status; got != config.StatusDeleting {
+		t.Errorf("expected status %q during deletion, got %q", config.StatusDeleting, got)
+	}
+	if decomm.InProgress() != 1 {
+		t.Errorf("expected 1 deletion in progress, got %d", decomm.InProgress())
+	}
+
+	// A repeated request must not start a second deletion
+	decomm.ProcessRequest(ctx, `{"webuserid":"user-abc"}`)
+
+	close(server.deleteRelease)
+	decomm.Wait()
+
+	if server.deleteCalls != 1 {
+		t.Errorf("expected 1 delete call, got %d", server.deleteCalls)
+	}
+	if len(mockRedis.deletedKeys) != 1 || mockRedis.deletedKeys[0] != cacheKey {
+		t.Errorf("expected cache entry to be removed, got %v", mockRedis.deletedKeys)
+	}
+	if decomm.InProgress() != 0 {
+		t.Errorf("expected no deletions in progress, got %d", decomm.InProgress())
+	}
+}
+
+func TestProcessRequest_AsyncDeleteCancelled(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	cacheKey := redis.ServerCacheKey("user-abc")
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(cacheKey, redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", Status: config.StatusRunning})
+
+	mockConn := newMockConnector()
+	server := mockConn.addServer("server-123", nil)
+	server.deleteStarted = make(chan struct{})
+	server.deleteRelease = make(chan struct{})
+	server.deleteBlocks = true
+	events := &recordingEvents{}
+
+	decomm := New(log, mockConn, mockRedis).WithAsyncDeletes().WithEvents(events)
+	decomm.ProcessRequest(ctx, `{"webuserid":"user-abc"}`)
+
+	// Shutdown cancels the service context while the provider deletion is running
+	<-server.deleteStarted
+	cancel()
+	close(server.deleteRelease)
+	decomm.Wait()
+
+	state := mockRedis.pushedStates[cacheKey]
+	if state.Status != config.StatusFailed || state.CloudStatus != CloudStatusDeleteFailed {
+		t.Errorf("expected the interrupted deletion to be marked failed, got status %q (%q)", state.Status, state.CloudStatus)
+	}
+	if len(events.events) != 1 || events.events[0].Type != redis.EventDecommissionFailed {
+		t.Errorf("expected the interrupted deletion to be recorded, got %v", events.events)
+	}
+}
+
+func TestTakesCleanup(t *testing.T) {
+	ctx := context.Background()
+	store := redistest.New()
+	decomm := New(slog.New(slog.NewTextHandler(io.Discard, nil)), newMockConnector(), newMockRedisClient()).
+		WithFlags(flags.New(slog.New(slog.NewTextHandler(io.Discard, nil)), store))
+
+	if !decomm.TakesCleanup(ctx, 1) {
+		t.Error("expected the cleanup queue to be taken from below the limit")
+	}
+	if decomm.TakesCleanup(ctx, 0) {
+		t.Error("expected the cleanup queue to be held back at the limit")
+	}
+
+	store.SetFlag(flags.PauseCleanup, "on")
+	paused := New(slog.New(slog.NewTextHandler(io.Discard, nil)), newMockConnector(), newMockRedisClient()).
+		WithFlags(flags.New(slog.New(slog.NewTextHandler(io.Discard, nil)), store))
+	if paused.TakesCleanup(ctx, 1) {
+		t.Error("expected the cleanup queue to be held back while cleanup is paused")
+	}
+}
+
+func TestProcessRequest_ProviderLookupError(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cacheKey := redis.ServerCacheKey("user-abc")
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(cacheKey, redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", Status: config.StatusRunning})
+	mockConn := newMockConnector()
+	mockConn.getErr = connector.NewError(connector.CodeRateLimited, errors.New("rate limit exceeded"))
+	events := &recordingEvents{}
+
+	decomm := New(log, mockConn, mockRedis).WithEvents(events)
+	decomm.recheckRetry = retry.Policy{MaxAttempts: 3}
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+
+	// Only a server the provider reports missing is dropped from the cache
+	if len(mockRedis.deletedKeys) != 0 {
+		t.Errorf("expected cache entry to be kept when the provider fails, got %v", mockRedis.deletedKeys)
+	}
+	if mockConn.getCalls["server-123"] != 3 {
+		t.Errorf("expected the rate limited lookup to be rechecked, got %d calls", mockConn.getCalls["server-123"])
+	}
+	if state := mockRedis.pushedStates[cacheKey]; state.Status != config.StatusFailed || state.CloudStatus != CloudStatusDeleteFailed {
+		t.Errorf("expected the entry to be marked failed, got %+v", state)
+	}
+	if len(events.events) != 1 || events.events[0].Type != redis.EventDecommissionFailed {
+		t.Errorf("expected one decommission failure event, got %+v", events.events)
+	}
+}
+
+func TestProcessRequest_RechecksLockedServer(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cacheKey := redis.ServerCacheKey("user-abc")
+	locked := connector.NewError(connector.CodeLocked, errors.New("server is locked"))
+
+	tests := []struct {
+		name        string
+		setup       func(conn *mockConnector, cache *mockRedisClient, server *mockConnectorServer)
+		deleteCalls int
+		removed     bool // whether the cache entry was removed
+		failed      bool // whether the cache entry was marked failed
+	}{
+		{
+			name: "unlocked on retry",
+			setup: func(conn *mockConnector, cache *mockRedisClient, server *mockConnectorServer) {
+				server.deleteErr = locked
+				server.deleteFailures = 1
+			},
+			deleteCalls: 2,
+			removed:     true,
+		},
+		{
+			name: "deleted by hand while locked",
+			setup: func(conn *mockConnector, cache *mockRedisClient, server *mockConnectorServer) {
+				server.deleteErr = locked
+				server.onDelete = func() { delete(conn.servers, server.id) }
+			},
+			deleteCalls: 1,
+			removed:     true,
+		},
+		{
+			name: "vanished during delete",
+			setup: func(conn *mockConnector, cache *mockRedisClient, server *mockConnectorServer) {
+				server.deleteErr = connector.NotFound("server %s not found", server.id)
+			},
+			deleteCalls: 1,
+			removed:     true,
+		},
+		{
+			name: "entry replaced during delete",
+			setup: func(conn *mockConnector, cache *mockRedisClient, server *mockConnectorServer) {
+				server.onDelete = func() {
+					cache.addState(cacheKey, redis.ServerState{ServerID: "server-456", WebUserID: "user-abc", LabID: 5, Status: config.StatusProvisioning})
+				}
+			},
+			deleteCalls: 1,
+		},
+		{
+			name: "stays locked",
+			setup: func(conn *mockConnector, cache *mockRedisClient, server *mockConnectorServer) {
+				server.deleteErr = locked
+			},
+			deleteCalls: 3,
+			failed:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRedis := newMockRedisClient()
+			mockRedis.addState(cacheKey, redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5, Status: config.StatusRunning})
+			mockConn := newMockConnector()
+			server := mockConn.addServer("server-123", nil)
+			tt.setup(mockConn, mockRedis, server)
+
+			decomm := New(log, mockConn, mockRedis)
+			decomm.recheckRetry = retry.Policy{MaxAttempts: 3}
+			decomm.ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+
+			if server.deleteCalls != tt.deleteCalls {
+				t.Errorf("expected %d delete calls, got %d", tt.deleteCalls, server.deleteCalls)
+			}
+			if removed := len(mockRedis.deletedKeys) == 1; removed != tt.removed {
+				t.Errorf("expected removed=%v, got deleted keys %v", tt.removed, mockRedis.deletedKeys)
+			}
+			state := mockRedis.pushedStates[cacheKey]
+			if failed := state.Status == config.StatusFailed; failed != tt.failed {
+				t.Fatalf("expected failed=%v, got %+v", tt.failed, state)
+			}
+			if tt.failed && (state.CloudStatus != CloudStatusDeleteFailed || time.Until(state.ExpiresAt) > 0) {
+				t.Errorf("expected a failed entry due for cleanup, got %+v", state)
+			}
+		})
+	}
+}
+
+func TestProcessRequest_CacheReadError(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mockRedis := newMockRedisClient()
+	mockRedis.getErr = errs.Mark(errors.New("i/o timeout"), errs.ErrTransient)
+	mockConn := newMockConnector()
+	server := mockConn.addServer("server-1", nil)
+	server.labels = map[string]string{connector.LabelType: connector.LabelTypeLabHost, userhash.LabelWebUserID: "user-abc"}
+	events := &recordingEvents{}
+
+	New(log, mockConn, mockRedis).WithEvents(events).ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+
+	// A Redis failure is not a cache miss, so the label fallback must not run
+	if server.deleteCalls != 0 {
+		t.Error("expected no deletion when the cache can't be read")
+	}
+	if len(events.events) != 1 || events.events[0].Type != redis.EventDecommissionFailed {
+		t.Errorf("expected one decommission failure event, got %+v", events.events)
+	}
+}
+
+func TestProcessRequest_CacheLessOwnership(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	lab := func(extra map[string]string) map[string]string {
+		labels := map[string]string{connector.LabelType: connector.LabelTypeLabHost}
+		maps.Copy(labels, extra)
+		return labels
+	}
+	tests := []struct {
+		name         string
+		secret       string
+		payload      string
+		labels       map[string]string
+		expectDelete bool
+	}{
+		{"labelled with the user", "", `{"webuserid":"user-xyz","serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserID: "user-xyz"}), true},
+		{"labelled with the user's hash", "secret", `{"webuserid":"user-xyz","serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserHash: userhash.Hash("secret", "user-xyz")}), true},
+		{"raw label from before hashing", "secret", `{"webuserid":"user-xyz","serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserID: "user-xyz"}), true},
+		{"not a lab server", "", `{"webuserid":"user-xyz","serverId":"42"}`,
+			map[string]string{userhash.LabelWebUserID: "user-xyz"}, false},
+		{"another user's server", "", `{"webuserid":"user-xyz","serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserID: "user-abc"}), false},
+		{"another user's hash", "secret", `{"webuserid":"user-xyz","serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserHash: userhash.Hash("secret", "user-abc")}), false},
+		{"another tenant's server", "", `{"webuserid":"user-xyz","serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserID: "user-xyz", connector.LabelTenant: "cs101"}), false},
+		{"another lab", "", `{"webuserid":"user-xyz","labId":3,"serverId":"42"}`,
+			lab(map[string]string{userhash.LabelWebUserID: "user-xyz", connector.LabelLabID: "4"}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LABEL_USER_HMAC_SECRET", tt.secret)
+			mockConn := newMockConnector()
+			server := mockConn.addServer("42", nil)
+			server.labels = tt.labels
+			events := &recordingEvents{}
+
+			New(log, mockConn, newMockRedisClient()).WithEvents(events).ProcessRequest(context.Background(), tt.payload)
+
+			if deleted := server.deleteCalls > 0; deleted != tt.expectDelete {
+				t.Errorf("expected deleted %v, got %v", tt.expectDelete, deleted)
+			}
+			if !tt.expectDelete && (len(events.events) != 1 || events.events[0].Type != redis.EventDecommissionFailed || events.events[0].ServerID != "42") {
+				t.Errorf("expected the refusal recorded, got %+v", events.events)
+			}
+		})
+	}
+}
+
+func TestProcessRequest_CacheLessDeleteFailure(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mockConn := newMockConnector()
+	server := mockConn.addServer("42", errors.New("server locked"))
+	server.labels = map[string]string{connector.LabelType: connector.LabelTypeLabHost, userhash.LabelWebUserID: "user-xyz"}
+	events := &recordingEvents{}
+
+	New(log, mockConn, newMockRedisClient()).WithEvents(events).ProcessRequest(context.Background(), `{"webuserid":"user-xyz","serverId":"42"}`)
+
+	// The failure belongs in the user's history like one of a cached server
+	if len(events.events) != 1 || events.events[0].Type != redis.EventDecommissionFailed || events.events[0].WebUserID != "user-xyz" {
+		t.Errorf("expected the failure recorded for the user, got %+v", events.events)
+	}
+}
+
+func TestProcessRequest_DeleteTimeout(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cacheKey := redis.ServerCacheKey("user-abc")
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(cacheKey, redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", Status: config.StatusRunning})
+	mockConn := newMockConnector()
+	server := mockConn.addServer("server-123", nil)
+	server.deleteBlocks = true
+	events := &recordingEvents{}
+
+	done := make(chan struct{})
+	go func() {
+		New(log, mockConn, mockRedis).WithDeleteTimeout(20*time.Millisecond).WithEvents(events).
+			ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the delete timeout to end the hung provider call")
+	}
+	if len(mockRedis.deletedKeys) != 0 {
+		t.Errorf("expected cache entry to be kept after a failed delete, got %v", mockRedis.deletedKeys)
+	}
+	if len(events.events) != 1 || !strings.Contains(events.events[0].Message, context.DeadlineExceeded.Error()) {
+		t.Errorf("expected one delete failure event for the deadline, got %+v", events.events)
+	}
+}
+
+// inventoryCalls runs an inventory hook against a test server and returns the bodies it receives
+func inventoryCalls(t *testing.T) (*inventory.Hook, <-chan string) {
+	t.Helper()
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	hook, err := inventory.New(slog.New(slog.NewTextHandler(io.Discard, nil)), inventory.Config{Register: inventory.Call{URL: srv.URL}})
+	if err != nil {
+		t.Fatalf("inventory.New failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hook.Run(ctx)
+	return hook, bodies
+}
+
+// expectInventoryCall waits for the next inventory call and checks it is event for serverID
+func expectInventoryCall(t *testing.T, bodies <-chan string, event, serverID string) {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		if !strings.Contains(body, `"event":"`+event+`"`) || !strings.Contains(body, `"serverId":"`+serverID+`"`) {
+			t.Errorf("expected %s of %s, got %s", event, serverID, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the %s call", event)
+	}
+}
+
+func TestProcessRequest_DeregistersInventory(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hook, bodies := inventoryCalls(t)
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+	mockConn := newMockConnector()
+	mockConn.addServer("server-123", nil)
+
+	New(log, mockConn, mockRedis).WithInventory(hook).ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+	expectInventoryCall(t, bodies, inventory.EventDeregister, "server-123")
+}
+
+// fakeDNSProvider keeps AAAA records in memory
+type fakeDNSProvider struct {
+	records map[string]string
+}
+
+func (f *fakeDNSProvider) UpsertAAAA(ctx context.Context, fqdn string, ipv6 string, ttl int) error {
+	f.records[fqdn] = ipv6
+	return nil
+}
+
+func (f *fakeDNSProvider) DeleteAAAA(ctx context.Context, fqdn string) error {
+	delete(f.records, fqdn)
+	return nil
+}
+
+func TestProcessRequest_UnregistersDNS(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	provider := &fakeDNSProvider{records: make(map[string]string)}
+	registrar := dns.NewRegistrar(provider, "labs.example.com", "secret", 0)
+
+	t.Run("cached hostname", func(t *testing.T) {
+		provider.records["lab5-cached.labs.example.com"] = "2001:db8::1"
+		mockRedis := newMockRedisClient()
+		mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{
+			ServerID: "server-123", WebUserID: "user-abc", LabID: 5, Hostname: "lab5-cached.labs.example.com",
+		})
+		mockConn := newMockConnector()
+		mockConn.addServer("server-123", nil)
+
+		New(log, mockConn, mockRedis).WithDNS(registrar).ProcessRequest(ctx, `{"webuserid":"user-abc"}`)
+
+		if _, ok := provider.records["lab5-cached.labs.example.com"]; ok {
+			t.Error("expected cached hostname to be removed")
+		}
+	})
+
+	t.Run("hostname derived from cache-less request", func(t *testing.T) {
+		hostname := registrar.Hostname("user-xyz", 3)
+		provider.records[hostname] = "2001:db8::2"
+		mockConn := newMockConnector()
+		mockConn.addServer("orphaned-server", nil).labels = map[string]string{
+			connector.LabelType: connector.LabelTypeLabHost, userhash.LabelWebUserID: "user-xyz", connector.LabelLabID: "3"}
+
+		New(log, mockConn, newMockRedisClient()).WithDNS(registrar).
+			ProcessRequest(ctx, `{"webuserid":"user-xyz","labId":3,"serverId":"orphaned-server"}`)
+
+		if _, ok := provider.records[hostname]; ok {
+			t.Error("expected derived hostname to be removed")
+		}
+	})
+
+	t.Run("kept when provider delete fails", func(t *testing.T) {
+		hostname := registrar.Hostname("user-def", 9)
+		provider.records[hostname] = "2001:db8::3"
+		mockRedis := newMockRedisClient()
+		mockRedis.addState(redis.ServerCacheKey("user-def"), redis.ServerState{ServerID: "server-9", WebUserID: "user-def", LabID: 9})
+		mockConn := newMockConnector()
+		mockConn.addServer("server-9", errors.New("api error"))
+
+		New(log, mockConn, mockRedis).WithDNS(registrar).ProcessRequest(ctx, `{"webuserid":"user-def"}`)
+
+		if _, ok := provider.records[hostname]; !ok {
+			t.Error("expected hostname to stay while the server still exists")
+		}
+	})
+}
+
+func TestProcessRequest_LabelLookup(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		secret        string
+		payload       string
+		labels        map[string]map[string]string // server ID -> labels
+		expectDeleted []string
+	}{
+		{
+			name:    "raw webuserid label isn't trusted without a secret",
+			payload: `{"webuserid":"user-abc"}`,
+			labels: map[string]map[string]string{
+				"server-1": {"type": "ephymerical-lab-host", "webuserid": "user-abc", "labid": "5"},
+			},
+		},
+		{
+			name:    "hashed webuserid label",
+			secret:  "test-secret",
+			payload: `{"webuserid":"user-abc"}`,
+			labels: map[string]map[string]string{
+				"server-1": {"type": "ephymerical-lab-host", "webuserhash": userhash.Hash("test-secret", "user-abc"), "labid": "5"},
+				"server-2": {"type": "ephymerical-lab-host", "webuserid": "user-abc", "labid": "5"}, // raw label ignored when hashing is enabled
+			},
+			expectDeleted: []string{"server-1"},
+		},
+		{
+			name:    "labId restricts matches",
+			secret:  "test-secret",
+			payload: `{"webuserid":"user-abc","labId":7}`,
+			labels: map[string]map[string]string{
+				"server-1": {"type": "ephymerical-lab-host", "webuserhash": userhash.Hash("test-secret", "user-abc"), "labid": "5"},
+				"server-2": {"type": "ephymerical-lab-host", "webuserhash": userhash.Hash("test-secret", "user-abc"), "labid": "7"},
+			},
+			expectDeleted: []string{"server-2"},
+		},
+		{
+			name:    "unmanaged servers are never touched",
+			secret:  "test-secret",
+			payload: `{"webuserid":"user-abc"}`,
+			labels: map[string]map[string]string{
+				"server-1": {"webuserhash": userhash.Hash("test-secret", "user-abc"), "labid": "5"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LABEL_USER_HMAC_SECRET", tt.secret)
+
+			mockConn := newMockConnector()
+			for id, labels := range tt.labels {
+				mockConn.addServer(id, nil).labels = labels
+			}
+
+			decomm := New(log, mockConn, newMockRedisClient())
+			decomm.ProcessRequest(ctx, tt.payload)
+
+			expected := make(map[string]bool)
+			for _, id := range tt.expectDeleted {
+				expected[id] = true
+			}
+			for id, server := range mockConn.servers {
+				if expected[id] && server.deleteCalls == 0 {
+					t.Errorf("expected %s to be deleted", id)
+				}
+				if !expected[id] && server.deleteCalls > 0 {
+					t.Errorf("expected %s not to be deleted", id)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessRequest_Targeted(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	managed := func(labID string) map[string]string {
+		return map[string]string{"type": "ephymerical-lab-host", "labid": labID}
+	}
+
+	tests := []struct {
+		name          string
+		payload       string
+		labels        map[string]map[string]string // server ID -> labels
+		expectDeleted []string
+	}{
+		{
+			name:    "by server name",
+			payload: `{"serverName":"mock-server-name-server-1"}`,
+			labels: map[string]map[string]string{
+				"server-1": managed("12"),
+				"server-2": managed("12"),
+			},
+			expectDeleted: []string{"server-1"},
+		},
+		{
+			name:    "by label selector",
+			payload: `{"labelSelector":{"labid":"12"}}`,
+			labels: map[string]map[string]string{
+				"server-1": managed("12"),
+				"server-2": managed("12"),
+				"server-3": managed("7"),
+			},
+			expectDeleted: []string{"server-1", "server-2"},
+		},
+		{
+			name:    "all selector pairs must match",
+			payload: `{"labelSelector":{"labid":"12","ttl":"30"}}`,
+			labels: map[string]map[string]string{
+				"server-1": {"type": "ephymerical-lab-host", "labid": "12", "ttl": "30"},
+				"server-2": {"type": "ephymerical-lab-host", "labid": "12", "ttl": "60"},
+			},
+			expectDeleted: []string{"server-1"},
+		},
+		{
+			name:    "unmanaged server by name is skipped",
+			payload: `{"serverName":"mock-server-name-server-1"}`,
+			labels: map[string]map[string]string{
+				"server-1": {"labid": "12"},
+			},
+		},
+		{
+			name:    "name and selector must both match",
+			payload: `{"serverName":"mock-server-name-server-1","labelSelector":{"labid":"7"}}`,
+			labels: map[string]map[string]string{
+				"server-1": managed("12"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConn := newMockConnector()
+			for id, labels := range tt.labels {
+				mockConn.addServer(id, nil).labels = labels
+			}
+
+			mockRedis := newMockRedisClient()
+			for _, id := range tt.expectDeleted {
+				user := "user-" + id
+				mockRedis.addState(redis.ServerCacheKey(user), redis.ServerState{ServerID: id, WebUserID: user})
+			}
+
+			decomm := New(log, mockConn, mockRedis)
+			decomm.ProcessRequest(ctx, tt.payload)
+
+			expected := make(map[string]bool)
+			for _, id := range tt.expectDeleted {
+				expected[id] = true
+			}
+			for id, server := range mockConn.servers {
+				if expected[id] && server.deleteCalls == 0 {
+					t.Errorf("expected %s to be deleted", id)
+				}
+				if !expected[id] && server.deleteCalls > 0 {
+					t.Errorf("expected %s not to be deleted", id)
+				}
+			}
+
+			// Cache entries pointing at deleted servers are removed
+			if len(mockRedis.deletedKeys) != len(tt.expectDeleted) {
+				t.Errorf("expected %d cache entries removed, got %v", len(tt.expectDeleted), mockRedis.deletedKeys)
+			}
+		})
+	}
+}
+
+// recordingHook remembers the events it ran for and how often the server was deleted by then
+type recordingHook struct {
+	server *mockConnectorServer
+	events []string
+	err    error
+}
+
+func (h *recordingHook) Run(ctx context.Context, event string, state redis.ServerState, payload []byte) error {
+	h.events = append(h.events, event+":"+state.ServerID)
+	if h.server.deleteCalls != 0 {
+		h.events = append(h.events, "ran after delete")
+	}
+	return h.err
+}
+
+func TestProcessRequest_RunsDecommissionHooks(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	for _, hookErr := range []error{nil, errors.New("grader unreachable")} {
+		mockRedis := newMockRedisClient()
+		mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+		mockConn := newMockConnector()
+		server := mockConn.addServer("server-123", nil)
+		hook := &recordingHook{server: server, err: hookErr}
+
+		New(log, mockConn, mockRedis).WithHooks(hooks.NewRunner(time.Second, hook)).ProcessRequest(ctx, `{"webuserid":"user-abc"}`)
+
+		if len(hook.events) != 1 || hook.events[0] != "decommission:server-123" {
+			t.Errorf("hook error %v: expected one decommission hook before deletion, got %v", hookErr, hook.events)
+		}
+		if server.deleteCalls != 1 {
+			t.Errorf("hook error %v: expected server to be deleted, got %d delete calls", hookErr, server.deleteCalls)
+		}
+	}
+}
+
+// recordingEvents remembers the events recorded for the dashboard
+type recordingEvents struct {
+	events []redis.Event
+}
+
+func (r *recordingEvents) RecordEvent(ctx context.Context, event redis.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestProcessRequest_RecordsDeleteFailure(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+	mockConn := newMockConnector()
+	mockConn.addServer("server-123", errors.New("server locked"))
+	events := &recordingEvents{}
+
+	New(log, mockConn, mockRedis).WithEvents(events).ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+
+	if len(events.events) != 1 {
+		t.Fatalf("expected one event, got %+v", events.events)
+	}
+	event := events.events[0]
+	if event.Type != redis.EventDecommissionFailed || event.Operation != "decommission" ||
+		event.ServerID != "server-123" || event.LabID != 5 || event.Message != "server locked" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
+
+// recordingHistory remembers the history events by tenant-scoped user ID
+type recordingHistory map[string][]redis.Event
+
+func (r recordingHistory) RecordHistory(ctx context.Context, userID string, event redis.Event) error {
+	r[userID] = append(r[userID], event)
+	return nil
+}
+
+func TestProcessRequest_RecordsHistory(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+	mockRedis.addState(redis.ServerCacheKey("user-def"), redis.ServerState{ServerID: "server-456", WebUserID: "user-def", LabID: 6})
+	mockConn := newMockConnector()
+	mockConn.addServer("server-123", nil)
+	mockConn.addServer("server-456", errors.New("server locked"))
+	history := recordingHistory{}
+
+	decomm := New(log, mockConn, mockRedis).WithHistory(history)
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-abc","correlationId":"corr-1"}`)
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-def"}`)
+
+	if events := history["user-abc"]; len(events) != 1 || events[0].Type != redis.EventDecommissioned ||
+		events[0].LabID != 5 || events[0].ServerID != "server-123" || events[0].CorrelationID != "corr-1" {
+		t.Errorf("expected a decommissioned event for user-abc, got %+v", events)
+	}
+	if events := history["user-def"]; len(events) != 1 || events[0].Type != redis.EventDecommissionFailed ||
+		events[0].Operation != "decommission" || events[0].Message != "server locked" {
+		t.Errorf("expected a decommission failure for user-def, got %+v", events)
+	}
+}
+
+type recordingArchive []redis.SessionRecord
+
+func (r *recordingArchive) Archive(ctx context.Context, record redis.SessionRecord) error {
+	*r = append(*r, record)
+	return nil
+}
+
+func TestProcessRequest_ArchivesSession(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mockRedis := newMockRedisClient()
+	createdAt := time.Now().Add(-90 * time.Minute)
+	mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5,
+		ServerType: "cx22", CreatedAt: createdAt, CorrelationID: "corr-1"})
+	mockRedis.addState(redis.ServerCacheKey("user-def"), redis.ServerState{ServerID: "server-456", WebUserID: "user-def", LabID: 6})
+	mockRedis.addState(redis.ServerCacheKey("user-ghi"), redis.ServerState{ServerID: "server-789", WebUserID: "user-ghi", LabID: 7})
+	mockRedis.addState(redis.ServerCacheKey("user-jkl"), redis.ServerState{WebUserID: "user-jkl", LabID: 8, Status: config.StatusFailed})
+	mockConn := newMockConnector()
+	mockConn.addServer("server-123", nil)
+	mockConn.addServer("server-456", nil)
+	mockConn.addServer("server-789", nil)
+	archived := &recordingArchive{}
+
+	decomm := New(log, mockConn, mockRedis).WithArchive(archived, "hcloud")
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-def","labId":6,"reason":"idle"}`)
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-ghi","labId":7,"serverId":"server-789","switch":true}`)
+	decomm.ProcessRequest(context.Background(), `{"webuserid":"user-jkl"}`)
+
+	if len(*archived) != 3 {
+		t.Fatalf("expected 3 sessions archived, none for the entry without a server, got %+v", *archived)
+	}
+	first := (*archived)[0]
+	if first.WebUserID != "user-abc" || first.LabID != 5 || first.ServerID != "server-123" || first.ServerType != "cx22" ||
+		first.Provider != "hcloud" || first.ExitReason != redis.ExitUser || first.CorrelationID != "corr-1" {
+		t.Errorf("unexpected session record %+v", first)
+	}
+	if !first.StartedAt.Equal(createdAt) || first.DurationSeconds < 90*60 || first.DurationSeconds > 91*60 {
+		t.Errorf("expected a session of 90 minutes from %v, got %+v", createdAt, first)
+	}
+	if reason := (*archived)[1].ExitReason; reason != "idle" {
+		t.Errorf("expected the cleanup reason as exit reason, got %q", reason)
+	}
+	if second := (*archived)[1]; !second.StartedAt.IsZero() || second.DurationSeconds != 0 {
+		t.Errorf("expected no duration without createdAt, got %+v", second)
+	}
+	if reason := (*archived)[2].ExitReason; reason != redis.ExitSwitch {
+		t.Errorf("expected exit reason %q for a lab switch, got %q", redis.ExitSwitch, reason)
+	}
+}
+
+func TestProcessRequest_AdminOverride(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	verifier := override.NewVerifier(nil, []string{"instructor"}, 0).WithSignedPayloads()
+
+	tests := []struct {
+		name    string
+		payload string
+		deleted bool
+	}{
+		{"granted", `{"webuserid":"user-abc","admin":true,"adminActor":"instructor"}`, true},
+		{"refused", `{"webuserid":"user-abc","admin":true,"adminActor":"student"}`, false},
+		{"not requested", `{"webuserid":"user-abc"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRedis := newMockRedisClient()
+			mockRedis.rateLimited = true
+			mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+			mockConn := newMockConnector()
+			mockConn.addServer("server-123", nil)
+			history := recordingHistory{}
+
+			New(log, mockConn, mockRedis).WithHistory(history).WithOverrides(verifier).ProcessRequest(context.Background(), tt.payload)
+
+			if deleted := mockConn.servers["server-123"].deleteCalls == 1; deleted != tt.deleted {
+				t.Errorf("expected deleted %v inside the rate limit window", tt.deleted)
+			}
+			var types []string
+			for _, event := range history["user-abc"] {
+				types = append(types, event.Type)
+			}
+			if overridden := slices.Contains(types, redis.EventAdminOverride); overridden != (tt.name != "not requested") {
+				t.Errorf("expected the override recorded when asked for, got events %v", types)
+			}
+		})
+	}
+}
+
+func TestProcessRequest_Sequence(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name    string
+		payload string
+		deleted bool
+	}{
+		{"overtaken", `{"webuserid":"user-abc","seq":6}`, false},
+		{"later", `{"webuserid":"user-abc","seq":8}`, true},
+		{"unsequenced", `{"webuserid":"user-abc"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The provision numbered 7 was served first
+			sequencer := redistest.New()
+			sequencer.ApplySequence(context.Background(), "user-abc", 7)
+
+			mockRedis := newMockRedisClient()
+			mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+			mockConn := newMockConnector()
+			mockConn.addServer("server-123", nil)
+			history := recordingHistory{}
+
+			New(log, mockConn, mockRedis).WithHistory(history).WithSequencer(sequencer).ProcessRequest(context.Background(), tt.payload)
+
+			if deleted := mockConn.servers["server-123"].deleteCalls == 1; deleted != tt.deleted {
+				t.Errorf("expected deleted %v", tt.deleted)
+			}
+			dropped := len(history["user-abc"]) > 0 && history["user-abc"][0].Type == redis.EventOutOfOrder
+			if dropped == tt.deleted {
+				t.Errorf("expected an out-of-order event only for a dropped request, got %v", history["user-abc"])
+			}
+		})
+	}
+}
+
+// recordingTombstones remembers the tombstones written
+type recordingTombstones struct {
+	tombstones []redis.Tombstone
+	ttl        time.Duration
+}
+
+func (r *recordingTombstones) PushTombstone(ctx context.Context, tombstone redis.Tombstone, ttl time.Duration) error {
+	r.tombstones = append(r.tombstones, tombstone)
+	r.ttl = ttl
+	return nil
+}
+
+func (r *recordingTombstones) TakeTombstone(ctx context.Context, userID string) (*redis.Tombstone, error) {
+	return nil, errs.New("tombstone not found", errs.ErrNotFound)
+}
+
+func TestProcessRequest_RecordsTombstone(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5, CorrelationID: "corr-1"})
+	mockRedis.addState(redis.ServerCacheKey("user-def"), redis.ServerState{ServerID: "server-456", WebUserID: "user-def", LabID: 6})
+	mockConn := newMockConnector()
+	mockConn.addServer("server-123", nil)
+	mockConn.addServer("server-456", errors.New("server locked"))
+	tombstones := &recordingTombstones{}
+
+	d := New(log, mockConn, mockRedis).WithTombstones(tombstones, 10*time.Minute)
+	d.ProcessRequest(context.Background(), `{"webuserid":"user-abc"}`)
+	// A failed deletion leaves nothing to undo
+	d.ProcessRequest(context.Background(), `{"webuserid":"user-def"}`)
+
+	if len(tombstones.tombstones) != 1 {
+		t.Fatalf("expected one tombstone, got %+v", tombstones.tombstones)
+	}
+	tombstone := tombstones.tombstones[0]
+	if tombstone.WebUserID != "user-abc" || tombstone.LabID != 5 || tombstone.ServerID != "server-123" ||
+		tombstone.CorrelationID != "corr-1" || tombstone.DeletedAt.IsZero() || tombstones.ttl != 10*time.Minute {
+		t.Errorf("unexpected tombstone: %+v (ttl %v)", tombstone, tombstones.ttl)
+	}
+}
+
+func TestProcessRequest_TombstoneOnlyForUserDeletions(t *testing.T) {
+	payloads := []string{
+		`{"webuserid":"user-abc","reason":"ttl"}`,
+		`{"webuserid":"user-abc","reason":"max lifetime"}`,
+		`{"webuserid":"user-abc","switch":true}`,
+		`{"labId":5,"allUsers":true}`,
+	}
+	for _, payload := range payloads {
+		log := slog.New(slog.NewTextHandler(io.Discard, nil))
+		mockRedis := newMockRedisClient()
+		mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+		mockConn := newMockConnector()
+		mockConn.addServer("server-123", nil)
+		tombstones := &recordingTombstones{}
+
+		New(log, mockConn, mockRedis).WithTombstones(tombstones, 10*time.Minute).ProcessRequest(context.Background(), payload)
+
+		if len(mockRedis.deletedKeys) == 0 {
+			t.Errorf("%s: expected the server to be decommissioned", payload)
+		}
+		if len(tombstones.tombstones) != 0 {
+			t.Errorf("%s: expected no tombstone, got %+v", payload, tombstones.tombstones)
+		}
+	}
+}
+
+func TestProcessRequest_RejectsInvalidFields(t *testing.T) {
+	payloads := []string{
+		`{"webuserid":"user-abc:other"}`,
+		`{"webuserid":"user-abc","labId":0}`,
+		`{"webuserid":"user-abc","serverId":"../server-123"}`,
+		`{"serverName":"lab5-abc\nforged"}`,
+		`{"webuserid":"user-abc","correlationId":"` + strings.Repeat("x", 200) + `"}`,
+	}
+	for _, payload := range payloads {
+		log := slog.New(slog.NewTextHandler(io.Discard, nil))
+		mockRedis := newMockRedisClient()
+		mockRedis.addState(redis.ServerCacheKey("user-abc"), redis.ServerState{ServerID: "server-123", WebUserID: "user-abc", LabID: 5})
+		mockConn := newMockConnector()
+		server := mockConn.addServer("server-123", nil)
+		events := &recordingEvents{}
+
+		New(log, mockConn, mockRedis).WithEvents(events).ProcessRequest(context.Background(), payload)
+
+		if server.deleteCalls != 0 {
+			t.Errorf("%s: expected no server to be deleted", payload)
+		}
+		if len(events.events) != 1 || events.events[0].Type != redis.EventDecommissionFailed {
+			t.Errorf("%s: expected one decommission failure event, got %+v", payload, events.events)
+		}
+	}
+}
+
+func TestProcessRequest_AllUsersOfLab(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	labLabels := func(labID string) map[string]string {
+		return map[string]string{connector.LabelType: connector.LabelTypeLabHost, connector.LabelLabID: labID}
+	}
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(redis.ServerCacheKey("alice"), redis.ServerState{ServerID: "1", WebUserID: "alice", LabID: 12})
+	mockRedis.addState(redis.ServerCacheKey("bob"), redis.ServerState{ServerID: "2", WebUserID: "bob", LabID: 12})
+	mockRedis.addState(redis.ServerCacheKey("carol"), redis.ServerState{WebUserID: "carol", LabID: 12, Status: config.StatusProvisioning})
+	mockRedis.addState(redis.ServerCacheKey("dave"), redis.ServerState{ServerID: "4", WebUserID: "dave", LabID: 7})
+
+	mockConn := newMockConnector()
+	alice := mockConn.addServer("1", nil)
+	alice.labels = labLabels("12")
+	bob := mockConn.addServer("2", nil)
+	bob.labels = labLabels("12")
+	uncached := mockConn.addServer("3", nil)
+	uncached.labels = labLabels("12")
+	dave := mockConn.addServer("4", nil)
+	dave.labels = labLabels("7")
+	unmanaged := mockConn.addServer("5", nil)
+	unmanaged.labels = map[string]string{connector.LabelLabID: "12"}
+
+	d := New(log, mockConn, mockRedis)
+
+	// Without a labId nothing is touched
+	d.ProcessRequest(ctx, `{"allUsers":true}`)
+	if alice.deleteCalls+bob.deleteCalls+uncached.deleteCalls != 0 {
+		t.Fatal("expected no deletion without labId")
+	}
+
+	d.ProcessRequest(ctx, `{"labId":12,"allUsers":true}`)
+
+	for _, server := range []*mockConnectorServer{alice, bob, uncached} {
+		if server.deleteCalls != 1 {
+			t.Errorf("expected lab 12 server %s deleted once, got %d", server.id, server.deleteCalls)
+		}
+	}
+	if dave.deleteCalls != 0 || unmanaged.deleteCalls != 0 {
+		t.Errorf("expected other labs and unmanaged servers untouched, got %d and %d", dave.deleteCalls, unmanaged.deleteCalls)
+	}
+
+	sort.Strings(mockRedis.deletedKeys)
+	want := []string{redis.ServerCacheKey("alice"), redis.ServerCacheKey("bob")}
+	if strings.Join(mockRedis.deletedKeys, ",") != strings.Join(want, ",") {
+		t.Errorf("expected cache entries %v removed, got %v", want, mockRedis.deletedKeys)
+	}
+}
+
+// recordingChannel remembers the notifications sent to it
+type recordingChannel struct {
+	sent []notify.Notification
+}
+
+func (c *recordingChannel) Send(ctx context.Context, n notify.Notification) error {
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+func TestProcessRequest_KeepsProtectedServers(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	protectedLabels := map[string]string{connector.LabelType: connector.LabelTypeLabHost, connector.LabelLabID: "12", connector.LabelProtected: "true"}
+
+	mockRedis := newMockRedisClient()
+	mockRedis.addState(redis.ServerCacheKey("alice"), redis.ServerState{ServerID: "1", WebUserID: "alice", LabID: 12})
+	mockConn := newMockConnector()
+	cached := mockConn.addServer("1", nil)
+	cached.labels = protectedLabels
+	uncached := mockConn.addServer("2", nil)
+	uncached.labels = protectedLabels
+	alerts := &recordingChannel{}
+	notifier := notify.NewNotifier(map[string]notify.Channel{notify.ChannelWebhook: alerts}, nil, 0, time.Second)
+	hook := &recordingHook{server: cached}
+
+	New(log, mockConn, mockRedis).WithNotifier(notifier).WithHooks(hooks.NewRunner(time.Second, hook)).ProcessRequest(ctx, `{"labId":12,"allUsers":true}`)
+
+	if cached.deleteCalls != 0 || uncached.deleteCalls != 0 || len(hook.events) != 0 {
+		t.Fatalf("expected protected servers kept without running hooks, got %d and %d deletions, hooks %v", cached.deleteCalls, uncached.deleteCalls, hook.events)
+	}
+	// The cache entry is released, so the cleanup worker doesn't queue the server again
+	if len(mockRedis.deletedKeys) != 1 || mockRedis.deletedKeys[0] != redis.ServerCacheKey("alice") {
+		t.Errorf("expected the cache entry of the kept server removed, got %v", mockRedis.deletedKeys)
+	}
+	// The second notification falls within the rate limit
+	if len(alerts.sent) != 1 || alerts.sent[0].Event != notify.EventProtectedServer {
+		t.Errorf("expected a protected server notification, got %+v", alerts.sent)
+	}
+}
+
+func TestProcessRequest_Tenant(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	registry, err := tenant.NewRegistry(map[string]tenant.Tenant{"cs101": {}})
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+
+	// The same user ID in two tenants are two different users
+	mockRedis := newMockRedisClient()
+	mockRedis.addState("vmmanager:servers:cs101:alice", redis.ServerState{ServerID: "1", WebUserID: "alice", LabID: 12, Tenant: "cs101"})
+	mockRedis.addState(redis.ServerCacheKey("alice"), redis.ServerState{ServerID: "2", WebUserID: "alice", LabID: 12})
+
+	mockConn := newMockConnector()
+	scoped := mockConn.addServer("1", nil)
+	unscoped := mockConn.addServer("2", nil)
+
+	d := New(log, mockConn, mockRedis).WithTenants(registry)
+	d.ProcessRequest(ctx, `{"webuserid":"alice","labId":12,"tenant":"cs202"}`)
+	if scoped.deleteCalls+unscoped.deleteCalls != 0 {
+		t.Fatal("expected no deletion for an unknown tenant")
+	}
+
+	d.ProcessRequest(ctx, `{"webuserid":"alice","labId":12,"tenant":"cs101"}`)
+	if scoped.deleteCalls != 1 || unscoped.deleteCalls != 0 {
+		t.Errorf("expected only the tenant's server deleted, got %d and %d", scoped.deleteCalls, unscoped.deleteCalls)
+	}
+	if len(mockRedis.deletedKeys) != 1 || mockRedis.deletedKeys[0] != "vmmanager:servers:cs101:alice" {
+		t.Errorf("expected only the tenant-scoped cache entry removed, got %v", mockRedis.deletedKeys)
+	}
+}
@@ -0,0 +1,230 @@
+// Package dispatch schedules queue messages onto handler goroutines.
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Handler processes one queue payload
+type Handler func(ctx context.Context, payload string)
+
+// FairDispatcher runs at most one payload per user at a time. Payloads for a user that
+// already has one running wait in a per-user slot; only the latest waiting payload is
+// kept, since a newer request for a user supersedes an older one.
+//
+// With a capacity set, at most that many payloads run at once; when a slot frees up the
+// waiting users are served in round-robin order.
+type FairDispatcher struct {
+	log      *slog.Logger
+	handler  Handler
+	wg       sync.WaitGroup
+	capacity int           // maximum running payloads, 0 = unlimited
+	freed    chan struct{} // signalled whenever a payload completes
+
+	mu           sync.Mutex
+	running      int
+	backpressure bool
+	active       map[string]bool   // users with a running payload
+	pending      map[string]string // latest waiting payload per user
+	order        []string          // users with a waiting payload, in arrival order
+}
+
+// NewFairDispatcher creates a dispatcher that runs handler for each submitted payload
+func NewFairDispatcher(log *slog.Logger, handler Handler) *FairDispatcher {
+	return &FairDispatcher{
+		log:     log,
+		handler: handler,
+		freed:   make(chan struct{}, 1),
+		active:  make(map[string]bool),
+		pending: make(map[string]string),
+	}
+}
+
+// WithCapacity caps the number of payloads running at once (0 = unlimited)
+func (d *FairDispatcher) WithCapacity(capacity int) *FairDispatcher {
+	d.capacity = capacity
+	return d
+}
+
+// WaitForCapacity blocks while the dispatcher is full, so the caller stops taking work
+// off the queue instead of accepting payloads it can't start. Returns ctx.Err() if ctx
+// is done first. The dispatcher is full when running plus waiting payloads reach the capacity.
+func (d *FairDispatcher) WaitForCapacity(ctx context.Context) error {
+	for {
+		if d.HasCapacity() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.freed:
+		}
+	}
+}
+
+// HasCapacity reports whether the dispatcher can accept another payload, without blocking.
+// Like WaitForCapacity it logs when backpressure turns on or off.
+func (d *FairDispatcher) HasCapacity() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	full := d.full()
+	if full != d.backpressure {
+		d.backpressure = full
+		if full {
+			d.log.Warn("provisioning at capacity, backpressure on", "running", d.running, "waiting", len(d.order), "capacity", d.capacity)
+		} else {
+			d.log.Info("provisioning below capacity, backpressure off", "running", d.running, "capacity", d.capacity)
+		}
+	}
+	return !full
+}
+
+// Running returns the number of payloads currently running
+func (d *FairDispatcher) Running() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
+
+// Backpressure reports whether the dispatcher was full the last time WaitForCapacity checked
+func (d *FairDispatcher) Backpressure() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.backpressure
+}
+
+// Submit schedules payload. It never blocks: the payload either starts right away or
+// waits until the user's running payload completes.
+func (d *FairDispatcher) Submit(ctx context.Context, payload string) {
+	user := userKey(payload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	atCapacity := d.capacity > 0 && d.running >= d.capacity
+
+	// Payloads without a user can't be attributed, so they are only held back by the capacity
+	if user == "" {
+		if atCapacity {
+			d.log.Warn("dropping unattributed payload submitted at capacity")
+			return
+		}
+		d.start(ctx, user, payload)
+		return
+	}
+
+	if !d.active[user] && !atCapacity {
+		d.start(ctx, user, payload)
+		return
+	}
+
+	if _, waiting := d.pending[user]; waiting {
+		d.log.Info("newer provision request supersedes waiting one", "webuserid", user)
+	} else {
+		d.order = append(d.order, user)
+	}
+	d.pending[user] = payload
+}
+
+// Wait blocks until every started payload has completed
+func (d *FairDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Pending removes and returns the payloads that never started, in arrival order,
+// so they can be returned to the queue on shutdown
+func (d *FairDispatcher) Pending() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	payloads := make([]string, 0, len(d.order))
+	for _, user := range d.order {
+		payloads = append(payloads, d.pending[user])
+	}
+	d.order = nil
+	d.pending = make(map[string]string)
+	return payloads
+}
+
+// full reports whether no more payloads should be accepted. Must be called with d.mu held.
+func (d *FairDispatcher) full() bool {
+	return d.capacity > 0 && d.running+len(d.order) >= d.capacity
+}
+
+// start runs payload in a new goroutine. Must be called with d.mu held.
+func (d *FairDispatcher) start(ctx context.Context, user, payload string) {
+	d.running++
+	if user != "" {
+		d.active[user] = true
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.handler(ctx, payload)
+		d.finish(ctx, user)
+	}()
+}
+
+// finish releases the user's slot and starts the next waiting payload
+func (d *FairDispatcher) finish(ctx context.Context, user string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.running--
+	delete(d.active, user)
+
+	// Stop handing out work once shutdown started; Pending returns the rest
+	if ctx.Err() == nil {
+		// The user that just finished goes last, so one user can't hold on to a freed slot
+		d.startWaiting(ctx, user)
+		d.startWaiting(ctx, "")
+	}
+
+	select {
+	case d.freed <- struct{}{}:
+	default:
+	}
+}
+
+// startWaiting starts waiting payloads, taking users in round-robin order, until the
+// capacity is reached or every waiting user other than skip already has a payload running.
+// Must be called with d.mu held.
+func (d *FairDispatcher) startWaiting(ctx context.Context, skip string) {
+	for i := 0; i < len(d.order); {
+		if d.capacity > 0 && d.running >= d.capacity {
+			return
+		}
+
+		user := d.order[i]
+		if d.active[user] || (skip != "" && user == skip) {
+			i++
+			continue
+		}
+
+		payload := d.pending[user]
+		d.order = append(d.order[:i], d.order[i+1:]...)
+		delete(d.pending, user)
+		d.start(ctx, user, payload)
+	}
+}
+
+// userKey extracts the tenant-qualified webuserid a payload belongs to, or "" if it can't
+// be parsed, so users of different tenants sharing a webuserid don't supersede each other
+func userKey(payload string) string {
+	var req struct {
+		WebUserID string `json:"webuserid"`
+		Tenant    string `json:"tenant"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil || req.WebUserID == "" {
+		return ""
+	}
+	return redis.TenantUserID(req.Tenant, req.WebUserID)
+}
@@ -0,0 +1,266 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+}
+
+// recorder is a handler that blocks each payload until released
+type recorder struct {
+	mu       sync.Mutex
+	started  []string
+	release  map[string]chan struct{}
+	inFlight map[string]int
+	maxPer   map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		release:  make(map[string]chan struct{}),
+		inFlight: make(map[string]int),
+		maxPer:   make(map[string]int),
+	}
+}
+
+func (r *recorder) gate(payload string) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.release[payload]
+	if !ok {
+		ch = make(chan struct{})
+		r.release[payload] = ch
+	}
+	return ch
+}
+
+func (r *recorder) handle(ctx context.Context, payload string) {
+	user := userKey(payload)
+	r.mu.Lock()
+	r.started = append(r.started, payload)
+	r.inFlight[user]++
+	if r.inFlight[user] > r.maxPer[user] {
+		r.maxPer[user] = r.inFlight[user]
+	}
+	r.mu.Unlock()
+
+	<-r.gate(payload)
+
+	r.mu.Lock()
+	r.inFlight[user]--
+	r.mu.Unlock()
+}
+
+func (r *recorder) startedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.started)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func payload(user string, lab int) string {
+	return fmt.Sprintf(`{"webuserid":"%s","labId":%d}`, user, lab)
+}
+
+func TestFairDispatcher_OnePerUser(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle)
+	ctx := context.Background()
+
+	d.Submit(ctx, payload("alice", 1))
+	d.Submit(ctx, payload("alice", 2))
+	d.Submit(ctx, payload("bob", 1))
+
+	// alice's second request waits, bob runs alongside alice's first
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+	time.Sleep(10 * time.Millisecond)
+	if r.startedCount() != 2 {
+		t.Fatalf("expected 2 running payloads, got %d", r.startedCount())
+	}
+
+	close(r.gate(payload("alice", 1)))
+	waitFor(t, func() bool { return r.startedCount() == 3 })
+
+	close(r.gate(payload("alice", 2)))
+	close(r.gate(payload("bob", 1)))
+	d.Wait()
+
+	if r.maxPer["alice"] != 1 {
+		t.Errorf("expected at most one in-flight payload for alice, got %d", r.maxPer["alice"])
+	}
+}
+
+func TestFairDispatcher_LatestWaitingPayloadWins(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle)
+	ctx := context.Background()
+
+	d.Submit(ctx, payload("alice", 1))
+	d.Submit(ctx, payload("alice", 2))
+	d.Submit(ctx, payload("alice", 3))
+	waitFor(t, func() bool { return r.startedCount() == 1 })
+
+	close(r.gate(payload("alice", 1)))
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+	close(r.gate(payload("alice", 3)))
+	d.Wait()
+
+	if r.started[1] != payload("alice", 3) {
+		t.Errorf("expected the latest waiting payload to run, got %s", r.started[1])
+	}
+	if len(r.started) != 2 {
+		t.Errorf("expected the superseded payload to be dropped, got %v", r.started)
+	}
+}
+
+func TestFairDispatcher_TenantsDontShareUsers(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle)
+	ctx := context.Background()
+
+	cs101 := `{"webuserid":"alice","tenant":"cs101","labId":1}`
+	cs102 := `{"webuserid":"alice","tenant":"cs102","labId":1}`
+	cs102Again := `{"webuserid":"alice","tenant":"cs102","labId":2}`
+	d.Submit(ctx, cs101)
+	d.Submit(ctx, cs102)
+	d.Submit(ctx, cs102Again)
+
+	// The same webuserid in another tenant is another user: it runs alongside and isn't superseded
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+	close(r.gate(cs101))
+	time.Sleep(10 * time.Millisecond)
+	if r.startedCount() != 2 {
+		t.Fatalf("expected cs102's second request to wait for its first, got %v", r.started)
+	}
+	close(r.gate(cs102))
+	waitFor(t, func() bool { return r.startedCount() == 3 })
+	close(r.gate(cs102Again))
+	d.Wait()
+}
+
+func TestFairDispatcher_UnattributedPayloadsRunImmediately(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle)
+	ctx := context.Background()
+
+	d.Submit(ctx, "not json")
+	d.Submit(ctx, "not json either")
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+
+	close(r.gate("not json"))
+	close(r.gate("not json either"))
+	d.Wait()
+}
+
+func TestFairDispatcher_PendingOnShutdown(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d.Submit(ctx, payload("alice", 1))
+	d.Submit(ctx, payload("bob", 1))
+	d.Submit(ctx, payload("bob", 2))
+	d.Submit(ctx, payload("alice", 2))
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+
+	// Once shutdown starts, finishing payloads don't start waiting ones
+	cancel()
+	close(r.gate(payload("alice", 1)))
+	close(r.gate(payload("bob", 1)))
+	d.Wait()
+
+	pending := d.Pending()
+	if len(pending) != 2 || pending[0] != payload("bob", 2) || pending[1] != payload("alice", 2) {
+		t.Errorf("expected waiting payloads in arrival order, got %v", pending)
+	}
+	if len(d.Pending()) != 0 {
+		t.Error("expected Pending to drain the waiting payloads")
+	}
+}
+
+func TestFairDispatcher_CapacityRoundRobin(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle).WithCapacity(1)
+	ctx := context.Background()
+
+	d.Submit(ctx, payload("alice", 1))
+	d.Submit(ctx, payload("alice", 2))
+	d.Submit(ctx, payload("bob", 1))
+	waitFor(t, func() bool { return r.startedCount() == 1 })
+
+	// bob gets the freed slot before alice's second request
+	close(r.gate(payload("alice", 1)))
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+	if r.started[1] != payload("bob", 1) {
+		t.Errorf("expected bob to be served next, got %s", r.started[1])
+	}
+	if d.Running() != 1 {
+		t.Errorf("expected 1 running payload, got %d", d.Running())
+	}
+
+	close(r.gate(payload("bob", 1)))
+	waitFor(t, func() bool { return r.startedCount() == 3 })
+	close(r.gate(payload("alice", 2)))
+	d.Wait()
+}
+
+func TestFairDispatcher_WaitForCapacity(t *testing.T) {
+	r := newRecorder()
+	d := NewFairDispatcher(newTestLogger(), r.handle).WithCapacity(2)
+	ctx := context.Background()
+
+	if err := d.WaitForCapacity(ctx); err != nil {
+		t.Fatalf("expected capacity on an idle dispatcher, got %v", err)
+	}
+
+	d.Submit(ctx, payload("alice", 1))
+	d.Submit(ctx, payload("bob", 1))
+	waitFor(t, func() bool { return r.startedCount() == 2 })
+
+	// Full: WaitForCapacity blocks until a payload completes
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := d.WaitForCapacity(timeoutCtx); err == nil {
+		t.Fatal("expected WaitForCapacity to block while full")
+	}
+	if !d.Backpressure() {
+		t.Error("expected backpressure while full")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- d.WaitForCapacity(ctx) }()
+	close(r.gate(payload("alice", 1)))
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected capacity after a payload completed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForCapacity did not return after a payload completed")
+	}
+	if d.Backpressure() {
+		t.Error("expected backpressure to clear")
+	}
+
+	close(r.gate(payload("bob", 1)))
+	d.Wait()
+}
@@ -0,0 +1,141 @@
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// States of the queue consumer loop, reported by PopTimer
+const (
+	StateBusy     = "busy"      // the last pop returned a request; pops are short
+	StateIdle     = "idle"      // the queues were empty at the last pop; pops grow longer
+	StateHeldBack = "held_back" // some queues aren't ready; pops are short so they are popped soon after they are
+	StateDraining = "draining"  // the instance is shutting down; pops are short so the loop stops soon
+	StatePaused   = "paused"    // Redis is unavailable; nothing is popped
+)
+
+// Results of a queue pop
+const (
+	PopRequest = "request" // a request was popped
+	PopEmpty   = "empty"   // the pop timed out on empty queues
+	PopError   = "error"   // the pop failed
+)
+
+var states = []string{StateBusy, StateIdle, StateHeldBack, StateDraining, StatePaused}
+
+var (
+	consumerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "swim_queue_consumer_state",
+		Help: "1 for the state the queue consumer loop is in, 0 for the others, by state.",
+	}, []string{"state"})
+
+	popTimeout = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "swim_queue_pop_timeout_seconds",
+		Help: "Timeout of the queue consumer loop's current or last blocking pop.",
+	})
+
+	pops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swim_queue_pops_total",
+		Help: "Blocking pops of the queue consumer loop, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(consumerState, popTimeout, pops)
+}
+
+// PopTimer picks the timeout of the queue consumer loop's blocking pops. After a pop that
+// returned a request the next one waits min, and each pop that finds the queues empty
+// doubles the wait up to max, so an idle instance sends few pops while a busy one reacts
+// quickly. Pops are kept at min while some queues are held back and once the instance
+// drains, since a blocking pop can't be cancelled and would delay the shutdown.
+type PopTimer struct {
+	min, max time.Duration
+	draining atomic.Bool
+
+	mu      sync.Mutex
+	backoff time.Duration // timeout of the next pop while nothing else shortens it
+	state   string
+}
+
+// NewPopTimer creates a timer whose pops wait between minTimeout and maxTimeout
+func NewPopTimer(minTimeout, maxTimeout time.Duration) *PopTimer {
+	maxTimeout = max(maxTimeout, minTimeout)
+	t := &PopTimer{min: minTimeout, max: maxTimeout, backoff: minTimeout}
+	t.setState(StateIdle)
+	return t
+}
+
+// Next returns the timeout of the next pop. heldBack tells whether some queues are left
+// out of it because they aren't ready.
+func (t *PopTimer) Next(heldBack bool) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timeout := t.backoff
+	switch {
+	case t.draining.Load():
+		t.setState(StateDraining)
+		timeout = t.min
+	case heldBack:
+		t.setState(StateHeldBack)
+		timeout = t.min
+	case t.state != StateBusy:
+		t.setState(StateIdle)
+	}
+	popTimeout.Set(timeout.Seconds())
+	return timeout
+}
+
+// Done records the result of a pop, one of PopRequest, PopEmpty and PopError
+func (t *PopTimer) Done(result string) {
+	pops.WithLabelValues(result).Inc()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch result {
+	case PopRequest:
+		t.backoff = t.min
+		if !t.draining.Load() {
+			t.setState(StateBusy)
+		}
+	case PopEmpty:
+		t.backoff = min(2*t.backoff, t.max)
+		if t.state == StateBusy {
+			t.setState(StateIdle)
+		}
+	}
+}
+
+// Pause records that nothing is popped because Redis is unavailable
+func (t *PopTimer) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setState(StatePaused)
+}
+
+// Drain keeps every following pop at min, so the loop stops soon after the instance does
+func (t *PopTimer) Drain() {
+	t.draining.Store(true)
+}
+
+// State returns the state the consumer loop was last in
+func (t *PopTimer) State() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+func (t *PopTimer) setState(state string) {
+	t.state = state
+	for _, s := range states {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		consumerState.WithLabelValues(s).Set(value)
+	}
+}
@@ -0,0 +1,94 @@
+package dispatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPopTimer_Backoff(t *testing.T) {
+	timer := NewPopTimer(time.Second, 5*time.Second)
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := timer.Next(false); got != w {
+			t.Fatalf("pop %d: expected timeout %v, got %v", i, w, got)
+		}
+		timer.Done(PopEmpty)
+	}
+	if state := timer.State(); state != StateIdle {
+		t.Errorf("expected state %s, got %s", StateIdle, state)
+	}
+
+	// A request resets the backoff
+	timer.Done(PopRequest)
+	if state := timer.State(); state != StateBusy {
+		t.Errorf("expected state %s, got %s", StateBusy, state)
+	}
+	if got := timer.Next(false); got != time.Second {
+		t.Errorf("expected timeout %v after a request, got %v", time.Second, got)
+	}
+	timer.Done(PopEmpty)
+	if state := timer.State(); state != StateIdle {
+		t.Errorf("expected state %s after an empty pop, got %s", StateIdle, state)
+	}
+
+	// Errors leave the backoff as it is
+	timer.Done(PopError)
+	if got := timer.Next(false); got != 2*time.Second {
+		t.Errorf("expected timeout %v after an error, got %v", 2*time.Second, got)
+	}
+}
+
+func TestPopTimer_HeldBack(t *testing.T) {
+	timer := NewPopTimer(time.Second, 30*time.Second)
+	for range 3 {
+		timer.Next(false)
+		timer.Done(PopEmpty)
+	}
+
+	if got := timer.Next(true); got != time.Second {
+		t.Errorf("expected timeout %v while held back, got %v", time.Second, got)
+	}
+	if state := timer.State(); state != StateHeldBack {
+		t.Errorf("expected state %s, got %s", StateHeldBack, state)
+	}
+
+	// The backoff resumes once every queue is ready
+	if got := timer.Next(false); got != 8*time.Second {
+		t.Errorf("expected timeout %v once ready, got %v", 8*time.Second, got)
+	}
+	if state := timer.State(); state != StateIdle {
+		t.Errorf("expected state %s, got %s", StateIdle, state)
+	}
+}
+
+func TestPopTimer_Drain(t *testing.T) {
+	timer := NewPopTimer(time.Second, 30*time.Second)
+	for range 3 {
+		timer.Next(false)
+		timer.Done(PopEmpty)
+	}
+
+	timer.Drain()
+	for range 2 {
+		if got := timer.Next(false); got != time.Second {
+			t.Errorf("expected timeout %v while draining, got %v", time.Second, got)
+		}
+		timer.Done(PopRequest)
+		if state := timer.State(); state != StateDraining {
+			t.Errorf("expected state %s, got %s", StateDraining, state)
+		}
+	}
+}
+
+func TestPopTimer_Pause(t *testing.T) {
+	timer := NewPopTimer(time.Second, 30*time.Second)
+	timer.Pause()
+	if state := timer.State(); state != StatePaused {
+		t.Errorf("expected state %s, got %s", StatePaused, state)
+	}
+	timer.Next(false)
+	if state := timer.State(); state != StateIdle {
+		t.Errorf("expected state %s once popping again, got %s", StateIdle, state)
+	}
+}
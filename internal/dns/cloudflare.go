@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const cloudflareBaseURL = "https://api.cloudflare.com/client/v4"
+
+// cloudflare manages records through the Cloudflare v4 API
+type cloudflare struct {
+	client  *http.Client
+	baseURL string
+	zoneID  string
+	token   string
+}
+
+func newCloudflare(client *http.Client, zoneID, token string) *cloudflare {
+	return &cloudflare{client: client, baseURL: cloudflareBaseURL, zoneID: zoneID, token: token}
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+// cloudflareResponse is the envelope of every Cloudflare API response
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (c *cloudflare) UpsertAAAA(ctx context.Context, fqdn string, ipv6 string, ttl int) error {
+	records, err := c.findAAAA(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	record := cloudflareRecord{Type: "AAAA", Name: fqdn, Content: ipv6, TTL: ttl}
+	if len(records) == 0 {
+		return c.do(ctx, http.MethodPost, "/zones/"+c.zoneID+"/dns_records", record, nil)
+	}
+	return c.do(ctx, http.MethodPut, "/zones/"+c.zoneID+"/dns_records/"+records[0].ID, record, nil)
+}
+
+func (c *cloudflare) DeleteAAAA(ctx context.Context, fqdn string) error {
+	records, err := c.findAAAA(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := c.do(ctx, http.MethodDelete, "/zones/"+c.zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findAAAA returns the AAAA records named fqdn
+func (c *cloudflare) findAAAA(ctx context.Context, fqdn string) ([]cloudflareRecord, error) {
+	query := url.Values{"type": {"AAAA"}, "name": {fqdn}}
+	var records []cloudflareRecord
+	if err := c.do(ctx, http.MethodGet, "/zones/"+c.zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// do sends a request and decodes the response's result into out, if set
+func (c *cloudflare) do(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal cloudflare request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("build cloudflare request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloudflare %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s: decode response (status %d): %w", method, resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		messages := make([]string, len(envelope.Errors))
+		for i, e := range envelope.Errors {
+			messages[i] = fmt.Sprintf("%d: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("cloudflare %s: status %d: %s", method, resp.StatusCode, strings.Join(messages, "; "))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(envelope.Result, out); err != nil {
+			return fmt.Errorf("cloudflare %s: decode result: %w", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloudflare serves the dns_records endpoints of one zone from memory
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records map[string]cloudflareRecord
+	nextID  int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]any{"success": false, "errors": []map[string]any{{"code": 10000, "message": "Authentication error"}}})
+		return
+	}
+
+	const prefix = "/zones/zone-1/dns_records"
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	var result any
+	switch r.Method {
+	case http.MethodGet:
+		matches := []cloudflareRecord{}
+		for _, record := range f.records {
+			if record.Type == r.URL.Query().Get("type") && record.Name == r.URL.Query().Get("name") {
+				matches = append(matches, record)
+			}
+		}
+		result = matches
+	case http.MethodPost, http.MethodPut:
+		var record cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		if r.Method == http.MethodPost {
+			f.nextID++
+			id = string(rune('a' + f.nextID))
+		}
+		record.ID = id
+		f.records[id] = record
+		result = record
+	case http.MethodDelete:
+		delete(f.records, id)
+		result = map[string]string{"id": id}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "errors": []any{}, "result": result})
+}
+
+func TestCloudflare_UpsertAndDelete(t *testing.T) {
+	fake := &fakeCloudflare{records: make(map[string]cloudflareRecord)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cf := newCloudflare(server.Client(), "zone-1", "token")
+	cf.baseURL = server.URL
+	ctx := context.Background()
+
+	if err := cf.UpsertAAAA(ctx, "lab5-abc.labs.example.com", "2001:db8::1", 60); err != nil {
+		t.Fatalf("UpsertAAAA failed: %v", err)
+	}
+	// A second upsert updates the address instead of adding a record
+	if err := cf.UpsertAAAA(ctx, "lab5-abc.labs.example.com", "2001:db8::2", 60); err != nil {
+		t.Fatalf("second UpsertAAAA failed: %v", err)
+	}
+	if len(fake.records) != 1 {
+		t.Fatalf("expected 1 record, got %v", fake.records)
+	}
+	for _, record := range fake.records {
+		if record.Content != "2001:db8::2" || record.Type != "AAAA" || record.Proxied {
+			t.Errorf("unexpected record: %+v", record)
+		}
+	}
+
+	if err := cf.DeleteAAAA(ctx, "lab5-abc.labs.example.com"); err != nil {
+		t.Fatalf("DeleteAAAA failed: %v", err)
+	}
+	if len(fake.records) != 0 {
+		t.Errorf("expected record to be deleted, got %v", fake.records)
+	}
+
+	// Deleting a missing record is not an error
+	if err := cf.DeleteAAAA(ctx, "lab5-abc.labs.example.com"); err != nil {
+		t.Errorf("DeleteAAAA of missing record failed: %v", err)
+	}
+}
+
+func TestCloudflare_APIError(t *testing.T) {
+	server := httptest.NewServer(&fakeCloudflare{records: make(map[string]cloudflareRecord)})
+	defer server.Close()
+
+	cf := newCloudflare(server.Client(), "zone-1", "wrong-token")
+	cf.baseURL = server.URL
+
+	err := cf.UpsertAAAA(context.Background(), "lab5-abc.labs.example.com", "2001:db8::1", 60)
+	if err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Package dns registers stable hostnames for lab servers, so students and the SSH proxy
+// don't have to use raw IPv6 addresses.
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/userhash"
+)
+
+// Supported DNS providers
+const (
+	ProviderCloudflare = "cloudflare"
+	ProviderHetzner    = "hetzner"
+)
+
+const (
+	defaultRecordTTL = 60
+	requestTimeout   = 10 * time.Second
+
+	// userHashLength keeps hostnames short while still telling users apart
+	userHashLength = 12
+)
+
+// Provider manages AAAA records at a DNS hosting API
+type Provider interface {
+	// UpsertAAAA creates the AAAA record for fqdn or updates its address
+	UpsertAAAA(ctx context.Context, fqdn string, ipv6 string, ttl int) error
+	// DeleteAAAA removes the AAAA records for fqdn; a missing record is not an error
+	DeleteAAAA(ctx context.Context, fqdn string) error
+}
+
+// Config contains DNS integration settings
+type Config struct {
+	Provider string // cloudflare or hetzner; empty disables DNS registration
+	Zone     string // zone the lab hostnames are created in, e.g. labs.example.com
+	ZoneID   string // provider zone ID
+	APIToken string // provider API token
+	TTL      int    // record TTL in seconds (default: 60)
+}
+
+// Registrar names lab servers and keeps their AAAA records
+type Registrar struct {
+	provider Provider
+	zone     string
+	secret   string
+	ttl      int
+}
+
+// New creates the registrar for the configured provider.
+// Returns nil if no provider is configured.
+func New(cfg Config) (*Registrar, error) {
+	if cfg.Provider == "" {
+		return nil, nil
+	}
+
+	var missing []string
+	if cfg.Zone == "" {
+		missing = append(missing, "zone")
+	}
+	if cfg.ZoneID == "" {
+		missing = append(missing, "zone ID")
+	}
+	if cfg.APIToken == "" {
+		missing = append(missing, "API token")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("dns provider %s: missing %s", cfg.Provider, strings.Join(missing, ", "))
+	}
+
+	client := &http.Client{Timeout: requestTimeout}
+	var provider Provider
+	switch cfg.Provider {
+	case ProviderCloudflare:
+		provider = newCloudflare(client, cfg.ZoneID, cfg.APIToken)
+	case ProviderHetzner:
+		provider = newHetzner(client, cfg.Zone, cfg.ZoneID, cfg.APIToken)
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q", cfg.Provider)
+	}
+
+	return NewRegistrar(provider, cfg.Zone, userhash.SecretFromEnv(), cfg.TTL), nil
+}
+
+// NewRegistrar creates a registrar on top of provider. User IDs in hostnames are
+// hashed with secret; a ttl of 0 uses the default.
+func NewRegistrar(provider Provider, zone string, secret string, ttl int) *Registrar {
+	if ttl <= 0 {
+		ttl = defaultRecordTTL
+	}
+	return &Registrar{
+		provider: provider,
+		zone:     strings.TrimSuffix(zone, "."),
+		secret:   secret,
+		ttl:      ttl,
+	}
+}
+
+// Hostname returns the stable hostname of a user's lab server: lab{labId}-{user-hash}.{zone}
+func (r *Registrar) Hostname(webUserID string, labID int) string {
+	hash := userhash.Hash(r.secret, webUserID)[:userHashLength]
+	return fmt.Sprintf("lab%d-%s.%s", labID, hash, r.zone)
+}
+
+// Register points the lab server's hostname at ipv6 and returns the hostname
+func (r *Registrar) Register(ctx context.Context, webUserID string, labID int, ipv6 string) (string, error) {
+	if ipv6 == "" {
+		return "", fmt.Errorf("register dns record: server has no IPv6 address")
+	}
+
+	hostname := r.Hostname(webUserID, labID)
+	if err := r.provider.UpsertAAAA(ctx, hostname, ipv6, r.ttl); err != nil {
+		return "", fmt.Errorf("register dns record %s: %w", hostname, err)
+	}
+	return hostname, nil
+}
+
+// Unregister removes the hostname's AAAA record
+func (r *Registrar) Unregister(ctx context.Context, hostname string) error {
+	if err := r.provider.DeleteAAAA(ctx, hostname); err != nil {
+		return fmt.Errorf("unregister dns record %s: %w", hostname, err)
+	}
+	return nil
+}
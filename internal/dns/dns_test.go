@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeProvider records the AAAA records it was asked to manage
+type fakeProvider struct {
+	records   map[string]string
+	ttl       int
+	upsertErr error
+}
+
+func (f *fakeProvider) UpsertAAAA(ctx context.Context, fqdn string, ipv6 string, ttl int) error {
+	if f.upsertErr != nil {
+		return f.upsertErr
+	}
+	f.records[fqdn] = ipv6
+	f.ttl = ttl
+	return nil
+}
+
+func (f *fakeProvider) DeleteAAAA(ctx context.Context, fqdn string) error {
+	delete(f.records, fqdn)
+	return nil
+}
+
+func TestRegistrar_Hostname(t *testing.T) {
+	r := NewRegistrar(&fakeProvider{}, "labs.example.com.", "secret", 0)
+
+	hostname := r.Hostname("550e8400-e29b-41d4-a716-446655440000", 5)
+	if !regexp.MustCompile(`^lab5-[0-9a-f]{12}\.labs\.example\.com$`).MatchString(hostname) {
+		t.Errorf("unexpected hostname %q", hostname)
+	}
+	if strings.Contains(hostname, "550e8400") {
+		t.Error("hostname must not contain the raw web user ID")
+	}
+	if hostname != r.Hostname("550e8400-e29b-41d4-a716-446655440000", 5) {
+		t.Error("expected hostname to be stable")
+	}
+	if hostname == r.Hostname("other-user", 5) {
+		t.Error("expected different users to get different hostnames")
+	}
+}
+
+func TestRegistrar_RegisterAndUnregister(t *testing.T) {
+	provider := &fakeProvider{records: make(map[string]string)}
+	r := NewRegistrar(provider, "labs.example.com", "secret", 0)
+	ctx := context.Background()
+
+	hostname, err := r.Register(ctx, "user-123", 7, "2001:db8::1")
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if provider.records[hostname] != "2001:db8::1" {
+		t.Errorf("expected AAAA record for %s, got %v", hostname, provider.records)
+	}
+	if provider.ttl != defaultRecordTTL {
+		t.Errorf("expected default TTL %d, got %d", defaultRecordTTL, provider.ttl)
+	}
+
+	if err := r.Unregister(ctx, hostname); err != nil {
+		t.Fatalf("Unregister failed: %v", err)
+	}
+	if len(provider.records) != 0 {
+		t.Errorf("expected record to be removed, got %v", provider.records)
+	}
+}
+
+func TestRegistrar_RegisterErrors(t *testing.T) {
+	ctx := context.Background()
+
+	r := NewRegistrar(&fakeProvider{records: make(map[string]string)}, "labs.example.com", "", 0)
+	if _, err := r.Register(ctx, "user-123", 7, ""); err == nil {
+		t.Error("expected error for server without IPv6 address")
+	}
+
+	r = NewRegistrar(&fakeProvider{upsertErr: errors.New("api down")}, "labs.example.com", "", 0)
+	if _, err := r.Register(ctx, "user-123", 7, "2001:db8::1"); err == nil {
+		t.Error("expected provider error to be returned")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		enabled bool
+		wantErr bool
+	}{
+		{name: "disabled", cfg: Config{}},
+		{name: "cloudflare", cfg: Config{Provider: ProviderCloudflare, Zone: "labs.example.com", ZoneID: "z", APIToken: "t"}, enabled: true},
+		{name: "hetzner", cfg: Config{Provider: ProviderHetzner, Zone: "labs.example.com", ZoneID: "z", APIToken: "t"}, enabled: true},
+		{name: "missing token", cfg: Config{Provider: ProviderHetzner, Zone: "labs.example.com", ZoneID: "z"}, wantErr: true},
+		{name: "unknown provider", cfg: Config{Provider: "route53", Zone: "labs.example.com", ZoneID: "z", APIToken: "t"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error=%v, got %v", tt.wantErr, err)
+			}
+			if (r != nil) != tt.enabled {
+				t.Errorf("expected enabled=%v, got %v", tt.enabled, r != nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const hetznerBaseURL = "https://dns.hetzner.com/api/v1"
+
+// hetzner manages records through the Hetzner DNS API
+type hetzner struct {
+	client  *http.Client
+	baseURL string
+	zone    string
+	zoneID  string
+	token   string
+}
+
+func newHetzner(client *http.Client, zone, zoneID, token string) *hetzner {
+	return &hetzner{client: client, baseURL: hetznerBaseURL, zone: strings.TrimSuffix(zone, "."), zoneID: zoneID, token: token}
+}
+
+type hetznerRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"` // relative to the zone
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+func (h *hetzner) UpsertAAAA(ctx context.Context, fqdn string, ipv6 string, ttl int) error {
+	records, err := h.findAAAA(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	record := hetznerRecord{ZoneID: h.zoneID, Type: "AAAA", Name: h.relativeName(fqdn), Value: ipv6, TTL: ttl}
+	if len(records) == 0 {
+		return h.do(ctx, http.MethodPost, "/records", record, nil)
+	}
+	return h.do(ctx, http.MethodPut, "/records/"+records[0].ID, record, nil)
+}
+
+func (h *hetzner) DeleteAAAA(ctx context.Context, fqdn string) error {
+	records, err := h.findAAAA(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := h.do(ctx, http.MethodDelete, "/records/"+record.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relativeName strips the zone from fqdn; Hetzner stores record names relative to the zone
+func (h *hetzner) relativeName(fqdn string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), "."+h.zone)
+}
+
+// findAAAA returns the zone's AAAA records named fqdn
+func (h *hetzner) findAAAA(ctx context.Context, fqdn string) ([]hetznerRecord, error) {
+	var out struct {
+		Records []hetznerRecord `json:"records"`
+	}
+	query := url.Values{"zone_id": {h.zoneID}}
+	if err := h.do(ctx, http.MethodGet, "/records?"+query.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+
+	name := h.relativeName(fqdn)
+	var records []hetznerRecord
+	for _, record := range out.Records {
+		if record.Type == "AAAA" && record.Name == name {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// do sends a request and decodes the JSON response into out, if set
+func (h *hetzner) do(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal hetzner dns request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("build hetzner dns request: %w", err)
+	}
+	req.Header.Set("Auth-API-Token", h.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("hetzner dns %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("hetzner dns %s: status %d: %s", method, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("hetzner dns %s: decode response: %w", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeHetznerDNS serves the records endpoints from memory
+type fakeHetznerDNS struct {
+	mu      sync.Mutex
+	records map[string]hetznerRecord
+	nextID  int
+}
+
+func (f *fakeHetznerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Auth-API-Token") != "token" {
+		http.Error(w, `{"message":"Invalid authentication credentials"}`, http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/records"), "/")
+	switch r.Method {
+	case http.MethodGet:
+		records := []hetznerRecord{}
+		for _, record := range f.records {
+			if record.ZoneID == r.URL.Query().Get("zone_id") {
+				records = append(records, record)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"records": records})
+	case http.MethodPost, http.MethodPut:
+		var record hetznerRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		if r.Method == http.MethodPost {
+			f.nextID++
+			id = strconv.Itoa(f.nextID)
+		}
+		record.ID = id
+		f.records[id] = record
+		json.NewEncoder(w).Encode(map[string]any{"record": record})
+	case http.MethodDelete:
+		delete(f.records, id)
+	}
+}
+
+func TestHetzner_UpsertAndDelete(t *testing.T) {
+	fake := &fakeHetznerDNS{records: map[string]hetznerRecord{
+		// Records of the same name but another type are left alone
+		"txt": {ID: "txt", ZoneID: "zone-1", Type: "TXT", Name: "lab5-abc", Value: "keep"},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	h := newHetzner(server.Client(), "labs.example.com", "zone-1", "token")
+	h.baseURL = server.URL
+	ctx := context.Background()
+
+	if err := h.UpsertAAAA(ctx, "lab5-abc.labs.example.com", "2001:db8::1", 60); err != nil {
+		t.Fatalf("UpsertAAAA failed: %v", err)
+	}
+	if err := h.UpsertAAAA(ctx, "lab5-abc.labs.example.com", "2001:db8::2", 60); err != nil {
+		t.Fatalf("second UpsertAAAA failed: %v", err)
+	}
+
+	var aaaa []hetznerRecord
+	for _, record := range fake.records {
+		if record.Type == "AAAA" {
+			aaaa = append(aaaa, record)
+		}
+	}
+	if len(aaaa) != 1 || aaaa[0].Name != "lab5-abc" || aaaa[0].Value != "2001:db8::2" {
+		t.Fatalf("expected one relative AAAA record with the new address, got %+v", aaaa)
+	}
+
+	if err := h.DeleteAAAA(ctx, "lab5-abc.labs.example.com"); err != nil {
+		t.Fatalf("DeleteAAAA failed: %v", err)
+	}
+	if len(fake.records) != 1 || fake.records["txt"].Value != "keep" {
+		t.Errorf("expected only the TXT record to remain, got %+v", fake.records)
+	}
+}
+
+func TestHetzner_APIError(t *testing.T) {
+	server := httptest.NewServer(&fakeHetznerDNS{records: make(map[string]hetznerRecord)})
+	defer server.Close()
+
+	h := newHetzner(server.Client(), "labs.example.com", "zone-1", "wrong-token")
+	h.baseURL = server.URL
+
+	err := h.DeleteAAAA(context.Background(), "lab5-abc.labs.example.com")
+	if err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+}
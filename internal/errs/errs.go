@@ -0,0 +1,42 @@
+// Package errs defines the error kinds SWIM branches on. The Redis client and the connectors
+// mark their errors with these, so callers use errors.Is instead of comparing messages.
+package errs
+
+import "errors"
+
+// Error kinds
+var (
+	ErrNotFound    = errors.New("not found")       // the cache entry, secret or server does not exist
+	ErrRateLimited = errors.New("rate limited")    // the provider throttled the call
+	ErrCapacity    = errors.New("no capacity")     // the provider has no capacity for the request
+	ErrLocked      = errors.New("locked")          // another action holds the resource
+	ErrTransient   = errors.New("transient error") // retrying later may succeed
+)
+
+// marked is an error with a kind that doesn't show up in its message
+type marked struct {
+	err  error
+	kind error
+}
+
+func (m *marked) Error() string {
+	return m.err.Error()
+}
+
+func (m *marked) Unwrap() []error {
+	return []error{m.err, m.kind}
+}
+
+// Mark returns err with kind attached: errors.Is(result, kind) reports true, errors.Is and
+// errors.As still see err, and the message stays err's. A nil err stays nil.
+func Mark(err error, kind error) error {
+	if err == nil {
+		return nil
+	}
+	return &marked{err: err, kind: kind}
+}
+
+// New returns an error with message text and kind attached
+func New(text string, kind error) error {
+	return Mark(errors.New(text), kind)
+}
@@ -0,0 +1,30 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMark(t *testing.T) {
+	cause := errors.New("dial tcp: connection refused")
+	err := fmt.Errorf("failed to get from cache: %w", Mark(cause, ErrTransient))
+
+	if !errors.Is(err, ErrTransient) || !errors.Is(err, cause) {
+		t.Errorf("expected error to be both the kind and the cause, got %v", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Error("expected error not to match another kind")
+	}
+	if err.Error() != "failed to get from cache: dial tcp: connection refused" {
+		t.Errorf("expected the kind to stay out of the message, got %q", err)
+	}
+	if Mark(nil, ErrTransient) != nil {
+		t.Error("expected nil error to stay nil")
+	}
+
+	notFound := New("user hash not found", ErrNotFound)
+	if !errors.Is(notFound, ErrNotFound) || notFound.Error() != "user hash not found" {
+		t.Errorf("unexpected error from New: %v", notFound)
+	}
+}
@@ -0,0 +1,225 @@
+// Package export builds an inventory of lab servers from the cache and the cloud provider,
+// for course admins who need to know who is running what and what it costs.
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/userhash"
+)
+
+// Supported output formats
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Where a record's data came from
+const (
+	SourceBoth     = "cache+provider"
+	SourceCache    = "cache"    // cache entry whose server doesn't exist (yet)
+	SourceProvider = "provider" // managed server without a cache entry
+)
+
+// Store is the part of the Redis client the export reads
+type Store interface {
+	GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error)
+	GetUserByHash(ctx context.Context, hash string) (string, error)
+}
+
+// createdServer is implemented by servers whose creation time the provider reports
+type createdServer interface {
+	GetCreated() time.Time
+}
+
+// pricedServer is implemented by servers whose hourly price the provider reports
+type pricedServer interface {
+	GetHourlyPrice() float64
+}
+
+// Record is one lab server in the inventory
+type Record struct {
+	ServerID      string    `json:"serverId"`
+	Name          string    `json:"name"`
+	WebUserID     string    `json:"webUserId"`
+	LabID         int       `json:"labId"`
+	Status        string    `json:"status"`
+	Address       string    `json:"address"`
+	ServerType    string    `json:"serverType"`
+	Created       time.Time `json:"created"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	HourlyPrice   float64   `json:"hourlyPrice"`   // net price per hour
+	EstimatedCost float64   `json:"estimatedCost"` // net price from creation until expiry, per started hour
+	Source        string    `json:"source"`
+	Tenant        string    `json:"tenant,omitempty"`
+}
+
+// Collect merges the cached server states with the managed servers at the provider
+func Collect(ctx context.Context, store Store, conn connector.Connector, now time.Time) ([]Record, error) {
+	states, err := store.GetAllServerStates(ctx, config.ServerCachePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("read server states: %w", err)
+	}
+	servers, err := conn.GetServersByLabel(ctx, connector.LabelType, connector.LabelTypeLabHost)
+	if err != nil {
+		return nil, fmt.Errorf("list servers: %w", err)
+	}
+
+	byID := make(map[string]connector.Server, len(servers))
+	for _, server := range servers {
+		byID[server.GetID()] = server
+	}
+
+	records := make([]Record, 0, len(states)+len(servers))
+	for _, state := range states {
+		record := Record{
+			ServerID:   state.ServerID,
+			WebUserID:  state.WebUserID,
+			LabID:      state.LabID,
+			Status:     state.Status,
+			Address:    state.Address,
+			ServerType: state.ServerType,
+			ExpiresAt:  state.ExpiresAt,
+			Source:     SourceCache,
+			Tenant:     state.Tenant,
+		}
+		if server, ok := byID[state.ServerID]; ok {
+			delete(byID, state.ServerID)
+			applyServer(&record, server)
+			record.Source = SourceBoth
+		}
+		records = append(records, record)
+	}
+
+	// Whatever is left runs at the provider without a cache entry
+	for _, server := range byID {
+		labels := server.GetLabels()
+		record := Record{
+			ServerID:  server.GetID(),
+			WebUserID: labels[userhash.LabelWebUserID],
+			Status:    "untracked",
+			Address:   server.GetIPv6Address(),
+			Source:    SourceProvider,
+			Tenant:    labels[connector.LabelTenant],
+		}
+		if record.WebUserID == "" && labels[userhash.LabelWebUserHash] != "" {
+			if webUserID, err := store.GetUserByHash(ctx, labels[userhash.LabelWebUserHash]); err == nil {
+				record.WebUserID = webUserID
+			}
+		}
+		if labID, err := strconv.Atoi(labels[connector.LabelLabID]); err == nil {
+			record.LabID = labID
+		}
+		applyServer(&record, server)
+		records = append(records, record)
+	}
+
+	for i := range records {
+		records[i].EstimatedCost = estimateCost(records[i], now)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].LabID != records[j].LabID {
+			return records[i].LabID < records[j].LabID
+		}
+		return records[i].WebUserID < records[j].WebUserID
+	})
+	return records, nil
+}
+
+// applyServer fills in the live provider data of a record
+func applyServer(record *Record, server connector.Server) {
+	record.Name = server.GetName()
+	if record.Address == "" {
+		record.Address = server.GetIPv6Address()
+	}
+	if record.ServerType == "" {
+		record.ServerType = server.GetServerType()
+	}
+	if s, ok := server.(createdServer); ok {
+		record.Created = s.GetCreated()
+	}
+	if s, ok := server.(pricedServer); ok {
+		record.HourlyPrice = s.GetHourlyPrice()
+	}
+}
+
+// estimateCost prices a server from creation until it expires, or until now if it has
+// no expiry or is already past it. Hetzner bills every started hour.
+func estimateCost(record Record, now time.Time) float64 {
+	if record.HourlyPrice == 0 || record.Created.IsZero() {
+		return 0
+	}
+	end := now
+	if record.ExpiresAt.After(now) {
+		end = record.ExpiresAt
+	}
+	hours := math.Ceil(end.Sub(record.Created).Hours())
+	if hours < 1 {
+		hours = 1
+	}
+	return math.Round(hours*record.HourlyPrice*10000) / 10000
+}
+
+// Write writes records to w in format
+func Write(w io.Writer, format string, records []Record) error {
+	switch format {
+	case FormatJSON:
+		return WriteJSON(w, records)
+	case FormatCSV:
+		return WriteCSV(w, records)
+	default:
+		return fmt.Errorf("unknown export format %q (want %s or %s)", format, FormatJSON, FormatCSV)
+	}
+}
+
+// WriteJSON writes records as an indented JSON array
+func WriteJSON(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+// WriteCSV writes records as CSV with a header row
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"server_id", "name", "webuserid", "lab_id", "status", "address", "server_type",
+		"created", "expires_at", "hourly_price", "estimated_cost", "source", "tenant"})
+	for _, r := range records {
+		cw.Write([]string{
+			r.ServerID,
+			r.Name,
+			r.WebUserID,
+			strconv.Itoa(r.LabID),
+			r.Status,
+			r.Address,
+			r.ServerType,
+			formatTime(r.Created),
+			formatTime(r.ExpiresAt),
+			strconv.FormatFloat(r.HourlyPrice, 'f', 4, 64),
+			strconv.FormatFloat(r.EstimatedCost, 'f', 4, 64),
+			r.Source,
+			r.Tenant,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,157 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/userhash"
+)
+
+type fakeStore struct {
+	states []redis.ServerState
+	users  map[string]string
+}
+
+func (f *fakeStore) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+	return f.states, nil
+}
+
+func (f *fakeStore) GetUserByHash(ctx context.Context, hash string) (string, error) {
+	if user, ok := f.users[hash]; ok {
+		return user, nil
+	}
+	return "", fmt.Errorf("hash %s not found", hash)
+}
+
+type fakeServer struct {
+	id      string
+	labels  map[string]string
+	created time.Time
+	price   float64
+}
+
+func (s *fakeServer) GetID() string                                { return s.id }
+func (s *fakeServer) GetName() string                              { return "lab-" + s.id }
+func (s *fakeServer) GetIPv6Address() string                       { return "2001:db8::" + s.id }
+func (s *fakeServer) GetLabels() map[string]string                 { return s.labels }
+func (s *fakeServer) GetServerType() string                        { return "cpx21" }
+func (s *fakeServer) GetSSHHostKey() string                        { return "" }
+func (s *fakeServer) GetState(ctx context.Context) (string, error) { return "running", nil }
+func (s *fakeServer) Delete(ctx context.Context) error             { return nil }
+func (s *fakeServer) Rebuild(ctx context.Context) error            { return nil }
+func (s *fakeServer) Resize(ctx context.Context, t string) error   { return nil }
+func (s *fakeServer) String() string                               { return s.id }
+func (s *fakeServer) GetCreated() time.Time                        { return s.created }
+func (s *fakeServer) GetHourlyPrice() float64                      { return s.price }
+
+type fakeConnector struct {
+	servers []connector.Server
+}
+
+func (c *fakeConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
+	return c.servers, nil
+}
+
+// GetConsoleURL implements connector.Connector.GetConsoleURL
+func (c *fakeConnector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// MapState implements connector.Connector.MapState
+func (c *fakeConnector) MapState(cloudState string) (string, bool) {
+	return cloudState, cloudState == "running"
+}
+func (c *fakeConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+func (c *fakeConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+func (c *fakeConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	return c.servers, nil
+}
+func (c *fakeConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func testInventory(t *testing.T) []Record {
+	t.Helper()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store := &fakeStore{
+		states: []redis.ServerState{
+			{ServerID: "1", WebUserID: "alice", LabID: 12, Status: "running", ExpiresAt: now.Add(30 * time.Minute)},
+			{WebUserID: "bob", LabID: 12, Status: "provisioning"},
+		},
+		users: map[string]string{"hash-carol": "carol"},
+	}
+	conn := &fakeConnector{servers: []connector.Server{
+		&fakeServer{id: "1", created: now.Add(-90 * time.Minute), price: 0.01},
+		&fakeServer{id: "2", created: now.Add(-10 * time.Minute), price: 0.02,
+			labels: map[string]string{userhash.LabelWebUserHash: "hash-carol", connector.LabelLabID: "7"}},
+	}}
+
+	records, err := Collect(context.Background(), store, conn, now)
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	return records
+}
+
+func TestCollect(t *testing.T) {
+	records := testInventory(t)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d: %+v", len(records), records)
+	}
+
+	orphan, alice, bob := records[0], records[1], records[2]
+	if orphan.Source != SourceProvider || orphan.WebUserID != "carol" || orphan.LabID != 7 {
+		t.Errorf("expected untracked server resolved to carol in lab 7, got %+v", orphan)
+	}
+	if alice.Source != SourceBoth || alice.Name != "lab-1" || alice.ServerType != "cpx21" {
+		t.Errorf("expected alice's entry merged with the live server, got %+v", alice)
+	}
+	// 90 minutes running plus 30 until expiry is two started hours
+	if alice.EstimatedCost != 0.02 {
+		t.Errorf("expected estimated cost 0.02, got %v", alice.EstimatedCost)
+	}
+	if bob.Source != SourceCache || bob.EstimatedCost != 0 {
+		t.Errorf("expected bob's pending entry from the cache only, got %+v", bob)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	records := testInventory(t)
+
+	var jsonOut bytes.Buffer
+	if err := Write(&jsonOut, FormatJSON, records); err != nil {
+		t.Fatalf("json export failed: %v", err)
+	}
+	var decoded []Record
+	if err := json.Unmarshal(jsonOut.Bytes(), &decoded); err != nil || len(decoded) != 3 {
+		t.Errorf("expected 3 JSON records, got %d (%v)", len(decoded), err)
+	}
+
+	var csvOut bytes.Buffer
+	if err := Write(&csvOut, FormatCSV, records); err != nil {
+		t.Fatalf("csv export failed: %v", err)
+	}
+	rows, err := csv.NewReader(&csvOut).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid csv: %v", err)
+	}
+	if len(rows) != 4 || rows[0][0] != "server_id" || rows[2][2] != "alice" || rows[2][10] != "0.0200" {
+		t.Errorf("unexpected csv rows: %v", rows)
+	}
+
+	if err := Write(&bytes.Buffer{}, "xml", records); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Errorf("expected unknown format error, got %v", err)
+	}
+}
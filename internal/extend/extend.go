@@ -0,0 +1,284 @@
+// Package extend moves the expiry of a user's running server on their request, e.g. when a
+// student clicks "extend 30 minutes" in LabMan. Extensions are rate limited per user, limited
+// per user and day and by the total length of a session; the outcome of each request,
+// including why it was rejected, is cached with the server state for LabMan to show.
+package extend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// Request minutes
+const (
+	DefaultMinutes = 30
+	MaxMinutes     = 240
+)
+
+// Outcomes of an extension request
+const (
+	StatusGranted  = "granted"
+	StatusRejected = "rejected"
+)
+
+// Reasons an extension request is rejected or granted in part
+const (
+	ReasonSessionLimit = "session_limit" // the server reached the longest session allowed
+	ReasonDailyLimit   = "daily_limit"   // the user had all extensions of the day
+	ReasonNotRunning   = "not_running"   // the server isn't running, e.g. still provisioning or being stopped
+	ReasonQuarantined  = "quarantined"   // the server was powered off for suspected abuse
+)
+
+// minExtension is the smallest move of the expiry granted as an extension
+const minExtension = 1 * time.Minute
+
+// errNoRoom aborts an extension the fresh entry leaves no room for
+var errNoRoom = errors.New("no room to extend")
+
+// Request asks to move the expiry of the server a user is running by Minutes
+type Request struct {
+	WebUserID     string `json:"webuserid"`
+	Minutes       int    `json:"minutes,omitempty"` // Optional: DefaultMinutes if omitted
+	LabID         *int   `json:"labId,omitempty"`   // Optional: only extend if the cached server runs this lab
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"` // Optional: traces the request through logs
+}
+
+// Limits bound the extensions of each user
+type Limits struct {
+	MaxSession time.Duration // longest a server may run after its creation
+	PerDay     int           // extensions granted to a user per UTC day
+}
+
+// Handler extends the servers of extension requests within the limits
+type Handler struct {
+	log         *slog.Logger
+	redisClient redis.ClientInterface
+	counter     redis.ExtensionCounter
+	limits      Limits
+	tenants     *tenant.Registry
+	history     redis.HistoryRecorder
+	now         func() time.Time
+}
+
+// New creates a Handler that counts the extensions of each user in counter
+func New(log *slog.Logger, redisClient redis.ClientInterface, counter redis.ExtensionCounter, limits Limits) *Handler {
+	return &Handler{log: log, redisClient: redisClient, counter: counter, limits: limits, now: time.Now}
+}
+
+// WithTenants resolves the tenant of each request for its cache namespace.
+// Without a registry only requests for the default tenant are accepted.
+func (h *Handler) WithTenants(registry *tenant.Registry) *Handler {
+	h.tenants = registry
+	return h
+}
+
+// WithHistory keeps granted and rejected extensions in the history of each user
+func (h *Handler) WithHistory(recorder redis.HistoryRecorder) *Handler {
+	h.history = recorder
+	return h
+}
+
+// ProcessRequest handles a single extension request from the queue
+func (h *Handler) ProcessRequest(ctx context.Context, payload string) {
+	var req Request
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		h.log.Error("failed to parse extension request", "error", err)
+		return
+	}
+	if req.Minutes == 0 {
+		req.Minutes = DefaultMinutes
+	}
+	errList := []error{validate.WebUserID(req.WebUserID), validate.CorrelationID(req.CorrelationID),
+		validate.Text("tenant", req.Tenant, validate.MaxLabelLength)}
+	if req.Minutes < 1 || req.Minutes > MaxMinutes {
+		errList = append(errList, fmt.Errorf("minutes %d is out of range 1-%d", req.Minutes, MaxMinutes))
+	}
+	if req.LabID != nil {
+		errList = append(errList, validate.LabID(*req.LabID))
+	}
+	if err := validate.First(errList...); err != nil {
+		h.log.Error("rejecting invalid extension request", "error", err)
+		return
+	}
+
+	ctx = tracing.WithCorrelationID(ctx, req.CorrelationID)
+	reqLog := tracing.Logger(ctx, h.log).With("webuserid", req.WebUserID, "minutes", req.Minutes)
+
+	t, err := h.tenants.Get(req.Tenant)
+	if err != nil {
+		reqLog.Error("rejecting extension request", "error", err)
+		return
+	}
+
+	userID := redis.TenantUserID(t.ID, req.WebUserID)
+
+	// A double click must not take two extensions of the day. The request is dropped without
+	// caching a result, which would hide the outcome of the one it repeats.
+	allowed, err := h.redisClient.TryAcquireRateLimit(ctx, userID, redis.RateLimitExtend, t.ExtendRateLimit())
+	if err != nil {
+		reqLog.Error("failed to check rate limit, dropping message", "error", err)
+		return
+	}
+	if !allowed {
+		reqLog.Warn("extension rate limit hit, dropping message")
+		h.recordHistory(ctx, redis.Event{Type: redis.EventRateLimited, WebUserID: req.WebUserID, Tenant: t.ID})
+		return
+	}
+
+	cacheKey := redis.ServerCacheKey(userID)
+	state, err := h.redisClient.GetServerState(ctx, cacheKey)
+	if errors.Is(err, errs.ErrNotFound) {
+		reqLog.Warn("no server to extend")
+		return
+	}
+	if err != nil {
+		reqLog.Error("failed to read server state", "error", err)
+		return
+	}
+	if req.LabID != nil && state.LabID != *req.LabID {
+		reqLog.Warn("labId mismatch, ignoring stale extension request", "requested_labid", *req.LabID, "current_labid", state.LabID)
+		return
+	}
+	serverLog := reqLog.With("server_id", state.ServerID, "labid", state.LabID)
+
+	now := h.now()
+	result := redis.ExtensionResult{ExtensionsPerDay: h.limits.PerDay, MaxExpiresAt: h.maxExpiresAt(*state), At: now}
+	if state.Status != config.StatusRunning || state.ServerID == "" {
+		serverLog.Warn("server is not running, rejecting extension request", "status", state.Status)
+		h.reject(ctx, *state, result, ReasonNotRunning)
+		return
+	}
+	if state.CloudStatus == config.CloudStatusQuarantined {
+		serverLog.Warn("server is quarantined, rejecting extension request")
+		h.reject(ctx, *state, result, ReasonQuarantined)
+		return
+	}
+	if _, _, ok := h.extendedExpiry(*state, req.Minutes, now); !ok {
+		serverLog.Info("server reached the session limit, rejecting extension request", "max_expires_at", result.MaxExpiresAt)
+		h.reject(ctx, *state, result, ReasonSessionLimit)
+		return
+	}
+
+	count, ok, err := h.counter.AcquireExtension(ctx, userID, now, h.limits.PerDay)
+	if err != nil {
+		serverLog.Error("failed to count extension", "error", err)
+		return
+	}
+	result.ExtensionsToday = count
+	if !ok {
+		serverLog.Info("user had all extensions of the day, rejecting extension request", "extensions_today", count)
+		h.reject(ctx, *state, result, ReasonDailyLimit)
+		return
+	}
+
+	// Re-check on the fresh entry, which may be a new server or already being decommissioned
+	serverID := state.ServerID
+	updated, err := redis.UpdateServerState(ctx, h.redisClient, cacheKey, config.ServerCacheTTL, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != serverID || fresh.Status != config.StatusRunning || fresh.CloudStatus == config.CloudStatusQuarantined {
+			return lifecycle.ErrSuperseded
+		}
+		expiresAt, shortened, ok := h.extendedExpiry(*fresh, req.Minutes, now)
+		if !ok {
+			return errNoRoom
+		}
+		granted := result
+		granted.Status = StatusGranted
+		granted.Minutes = int(expiresAt.Sub(fresh.ExpiresAt) / time.Minute)
+		if shortened {
+			granted.Reason = ReasonSessionLimit
+		}
+		fresh.ExpiresAt = expiresAt
+		fresh.Extension = &granted
+		return nil
+	})
+	if err != nil {
+		if err := h.counter.ReleaseExtension(ctx, userID, now); err != nil {
+			serverLog.Warn("failed to release extension", "error", err)
+		}
+		if errors.Is(err, errNoRoom) {
+			h.reject(ctx, *state, result, ReasonSessionLimit)
+			return
+		}
+		// Decommissioned or replaced since it was read
+		serverLog.Warn("server state changed, skipping extension", "error", err)
+		return
+	}
+
+	serverLog.Info("extended server expiry", "expires_at", updated.ExpiresAt, "minutes", updated.Extension.Minutes, "extensions_today", count)
+	h.recordHistory(ctx, redis.Event{Type: redis.EventExtended, WebUserID: updated.WebUserID, Tenant: updated.Tenant,
+		LabID: updated.LabID, ServerID: serverID, Message: fmt.Sprintf("extended by %d minutes", updated.Extension.Minutes)})
+}
+
+// maxExpiresAt returns the latest expiry extensions can give state. Entries without a
+// creation time can't be bounded and are never extended.
+func (h *Handler) maxExpiresAt(state redis.ServerState) time.Time {
+	if state.CreatedAt.IsZero() {
+		return state.ExpiresAt
+	}
+	return state.CreatedAt.Add(h.limits.MaxSession)
+}
+
+// extendedExpiry returns the expiry of state after extending it by minutes at now, whether
+// the session limit shortened it, and whether it moves the current expiry by at least
+// minExtension. An expiry that has passed already is extended from now.
+func (h *Handler) extendedExpiry(state redis.ServerState, minutes int, now time.Time) (time.Time, bool, bool) {
+	from := state.ExpiresAt
+	if from.Before(now) {
+		from = now
+	}
+	expiresAt := from.Add(time.Duration(minutes) * time.Minute)
+	shortened := false
+	if limit := h.maxExpiresAt(state); expiresAt.After(limit) {
+		expiresAt = limit
+		shortened = true
+	}
+	if expiresAt.Sub(state.ExpiresAt) < minExtension {
+		return time.Time{}, false, false
+	}
+	return expiresAt, shortened, true
+}
+
+// reject caches the rejection of an extension request with its reason, leaving the rest of
+// the entry alone. The rejection is informational, so a failure is only logged.
+func (h *Handler) reject(ctx context.Context, state redis.ServerState, result redis.ExtensionResult, reason string) {
+	result.Status = StatusRejected
+	result.Reason = reason
+	_, err := redis.UpdateServerState(ctx, h.redisClient, state.CacheKey(), config.ServerCacheTTL, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != state.ServerID {
+			return lifecycle.ErrSuperseded
+		}
+		fresh.Extension = &result
+		return nil
+	})
+	if err != nil && !errors.Is(err, lifecycle.ErrSuperseded) && !errors.Is(err, errs.ErrNotFound) {
+		tracing.Logger(ctx, h.log).Warn("failed to record extension rejection", "error", err)
+	}
+	h.recordHistory(ctx, redis.Event{Type: redis.EventExtensionDenied, WebUserID: state.WebUserID, Tenant: state.Tenant,
+		LabID: state.LabID, ServerID: state.ServerID, Message: reason})
+}
+
+// recordHistory keeps an event in the history of its user.
+// History is informational, so a failure is only logged.
+func (h *Handler) recordHistory(ctx context.Context, event redis.Event) {
+	if h.history == nil {
+		return
+	}
+	event.Operation = "extend"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := h.history.RecordHistory(ctx, redis.TenantUserID(event.Tenant, event.WebUserID), event); err != nil {
+		tracing.Logger(ctx, h.log).Warn("failed to record history", "type", event.Type, "error", err)
+	}
+}
@@ -0,0 +1,183 @@
+package extend
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeCache holds cached states by key and grants every rate limit unless limited
+type fakeCache struct {
+	redis.ClientInterface
+	states  map[string]redis.ServerState
+	limited bool
+}
+
+func (f *fakeCache) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
+	return !f.limited, nil
+}
+
+func (f *fakeCache) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	state, ok := f.states[cacheKey]
+	if !ok {
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
+	}
+	return &state, nil
+}
+
+func (f *fakeCache) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	f.states[cacheKey] = state
+	return nil
+}
+
+// fakeCounter counts extensions per user, ignoring the day
+type fakeCounter struct {
+	counts map[string]int
+}
+
+func (c *fakeCounter) AcquireExtension(ctx context.Context, userID string, at time.Time, limit int) (int, bool, error) {
+	if c.counts[userID] >= limit {
+		return c.counts[userID], false, nil
+	}
+	c.counts[userID]++
+	return c.counts[userID], true, nil
+}
+
+func (c *fakeCounter) ReleaseExtension(ctx context.Context, userID string, at time.Time) error {
+	c.counts[userID]--
+	return nil
+}
+
+func TestProcessRequest(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	key := redis.ServerCacheKey("user-1")
+	running := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", Status: config.StatusRunning, Available: true,
+		CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(10 * time.Minute)}
+
+	tests := []struct {
+		name        string
+		payload     string
+		state       *redis.ServerState
+		usedToday   int
+		limited     bool
+		wantExpires time.Time // cached expiry afterwards
+		wantResult  *redis.ExtensionResult
+		wantCount   int // extensions counted afterwards
+	}{
+		{
+			name:        "default extension",
+			payload:     `{"webuserid":"user-1"}`,
+			state:       &running,
+			wantExpires: now.Add(40 * time.Minute),
+			wantResult:  &redis.ExtensionResult{Status: StatusGranted, Minutes: 30, ExtensionsToday: 1},
+			wantCount:   1,
+		},
+		{
+			name:        "shortened by the session limit",
+			payload:     `{"webuserid":"user-1","minutes":120}`,
+			state:       &running,
+			wantExpires: now.Add(time.Hour),
+			wantResult:  &redis.ExtensionResult{Status: StatusGranted, Reason: ReasonSessionLimit, Minutes: 50, ExtensionsToday: 1},
+			wantCount:   1,
+		},
+		{
+			name:        "session limit reached",
+			payload:     `{"webuserid":"user-1"}`,
+			state:       &redis.ServerState{WebUserID: "user-1", ServerID: "42", Status: config.StatusRunning, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+			wantExpires: now.Add(time.Hour),
+			wantResult:  &redis.ExtensionResult{Status: StatusRejected, Reason: ReasonSessionLimit},
+		},
+		{
+			name:        "daily limit reached",
+			payload:     `{"webuserid":"user-1"}`,
+			state:       &running,
+			usedToday:   2,
+			wantExpires: running.ExpiresAt,
+			wantResult:  &redis.ExtensionResult{Status: StatusRejected, Reason: ReasonDailyLimit, ExtensionsToday: 2},
+			wantCount:   2,
+		},
+		{
+			name:        "server not running",
+			payload:     `{"webuserid":"user-1"}`,
+			state:       &redis.ServerState{WebUserID: "user-1", ServerID: "42", Status: config.StatusStopping, CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(10 * time.Minute)},
+			wantExpires: now.Add(10 * time.Minute),
+			wantResult:  &redis.ExtensionResult{Status: StatusRejected, Reason: ReasonNotRunning},
+		},
+		{
+			name:    "quarantined server",
+			payload: `{"webuserid":"user-1"}`,
+			state: &redis.ServerState{WebUserID: "user-1", ServerID: "42", Status: config.StatusRunning, CloudStatus: config.CloudStatusQuarantined,
+				CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(10 * time.Minute)},
+			wantExpires: now.Add(10 * time.Minute),
+			wantResult:  &redis.ExtensionResult{Status: StatusRejected, Reason: ReasonQuarantined},
+		},
+		{
+			name:        "rate limited",
+			payload:     `{"webuserid":"user-1"}`,
+			state:       &running,
+			limited:     true,
+			wantExpires: running.ExpiresAt,
+		},
+		{
+			name:        "stale labId",
+			payload:     `{"webuserid":"user-1","labId":6}`,
+			state:       &running,
+			wantExpires: running.ExpiresAt,
+		},
+		{
+			name:        "minutes out of range",
+			payload:     `{"webuserid":"user-1","minutes":-5}`,
+			state:       &running,
+			wantExpires: running.ExpiresAt,
+		},
+		{name: "no server", payload: `{"webuserid":"user-1"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &fakeCache{states: map[string]redis.ServerState{}, limited: tt.limited}
+			if tt.state != nil {
+				cache.states[key] = *tt.state
+			}
+			counter := &fakeCounter{counts: map[string]int{"user-1": tt.usedToday}}
+
+			h := New(log, cache, counter, Limits{MaxSession: 2 * time.Hour, PerDay: 2})
+			h.now = func() time.Time { return now }
+			h.ProcessRequest(context.Background(), tt.payload)
+
+			if counter.counts["user-1"] != tt.wantCount {
+				t.Errorf("expected %d extensions counted, got %d", tt.wantCount, counter.counts["user-1"])
+			}
+			state, ok := cache.states[key]
+			if !ok {
+				if tt.state != nil {
+					t.Fatal("expected the entry to be kept")
+				}
+				return
+			}
+			if !state.ExpiresAt.Equal(tt.wantExpires) {
+				t.Errorf("expected expiry %v, got %v", tt.wantExpires, state.ExpiresAt)
+			}
+			if tt.wantResult == nil {
+				if state.Extension != nil {
+					t.Errorf("expected no extension result, got %+v", state.Extension)
+				}
+				return
+			}
+			want := *tt.wantResult
+			want.ExtensionsPerDay = 2
+			want.MaxExpiresAt = state.CreatedAt.Add(2 * time.Hour)
+			want.At = now
+			if state.Extension == nil || *state.Extension != want {
+				t.Errorf("expected extension result %+v, got %+v", want, state.Extension)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Package flags reads runtime feature flags, which operators flip in Redis to change how SWIM
+// behaves without a redeploy, e.g. to pause cleanup during an incident:
+//
+//	SET vmmanager:flags:pause-cleanup on
+//
+// A flag is on for "1", "true", "on" or "yes" and off for "0", "false", "off" or "no"; a flag
+// that is unset or has another value keeps its default. Every instance reads a flag again at
+// most every few seconds, so a change takes effect everywhere within that time.
+package flags
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Feature flags
+const (
+	ReadinessProbe    = "readiness-probe"     // probe Remote Desktop and the lab's readiness check before a server is available (default: on)
+	ReconcilerAutoFix = "reconciler-auto-fix" // let the watchdog apply STUCK_REMEDIATION to stuck entries (default: on)
+	PauseCleanup      = "pause-cleanup"       // stop queuing and deleting expired servers (default: off)
+)
+
+// defaults are the values of flags that aren't set; unknown flags are off
+var defaults = map[string]bool{
+	ReadinessProbe:    true,
+	ReconcilerAutoFix: true,
+	PauseCleanup:      false,
+}
+
+// defaultRefresh is how long a flag value is used before it is read again
+const defaultRefresh = 5 * time.Second
+
+// Default returns the value of the flag name when it isn't set
+func Default(name string) bool {
+	return defaults[name]
+}
+
+// reading is a flag value and when it was read
+type reading struct {
+	enabled bool
+	readAt  time.Time
+}
+
+// Reader reads feature flags from Redis, caching each for a few seconds. A nil Reader
+// reports every flag's default.
+type Reader struct {
+	log     *slog.Logger
+	store   redis.FlagReader
+	refresh time.Duration
+	clock   clock.Clock
+
+	mu       sync.Mutex
+	readings map[string]reading
+}
+
+// New creates a Reader of the flags in store
+func New(log *slog.Logger, store redis.FlagReader) *Reader {
+	return &Reader{
+		log:      log,
+		store:    store,
+		refresh:  defaultRefresh,
+		clock:    clock.Real,
+		readings: make(map[string]reading),
+	}
+}
+
+// WithClock measures how long flags are cached with c instead of the system clock
+func (r *Reader) WithClock(c clock.Clock) *Reader {
+	r.clock = c
+	return r
+}
+
+// Enabled reports whether the flag name is on. A flag that can't be read keeps its last
+// known value, or its default if it was never read.
+func (r *Reader) Enabled(ctx context.Context, name string) bool {
+	if r == nil {
+		return Default(name)
+	}
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	last, known := r.readings[name]
+	r.mu.Unlock()
+	if known && now.Sub(last.readAt) < r.refresh {
+		return last.enabled
+	}
+
+	enabled := Default(name)
+	if known {
+		enabled = last.enabled
+	}
+	value, set, err := r.store.GetFlag(ctx, name)
+	switch {
+	case err != nil:
+		r.log.Warn("failed to read feature flag, keeping its value", "flag", name, "enabled", enabled, "error", err)
+	case !set:
+		enabled = Default(name)
+	default:
+		parsed, ok := parse(value)
+		if !ok {
+			r.log.Warn("invalid feature flag value, using the default", "flag", name, "value", value, "default", Default(name))
+			parsed = Default(name)
+		}
+		enabled = parsed
+	}
+
+	r.mu.Lock()
+	r.readings[name] = reading{enabled: enabled, readAt: now}
+	r.mu.Unlock()
+	// Flags set at startup are logged like flags flipped later
+	if known && enabled != last.enabled || !known && enabled != Default(name) {
+		r.log.Info("feature flag changed", "flag", name, "enabled", enabled)
+	}
+	return enabled
+}
+
+// parse reads a flag value, reporting false if it is neither on nor off
+func parse(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "on", "yes":
+		return true, true
+	case "0", "false", "off", "no":
+		return false, true
+	}
+	return false, false
+}
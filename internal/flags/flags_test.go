@@ -0,0 +1,90 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+// failingStore can't be read
+type failingStore struct{}
+
+func (failingStore) GetFlag(ctx context.Context, name string) (string, bool, error) {
+	return "", false, errors.New("connection refused")
+}
+
+func newTestReader(store *redistest.Store) (*Reader, *clock.Fake) {
+	now := clock.NewFake(time.Now())
+	return New(slog.New(slog.NewTextHandler(io.Discard, nil)), store).WithClock(now), now
+}
+
+func TestReader_Enabled(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		flag  string
+		value string // "" leaves the flag unset
+		want  bool
+	}{
+		{name: "unset keeps default on", flag: ReadinessProbe, want: true},
+		{name: "unset keeps default off", flag: PauseCleanup, want: false},
+		{name: "on", flag: PauseCleanup, value: "on", want: true},
+		{name: "true", flag: PauseCleanup, value: "TRUE", want: true},
+		{name: "off", flag: ReadinessProbe, value: "0", want: false},
+		{name: "invalid keeps default", flag: ReadinessProbe, value: "maybe", want: true},
+		{name: "unknown flags are off", flag: "no-such-flag", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := redistest.New()
+			if tt.value != "" {
+				store.SetFlag(tt.flag, tt.value)
+			}
+			reader, _ := newTestReader(store)
+			if got := reader.Enabled(ctx, tt.flag); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReader_Refresh(t *testing.T) {
+	ctx := context.Background()
+	store := redistest.New()
+	reader, now := newTestReader(store)
+
+	if reader.Enabled(ctx, PauseCleanup) {
+		t.Fatal("expected cleanup to run by default")
+	}
+
+	// A flipped flag is seen once the cached value is stale
+	store.SetFlag(PauseCleanup, "on")
+	if reader.Enabled(ctx, PauseCleanup) {
+		t.Error("expected the cached value within the refresh interval")
+	}
+	now.Advance(defaultRefresh)
+	if !reader.Enabled(ctx, PauseCleanup) {
+		t.Error("expected the flipped flag after the refresh interval")
+	}
+
+	// An unreadable flag keeps its last value
+	reader.store = failingStore{}
+	now.Advance(defaultRefresh)
+	if !reader.Enabled(ctx, PauseCleanup) {
+		t.Error("expected the last known value while Redis is unreachable")
+	}
+}
+
+func TestReader_Nil(t *testing.T) {
+	var reader *Reader
+	if !reader.Enabled(context.Background(), ReconcilerAutoFix) || reader.Enabled(context.Background(), PauseCleanup) {
+		t.Error("expected a nil reader to report the defaults")
+	}
+}
@@ -0,0 +1,98 @@
+// Package heartbeat keeps a SWIM instance registered in Redis while it runs,
+// so replicas and operators can tell which instances are alive.
+package heartbeat
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Publisher stores instance heartbeats
+type Publisher interface {
+	PublishInstance(ctx context.Context, info redis.InstanceInfo, ttl time.Duration) error
+}
+
+// Worker periodically publishes the instance heartbeat
+type Worker struct {
+	log       *slog.Logger
+	publisher Publisher
+	interval  time.Duration
+	ttl       time.Duration
+
+	mu   sync.Mutex
+	info redis.InstanceInfo
+}
+
+// New creates a heartbeat Worker for the given instance.
+// The instance starts in the running status; StartedAt defaults to now.
+func New(log *slog.Logger, publisher Publisher, info redis.InstanceInfo) *Worker {
+	if info.StartedAt.IsZero() {
+		info.StartedAt = time.Now().UTC()
+	}
+	info.Status = config.InstanceRunning
+
+	return &Worker{
+		log:       log,
+		publisher: publisher,
+		interval:  config.HeartbeatInterval,
+		ttl:       config.HeartbeatTTL,
+		info:      info,
+	}
+}
+
+// WithInterval sets a custom heartbeat interval and TTL (useful for testing)
+func (w *Worker) WithInterval(interval, ttl time.Duration) *Worker {
+	w.interval = interval
+	w.ttl = ttl
+	return w
+}
+
+// Info returns the current heartbeat record
+func (w *Worker) Info() redis.InstanceInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.info
+}
+
+// Run publishes the heartbeat immediately and then every interval until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	w.publish(ctx)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.publish(ctx)
+		}
+	}
+}
+
+// Drain switches the instance to the draining status and publishes it right away
+func (w *Worker) Drain(ctx context.Context) {
+	w.mu.Lock()
+	w.info.Status = config.InstanceDraining
+	w.mu.Unlock()
+
+	w.publish(ctx)
+}
+
+// publish writes the current heartbeat record
+func (w *Worker) publish(ctx context.Context) {
+	w.mu.Lock()
+	w.info.UpdatedAt = time.Now().UTC()
+	info := w.info
+	w.mu.Unlock()
+
+	if err := w.publisher.PublishInstance(ctx, info, w.ttl); err != nil {
+		w.log.Warn("failed to publish heartbeat", "instance_id", info.ID, "status", info.Status, "error", err)
+	}
+}
@@ -0,0 +1,109 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+type mockPublisher struct {
+	mu        sync.Mutex
+	published []redis.InstanceInfo
+	ttls      []time.Duration
+	err       error
+}
+
+func (m *mockPublisher) PublishInstance(ctx context.Context, info redis.InstanceInfo, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published = append(m.published, info)
+	m.ttls = append(m.ttls, ttl)
+	return m.err
+}
+
+func (m *mockPublisher) snapshot() []redis.InstanceInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]redis.InstanceInfo(nil), m.published...)
+}
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+}
+
+func TestNew_Defaults(t *testing.T) {
+	w := New(newTestLogger(), &mockPublisher{}, redis.InstanceInfo{ID: "swim-1", Status: "bogus"})
+
+	info := w.Info()
+	if info.Status != config.InstanceRunning {
+		t.Errorf("expected status %s, got %s", config.InstanceRunning, info.Status)
+	}
+	if info.StartedAt.IsZero() {
+		t.Error("expected StartedAt to default to now")
+	}
+	if w.interval != config.HeartbeatInterval || w.ttl != config.HeartbeatTTL {
+		t.Errorf("expected default interval/ttl, got %v/%v", w.interval, w.ttl)
+	}
+}
+
+func TestRun_PublishesUntilCancelled(t *testing.T) {
+	publisher := &mockPublisher{}
+	w := New(newTestLogger(), publisher, redis.InstanceInfo{ID: "swim-1", Version: "1.2.3", Provider: "hcloud"}).
+		WithInterval(5*time.Millisecond, 15*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+
+	published := publisher.snapshot()
+	if len(published) < 2 {
+		t.Fatalf("expected repeated heartbeats, got %d", len(published))
+	}
+	for _, info := range published {
+		if info.ID != "swim-1" || info.Version != "1.2.3" || info.Provider != "hcloud" {
+			t.Errorf("unexpected heartbeat metadata: %+v", info)
+		}
+		if info.UpdatedAt.IsZero() {
+			t.Error("expected UpdatedAt to be set")
+		}
+	}
+	if publisher.ttls[0] != 15*time.Millisecond {
+		t.Errorf("expected ttl 15ms, got %v", publisher.ttls[0])
+	}
+}
+
+func TestDrain_PublishesDrainingStatus(t *testing.T) {
+	publisher := &mockPublisher{}
+	w := New(newTestLogger(), publisher, redis.InstanceInfo{ID: "swim-1"})
+
+	w.Drain(context.Background())
+
+	published := publisher.snapshot()
+	if len(published) != 1 {
+		t.Fatalf("expected 1 heartbeat, got %d", len(published))
+	}
+	if published[0].Status != config.InstanceDraining {
+		t.Errorf("expected status %s, got %s", config.InstanceDraining, published[0].Status)
+	}
+	if w.Info().Status != config.InstanceDraining {
+		t.Error("expected draining status to stick for later heartbeats")
+	}
+}
+
+func TestPublish_ErrorIsNotFatal(t *testing.T) {
+	publisher := &mockPublisher{err: errors.New("redis down")}
+	w := New(newTestLogger(), publisher, redis.InstanceInfo{ID: "swim-1"})
+
+	w.Drain(context.Background())
+
+	if len(publisher.snapshot()) != 1 {
+		t.Error("expected publish to be attempted")
+	}
+}
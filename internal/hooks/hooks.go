@@ -0,0 +1,148 @@
+// Package hooks notifies integrations such as grading systems and monitoring about
+// lab lifecycle events, through outbound webhooks or a local command.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Lifecycle events hooks are run for
+const (
+	EventAvailable    = "available"    // server became reachable over SSH
+	EventDecommission = "decommission" // server is about to be deleted
+)
+
+const defaultTimeout = 30 * time.Second
+
+// Hook reacts to a lifecycle event. payload is the server state as JSON.
+type Hook interface {
+	Run(ctx context.Context, event string, state redis.ServerState, payload []byte) error
+}
+
+// Config contains hook settings
+type Config struct {
+	WebhookURL string        // URL the server state is POSTed to; empty disables the webhook
+	Command    string        // executable run with the event as argument; empty disables the command
+	Timeout    time.Duration // per-hook timeout (default: 30s)
+}
+
+// Runner runs every configured hook for an event
+type Runner struct {
+	hooks   []Hook
+	timeout time.Duration
+}
+
+// New creates the runner for the configured hooks.
+// Returns nil if no hook is configured.
+func New(cfg Config) *Runner {
+	var configured []Hook
+	if cfg.WebhookURL != "" {
+		configured = append(configured, NewWebhook(cfg.WebhookURL, http.DefaultClient))
+	}
+	if cfg.Command != "" {
+		configured = append(configured, &Command{Path: cfg.Command})
+	}
+	if len(configured) == 0 {
+		return nil
+	}
+	return NewRunner(cfg.Timeout, configured...)
+}
+
+// NewRunner creates a runner for hooks; a timeout of 0 uses the default
+func NewRunner(timeout time.Duration, hooks ...Hook) *Runner {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Runner{hooks: hooks, timeout: timeout}
+}
+
+// Run runs every hook for event and returns their combined errors.
+// A failing hook doesn't stop the others.
+func (r *Runner) Run(ctx context.Context, event string, state redis.ServerState) error {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal server state: %w", err)
+	}
+
+	var errs []error
+	for _, hook := range r.hooks {
+		hookCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		if err := hook.Run(hookCtx, event, state, payload); err != nil {
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// Webhook POSTs the server state JSON to a URL. The event is sent in the X-Swim-Event header.
+type Webhook struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhook creates a webhook hook that posts to url with client
+func NewWebhook(url string, client *http.Client) *Webhook {
+	return &Webhook{URL: url, client: client}
+}
+
+// Run implements Hook
+func (w *Webhook) Run(ctx context.Context, event string, state redis.ServerState, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", event, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Swim-Event", event)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", event, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: unexpected status %s", event, resp.Status)
+	}
+	return nil
+}
+
+// Command runs a local executable with the event as its only argument.
+// The server state JSON is written to its stdin and the main fields are
+// also passed as SWIM_* environment variables.
+type Command struct {
+	Path string
+}
+
+// Run implements Hook
+func (c *Command) Run(ctx context.Context, event string, state redis.ServerState, payload []byte) error {
+	cmd := exec.CommandContext(ctx, c.Path, event)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"SWIM_EVENT="+event,
+		"SWIM_SERVER_ID="+state.ServerID,
+		"SWIM_ADDRESS="+state.Address,
+		"SWIM_HOSTNAME="+state.Hostname,
+		"SWIM_USER="+state.User,
+		"SWIM_WEBUSERID="+state.WebUserID,
+		"SWIM_LABID="+strconv.Itoa(state.LabID),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("hook command %s %s: %w: %s", c.Path, event, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
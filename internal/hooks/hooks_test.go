@@ -0,0 +1,137 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+func testState() redis.ServerState {
+	return redis.ServerState{
+		User:      "student",
+		Address:   "2001:db8::1",
+		ServerID:  "server-123",
+		WebUserID: "user-123",
+		LabID:     42,
+		Available: true,
+	}
+}
+
+func TestNew_NothingConfigured(t *testing.T) {
+	if runner := New(Config{}); runner != nil {
+		t.Errorf("expected nil runner without hooks, got %+v", runner)
+	}
+}
+
+func TestWebhook_PostsServerState(t *testing.T) {
+	var gotEvent string
+	var got redis.ServerState
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEvent = r.Header.Get("X-Swim-Event")
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	runner := New(Config{WebhookURL: srv.URL})
+	if err := runner.Run(context.Background(), EventAvailable, testState()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if gotEvent != EventAvailable {
+		t.Errorf("expected event header %q, got %q", EventAvailable, gotEvent)
+	}
+	if got.ServerID != "server-123" || got.LabID != 42 || !got.Available {
+		t.Errorf("unexpected posted state: %+v", got)
+	}
+}
+
+func TestWebhook_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	err := New(Config{WebhookURL: srv.URL}).Run(context.Background(), EventDecommission, testState())
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected status error, got %v", err)
+	}
+}
+
+func TestCommand_ReceivesEventAndState(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	body := "#!/bin/sh\n{ echo \"$1 $SWIM_SERVER_ID $SWIM_LABID\"; cat; } > " + out + "\n"
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(Config{Command: script}).Run(context.Background(), EventDecommission, testState()); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLine, stdin, _ := strings.Cut(string(data), "\n")
+	if firstLine != "decommission server-123 42" {
+		t.Errorf("unexpected arguments and environment: %q", firstLine)
+	}
+	var state redis.ServerState
+	if err := json.Unmarshal([]byte(stdin), &state); err != nil || state.Address != "2001:db8::1" {
+		t.Errorf("expected server state on stdin, got %q (%v)", stdin, err)
+	}
+}
+
+func TestCommand_FailureIncludesOutput(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho grader down >&2\nexit 3\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := New(Config{Command: script}).Run(context.Background(), EventAvailable, testState())
+	if err == nil || !strings.Contains(err.Error(), "grader down") {
+		t.Errorf("expected error with command output, got %v", err)
+	}
+}
+
+// funcHook adapts a function to Hook
+type funcHook func(ctx context.Context) error
+
+func (f funcHook) Run(ctx context.Context, event string, state redis.ServerState, payload []byte) error {
+	return f(ctx)
+}
+
+func TestRunner_RunsAllHooksWithTimeout(t *testing.T) {
+	var ran int
+	slow := funcHook(func(ctx context.Context) error {
+		ran++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	fast := funcHook(func(ctx context.Context) error {
+		ran++
+		return nil
+	})
+
+	err := NewRunner(10*time.Millisecond, slow, fast).Run(context.Background(), EventAvailable, testState())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the slow hook to time out, got %v", err)
+	}
+	if ran != 2 {
+		t.Errorf("expected both hooks to run, got %d", ran)
+	}
+}
@@ -0,0 +1,341 @@
+// Package ingest serves an HTTP API that queues provision and decommission requests, for
+// producers that can't talk to Redis. Requests are checked like the queue consumers check
+// them and pushed to the same queues, so they take the same path through SWIM.
+package ingest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+const (
+	// maxBodySize bounds request bodies; requests are a few hundred bytes
+	maxBodySize = 64 * 1024
+
+	// correlationPrefix marks the correlation IDs generated for requests without one
+	correlationPrefix = "api-"
+
+	// DefaultRate and DefaultBurst are the requests per second and at once each client may make
+	DefaultRate  = 10
+	DefaultBurst = 20
+)
+
+var requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "swim_ingest_requests_total",
+	Help: "Requests to the ingestion API, by endpoint and HTTP status code.",
+}, []string{"endpoint", "code"})
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+}
+
+// Queue takes the requests accepted by the API, see redis.ClientInterface
+type Queue interface {
+	PushPayload(ctx context.Context, queueKey string, payload string) error
+}
+
+// ProvisionRequest is the body of POST /v1/provision, the provision request LabMan queues.
+// Admin overrides and enqueuedAt are left out: requests are signed when queued, so the
+// consumers would take an override or a backdated request from any API client.
+type ProvisionRequest struct {
+	WebUserID     string `json:"webuserid"`
+	LabID         int    `json:"labId"`
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	Seq           int64  `json:"seq,omitempty"`
+}
+
+// queuedProvision is a provision request as queued, stamped with the time it was accepted
+type queuedProvision struct {
+	ProvisionRequest
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+}
+
+// DecommissionRequest is the body of POST /v1/decommission: a user's own decommission.
+// Ops requests targeting servers by name, label or lab stay on the Redis queue.
+type DecommissionRequest struct {
+	WebUserID     string `json:"webuserid"`
+	LabID         *int   `json:"labId,omitempty"`
+	ServerID      string `json:"serverId,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	Seq           int64  `json:"seq,omitempty"`
+}
+
+// Response is the body of an accepted request
+type Response struct {
+	CorrelationID string `json:"correlationId"` // traces the request through SWIM's logs, events and user history
+}
+
+// Server serves the ingestion API
+type Server struct {
+	log     *slog.Logger
+	queue   Queue
+	clients map[string]string // client name by token
+	tenants *tenant.Registry
+	rate    float64 // requests per second per client
+	burst   int
+	clock   clock.Clock
+
+	mu      sync.Mutex
+	buckets map[string]*bucket // by client name
+}
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// New creates the ingestion API. clients maps each accepted bearer token to the name of its
+// client, see ParseClients.
+func New(log *slog.Logger, queue Queue, clients map[string]string) *Server {
+	return &Server{
+		log:     log,
+		queue:   queue,
+		clients: clients,
+		rate:    DefaultRate,
+		burst:   DefaultBurst,
+		clock:   clock.Real,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// WithTenants rejects requests of unknown tenants and provisions of labs outside their tenant's catalog
+func (s *Server) WithTenants(tenants *tenant.Registry) *Server {
+	s.tenants = tenants
+	return s
+}
+
+// WithRateLimit lets each client make rate requests per second on average and burst at once.
+// Limits are kept per instance.
+func (s *Server) WithRateLimit(rate float64, burst int) *Server {
+	s.rate = rate
+	s.burst = burst
+	return s
+}
+
+// WithClock sets the clock used for rate limits and enqueuedAt
+func (s *Server) WithClock(c clock.Clock) *Server {
+	s.clock = c
+	return s
+}
+
+// ParseClients reads API clients listed as name:token pairs separated by commas
+func ParseClients(value string) (map[string]string, error) {
+	clients := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("client %q must be name:token", name)
+		}
+		if _, exists := clients[token]; exists {
+			return nil, fmt.Errorf("client %s reuses the token of client %s", name, clients[token])
+		}
+		clients[token] = name
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no clients")
+	}
+	return clients, nil
+}
+
+// Handler returns the HTTP handler with all ingestion routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/provision", s.authorize("provision", s.handleProvision))
+	mux.Handle("POST /v1/decommission", s.authorize("decommission", s.handleDecommission))
+	return mux
+}
+
+// handlerFunc handles a request of an authorized client and returns the HTTP status code
+type handlerFunc func(w http.ResponseWriter, r *http.Request, client string) int
+
+// authorize rejects requests without a client token and requests over the client's rate
+// limit, and counts the responses of endpoint
+func (s *Server) authorize(endpoint string, next handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := s.serve(w, r, next)
+		requestsTotal.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+	})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, next handlerFunc) int {
+	client, ok := s.client(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return http.StatusUnauthorized
+	}
+	if wait := s.take(client); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return http.StatusTooManyRequests
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	return next(w, r, client)
+}
+
+// client returns the name of the client whose bearer token r carries
+func (s *Server) client(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for known, name := range s.clients {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// take takes a token from the bucket of client. Returns 0 if one was taken, or else how
+// long until one is available.
+func (s *Server) take(client string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	b, ok := s.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(s.burst), at: now}
+		s.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(s.burst), b.tokens+now.Sub(b.at).Seconds()*s.rate)
+	b.at = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / s.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request, client string) int {
+	var req ProvisionRequest
+	if err := decode(r, &req); err != nil {
+		return reject(w, err)
+	}
+	if err := validate.First(validate.WebUserID(req.WebUserID), validate.LabID(req.LabID),
+		validate.CorrelationID(req.CorrelationID), validate.Text("tenant", req.Tenant, validate.MaxLabelLength)); err != nil {
+		return reject(w, err)
+	}
+	t, err := s.tenants.Get(req.Tenant)
+	if err != nil {
+		return reject(w, err)
+	}
+	if !t.AllowsLab(req.LabID) {
+		return reject(w, fmt.Errorf("lab %d is not in the catalog of tenant %q", req.LabID, t.ID))
+	}
+
+	req.CorrelationID = s.correlationID(req.CorrelationID)
+	queued := queuedProvision{ProvisionRequest: req, EnqueuedAt: s.clock.Now().UTC()}
+	return s.push(w, r, client, config.ProvisionQueueKey, req.WebUserID, req.CorrelationID, queued)
+}
+
+func (s *Server) handleDecommission(w http.ResponseWriter, r *http.Request, client string) int {
+	var req DecommissionRequest
+	if err := decode(r, &req); err != nil {
+		return reject(w, err)
+	}
+	checks := []error{
+		validate.WebUserID(req.WebUserID),
+		validate.CorrelationID(req.CorrelationID),
+		validate.Text("tenant", req.Tenant, validate.MaxLabelLength),
+	}
+	if req.LabID != nil {
+		checks = append(checks, validate.LabID(*req.LabID))
+	}
+	if req.ServerID != "" {
+		checks = append(checks, validate.ServerID(req.ServerID))
+	}
+	if err := validate.First(checks...); err != nil {
+		return reject(w, err)
+	}
+	if _, err := s.tenants.Get(req.Tenant); err != nil {
+		return reject(w, err)
+	}
+
+	req.CorrelationID = s.correlationID(req.CorrelationID)
+	return s.push(w, r, client, config.DecommissionQueueKey, req.WebUserID, req.CorrelationID, req)
+}
+
+// push queues an accepted request on queueKey
+func (s *Server) push(w http.ResponseWriter, r *http.Request, client, queueKey, webUserID, correlationID string, req any) int {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		s.log.Error("failed to marshal request", "queue", queueKey, "error", err)
+		http.Error(w, "failed to queue request", http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+	if err := s.queue.PushPayload(r.Context(), queueKey, string(payload)); err != nil {
+		s.log.Error("failed to queue request", "queue", queueKey, "client", client, "error", err)
+		code := http.StatusInternalServerError
+		if errors.Is(err, errs.ErrTransient) {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, "failed to queue request", code)
+		return code
+	}
+
+	s.log.Info("request queued", "queue", queueKey, "client", client, "webuserid", webUserID, "correlation_id", correlationID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(Response{CorrelationID: correlationID})
+	return http.StatusAccepted
+}
+
+// correlationID returns id, or a new correlation ID if id is empty
+func (s *Server) correlationID(id string) string {
+	if id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return correlationPrefix + hex.EncodeToString(b)
+}
+
+// decode parses a JSON body into v. Unknown fields are rejected, which also keeps out the
+// fields only SWIM sets and the ops fields the API doesn't take.
+func decode(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("parse body: %w", err)
+	}
+	return nil
+}
+
+// reject answers a request that can't be queued
+func reject(w http.ResponseWriter, err error) int {
+	code := http.StatusBadRequest
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), code)
+	return code
+}
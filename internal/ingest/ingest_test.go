@@ -0,0 +1,191 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+	"github.com/alex-sviridov/swim/internal/tenant"
+)
+
+// failingQueue fails every push with err
+type failingQueue struct{ err error }
+
+func (q failingQueue) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	return q.err
+}
+
+func newTestServer(queue Queue) *Server {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(log, queue, map[string]string{"secret": "portal"})
+}
+
+func post(handler http.Handler, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_Provision(t *testing.T) {
+	store := redistest.New()
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	tenants, err := tenant.NewRegistry(map[string]tenant.Tenant{"cs101": {Labs: []int{5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestServer(store).WithTenants(tenants).WithClock(clock.NewFake(now)).Handler()
+
+	rec := post(handler, "/v1/provision", "secret", `{"webuserid":"student-1","labId":5,"tenant":"cs101","seq":3}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp Response
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || !strings.HasPrefix(resp.CorrelationID, correlationPrefix) {
+		t.Fatalf("expected a generated correlation ID, got %+v, %v", resp, err)
+	}
+
+	queued := store.Queue(config.ProvisionQueueKey)
+	if len(queued) != 1 {
+		t.Fatalf("expected one queued request, got %q", queued)
+	}
+	var req queuedProvision
+	if err := json.Unmarshal([]byte(queued[0]), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.WebUserID != "student-1" || req.LabID != 5 || req.Tenant != "cs101" || req.Seq != 3 ||
+		req.CorrelationID != resp.CorrelationID || !req.EnqueuedAt.Equal(now) {
+		t.Errorf("unexpected queued request %+v", req)
+	}
+}
+
+func TestServer_Rejects(t *testing.T) {
+	tenants, err := tenant.NewRegistry(map[string]tenant.Tenant{"cs101": {Labs: []int{5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		token  string
+		body   string
+		want   int
+	}{
+		{name: "no token", target: "/v1/provision", body: `{"webuserid":"a","labId":5}`, want: http.StatusUnauthorized},
+		{name: "wrong token", target: "/v1/provision", token: "guess", body: `{"webuserid":"a","labId":5}`, want: http.StatusUnauthorized},
+		{name: "invalid webuserid", target: "/v1/provision", token: "secret", body: `{"webuserid":"a:b","labId":5}`, want: http.StatusBadRequest},
+		{name: "missing lab", target: "/v1/provision", token: "secret", body: `{"webuserid":"a"}`, want: http.StatusBadRequest},
+		{name: "unknown tenant", target: "/v1/provision", token: "secret", body: `{"webuserid":"a","labId":5,"tenant":"cs999"}`, want: http.StatusBadRequest},
+		{name: "lab outside catalog", target: "/v1/provision", token: "secret", body: `{"webuserid":"a","labId":6,"tenant":"cs101"}`, want: http.StatusBadRequest},
+		{name: "field set by SWIM", target: "/v1/provision", token: "secret", body: `{"webuserid":"a","labId":5,"node":"db"}`, want: http.StatusBadRequest},
+		{name: "actor override", target: "/v1/provision", token: "secret", body: `{"webuserid":"a","labId":5,"admin":true,"adminActor":"ops"}`, want: http.StatusBadRequest},
+		{name: "signed override", target: "/v1/decommission", token: "secret", body: `{"webuserid":"a","admin":true,"adminActor":"ops","adminTimestamp":1,"adminSignature":"00"}`, want: http.StatusBadRequest},
+		{name: "client enqueuedAt", target: "/v1/provision", token: "secret", body: `{"webuserid":"a","labId":5,"enqueuedAt":"2099-01-01T00:00:00Z"}`, want: http.StatusBadRequest},
+		{name: "ops decommission", target: "/v1/decommission", token: "secret", body: `{"labId":5,"allUsers":true}`, want: http.StatusBadRequest},
+		{name: "too large", target: "/v1/decommission", token: "secret", body: `{"webuserid":"` + strings.Repeat("a", maxBodySize) + `"}`, want: http.StatusRequestEntityTooLarge},
+		{name: "wrong method", target: "/v1/decommission", token: "secret", want: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := redistest.New()
+			handler := newTestServer(store).WithTenants(tenants).Handler()
+			var rec *httptest.ResponseRecorder
+			if tt.want == http.StatusMethodNotAllowed {
+				req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+				rec = httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+			} else {
+				rec = post(handler, tt.target, tt.token, tt.body)
+			}
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+			if n := store.QueueLength(config.ProvisionQueueKey) + store.QueueLength(config.DecommissionQueueKey); n != 0 {
+				t.Errorf("expected nothing queued, got %d", n)
+			}
+		})
+	}
+}
+
+func TestServer_Decommission(t *testing.T) {
+	store := redistest.New()
+	handler := newTestServer(store).Handler()
+
+	rec := post(handler, "/v1/decommission", "secret", `{"webuserid":"student-1","labId":5,"correlationId":"portal-42"}`)
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"portal-42"`) {
+		t.Fatalf("expected 202 with the request's correlation ID, got %d: %s", rec.Code, rec.Body)
+	}
+	queued := store.Queue(config.DecommissionQueueKey)
+	if len(queued) != 1 || !strings.Contains(queued[0], `"webuserid":"student-1"`) || !strings.Contains(queued[0], `"labId":5`) {
+		t.Errorf("expected the decommission queued, got %q", queued)
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	now := clock.NewFake(time.Now())
+	handler := newTestServer(redistest.New()).WithRateLimit(1, 2).WithClock(now).Handler()
+	body := `{"webuserid":"student-1","labId":5}`
+
+	for i := range 2 {
+		if rec := post(handler, "/v1/provision", "secret", body); rec.Code != http.StatusAccepted {
+			t.Fatalf("request %d: expected 202 within the burst, got %d", i+1, rec.Code)
+		}
+	}
+	rec := post(handler, "/v1/provision", "secret", body)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d, %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	now.Advance(time.Second)
+	if rec := post(handler, "/v1/provision", "secret", body); rec.Code != http.StatusAccepted {
+		t.Errorf("expected 202 once a token is back, got %d", rec.Code)
+	}
+}
+
+func TestServer_QueueFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: errs.Mark(errors.New("connection refused"), errs.ErrTransient), want: http.StatusServiceUnavailable},
+		{err: errors.New("WRONGTYPE"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.want), func(t *testing.T) {
+			handler := newTestServer(failingQueue{err: tt.err}).Handler()
+			if rec := post(handler, "/v1/provision", "secret", `{"webuserid":"a","labId":5}`); rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestParseClients(t *testing.T) {
+	clients, err := ParseClients("portal:abc, lms:def")
+	if err != nil || clients["abc"] != "portal" || clients["def"] != "lms" {
+		t.Errorf("expected two clients, got %v, %v", clients, err)
+	}
+	for _, value := range []string{"", "portal", "portal:", "a:x,b:x"} {
+		if _, err := ParseClients(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
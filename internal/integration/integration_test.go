@@ -131,7 +131,7 @@ func TestEndToEnd_DecommissioningFlow(t *testing.T) {
 	t.Logf("✓ Server removed from cache")
 
 	// Step 5: Verify server is deleted from connector
-	_, err = mockConn.GetServerByID(serverID)
+	_, err = mockConn.GetServerByID(context.Background(), serverID)
 	if err == nil {
 		t.Error("Server should be deleted from connector")
 	}
@@ -164,8 +164,8 @@ func TestEndToEnd_DecommissionAlreadyDeleted(t *testing.T) {
 	serverID := state.ServerID
 
 	// Manually delete the server from connector (simulating manual deletion)
-	server, _ := mockConn.GetServerByID(serverID)
-	server.Delete()
+	server, _ := mockConn.GetServerByID(context.Background(), serverID)
+	server.Delete(context.Background())
 	t.Logf("✓ Server manually deleted from cloud provider")
 
 	// Now try to decommission via queue
@@ -1,7 +1,10 @@
 package integration
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -24,17 +27,29 @@ func NewMockConnector() *MockConnector {
 }
 
 // CreateServer creates a mock server
-func (m *MockConnector) CreateServer(payload string) (connector.Server, error) {
+func (m *MockConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	id := fmt.Sprintf("mock-server-%d", m.nextID)
 	m.nextID++
 
+	// Label like the real connector so label lookups work
+	var req struct {
+		WebUserID string `json:"webuserid"`
+		LabID     int    `json:"labId"`
+	}
+	_ = json.Unmarshal([]byte(payload), &req)
+
 	server := &MockServer{
-		id:      id,
-		name:    fmt.Sprintf("Test Server %s", id),
-		ipv6:    fmt.Sprintf("2001:db8::%d", m.nextID-1),
+		id:   id,
+		name: fmt.Sprintf("Test Server %s", id),
+		ipv6: fmt.Sprintf("2001:db8::%d", m.nextID-1),
+		labels: map[string]string{
+			connector.LabelType:  connector.LabelTypeLabHost,
+			"webuserid":          req.WebUserID,
+			connector.LabelLabID: strconv.Itoa(req.LabID),
+		},
 		state:   "initializing",
 		created: time.Now(),
 		deleted: false,
@@ -56,7 +71,7 @@ func (m *MockConnector) CreateServer(payload string) (connector.Server, error) {
 }
 
 // ListServers returns all servers
-func (m *MockConnector) ListServers() ([]connector.Server, error) {
+func (m *MockConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -70,19 +85,64 @@ func (m *MockConnector) ListServers() ([]connector.Server, error) {
 	return servers, nil
 }
 
+// GetConsoleURL implements connector.Connector.GetConsoleURL
+func (m *MockConnector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// MapState implements connector.Connector.MapState with Hetzner's states
+func (m *MockConnector) MapState(cloudState string) (string, bool) {
+	switch cloudState {
+	case "running":
+		return "running", true
+	case "stopping", "off", "deleting":
+		return "stopping", false
+	}
+	return "provisioning", false
+}
+
 // GetServerByID retrieves a server by ID
-func (m *MockConnector) GetServerByID(serverID string) (connector.Server, error) {
+func (m *MockConnector) GetServerByID(ctx context.Context, serverID string) (connector.Server, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	server, exists := m.servers[serverID]
 	if !exists || server.deleted {
-		return nil, fmt.Errorf("server not found: %s", serverID)
+		return nil, connector.NotFound("server not found: %s", serverID)
 	}
 
 	return server, nil
 }
 
+// GetServerByName retrieves a server by name
+func (m *MockConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, server := range m.servers {
+		if server.name == name && !server.deleted {
+			return server, nil
+		}
+	}
+
+	return nil, connector.NotFound("server not found: %s", name)
+}
+
+// GetServersByLabel returns all servers whose label key equals value
+func (m *MockConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var servers []connector.Server
+	for _, server := range m.servers {
+		if !server.deleted && server.labels[key] == value {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers, nil
+}
+
 // GetServerCount returns the number of active servers (for testing)
 func (m *MockConnector) GetServerCount() int {
 	m.mu.Lock()
@@ -103,6 +163,7 @@ type MockServer struct {
 	id      string
 	name    string
 	ipv6    string
+	labels  map[string]string
 	state   string
 	created time.Time
 	deleted bool
@@ -129,8 +190,25 @@ func (s *MockServer) GetIPv6Address() string {
 	return s.ipv6
 }
 
+// GetLabels returns the provider labels
+func (s *MockServer) GetLabels() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels
+}
+
+// GetServerType returns the server type
+func (s *MockServer) GetServerType() string {
+	return "cx22"
+}
+
+// GetSSHHostKey returns the host key
+func (s *MockServer) GetSSHHostKey() string {
+	return ""
+}
+
 // GetState returns the current state
-func (s *MockServer) GetState() (string, error) {
+func (s *MockServer) GetState(ctx context.Context) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -142,7 +220,7 @@ func (s *MockServer) GetState() (string, error) {
 }
 
 // Delete marks the server as deleted
-func (s *MockServer) Delete() error {
+func (s *MockServer) Delete(ctx context.Context) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -155,6 +233,26 @@ func (s *MockServer) Delete() error {
 	return nil
 }
 
+func (s *MockServer) Rebuild(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deleted {
+		return fmt.Errorf("server already deleted")
+	}
+	return nil
+}
+
+func (s *MockServer) Resize(ctx context.Context, serverType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deleted {
+		return fmt.Errorf("server already deleted")
+	}
+	return nil
+}
+
 // String returns a string representation
 func (s *MockServer) String() string {
 	s.mu.Lock()
@@ -6,87 +6,20 @@ import (
 	"testing"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/clock"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/decommissioner"
 	"github.com/alex-sviridov/swim/internal/provisioner"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
 	"log/slog"
 	"os"
 )
 
-// TestInMemoryRedis implements redis.ClientInterface for testing
-type TestInMemoryRedis struct {
-	states     map[string]redis.ServerState
-	queues     map[string][]string
-	rateLimits map[string]bool // Track rate limit keys
-}
-
-func NewTestInMemoryRedis() *TestInMemoryRedis {
-	return &TestInMemoryRedis{
-		states:     make(map[string]redis.ServerState),
-		queues:     make(map[string][]string),
-		rateLimits: make(map[string]bool),
-	}
-}
-
-func (c *TestInMemoryRedis) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
-	state, ok := c.states[cacheKey]
-	if !ok {
-		return nil, fmt.Errorf("server state not found in cache")
-	}
-	return &state, nil
-}
-
-func (c *TestInMemoryRedis) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
-	c.states[cacheKey] = state
-	return nil
-}
-
-func (c *TestInMemoryRedis) DeleteServerState(ctx context.Context, cacheKey string) error {
-	delete(c.states, cacheKey)
-	return nil
-}
-
-func (c *TestInMemoryRedis) PushPayload(ctx context.Context, queueKey string, payload string) error {
-	c.queues[queueKey] = append(c.queues[queueKey], payload)
-	return nil
-}
-
-func (c *TestInMemoryRedis) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
-	queue, ok := c.queues[queueKey]
-	if !ok || len(queue) == 0 {
-		return "", fmt.Errorf("no payload available")
-	}
-
-	payload := queue[0]
-	c.queues[queueKey] = queue[1:]
-	return payload, nil
-}
-
-func (c *TestInMemoryRedis) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
-	states := make([]redis.ServerState, 0)
-	for key, state := range c.states {
-		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
-			states = append(states, state)
-		}
-	}
-	return states, nil
-}
-
-func (c *TestInMemoryRedis) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
-	// For integration tests, always allow (don't enforce rate limiting)
-	// Integration tests are testing provisioning/decommissioning logic, not rate limiting
-	return true, nil
-}
-
-func (c *TestInMemoryRedis) Close() error {
-	return nil
-}
-
 func TestProvisioningAndDecommissioning_SameLabID(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewTestInMemoryRedis()
+	redisClient := redistest.New()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
 	prov := provisioner.New(log, mockConn, redisClient).WithPollInterval(1 * time.Millisecond)
@@ -145,7 +78,8 @@ func TestProvisioningAndDecommissioning_SameLabID(t *testing.T) {
 func TestProvisioningAndDecommissioning_DifferentLabID(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewTestInMemoryRedis()
+	now := clock.NewFake(time.Now())
+	redisClient := redistest.New().WithClock(now)
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
 	prov := provisioner.New(log, mockConn, redisClient).WithPollInterval(1 * time.Millisecond)
@@ -175,7 +109,8 @@ func TestProvisioningAndDecommissioning_DifferentLabID(t *testing.T) {
 		t.Errorf("expected LabID 42, got %d", state1.LabID)
 	}
 
-	// Test: Provision with different labId=99
+	// Test: Provision with different labId=99, once the provision rate limit has passed
+	now.Advance(config.GetProvisionRateLimitDuration())
 	payload2 := `{"webuserid":"user-123","labId":99}`
 	prov.ProcessRequest(ctx, payload2)
 
@@ -183,7 +118,7 @@ func TestProvisioningAndDecommissioning_DifferentLabID(t *testing.T) {
 	time.Sleep(150 * time.Millisecond)
 
 	// Verify decommission request was queued for old server
-	decommQueue := redisClient.queues[config.DecommissionQueueKey]
+	decommQueue := redisClient.Queue(config.DecommissionQueueKey)
 	if len(decommQueue) != 1 {
 		t.Fatalf("expected 1 decommission request queued, got %d", len(decommQueue))
 	}
@@ -217,11 +152,11 @@ func TestProvisioningAndDecommissioning_DifferentLabID(t *testing.T) {
 	time.Sleep(50 * time.Millisecond)
 
 	// Verify old server was deleted from cloud
-	_, err = mockConn.GetServerByID(firstServerID)
+	_, err = mockConn.GetServerByID(context.Background(), firstServerID)
 	if err == nil {
 		t.Errorf("expected old server to be deleted from cloud, firstServerID=%s", firstServerID)
 		// List all servers for debugging
-		servers, _ := mockConn.ListServers()
+		servers, _ := mockConn.ListServers(context.Background())
 		t.Logf("Remaining servers: %d", len(servers))
 		for _, s := range servers {
 			t.Logf("  - Server ID: %s", s.GetID())
@@ -233,14 +168,14 @@ func TestProvisioningAndDecommissioning_DifferentLabID(t *testing.T) {
 	if actualCount != 1 {
 		t.Errorf("expected 1 server in cloud (new server only), got %d", actualCount)
 		// List all servers for debugging
-		servers, _ := mockConn.ListServers()
+		servers, _ := mockConn.ListServers(context.Background())
 		for _, s := range servers {
 			t.Logf("  - Remaining server ID: %s", s.GetID())
 		}
 	}
 
 	// Verify new server still exists
-	_, err = mockConn.GetServerByID(state2.ServerID)
+	_, err = mockConn.GetServerByID(context.Background(), state2.ServerID)
 	if err != nil {
 		t.Errorf("expected new server to still exist in cloud, got error: %v", err)
 	}
@@ -249,7 +184,7 @@ func TestProvisioningAndDecommissioning_DifferentLabID(t *testing.T) {
 func TestDecommissioning_CachelessDeletion(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewTestInMemoryRedis()
+	redisClient := redistest.New()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
 	decomm := decommissioner.New(log, mockConn, redisClient)
@@ -257,7 +192,7 @@ func TestDecommissioning_CachelessDeletion(t *testing.T) {
 	ctx := context.Background()
 
 	// Manually create a server in cloud (simulating orphaned server)
-	orphanedServer, _ := mockConn.CreateServer(`{"webuserid":"orphan","labId":1}`)
+	orphanedServer, _ := mockConn.CreateServer(context.Background(), `{"webuserid":"user-orphan","labId":1}`)
 	orphanedServerID := orphanedServer.GetID()
 
 	// Verify server exists in cloud
@@ -274,7 +209,7 @@ func TestDecommissioning_CachelessDeletion(t *testing.T) {
 		t.Errorf("expected 0 servers in cloud after cache-less deletion, got %d", mockConn.GetServerCount())
 	}
 
-	_, err := mockConn.GetServerByID(orphanedServerID)
+	_, err := mockConn.GetServerByID(context.Background(), orphanedServerID)
 	if err == nil {
 		t.Errorf("expected orphaned server to be deleted from cloud")
 	}
@@ -283,7 +218,7 @@ func TestDecommissioning_CachelessDeletion(t *testing.T) {
 func TestMultipleUsers_IndependentServers(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewTestInMemoryRedis()
+	redisClient := redistest.New()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
 	prov := provisioner.New(log, mockConn, redisClient).WithPollInterval(1 * time.Millisecond)
@@ -323,14 +258,14 @@ func TestMultipleUsers_IndependentServers(t *testing.T) {
 	}
 
 	// Verify user-1 and user-3 servers still exist
-	_, err1 := mockConn.GetServerByID(state1.ServerID)
-	_, err3 := mockConn.GetServerByID(state3.ServerID)
+	_, err1 := mockConn.GetServerByID(context.Background(), state1.ServerID)
+	_, err3 := mockConn.GetServerByID(context.Background(), state3.ServerID)
 	if err1 != nil || err3 != nil {
 		t.Errorf("expected user-1 and user-3 servers to still exist")
 	}
 
 	// Verify user-2 server was deleted
-	_, err2 := mockConn.GetServerByID(state2.ServerID)
+	_, err2 := mockConn.GetServerByID(context.Background(), state2.ServerID)
 	if err2 == nil {
 		t.Errorf("expected user-2 server to be deleted")
 	}
@@ -13,111 +13,9 @@ import (
 	"github.com/alex-sviridov/swim/internal/decommissioner"
 	"github.com/alex-sviridov/swim/internal/provisioner"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
 )
 
-// RateLimitedTestRedis implements redis.ClientInterface with proper rate limiting
-// This is used for rate limit integration tests to simulate real Redis behavior
-type RateLimitedTestRedis struct {
-	states         map[string]redis.ServerState
-	queues         map[string][]string
-	rateLimitTimes map[string]time.Time // Track when rate limit was acquired
-	mu             sync.RWMutex
-}
-
-func NewRateLimitedTestRedis() *RateLimitedTestRedis {
-	return &RateLimitedTestRedis{
-		states:         make(map[string]redis.ServerState),
-		queues:         make(map[string][]string),
-		rateLimitTimes: make(map[string]time.Time),
-	}
-}
-
-func (c *RateLimitedTestRedis) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	state, ok := c.states[cacheKey]
-	if !ok {
-		return nil, fmt.Errorf("server state not found in cache")
-	}
-	return &state, nil
-}
-
-func (c *RateLimitedTestRedis) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	c.states[cacheKey] = state
-	return nil
-}
-
-func (c *RateLimitedTestRedis) DeleteServerState(ctx context.Context, cacheKey string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	delete(c.states, cacheKey)
-	return nil
-}
-
-func (c *RateLimitedTestRedis) PushPayload(ctx context.Context, queueKey string, payload string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	c.queues[queueKey] = append(c.queues[queueKey], payload)
-	return nil
-}
-
-func (c *RateLimitedTestRedis) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	queue, ok := c.queues[queueKey]
-	if !ok || len(queue) == 0 {
-		return "", fmt.Errorf("no payload available")
-	}
-
-	payload := queue[0]
-	c.queues[queueKey] = queue[1:]
-	return payload, nil
-}
-
-func (c *RateLimitedTestRedis) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
-	states := make([]redis.ServerState, 0)
-	for key, state := range c.states {
-		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
-			states = append(states, state)
-		}
-	}
-	return states, nil
-}
-
-func (c *RateLimitedTestRedis) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	key := redis.RateLimitKey(webUserID, operation)
-
-	// Check if rate limit exists and hasn't expired
-	if acquiredAt, exists := c.rateLimitTimes[key]; exists {
-		if time.Since(acquiredAt) < ttl {
-			// Still rate limited
-			return false, nil
-		}
-		// TTL expired, can acquire again
-	}
-
-	// Acquire rate limit
-	c.rateLimitTimes[key] = time.Now()
-	return true, nil
-}
-
-func (c *RateLimitedTestRedis) Close() error {
-	return nil
-}
-
 // TestRateLimit_FloodingWithMultipleUsers simulates flooding the system with messages
 // from different users and verifies that:
 // 1. Each user ends up with exactly one VM
@@ -126,7 +24,7 @@ func (c *RateLimitedTestRedis) Close() error {
 func TestRateLimit_FloodingWithMultipleUsers(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewRateLimitedTestRedis()
+	redisClient := redistest.New()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelWarn}))
 
 	// Create provisioner and decommissioner with very fast polling for tests
@@ -183,7 +81,7 @@ func TestRateLimit_FloodingWithMultipleUsers(t *testing.T) {
 	t.Log("Phase 2: Verifying system state")
 
 	// Verify: Each user has exactly ONE server in the cloud
-	serversInCloud, err := mockConn.ListServers()
+	serversInCloud, err := mockConn.ListServers(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to list servers: %v", err)
 	}
@@ -232,7 +130,7 @@ func TestRateLimit_FloodingWithMultipleUsers(t *testing.T) {
 		}
 
 		// Get server from cloud by ServerID
-		cloudServer, err := mockConn.GetServerByID(cachedState.ServerID)
+		cloudServer, err := mockConn.GetServerByID(context.Background(), cachedState.ServerID)
 		if err != nil {
 			t.Errorf("User %s: Server ID %s in cache but not in cloud: %v",
 				userID, cachedState.ServerID, err)
@@ -286,7 +184,7 @@ func TestRateLimit_FloodingWithMultipleUsers(t *testing.T) {
 	}
 
 	// Verify: Cloud has one less server
-	remainingServers, err := mockConn.ListServers()
+	remainingServers, err := mockConn.ListServers(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to list remaining servers: %v", err)
 	}
@@ -310,7 +208,7 @@ func TestRateLimit_FloodingWithMultipleUsers(t *testing.T) {
 func TestRateLimit_RapidLabSwitching(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewRateLimitedTestRedis()
+	redisClient := redistest.New()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelWarn}))
 
 	prov := provisioner.New(log, mockConn, redisClient).WithPollInterval(1 * time.Millisecond)
@@ -330,7 +228,7 @@ func TestRateLimit_RapidLabSwitching(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	// Verify: Only ONE server exists in cloud for this user
-	allServers, err := mockConn.ListServers()
+	allServers, err := mockConn.ListServers(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to list servers: %v", err)
 	}
@@ -373,7 +271,7 @@ func TestRateLimit_RapidLabSwitching(t *testing.T) {
 func TestRateLimit_ConcurrentProvisionAndDecommission(t *testing.T) {
 	// Setup
 	mockConn := NewMockConnector()
-	redisClient := NewRateLimitedTestRedis()
+	redisClient := redistest.New()
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelWarn}))
 
 	prov := provisioner.New(log, mockConn, redisClient).WithPollInterval(1 * time.Millisecond)
@@ -442,7 +340,7 @@ func TestRateLimit_ConcurrentProvisionAndDecommission(t *testing.T) {
 		if cacheErr != nil {
 			t.Errorf("Cloud has server but cache is empty: %v", cacheErr)
 		} else {
-			servers, err := mockConn.ListServers()
+			servers, err := mockConn.ListServers(context.Background())
 			if err != nil {
 				t.Fatalf("Failed to list servers: %v", err)
 			}
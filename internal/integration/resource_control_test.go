@@ -63,7 +63,7 @@ func TestResourceControl_TTLEnforcement(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	// Process decommission request
-	decommPayload, err := redisClient.PopPayload(ctx, config.DecommissionQueueKey, 3*time.Second)
+	decommPayload, err := redisClient.PopPayload(ctx, config.CleanupQueueKey, 3*time.Second)
 	if err != nil {
 		t.Fatalf("Cleanup should have pushed decommission request: %v", err)
 	}
@@ -141,7 +141,7 @@ func TestResourceControl_CleanupWorkerRecovery(t *testing.T) {
 
 	// Process all decommission requests
 	for i := 0; i < 3; i++ {
-		decommPayload, err := redisClient.PopPayload(ctx, config.DecommissionQueueKey, 3*time.Second)
+		decommPayload, err := redisClient.PopPayload(ctx, config.CleanupQueueKey, 3*time.Second)
 		if err != nil {
 			t.Errorf("Expected decommission request %d: %v", i+1, err)
 			continue
@@ -243,13 +243,13 @@ func TestResourceControl_NoResourceLeaksOnLabSwitch(t *testing.T) {
 	}
 
 	// Verify old server is actually deleted (not just removed from cache)
-	_, err = mockConn.GetServerByID(serverID1)
+	_, err = mockConn.GetServerByID(context.Background(), serverID1)
 	if err == nil {
 		t.Error("Old server (lab 5) should be deleted from connector")
 	}
 
 	// Verify new server exists
-	_, err = mockConn.GetServerByID(serverID2)
+	_, err = mockConn.GetServerByID(context.Background(), serverID2)
 	if err != nil {
 		t.Errorf("New server (lab 7) should exist: %v", err)
 	}
@@ -330,7 +330,7 @@ func TestResourceControl_PreventMultipleActiveProvisions(t *testing.T) {
 	}
 
 	// Verify lab 1's VM still exists in cloud (orphaned), but lab 2 is in cache
-	if _, err := mockConn.GetServerByID(server1ID); err != nil {
+	if _, err := mockConn.GetServerByID(context.Background(), server1ID); err != nil {
 		t.Errorf("Lab 1's VM should still exist in cloud (orphaned): %v", err)
 	}
 
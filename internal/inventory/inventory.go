@@ -0,0 +1,321 @@
+// Package inventory records lab servers in an external inventory such as a university CMDB:
+// every server is registered once it is created, with its public address, and deregistered
+// once it is deleted. Calls are plain HTTP requests whose URL and body are templates over
+// the server's Record, so any inventory API can be targeted without code changes.
+//
+// Calls are queued and made in the background under the inventory-call retry policy, so a
+// slow or unavailable inventory never holds up provisioning. A call that still fails is
+// logged and dropped.
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/retry"
+)
+
+// Record events
+const (
+	EventRegister   = "register"   // the server was created
+	EventDeregister = "deregister" // the server was deleted
+)
+
+const (
+	defaultQueueSize = 1000
+	defaultTimeout   = 10 * time.Second
+)
+
+// Record describes a server to the inventory. It is the data of the URL and body templates,
+// and the default body as JSON.
+type Record struct {
+	Event      string            `json:"event"`
+	ServerID   string            `json:"serverId"`
+	Name       string            `json:"name"`
+	Address    string            `json:"address"` // public IPv6 address
+	ServerType string            `json:"serverType,omitempty"`
+	LabID      int               `json:"labId,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Node       string            `json:"node,omitempty"` // node name within a composite lab
+	Labels     map[string]string `json:"labels,omitempty"`
+	At         time.Time         `json:"at"`
+}
+
+// Call configures the request made for one event
+type Call struct {
+	Method string // HTTP method
+	URL    string // template of the URL, e.g. https://cmdb.example.org/ci/{{.Name | urlquery}}
+	Body   string // template of the body; empty sends the Record as JSON
+}
+
+// Config contains inventory settings
+type Config struct {
+	Register    Call   // sent when a server is created; an empty URL disables the inventory
+	Deregister  Call   // sent when a server is deleted; an empty URL uses the register URL
+	Token       string // sent as a bearer token, if set
+	ContentType string // content type of the body (default: application/json)
+}
+
+// call is a Call with its templates parsed
+type call struct {
+	method string
+	url    *template.Template
+	body   *template.Template // nil sends the Record as JSON
+}
+
+// Hook makes the inventory calls of created and deleted servers. A nil Hook does nothing.
+type Hook struct {
+	log         *slog.Logger
+	register    call
+	deregister  call
+	token       string
+	contentType string
+	client      *http.Client
+	policy      retry.Policy
+	records     chan Record
+	now         func() time.Time
+	dropped     atomic.Int64
+}
+
+// New creates the hook for cfg. Returns nil if no register URL is configured, and an error
+// if a template doesn't parse.
+func New(log *slog.Logger, cfg Config) (*Hook, error) {
+	if cfg.Register.URL == "" {
+		return nil, nil
+	}
+	if cfg.Deregister.URL == "" {
+		cfg.Deregister.URL = cfg.Register.URL
+	}
+	register, err := parseCall(EventRegister, cfg.Register, http.MethodPost)
+	if err != nil {
+		return nil, err
+	}
+	deregister, err := parseCall(EventDeregister, cfg.Deregister, http.MethodDelete)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "application/json"
+	}
+	return &Hook{
+		log:         log,
+		register:    register,
+		deregister:  deregister,
+		token:       cfg.Token,
+		contentType: cfg.ContentType,
+		client:      &http.Client{Timeout: defaultTimeout},
+		policy:      retry.Get(retry.InventoryCall),
+		records:     make(chan Record, defaultQueueSize),
+		now:         time.Now,
+	}, nil
+}
+
+// funcs are the functions the templates can use besides the text/template built-ins
+var funcs = template.FuncMap{
+	// json encodes a value as JSON, e.g. {{json .Name}} for a quoted and escaped string
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parseCall parses the templates of c, using defaultMethod if it names none
+func parseCall(event string, c Call, defaultMethod string) (call, error) {
+	parsed := call{method: strings.ToUpper(c.Method)}
+	if parsed.method == "" {
+		parsed.method = defaultMethod
+	}
+	var err error
+	if parsed.url, err = template.New(event + " url").Funcs(funcs).Option("missingkey=error").Parse(c.URL); err != nil {
+		return call{}, fmt.Errorf("inventory %s url: %w", event, err)
+	}
+	if c.Body != "" {
+		if parsed.body, err = template.New(event + " body").Funcs(funcs).Option("missingkey=error").Parse(c.Body); err != nil {
+			return call{}, fmt.Errorf("inventory %s body: %w", event, err)
+		}
+	}
+	return parsed, nil
+}
+
+// WithHTTPClient sets the client calls are made with (default: 10 second timeout)
+func (h *Hook) WithHTTPClient(client *http.Client) *Hook {
+	h.client = client
+	return h
+}
+
+// Dropped returns the number of calls dropped because the queue was full or the call failed
+func (h *Hook) Dropped() int64 {
+	return h.dropped.Load()
+}
+
+// Register queues the registration of a created server, every node of a composite lab
+func (h *Hook) Register(server connector.Server) {
+	h.enqueue(EventRegister, server)
+}
+
+// Deregister queues the deregistration of a deleted server, every node of a composite lab
+func (h *Hook) Deregister(server connector.Server) {
+	h.enqueue(EventDeregister, server)
+}
+
+// Run makes the queued calls in order until ctx is done
+func (h *Hook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case record := <-h.records:
+			if err := h.deliver(ctx, record); err != nil && ctx.Err() == nil {
+				h.dropped.Add(1)
+				h.log.Error("failed to update inventory", "event", record.Event, "server_id", record.ServerID,
+					"name", record.Name, "error", err)
+			}
+		}
+	}
+}
+
+// enqueue queues a call for every server of server without blocking the caller
+func (h *Hook) enqueue(event string, server connector.Server) {
+	if h == nil || server == nil {
+		return
+	}
+	for _, record := range records(event, server, h.now()) {
+		select {
+		case h.records <- record:
+		default:
+			h.dropped.Add(1)
+			h.log.Error("inventory queue full, dropping call", "event", event, "server_id", record.ServerID, "name", record.Name)
+		}
+	}
+}
+
+// records describes server, or each node of a composite lab, for event
+func records(event string, server connector.Server, at time.Time) []Record {
+	servers := []connector.Server{server}
+	if group, ok := server.(*connector.Group); ok {
+		names := make([]string, 0, len(group.Nodes()))
+		for name := range group.Nodes() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		servers = servers[:0]
+		for _, name := range names {
+			servers = append(servers, group.Nodes()[name])
+		}
+	}
+
+	described := make([]Record, 0, len(servers))
+	for _, s := range servers {
+		labels := s.GetLabels()
+		labID, _ := strconv.Atoi(labels[connector.LabelLabID])
+		described = append(described, Record{
+			Event:      event,
+			ServerID:   s.GetID(),
+			Name:       s.GetName(),
+			Address:    s.GetIPv6Address(),
+			ServerType: s.GetServerType(),
+			LabID:      labID,
+			Tenant:     labels[connector.LabelTenant],
+			Node:       labels[connector.LabelNode],
+			Labels:     labels,
+			At:         at.UTC(),
+		})
+	}
+	return described
+}
+
+// deliver makes the call of a record under the inventory-call retry policy. Network errors,
+// 429 and 5xx responses are retried; other rejections are not. An inventory that doesn't
+// know a deregistered server answers 404, which counts as done.
+func (h *Hook) deliver(ctx context.Context, record Record) error {
+	c := h.register
+	if record.Event == EventDeregister {
+		c = h.deregister
+	}
+	url, body, err := c.render(record)
+	if err != nil {
+		return err
+	}
+	return h.policy.Do(ctx, func() error {
+		err := h.send(ctx, c.method, url, body)
+		var statusErr *statusError
+		if record.Event == EventDeregister && errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}, func(err error) bool {
+		var statusErr *statusError
+		return !errors.As(err, &statusErr) || statusErr.retryable()
+	}, nil)
+}
+
+// render fills in the URL and body of c for record
+func (c call) render(record Record) (string, []byte, error) {
+	var url bytes.Buffer
+	if err := c.url.Execute(&url, record); err != nil {
+		return "", nil, fmt.Errorf("render url: %w", err)
+	}
+	if c.body == nil {
+		body, err := json.Marshal(record)
+		if err != nil {
+			return "", nil, fmt.Errorf("marshal record: %w", err)
+		}
+		return strings.TrimSpace(url.String()), body, nil
+	}
+	var body bytes.Buffer
+	if err := c.body.Execute(&body, record); err != nil {
+		return "", nil, fmt.Errorf("render body: %w", err)
+	}
+	return strings.TrimSpace(url.String()), body.Bytes(), nil
+}
+
+// send makes one call
+func (h *Hook) send(ctx context.Context, method, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// statusError is a non-2xx inventory response
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
+
+// retryable reports whether the call may succeed later
+func (e *statusError) retryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
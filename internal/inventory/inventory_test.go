@@ -0,0 +1,190 @@
+package inventory
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+)
+
+type fakeServer struct {
+	id     string
+	labels map[string]string
+}
+
+func (s *fakeServer) GetID() string                                { return s.id }
+func (s *fakeServer) GetName() string                              { return "lab-" + s.id }
+func (s *fakeServer) GetIPv6Address() string                       { return "2001:db8::" + s.id }
+func (s *fakeServer) GetLabels() map[string]string                 { return s.labels }
+func (s *fakeServer) GetServerType() string                        { return "cx22" }
+func (s *fakeServer) GetSSHHostKey() string                        { return "" }
+func (s *fakeServer) GetState(ctx context.Context) (string, error) { return "running", nil }
+func (s *fakeServer) Delete(ctx context.Context) error             { return nil }
+func (s *fakeServer) Rebuild(ctx context.Context) error            { return nil }
+func (s *fakeServer) Resize(ctx context.Context, t string) error   { return nil }
+func (s *fakeServer) String() string                               { return s.id }
+
+// request is a call the inventory received
+type request struct {
+	method, path, auth, body string
+}
+
+// receiver records the calls it accepts and answers with the queued status codes first
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	calls    []request
+	received chan struct{}
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, request{req.Method, req.URL.RequestURI(), req.Header.Get("Authorization"), string(body)})
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	r.received <- struct{}{}
+}
+
+func newTestHook(t *testing.T, cfg Config, statuses ...int) (*Hook, *receiver) {
+	t.Helper()
+	recv := &receiver{statuses: statuses, received: make(chan struct{}, 10)}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+
+	cfg.Register.URL = srv.URL + cfg.Register.URL
+	if cfg.Deregister.URL != "" {
+		cfg.Deregister.URL = srv.URL + cfg.Deregister.URL
+	}
+	hook, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	hook.policy.InitialDelay = time.Millisecond
+	hook.now = func() time.Time { return time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC) }
+	return hook, recv
+}
+
+func waitForCalls(t *testing.T, recv *receiver, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-recv.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for inventory calls")
+		}
+	}
+}
+
+func TestHook_RegistersAndDeregisters(t *testing.T) {
+	hook, recv := newTestHook(t, Config{
+		Register:   Call{URL: "/ci", Body: `{"name":{{json .Name}},"ip":{{json .Address}},"lab":{{.LabID}}}`},
+		Deregister: Call{URL: "/ci/{{.Name | urlquery}}"},
+		Token:      "token",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hook.Run(ctx)
+
+	server := &fakeServer{id: "1", labels: map[string]string{connector.LabelLabID: "42"}}
+	hook.Register(server)
+	hook.Deregister(server)
+	waitForCalls(t, recv, 2)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	register, deregister := recv.calls[0], recv.calls[1]
+	if register.method != http.MethodPost || register.path != "/ci" || register.auth != "Bearer token" ||
+		register.body != `{"name":"lab-1","ip":"2001:db8::1","lab":42}` {
+		t.Errorf("unexpected registration %+v", register)
+	}
+	if deregister.method != http.MethodDelete || deregister.path != "/ci/lab-1" {
+		t.Errorf("unexpected deregistration %+v", deregister)
+	}
+	// Without a body template the record is sent as JSON
+	if !strings.Contains(deregister.body, `"event":"deregister"`) || !strings.Contains(deregister.body, `"serverId":"1"`) {
+		t.Errorf("expected the record as the deregistration body, got %s", deregister.body)
+	}
+}
+
+func TestHook_RegistersEveryNode(t *testing.T) {
+	group := connector.NewGroup("attacker", map[string]connector.Server{
+		"attacker": &fakeServer{id: "1", labels: map[string]string{connector.LabelNode: "attacker"}},
+		"target":   &fakeServer{id: "2", labels: map[string]string{connector.LabelNode: "target"}},
+	}, func(string) bool { return true })
+
+	records := records(EventRegister, group, time.Now())
+	if len(records) != 2 || records[0].Node != "attacker" || records[1].Node != "target" || records[1].ServerID != "2" {
+		t.Errorf("expected a record per node, got %+v", records)
+	}
+}
+
+func TestDeliver_Retries(t *testing.T) {
+	ctx := context.Background()
+	record := Record{Event: EventRegister, Name: "lab-1"}
+
+	// Server errors and rate limits are retried
+	hook, recv := newTestHook(t, Config{Register: Call{URL: "/ci"}}, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	if err := hook.deliver(ctx, record); err != nil {
+		t.Fatalf("expected the call to succeed after retries, got %v", err)
+	}
+	if len(recv.calls) != 3 {
+		t.Errorf("expected 3 calls, got %d", len(recv.calls))
+	}
+
+	// Other rejections are not
+	hook, recv = newTestHook(t, Config{Register: Call{URL: "/ci"}}, http.StatusBadRequest)
+	if err := hook.deliver(ctx, record); err == nil {
+		t.Fatal("expected a rejected call to fail")
+	}
+	if len(recv.calls) != 1 {
+		t.Errorf("expected no retry of a 400, got %d calls", len(recv.calls))
+	}
+
+	// A server the inventory doesn't know is deregistered already
+	hook, _ = newTestHook(t, Config{Register: Call{URL: "/ci"}}, http.StatusNotFound)
+	if err := hook.deliver(ctx, Record{Event: EventDeregister, Name: "lab-1"}); err != nil {
+		t.Errorf("expected a 404 deregistration to count as done, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if hook, err := New(log, Config{}); hook != nil || err != nil {
+		t.Errorf("expected no hook without a register URL, got %v, %v", hook, err)
+	}
+	if _, err := New(log, Config{Register: Call{URL: "http://cmdb/{{.Name"}}); err == nil {
+		t.Error("expected an invalid url template to be rejected")
+	}
+	if _, err := New(log, Config{Register: Call{URL: "http://cmdb"}, Deregister: Call{Body: "{{json}"}}); err == nil {
+		t.Error("expected an invalid body template to be rejected")
+	}
+
+	// A nil hook does nothing
+	var hook *Hook
+	hook.Register(&fakeServer{id: "1"})
+}
+
+func TestEnqueue_DropsWhenFull(t *testing.T) {
+	hook, _ := newTestHook(t, Config{Register: Call{URL: "/ci"}})
+	hook.records = make(chan Record, 1)
+
+	hook.Register(&fakeServer{id: "1"})
+	hook.Register(&fakeServer{id: "2"})
+	if hook.Dropped() != 1 {
+		t.Errorf("expected 1 dropped call, got %d", hook.Dropped())
+	}
+}
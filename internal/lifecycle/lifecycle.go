@@ -0,0 +1,79 @@
+// Package lifecycle defines the statuses a cached server moves through and the transitions
+// allowed between them:
+//
+//	queued → provisioning → running → expired → stopping → deleting → deleted
+//
+// A server can also be stopped while it is provisioning, a running server provisions again
+// while it is rebuilt or resized, and a failed deletion goes back to stopping when the
+// cleanup worker retries it. Provisioning and deletion can fail.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// ErrIllegalTransition is returned when a server can't move from its status to the requested one
+var ErrIllegalTransition = errors.New("illegal status transition")
+
+// transitions lists the statuses each status may move to. Moving to the same status is
+// always allowed, e.g. to update the provider status while a server stays "provisioning".
+var transitions = map[string][]string{
+	// No entry yet, or one written without a status, which can still be decommissioned
+	"": {config.StatusQueued, config.StatusProvisioning, config.StatusStopping, config.StatusDeleting},
+
+	config.StatusQueued:       {config.StatusProvisioning, config.StatusFailed, config.StatusDeleted},
+	config.StatusProvisioning: {config.StatusRunning, config.StatusStopping, config.StatusDeleting, config.StatusDeleted, config.StatusFailed},
+	config.StatusRunning:      {config.StatusProvisioning, config.StatusExpired, config.StatusStopping, config.StatusDeleting, config.StatusDeleted, config.StatusFailed},
+	config.StatusExpired:      {config.StatusStopping, config.StatusDeleting, config.StatusDeleted},
+	config.StatusStopping:     {config.StatusDeleting, config.StatusDeleted, config.StatusFailed},
+	config.StatusDeleting:     {config.StatusStopping, config.StatusDeleted, config.StatusFailed},
+	config.StatusFailed:       {config.StatusStopping, config.StatusDeleting, config.StatusDeleted},
+	config.StatusDeleted:      {},
+}
+
+// CanTransition reports whether a server in status from may move to status to
+func CanTransition(from, to string) bool {
+	if from == to && from != "" {
+		_, known := transitions[from]
+		return known
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an ErrIllegalTransition error if a server in status from may not move to status to
+func Check(from, to string) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %q to %q", ErrIllegalTransition, from, to)
+	}
+	return nil
+}
+
+// Transition moves the cached state at cacheKey to status to. mutate, if set, is applied to
+// the freshly read entry first and may reject it by returning an error; it must not change
+// the status. Conflicting writes are retried like redis.UpdateServerState. Returns the
+// written state, or an ErrIllegalTransition error if the cached status can't move to to.
+func Transition(ctx context.Context, client redis.ClientInterface, cacheKey, to string, mutate func(state *redis.ServerState) error) (*redis.ServerState, error) {
+	return redis.UpdateServerState(ctx, client, cacheKey, config.ServerCacheTTL, func(state *redis.ServerState) error {
+		from := state.Status
+		if mutate != nil {
+			if err := mutate(state); err != nil {
+				return err
+			}
+		}
+		if err := Check(from, to); err != nil {
+			return err
+		}
+		state.Status = to
+		return nil
+	})
+}
@@ -0,0 +1,94 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeCache holds a single cached state
+type fakeCache struct {
+	redis.ClientInterface
+	state  redis.ServerState
+	writes int
+}
+
+func (f *fakeCache) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	state := f.state
+	return &state, nil
+}
+
+func (f *fakeCache) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	f.state = state
+	f.writes++
+	return nil
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"", config.StatusProvisioning, true},
+		{config.StatusQueued, config.StatusProvisioning, true},
+		{config.StatusProvisioning, config.StatusProvisioning, true},
+		{config.StatusProvisioning, config.StatusRunning, true},
+		{config.StatusRunning, config.StatusExpired, true},
+		{config.StatusExpired, config.StatusStopping, true},
+		{config.StatusStopping, config.StatusDeleting, true},
+		{config.StatusDeleting, config.StatusStopping, true},
+		{config.StatusDeleting, config.StatusDeleted, true},
+		{config.StatusRunning, config.StatusProvisioning, true},
+		{config.StatusExpired, config.StatusProvisioning, false},
+		{config.StatusStopping, config.StatusRunning, false},
+		{config.StatusDeleting, config.StatusProvisioning, false},
+		{config.StatusQueued, config.StatusRunning, false},
+		{config.StatusDeleted, config.StatusRunning, false},
+		{config.StatusDeleted, config.StatusDeleted, true},
+		{"bogus", "bogus", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("CanTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.allowed)
+		}
+		if err := Check(tt.from, tt.to); (err == nil) != tt.allowed || (err != nil && !errors.Is(err, ErrIllegalTransition)) {
+			t.Errorf("Check(%q, %q) = %v", tt.from, tt.to, err)
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	ctx := context.Background()
+	cache := &fakeCache{state: redis.ServerState{Status: config.StatusRunning, Available: true, LabID: 1}}
+
+	updated, err := Transition(ctx, cache, "key", config.StatusStopping, func(state *redis.ServerState) error {
+		state.Available = false
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Transition failed: %v", err)
+	}
+	if updated.Status != config.StatusStopping || updated.Available || cache.state.Status != config.StatusStopping {
+		t.Errorf("expected stopping, unavailable entry written, got %+v", cache.state)
+	}
+
+	// Illegal transitions and rejections by mutate leave the entry alone
+	if _, err := Transition(ctx, cache, "key", config.StatusRunning, nil); !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("expected ErrIllegalTransition, got %v", err)
+	}
+	errRejected := errors.New("rejected")
+	if _, err := Transition(ctx, cache, "key", config.StatusDeleting, func(state *redis.ServerState) error {
+		return errRejected
+	}); !errors.Is(err, errRejected) {
+		t.Errorf("expected mutate's error, got %v", err)
+	}
+	if cache.writes != 1 || cache.state.Status != config.StatusStopping {
+		t.Errorf("expected no further writes, got %d writes and status %q", cache.writes, cache.state.Status)
+	}
+}
@@ -0,0 +1,129 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// ErrSuperseded is returned by the mutate function of a Transition when the cache entry now
+// belongs to another server or lab than the one the caller read
+var ErrSuperseded = errors.New("server state superseded by another writer")
+
+// Operation changes a user's running server in place, e.g. rebuilds or resizes it. The cache
+// entry provisions again while the provider runs the operation, and the server is then
+// polled like a provision until it is available again.
+type Operation struct {
+	Name        string // cached as the entry's operation, e.g. redis.OperationRebuild
+	CloudStatus string // cached while the provider runs the operation
+
+	// Skip, if set, returns why the running server doesn't need or may not get the operation, or ""
+	Skip func(state *redis.ServerState) string
+	// Apply runs the operation on server at the provider
+	Apply func(ctx context.Context, server connector.Server) error
+	// Done, if set, is called once Apply succeeded and returns the state to resume polling with
+	Done func(ctx context.Context, state *redis.ServerState) *redis.ServerState
+	// Failed, if set, is called when the server can't be looked up or Apply fails
+	Failed func(ctx context.Context, state redis.ServerState, err error)
+	// Resume polls the server until it is available again
+	Resume func(ctx context.Context, entry redis.HandoffEntry)
+}
+
+// Run runs op on the server cached at cacheKey. Only a running server that isn't quarantined
+// is changed, and with labID set only one running that lab; other requests are logged and ignored. A server that
+// vanished at the provider is removed from the cache; any other failure of Apply still
+// resumes polling, which caches whatever state the server was left in.
+func (op Operation) Run(ctx context.Context, log *slog.Logger, client redis.ClientInterface, conn connector.Connector, cacheKey string, labID *int) {
+	reqLog := log.With("operation", op.Name)
+
+	state, err := client.GetServerState(ctx, cacheKey)
+	if errors.Is(err, errs.ErrNotFound) {
+		reqLog.Warn("no server to change")
+		return
+	}
+	if err != nil {
+		reqLog.Error("failed to read server state", "error", err)
+		return
+	}
+	if labID != nil && state.LabID != *labID {
+		reqLog.Warn("labId mismatch, ignoring stale request", "requested_labid", *labID, "current_labid", state.LabID)
+		return
+	}
+	// An operation in progress leaves the entry provisioning, so repeated requests are ignored here
+	if state.Status != config.StatusRunning || state.ServerID == "" {
+		reqLog.Warn("server is not running, ignoring request", "status", state.Status)
+		return
+	}
+	// Changing a quarantined server would power it on again
+	if state.CloudStatus == config.CloudStatusQuarantined {
+		reqLog.Warn("server is quarantined, ignoring request")
+		return
+	}
+	if op.Skip != nil {
+		if reason := op.Skip(state); reason != "" {
+			reqLog.Info("ignoring request", "reason", reason)
+			return
+		}
+	}
+	serverLog := reqLog.With("server_id", state.ServerID, "labid", state.LabID)
+
+	server, err := conn.GetServerByID(ctx, state.ServerID)
+	if err != nil {
+		serverLog.Error("failed to get server", "error", err)
+		op.failed(ctx, *state, err)
+		return
+	}
+
+	// The entry provisions again until the server is available
+	serverID := state.ServerID
+	updated, err := Transition(ctx, client, cacheKey, config.StatusProvisioning, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != serverID || fresh.CloudStatus == config.CloudStatusQuarantined {
+			return ErrSuperseded
+		}
+		fresh.Available = false
+		fresh.CloudStatus = op.CloudStatus
+		fresh.Operation = op.Name
+		return nil
+	})
+	if err != nil {
+		// Decommissioned or replaced since it was read
+		serverLog.Warn("server state changed, skipping request", "error", err)
+		return
+	}
+
+	serverLog.Info("changing server")
+	if err := op.Apply(ctx, server); err != nil {
+		serverLog.Error("failed to change server", "error", err)
+		op.failed(ctx, *updated, err)
+		if errors.Is(err, errs.ErrNotFound) {
+			// The server is gone, so is the lab
+			if err := client.DeleteServerState(ctx, cacheKey); err != nil {
+				serverLog.Error("failed to remove vanished server from cache", "error", err)
+			}
+			return
+		}
+	} else {
+		serverLog.Info("server changed, waiting for it to become available")
+		if op.Done != nil {
+			updated = op.Done(ctx, updated)
+		}
+	}
+
+	op.Resume(ctx, redis.HandoffEntry{
+		CacheKey:    cacheKey,
+		ServerID:    serverID,
+		CloudStatus: op.CloudStatus,
+		State:       *updated,
+	})
+}
+
+func (op Operation) failed(ctx context.Context, state redis.ServerState, err error) {
+	if op.Failed != nil {
+		op.Failed(ctx, state, err)
+	}
+}
@@ -0,0 +1,288 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+)
+
+// FakeConnector is a provider that keeps its servers in memory. Servers report
+// "initializing" until bootDelay has passed and take deleteDelay to delete, so the
+// provisioner and decommissioner go through the same states as with Hetzner Cloud.
+type FakeConnector struct {
+	bootDelay   time.Duration
+	deleteDelay time.Duration
+	callLatency time.Duration // every provider call takes this long, see WithLatency
+	jitter      float64       // delays and latencies vary randomly by up to this fraction either way
+
+	mu      sync.Mutex
+	servers map[string]*fakeServer
+	nextID  int
+	created int
+}
+
+// NewFakeConnector creates a fake provider whose servers boot in bootDelay and delete in deleteDelay
+func NewFakeConnector(bootDelay, deleteDelay time.Duration) *FakeConnector {
+	return &FakeConnector{
+		bootDelay:   bootDelay,
+		deleteDelay: deleteDelay,
+		servers:     make(map[string]*fakeServer),
+		nextID:      1,
+	}
+}
+
+// Latencies of Hetzner Cloud a rehearsal simulates, see NewRehearsalConnector
+const (
+	RehearsalBootDelay   = 40 * time.Second
+	RehearsalDeleteDelay = 10 * time.Second
+	RehearsalCallLatency = 300 * time.Millisecond
+	RehearsalJitter      = 0.5
+)
+
+// NewRehearsalConnector creates a fake provider whose servers boot, delete and answer
+// calls about as fast as Hetzner Cloud's, for rehearsing a load against a real Redis
+func NewRehearsalConnector() *FakeConnector {
+	return NewFakeConnector(RehearsalBootDelay, RehearsalDeleteDelay).WithLatency(RehearsalCallLatency, RehearsalJitter)
+}
+
+// WithLatency makes every provider call take callLatency, and varies it as well as the boot
+// and delete delays randomly by up to jitter (a fraction) either way
+func (f *FakeConnector) WithLatency(callLatency time.Duration, jitter float64) *FakeConnector {
+	f.callLatency = callLatency
+	f.jitter = jitter
+	return f
+}
+
+// vary varies d randomly by up to the jitter either way
+func (f *FakeConnector) vary(d time.Duration) time.Duration {
+	if f.jitter == 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + f.jitter*(2*rand.Float64()-1)))
+}
+
+// call waits for the latency of a provider call, or until ctx is done
+func (f *FakeConnector) call(ctx context.Context) error {
+	if f.callLatency == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(f.vary(f.callLatency)):
+		return nil
+	}
+}
+
+var (
+	_ connector.Connector     = (*FakeConnector)(nil)
+	_ connector.FailureStates = (*FakeConnector)(nil)
+)
+
+// CreateServer creates a server labelled like the real connector does
+func (f *FakeConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
+	var req struct {
+		WebUserID string `json:"webuserid"`
+		LabID     int    `json:"labId"`
+		Tenant    string `json:"tenant"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return nil, fmt.Errorf("failed to parse payload: %w", err)
+	}
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := strconv.Itoa(f.nextID)
+	f.nextID++
+	f.created++
+
+	labels := map[string]string{
+		connector.LabelType:  connector.LabelTypeLabHost,
+		"webuserid":          req.WebUserID,
+		connector.LabelLabID: strconv.Itoa(req.LabID),
+	}
+	if req.Tenant != "" {
+		labels[connector.LabelTenant] = req.Tenant
+	}
+	server := &fakeServer{
+		conn:    f,
+		id:      id,
+		name:    fmt.Sprintf("lab%d-loadtest-%s", req.LabID, id),
+		labels:  labels,
+		readyAt: time.Now().Add(f.vary(f.bootDelay)),
+	}
+	f.servers[id] = server
+	return server, nil
+}
+
+// ListServers returns every server that hasn't been deleted
+func (f *FakeConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	servers := make([]connector.Server, 0, len(f.servers))
+	for _, server := range f.servers {
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// GetServerByID returns the server with id
+func (f *FakeConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if server, ok := f.servers[id]; ok {
+		return server, nil
+	}
+	return nil, connector.NotFound("server %s not found", id)
+}
+
+// GetServerByName returns the server named name
+func (f *FakeConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, server := range f.servers {
+		if server.name == name {
+			return server, nil
+		}
+	}
+	return nil, connector.NotFound("server %s not found", name)
+}
+
+// GetServersByLabel returns the servers labelled key=value
+func (f *FakeConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	if err := f.call(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var servers []connector.Server
+	for _, server := range f.servers {
+		if server.labels[key] == value {
+			servers = append(servers, server)
+		}
+	}
+	return servers, nil
+}
+
+// GetConsoleURL returns a console that can't be connected to, for servers that exist
+func (f *FakeConnector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	if _, err := f.GetServerByID(ctx, id); err != nil {
+		return nil, err
+	}
+	return &connector.Console{URL: "wss://console.invalid/" + id, Password: "fake", ExpiresAt: time.Now().Add(time.Minute)}, nil
+}
+
+// MapState maps states like the Hetzner Cloud connector
+func (f *FakeConnector) MapState(cloudState string) (string, bool) {
+	switch cloudState {
+	case "running":
+		return config.StatusRunning, true
+	case "stopping", "off", "deleting":
+		return config.StatusStopping, false
+	}
+	return config.StatusProvisioning, false
+}
+
+// ProvisionFailed classifies states like the Hetzner Cloud connector
+func (f *FakeConnector) ProvisionFailed(cloudState string) bool {
+	switch cloudState {
+	case "stopping", "off", "deleting":
+		return true
+	}
+	return false
+}
+
+// Counts returns the number of servers created so far and the number that still exist
+func (f *FakeConnector) Counts() (created, existing int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.created, len(f.servers)
+}
+
+// fakeServer is a server of FakeConnector
+type fakeServer struct {
+	conn    *FakeConnector
+	id      string
+	name    string
+	labels  map[string]string
+	readyAt time.Time
+}
+
+func (s *fakeServer) GetID() string                { return s.id }
+func (s *fakeServer) GetName() string              { return s.name }
+func (s *fakeServer) GetIPv6Address() string       { return "2001:db8::" + s.id }
+func (s *fakeServer) GetLabels() map[string]string { return s.labels }
+func (s *fakeServer) GetServerType() string        { return "fake" }
+func (s *fakeServer) GetSSHHostKey() string        { return "" }
+func (s *fakeServer) String() string               { return s.name }
+
+// GetState returns "initializing" until the server has booted, then "running"
+func (s *fakeServer) GetState(ctx context.Context) (string, error) {
+	if err := s.conn.call(ctx); err != nil {
+		return "", err
+	}
+	if time.Now().Before(s.readyAt) {
+		return "initializing", nil
+	}
+	return "running", nil
+}
+
+// Rebuild makes the server boot again as if it had just been created
+func (s *fakeServer) Rebuild(ctx context.Context) error {
+	if err := s.conn.call(ctx); err != nil {
+		return err
+	}
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	if _, ok := s.conn.servers[s.id]; !ok {
+		return connector.NotFound("server %s not found", s.id)
+	}
+	s.readyAt = time.Now().Add(s.conn.vary(s.conn.bootDelay))
+	return nil
+}
+
+// Resize makes the server boot again; fake servers have no type to change
+func (s *fakeServer) Resize(ctx context.Context, serverType string) error {
+	return s.Rebuild(ctx)
+}
+
+// Delete waits for the delete delay and removes the server
+func (s *fakeServer) Delete(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.conn.vary(s.conn.deleteDelay)):
+	}
+
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	if _, ok := s.conn.servers[s.id]; !ok {
+		return connector.NotFound("server %s not found", s.id)
+	}
+	delete(s.conn.servers, s.id)
+	return nil
+}
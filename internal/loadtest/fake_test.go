@@ -0,0 +1,27 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFakeConnector_Latency(t *testing.T) {
+	conn := NewFakeConnector(0, 0).WithLatency(20*time.Millisecond, 0.5)
+
+	start := time.Now()
+	server, err := conn.CreateServer(context.Background(), `{"webuserid":"alice","labId":1}`)
+	if err != nil {
+		t.Fatalf("CreateServer failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("expected the call to take at least half its latency, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := server.GetState(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled call to return the context error, got %v", err)
+	}
+}
@@ -0,0 +1,474 @@
+// Package loadtest simulates students against the provisioner, decommissioner and cleanup
+// worker, with a fake provider and a real or in-memory Redis, to size a deployment.
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/cleanup"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/decommissioner"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/provisioner"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+)
+
+// defaultTenant holds the rate limits of the simulated students, who have no tenant
+var defaultTenant tenant.Tenant
+
+// Measured operations
+const (
+	OpProvision    = "provision"    // first lab: request to server available
+	OpSwitch       = "switch"       // lab switch: request to the new lab's server available
+	OpReconnect    = "reconnect"    // cache read of a student reconnecting over SSH
+	OpIdleExpiry   = "idle expiry"  // idle student: last activity to server removed
+	OpDecommission = "decommission" // student leaves: request to server removed
+	OpActivity     = "activity"     // activity heartbeat written while the student works
+)
+
+const (
+	// checkInterval is how often a student checks the cache while waiting for a change
+	checkInterval = 50 * time.Millisecond
+
+	// popTimeout bounds each queue pop, so the consumer notices the end of the test
+	popTimeout = 1 * time.Second
+
+	// userPrefix starts every simulated web user ID
+	userPrefix = "loadtest-"
+)
+
+// Store is the cache and queues the load test runs against: *redis.Client or a redistest.Store
+type Store interface {
+	redis.ClientInterface
+	redis.ActivityReader
+	RecordActivity(ctx context.Context, userID string, at time.Time, ttl time.Duration) error
+}
+
+// Config describes the simulated students
+type Config struct {
+	Users           int           // simulated students
+	Labs            int           // students pick lab IDs from 1 to Labs
+	Duration        time.Duration // how long active students work after their first lab is up
+	SwitchRate      float64       // lab switches per student per hour
+	ReconnectRate   float64       // reconnects per student per hour
+	IdleFraction    float64       // share of students who go idle right after their first lab is up
+	IdleTimeout     time.Duration // idle expiry of the cleanup worker (0 = fixed TTL only)
+	BootDelay       time.Duration // time a fake server takes to boot
+	DeleteDelay     time.Duration // time a fake server takes to delete
+	PollInterval    time.Duration // provisioner poll interval
+	CleanupInterval time.Duration // time between cleanup runs
+	ReadyTimeout    time.Duration // longest a student waits for a change before it counts as failed
+	Seed            uint64        // seed of the students' random behavior
+}
+
+// DefaultConfig returns a class of 200 students switching labs twice an hour for 5 minutes
+func DefaultConfig() Config {
+	return Config{
+		Users:           200,
+		Labs:            10,
+		Duration:        5 * time.Minute,
+		SwitchRate:      2,
+		ReconnectRate:   12,
+		IdleFraction:    0.1,
+		IdleTimeout:     1 * time.Minute,
+		BootDelay:       5 * time.Second,
+		DeleteDelay:     2 * time.Second,
+		PollInterval:    1 * time.Second,
+		CleanupInterval: 10 * time.Second,
+		ReadyTimeout:    2 * time.Minute,
+		Seed:            1,
+	}
+}
+
+// Validate checks that the configuration can run
+func (c Config) Validate() error {
+	switch {
+	case c.Users < 1:
+		return fmt.Errorf("users must be at least 1")
+	case c.Labs < 1:
+		return fmt.Errorf("labs must be at least 1")
+	case c.Duration <= 0:
+		return fmt.Errorf("duration must be positive")
+	case c.SwitchRate < 0 || c.ReconnectRate < 0:
+		return fmt.Errorf("rates must not be negative")
+	case c.IdleFraction < 0 || c.IdleFraction > 1:
+		return fmt.Errorf("idle fraction must be between 0 and 1")
+	case c.PollInterval <= 0 || c.CleanupInterval <= 0 || c.ReadyTimeout <= 0:
+		return fmt.Errorf("poll interval, cleanup interval and ready timeout must be positive")
+	}
+	return nil
+}
+
+// Stats summarizes the latencies of one operation
+type Stats struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Report is the outcome of a load test
+type Report struct {
+	Elapsed        time.Duration
+	Operations     map[string]Stats // by Op* name
+	Failures       map[string]int   // by Op* name
+	ServersCreated int              // servers created at the fake provider
+	ServersLeft    int              // servers still at the fake provider after the test
+}
+
+// Run simulates cfg.Users students against store and returns the measured latencies.
+// Every student leaves at the end, so the cache is empty again once Run returns.
+func Run(ctx context.Context, log *slog.Logger, cfg Config, store Store) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+
+	conn := NewFakeConnector(cfg.BootDelay, cfg.DeleteDelay)
+	prov := provisioner.New(log, conn, store).WithPollInterval(cfg.PollInterval)
+	decomm := decommissioner.New(log, conn, store).WithAsyncDeletes()
+	worker := cleanup.New(log, conn, store).WithInterval(cfg.CleanupInterval)
+	if cfg.IdleTimeout > 0 {
+		worker.WithIdleExpiry(store, cfg.IdleTimeout, config.GetMaxLifetime())
+	}
+
+	serviceCtx, stopService := context.WithCancel(context.Background())
+	var handlers sync.WaitGroup
+	go worker.Run(serviceCtx)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		consume(serviceCtx, log, store, &handlers, map[string]func(context.Context, string){
+			config.DecommissionQueueKey: decomm.ProcessRequest,
+			config.ProvisionQueueKey:    prov.ProcessRequest,
+			config.CleanupQueueKey:      decomm.ProcessRequest,
+		})
+	}()
+
+	rec := newRecorder()
+	var students sync.WaitGroup
+	for i := range cfg.Users {
+		students.Add(1)
+		go func() {
+			defer students.Done()
+			s := &student{
+				cfg:    cfg,
+				store:  store,
+				rec:    rec,
+				userID: fmt.Sprintf("%s%d", userPrefix, i+1),
+				rnd:    rand.New(rand.NewPCG(cfg.Seed, uint64(i))),
+			}
+			s.run(ctx)
+		}()
+	}
+	students.Wait()
+
+	stopService()
+	<-consumed
+	handlers.Wait()
+	decomm.Wait()
+
+	report := rec.report()
+	report.Elapsed = time.Since(started)
+	report.ServersCreated, report.ServersLeft = conn.Counts()
+	return report, ctx.Err()
+}
+
+// consume pops the queues in priority order and runs their handlers until ctx is done
+func consume(ctx context.Context, log *slog.Logger, store Store, handlers *sync.WaitGroup, queues map[string]func(context.Context, string)) {
+	keys := []string{config.DecommissionQueueKey, config.ProvisionQueueKey, config.CleanupQueueKey}
+	for ctx.Err() == nil {
+		queueKey, payload, err := store.PopAnyPayload(ctx, keys, popTimeout)
+		if err != nil {
+			if !errors.Is(err, errs.ErrNotFound) && ctx.Err() == nil {
+				log.Warn("failed to pop payload", "error", err)
+			}
+			continue
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			queues[queueKey](ctx, payload)
+		}()
+	}
+}
+
+// student is one simulated student
+type student struct {
+	cfg    Config
+	store  Store
+	rec    *recorder
+	userID string
+	rnd    *rand.Rand
+
+	labID         int
+	lastProvision time.Time // the switch rate limit is counted from here
+}
+
+// run takes a first lab, then works, switches and reconnects until the test ends, or goes idle
+func (s *student) run(ctx context.Context) {
+	if !s.provision(ctx, OpProvision, s.pickLab()) {
+		return
+	}
+	s.touch(ctx)
+
+	if s.rnd.Float64() < s.cfg.IdleFraction {
+		s.idle(ctx)
+		return
+	}
+	s.work(ctx)
+	s.leave(ctx)
+}
+
+// work switches labs and reconnects at random, keeping the activity heartbeat alive, until the test ends
+func (s *student) work(ctx context.Context) {
+	end := time.Now().Add(s.cfg.Duration)
+	nextSwitch := s.next(s.cfg.SwitchRate)
+	nextReconnect := s.next(s.cfg.ReconnectRate)
+	heartbeat := time.NewTicker(s.heartbeatInterval())
+	defer heartbeat.Stop()
+
+	for {
+		wake := end
+		if nextSwitch.Before(wake) {
+			wake = nextSwitch
+		}
+		if nextReconnect.Before(wake) {
+			wake = nextReconnect
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			s.touch(ctx)
+			continue
+		case <-time.After(time.Until(wake)):
+		}
+
+		now := time.Now()
+		switch {
+		case !now.Before(end):
+			return
+		case !now.Before(nextSwitch):
+			// LabMan only offers a switch once the switch rate limit has passed
+			s.waitUntil(ctx, s.lastProvision.Add(defaultTenant.SwitchRateLimit()))
+			s.provision(ctx, OpSwitch, s.pickOtherLab())
+			s.touch(ctx)
+			nextSwitch = s.next(s.cfg.SwitchRate)
+		default:
+			s.reconnect(ctx)
+			nextReconnect = s.next(s.cfg.ReconnectRate)
+		}
+	}
+}
+
+// provision requests labID and waits until its server is available
+func (s *student) provision(ctx context.Context, op string, labID int) bool {
+	payload, _ := json.Marshal(map[string]any{"webuserid": s.userID, "labId": labID})
+	requested := time.Now()
+	if err := s.store.PushPayload(ctx, config.ProvisionQueueKey, string(payload)); err != nil {
+		s.rec.fail(op)
+		return false
+	}
+
+	ok := s.waitFor(ctx, func(state *redis.ServerState) bool {
+		return state != nil && state.LabID == labID && state.Available
+	})
+	if !ok {
+		s.rec.fail(op)
+		return false
+	}
+	// The rate limits were taken while the request was processed, before the server came up
+	s.lastProvision = time.Now()
+	s.labID = labID
+	s.rec.observe(op, time.Since(requested))
+	return true
+}
+
+// reconnect reads the cache entry like LabMan does when the student opens a terminal
+func (s *student) reconnect(ctx context.Context) {
+	started := time.Now()
+	state, err := s.store.GetServerState(ctx, s.cacheKey())
+	if err != nil || !state.Available {
+		s.rec.fail(OpReconnect)
+		return
+	}
+	s.rec.observe(OpReconnect, time.Since(started))
+}
+
+// idle stops working and waits for the cleanup worker to decommission the server
+func (s *student) idle(ctx context.Context) {
+	if s.cfg.IdleTimeout <= 0 {
+		s.leave(ctx)
+		return
+	}
+	idleSince := time.Now()
+	limit := s.cfg.IdleTimeout + 2*s.cfg.CleanupInterval + s.cfg.ReadyTimeout
+	ok := s.waitForWithin(ctx, limit, func(state *redis.ServerState) bool { return state == nil })
+	if !ok {
+		s.rec.fail(OpIdleExpiry)
+		s.leave(ctx)
+		return
+	}
+	s.rec.observe(OpIdleExpiry, time.Since(idleSince))
+}
+
+// leave decommissions the student's server and waits until it is gone
+func (s *student) leave(ctx context.Context) {
+	payload, _ := json.Marshal(map[string]any{"webuserid": s.userID})
+	requested := time.Now()
+	if err := s.store.PushPayload(ctx, config.DecommissionQueueKey, string(payload)); err != nil {
+		s.rec.fail(OpDecommission)
+		return
+	}
+	if !s.waitFor(ctx, func(state *redis.ServerState) bool { return state == nil }) {
+		s.rec.fail(OpDecommission)
+		return
+	}
+	s.rec.observe(OpDecommission, time.Since(requested))
+}
+
+// touch records activity like the SSH proxy does while the student works
+func (s *student) touch(ctx context.Context) {
+	if err := s.store.RecordActivity(ctx, s.userID, time.Now(), 24*time.Hour); err != nil {
+		s.rec.fail(OpActivity)
+	}
+}
+
+// waitFor waits up to the ready timeout until done accepts the cached state (nil once removed)
+func (s *student) waitFor(ctx context.Context, done func(state *redis.ServerState) bool) bool {
+	return s.waitForWithin(ctx, s.cfg.ReadyTimeout, done)
+}
+
+// waitForWithin waits up to limit until done accepts the cached state (nil once removed)
+func (s *student) waitForWithin(ctx context.Context, limit time.Duration, done func(state *redis.ServerState) bool) bool {
+	deadline := time.Now().Add(limit)
+	for time.Now().Before(deadline) {
+		state, err := s.store.GetServerState(ctx, s.cacheKey())
+		if err != nil && !errors.Is(err, errs.ErrNotFound) {
+			state = nil
+		} else if done(state) {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(checkInterval):
+		}
+	}
+	return false
+}
+
+// waitUntil sleeps until t or until ctx is done
+func (s *student) waitUntil(ctx context.Context, t time.Time) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Until(t)):
+	}
+}
+
+// next returns the time of the next event of a Poisson process with rate events per hour
+func (s *student) next(ratePerHour float64) time.Time {
+	if ratePerHour <= 0 {
+		return time.Now().Add(100 * 365 * 24 * time.Hour)
+	}
+	return time.Now().Add(time.Duration(s.rnd.ExpFloat64() / ratePerHour * float64(time.Hour)))
+}
+
+// heartbeatInterval keeps activity well inside the idle timeout
+func (s *student) heartbeatInterval() time.Duration {
+	interval := 30 * time.Second
+	if s.cfg.IdleTimeout > 0 && s.cfg.IdleTimeout/4 < interval {
+		interval = max(s.cfg.IdleTimeout/4, 100*time.Millisecond)
+	}
+	return interval
+}
+
+func (s *student) pickLab() int {
+	return s.rnd.IntN(s.cfg.Labs) + 1
+}
+
+// pickOtherLab picks a lab other than the current one, if there is one
+func (s *student) pickOtherLab() int {
+	if s.cfg.Labs == 1 {
+		return s.labID
+	}
+	lab := s.rnd.IntN(s.cfg.Labs-1) + 1
+	if lab >= s.labID {
+		lab++
+	}
+	return lab
+}
+
+func (s *student) cacheKey() string {
+	return redis.ServerCacheKey(s.userID)
+}
+
+// recorder collects latencies and failures from every student
+type recorder struct {
+	mu       sync.Mutex
+	samples  map[string][]time.Duration
+	failures map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{samples: make(map[string][]time.Duration), failures: make(map[string]int)}
+}
+
+func (r *recorder) observe(op string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[op] = append(r.samples[op], latency)
+}
+
+func (r *recorder) fail(op string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[op]++
+}
+
+// report computes the percentiles of every operation
+func (r *recorder) report() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &Report{Operations: make(map[string]Stats, len(r.samples)), Failures: make(map[string]int, len(r.failures))}
+	for op, samples := range r.samples {
+		report.Operations[op] = summarize(samples)
+	}
+	for op, count := range r.failures {
+		report.Failures[op] = count
+	}
+	return report
+}
+
+// summarize returns the count and percentiles of samples
+func summarize(samples []time.Duration) Stats {
+	if len(samples) == 0 {
+		return Stats{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return Stats{
+		Count: len(sorted),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P99:   percentile(0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
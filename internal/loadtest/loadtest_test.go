@@ -0,0 +1,70 @@
+package loadtest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+func TestRun_InMemory(t *testing.T) {
+	t.Setenv("PROVISION_RATE_LIMIT_SECONDS", "1")
+	t.Setenv("DECOMMISSION_RATE_LIMIT_SECONDS", "1")
+
+	cfg := Config{
+		Users:           6,
+		Labs:            3,
+		Duration:        2 * time.Second,
+		SwitchRate:      3600,
+		ReconnectRate:   7200,
+		IdleFraction:    0.3,
+		IdleTimeout:     2 * time.Second,
+		BootDelay:       20 * time.Millisecond,
+		DeleteDelay:     10 * time.Millisecond,
+		PollInterval:    10 * time.Millisecond,
+		CleanupInterval: 100 * time.Millisecond,
+		ReadyTimeout:    5 * time.Second,
+		Seed:            1,
+	}
+	store := redistest.New()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	report, err := Run(context.Background(), log, cfg, store)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if got := report.Operations[OpProvision].Count; got != cfg.Users {
+		t.Errorf("expected %d provisions, got %d", cfg.Users, got)
+	}
+	if len(report.Failures) != 0 {
+		t.Errorf("expected no failures, got %v", report.Failures)
+	}
+	idle := report.Operations[OpIdleExpiry].Count
+	if left := report.Operations[OpDecommission].Count; idle+left != cfg.Users {
+		t.Errorf("expected every student to leave or expire, got %d left and %d expired", left, idle)
+	}
+	if report.ServersLeft != 0 || store.ServerCount() != 0 {
+		t.Errorf("expected no servers left, got %d at the provider and %d cached", report.ServersLeft, store.ServerCount())
+	}
+	if report.ServersCreated <= cfg.Users && report.Operations[OpSwitch].Count > 0 {
+		t.Errorf("expected switches to create servers, got %d for %d switches", report.ServersCreated, report.Operations[OpSwitch].Count)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[len(samples)-1-i] = time.Duration(i+1) * time.Millisecond
+	}
+	stats := summarize(samples)
+	if stats.Count != 100 || stats.P50 != 50*time.Millisecond || stats.P90 != 90*time.Millisecond || stats.P99 != 99*time.Millisecond || stats.Max != 100*time.Millisecond {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if (summarize(nil) != Stats{}) {
+		t.Error("expected zero stats without samples")
+	}
+}
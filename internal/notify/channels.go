@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Slack posts notifications to a Slack incoming webhook
+type Slack struct {
+	URL    string
+	client *http.Client
+}
+
+// NewSlack creates a Slack channel that posts to url with client
+func NewSlack(url string, client *http.Client) *Slack {
+	return &Slack{URL: url, client: client}
+}
+
+// Send implements Channel
+func (s *Slack) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(map[string]string{"text": "*" + n.Title + "*\n" + n.Text()})
+	if err != nil {
+		return err
+	}
+	return post(ctx, s.client, s.URL, body, nil)
+}
+
+// Webhook POSTs the notification JSON to a URL. The event is sent in the X-Swim-Event header.
+type Webhook struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhook creates a webhook channel that posts to url with client
+func NewWebhook(url string, client *http.Client) *Webhook {
+	return &Webhook{URL: url, client: client}
+}
+
+// Send implements Channel
+func (w *Webhook) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return post(ctx, w.client, w.URL, body, map[string]string{"X-Swim-Event": n.Event})
+}
+
+// post sends a JSON body and fails on any non-2xx response
+func post(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sendMailFunc matches smtp.SendMail
+type sendMailFunc func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+
+// Email sends notifications as plain-text mail over SMTP
+type Email struct {
+	Addr string
+	From string
+	To   []string
+	auth smtp.Auth
+	send sendMailFunc
+}
+
+// NewEmail creates an email channel. Without a username mail is sent unauthenticated.
+func NewEmail(addr, username, password, from string, to []string) *Email {
+	e := &Email{Addr: addr, From: from, To: to, send: smtp.SendMail}
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		e.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return e
+}
+
+// Send implements Channel. net/smtp has no context support, so a send that
+// outlives ctx is abandoned rather than cancelled.
+func (e *Email) Send(ctx context.Context, n Notification) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [swim] %s\r\n", n.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.At.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text(), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- e.send(e.Addr, e.auth, e.From, e.To, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+const monitorInterval = time.Minute
+
+// DepthReader reports the number of messages waiting in queues
+type DepthReader interface {
+	QueueDepths(ctx context.Context, queueKeys ...string) (map[string]int64, error)
+}
+
+// QueueMonitor notifies when a request queue grows beyond a threshold
+type QueueMonitor struct {
+	log       *slog.Logger
+	store     DepthReader
+	notifier  *Notifier
+	threshold int64
+	interval  time.Duration
+}
+
+// NewQueueMonitor creates a monitor that alerts when the provision or decommission
+// queue holds more than threshold requests
+func NewQueueMonitor(log *slog.Logger, store DepthReader, notifier *Notifier, threshold int64) *QueueMonitor {
+	return &QueueMonitor{
+		log:       log,
+		store:     store,
+		notifier:  notifier,
+		threshold: threshold,
+		interval:  monitorInterval,
+	}
+}
+
+// Run checks the queue depths every minute until ctx is cancelled
+func (m *QueueMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(ctx)
+		}
+	}
+}
+
+// check sends one notification listing every queue over the threshold
+func (m *QueueMonitor) check(ctx context.Context) {
+	queueKeys := []string{config.ProvisionQueueKey, config.DecommissionQueueKey, config.CleanupQueueKey}
+	depths, err := m.store.QueueDepths(ctx, queueKeys...)
+	if err != nil {
+		m.log.Warn("failed to read queue depths", "error", err)
+		return
+	}
+
+	var backlog []string
+	for _, queueKey := range queueKeys {
+		if depth := depths[queueKey]; depth > m.threshold {
+			m.log.Warn("queue depth over alert threshold", "queue", queueKey, "depth", depth, "threshold", m.threshold)
+			backlog = append(backlog, fmt.Sprintf("%s holds %d requests", queueKey, depth))
+		}
+	}
+	if len(backlog) == 0 {
+		return
+	}
+
+	err = m.notifier.Notify(ctx, Notification{
+		Event:   EventQueueBacklog,
+		Title:   "Queue backlog",
+		Message: fmt.Sprintf("%s (threshold %d)", strings.Join(backlog, ", "), m.threshold),
+	})
+	if err != nil {
+		m.log.Warn("failed to send queue backlog notification", "error", err)
+	}
+}
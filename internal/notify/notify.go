@@ -0,0 +1,224 @@
+// Package notify alerts operators about failures that need attention, through
+// Slack, a generic webhook or email.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types notifications are sent for
+const (
+	EventProvisionFailed = "provision_failed" // a provision failed for good and its server was cleaned up
+	EventOrphanFound     = "orphan_found"     // reconciliation found a server no provision owns
+	EventQueueBacklog    = "queue_backlog"    // a queue is deeper than the alert threshold
+	EventStuckState      = "stuck_state"      // cache entries stayed provisioning or stopping beyond the watchdog threshold
+	EventProtectedServer = "protected_server" // a server labelled protected was kept instead of deleted
+	EventAbuseSuspected  = "abuse_suspected"  // a server's CPU or network usage looks like mining or an attack
+)
+
+// Channel names used in routes
+const (
+	ChannelSlack   = "slack"
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+)
+
+const (
+	defaultRateLimit = 5 * time.Minute
+	defaultTimeout   = 10 * time.Second
+)
+
+// Notification is one alert
+type Notification struct {
+	Event      string    `json:"event"`
+	Title      string    `json:"title"`
+	Message    string    `json:"message"`
+	Suppressed int       `json:"suppressed,omitempty"` // notifications of this event dropped by the rate limit since the last one
+	At         time.Time `json:"at"`
+}
+
+// Text is the message with a note about suppressed notifications, if any
+func (n Notification) Text() string {
+	if n.Suppressed == 0 {
+		return n.Message
+	}
+	return fmt.Sprintf("%s\n(%d similar notifications suppressed)", n.Message, n.Suppressed)
+}
+
+// Channel delivers notifications
+type Channel interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// Config contains notification settings
+type Config struct {
+	SlackWebhookURL string              // Slack incoming webhook; empty disables Slack
+	WebhookURL      string              // URL the notification JSON is POSTed to; empty disables the webhook
+	SMTPAddr        string              // SMTP server as host:port; empty disables email
+	SMTPUsername    string              // SMTP user; empty sends without authentication
+	SMTPPassword    string              // SMTP password
+	EmailFrom       string              // sender address
+	EmailTo         []string            // recipient addresses
+	Routes          map[string][]string // channel names per event type; nil sends every event to every channel
+	RateLimit       time.Duration       // minimum time between notifications of the same event type (default: 5m)
+	Timeout         time.Duration       // per-channel send timeout (default: 10s)
+}
+
+// Notifier sends notifications to the channels routed for their event type,
+// at most once per rate limit interval per event type
+type Notifier struct {
+	channels  map[string]Channel
+	routes    map[string][]string
+	rateLimit time.Duration
+	timeout   time.Duration
+	now       func() time.Time
+
+	mu         sync.Mutex
+	lastSent   map[string]time.Time
+	suppressed map[string]int
+}
+
+// New creates the notifier for the configured channels.
+// Returns nil if no channel is configured.
+func New(cfg Config) (*Notifier, error) {
+	channels := make(map[string]Channel)
+	if cfg.SlackWebhookURL != "" {
+		channels[ChannelSlack] = NewSlack(cfg.SlackWebhookURL, http.DefaultClient)
+	}
+	if cfg.WebhookURL != "" {
+		channels[ChannelWebhook] = NewWebhook(cfg.WebhookURL, http.DefaultClient)
+	}
+	if cfg.SMTPAddr != "" {
+		if cfg.EmailFrom == "" || len(cfg.EmailTo) == 0 {
+			return nil, fmt.Errorf("email notifications need a sender and at least one recipient")
+		}
+		channels[ChannelEmail] = NewEmail(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.EmailFrom, cfg.EmailTo)
+	}
+	if len(channels) == 0 {
+		return nil, nil
+	}
+
+	for event, names := range cfg.Routes {
+		for _, name := range names {
+			if _, ok := channels[name]; !ok {
+				return nil, fmt.Errorf("event %s is routed to channel %q, which is not configured", event, name)
+			}
+		}
+	}
+	return NewNotifier(channels, cfg.Routes, cfg.RateLimit, cfg.Timeout), nil
+}
+
+// NewNotifier creates a notifier for named channels. A nil routes map sends every
+// event to every channel; zero durations use the defaults.
+func NewNotifier(channels map[string]Channel, routes map[string][]string, rateLimit, timeout time.Duration) *Notifier {
+	if rateLimit <= 0 {
+		rateLimit = defaultRateLimit
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Notifier{
+		channels:   channels,
+		routes:     routes,
+		rateLimit:  rateLimit,
+		timeout:    timeout,
+		now:        time.Now,
+		lastSent:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// Notify sends n to the channels routed for its event and returns their combined errors.
+// Within the rate limit interval of the last notification of the same event type n is
+// only counted, and the count is reported with the next notification that goes out.
+func (n *Notifier) Notify(ctx context.Context, notification Notification) error {
+	names := n.channelsFor(notification.Event)
+	if len(names) == 0 {
+		return nil
+	}
+
+	now := n.now()
+	n.mu.Lock()
+	if last, ok := n.lastSent[notification.Event]; ok && now.Sub(last) < n.rateLimit {
+		n.suppressed[notification.Event]++
+		n.mu.Unlock()
+		return nil
+	}
+	n.lastSent[notification.Event] = now
+	notification.Suppressed = n.suppressed[notification.Event]
+	delete(n.suppressed, notification.Event)
+	n.mu.Unlock()
+
+	if notification.At.IsZero() {
+		notification.At = now.UTC()
+	}
+
+	var errs []error
+	for _, name := range names {
+		sendCtx, cancel := context.WithTimeout(ctx, n.timeout)
+		if err := n.channels[name].Send(sendCtx, notification); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// channelsFor returns the names of the channels event is sent to
+func (n *Notifier) channelsFor(event string) []string {
+	if n.routes != nil {
+		return n.routes[event]
+	}
+	names := make([]string, 0, len(n.channels))
+	for name := range n.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseRoutes parses per-event routing such as "provision_failed=slack,email;queue_backlog=webhook".
+// Events left out of a non-empty spec are not sent anywhere. An empty spec returns nil.
+func ParseRoutes(spec string) (map[string][]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	routes := make(map[string][]string)
+	for _, rule := range strings.Split(spec, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		event, channels, ok := strings.Cut(rule, "=")
+		event = strings.TrimSpace(event)
+		if !ok {
+			return nil, fmt.Errorf("invalid route %q (want event=channel,...)", rule)
+		}
+		switch event {
+		case EventProvisionFailed, EventOrphanFound, EventQueueBacklog, EventStuckState, EventProtectedServer, EventAbuseSuspected:
+		default:
+			return nil, fmt.Errorf("unknown notification event %q", event)
+		}
+
+		routes[event] = []string{}
+		for _, channel := range strings.Split(channels, ",") {
+			channel = strings.TrimSpace(channel)
+			switch channel {
+			case "":
+				continue
+			case ChannelSlack, ChannelWebhook, ChannelEmail:
+				routes[event] = append(routes[event], channel)
+			default:
+				return nil, fmt.Errorf("unknown notification channel %q", channel)
+			}
+		}
+	}
+	return routes, nil
+}
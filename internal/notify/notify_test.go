@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// recordingChannel remembers the notifications it was sent
+type recordingChannel struct {
+	sent []Notification
+	err  error
+}
+
+func (c *recordingChannel) Send(ctx context.Context, n Notification) error {
+	c.sent = append(c.sent, n)
+	return c.err
+}
+
+func TestNew(t *testing.T) {
+	if n, err := New(Config{}); n != nil || err != nil {
+		t.Errorf("expected nil notifier without channels, got %+v, %v", n, err)
+	}
+	if _, err := New(Config{SMTPAddr: "mail:25"}); err == nil {
+		t.Error("expected error for email without sender and recipients")
+	}
+	routes := map[string][]string{EventOrphanFound: {ChannelEmail}}
+	if _, err := New(Config{SlackWebhookURL: "http://slack", Routes: routes}); err == nil {
+		t.Error("expected error for a route to an unconfigured channel")
+	}
+}
+
+func TestNotify_Routes(t *testing.T) {
+	slack, email := &recordingChannel{}, &recordingChannel{}
+	channels := map[string]Channel{ChannelSlack: slack, ChannelEmail: email}
+	routes := map[string][]string{EventProvisionFailed: {ChannelSlack, ChannelEmail}, EventQueueBacklog: {ChannelSlack}}
+	n := NewNotifier(channels, routes, time.Minute, time.Second)
+
+	for _, event := range []string{EventProvisionFailed, EventQueueBacklog, EventOrphanFound} {
+		if err := n.Notify(context.Background(), Notification{Event: event}); err != nil {
+			t.Fatalf("Notify returned error: %v", err)
+		}
+	}
+	if len(slack.sent) != 2 || len(email.sent) != 1 || email.sent[0].Event != EventProvisionFailed {
+		t.Errorf("expected slack to get 2 and email 1 notification, got %d and %d", len(slack.sent), len(email.sent))
+	}
+
+	// Without routes every event goes everywhere, and errors are combined
+	slack.err = errors.New("slack down")
+	err := NewNotifier(channels, nil, time.Minute, time.Second).Notify(context.Background(), Notification{Event: EventOrphanFound})
+	if err == nil || !strings.Contains(err.Error(), "slack down") || len(email.sent) != 2 {
+		t.Errorf("expected slack error and delivery to email, got %v", err)
+	}
+}
+
+func TestNotify_RateLimit(t *testing.T) {
+	channel := &recordingChannel{}
+	n := NewNotifier(map[string]Channel{ChannelWebhook: channel}, nil, 5*time.Minute, time.Second)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	n.Notify(ctx, Notification{Event: EventProvisionFailed, Message: "first"})
+	n.Notify(ctx, Notification{Event: EventProvisionFailed, Message: "second"})
+	n.Notify(ctx, Notification{Event: EventProvisionFailed, Message: "third"})
+	n.Notify(ctx, Notification{Event: EventOrphanFound, Message: "other event"})
+
+	now = now.Add(5 * time.Minute)
+	n.Notify(ctx, Notification{Event: EventProvisionFailed, Message: "fourth"})
+
+	if len(channel.sent) != 3 {
+		t.Fatalf("expected 3 notifications through the rate limit, got %d", len(channel.sent))
+	}
+	last := channel.sent[2]
+	if last.Message != "fourth" || last.Suppressed != 2 || !strings.Contains(last.Text(), "2 similar notifications suppressed") {
+		t.Errorf("expected fourth notification to report 2 suppressed, got %+v", last)
+	}
+	if !last.At.Equal(now) {
+		t.Errorf("expected notification time %v, got %v", now, last.At)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("provision_failed=slack, email; queue_backlog=")
+	if err != nil {
+		t.Fatalf("ParseRoutes returned error: %v", err)
+	}
+	if strings.Join(routes[EventProvisionFailed], ",") != "slack,email" || len(routes[EventQueueBacklog]) != 0 {
+		t.Errorf("unexpected routes: %v", routes)
+	}
+	if _, ok := routes[EventOrphanFound]; ok {
+		t.Errorf("expected orphan_found to be left unrouted, got %v", routes)
+	}
+
+	if routes, err := ParseRoutes(""); routes != nil || err != nil {
+		t.Errorf("expected nil routes for empty spec, got %v, %v", routes, err)
+	}
+	for _, spec := range []string{"provision_failed", "unknown=slack", "orphan_found=pager"} {
+		if _, err := ParseRoutes(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestSlackAndWebhook(t *testing.T) {
+	var slackBody map[string]string
+	var webhookBody Notification
+	var webhookEvent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slack":
+			json.NewDecoder(r.Body).Decode(&slackBody)
+		case "/webhook":
+			webhookEvent = r.Header.Get("X-Swim-Event")
+			json.NewDecoder(r.Body).Decode(&webhookBody)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	n := Notification{Event: EventOrphanFound, Title: "Orphaned server found", Message: "server 42", Suppressed: 1}
+	ctx := context.Background()
+	if err := NewSlack(srv.URL+"/slack", srv.Client()).Send(ctx, n); err != nil {
+		t.Fatalf("slack send failed: %v", err)
+	}
+	if slackBody["text"] != "*Orphaned server found*\nserver 42\n(1 similar notifications suppressed)" {
+		t.Errorf("unexpected slack text: %q", slackBody["text"])
+	}
+
+	if err := NewWebhook(srv.URL+"/webhook", srv.Client()).Send(ctx, n); err != nil {
+		t.Fatalf("webhook send failed: %v", err)
+	}
+	if webhookEvent != EventOrphanFound || webhookBody.Message != "server 42" || webhookBody.Suppressed != 1 {
+		t.Errorf("unexpected webhook request: event %q, body %+v", webhookEvent, webhookBody)
+	}
+
+	err := NewWebhook(srv.URL+"/missing", srv.Client()).Send(ctx, n)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected status error, got %v", err)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	email := NewEmail("mail.example.com:587", "swim", "secret", "swim@example.com", []string{"ops@example.com", "tas@example.com"})
+	var gotAddr string
+	var gotTo []string
+	var gotMsg string
+	email.send = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotTo, gotMsg = addr, to, string(msg)
+		if auth == nil {
+			return errors.New("expected authentication")
+		}
+		return nil
+	}
+
+	n := Notification{Title: "Provisioning failed", Message: "user alice, lab 12: quota exceeded", At: time.Now()}
+	if err := email.Send(context.Background(), n); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if gotAddr != "mail.example.com:587" || len(gotTo) != 2 {
+		t.Errorf("unexpected envelope: %s %v", gotAddr, gotTo)
+	}
+	if !strings.Contains(gotMsg, "Subject: [swim] Provisioning failed\r\n") ||
+		!strings.Contains(gotMsg, "To: ops@example.com, tas@example.com\r\n") ||
+		!strings.HasSuffix(gotMsg, "\r\n\r\nuser alice, lab 12: quota exceeded\r\n") {
+		t.Errorf("unexpected message:\n%s", gotMsg)
+	}
+}
+
+type fakeDepths map[string]int64
+
+func (f fakeDepths) QueueDepths(ctx context.Context, queueKeys ...string) (map[string]int64, error) {
+	return f, nil
+}
+
+func TestQueueMonitor(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	channel := &recordingChannel{}
+	notifier := NewNotifier(map[string]Channel{ChannelSlack: channel}, nil, time.Minute, time.Second)
+
+	NewQueueMonitor(log, fakeDepths{config.ProvisionQueueKey: 10}, notifier, 10).check(context.Background())
+	if len(channel.sent) != 0 {
+		t.Fatalf("expected no notification at the threshold, got %+v", channel.sent)
+	}
+
+	depths := fakeDepths{config.ProvisionQueueKey: 25, config.DecommissionQueueKey: 11}
+	NewQueueMonitor(log, depths, notifier, 10).check(context.Background())
+	if len(channel.sent) != 1 || channel.sent[0].Event != EventQueueBacklog {
+		t.Fatalf("expected one backlog notification, got %+v", channel.sent)
+	}
+	msg := channel.sent[0].Message
+	if !strings.Contains(msg, config.ProvisionQueueKey+" holds 25") || !strings.Contains(msg, config.DecommissionQueueKey+" holds 11") {
+		t.Errorf("expected both queues in the message, got %q", msg)
+	}
+}
@@ -0,0 +1,139 @@
+// Package override lets instructor tooling skip the per-user rate limits and the tenant
+// quota, e.g. to force-restart a student's lab during a live session without waiting out
+// the window. A payload asks for it with "admin": true and names the instructor in
+// "adminActor"; the request is only let through if the override carries a valid HMAC, or
+// its actor is allowlisted and the payload itself is authenticated by payload signing.
+package override
+
+import (
+	"crypto/hmac"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/signing"
+)
+
+// Verification failures
+var (
+	ErrDisabled     = errors.New("admin overrides are not enabled")
+	ErrNoActor      = errors.New("admin override names no actor")
+	ErrUnknownActor = errors.New("admin override actor is not allowed")
+	ErrBadSignature = errors.New("admin override signature is invalid")
+	ErrExpired      = errors.New("admin override signature has expired")
+	ErrFuture       = errors.New("admin override signature is from the future")
+	ErrUnsigned     = errors.New("admin overrides of an allowlisted actor need signed payloads")
+)
+
+// Operations an override is signed for
+const (
+	OperationProvision    = "provision"
+	OperationDecommission = "decommission"
+	OperationRebuild      = "rebuild"
+	OperationResize       = "resize"
+)
+
+// maxClockSkew is how far in the future a signature's timestamp may be, for the clocks of
+// the tooling and SWIM not agreeing
+const maxClockSkew = 30 * time.Second
+
+// Fields are the override fields a queue payload carries next to its own. Signature is the hex
+// HMAC-SHA256 of "{adminTimestamp}.{adminActor}.{operation}.{webuserid}.{labId}" under the
+// override secret, with labId 0 for a request naming no lab.
+type Fields struct {
+	Admin     bool   `json:"admin,omitempty"`
+	Actor     string `json:"adminActor,omitempty"`
+	Timestamp int64  `json:"adminTimestamp,omitempty"` // unix seconds
+	Signature string `json:"adminSignature,omitempty"`
+}
+
+// Verifier decides whether the override of a payload is granted
+type Verifier struct {
+	signer *signing.Signer // nil when overrides are not signed
+	maxAge time.Duration
+	actors map[string]bool // empty allows every actor of a signed override
+	clock  clock.Clock
+
+	// signedPayloads is set when every payload is authenticated by payload signing, which
+	// lets an allowlisted actor override without a signature of its own
+	signedPayloads bool
+}
+
+// NewVerifier creates a verifier. With a secret, overrides must be signed with it, no older
+// than a positive maxAge; with actors, only the named actors may override. Without a secret,
+// overrides are only granted to the actors once WithSignedPayloads is set; otherwise, like
+// without either, every override is refused.
+func NewVerifier(secret []byte, actors []string, maxAge time.Duration) *Verifier {
+	v := &Verifier{maxAge: maxAge, actors: make(map[string]bool), clock: clock.Real}
+	if len(secret) > 0 {
+		v.signer = signing.NewSigner(secret, 0)
+	}
+	for _, actor := range actors {
+		if actor = strings.TrimSpace(actor); actor != "" {
+			v.actors[actor] = true
+		}
+	}
+	return v
+}
+
+// WithSignedPayloads grants the overrides of allowlisted actors without an override
+// signature, since payload signing already authenticates the payloads carrying them.
+// Only for payloads that can't be pushed unsigned.
+func (v *Verifier) WithSignedPayloads() *Verifier {
+	v.signedPayloads = true
+	return v
+}
+
+// WithClock ages signatures with c instead of the system clock
+func (v *Verifier) WithClock(c clock.Clock) *Verifier {
+	v.clock = c
+	return v
+}
+
+// Check reports whether f grants an override for the operation request of webUserID for
+// labID, 0 if it names no lab. A payload that doesn't ask for one returns false and no
+// error; a refused override returns the reason. A nil verifier refuses every override.
+func (v *Verifier) Check(operation, webUserID string, labID int, f Fields) (bool, error) {
+	if !f.Admin {
+		return false, nil
+	}
+	if v == nil || (v.signer == nil && len(v.actors) == 0) {
+		return false, ErrDisabled
+	}
+	if f.Actor == "" {
+		return false, ErrNoActor
+	}
+	if len(v.actors) > 0 && !v.actors[f.Actor] {
+		return false, ErrUnknownActor
+	}
+	if v.signer == nil {
+		if !v.signedPayloads {
+			return false, ErrUnsigned
+		}
+		return true, nil
+	}
+
+	expected := v.Signature(f.Timestamp, f.Actor, operation, webUserID, labID)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(f.Signature))) {
+		return false, ErrBadSignature
+	}
+	age := v.clock.Now().Sub(time.Unix(f.Timestamp, 0))
+	if age < -maxClockSkew {
+		return false, ErrFuture
+	}
+	if v.maxAge > 0 && age > v.maxAge {
+		return false, ErrExpired
+	}
+	return true, nil
+}
+
+// Signature computes the hex HMAC of an override, for tooling and tests. It is empty
+// when overrides are not signed.
+func (v *Verifier) Signature(timestamp int64, actor, operation, webUserID string, labID int) string {
+	if v == nil || v.signer == nil {
+		return ""
+	}
+	return v.signer.Signature(timestamp, actor+"."+operation+"."+webUserID+"."+strconv.Itoa(labID))
+}
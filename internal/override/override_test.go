@@ -0,0 +1,74 @@
+package override
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+)
+
+func TestVerifier_Check(t *testing.T) {
+	now := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	signed := NewVerifier([]byte("secret"), nil, time.Minute).WithClock(now)
+	allowlist := NewVerifier(nil, []string{"alice", " bob "}, 0).WithSignedPayloads()
+	unsignedAllowlist := NewVerifier(nil, []string{"alice"}, 0)
+	both := NewVerifier([]byte("secret"), []string{"alice"}, time.Minute).WithClock(now)
+
+	ts := now.Now().Unix()
+	sign := func(v *Verifier, actor, user string) Fields {
+		return Fields{Admin: true, Actor: actor, Timestamp: ts, Signature: v.Signature(ts, actor, OperationProvision, user, 3)}
+	}
+
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		fields   Fields
+		granted  bool
+		err      error
+	}{
+		{"not requested", signed, Fields{Actor: "alice"}, false, nil},
+		{"nil verifier", nil, Fields{Admin: true, Actor: "alice"}, false, ErrDisabled},
+		{"nothing configured", NewVerifier(nil, nil, 0), Fields{Admin: true, Actor: "alice"}, false, ErrDisabled},
+		{"no actor", allowlist, Fields{Admin: true}, false, ErrNoActor},
+		{"allowlisted", allowlist, Fields{Admin: true, Actor: "bob"}, true, nil},
+		{"not allowlisted", allowlist, Fields{Admin: true, Actor: "mallory"}, false, ErrUnknownActor},
+		{"allowlisted in an unsigned payload", unsignedAllowlist, Fields{Admin: true, Actor: "alice"}, false, ErrUnsigned},
+		{"signed", signed, sign(signed, "carol", "user-1"), true, nil},
+		{"signed for another user", signed, sign(signed, "carol", "user-2"), false, ErrBadSignature},
+		{"signed for another operation", signed, Fields{Admin: true, Actor: "carol", Timestamp: ts,
+			Signature: signed.Signature(ts, "carol", OperationDecommission, "user-1", 3)}, false, ErrBadSignature},
+		{"signed for another lab", signed, Fields{Admin: true, Actor: "carol", Timestamp: ts,
+			Signature: signed.Signature(ts, "carol", OperationProvision, "user-1", 4)}, false, ErrBadSignature},
+		{"unsigned", signed, Fields{Admin: true, Actor: "carol", Timestamp: ts}, false, ErrBadSignature},
+		{"signed and allowlisted", both, sign(both, "alice", "user-1"), true, nil},
+		{"signed but not allowlisted", both, sign(both, "carol", "user-1"), false, ErrUnknownActor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			granted, err := tt.verifier.Check(OperationProvision, "user-1", 3, tt.fields)
+			if granted != tt.granted || !errors.Is(err, tt.err) {
+				t.Errorf("expected %v (%v), got %v (%v)", tt.granted, tt.err, granted, err)
+			}
+		})
+	}
+
+	// A signature older than maxAge is refused
+	fields := sign(signed, "carol", "user-1")
+	now.Advance(time.Minute + time.Second)
+	if granted, err := signed.Check(OperationProvision, "user-1", 3, fields); granted || !errors.Is(err, ErrExpired) {
+		t.Errorf("expected an expired override, got %v (%v)", granted, err)
+	}
+
+	// A signature from the future is refused beyond the clock skew, so it can't outlive maxAge
+	for _, tt := range []struct {
+		ahead time.Duration
+		err   error
+	}{{10 * time.Second, nil}, {time.Hour, ErrFuture}} {
+		future := now.Now().Add(tt.ahead).Unix()
+		fields := Fields{Admin: true, Actor: "carol", Timestamp: future, Signature: signed.Signature(future, "carol", OperationProvision, "user-1", 3)}
+		if granted, err := signed.Check(OperationProvision, "user-1", 3, fields); granted != (tt.err == nil) || !errors.Is(err, tt.err) {
+			t.Errorf("%s ahead: expected %v, got %v (%v)", tt.ahead, tt.err, granted, err)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/userhash"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// ErrStop is returned by a step that ended the request itself, e.g. a rejected or
+// duplicate request, after logging and reporting why. No further step runs.
+var ErrStop = errors.New("provision request stopped")
+
+// Request is a provision request as it moves through the steps of ProcessRequest. Each
+// step fills in the fields the steps after it need.
+type Request struct {
+	// Set by Decode
+	Payload       string
+	WebUserID     string
+	LabID         int
+	TenantID      string // as requested; Tenant is the tenant it resolved to
+	CorrelationID string
+	EnqueuedAt    time.Time
+	Override      override.Fields // as requested; checked by Admit
+	Seq           int64           // operation sequence number of the user, 0 if unsequenced
+
+	// Log carries the user and lab, and the tenant and server once they are known
+	Log *slog.Logger
+
+	// Set by Admit
+	Tenant     *tenant.Tenant
+	AdminActor string // instructor whose granted override skips the quota and rate limit, empty without one
+
+	// Set by PrepareState: the cache entry and the state written to it, kept up to date
+	// with every write by the later steps
+	CacheKey string
+	State    redis.ServerState
+
+	// Set by Create
+	Server     connector.Server
+	CloudState string
+}
+
+// Decoder parses and validates the payload of a provision request
+type Decoder interface {
+	Decode(ctx context.Context, payload string) (*Request, error)
+}
+
+// Admitter decides whether a request is served, before anything is written
+type Admitter interface {
+	Admit(ctx context.Context, req *Request) error
+}
+
+// StatePreparer writes the initial state of an admitted request to the cache, or stops a
+// request that is rate limited or a duplicate
+type StatePreparer interface {
+	PrepareState(ctx context.Context, req *Request) error
+}
+
+// Creator creates the servers of a request
+type Creator interface {
+	Create(ctx context.Context, req *Request) error
+}
+
+// StateTracker caches the state of the created servers and follows it until they are
+// available or have failed
+type StateTracker interface {
+	TrackState(ctx context.Context, req *Request)
+}
+
+// Steps are the stages ProcessRequest runs a request through, in field order. A step can
+// wrap the default one, see DefaultSteps, to add checks or side effects around it.
+type Steps struct {
+	Decode       Decoder
+	Admit        Admitter
+	PrepareState StatePreparer
+	Create       Creator
+	TrackState   StateTracker
+}
+
+// DefaultSteps returns the built-in steps of the provisioner
+func (p *Provisioner) DefaultSteps() Steps {
+	return Steps{
+		Decode:       decodeStep{p},
+		Admit:        admitStep{p},
+		PrepareState: prepareStateStep{p},
+		Create:       createStep{p},
+		TrackState:   trackStateStep{p},
+	}
+}
+
+// WithSteps replaces the steps that are set in steps; the others stay as they are
+func (p *Provisioner) WithSteps(steps Steps) *Provisioner {
+	if steps.Decode != nil {
+		p.steps.Decode = steps.Decode
+	}
+	if steps.Admit != nil {
+		p.steps.Admit = steps.Admit
+	}
+	if steps.PrepareState != nil {
+		p.steps.PrepareState = steps.PrepareState
+	}
+	if steps.Create != nil {
+		p.steps.Create = steps.Create
+	}
+	if steps.TrackState != nil {
+		p.steps.TrackState = steps.TrackState
+	}
+	return p
+}
+
+// ProcessRequest handles a single provision request from the queue:
+// Decode → Admit → PrepareState → Create → TrackState
+func (p *Provisioner) ProcessRequest(ctx context.Context, payload string) {
+	req, err := p.steps.Decode.Decode(ctx, payload)
+	if err != nil {
+		if !errors.Is(err, ErrStop) {
+			p.log.Error("failed to decode provision request", "error", err)
+		}
+		return
+	}
+
+	ctx = tracing.WithCorrelationID(ctx, req.CorrelationID)
+	req.Log = p.logger(ctx).With("webuserid", req.WebUserID, "labid", req.LabID)
+
+	steps := []struct {
+		name string
+		run  func(context.Context, *Request) error
+	}{
+		{"admit", p.steps.Admit.Admit},
+		{"prepare_state", p.steps.PrepareState.PrepareState},
+		{"create", p.steps.Create.Create},
+	}
+	for _, step := range steps {
+		if err := step.run(ctx, req); err != nil {
+			if !errors.Is(err, ErrStop) {
+				req.Log.Error("provision request failed", "step", step.name, "error", err)
+			}
+			return
+		}
+	}
+	p.steps.TrackState.TrackState(ctx, req)
+}
+
+// decodeStep parses the payload and rejects malformed fields
+type decodeStep struct{ p *Provisioner }
+
+func (s decodeStep) Decode(ctx context.Context, payload string) (*Request, error) {
+	// Extract WebUserID and LabID from the minimal request
+	var fields struct {
+		WebUserID     string    `json:"webuserid"`
+		LabID         int       `json:"labId"`
+		Tenant        string    `json:"tenant"`
+		CorrelationID string    `json:"correlationId"`
+		EnqueuedAt    time.Time `json:"enqueuedAt"`
+		Seq           int64     `json:"seq"`
+		override.Fields
+	}
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return nil, fmt.Errorf("parse payload: %w", err)
+	}
+
+	// Reject malformed fields before they reach cache keys, provider labels and logs
+	if err := validate.First(validate.WebUserID(fields.WebUserID), validate.LabID(fields.LabID),
+		validate.CorrelationID(fields.CorrelationID), validate.Text("tenant", fields.Tenant, validate.MaxLabelLength)); err != nil {
+		s.p.log.Error("rejecting invalid provision request", "error", err)
+		s.p.recordEvent(ctx, redis.Event{Type: redis.EventProvisionFailed, Message: err.Error()})
+		return nil, ErrStop
+	}
+
+	return &Request{
+		Payload:       payload,
+		WebUserID:     fields.WebUserID,
+		LabID:         fields.LabID,
+		TenantID:      fields.Tenant,
+		CorrelationID: fields.CorrelationID,
+		EnqueuedAt:    fields.EnqueuedAt,
+		Override:      fields.Fields,
+		Seq:           fields.Seq,
+	}, nil
+}
+
+// admitStep drops stale and out-of-order requests, checks the tenant's lab catalog and
+// quota, and grants admin overrides
+type admitStep struct{ p *Provisioner }
+
+func (s admitStep) Admit(ctx context.Context, req *Request) error {
+	p := s.p
+
+	// The student of a request queued while SWIM was down or backed up is long gone
+	if age := p.clock.Now().Sub(req.EnqueuedAt); p.maxAge > 0 && !req.EnqueuedAt.IsZero() && age > p.maxAge {
+		req.Log.Warn("dropping stale provision request", "enqueued_at", req.EnqueuedAt, "age", age.Round(time.Second))
+		p.deadLetter(ctx, req.Payload)
+		p.recordEvent(ctx, redis.Event{Type: redis.EventStaleRequest, WebUserID: req.WebUserID, Tenant: req.TenantID,
+			LabID: req.LabID, Message: fmt.Sprintf("enqueued %s ago", age.Round(time.Second))})
+		return ErrStop
+	}
+
+	// Resolve the tenant and check its lab catalog and quota before anything is written
+	t, err := p.tenants.Get(req.TenantID)
+	if err != nil {
+		req.Log.Error("rejecting provision request", "error", err)
+		p.recordEvent(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: req.WebUserID, Tenant: req.TenantID,
+			LabID: req.LabID, Message: err.Error()})
+		return ErrStop
+	}
+	req.Tenant = t
+	if t.ID != "" {
+		req.Log = req.Log.With("tenant", t.ID)
+	}
+	if !t.AllowsLab(req.LabID) {
+		req.Log.Error("rejecting provision request, lab is not in the tenant's catalog")
+		p.recordEvent(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: req.WebUserID, Tenant: t.ID,
+			LabID: req.LabID, Message: fmt.Sprintf("lab %d is not in the catalog of tenant %q", req.LabID, t.ID)})
+		return ErrStop
+	}
+	if err := s.checkSequence(ctx, req); err != nil {
+		return err
+	}
+	s.checkOverride(ctx, req)
+	if t.MaxServers > 0 && req.AdminActor == "" {
+		count, err := p.countTenantServers(ctx, t.ID, req.WebUserID, t.MaxServers)
+		if err != nil {
+			req.Log.Error("failed to check tenant quota, dropping message", "error", err)
+			return ErrStop
+		}
+		if count >= t.MaxServers {
+			req.Log.Warn("tenant quota reached, dropping message", "max_servers", t.MaxServers)
+			p.recordEvent(ctx, redis.Event{Type: redis.EventRateLimited, WebUserID: req.WebUserID, Tenant: t.ID,
+				LabID: req.LabID, Message: fmt.Sprintf("tenant quota of %d servers reached", t.MaxServers)})
+			return ErrStop
+		}
+	}
+	return nil
+}
+
+// checkSequence drops a request whose sequence number a later request of the user has
+// overtaken, e.g. a provision read after the decommission that cleanup queued after it
+func (s admitStep) checkSequence(ctx context.Context, req *Request) error {
+	p := s.p
+	if p.sequencer == nil || req.Seq <= 0 {
+		return nil
+	}
+	applied, last, err := p.sequencer.ApplySequence(ctx, redis.TenantUserID(req.Tenant.ID, req.WebUserID), req.Seq)
+	if err != nil {
+		req.Log.Error("failed to check sequence number, dropping message", "seq", req.Seq, "error", err)
+		return ErrStop
+	}
+	if !applied {
+		req.Log.Warn("dropping out-of-order provision request", "seq", req.Seq, "applied_seq", last)
+		p.recordEvent(ctx, redis.Event{Type: redis.EventOutOfOrder, WebUserID: req.WebUserID, Tenant: req.Tenant.ID,
+			LabID: req.LabID, Message: fmt.Sprintf("sequence %d overtaken by %d", req.Seq, last)})
+		return ErrStop
+	}
+	return nil
+}
+
+// checkOverride grants the admin override of the request, if it asks for one. A refused
+// override is recorded and the request is served under the usual limits.
+func (s admitStep) checkOverride(ctx context.Context, req *Request) {
+	granted, err := s.p.overrides.Check(override.OperationProvision, req.WebUserID, req.LabID, req.Override)
+	if err != nil {
+		req.Log.Warn("refusing admin override", "admin_actor", req.Override.Actor, "error", err)
+		s.p.recordEvent(ctx, redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: req.Tenant.ID,
+			LabID: req.LabID, Message: fmt.Sprintf("override by %q refused: %v", req.Override.Actor, err)})
+		return
+	}
+	if granted {
+		req.AdminActor = req.Override.Actor
+		req.Log = req.Log.With("admin_actor", req.AdminActor)
+		req.Log.Info("admin override granted, skipping quota and rate limit")
+		s.p.recordEvent(ctx, redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: req.Tenant.ID,
+			LabID: req.LabID, Message: fmt.Sprintf("override by %q", req.AdminActor)})
+	}
+}
+
+// prepareStateStep writes the initial provisioning state through the admission script,
+// which also spots duplicates and lab switches and applies their rate limit windows
+type prepareStateStep struct{ p *Provisioner }
+
+func (s prepareStateStep) PrepareState(ctx context.Context, req *Request) error {
+	p := s.p
+	t := req.Tenant
+
+	// Build cache key (note: labId is stored in the state, not the key)
+	req.CacheKey = redis.ServerCacheKey(redis.TenantUserID(t.ID, req.WebUserID))
+
+	// Get SSH username from environment (default: "student")
+	sshUsername := "student"
+	if envUser := os.Getenv("SSH_USERNAME"); envUser != "" {
+		sshUsername = envUser
+	}
+
+	// Get TTL from environment (default: 30 minutes)
+	ttlMinutes := 30
+	if envTTL := os.Getenv("DEFAULT_TTL_MINUTES"); envTTL != "" {
+		if ttl, err := strconv.Atoi(envTTL); err == nil {
+			ttlMinutes = ttl
+		}
+	}
+	createdAt := p.clock.Now()
+	expiresAt := createdAt.Add(time.Duration(ttlMinutes) * time.Minute)
+
+	// Initial provisioning state, written by the admission script if the request is admitted
+	initialState := redis.ServerState{
+		User:          sshUsername,
+		Address:       "", // Will be set after provisioning
+		Status:        config.StatusProvisioning,
+		Available:     false, // Not available until running
+		CloudStatus:   "",    // Will be set after provisioning
+		ServerID:      "",    // Will be set after provisioning
+		ExpiresAt:     expiresAt,
+		CreatedAt:     createdAt,
+		WebUserID:     req.WebUserID,
+		LabID:         req.LabID,
+		Tenant:        t.ID,
+		CorrelationID: req.CorrelationID,
+	}
+
+	// Atomically check the existing cache entry and the start or switch window, and write
+	// initial state. An admin override is admitted without taking a window.
+	limits := redis.AdmissionLimits{Start: t.ProvisionRateLimit(), Switch: t.SwitchRateLimit()}
+	if req.AdminActor != "" {
+		limits = redis.AdmissionLimits{}
+	}
+	admission, err := p.admitProvisionWithRetry(ctx, req.CacheKey, initialState, limits)
+	if err != nil {
+		req.Log.Error("failed to run provision admission after retries, dropping message", "error", err)
+		p.reportFailure(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: req.WebUserID, Tenant: t.ID,
+			LabID: req.LabID, Message: err.Error()})
+		return ErrStop
+	}
+
+	switch admission.Decision {
+	case redis.AdmissionRateLimited:
+		if admission.Existing != nil {
+			req.Log.Warn("switch rate limit hit, dropping message", "current_labid", admission.Existing.LabID)
+		} else {
+			req.Log.Warn("provision rate limit hit, dropping message")
+		}
+		p.recordEvent(ctx, redis.Event{Type: redis.EventRateLimited, WebUserID: req.WebUserID, Tenant: t.ID, LabID: req.LabID})
+		return ErrStop
+
+	case redis.AdmissionDuplicate:
+		// Same labId - this is a duplicate request, do nothing
+		req.Log.Info("server already exists with same labId, ignoring duplicate request",
+			"server_id", admission.Existing.ServerID,
+			"status", admission.Existing.Status,
+			"address", admission.Existing.Address)
+		return ErrStop
+
+	case redis.AdmissionReplaced:
+		// Different labId - need to decommission old server and provision new one
+		s.decommissionReplaced(ctx, req, admission.Existing)
+		// Continue with provisioning new server below
+	}
+
+	initialState.Version = admission.Version
+	req.State = initialState
+	req.Log.Info("initial provisioning state cached")
+	p.recordHistory(ctx, redis.Event{Type: redis.EventProvisionStarted, WebUserID: req.WebUserID, Tenant: t.ID, LabID: req.LabID})
+
+	// Keep the label hash resolvable; the provider only ever sees the hash
+	if secret := userhash.SecretFromEnv(); secret != "" {
+		if err := p.redisClient.PushUserHash(ctx, userhash.Hash(secret, req.WebUserID), req.WebUserID, config.ServerCacheTTL); err != nil {
+			req.Log.Warn("failed to store user hash mapping", "error", err)
+		}
+	}
+	return nil
+}
+
+// decommissionReplaced queues the decommission of the server of another lab the request's
+// entry replaced. A failure is only logged: the new lab is provisioned anyway.
+func (s prepareStateStep) decommissionReplaced(ctx context.Context, req *Request, existingState *redis.ServerState) {
+	req.Log.Info("server exists with different labId, triggering decommission and starting new provision",
+		"old_labid", existingState.LabID,
+		"new_labid", req.LabID,
+		"old_server_id", existingState.ServerID)
+
+	// Push decommission request to queue (non-blocking)
+	// Include serverID so decommissioner can delete even if cache entry is replaced, and
+	// mark it as part of the switch so it doesn't take the user's stop window
+	decommissionPayload, err := json.Marshal(struct {
+		WebUserID     string `json:"webuserid"`
+		LabID         int    `json:"labId"`
+		ServerID      string `json:"serverId"`
+		CorrelationID string `json:"correlationId,omitempty"`
+		Switch        bool   `json:"switch"`
+	}{req.WebUserID, existingState.LabID, existingState.ServerID, req.CorrelationID, true})
+	if err != nil {
+		req.Log.Error("failed to marshal decommission request", "error", err)
+	} else if err := s.p.redisClient.PushPayload(ctx, config.DecommissionQueueKey, string(decommissionPayload)); err != nil {
+		req.Log.Error("failed to queue decommission request", "error", err)
+		// Continue with provisioning anyway - decommission can be handled later
+	} else {
+		req.Log.Info("decommission request queued for old server", "old_server_id", existingState.ServerID)
+	}
+}
+
+// createStep creates the servers and builds the state describing them. If creation
+// fails, the initial state is removed again.
+type createStep struct{ p *Provisioner }
+
+func (s createStep) Create(ctx context.Context, req *Request) error {
+	p := s.p
+
+	// Create server using the connector (validation happens inside)
+	server, err := p.createServers(ctx, req.Payload, req.LabID)
+	if err != nil {
+		req.Log.Error("failed to provision server", "error", err)
+		p.reportFailure(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: req.WebUserID, Tenant: req.State.Tenant,
+			LabID: req.LabID, Message: err.Error()})
+		p.archiveFailure(ctx, req.State)
+		// Delete cache on error
+		p.redisClient.DeleteServerState(ctx, req.CacheKey)
+		return ErrStop
+	}
+
+	req.Server = server
+	req.Log = req.Log.With("server_id", server.GetID(), "server_name", server.GetName(), "server_type", server.GetServerType())
+	req.Log.Info("server provisioned successfully")
+	p.inventory.Register(server)
+
+	// Get initial server state from cloud provider
+	cloudState, err := server.GetState(ctx)
+	if err != nil {
+		req.Log.Warn("failed to get server state", "error", err)
+		cloudState = "unknown"
+	}
+
+	// Update cache with server details
+	status, available := p.readiness(ctx, server, req.LabID, cloudState)
+	state := req.State
+	if isWindows(server) {
+		state.User = windowsAdminUser
+	}
+	state.Address = server.GetIPv6Address()
+	state.Status = status
+	state.Available = available
+	state.CloudStatus = cloudState
+	state.ServerID = server.GetID()
+	state.ServerType = server.GetServerType()
+	state.SSHHostKey = server.GetSSHHostKey()
+	state.Hostname = p.registerDNS(ctx, req.WebUserID, req.LabID, server.GetIPv6Address())
+	state.Password = adminPassword(server)
+	state.Nodes = nodeStates(server)
+
+	// A lab with a warm-up step isn't available until the step has run; an empty last
+	// state makes the first poll see "running" as a change and run it
+	if state.Available && p.needsWarmUp(req.LabID) {
+		state.Status = config.StatusProvisioning
+		state.Available = false
+		cloudState = ""
+	}
+	if state.Available {
+		state.AvailableAt = p.clock.Now().UTC()
+	}
+
+	req.State = state
+	req.CloudState = cloudState
+	return nil
+}
+
+// trackStateStep caches the state of the created servers and polls it until they are available
+type trackStateStep struct{ p *Provisioner }
+
+func (s trackStateStep) TrackState(ctx context.Context, req *Request) {
+	p := s.p
+	server, cacheKey := req.Server, req.CacheKey
+
+	// From here on the server exists, so a draining shutdown must hand it off
+	p.track(cacheKey, req.State, req.CloudState)
+	defer p.untrackUnlessCancelled(ctx, cacheKey)
+
+	if err := p.writeServerState(ctx, cacheKey, &req.State); err != nil {
+		if errors.Is(err, lifecycle.ErrSuperseded) {
+			// The entry was taken over while the server was being created, so nobody else
+			// knows this server's ID - delete it here instead of leaking it
+			req.Log.Warn("cache entry superseded during creation, deleting new server")
+			p.untrack(cacheKey)
+			if delErr := server.Delete(ctx); delErr != nil {
+				req.Log.Error("failed to delete superseded server", "error", delErr)
+			} else {
+				p.inventory.Deregister(server)
+				p.clearPendingCreates(ctx, server)
+			}
+			p.unregisterDNS(ctx, req.State.Hostname)
+			return
+		}
+		if errors.Is(err, errs.ErrTransient) {
+			// An empty last state makes the first poll see a change and write the state again
+			req.Log.Warn("failed to cache server state, retrying on next poll", "error", err)
+			req.CloudState = ""
+		} else {
+			req.Log.Error("failed to cache server state", "error", err)
+		}
+	} else {
+		req.Log.Info("server state cached", "status", req.State.Status, "address", req.State.Address)
+		p.clearPendingCreates(ctx, server)
+		p.track(cacheKey, req.State, req.CloudState)
+		if req.State.Available {
+			p.runAvailableHooks(ctx, req.State)
+		}
+	}
+
+	req.Log.Info("provisioned server details", "server", server.String())
+
+	// Poll for state changes
+	p.pollServerState(ctx, server, cacheKey, req.State, req.CloudState)
+}
@@ -0,0 +1,66 @@
+package provisioner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// blockedLabs wraps an admitter, stopping requests for some labs first
+type blockedLabs struct {
+	next    Admitter
+	blocked map[int]bool
+}
+
+func (b blockedLabs) Admit(ctx context.Context, req *Request) error {
+	if b.blocked[req.LabID] {
+		req.Log.Warn("lab is blocked")
+		return ErrStop
+	}
+	return b.next.Admit(ctx, req)
+}
+
+// recordingTracker keeps the requests that reached it instead of polling their servers
+type recordingTracker struct {
+	requests []*Request
+}
+
+func (r *recordingTracker) TrackState(ctx context.Context, req *Request) {
+	r.requests = append(r.requests, req)
+}
+
+func TestWithSteps(t *testing.T) {
+	ctx := context.Background()
+	mockRedis := &mockRedisClient{}
+	created := 0
+	mockConn := &mockConnector{createServerFunc: func(payload string) (connector.Server, error) {
+		created++
+		return &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"running"}}, nil
+	}}
+	tracker := &recordingTracker{}
+
+	p := New(newTestLogger(), mockConn, mockRedis)
+	p.WithSteps(Steps{
+		Admit:      blockedLabs{next: p.DefaultSteps().Admit, blocked: map[int]bool{13: true}},
+		TrackState: tracker,
+	})
+
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":13}`)
+	if created != 0 || len(mockRedis.states) != 0 || len(tracker.requests) != 0 {
+		t.Fatalf("expected a blocked lab to stop before anything is written, got %d servers and states %v", created, mockRedis.states)
+	}
+
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":42,"correlationId":"req-1"}`)
+	if created != 1 || len(tracker.requests) != 1 {
+		t.Fatalf("expected the default steps to create the server and hand it to the tracker, got %d servers and %d requests", created, len(tracker.requests))
+	}
+	req := tracker.requests[0]
+	if req.CacheKey != redis.ServerCacheKey("user-123") || req.CorrelationID != "req-1" || req.Server.GetID() != "server-123" {
+		t.Errorf("expected the request to carry its cache key, correlation ID and server, got %+v", req)
+	}
+	if req.State.ServerID != "server-123" || req.State.Address != "2001:db8::1" || !req.State.Available || req.CloudState != "running" {
+		t.Errorf("expected the state of the created server, got %+v (cloud state %q)", req.State, req.CloudState)
+	}
+}
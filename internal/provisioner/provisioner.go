@@ -2,21 +2,45 @@ package provisioner
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
-	"strconv"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/archive"
+	"github.com/alex-sviridov/swim/internal/clock"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/dns"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/hooks"
+	"github.com/alex-sviridov/swim/internal/inventory"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/readiness"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/retry"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/warmup"
 )
 
 const (
 	defaultPollInterval = 15 * time.Second
 	stateTimeout        = 300 * time.Second
+	quotaPageSize       = 500
+
+	// Windows servers accept connections once Remote Desktop answers, well after they run
+	rdpPort          = "3389"
+	rdpProbeTimeout  = 5 * time.Second
+	windowsAdminUser = "Administrator"
 )
 
 // Provisioner handles server provisioning workflows
@@ -25,16 +49,66 @@ type Provisioner struct {
 	conn         connector.Connector
 	redisClient  redis.ClientInterface
 	pollInterval time.Duration
+	clock        clock.Clock // dates new servers and ages requests
+	dns          *dns.Registrar
+	hooks        *hooks.Runner
+	inventory    *inventory.Hook
+	warmup       *warmup.Runner
+	events       redis.EventRecorder
+	history      redis.HistoryRecorder
+	notifier     *notify.Notifier
+	tenants      *tenant.Registry
+	overrides    *override.Verifier
+	sequencer    redis.Sequencer
+	flags        *flags.Reader
+	archive      archive.Archiver
+	provider     string        // named in session records
+	maxAge       time.Duration // requests enqueued longer ago are dropped, 0 for no limit
+	redisRetry   retry.Policy  // retries of the admission
+	createRetry  retry.Policy  // retries of creations throttled by the provider
+	stateRetry   retry.Policy  // retries of failed state lookups while polling
+
+	// createLimiter, when set, spreads the creations of all instances to createRate per second
+	createLimiter redis.CreateLimiter
+	createRate    float64
+	createBurst   int
+
+	// labNodes, when set, names the nodes of composite labs
+	labNodes func(labID int) ([]string, error)
+
+	// probeRDP reports whether Remote Desktop accepts connections at address
+	probeRDP func(ctx context.Context, address string) bool
+
+	// checks, when set, holds the readiness checks of labs that aren't ready when they run
+	checks *readiness.Checks
+
+	// journal, when set, is the pending-create journal whose entries are cleared once the server is cached
+	journal connector.CreateJournal
+
+	// steps are the stages of ProcessRequest, see Steps
+	steps Steps
+
+	// inFlight tracks created servers that are still being polled, keyed by cache key
+	mu       sync.Mutex
+	inFlight map[string]redis.HandoffEntry
 }
 
 // New creates a new Provisioner
 func New(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface) *Provisioner {
-	return &Provisioner{
+	p := &Provisioner{
 		log:          log,
 		conn:         conn,
 		redisClient:  redisClient,
 		pollInterval: defaultPollInterval,
+		clock:        clock.Real,
+		redisRetry:   retry.Get(retry.RedisCall),
+		createRetry:  retry.Get(retry.ProvisionCreate),
+		stateRetry:   retry.Get(retry.PollState),
+		inFlight:     make(map[string]redis.HandoffEntry),
+		probeRDP:     dialRDP,
 	}
+	p.steps = p.DefaultSteps()
+	return p
 }
 
 // WithPollInterval sets a custom poll interval (useful for testing)
@@ -43,160 +117,154 @@ func (p *Provisioner) WithPollInterval(interval time.Duration) *Provisioner {
 	return p
 }
 
-// ProcessRequest handles a single provision request from the queue
-func (p *Provisioner) ProcessRequest(ctx context.Context, payload string) {
-	// Extract WebUserID and LabID from the minimal request
-	var req struct {
-		WebUserID string `json:"webuserid"`
-		LabID     int    `json:"labId"`
-	}
-	if err := json.Unmarshal([]byte(payload), &req); err != nil {
-		p.log.Error("failed to parse payload", "error", err)
-		return
-	}
+// WithClock dates new servers and ages requests with c instead of the system clock
+func (p *Provisioner) WithClock(c clock.Clock) *Provisioner {
+	p.clock = c
+	return p
+}
 
-	serverLog := p.log.With("webuserid", req.WebUserID, "labid", req.LabID)
+// WithDNS registers a stable hostname for every provisioned server
+func (p *Provisioner) WithDNS(registrar *dns.Registrar) *Provisioner {
+	p.dns = registrar
+	return p
+}
 
-	// Check rate limit with retry logic
-	rateLimitTTL := config.GetProvisionRateLimitDuration()
-	allowed, err := p.tryAcquireRateLimitWithRetry(ctx, req.WebUserID, "provision", rateLimitTTL)
-	if err != nil {
-		serverLog.Error("failed to check rate limit after retries, dropping message", "error", err)
-		return
-	}
-	if !allowed {
-		serverLog.Warn("provision rate limit hit, dropping message")
-		return
-	}
+// WithHooks runs the "available" hooks once a provisioned server becomes reachable
+func (p *Provisioner) WithHooks(runner *hooks.Runner) *Provisioner {
+	p.hooks = runner
+	return p
+}
 
-	// Build cache key (note: labId is stored in the state, not the key)
-	cacheKey := redis.ServerCacheKey(req.WebUserID)
+// WithInventory registers every created server in the external inventory, and deregisters
+// the servers the provisioner deletes itself, e.g. after a failed provision
+func (p *Provisioner) WithInventory(hook *inventory.Hook) *Provisioner {
+	p.inventory = hook
+	return p
+}
 
-	// Check if server already exists in cache with retry logic
-	existingState, err := p.getServerStateWithRetry(ctx, cacheKey)
-	if err != nil {
-		serverLog.Error("failed to check existing server state after retries, aborting provision", "error", err)
-		return
-	}
+// WithWarmUp runs the lab's warm-up command on the server before it is marked available
+func (p *Provisioner) WithWarmUp(runner *warmup.Runner) *Provisioner {
+	p.warmup = runner
+	return p
+}
 
-	if existingState != nil {
-		// Server exists in cache
-		if existingState.LabID == req.LabID {
-			// Same labId - this is a duplicate request, do nothing
-			serverLog.Info("server already exists with same labId, ignoring duplicate request",
-				"server_id", existingState.ServerID,
-				"status", existingState.Status,
-				"address", existingState.Address)
-			return
-		}
+// WithEvents records provisioning failures and rate-limited requests for the status dashboard
+func (p *Provisioner) WithEvents(recorder redis.EventRecorder) *Provisioner {
+	p.events = recorder
+	return p
+}
 
-		// Different labId - need to decommission old server and provision new one
-		serverLog.Info("server exists with different labId, triggering decommission and starting new provision",
-			"old_labid", existingState.LabID,
-			"new_labid", req.LabID,
-			"old_server_id", existingState.ServerID)
-
-		// Push decommission request to queue (non-blocking)
-		// Include serverID so decommissioner can delete even if cache entry is replaced
-		decommissionPayload := fmt.Sprintf(`{"webuserid":"%s","labId":%d,"serverId":"%s"}`,
-			req.WebUserID, existingState.LabID, existingState.ServerID)
-		if err := p.redisClient.PushPayload(ctx, config.DecommissionQueueKey, decommissionPayload); err != nil {
-			serverLog.Error("failed to queue decommission request", "error", err)
-			// Continue with provisioning anyway - decommission can be handled later
-		} else {
-			serverLog.Info("decommission request queued for old server", "old_server_id", existingState.ServerID)
-		}
-		// Continue with provisioning new server below
-	}
+// WithHistory keeps the lifecycle of each user's provisions, including failed and dropped ones
+func (p *Provisioner) WithHistory(recorder redis.HistoryRecorder) *Provisioner {
+	p.history = recorder
+	return p
+}
 
-	// Get SSH username from environment (default: "student")
-	sshUsername := "student"
-	if envUser := os.Getenv("SSH_USERNAME"); envUser != "" {
-		sshUsername = envUser
-	}
+// WithNotifier alerts operators about failed provisions and orphaned servers
+func (p *Provisioner) WithNotifier(notifier *notify.Notifier) *Provisioner {
+	p.notifier = notifier
+	return p
+}
 
-	// Get TTL from environment (default: 30 minutes)
-	ttlMinutes := 30
-	if envTTL := os.Getenv("DEFAULT_TTL_MINUTES"); envTTL != "" {
-		if ttl, err := strconv.Atoi(envTTL); err == nil {
-			ttlMinutes = ttl
-		}
-	}
-	expiresAt := time.Now().Add(time.Duration(ttlMinutes) * time.Minute)
+// WithTenants resolves the tenant of each request for its lab catalog, quota and rate limit.
+// Without a registry only requests for the default tenant are accepted.
+func (p *Provisioner) WithTenants(registry *tenant.Registry) *Provisioner {
+	p.tenants = registry
+	return p
+}
 
-	// Set initial provisioning state in cache
-	initialState := redis.ServerState{
-		User:        sshUsername,
-		Address:     "", // Will be set after provisioning
-		Status:      config.StatusProvisioning,
-		Available:   false, // Not available until running
-		CloudStatus: "",    // Will be set after provisioning
-		ServerID:    "",    // Will be set after provisioning
-		ExpiresAt:   expiresAt,
-		WebUserID:   req.WebUserID,
-		LabID:       req.LabID,
-	}
+// WithOverrides lets requests whose admin override verifier grants skip the tenant quota and
+// the provision rate limit. Without a verifier admin overrides are refused.
+func (p *Provisioner) WithOverrides(verifier *override.Verifier) *Provisioner {
+	p.overrides = verifier
+	return p
+}
 
-	if err := p.redisClient.PushServerState(ctx, cacheKey, initialState, config.ServerCacheTTL); err != nil {
-		serverLog.Error("failed to cache initial provisioning state", "error", err)
-		// Continue anyway - caching failure shouldn't stop provisioning
-	} else {
-		serverLog.Info("initial provisioning state cached")
-	}
+// WithSequencer drops requests whose sequence number a later provision or decommission of
+// the same user has overtaken, so the order in which the queues are read can't decide which
+// one wins. Requests without a sequence number are always served.
+func (p *Provisioner) WithSequencer(sequencer redis.Sequencer) *Provisioner {
+	p.sequencer = sequencer
+	return p
+}
 
-	// Create server using the connector (validation happens inside)
-	server, err := p.conn.CreateServer(payload)
-	if err != nil {
-		serverLog.Error("failed to provision server", "error", err)
-		// Delete cache on error
-		p.redisClient.DeleteServerState(ctx, cacheKey)
-		return
-	}
+// WithCreateJournal clears the pending-create journal entry of a new server once its ID is
+// cached. Until then the entry stays, so a server created by an instance that died in between
+// is found and adopted or deleted on the next startup.
+func (p *Provisioner) WithCreateJournal(journal connector.CreateJournal) *Provisioner {
+	p.journal = journal
+	return p
+}
 
-	serverLog = serverLog.With("server_id", server.GetID(), "server_name", server.GetName())
-	serverLog.Info("server provisioned successfully")
+// WithFlags reads runtime feature flags from reader, e.g. to switch the readiness probe off
+func (p *Provisioner) WithFlags(reader *flags.Reader) *Provisioner {
+	p.flags = reader
+	return p
+}
 
-	// Get initial server state from cloud provider
-	cloudState, err := server.GetState()
-	if err != nil {
-		serverLog.Warn("failed to get server state", "error", err)
-		cloudState = "unknown"
-	}
+// WithMaxRequestAge drops requests enqueued longer than maxAge ago, e.g. while SWIM was down,
+// since their student has given up by now. Dropped requests go to the dead-letter queue.
+// Requests without an enqueuedAt are never dropped.
+func (p *Provisioner) WithMaxRequestAge(maxAge time.Duration) *Provisioner {
+	p.maxAge = maxAge
+	return p
+}
 
-	// Update cache with server details
-	serverState := redis.ServerState{
-		User:        sshUsername,
-		Address:     server.GetIPv6Address(),
-		Status:      mapCloudStateToStatus(cloudState),
-		Available:   isServerAvailable(cloudState),
-		CloudStatus: cloudState,
-		ServerID:    server.GetID(),
-		ExpiresAt:   expiresAt,
-		WebUserID:   req.WebUserID,
-		LabID:       req.LabID,
-	}
+// WithCreateLimit makes every server creation take a token from the bucket limiter shares
+// with the other instances, refilled at rate per second up to burst, so a classroom starting
+// at once is spread out instead of tripping the provider's abuse detection
+func (p *Provisioner) WithCreateLimit(limiter redis.CreateLimiter, rate float64, burst int) *Provisioner {
+	p.createLimiter = limiter
+	p.createRate = rate
+	p.createBurst = burst
+	return p
+}
 
-	if err := p.redisClient.PushServerState(ctx, cacheKey, serverState, config.ServerCacheTTL); err != nil {
-		serverLog.Error("failed to cache server state", "error", err)
-	} else {
-		serverLog.Info("server state cached", "status", serverState.Status, "address", serverState.Address)
-	}
+// WithArchive keeps a session record of every failed provision, so failure rates can be
+// computed next to the sessions archived by the decommissioner. provider names the server's
+// cloud provider.
+func (p *Provisioner) WithArchive(archiver archive.Archiver, provider string) *Provisioner {
+	p.archive = archiver
+	p.provider = provider
+	return p
+}
 
-	serverLog.Info("provisioned server details", "server", server.String())
+// WithLabNodes provisions labs that nodes names several nodes for, e.g. an attacker and a
+// target, as composite labs: every node is created in parallel and the lab is cached as one
+// entry whose fields describe the first node, with the others in its node map
+func (p *Provisioner) WithLabNodes(nodes func(labID int) ([]string, error)) *Provisioner {
+	p.labNodes = nodes
+	return p
+}
 
-	// Poll for state changes
-	p.pollServerState(ctx, server, cacheKey, serverState, cloudState)
+// WithReadiness makes a running server of a lab with a readiness check available only once
+// the check passes, e.g. once the lab's web IDE answers, polling it for up to the check's
+// timeout. Labs without a check are available as soon as they run.
+func (p *Provisioner) WithReadiness(checks *readiness.Checks) *Provisioner {
+	p.checks = checks
+	return p
 }
 
-// pollServerState polls for server state changes until running or timeout
+// pollServerState polls for server state changes until running, failed or timeout. A state
+// that couldn't be written because Redis was unavailable, e.g. during a Sentinel failover, is
+// kept and written again on the next poll; the server itself is fine, so it isn't deleted.
+// A new server in a status the provider reports it doesn't recover from fails the provision;
+// a rebuilt or resized one holds the student's work, so it is powered on again instead.
 func (p *Provisioner) pollServerState(ctx context.Context, server connector.Server, cacheKey string, serverState redis.ServerState, initialState string) {
-	serverLog := p.log.With("server_id", server.GetID())
+	serverLog := p.logger(ctx).With("server_id", server.GetID())
 
 	ticker := time.NewTicker(p.pollInterval)
 	defer ticker.Stop()
 
 	timeout := time.After(stateTimeout)
+	if checkTimeout := p.checks.Timeout(serverState.LabID); checkTimeout > 0 {
+		timeout = time.After(checkTimeout)
+	} else if isWindows(server) {
+		timeout = time.After(config.GetWindowsStateTimeout())
+	}
 	lastState := initialState
+	unwritten := false // serverState has changes the cache doesn't have yet
+	restarted := false // a rebuilt or resized server was powered on again
 
 	for {
 		select {
@@ -205,34 +273,90 @@ func (p *Provisioner) pollServerState(ctx context.Context, server connector.Serv
 			return
 
 		case <-timeout:
+			if unwritten {
+				// The cache entry keeps the last state written and expires as usual
+				serverLog.Error("state polling timeout reached before the server state could be cached", "final_state", lastState)
+				return
+			}
 			serverLog.Info("state polling timeout reached", "final_state", lastState)
 			return
 
 		case <-ticker.C:
-			currentState, err := server.GetState()
+			currentState, err := p.getStateWithRetry(ctx, server)
 			if err != nil {
+				if ctx.Err() != nil {
+					serverLog.Info("context cancelled, stopping state polling")
+					return
+				}
 				p.handleProvisioningError(ctx, server, cacheKey, serverState, "failed to get server state during polling", err)
 				return
 			}
 
-			// Update cache if state changed
-			if currentState != lastState {
+			if connector.ProvisionFailed(p.conn, currentState) && serverState.Operation != "" {
+				if !restarted {
+					p.restart(ctx, server, serverState, currentState)
+					restarted = true
+				}
+				continue
+			}
+			if connector.ProvisionFailed(p.conn, currentState) {
+				if p.failProvision(ctx, server, cacheKey, serverState, currentState) {
+					return
+				}
+				continue
+			}
+
+			status, available := p.readiness(ctx, server, serverState.LabID, currentState)
+
+			// Update cache if state changed, or a running server passed its readiness check
+			if currentState != lastState || available != serverState.Available {
 				serverLog.Info("server state changed", "old_state", lastState, "new_state", currentState)
 
-				serverState.Status = mapCloudStateToStatus(currentState)
-				serverState.Available = isServerAvailable(currentState)
+				serverState.Status = status
+				serverState.Available = available
 				serverState.CloudStatus = currentState
-				if err := p.redisClient.PushServerState(ctx, cacheKey, serverState, config.ServerCacheTTL); err != nil {
+				if serverState.Available && p.needsWarmUp(serverState.LabID) {
+					if err := p.runWarmUp(ctx, serverState); err != nil {
+						if ctx.Err() != nil {
+							// Shutdown interrupted the warm-up; the provision stays in flight for handoff
+							serverLog.Info("context cancelled during warm-up, stopping state polling")
+							return
+						}
+						p.handleProvisioningError(ctx, server, cacheKey, serverState, "lab warm-up failed", err)
+						return
+					}
+				}
+				if serverState.Available && serverState.AvailableAt.IsZero() {
+					serverState.AvailableAt = p.clock.Now().UTC()
+				}
+				lastState = currentState
+				unwritten = true
+			}
+
+			if unwritten {
+				if err := p.writeServerState(ctx, cacheKey, &serverState); err != nil {
+					if errors.Is(err, lifecycle.ErrSuperseded) {
+						// Decommissioner or a newer provision owns the entry now
+						serverLog.Info("cache entry superseded, stopping state polling")
+						return
+					}
+					if errors.Is(err, errs.ErrTransient) {
+						serverLog.Warn("failed to update server state in cache, retrying on next poll", "error", err)
+						continue
+					}
 					p.handleProvisioningError(ctx, server, cacheKey, serverState, "failed to update server state in cache", err)
 					return
 				}
+				unwritten = false
 				serverLog.Info("server state updated in cache", "status", serverState.Status, "available", serverState.Available, "cloud_status", serverState.CloudStatus)
-
-				lastState = currentState
+				p.track(cacheKey, serverState, currentState)
+				if serverState.Available {
+					p.runAvailableHooks(ctx, serverState)
+				}
 			}
 
-			// Exit if server is running
-			if currentState == "running" {
+			// Exit once the server accepts connections
+			if available {
 				serverLog.Info("server is running, stopping state polling")
 				return
 			}
@@ -240,37 +364,218 @@ func (p *Provisioner) pollServerState(ctx context.Context, server connector.Serv
 	}
 }
 
-// mapCloudStateToStatus maps cloud provider state to VMManager status
-func mapCloudStateToStatus(cloudState string) string {
-	switch cloudState {
-	case "running":
-		return config.StatusRunning
-	case "starting", "initializing":
-		return config.StatusProvisioning
-	case "stopping", "off", "deleting":
-		return config.StatusStopping
-	default:
-		return config.StatusProvisioning
+// logger returns the provisioner logger tagged with the request's correlation ID
+func (p *Provisioner) logger(ctx context.Context) *slog.Logger {
+	return tracing.Logger(ctx, p.log)
+}
+
+// Resume adopts a provision handed off by a draining instance and continues polling it
+func (p *Provisioner) Resume(ctx context.Context, entry redis.HandoffEntry) {
+	ctx = tracing.WithCorrelationID(ctx, entry.State.CorrelationID)
+	serverLog := p.logger(ctx).With("server_id", entry.ServerID,
+		"webuserid", entry.State.WebUserID,
+		"labid", entry.State.LabID,
+		"from_instance", entry.InstanceID)
+
+	server, err := p.conn.GetServerByID(ctx, entry.ServerID)
+	if err != nil {
+		serverLog.Warn("handed-off server not found, skipping", "error", err)
+		return
+	}
+
+	serverLog.Info("resuming handed-off provision", "cloud_status", entry.CloudStatus)
+
+	p.track(entry.CacheKey, entry.State, entry.CloudStatus)
+	defer p.untrackUnlessCancelled(ctx, entry.CacheKey)
+
+	// An empty last state forces a cache write on the first poll,
+	// in case the previous owner's last write never landed
+	p.pollServerState(ctx, server, entry.CacheKey, entry.State, "")
+}
+
+// ReconcilePendingCreate resolves a creation left in the pending-create journal by an instance
+// that died or failed before the server was known. A server whose provision is still waiting
+// in the cache is returned for adoption with Resume; a server nobody knows about is deleted.
+// The journal entry may be cleared when err is nil.
+func (p *Provisioner) ReconcilePendingCreate(ctx context.Context, pending redis.PendingCreate) (*redis.HandoffEntry, error) {
+	ctx = tracing.WithCorrelationID(ctx, pending.CorrelationID)
+	serverLog := p.logger(ctx).With("server_name", pending.Name,
+		"webuserid", pending.WebUserID,
+		"labid", pending.LabID,
+		"from_instance", pending.InstanceID)
+
+	// List managed servers instead of looking up by name, so an API error isn't taken for "not found"
+	servers, err := p.conn.GetServersByLabel(ctx, connector.LabelType, connector.LabelTypeLabHost)
+	if err != nil {
+		return nil, fmt.Errorf("list managed servers: %w", err)
+	}
+
+	var server connector.Server
+	for _, s := range servers {
+		if s.GetName() == pending.Name {
+			server = s
+			break
+		}
+	}
+	if server == nil {
+		serverLog.Info("pending create never reached the provider, clearing")
+		return nil, nil
+	}
+	serverLog = serverLog.With("server_id", server.GetID())
+
+	cacheKey := redis.ServerCacheKey(redis.TenantUserID(pending.Tenant, pending.WebUserID))
+	state, err := p.redisClient.GetServerState(ctx, cacheKey)
+	if err == nil && (state.ServerID == server.GetID() || hasNode(state, server.GetID())) {
+		serverLog.Info("pending create already cached, clearing")
+		return nil, nil
+	}
+
+	// The provision was interrupted while creating: its cache entry still waits for a server.
+	// A node of a composite lab is deleted instead, the lab can't do without its other nodes.
+	if err == nil && state.ServerID == "" && state.LabID == pending.LabID && state.Status == config.StatusProvisioning &&
+		server.GetLabels()[connector.LabelNode] == "" {
+		serverLog.Info("adopting server left behind by interrupted creation")
+		state.ServerID = server.GetID()
+		state.ServerType = server.GetServerType()
+		state.Address = server.GetIPv6Address()
+		return &redis.HandoffEntry{
+			CacheKey:   cacheKey,
+			ServerID:   server.GetID(),
+			State:      *state,
+			InstanceID: pending.InstanceID,
+		}, nil
+	}
+
+	orphan := notify.Notification{
+		Event: notify.EventOrphanFound,
+		Title: "Orphaned server found",
+		Message: fmt.Sprintf("server %s (%s) of user %s, lab %d was left behind by a failed creation on %s",
+			server.GetID(), pending.Name, pending.WebUserID, pending.LabID, pending.InstanceID),
+	}
+	if connector.Protected(server) {
+		serverLog.Warn("server left behind by failed creation is labelled protected, keeping it")
+		orphan.Message += fmt.Sprintf(" and was kept, it is labelled %s=true", connector.LabelProtected)
+		p.notify(ctx, orphan)
+		return nil, nil
+	}
+
+	serverLog.Warn("deleting server left behind by failed creation")
+	if err := server.Delete(ctx); err != nil {
+		orphan.Message += fmt.Sprintf(" and could not be deleted: %v", err)
+		p.notify(ctx, orphan)
+		return nil, fmt.Errorf("delete server %s: %w", server.GetID(), err)
+	}
+	p.inventory.Deregister(server)
+	orphan.Message += " and was deleted"
+	p.notify(ctx, orphan)
+	return nil, nil
+}
+
+// InFlight returns the provisions whose server exists but hasn't finished polling
+func (p *Provisioner) InFlight() []redis.HandoffEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := make([]redis.HandoffEntry, 0, len(p.inFlight))
+	for _, entry := range p.inFlight {
+		entries = append(entries, entry)
 	}
+	return entries
 }
 
-// isServerAvailable determines if server is ready for SSH connections
-// This logic can vary by cloud provider - for Hetzner, only "running" means available
-func isServerAvailable(cloudState string) bool {
-	return cloudState == "running"
+// track records the latest known state of an in-flight provision
+func (p *Provisioner) track(cacheKey string, serverState redis.ServerState, cloudState string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight[cacheKey] = redis.HandoffEntry{
+		CacheKey:    cacheKey,
+		ServerID:    serverState.ServerID,
+		CloudStatus: cloudState,
+		State:       serverState,
+	}
+}
+
+// untrack forgets an in-flight provision
+func (p *Provisioner) untrack(cacheKey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inFlight, cacheKey)
+}
+
+// untrackUnlessCancelled forgets an in-flight provision unless ctx was cancelled,
+// in which case the provision was interrupted by shutdown and stays available for handoff
+func (p *Provisioner) untrackUnlessCancelled(ctx context.Context, cacheKey string) {
+	if ctx.Err() == nil {
+		p.untrack(cacheKey)
+	}
+}
+
+// writeServerState writes serverState to the cache and bumps its version.
+// If another writer changed the entry in between, the provisioning fields are re-applied
+// on top of the fresh entry. Returns lifecycle.ErrSuperseded if the entry now belongs to a
+// different lab or server, or is being decommissioned.
+func (p *Provisioner) writeServerState(ctx context.Context, cacheKey string, serverState *redis.ServerState) error {
+	err := p.redisClient.PushServerState(ctx, cacheKey, *serverState, config.ServerCacheTTL)
+	if err == nil {
+		serverState.Version++
+		return nil
+	}
+	if !errors.Is(err, redis.ErrVersionConflict) {
+		return err
+	}
+
+	// A decommission moves the entry past any provisioning status, so an illegal transition
+	// means the entry was taken over as well
+	updated, err := lifecycle.Transition(ctx, p.redisClient, cacheKey, serverState.Status, func(fresh *redis.ServerState) error {
+		if fresh.LabID != serverState.LabID || !lifecycle.CanTransition(fresh.Status, serverState.Status) ||
+			(fresh.ServerID != "" && fresh.ServerID != serverState.ServerID) {
+			return lifecycle.ErrSuperseded
+		}
+		fresh.Address = serverState.Address
+		fresh.Available = serverState.Available
+		fresh.AvailableAt = serverState.AvailableAt
+		fresh.CloudStatus = serverState.CloudStatus
+		fresh.ServerID = serverState.ServerID
+		fresh.User = serverState.User
+		fresh.Password = serverState.Password
+		fresh.Nodes = serverState.Nodes
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	*serverState = *updated
+	return nil
+}
+
+// deadLetter moves a dropped request to the provision dead-letter queue for inspection
+func (p *Provisioner) deadLetter(ctx context.Context, payload string) {
+	deadLetterKey := config.DeadLetterQueueKey(config.ProvisionQueueKey)
+	if err := p.redisClient.PushPayload(ctx, deadLetterKey, payload); err != nil {
+		p.logger(ctx).Error("failed to move request to dead-letter queue", "queue", deadLetterKey, "error", err)
+	}
 }
 
 // handleProvisioningError deletes the server and removes from cache
 func (p *Provisioner) handleProvisioningError(ctx context.Context, server connector.Server, cacheKey string, serverState redis.ServerState, errorMsg string, err error) {
-	serverLog := p.log.With("server_id", server.GetID())
+	serverLog := p.logger(ctx).With("server_id", server.GetID())
 	serverLog.Error(errorMsg, "error", err)
+	p.reportFailure(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: serverState.WebUserID, Tenant: serverState.Tenant,
+		LabID: serverState.LabID, ServerID: server.GetID(), Message: fmt.Sprintf("%s: %v", errorMsg, err)})
 
 	// Delete the server
-	if delErr := server.Delete(); delErr != nil {
+	if delErr := server.Delete(ctx); delErr != nil {
 		serverLog.Error("failed to delete server after error", "error", delErr)
 	} else {
 		serverLog.Info("server deleted due to error")
+		p.inventory.Deregister(server)
 	}
+	p.unregisterDNS(ctx, serverState.Hostname)
+	serverState.ServerID = server.GetID()
+	p.archiveFailure(ctx, serverState)
 
 	// Remove from cache
 	if cacheErr := p.redisClient.DeleteServerState(ctx, cacheKey); cacheErr != nil {
@@ -280,70 +585,519 @@ func (p *Provisioner) handleProvisioningError(ctx context.Context, server connec
 	}
 }
 
-// getServerStateWithRetry attempts to get server state from cache with retry logic
-// Returns (nil, nil) if server not found in cache
-// Returns (nil, error) if all retries exhausted with errors
-// Returns (state, nil) if server found successfully
-func (p *Provisioner) getServerStateWithRetry(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
-	var lastErr error
+// failProvision ends a provision whose server went into a status it doesn't recover from,
+// e.g. switched off: the entry is marked failed with the reason for LabMan and the server is
+// deleted. The cleanup worker removes the entry on its next run. Returns false if the entry
+// couldn't be marked, so the next poll tries again.
+func (p *Provisioner) failProvision(ctx context.Context, server connector.Server, cacheKey string, serverState redis.ServerState, cloudState string) bool {
+	serverID := server.GetID()
+	serverLog := p.logger(ctx).With("server_id", serverID)
+	reason := fmt.Sprintf("server went %q during provisioning", cloudState)
 
-	for attempt := 1; attempt <= config.CacheReadRetryAttempts; attempt++ {
-		state, err := p.redisClient.GetServerState(ctx, cacheKey)
-		if err == nil {
-			// Success - server found
-			return state, nil
+	// A decommission stops and deletes the server too, but moves the entry past provisioning first
+	_, err := lifecycle.Transition(ctx, p.redisClient, cacheKey, config.StatusFailed, func(fresh *redis.ServerState) error {
+		if fresh.Status != config.StatusProvisioning || fresh.LabID != serverState.LabID ||
+			(fresh.ServerID != "" && fresh.ServerID != serverID) {
+			return lifecycle.ErrSuperseded
 		}
+		fresh.Available = false
+		fresh.CloudStatus = cloudState
+		fresh.FailureReason = reason
+		fresh.ExpiresAt = p.clock.Now()
+		return nil
+	})
+	switch {
+	case errors.Is(err, lifecycle.ErrSuperseded) || errors.Is(err, errs.ErrNotFound):
+		serverLog.Info("cache entry superseded, stopping state polling", "cloud_status", cloudState)
+		return true
+	case err != nil:
+		serverLog.Warn("failed to mark provision as failed, retrying on next poll", "cloud_status", cloudState, "error", err)
+		return false
+	}
+
+	serverLog.Error("provisioning failed", "reason", reason)
+	p.reportFailure(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: serverState.WebUserID, Tenant: serverState.Tenant,
+		LabID: serverState.LabID, ServerID: serverID, Message: reason})
+	serverState.ServerID = serverID
+	p.archiveFailure(ctx, serverState)
+	p.unregisterDNS(ctx, serverState.Hostname)
+
+	if err := server.Delete(ctx); err != nil {
+		// The entry keeps the server ID, so the cleanup worker deletes it with the entry
+		serverLog.Error("failed to delete server after failed provisioning", "error", err)
+		return true
+	}
+	serverLog.Info("server deleted after failed provisioning")
+	p.inventory.Deregister(server)
 
-		// Check if it's a "not found" error (which is not a failure, just means no server exists)
-		if err.Error() == "server state not found in cache" {
-			// Server doesn't exist in cache - this is a normal case, not an error
-			return nil, nil
+	// Without a server the cleanup worker only removes the entry
+	_, err = lifecycle.Transition(ctx, p.redisClient, cacheKey, config.StatusFailed, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != serverID {
+			return lifecycle.ErrSuperseded
 		}
+		fresh.ServerID = ""
+		fresh.Address = ""
+		fresh.Nodes = nil
+		return nil
+	})
+	if err != nil && !errors.Is(err, lifecycle.ErrSuperseded) {
+		serverLog.Warn("failed to remove deleted server from failed cache entry", "error", err)
+	}
+	return true
+}
+
+// restart powers a rebuilt or resized server on again that went into a status it doesn't
+// recover from by itself, e.g. off after a failed resize. Unlike a new server it is never
+// deleted: if it can't be started, the entry stays provisioning until polling times out and
+// the watchdog reports it.
+func (p *Provisioner) restart(ctx context.Context, server connector.Server, serverState redis.ServerState, cloudState string) {
+	serverLog := p.logger(ctx).With("server_id", server.GetID(), "operation", serverState.Operation)
+	reason := fmt.Sprintf("server went %q during %s", cloudState, serverState.Operation)
+
+	starter, ok := server.(connector.Starter)
+	if !ok {
+		serverLog.Error("server can't be powered on, leaving it for operators", "reason", reason)
+		p.reportFailure(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: serverState.WebUserID, Tenant: serverState.Tenant,
+			LabID: serverState.LabID, ServerID: server.GetID(), Message: reason})
+		return
+	}
+	serverLog.Warn("powering server on again", "reason", reason)
+	if err := starter.PowerOn(ctx); err != nil {
+		serverLog.Error("failed to power server on again, leaving it for operators", "reason", reason, "error", err)
+		p.reportFailure(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: serverState.WebUserID, Tenant: serverState.Tenant,
+			LabID: serverState.LabID, ServerID: server.GetID(), Message: reason + ": " + err.Error()})
+	}
+}
+
+// countTenantServers counts the cached servers of a tenant, leaving out webUserID's own
+// entry since a lab switch replaces it. Counting stops at limit.
+func (p *Provisioner) countTenantServers(ctx context.Context, tenantID, webUserID string, limit int) (int, error) {
+	count := 0
+	filter := redis.StateFilter{Tenant: tenantID, Limit: quotaPageSize}
+	for {
+		page, err := p.redisClient.QueryServerStates(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		for _, state := range page.States {
+			// An empty filter matches every tenant, so the default tenant is checked here
+			if state.Tenant != tenantID || state.WebUserID == webUserID {
+				continue
+			}
+			count++
+			if count >= limit {
+				return count, nil
+			}
+		}
+		if page.NextCursor == "" {
+			return count, nil
+		}
+		filter.Cursor = page.NextCursor
+	}
+}
+
+// reportFailure records a failed provision for the status dashboard and notifies operators
+func (p *Provisioner) reportFailure(ctx context.Context, event redis.Event) {
+	p.recordEvent(ctx, event)
+
+	message := fmt.Sprintf("user %s, lab %d", event.WebUserID, event.LabID)
+	if event.ServerID != "" {
+		message += ", server " + event.ServerID
+	}
+	p.notify(ctx, notify.Notification{
+		Event:   notify.EventProvisionFailed,
+		Title:   "Provisioning failed",
+		Message: message + ": " + event.Message,
+	})
+}
+
+// archiveFailure keeps the record of a session that ended because its provision failed. The
+// archive is for analytics, so a failure is only logged.
+func (p *Provisioner) archiveFailure(ctx context.Context, state redis.ServerState) {
+	if p.archive == nil {
+		return
+	}
+	// The server never became available, so there is no provisioning time
+	state.AvailableAt = time.Time{}
+	record := archive.Record(state, p.provider, redis.ExitProvisionFailed, p.clock.Now().UTC())
+	if err := p.archive.Archive(ctx, record); err != nil {
+		p.logger(ctx).Warn("failed to archive session", "webuserid", state.WebUserID, "error", err)
+	}
+}
 
-		// It's a real error (Redis connection issue, etc.)
-		lastErr = err
-		p.log.Warn("failed to read server state from cache, retrying",
+// notify alerts operators. Notifications are best-effort, so a failure is only logged.
+func (p *Provisioner) notify(ctx context.Context, notification notify.Notification) {
+	if p.notifier == nil {
+		return
+	}
+	if err := p.notifier.Notify(ctx, notification); err != nil {
+		p.logger(ctx).Warn("failed to send notification", "event", notification.Event, "error", err)
+	}
+}
+
+// recordEvent keeps an event for the status dashboard and the user's history. Events are
+// informational, so a failure is only logged.
+func (p *Provisioner) recordEvent(ctx context.Context, event redis.Event) {
+	p.recordHistory(ctx, event)
+	if p.events == nil {
+		return
+	}
+	event.Operation = "provision"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := p.events.RecordEvent(ctx, event); err != nil {
+		p.logger(ctx).Warn("failed to record event", "type", event.Type, "error", err)
+	}
+}
+
+// recordHistory keeps an event in the history of its user, if it names one.
+// History is informational, so a failure is only logged.
+func (p *Provisioner) recordHistory(ctx context.Context, event redis.Event) {
+	if p.history == nil || event.WebUserID == "" {
+		return
+	}
+	event.Operation = "provision"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := p.history.RecordHistory(ctx, redis.TenantUserID(event.Tenant, event.WebUserID), event); err != nil {
+		p.logger(ctx).Warn("failed to record history", "type", event.Type, "error", err)
+	}
+}
+
+// registerDNS points the lab server's hostname at its address and returns the hostname.
+// DNS is a convenience, so a failure is logged and the server is used by address only.
+func (p *Provisioner) registerDNS(ctx context.Context, webUserID string, labID int, ipv6 string) string {
+	if p.dns == nil {
+		return ""
+	}
+	hostname, err := p.dns.Register(ctx, webUserID, labID, ipv6)
+	if err != nil {
+		p.logger(ctx).Warn("failed to register dns record", "webuserid", webUserID, "labid", labID, "error", err)
+		return ""
+	}
+	p.logger(ctx).Info("dns record registered", "hostname", hostname, "address", ipv6)
+	return hostname
+}
+
+// unregisterDNS removes a hostname registered for a server that is gone
+func (p *Provisioner) unregisterDNS(ctx context.Context, hostname string) {
+	if p.dns == nil || hostname == "" {
+		return
+	}
+	if err := p.dns.Unregister(ctx, hostname); err != nil {
+		p.logger(ctx).Warn("failed to remove dns record", "hostname", hostname, "error", err)
+	}
+}
+
+// needsWarmUp reports whether labID has a warm-up step to run before the server is available
+func (p *Provisioner) needsWarmUp(labID int) bool {
+	return p.warmup != nil && p.warmup.Has(labID)
+}
+
+// runWarmUp runs the lab's warm-up step on a running server
+func (p *Provisioner) runWarmUp(ctx context.Context, serverState redis.ServerState) error {
+	serverLog := p.logger(ctx).With("server_id", serverState.ServerID, "labid", serverState.LabID)
+	serverLog.Info("running lab warm-up")
+
+	start := time.Now()
+	if err := p.warmup.Run(ctx, serverState.LabID, serverState.Address, serverState.SSHHostKey); err != nil {
+		return err
+	}
+	serverLog.Info("lab warm-up finished", "duration", time.Since(start))
+	return nil
+}
+
+// runAvailableHooks records in the user's history that a server became reachable and tells
+// integrations. Hooks are best-effort, so a failure is only logged.
+func (p *Provisioner) runAvailableHooks(ctx context.Context, serverState redis.ServerState) {
+	p.recordHistory(ctx, redis.Event{Type: redis.EventAvailable, WebUserID: serverState.WebUserID, Tenant: serverState.Tenant,
+		LabID: serverState.LabID, ServerID: serverState.ServerID})
+	if p.hooks == nil {
+		return
+	}
+	if err := p.hooks.Run(ctx, hooks.EventAvailable, serverState); err != nil {
+		p.logger(ctx).Warn("available hook failed", "server_id", serverState.ServerID, "error", err)
+	}
+}
+
+// admitProvisionWithRetry runs the atomic provision admission under the redis-call retry policy
+// Returns (result, nil) once the admission script ran successfully
+// Returns (nil, error) if all retries exhausted with Redis errors
+func (p *Provisioner) admitProvisionWithRetry(ctx context.Context, cacheKey string, initialState redis.ServerState, limits redis.AdmissionLimits) (*redis.AdmissionResult, error) {
+	var result *redis.AdmissionResult
+	err := p.redisRetry.Do(ctx, func() (err error) {
+		result, err = p.redisClient.AdmitProvision(ctx, cacheKey, initialState, limits, config.ServerCacheTTL)
+		return err
+	}, nil, func(attempt int, delay time.Duration, err error) {
+		p.logger(ctx).Warn("failed to run provision admission, retrying",
 			"attempt", attempt,
-			"max_attempts", config.CacheReadRetryAttempts,
+			"max_attempts", p.redisRetry.MaxAttempts,
+			"retry_delay", delay,
 			"error", err)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run provision admission after %d attempts: %w", p.redisRetry.MaxAttempts, err)
+	}
+	return result, nil
+}
+
+// waitForCreateToken blocks until the shared create bucket has a token for a creation.
+// If the bucket can't be read the creation goes ahead, limited only by the per-user rate
+// limits and the provider.
+func (p *Provisioner) waitForCreateToken(ctx context.Context) error {
+	if p.createLimiter == nil {
+		return nil
+	}
+	start := time.Now()
+	for {
+		wait, err := p.createLimiter.TakeCreateToken(ctx, p.createRate, p.createBurst)
+		if err != nil {
+			p.logger(ctx).Warn("failed to take create token, creating server without it", "error", err)
+			return nil
+		}
+		if wait <= 0 {
+			if waited := time.Since(start); waited >= time.Second {
+				p.logger(ctx).Info("server creation held back by the global create rate", "waited", waited.Round(time.Millisecond))
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
 
-		// Don't sleep after the last attempt
-		if attempt < config.CacheReadRetryAttempts {
-			time.Sleep(config.CacheReadRetryTimeout)
+// createServers creates the server of a request, or every node of a composite lab in parallel,
+// grouped as one server. If a node can't be created, the nodes already created are deleted.
+func (p *Provisioner) createServers(ctx context.Context, payload string, labID int) (connector.Server, error) {
+	var nodes []string
+	if p.labNodes != nil {
+		var err error
+		if nodes, err = p.labNodes(labID); err != nil {
+			return nil, fmt.Errorf("look up nodes of lab %d: %w", labID, err)
 		}
 	}
+	if len(nodes) == 0 {
+		return p.createServerWithRetry(ctx, payload)
+	}
 
-	// All retries exhausted
-	return nil, fmt.Errorf("failed to read from cache after %d attempts: %w", config.CacheReadRetryAttempts, lastErr)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return nil, fmt.Errorf("parse payload: %w", err)
+	}
+	group, err := newNodeGroupID()
+	if err != nil {
+		return nil, err
+	}
+	fields["nodeGroup"], _ = json.Marshal(group)
+	p.logger(ctx).Info("creating composite lab", "labid", labID, "nodes", nodes, "node_group", group)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		servers = make(map[string]connector.Server, len(nodes))
+		failed  []error
+	)
+	for _, node := range nodes {
+		nodeFields := make(map[string]json.RawMessage, len(fields)+1)
+		for key, value := range fields {
+			nodeFields[key] = value
+		}
+		nodeFields["node"], _ = json.Marshal(node)
+		nodePayload, err := json.Marshal(nodeFields)
+		if err != nil {
+			return nil, fmt.Errorf("build request of node %s: %w", node, err)
+		}
+
+		wg.Add(1)
+		go func(node string, nodePayload string) {
+			defer wg.Done()
+			server, err := p.createServerWithRetry(ctx, nodePayload)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, fmt.Errorf("node %s: %w", node, err))
+				return
+			}
+			servers[node] = server
+		}(node, string(nodePayload))
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		// Clean up even if ctx was cancelled, the nodes would otherwise be left behind
+		for node, server := range servers {
+			if err := server.Delete(context.WithoutCancel(ctx)); err != nil {
+				p.logger(ctx).Error("failed to delete node of failed composite lab", "node", node, "server_id", server.GetID(), "error", err)
+			}
+		}
+		return nil, errors.Join(failed...)
+	}
+	return connector.NewGroup(nodes[0], servers, func(cloudState string) bool {
+		_, available := p.conn.MapState(cloudState)
+		return available
+	}), nil
 }
 
-// tryAcquireRateLimitWithRetry attempts to acquire rate limit with retry logic
-// Returns (true, nil) if rate limit acquired successfully
-// Returns (false, nil) if rate limited (another request within TTL window)
-// Returns (false, error) if all retries exhausted with Redis errors
-func (p *Provisioner) tryAcquireRateLimitWithRetry(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
-	var lastErr error
+// newNodeGroupID returns a random ID shared by the nodes of one composite lab
+func newNodeGroupID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate node group ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
 
-	for attempt := 1; attempt <= config.CacheReadRetryAttempts; attempt++ {
-		allowed, err := p.redisClient.TryAcquireRateLimit(ctx, webUserID, operation, ttl)
-		if err == nil {
-			// Success - return whether rate limit was acquired
-			return allowed, nil
+// readiness maps the provider status of server to a SWIM status and whether the server
+// accepts connections. A Windows server only does once Remote Desktop answers, which
+// takes minutes after the provider reports it running, and a server of a lab with a
+// readiness check once the check passes, unless the readiness-probe flag is off.
+func (p *Provisioner) readiness(ctx context.Context, server connector.Server, labID int, cloudState string) (string, bool) {
+	status, available := p.conn.MapState(cloudState)
+	if !available || !p.flags.Enabled(ctx, flags.ReadinessProbe) {
+		return status, available
+	}
+	if isWindows(server) && !p.probeRDP(ctx, server.GetIPv6Address()) {
+		return config.StatusProvisioning, false
+	}
+	target := readiness.Target{ServerID: server.GetID(), Address: server.GetIPv6Address()}
+	if err := p.checks.Check(ctx, labID, target); err != nil {
+		p.logger(ctx).Debug("server not ready yet", "server_id", target.ServerID, "labid", labID, "reason", err)
+		return config.StatusProvisioning, false
+	}
+	return status, available
+}
+
+// dialRDP reports whether a TCP connection to the Remote Desktop port at address succeeds
+func dialRDP(ctx context.Context, address string) bool {
+	dialer := net.Dialer{Timeout: rdpProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, rdpPort))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// isWindows reports whether server runs Windows, which is logged into over RDP instead of SSH
+func isWindows(server connector.Server) bool {
+	return server.GetLabels()[connector.LabelOS] == connector.OSWindows
+}
+
+// adminServer is implemented by servers the provider created with an administrator password
+type adminServer interface {
+	GetAdminPassword() string
+}
+
+// adminPassword returns the administrator password of a Windows server, or "" if it has none
+func adminPassword(server connector.Server) string {
+	if group, ok := server.(*connector.Group); ok {
+		server = group.Nodes()[group.Primary()]
+	}
+	if s, ok := server.(adminServer); ok {
+		return s.GetAdminPassword()
+	}
+	return ""
+}
+
+// privateServer is implemented by servers the provider attaches to a private network
+type privateServer interface {
+	GetPrivateAddress() string
+}
+
+// nodeStates returns the cached details of every node of a composite lab, or nil for a single server
+func nodeStates(server connector.Server) map[string]redis.NodeState {
+	group, ok := server.(*connector.Group)
+	if !ok {
+		return nil
+	}
+	nodes := make(map[string]redis.NodeState, len(group.Nodes()))
+	for name, node := range group.Nodes() {
+		state := redis.NodeState{
+			ServerID:   node.GetID(),
+			Address:    node.GetIPv6Address(),
+			ServerType: node.GetServerType(),
+			SSHHostKey: node.GetSSHHostKey(),
+		}
+		if s, ok := node.(privateServer); ok {
+			state.PrivateAddress = s.GetPrivateAddress()
 		}
+		state.Password = adminPassword(node)
+		nodes[name] = state
+	}
+	return nodes
+}
 
-		// It's a real error (Redis connection issue, etc.)
-		lastErr = err
-		p.log.Warn("failed to check rate limit, retrying",
+// hasNode reports whether serverID is one of the nodes of the composite lab cached in state
+func hasNode(state *redis.ServerState, serverID string) bool {
+	for _, node := range state.Nodes {
+		if node.ServerID == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// getStateWithRetry reads the server's state under the poll-state retry policy. A server the
+// provider reports gone isn't looked up again; any other failure, e.g. a timeout or a 5xx
+// answer, only counts as fatal once every attempt failed.
+func (p *Provisioner) getStateWithRetry(ctx context.Context, server connector.Server) (string, error) {
+	var state string
+	err := p.stateRetry.Do(ctx, func() (err error) {
+		state, err = server.GetState(ctx)
+		return err
+	}, func(err error) bool {
+		return !errors.Is(err, errs.ErrNotFound)
+	}, func(attempt int, delay time.Duration, err error) {
+		p.logger(ctx).Warn("failed to get server state during polling, retrying",
+			"server_id", server.GetID(),
 			"attempt", attempt,
-			"max_attempts", config.CacheReadRetryAttempts,
+			"max_attempts", p.stateRetry.MaxAttempts,
+			"retry_delay", delay,
 			"error", err)
+	})
+	return state, err
+}
 
-		// Don't sleep after the last attempt
-		if attempt < config.CacheReadRetryAttempts {
-			time.Sleep(config.CacheReadRetryTimeout)
+// clearPendingCreates removes the journal entries of server, or of each node of a composite
+// lab, once its ID is cached or it was deleted. A failure is only logged: the entry is
+// cleared on the next startup, which finds the server cached or gone.
+func (p *Provisioner) clearPendingCreates(ctx context.Context, server connector.Server) {
+	if p.journal == nil {
+		return
+	}
+	servers := []connector.Server{server}
+	if group, ok := server.(*connector.Group); ok {
+		servers = servers[:0]
+		for _, node := range group.Nodes() {
+			servers = append(servers, node)
+		}
+	}
+	for _, s := range servers {
+		if err := p.journal.ClearPendingCreate(s.GetName()); err != nil {
+			p.logger(ctx).Warn("failed to clear pending create", "server_name", s.GetName(), "error", err)
 		}
 	}
+}
 
-	// All retries exhausted
-	return false, fmt.Errorf("failed to check rate limit after %d attempts: %w", config.CacheReadRetryAttempts, lastErr)
+// createServerWithRetry creates the server under the provision-create retry policy. Only
+// calls the provider throttled are retried, since those created no server.
+func (p *Provisioner) createServerWithRetry(ctx context.Context, payload string) (connector.Server, error) {
+	var server connector.Server
+	err := p.createRetry.Do(ctx, func() (err error) {
+		if err := p.waitForCreateToken(ctx); err != nil {
+			return err
+		}
+		server, err = p.conn.CreateServer(ctx, payload)
+		return err
+	}, func(err error) bool {
+		return errors.Is(err, errs.ErrRateLimited)
+	}, func(attempt int, delay time.Duration, err error) {
+		p.logger(ctx).Warn("server creation rate limited by the provider, retrying",
+			"attempt", attempt,
+			"max_attempts", p.createRetry.MaxAttempts,
+			"retry_delay", delay,
+			"error", err)
+	})
+	return server, err
 }
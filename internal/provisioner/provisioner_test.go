@@ -2,16 +2,36 @@ package provisioner
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alex-sviridov/swim/internal/clock"
 	"github.com/alex-sviridov/swim/internal/config"
 	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/dns"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/flags"
+	"github.com/alex-sviridov/swim/internal/hooks"
+	"github.com/alex-sviridov/swim/internal/inventory"
+	"github.com/alex-sviridov/swim/internal/notify"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/readiness"
 	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/userhash"
+	"github.com/alex-sviridov/swim/internal/warmup"
 )
 
 // Mock Redis Client
@@ -20,14 +40,20 @@ type mockRedisClient struct {
 	deleteServerStateFunc func(ctx context.Context, cacheKey string) error
 	getServerStateFunc    func(ctx context.Context, cacheKey string) (*redis.ServerState, error)
 	pushPayloadFunc       func(ctx context.Context, queueKey string, payload string) error
+	admitProvisionFunc    func(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error)
 	states                map[string]redis.ServerState
-	queuedPayloads        []string // Track payloads pushed to queues
+	queuedPayloads        []string          // Track payloads pushed to queues
+	userHashes            map[string]string // Track label hash mappings
 }
 
 func (m *mockRedisClient) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
 	return "", nil
 }
 
+func (m *mockRedisClient) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	return "", "", nil
+}
+
 func (m *mockRedisClient) PushPayload(ctx context.Context, queueKey string, payload string) error {
 	if m.pushPayloadFunc != nil {
 		return m.pushPayloadFunc(ctx, queueKey, payload)
@@ -53,7 +79,7 @@ func (m *mockRedisClient) GetServerState(ctx context.Context, cacheKey string) (
 	}
 	state, ok := m.states[cacheKey]
 	if !ok {
-		return nil, fmt.Errorf("server state not found in cache")
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
 	}
 	return &state, nil
 }
@@ -62,6 +88,20 @@ func (m *mockRedisClient) GetAllServerStates(ctx context.Context, prefix string)
 	return nil, nil
 }
 
+func (m *mockRedisClient) GetExpiredServerStates(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+	return nil, nil
+}
+
+func (m *mockRedisClient) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	page := &redis.StatePage{}
+	for _, s := range m.states {
+		if filter.Matches(s) {
+			page.States = append(page.States, s)
+		}
+	}
+	return page, nil
+}
+
 func (m *mockRedisClient) DeleteServerState(ctx context.Context, cacheKey string) error {
 	if m.deleteServerStateFunc != nil {
 		return m.deleteServerStateFunc(ctx, cacheKey)
@@ -72,11 +112,74 @@ func (m *mockRedisClient) DeleteServerState(ctx context.Context, cacheKey string
 	return nil
 }
 
+func (m *mockRedisClient) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	for _, key := range cacheKeys {
+		if err := m.DeleteServerState(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockRedisClient) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	for key, state := range states {
+		if err := m.PushServerState(ctx, key, state, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockRedisClient) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	for _, payload := range payloads {
+		if err := m.PushPayload(ctx, queueKey, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockRedisClient) PushUserHash(ctx context.Context, hash string, webUserID string, ttl time.Duration) error {
+	if m.userHashes == nil {
+		m.userHashes = make(map[string]string)
+	}
+	m.userHashes[hash] = webUserID
+	return nil
+}
+
+func (m *mockRedisClient) GetUserByHash(ctx context.Context, hash string) (string, error) {
+	if webUserID, ok := m.userHashes[hash]; ok {
+		return webUserID, nil
+	}
+	return "", errors.New("user hash not found")
+}
+
 func (m *mockRedisClient) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
 	// Allow by default in tests (not rate limited)
 	return true, nil
 }
 
+func (m *mockRedisClient) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	if m.admitProvisionFunc != nil {
+		return m.admitProvisionFunc(ctx, cacheKey, state, limits, cacheTTL)
+	}
+	// Emulate the admission script: duplicate if same lab, otherwise write initial state
+	result := &redis.AdmissionResult{Decision: redis.AdmissionAccepted}
+	if existing, ok := m.states[cacheKey]; ok {
+		result.Existing = &existing
+		if existing.LabID == state.LabID {
+			result.Decision = redis.AdmissionDuplicate
+			return result, nil
+		}
+		result.Decision = redis.AdmissionReplaced
+	}
+	if m.states == nil {
+		m.states = make(map[string]redis.ServerState)
+	}
+	m.states[cacheKey] = state
+	return result, nil
+}
+
 func (m *mockRedisClient) Close() error {
 	return nil
 }
@@ -86,8 +189,13 @@ type mockServer struct {
 	id            string
 	name          string
 	ipv6Address   string
+	serverType    string
+	sshHostKey    string
+	labels        map[string]string
 	state         string
 	stateErr      error
+	stateErrCalls int // with stateErr, only the first calls fail; 0 fails them all
+	stateErrIndex int
 	deleteErr     error
 	deleteCalled  bool
 	stateSequence []string
@@ -106,8 +214,21 @@ func (m *mockServer) GetIPv6Address() string {
 	return m.ipv6Address
 }
 
-func (m *mockServer) GetState() (string, error) {
-	if m.stateErr != nil {
+func (m *mockServer) GetLabels() map[string]string {
+	return m.labels
+}
+
+func (m *mockServer) GetServerType() string {
+	return m.serverType
+}
+
+func (m *mockServer) GetSSHHostKey() string {
+	return m.sshHostKey
+}
+
+func (m *mockServer) GetState(ctx context.Context) (string, error) {
+	if m.stateErr != nil && (m.stateErrCalls == 0 || m.stateErrCalls > m.stateErrIndex) {
+		m.stateErrIndex++
 		return "", m.stateErr
 	}
 	if len(m.stateSequence) > 0 {
@@ -121,11 +242,19 @@ func (m *mockServer) GetState() (string, error) {
 	return m.state, nil
 }
 
-func (m *mockServer) Delete() error {
+func (m *mockServer) Delete(ctx context.Context) error {
 	m.deleteCalled = true
 	return m.deleteErr
 }
 
+func (m *mockServer) Rebuild(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockServer) Resize(ctx context.Context, serverType string) error {
+	return nil
+}
+
 func (m *mockServer) String() string {
 	return fmt.Sprintf("Server{id=%s, name=%s, ipv6=%s}", m.id, m.name, m.ipv6Address)
 }
@@ -135,17 +264,55 @@ type mockConnector struct {
 	createServerFunc func(payload string) (connector.Server, error)
 	server           connector.Server
 	createErr        error
+	labelServers     []connector.Server
+	labelErr         error
 }
 
-func (m *mockConnector) ListServers() ([]connector.Server, error) {
+func (m *mockConnector) ListServers(ctx context.Context) ([]connector.Server, error) {
 	return nil, nil
 }
 
-func (m *mockConnector) GetServerByID(id string) (connector.Server, error) {
+// GetConsoleURL implements connector.Connector.GetConsoleURL
+func (m *mockConnector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// MapState implements connector.Connector.MapState with Hetzner's states
+func (m *mockConnector) MapState(cloudState string) (string, bool) {
+	switch cloudState {
+	case "running":
+		return config.StatusRunning, true
+	case "stopping", "off", "deleting":
+		return config.StatusStopping, false
+	}
+	return config.StatusProvisioning, false
+}
+
+// ProvisionFailed implements connector.FailureStates with Hetzner's states
+func (m *mockConnector) ProvisionFailed(cloudState string) bool {
+	switch cloudState {
+	case "stopping", "off", "deleting":
+		return true
+	}
+	return false
+}
+
+func (m *mockConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	if m.server == nil {
+		return nil, connector.NotFound("server with ID %s not found", id)
+	}
+	return m.server, nil
+}
+
+func (m *mockConnector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
 	return nil, nil
 }
 
-func (m *mockConnector) CreateServer(payload string) (connector.Server, error) {
+func (m *mockConnector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	return m.labelServers, m.labelErr
+}
+
+func (m *mockConnector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
 	if m.createServerFunc != nil {
 		return m.createServerFunc(payload)
 	}
@@ -210,6 +377,35 @@ func TestProcessRequest_InvalidPayload(t *testing.T) {
 	}
 }
 
+func TestProcessRequest_RejectsInvalidFields(t *testing.T) {
+	payloads := []string{
+		`{"webuserid":"tenant:user-123","labId":42}`,
+		`{"webuserid":"user-123\nlevel=ERROR msg=forged","labId":42}`,
+		`{"webuserid":"user-123","labId":-5}`,
+		`{"webuserid":"user-123","labId":42,"correlationId":"req-1\r\nforged"}`,
+	}
+	for _, payload := range payloads {
+		mockConn, creates := countingConnector()
+		events := &recordingEvents{}
+		admitted := false
+		mockRedis := &mockRedisClient{
+			admitProvisionFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+				admitted = true
+				return &redis.AdmissionResult{Decision: redis.AdmissionAccepted}, nil
+			},
+		}
+
+		New(newTestLogger(), mockConn, mockRedis).WithEvents(events).ProcessRequest(context.Background(), payload)
+
+		if admitted || *creates != 0 {
+			t.Errorf("%s: expected request to be rejected before admission", payload)
+		}
+		if len(events.events) != 1 || events.events[0].Type != redis.EventProvisionFailed || events.events[0].WebUserID != "" {
+			t.Errorf("%s: expected one provision failure event without the user ID, got %+v", payload, events.events)
+		}
+	}
+}
+
 func TestProcessRequest_SuccessfulProvisioning(t *testing.T) {
 	log := newTestLogger()
 	mockRedis := &mockRedisClient{}
@@ -218,6 +414,8 @@ func TestProcessRequest_SuccessfulProvisioning(t *testing.T) {
 		id:            "server-123",
 		name:          "test-server",
 		ipv6Address:   "2001:db8::1",
+		serverType:    "cpx21", // fallback type picked by the connector
+		sshHostKey:    "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAtest",
 		stateSequence: []string{"starting", "running"}, // Transitions to running
 	}
 
@@ -251,6 +449,97 @@ func TestProcessRequest_SuccessfulProvisioning(t *testing.T) {
 	if state.Address != "2001:db8::1" {
 		t.Errorf("expected Address '2001:db8::1', got %s", state.Address)
 	}
+	if state.ServerType != "cpx21" {
+		t.Errorf("expected ServerType 'cpx21', got %s", state.ServerType)
+	}
+	if state.SSHHostKey != "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAtest" {
+		t.Errorf("expected SSH host key to be cached, got %q", state.SSHHostKey)
+	}
+}
+
+// recordingJournal remembers the pending creates cleared, and whether the server was cached by then
+type recordingJournal struct {
+	redis   *mockRedisClient
+	cleared []string
+	cached  bool
+}
+
+func (j *recordingJournal) RecordPendingCreate(name, tenant, webUserID string, labID int, correlationID string) error {
+	return nil
+}
+
+func (j *recordingJournal) ClearPendingCreate(name string) error {
+	j.cleared = append(j.cleared, name)
+	j.cached = j.redis.states[redis.ServerCacheKey("user-123")].ServerID != ""
+	return nil
+}
+
+func TestProcessRequest_ClearsPendingCreateOnceCached(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	journal := &recordingJournal{redis: mockRedis}
+	mockConn := &mockConnector{
+		server: &mockServer{id: "server-123", name: "test-server", stateSequence: []string{"running"}},
+	}
+
+	p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(1 * time.Millisecond).WithCreateJournal(journal)
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if len(journal.cleared) != 1 || journal.cleared[0] != "test-server" || !journal.cached {
+		t.Errorf("expected the pending create to be cleared after the server was cached, got %v (cached %v)", journal.cleared, journal.cached)
+	}
+
+	// A server whose ID couldn't be cached keeps its entry for the next startup
+	failing := &mockRedisClient{states: make(map[string]redis.ServerState)}
+	failing.pushServerStateFunc = func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+		if state.ServerID != "" {
+			return errors.New("redis unavailable")
+		}
+		failing.states[cacheKey] = state
+		return nil
+	}
+	journal = &recordingJournal{redis: failing}
+	p = New(newTestLogger(), mockConn, failing).WithPollInterval(1 * time.Millisecond).WithCreateJournal(journal)
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if len(journal.cleared) != 0 {
+		t.Errorf("expected the pending create to be kept, got %v", journal.cleared)
+	}
+}
+
+func TestProcessRequest_StoresUserHashMapping(t *testing.T) {
+	log := newTestLogger()
+
+	tests := []struct {
+		name          string
+		secret        string
+		expectMapping bool
+	}{
+		{"hashing disabled", "", false},
+		{"hashing enabled", "test-secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LABEL_USER_HMAC_SECRET", tt.secret)
+
+			mockRedis := &mockRedisClient{}
+			mockConn := &mockConnector{
+				server: &mockServer{id: "server-123", stateSequence: []string{"running"}},
+			}
+
+			p := New(log, mockConn, mockRedis).WithPollInterval(1 * time.Millisecond)
+			p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+			webUserID, err := mockRedis.GetUserByHash(context.Background(), userhash.Hash("test-secret", "user-123"))
+			if tt.expectMapping {
+				if err != nil || webUserID != "user-123" {
+					t.Errorf("expected hash to map to user-123, got %q (err: %v)", webUserID, err)
+				}
+			} else if len(mockRedis.userHashes) != 0 {
+				t.Errorf("expected no hash mapping, got %v", mockRedis.userHashes)
+			}
+		})
+	}
 }
 
 func TestProcessRequest_CreateServerError(t *testing.T) {
@@ -275,6 +564,232 @@ func TestProcessRequest_CreateServerError(t *testing.T) {
 	}
 }
 
+type recordingArchive []redis.SessionRecord
+
+func (r *recordingArchive) Archive(ctx context.Context, record redis.SessionRecord) error {
+	*r = append(*r, record)
+	return nil
+}
+
+func TestProcessRequest_ArchivesFailedProvision(t *testing.T) {
+	mockConn := &mockConnector{createErr: errors.New("failed to create server")}
+	archived := &recordingArchive{}
+	p := New(newTestLogger(), mockConn, &mockRedisClient{}).WithArchive(archived, "hetzner")
+
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if len(*archived) != 1 {
+		t.Fatalf("expected one archived session, got %+v", *archived)
+	}
+	record := (*archived)[0]
+	if record.ExitReason != redis.ExitProvisionFailed || record.WebUserID != "user-123" || record.LabID != 42 || record.Provider != "hetzner" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.StartedAt.IsZero() || record.ProvisionSeconds != 0 {
+		t.Errorf("expected a start time and no provisioning time, got %+v", record)
+	}
+}
+
+func TestProcessRequest_CompositeLab(t *testing.T) {
+	ctx := context.Background()
+	labNodes := func(labID int) ([]string, error) {
+		return []string{"attacker", "target"}, nil
+	}
+
+	// Every node is created with its name and the shared group, and cached in the node map
+	var mu sync.Mutex
+	groups := map[string]bool{}
+	mockRedis := &mockRedisClient{}
+	mockConn := &mockConnector{
+		createServerFunc: func(payload string) (connector.Server, error) {
+			var req struct{ Node, NodeGroup string }
+			if err := json.Unmarshal([]byte(payload), &req); err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			groups[req.NodeGroup] = true
+			mu.Unlock()
+			return &mockServer{id: req.Node + "-id", ipv6Address: "2001:db8::" + req.Node, state: "running"}, nil
+		},
+	}
+	p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond).WithLabNodes(labNodes)
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":7}`)
+
+	state, err := mockRedis.GetServerState(ctx, redis.ServerCacheKey("user-123"))
+	if err != nil {
+		t.Fatalf("expected the lab to be cached, got %v", err)
+	}
+	if state.ServerID != "attacker-id" || state.Status != config.StatusRunning {
+		t.Errorf("expected the running lab to be cached as its primary node, got %+v", state)
+	}
+	if len(state.Nodes) != 2 || state.Nodes["target"].ServerID != "target-id" || state.Nodes["target"].Address != "2001:db8::target" {
+		t.Errorf("expected both nodes to be cached, got %+v", state.Nodes)
+	}
+	if len(groups) != 1 || groups[""] {
+		t.Errorf("expected one node group shared by the nodes, got %v", groups)
+	}
+
+	// A node that can't be created takes the nodes created already with it
+	var created []*mockServer
+	mockRedis = &mockRedisClient{}
+	mockConn = &mockConnector{
+		createServerFunc: func(payload string) (connector.Server, error) {
+			if strings.Contains(payload, `"target"`) {
+				return nil, errors.New("failed to create server")
+			}
+			server := &mockServer{id: "attacker-id", state: "running"}
+			mu.Lock()
+			created = append(created, server)
+			mu.Unlock()
+			return server, nil
+		},
+	}
+	p = New(newTestLogger(), mockConn, mockRedis).WithLabNodes(labNodes)
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":7}`)
+
+	if _, err := mockRedis.GetServerState(ctx, redis.ServerCacheKey("user-123")); err == nil {
+		t.Error("expected cache to be deleted after a node failed")
+	}
+	if len(created) != 1 || !created[0].deleteCalled {
+		t.Errorf("expected the created node to be deleted, got %+v", created)
+	}
+}
+
+// mockWindowsServer is a Windows server created with an administrator password
+type mockWindowsServer struct {
+	*mockServer
+	password string
+}
+
+func (m *mockWindowsServer) GetAdminPassword() string {
+	return m.password
+}
+
+func TestProcessRequest_Windows(t *testing.T) {
+	ctx := context.Background()
+	mockRedis := &mockRedisClient{}
+	mockConn := &mockConnector{
+		server: &mockWindowsServer{
+			mockServer: &mockServer{
+				id:          "server-123",
+				ipv6Address: "2001:db8::1",
+				labels:      map[string]string{connector.LabelOS: connector.OSWindows},
+				state:       "running",
+			},
+			password: "s3cretPassw0rd",
+		},
+	}
+
+	// Remote Desktop answers on the third probe, long after the server runs
+	probes := 0
+	p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond)
+	p.probeRDP = func(ctx context.Context, address string) bool {
+		if address != "2001:db8::1" {
+			t.Errorf("expected the server's address to be probed, got %s", address)
+		}
+		probes++
+		return probes >= 3
+	}
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":42}`)
+
+	state, err := mockRedis.GetServerState(ctx, redis.ServerCacheKey("user-123"))
+	if err != nil {
+		t.Fatalf("expected server state to be cached, got error: %v", err)
+	}
+	if !state.Available || state.Status != config.StatusRunning || probes != 3 {
+		t.Errorf("expected the server to be available once RDP answered, got %+v after %d probes", state, probes)
+	}
+	if state.User != "Administrator" || state.Password != "s3cretPassw0rd" {
+		t.Errorf("expected the administrator's credentials, got user %q, password %q", state.User, state.Password)
+	}
+}
+
+func TestProcessRequest_WindowsProbeOff(t *testing.T) {
+	ctx := context.Background()
+	mockRedis := &mockRedisClient{}
+	mockConn := &mockConnector{
+		server: &mockWindowsServer{
+			mockServer: &mockServer{
+				id:          "server-123",
+				ipv6Address: "2001:db8::1",
+				labels:      map[string]string{connector.LabelOS: connector.OSWindows},
+				state:       "running",
+			},
+		},
+	}
+
+	// With the readiness probe switched off the server is available once it runs
+	store := redistest.New()
+	store.SetFlag(flags.ReadinessProbe, "off")
+	p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond).WithFlags(flags.New(newTestLogger(), store))
+	p.probeRDP = func(ctx context.Context, address string) bool {
+		t.Error("expected no Remote Desktop probe")
+		return false
+	}
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":42}`)
+
+	state, err := mockRedis.GetServerState(ctx, redis.ServerCacheKey("user-123"))
+	if err != nil {
+		t.Fatalf("expected server state to be cached, got error: %v", err)
+	}
+	if !state.Available || state.Status != config.StatusRunning {
+		t.Errorf("expected the server to be available, got %+v", state)
+	}
+}
+
+// phoneHomeAfter is a phone-home reader whose server phones home on the given poll
+type phoneHomeAfter struct {
+	polls, after int
+	serverIDs    []string
+}
+
+func (r *phoneHomeAfter) PhonedHome(ctx context.Context, serverID string) (bool, error) {
+	r.polls++
+	r.serverIDs = append(r.serverIDs, serverID)
+	return r.polls >= r.after, nil
+}
+
+func TestProcessRequest_ReadinessCheck(t *testing.T) {
+	ctx := context.Background()
+	mockRedis := &mockRedisClient{}
+	mockConn := &mockConnector{
+		server: &mockServer{id: "server-123", ipv6Address: "2001:db8::1", state: "running"},
+	}
+
+	// Lab 42 phones home on the third poll, long after the server runs; lab 7 has no check
+	phoneHome := &phoneHomeAfter{after: 3}
+	checks := readiness.NewChecks(func(labID int) (*readiness.Spec, error) {
+		if labID != 42 {
+			return nil, nil
+		}
+		return &readiness.Spec{Type: readiness.TypePhoneHome}, nil
+	}, phoneHome)
+	p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond).WithReadiness(checks)
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":42}`)
+
+	state, err := mockRedis.GetServerState(ctx, redis.ServerCacheKey("user-123"))
+	if err != nil {
+		t.Fatalf("expected server state to be cached, got error: %v", err)
+	}
+	if !state.Available || state.Status != config.StatusRunning || phoneHome.polls != 3 {
+		t.Errorf("expected the server to be available once it phoned home, got %+v after %d polls", state, phoneHome.polls)
+	}
+	for _, id := range phoneHome.serverIDs {
+		if id != "server-123" {
+			t.Errorf("expected the server's phone-home key to be read, got %s", id)
+		}
+	}
+
+	p.ProcessRequest(ctx, `{"webuserid":"user-456","labId":7}`)
+	state, err = mockRedis.GetServerState(ctx, redis.ServerCacheKey("user-456"))
+	if err != nil {
+		t.Fatalf("expected server state to be cached, got error: %v", err)
+	}
+	if !state.Available || phoneHome.polls != 3 {
+		t.Errorf("expected a lab without a check to be available at once, got %+v after %d polls", state, phoneHome.polls)
+	}
+}
+
 func TestProcessRequest_WithEnvironmentVariables(t *testing.T) {
 	// Set environment variables
 	os.Setenv("SSH_USERNAME", "custom-user")
@@ -323,55 +838,6 @@ func TestProcessRequest_WithEnvironmentVariables(t *testing.T) {
 	}
 }
 
-func TestMapCloudStateToStatus(t *testing.T) {
-	tests := []struct {
-		cloudState     string
-		expectedStatus string
-	}{
-		{"running", config.StatusRunning},
-		{"starting", config.StatusProvisioning},
-		{"initializing", config.StatusProvisioning},
-		{"stopping", config.StatusStopping},
-		{"off", config.StatusStopping},
-		{"deleting", config.StatusStopping},
-		{"unknown", config.StatusProvisioning},
-		{"", config.StatusProvisioning},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.cloudState, func(t *testing.T) {
-			result := mapCloudStateToStatus(tt.cloudState)
-			if result != tt.expectedStatus {
-				t.Errorf("mapCloudStateToStatus(%q) = %q, want %q", tt.cloudState, result, tt.expectedStatus)
-			}
-		})
-	}
-}
-
-func TestIsServerAvailable(t *testing.T) {
-	tests := []struct {
-		cloudState string
-		expected   bool
-	}{
-		{"running", true},
-		{"starting", false},
-		{"initializing", false},
-		{"stopping", false},
-		{"off", false},
-		{"unknown", false},
-		{"", false},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.cloudState, func(t *testing.T) {
-			result := isServerAvailable(tt.cloudState)
-			if result != tt.expected {
-				t.Errorf("isServerAvailable(%q) = %v, want %v", tt.cloudState, result, tt.expected)
-			}
-		})
-	}
-}
-
 func TestPollServerState_StateChanges(t *testing.T) {
 	log := newTestLogger()
 	mockRedis := &mockRedisClient{}
@@ -383,7 +849,7 @@ func TestPollServerState_StateChanges(t *testing.T) {
 		stateSequence: []string{"starting", "initializing", "running"},
 	}
 
-	p := New(log, nil, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p := New(log, &mockConnector{}, mockRedis).WithPollInterval(1 * time.Millisecond)
 	ctx := context.Background()
 
 	cacheKey := redis.ServerCacheKey("user-123")
@@ -429,7 +895,7 @@ func TestPollServerState_Timeout(t *testing.T) {
 		state:       "starting", // Never reaches "running"
 	}
 
-	p := New(log, nil, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p := New(log, &mockConnector{}, mockRedis).WithPollInterval(1 * time.Millisecond)
 
 	// Create a context with very short timeout to simulate stateTimeout
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
@@ -458,39 +924,94 @@ func TestPollServerState_Timeout(t *testing.T) {
 	}
 }
 
-func TestPollServerState_GetStateError(t *testing.T) {
+func TestPollServerState_SupersededByDecommission(t *testing.T) {
 	log := newTestLogger()
-	mockRedis := &mockRedisClient{}
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	mockRedis := &mockRedisClient{
+		states: map[string]redis.ServerState{
+			cacheKey: {
+				Status:    config.StatusStopping,
+				ServerID:  "server-123",
+				WebUserID: "user-123",
+				LabID:     42,
+				Version:   3,
+			},
+		},
+		pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+			// Decommissioner already bumped the version
+			return redis.ErrVersionConflict
+		},
+	}
 
 	mockSrv := &mockServer{
-		id:          "server-123",
-		name:        "test-server",
-		ipv6Address: "2001:db8::1",
-		state:       "starting",
-		stateErr:    errors.New("failed to get state"),
+		id:            "server-123",
+		name:          "test-server",
+		ipv6Address:   "2001:db8::1",
+		stateSequence: []string{"running"},
 	}
 
-	p := New(log, nil, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p := New(log, &mockConnector{}, mockRedis).WithPollInterval(1 * time.Millisecond)
 	ctx := context.Background()
 
-	cacheKey := redis.ServerCacheKey("user-123")
 	initialState := redis.ServerState{
-		User:        "student",
-		Address:     "2001:db8::1",
 		Status:      config.StatusProvisioning,
-		Available:   false,
 		CloudStatus: "starting",
 		ServerID:    "server-123",
 		WebUserID:   "user-123",
 		LabID:       42,
+		Version:     2,
 	}
 
-	// This should handle the error and delete the server
 	p.pollServerState(ctx, mockSrv, cacheKey, initialState, "starting")
 
-	// Verify server was deleted
-	if !mockSrv.deleteCalled {
-		t.Error("expected server to be deleted after GetState error")
+	// Poller must not delete the server or the entry owned by the decommissioner
+	if mockSrv.deleteCalled {
+		t.Error("expected server to not be deleted when entry is superseded")
+	}
+	state, ok := mockRedis.states[cacheKey]
+	if !ok {
+		t.Fatal("expected cache entry to be kept")
+	}
+	if state.Status != config.StatusStopping {
+		t.Errorf("expected status to remain %q, got %q", config.StatusStopping, state.Status)
+	}
+}
+
+func TestPollServerState_GetStateError(t *testing.T) {
+	log := newTestLogger()
+	mockRedis := &mockRedisClient{}
+
+	mockSrv := &mockServer{
+		id:          "server-123",
+		name:        "test-server",
+		ipv6Address: "2001:db8::1",
+		state:       "starting",
+		stateErr:    errors.New("failed to get state"),
+	}
+
+	p := New(log, &mockConnector{}, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p.stateRetry.InitialDelay = time.Millisecond
+	ctx := context.Background()
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	initialState := redis.ServerState{
+		User:        "student",
+		Address:     "2001:db8::1",
+		Status:      config.StatusProvisioning,
+		Available:   false,
+		CloudStatus: "starting",
+		ServerID:    "server-123",
+		WebUserID:   "user-123",
+		LabID:       42,
+	}
+
+	// This should handle the error and delete the server once every attempt failed
+	p.pollServerState(ctx, mockSrv, cacheKey, initialState, "starting")
+
+	// Verify server was deleted
+	if !mockSrv.deleteCalled {
+		t.Error("expected server to be deleted after GetState error")
 	}
 
 	// Verify cache was cleared
@@ -500,6 +1021,168 @@ func TestPollServerState_GetStateError(t *testing.T) {
 	}
 }
 
+func TestPollServerState_TransientGetStateError(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	// The provider fails a few lookups, e.g. with 5xx answers, then reports the server running
+	mockSrv := &mockServer{
+		id:            "server-123",
+		name:          "test-server",
+		ipv6Address:   "2001:db8::1",
+		state:         "running",
+		stateErr:      errors.New("hcloud: server error (500)"),
+		stateErrCalls: 3,
+	}
+
+	p := New(newTestLogger(), &mockConnector{}, mockRedis).WithPollInterval(time.Millisecond)
+	p.stateRetry.InitialDelay = time.Millisecond
+	ctx := context.Background()
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	initialState := redis.ServerState{Status: config.StatusProvisioning, CloudStatus: "starting", ServerID: "server-123", WebUserID: "user-123", LabID: 42}
+	p.pollServerState(ctx, mockSrv, cacheKey, initialState, "starting")
+
+	if mockSrv.deleteCalled {
+		t.Error("expected the server to be kept after lookups that failed only for a while")
+	}
+	state, err := mockRedis.GetServerState(ctx, cacheKey)
+	if err != nil || !state.Available {
+		t.Errorf("expected the available state cached, got %+v, %v", state, err)
+	}
+}
+
+func TestPollServerState_ServerGone(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	// A server the provider reports gone isn't looked up again
+	mockSrv := &mockServer{
+		id:            "server-123",
+		name:          "test-server",
+		state:         "running",
+		stateErr:      connector.NotFound("server with ID 123 not found"),
+		stateErrCalls: 1,
+	}
+
+	p := New(newTestLogger(), &mockConnector{}, mockRedis).WithPollInterval(time.Millisecond)
+	p.stateRetry.InitialDelay = time.Hour
+	ctx := context.Background()
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	initialState := redis.ServerState{Status: config.StatusProvisioning, CloudStatus: "starting", ServerID: "server-123", WebUserID: "user-123", LabID: 42}
+	mockRedis.PushServerState(ctx, cacheKey, initialState, config.ServerCacheTTL)
+	p.pollServerState(ctx, mockSrv, cacheKey, initialState, "starting")
+
+	if mockSrv.stateErrIndex != 1 {
+		t.Errorf("expected a single lookup, got %d", mockSrv.stateErrIndex)
+	}
+	if _, err := mockRedis.GetServerState(ctx, cacheKey); err == nil {
+		t.Error("expected the cache entry of the gone server removed")
+	}
+}
+
+func TestPollServerState_TerminalState(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	mockSrv := &mockServer{id: "server-123", name: "test-server", ipv6Address: "2001:db8::1", stateSequence: []string{"off"}}
+	archived := &recordingArchive{}
+	p := New(newTestLogger(), &mockConnector{}, mockRedis).WithPollInterval(time.Millisecond).WithArchive(archived, "hetzner")
+	ctx := context.Background()
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	initialState := redis.ServerState{Status: config.StatusProvisioning, CloudStatus: "starting", ServerID: "server-123", Address: "2001:db8::1",
+		WebUserID: "user-123", LabID: 42, ExpiresAt: time.Now().Add(time.Hour)}
+	mockRedis.PushServerState(ctx, cacheKey, initialState, config.ServerCacheTTL)
+
+	done := make(chan struct{})
+	go func() {
+		p.pollServerState(ctx, mockSrv, cacheKey, initialState, "starting")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected polling to stop at once on a terminal state")
+	}
+
+	if !mockSrv.deleteCalled {
+		t.Error("expected the server to be deleted")
+	}
+	state, err := mockRedis.GetServerState(ctx, cacheKey)
+	if err != nil {
+		t.Fatalf("expected the failed entry to stay for LabMan, got %v", err)
+	}
+	if state.Status != config.StatusFailed || state.CloudStatus != "off" || state.FailureReason == "" || state.Available {
+		t.Errorf("expected a failed entry with the reason, got %+v", state)
+	}
+	if state.ServerID != "" || time.Until(state.ExpiresAt) > 0 {
+		t.Errorf("expected the deleted server cleared and the entry due for cleanup, got %+v", state)
+	}
+	if len(*archived) != 1 || (*archived)[0].ExitReason != redis.ExitProvisionFailed || (*archived)[0].ServerID != "server-123" {
+		t.Errorf("expected the failed session archived, got %+v", *archived)
+	}
+}
+
+// startableServer is a mock server that can be powered on again
+type startableServer struct {
+	*mockServer
+	powerOns int
+}
+
+func (s *startableServer) PowerOn(ctx context.Context) error {
+	s.powerOns++
+	return nil
+}
+
+func TestPollServerState_TerminalStateAfterResize(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	// A failed resize left the server off; it comes back once powered on
+	mockSrv := &startableServer{mockServer: &mockServer{id: "server-123", name: "test-server", ipv6Address: "2001:db8::1",
+		stateSequence: []string{"off", "off", "starting", "running"}}}
+	p := New(newTestLogger(), &mockConnector{}, mockRedis).WithPollInterval(time.Millisecond)
+	ctx := context.Background()
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	initialState := redis.ServerState{Status: config.StatusProvisioning, CloudStatus: "resizing", ServerID: "server-123", Address: "2001:db8::1",
+		WebUserID: "user-123", LabID: 42, ExpiresAt: time.Now().Add(time.Hour), Operation: redis.OperationResize}
+	mockRedis.PushServerState(ctx, cacheKey, initialState, config.ServerCacheTTL)
+
+	p.pollServerState(ctx, mockSrv, cacheKey, initialState, "")
+
+	if mockSrv.deleteCalled {
+		t.Error("expected the resized server to be kept")
+	}
+	if mockSrv.powerOns != 1 {
+		t.Errorf("expected the server powered on once, got %d", mockSrv.powerOns)
+	}
+	state, err := mockRedis.GetServerState(ctx, cacheKey)
+	if err != nil {
+		t.Fatalf("expected the entry to stay, got %v", err)
+	}
+	if state.Status != config.StatusRunning || !state.Available || state.ServerID != "server-123" {
+		t.Errorf("expected the server available again, got %+v", state)
+	}
+}
+
+func TestPollServerState_TerminalStateAfterDecommission(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	mockSrv := &mockServer{id: "server-123", name: "test-server", stateSequence: []string{"deleting"}}
+	p := New(newTestLogger(), &mockConnector{}, mockRedis).WithPollInterval(time.Millisecond)
+	ctx := context.Background()
+
+	// A decommission moved the entry on and is deleting the server
+	cacheKey := redis.ServerCacheKey("user-123")
+	initialState := redis.ServerState{Status: config.StatusProvisioning, ServerID: "server-123", WebUserID: "user-123", LabID: 42}
+	stopping := initialState
+	stopping.Status = config.StatusStopping
+	mockRedis.PushServerState(ctx, cacheKey, stopping, config.ServerCacheTTL)
+
+	p.pollServerState(ctx, mockSrv, cacheKey, initialState, "starting")
+
+	if mockSrv.deleteCalled {
+		t.Error("expected the deletion left to the decommission")
+	}
+	if state, _ := mockRedis.GetServerState(ctx, cacheKey); state == nil || state.Status != config.StatusStopping {
+		t.Errorf("expected the entry left to the decommission, got %+v", state)
+	}
+}
+
 func TestHandleProvisioningError(t *testing.T) {
 	log := newTestLogger()
 	mockRedis := &mockRedisClient{}
@@ -510,7 +1193,7 @@ func TestHandleProvisioningError(t *testing.T) {
 		ipv6Address: "2001:db8::1",
 	}
 
-	p := New(log, nil, mockRedis)
+	p := New(log, &mockConnector{}, mockRedis)
 	ctx := context.Background()
 
 	cacheKey := redis.ServerCacheKey("user-123")
@@ -552,7 +1235,7 @@ func TestHandleProvisioningError_DeleteServerFails(t *testing.T) {
 		deleteErr:   errors.New("failed to delete server"),
 	}
 
-	p := New(log, nil, mockRedis)
+	p := New(log, &mockConnector{}, mockRedis)
 	ctx := context.Background()
 
 	cacheKey := redis.ServerCacheKey("user-123")
@@ -583,42 +1266,89 @@ func TestHandleProvisioningError_DeleteServerFails(t *testing.T) {
 	}
 }
 
-func TestProcessRequest_CacheInitialStateError(t *testing.T) {
+func TestProcessRequest_RateLimited(t *testing.T) {
 	log := newTestLogger()
 
-	cacheError := errors.New("cache error")
 	mockRedis := &mockRedisClient{
-		pushServerStateFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
-			// Only fail on initial provisioning state (empty ServerID)
-			if state.ServerID == "" {
-				return cacheError
-			}
-			return nil
+		admitProvisionFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+			return &redis.AdmissionResult{Decision: redis.AdmissionRateLimited}, nil
 		},
 	}
 
-	mockSrv := &mockServer{
-		id:          "server-123",
-		name:        "test-server",
-		ipv6Address: "2001:db8::1",
-		state:       "running",
-	}
-
+	createCalled := false
 	mockConn := &mockConnector{
-		server: mockSrv,
+		createServerFunc: func(payload string) (connector.Server, error) {
+			createCalled = true
+			return nil, errors.New("should not be called")
+		},
 	}
 
 	p := New(log, mockConn, mockRedis).WithPollInterval(1 * time.Millisecond)
-	ctx := context.Background()
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
 
-	payload := `{"webuserid":"user-123","labId":42}`
+	if createCalled {
+		t.Error("expected CreateServer to not be called when rate limited")
+	}
+	if len(mockRedis.states) != 0 {
+		t.Errorf("expected no cached state when rate limited, got %d", len(mockRedis.states))
+	}
+}
 
-	// Should continue provisioning even if initial cache fails
-	p.ProcessRequest(ctx, payload)
+func TestProcessRequest_StaleRequest(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	stale := now.Add(-time.Hour - time.Second).Format(time.RFC3339)
+	fresh := now.Add(-time.Hour + time.Second).Format(time.RFC3339)
 
-	// Server should still have been created (no deletion should occur)
-	if mockSrv.deleteCalled {
-		t.Error("server should not be deleted when only initial cache fails")
+	tests := []struct {
+		name    string
+		payload string
+		maxAge  time.Duration
+		dropped bool
+	}{
+		{name: "stale", payload: `{"webuserid":"user-123","labId":42,"enqueuedAt":"` + stale + `"}`, maxAge: time.Hour, dropped: true},
+		{name: "fresh", payload: `{"webuserid":"user-123","labId":42,"enqueuedAt":"` + fresh + `"}`, maxAge: time.Hour},
+		{name: "no enqueuedAt", payload: `{"webuserid":"user-123","labId":42}`, maxAge: time.Hour},
+		{name: "no max age", payload: `{"webuserid":"user-123","labId":42,"enqueuedAt":"` + stale + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deadLettered []string
+			mockRedis := &mockRedisClient{
+				pushPayloadFunc: func(ctx context.Context, queueKey string, payload string) error {
+					if queueKey == config.DeadLetterQueueKey(config.ProvisionQueueKey) {
+						deadLettered = append(deadLettered, payload)
+					}
+					return nil
+				},
+			}
+			created := false
+			mockConn := &mockConnector{
+				server: &mockServer{id: "server-123", state: "running"},
+				createServerFunc: func(payload string) (connector.Server, error) {
+					created = true
+					return &mockServer{id: "server-123", state: "running"}, nil
+				},
+			}
+			events := &recordingEvents{}
+
+			p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(1 * time.Millisecond).
+				WithEvents(events).WithMaxRequestAge(tt.maxAge).WithClock(clock.NewFake(now))
+			p.ProcessRequest(context.Background(), tt.payload)
+
+			if created == tt.dropped {
+				t.Errorf("expected dropped=%v, got created=%v", tt.dropped, created)
+			}
+			if !tt.dropped {
+				return
+			}
+			if len(deadLettered) != 1 || deadLettered[0] != tt.payload {
+				t.Errorf("expected the request in the dead-letter queue, got %v", deadLettered)
+			}
+			if len(events.events) != 1 || events.events[0].Type != redis.EventStaleRequest {
+				t.Errorf("expected one stale request event, got %+v", events.events)
+			}
+		})
 	}
 }
 
@@ -640,12 +1370,13 @@ func TestProcessRequest_GetStateError(t *testing.T) {
 	}
 
 	p := New(log, mockConn, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p.stateRetry.InitialDelay = time.Millisecond
 	ctx := context.Background()
 
 	payload := `{"webuserid":"user-123","labId":42}`
 	p.ProcessRequest(ctx, payload)
 
-	// When GetState fails during polling, handleProvisioningError deletes cache and server
+	// When GetState keeps failing during polling, handleProvisioningError deletes cache and server
 	cacheKey := redis.ServerCacheKey("user-123")
 	_, err := mockRedis.GetServerState(ctx, cacheKey)
 	if err == nil {
@@ -669,7 +1400,7 @@ func TestPollServerState_ContextCancellation(t *testing.T) {
 		state:       "starting", // Never reaches "running"
 	}
 
-	p := New(log, nil, mockRedis).WithPollInterval(10 * time.Millisecond)
+	p := New(log, &mockConnector{}, mockRedis).WithPollInterval(10 * time.Millisecond)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -738,6 +1469,47 @@ func TestProcessRequest_UpdateCacheError(t *testing.T) {
 	}
 }
 
+func TestProcessRequest_RetriesTransientCacheWrite(t *testing.T) {
+	// Sentinel fails over while the server boots: the writes of the poll fail for a while
+	failover := errs.Mark(errors.New("READONLY You can't write against a read only replica."), errs.ErrTransient)
+	mockRedis := &mockRedisClient{}
+	pushes := 0
+	mockRedis.pushServerStateFunc = func(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+		pushes++
+		if pushes >= 2 && pushes <= 4 {
+			return failover
+		}
+		if mockRedis.states == nil {
+			mockRedis.states = make(map[string]redis.ServerState)
+		}
+		mockRedis.states[cacheKey] = state
+		return nil
+	}
+	mockSrv := &mockServer{
+		id:            "server-123",
+		name:          "test-server",
+		ipv6Address:   "2001:db8::1",
+		stateSequence: []string{"starting", "running"},
+	}
+
+	p := New(newTestLogger(), &mockConnector{server: mockSrv}, mockRedis).WithPollInterval(time.Millisecond)
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if mockSrv.deleteCalled {
+		t.Error("expected the server to be kept when only the cache write failed")
+	}
+	state, err := mockRedis.GetServerState(context.Background(), redis.ServerCacheKey("user-123"))
+	if err != nil {
+		t.Fatalf("expected a cached state, got %v", err)
+	}
+	if !state.Available || state.ServerID != "server-123" {
+		t.Errorf("expected the available state written after the failover, got %+v", state)
+	}
+	if pushes != 5 {
+		t.Errorf("expected the write retried until it succeeded (5 writes), got %d", pushes)
+	}
+}
+
 func TestProcessRequest_CompleteFlow(t *testing.T) {
 	log := newTestLogger()
 	mockRedis := &mockRedisClient{}
@@ -925,7 +1697,7 @@ func TestProcessRequest_DifferentLabID_DecommissionsAndProvisions(t *testing.T)
 	p := New(log, mockConn, mockRedis).WithPollInterval(1 * time.Millisecond)
 	ctx := context.Background()
 
-	payload := `{"webuserid":"user-123","labId":99}` // New labId
+	payload := `{"webuserid":"user-123","labId":99,"correlationId":"req-99"}` // New labId
 	p.ProcessRequest(ctx, payload)
 
 	// Verify decommission request was queued for old server
@@ -933,7 +1705,7 @@ func TestProcessRequest_DifferentLabID_DecommissionsAndProvisions(t *testing.T)
 		t.Fatalf("expected 1 decommission request, got %d", len(mockRedis.queuedPayloads))
 	}
 
-	expectedDecommissionPayload := `{"webuserid":"user-123","labId":42,"serverId":"old-server-123"}`
+	expectedDecommissionPayload := `{"webuserid":"user-123","labId":42,"serverId":"old-server-123","correlationId":"req-99","switch":true}`
 	if mockRedis.queuedPayloads[0] != expectedDecommissionPayload {
 		t.Errorf("expected decommission payload %q, got %q", expectedDecommissionPayload, mockRedis.queuedPayloads[0])
 	}
@@ -947,26 +1719,30 @@ func TestProcessRequest_DifferentLabID_DecommissionsAndProvisions(t *testing.T)
 	if state.ServerID != "new-server-456" {
 		t.Errorf("expected new ServerID 'new-server-456', got %s", state.ServerID)
 	}
+	if state.CorrelationID != "req-99" {
+		t.Errorf("expected correlation ID req-99 in cached state, got %q", state.CorrelationID)
+	}
 	if state.LabID != 99 {
 		t.Errorf("expected new LabID 99, got %d", state.LabID)
 	}
 }
 
-func TestProcessRequest_CacheReadRetry_Success(t *testing.T) {
+func TestProcessRequest_AdmissionRetry_Success(t *testing.T) {
 	log := newTestLogger()
 
 	callCount := 0
 	mockRedis := &mockRedisClient{
 		states: make(map[string]redis.ServerState),
-		getServerStateFunc: func(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
-			callCount++
-			if callCount < 2 {
-				// First call fails with connection error
-				return nil, errors.New("redis connection error")
-			}
-			// Second call succeeds - no server found
-			return nil, fmt.Errorf("server state not found in cache")
-		},
+	}
+	mockRedis.admitProvisionFunc = func(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+		callCount++
+		if callCount < 2 {
+			// First call fails with connection error
+			return nil, errors.New("redis connection error")
+		}
+		// Second call succeeds - no server found
+		mockRedis.states[cacheKey] = state
+		return &redis.AdmissionResult{Decision: redis.AdmissionAccepted}, nil
 	}
 
 	mockSrv := &mockServer{
@@ -988,11 +1764,10 @@ func TestProcessRequest_CacheReadRetry_Success(t *testing.T) {
 
 	// Verify retry was attempted (callCount should be 2)
 	if callCount != 2 {
-		t.Errorf("expected 2 GetServerState calls (1 failure + 1 success), got %d", callCount)
+		t.Errorf("expected 2 AdmitProvision calls (1 failure + 1 success), got %d", callCount)
 	}
 
 	// Verify provisioning proceeded after successful retry
-	// Check directly in the states map since getServerStateFunc is still set
 	cacheKey := redis.ServerCacheKey("user-123")
 	state, ok := mockRedis.states[cacheKey]
 	if !ok {
@@ -1003,12 +1778,12 @@ func TestProcessRequest_CacheReadRetry_Success(t *testing.T) {
 	}
 }
 
-func TestProcessRequest_CacheReadRetry_AllFail(t *testing.T) {
+func TestProcessRequest_AdmissionRetry_AllFail(t *testing.T) {
 	log := newTestLogger()
 
 	callCount := 0
 	mockRedis := &mockRedisClient{
-		getServerStateFunc: func(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+		admitProvisionFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
 			callCount++
 			// All retries fail with connection error
 			return nil, errors.New("redis connection error")
@@ -1024,19 +1799,128 @@ func TestProcessRequest_CacheReadRetry_AllFail(t *testing.T) {
 	}
 
 	p := New(log, mockConn, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p.redisRetry.InitialDelay = time.Millisecond
 	ctx := context.Background()
 
 	payload := `{"webuserid":"user-123","labId":42}`
 	p.ProcessRequest(ctx, payload)
 
-	// Verify all retry attempts were made (config.CacheReadRetryAttempts = 3)
-	if callCount != config.CacheReadRetryAttempts {
-		t.Errorf("expected %d GetServerState calls (all retries), got %d", config.CacheReadRetryAttempts, callCount)
+	// Verify all retry attempts were made (redis-call policy: 3 attempts)
+	if callCount != p.redisRetry.MaxAttempts {
+		t.Errorf("expected %d AdmitProvision calls (all retries), got %d", p.redisRetry.MaxAttempts, callCount)
 	}
 
 	// Verify provisioning was aborted
 	if createCalled {
-		t.Error("expected CreateServer to not be called when cache read retries exhausted")
+		t.Error("expected CreateServer to not be called when admission retries exhausted")
+	}
+}
+
+func TestProcessRequest_CreateRetry(t *testing.T) {
+	log := newTestLogger()
+	mockRedis := &mockRedisClient{states: make(map[string]redis.ServerState)}
+	mockSrv := &mockServer{id: "server-123", name: "test-server", ipv6Address: "2001:db8::1", state: "running"}
+
+	calls := 0
+	mockConn := &mockConnector{
+		createServerFunc: func(payload string) (connector.Server, error) {
+			calls++
+			if calls == 1 {
+				return nil, connector.NewError(connector.CodeRateLimited, errors.New("rate limit exceeded"))
+			}
+			return mockSrv, nil
+		},
+	}
+
+	p := New(log, mockConn, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p.createRetry.InitialDelay = time.Millisecond
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if calls != 2 {
+		t.Errorf("expected the throttled creation to be retried once, got %d calls", calls)
+	}
+	if state := mockRedis.states[redis.ServerCacheKey("user-123")]; state.ServerID != "server-123" {
+		t.Errorf("expected the server to be cached after the retry, got %+v", state)
+	}
+
+	// Other failures may have created a server, so they are not retried
+	calls = 0
+	mockConn.createServerFunc = func(payload string) (connector.Server, error) {
+		calls++
+		return nil, errors.New("internal server error")
+	}
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-456","labId":42}`)
+	if calls != 1 {
+		t.Errorf("expected no retry of an unclassified error, got %d calls", calls)
+	}
+}
+
+// fakeCreateLimiter hands out the waits in order, then tokens
+type fakeCreateLimiter struct {
+	waits []time.Duration
+	err   error
+	takes int
+}
+
+func (f *fakeCreateLimiter) TakeCreateToken(ctx context.Context, rate float64, burst int) (time.Duration, error) {
+	f.takes++
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(f.waits) == 0 {
+		return 0, nil
+	}
+	wait := f.waits[0]
+	f.waits = f.waits[1:]
+	return wait, nil
+}
+
+func TestProcessRequest_CreateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter *fakeCreateLimiter
+		takes   int
+	}{
+		{name: "token available", limiter: &fakeCreateLimiter{}, takes: 1},
+		{name: "waits for a token", limiter: &fakeCreateLimiter{waits: []time.Duration{time.Millisecond, time.Millisecond}}, takes: 3},
+		{name: "bucket unreadable", limiter: &fakeCreateLimiter{err: errors.New("connection refused")}, takes: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var takesAtCreate []int
+			mockConn := &mockConnector{
+				createServerFunc: func(payload string) (connector.Server, error) {
+					takesAtCreate = append(takesAtCreate, tt.limiter.takes)
+					return &mockServer{id: "server-123", state: "running"}, nil
+				},
+			}
+
+			p := New(newTestLogger(), mockConn, &mockRedisClient{}).WithPollInterval(1*time.Millisecond).
+				WithCreateLimit(tt.limiter, 5, 10)
+			p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+			if len(takesAtCreate) != 1 || takesAtCreate[0] != tt.takes {
+				t.Errorf("expected one creation after %d token requests, got %v", tt.takes, takesAtCreate)
+			}
+		})
+	}
+
+	// A cancelled wait gives up without creating a server
+	ctx, cancel := context.WithCancel(context.Background())
+	created := false
+	mockConn := &mockConnector{
+		createServerFunc: func(payload string) (connector.Server, error) {
+			created = true
+			return nil, errors.New("should not be called")
+		},
+	}
+	limiter := &fakeCreateLimiter{waits: []time.Duration{time.Hour}}
+	p := New(newTestLogger(), mockConn, &mockRedisClient{}).WithCreateLimit(limiter, 5, 10)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":42}`)
+	if created {
+		t.Error("expected no creation once the wait for a token was cancelled")
 	}
 }
 
@@ -1088,23 +1972,667 @@ func TestProcessRequest_DifferentLabID_QueueDecommissionFails(t *testing.T) {
 	}
 }
 
-func TestGetServerStateWithRetry_NotFoundIsNotError(t *testing.T) {
+func TestProcessRequest_CompletedProvisionNotInFlight(t *testing.T) {
 	log := newTestLogger()
-	mockRedis := &mockRedisClient{
-		states: map[string]redis.ServerState{},
+	mockRedis := &mockRedisClient{}
+	mockSrv := &mockServer{id: "server-123", stateSequence: []string{"starting", "running"}}
+
+	p := New(log, &mockConnector{server: mockSrv}, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if entries := p.InFlight(); len(entries) != 0 {
+		t.Errorf("expected no in-flight provisions after completion, got %d", len(entries))
 	}
+}
 
-	p := New(log, nil, mockRedis)
-	ctx := context.Background()
+func TestProcessRequest_CancelledProvisionKeptForHandoff(t *testing.T) {
+	log := newTestLogger()
+	mockRedis := &mockRedisClient{}
+	mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", state: "starting"} // Never reaches "running"
+
+	p := New(log, &mockConnector{server: mockSrv}, mockRedis).WithPollInterval(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	p.ProcessRequest(ctx, `{"webuserid":"user-123","labId":42}`)
+
+	entries := p.InFlight()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 in-flight provision after cancellation, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.CacheKey != redis.ServerCacheKey("user-123") {
+		t.Errorf("expected cache key for user-123, got %s", entry.CacheKey)
+	}
+	if entry.ServerID != "server-123" {
+		t.Errorf("expected server ID server-123, got %s", entry.ServerID)
+	}
+	if entry.CloudStatus != "starting" {
+		t.Errorf("expected cloud status starting, got %s", entry.CloudStatus)
+	}
+	if entry.State.LabID != 42 || entry.State.Address != "2001:db8::1" {
+		t.Errorf("expected tracked state for lab 42 with address, got %+v", entry.State)
+	}
+	if mockSrv.deleteCalled {
+		t.Error("server should not be deleted when provisioning is interrupted by shutdown")
+	}
+}
+
+func TestResume_PollsHandedOffServerToRunning(t *testing.T) {
+	log := newTestLogger()
+	mockRedis := &mockRedisClient{}
+	mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", state: "starting"}
+
+	cacheKey := redis.ServerCacheKey("user-123")
+	entry := redis.HandoffEntry{
+		CacheKey:    cacheKey,
+		ServerID:    "server-123",
+		CloudStatus: "starting",
+		State: redis.ServerState{
+			Status:    config.StatusProvisioning,
+			ServerID:  "server-123",
+			WebUserID: "user-123",
+			LabID:     42,
+		},
+		InstanceID: "old-instance",
+	}
+
+	p := New(log, &mockConnector{server: mockSrv}, mockRedis).WithPollInterval(1 * time.Millisecond)
+
+	// Same cloud state as handed off: the first poll still writes the cache
+	mockSrv.stateSequence = []string{"starting", "running"}
+	p.Resume(context.Background(), entry)
+
+	state, err := mockRedis.GetServerState(context.Background(), cacheKey)
+	if err != nil {
+		t.Fatalf("expected state to be cached, got error: %v", err)
+	}
+	if state.Status != config.StatusRunning || !state.Available {
+		t.Errorf("expected running and available, got status=%s available=%v", state.Status, state.Available)
+	}
+	if entries := p.InFlight(); len(entries) != 0 {
+		t.Errorf("expected no in-flight provisions after resume completed, got %d", len(entries))
+	}
+}
+
+func TestResume_ServerNotFound(t *testing.T) {
+	log := newTestLogger()
+	mockRedis := &mockRedisClient{}
+
+	p := New(log, &mockConnector{}, mockRedis).WithPollInterval(1 * time.Millisecond)
+	p.Resume(context.Background(), redis.HandoffEntry{CacheKey: redis.ServerCacheKey("user-123"), ServerID: "gone"})
+
+	if len(mockRedis.states) != 0 {
+		t.Error("expected no cache writes for a handed-off server that no longer exists")
+	}
+	if entries := p.InFlight(); len(entries) != 0 {
+		t.Errorf("expected nothing tracked, got %d", len(entries))
+	}
+}
+
+func TestReconcilePendingCreate(t *testing.T) {
+	cacheKey := redis.ServerCacheKey("user-123")
+	pending := redis.PendingCreate{Name: "lab-42-abc", WebUserID: "user-123", LabID: 42, InstanceID: "dead-instance"}
+
+	tests := []struct {
+		name         string
+		server       *mockServer
+		labelErr     error
+		cached       *redis.ServerState
+		expectAdopt  bool
+		expectDelete bool
+		expectErr    bool
+	}{
+		{
+			name: "server never created",
+		},
+		{
+			name:     "provider error keeps the entry",
+			labelErr: errors.New("api unavailable"),
+			cached:   &redis.ServerState{Status: config.StatusProvisioning, LabID: 42},
+			// An outage must not look like a server that was never created
+			expectErr: true,
+		},
+		{
+			name:   "server already cached",
+			server: &mockServer{id: "server-1", name: "lab-42-abc"},
+			cached: &redis.ServerState{Status: config.StatusRunning, ServerID: "server-1", LabID: 42},
+		},
+		{
+			name:        "interrupted provision is adopted",
+			server:      &mockServer{id: "server-1", name: "lab-42-abc", ipv6Address: "2001:db8::1"},
+			cached:      &redis.ServerState{Status: config.StatusProvisioning, LabID: 42},
+			expectAdopt: true,
+		},
+		{
+			name:         "server without cache entry is deleted",
+			server:       &mockServer{id: "server-1", name: "lab-42-abc"},
+			expectDelete: true,
+		},
+		{
+			name:         "cache entry for another lab is not adopted",
+			server:       &mockServer{id: "server-1", name: "lab-42-abc"},
+			cached:       &redis.ServerState{Status: config.StatusProvisioning, LabID: 7},
+			expectDelete: true,
+		},
+		{
+			name:         "failed delete keeps the entry",
+			server:       &mockServer{id: "server-1", name: "lab-42-abc", deleteErr: errors.New("api error")},
+			expectDelete: true,
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRedis := &mockRedisClient{states: make(map[string]redis.ServerState)}
+			if tt.cached != nil {
+				mockRedis.states[cacheKey] = *tt.cached
+			}
+			mockConn := &mockConnector{labelErr: tt.labelErr}
+			if tt.server != nil {
+				mockConn.labelServers = []connector.Server{&mockServer{id: "other", name: "lab-1-zzz"}, tt.server}
+			}
+
+			alerts := &recordingChannel{}
+			notifier := notify.NewNotifier(map[string]notify.Channel{notify.ChannelWebhook: alerts}, nil, time.Minute, time.Second)
+			p := New(newTestLogger(), mockConn, mockRedis).WithNotifier(notifier)
+			entry, err := p.ReconcilePendingCreate(context.Background(), pending)
+
+			if tt.expectErr != (err != nil) {
+				t.Fatalf("expected error=%v, got %v", tt.expectErr, err)
+			}
+			if tt.expectAdopt != (entry != nil) {
+				t.Fatalf("expected adopt=%v, got entry %+v", tt.expectAdopt, entry)
+			}
+			if entry != nil {
+				if entry.CacheKey != cacheKey || entry.State.ServerID != "server-1" || entry.State.Address != "2001:db8::1" {
+					t.Errorf("unexpected adoption entry: %+v", entry)
+				}
+			}
+			if tt.server != nil && tt.server.deleteCalled != tt.expectDelete {
+				t.Errorf("expected delete=%v, got %v", tt.expectDelete, tt.server.deleteCalled)
+			}
+			if tt.expectDelete != (len(alerts.sent) == 1) {
+				t.Errorf("expected orphan notification=%v, got %+v", tt.expectDelete, alerts.sent)
+			} else if tt.expectDelete && alerts.sent[0].Event != notify.EventOrphanFound {
+				t.Errorf("expected orphan_found notification, got %+v", alerts.sent[0])
+			}
+		})
+	}
+}
+
+// fakeDNSProvider keeps AAAA records in memory
+type fakeDNSProvider struct {
+	records map[string]string
+}
+
+func (f *fakeDNSProvider) UpsertAAAA(ctx context.Context, fqdn string, ipv6 string, ttl int) error {
+	f.records[fqdn] = ipv6
+	return nil
+}
 
-	cacheKey := redis.ServerCacheKey("nonexistent-user")
-	state, err := p.getServerStateWithRetry(ctx, cacheKey)
+func (f *fakeDNSProvider) DeleteAAAA(ctx context.Context, fqdn string) error {
+	delete(f.records, fqdn)
+	return nil
+}
+
+func TestProcessRequest_RegistersDNS(t *testing.T) {
+	mockRedis := &mockRedisClient{}
+	mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"running"}}
+	provider := &fakeDNSProvider{records: make(map[string]string)}
+	registrar := dns.NewRegistrar(provider, "labs.example.com", "secret", 0)
+
+	p := New(newTestLogger(), &mockConnector{server: mockSrv}, mockRedis).
+		WithPollInterval(1 * time.Millisecond).
+		WithDNS(registrar)
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	state, err := mockRedis.GetServerState(context.Background(), redis.ServerCacheKey("user-123"))
+	if err != nil {
+		t.Fatalf("expected state to be cached, got error: %v", err)
+	}
+	expected := registrar.Hostname("user-123", 42)
+	if state.Hostname != expected {
+		t.Errorf("expected hostname %q, got %q", expected, state.Hostname)
+	}
+	if provider.records[expected] != "2001:db8::1" {
+		t.Errorf("expected AAAA record for %s, got %v", expected, provider.records)
+	}
+}
+
+func TestHandleProvisioningError_UnregistersDNS(t *testing.T) {
+	provider := &fakeDNSProvider{records: map[string]string{"lab42-abc.labs.example.com": "2001:db8::1"}}
+	registrar := dns.NewRegistrar(provider, "labs.example.com", "secret", 0)
+
+	p := New(newTestLogger(), &mockConnector{}, &mockRedisClient{}).WithDNS(registrar)
+	p.handleProvisioningError(context.Background(), &mockServer{id: "server-123"}, redis.ServerCacheKey("user-123"),
+		redis.ServerState{Hostname: "lab42-abc.labs.example.com"}, "polling failed", errors.New("boom"))
+
+	if len(provider.records) != 0 {
+		t.Errorf("expected dns record to be removed, got %v", provider.records)
+	}
+}
 
-	// Should return (nil, nil) for "not found" - not an error
+// inventoryCalls runs an inventory hook against a test server and returns the bodies it receives
+func inventoryCalls(t *testing.T) (*inventory.Hook, <-chan string) {
+	t.Helper()
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	hook, err := inventory.New(slog.New(slog.NewTextHandler(io.Discard, nil)), inventory.Config{Register: inventory.Call{URL: srv.URL}})
 	if err != nil {
-		t.Errorf("expected no error for non-existent cache key, got: %v", err)
+		t.Fatalf("inventory.New failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hook.Run(ctx)
+	return hook, bodies
+}
+
+// expectInventoryCall waits for the next inventory call and checks it is event for serverID
+func expectInventoryCall(t *testing.T, bodies <-chan string, event, serverID string) {
+	t.Helper()
+	select {
+	case body := <-bodies:
+		if !strings.Contains(body, `"event":"`+event+`"`) || !strings.Contains(body, `"serverId":"`+serverID+`"`) {
+			t.Errorf("expected %s of %s, got %s", event, serverID, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the %s call", event)
 	}
-	if state != nil {
-		t.Errorf("expected nil state for non-existent cache key, got: %+v", state)
+}
+
+func TestProcessRequest_RegistersInventory(t *testing.T) {
+	hook, bodies := inventoryCalls(t)
+	mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"running"}}
+
+	New(newTestLogger(), &mockConnector{server: mockSrv}, &mockRedisClient{}).WithPollInterval(time.Millisecond).
+		WithInventory(hook).ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+	expectInventoryCall(t, bodies, inventory.EventRegister, "server-123")
+
+	// A server deleted after a failed provision is deregistered again
+	p := New(newTestLogger(), &mockConnector{}, &mockRedisClient{}).WithInventory(hook)
+	p.handleProvisioningError(context.Background(), mockSrv, redis.ServerCacheKey("user-123"),
+		redis.ServerState{}, "polling failed", errors.New("boom"))
+	expectInventoryCall(t, bodies, inventory.EventDeregister, "server-123")
+}
+
+// recordingHook remembers the events it ran for
+type recordingHook struct {
+	events []string
+}
+
+func (h *recordingHook) Run(ctx context.Context, event string, state redis.ServerState, payload []byte) error {
+	h.events = append(h.events, fmt.Sprintf("%s:%s:%t", event, state.ServerID, state.Available))
+	return nil
+}
+
+func TestProcessRequest_RunsAvailableHooks(t *testing.T) {
+	mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"starting", "initializing", "running"}}
+	hook := &recordingHook{}
+
+	p := New(newTestLogger(), &mockConnector{server: mockSrv}, &mockRedisClient{}).
+		WithPollInterval(1 * time.Millisecond).
+		WithHooks(hooks.NewRunner(time.Second, hook))
+	p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+	if len(hook.events) != 1 || hook.events[0] != "available:server-123:true" {
+		t.Errorf("expected one available hook once the server is running, got %v", hook.events)
+	}
+}
+
+// fakeWarmUpExecutor records the state cached while the warm-up runs
+type fakeWarmUpExecutor struct {
+	redis   *mockRedisClient
+	cached  []redis.ServerState
+	hostKey string
+	err     error
+}
+
+func (f *fakeWarmUpExecutor) Run(ctx context.Context, address string, hostKey string, command string) error {
+	if state, err := f.redis.GetServerState(ctx, redis.ServerCacheKey("user-123")); err == nil {
+		f.cached = append(f.cached, *state)
+	}
+	f.hostKey = hostKey
+	return f.err
+}
+
+func TestProcessRequest_WarmUp(t *testing.T) {
+	catalog := warmup.Catalog{42: {Command: "docker pull lab42"}}
+
+	t.Run("available only after warm-up", func(t *testing.T) {
+		mockRedis := &mockRedisClient{}
+		mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", sshHostKey: "ssh-ed25519 AAAA", stateSequence: []string{"running"}}
+		executor := &fakeWarmUpExecutor{redis: mockRedis}
+
+		p := New(newTestLogger(), &mockConnector{server: mockSrv}, mockRedis).
+			WithPollInterval(1 * time.Millisecond).
+			WithWarmUp(warmup.NewRunner(executor, catalog, time.Second))
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+		if len(executor.cached) != 1 || executor.cached[0].Available {
+			t.Fatalf("expected one warm-up on an unavailable server, got %+v", executor.cached)
+		}
+		if executor.hostKey != "ssh-ed25519 AAAA" {
+			t.Errorf("expected warm-up to pin the host key, got %q", executor.hostKey)
+		}
+		state, err := mockRedis.GetServerState(context.Background(), redis.ServerCacheKey("user-123"))
+		if err != nil {
+			t.Fatalf("expected state to be cached, got error: %v", err)
+		}
+		if !state.Available || state.Status != config.StatusRunning {
+			t.Errorf("expected server available after warm-up, got %+v", state)
+		}
+	})
+
+	t.Run("failure deletes the server", func(t *testing.T) {
+		mockRedis := &mockRedisClient{}
+		mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"running"}}
+		executor := &fakeWarmUpExecutor{redis: mockRedis, err: errors.New("exit status 1")}
+
+		p := New(newTestLogger(), &mockConnector{server: mockSrv}, mockRedis).
+			WithPollInterval(1 * time.Millisecond).
+			WithWarmUp(warmup.NewRunner(executor, catalog, time.Second))
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+		if !mockSrv.deleteCalled {
+			t.Error("expected server to be deleted after failed warm-up")
+		}
+		if _, err := mockRedis.GetServerState(context.Background(), redis.ServerCacheKey("user-123")); err == nil {
+			t.Error("expected cache entry to be removed after failed warm-up")
+		}
+	})
+
+	t.Run("labs without warm-up skip it", func(t *testing.T) {
+		mockRedis := &mockRedisClient{}
+		mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"running"}}
+		executor := &fakeWarmUpExecutor{redis: mockRedis}
+
+		p := New(newTestLogger(), &mockConnector{server: mockSrv}, mockRedis).
+			WithPollInterval(1 * time.Millisecond).
+			WithWarmUp(warmup.NewRunner(executor, catalog, time.Second))
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":7}`)
+
+		if len(executor.cached) != 0 {
+			t.Errorf("expected no warm-up for lab 7, got %d runs", len(executor.cached))
+		}
+	})
+}
+
+// recordingEvents remembers the events recorded for the dashboard
+type recordingEvents struct {
+	events []redis.Event
+}
+
+func (r *recordingEvents) RecordEvent(ctx context.Context, event redis.Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestProcessRequest_RecordsEvents(t *testing.T) {
+	t.Run("rate limited", func(t *testing.T) {
+		events := &recordingEvents{}
+		mockRedis := &mockRedisClient{
+			admitProvisionFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+				return &redis.AdmissionResult{Decision: redis.AdmissionRateLimited}, nil
+			},
+		}
+
+		p := New(newTestLogger(), &mockConnector{}, mockRedis).WithEvents(events)
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+		if len(events.events) != 1 || events.events[0].Type != redis.EventRateLimited ||
+			events.events[0].Operation != "provision" || events.events[0].WebUserID != "user-123" {
+			t.Errorf("expected one rate-limit event, got %+v", events.events)
+		}
+	})
+
+	t.Run("create failure", func(t *testing.T) {
+		events := &recordingEvents{}
+		alerts := &recordingChannel{}
+		notifier := notify.NewNotifier(map[string]notify.Channel{notify.ChannelSlack: alerts}, nil, time.Minute, time.Second)
+		p := New(newTestLogger(), &mockConnector{createErr: errors.New("quota exceeded")}, &mockRedisClient{}).
+			WithEvents(events).
+			WithNotifier(notifier)
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+		if len(events.events) != 1 || events.events[0].Type != redis.EventProvisionFailed ||
+			events.events[0].LabID != 42 || !strings.Contains(events.events[0].Message, "quota exceeded") {
+			t.Errorf("expected one provision failure event, got %+v", events.events)
+		}
+		if len(alerts.sent) != 1 || alerts.sent[0].Message != "user user-123, lab 42: quota exceeded" {
+			t.Errorf("expected one provision failure notification, got %+v", alerts.sent)
+		}
+	})
+}
+
+// recordingHistory remembers the history events by tenant-scoped user ID
+type recordingHistory map[string][]redis.Event
+
+func (r recordingHistory) RecordHistory(ctx context.Context, userID string, event redis.Event) error {
+	r[userID] = append(r[userID], event)
+	return nil
+}
+
+func TestProcessRequest_RecordsHistory(t *testing.T) {
+	t.Run("provisioned", func(t *testing.T) {
+		mockSrv := &mockServer{id: "server-123", ipv6Address: "2001:db8::1", stateSequence: []string{"starting", "running"}}
+		history := recordingHistory{}
+
+		p := New(newTestLogger(), &mockConnector{server: mockSrv}, &mockRedisClient{}).
+			WithPollInterval(1 * time.Millisecond).
+			WithHistory(history)
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42,"correlationId":"corr-1"}`)
+
+		events := history["user-123"]
+		if len(events) != 2 || events[0].Type != redis.EventProvisionStarted || events[1].Type != redis.EventAvailable {
+			t.Fatalf("expected provision_started then available, got %+v", events)
+		}
+		if events[1].ServerID != "server-123" || events[1].LabID != 42 || events[1].CorrelationID != "corr-1" {
+			t.Errorf("unexpected available event %+v", events[1])
+		}
+	})
+
+	t.Run("create failure", func(t *testing.T) {
+		history := recordingHistory{}
+		p := New(newTestLogger(), &mockConnector{createErr: errors.New("resource unavailable")}, &mockRedisClient{}).
+			WithHistory(history)
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42}`)
+
+		events := history["user-123"]
+		if len(events) != 2 || events[1].Type != redis.EventProvisionFailed || !strings.Contains(events[1].Message, "resource unavailable") {
+			t.Errorf("expected the failure after the start, got %+v", events)
+		}
+	})
+}
+
+// recordingChannel remembers the notifications sent to it
+type recordingChannel struct {
+	sent []notify.Notification
+}
+
+func (c *recordingChannel) Send(ctx context.Context, n notify.Notification) error {
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+// countingConnector returns a connector creating running servers, and a counter of its creations
+func countingConnector() (*mockConnector, *int) {
+	creates := 0
+	srv := &mockServer{id: "server-123", name: "test-server", ipv6Address: "2001:db8::1", state: "running"}
+	return &mockConnector{
+		server: srv,
+		createServerFunc: func(payload string) (connector.Server, error) {
+			creates++
+			return srv, nil
+		},
+	}, &creates
+}
+
+func TestProcessRequest_Tenants(t *testing.T) {
+	registry, err := tenant.NewRegistry(map[string]tenant.Tenant{
+		"cs101": {MaxServers: 2, Labs: []int{42, 43}},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+
+	t.Run("scoped cache key", func(t *testing.T) {
+		mockRedis := &mockRedisClient{}
+		mockConn, _ := countingConnector()
+		p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond).WithTenants(registry)
+		p.ProcessRequest(context.Background(), `{"webuserid":"user-123","labId":42,"tenant":"cs101"}`)
+
+		state, ok := mockRedis.states["vmmanager:servers:cs101:user-123"]
+		if !ok {
+			t.Fatalf("expected state under the tenant-scoped key, got %v", mockRedis.states)
+		}
+		if state.Tenant != "cs101" || state.WebUserID != "user-123" {
+			t.Errorf("expected tenant and plain user ID in state, got %+v", state)
+		}
+	})
+
+	t.Run("rejected requests", func(t *testing.T) {
+		for name, payload := range map[string]string{
+			"unknown tenant":     `{"webuserid":"user-123","labId":42,"tenant":"cs202"}`,
+			"lab not in catalog": `{"webuserid":"user-123","labId":7,"tenant":"cs101"}`,
+		} {
+			events := &recordingEvents{}
+			mockConn, creates := countingConnector()
+			mockRedis := &mockRedisClient{}
+			New(newTestLogger(), mockConn, mockRedis).WithTenants(registry).WithEvents(events).
+				ProcessRequest(context.Background(), payload)
+
+			if *creates != 0 || len(mockRedis.states) != 0 {
+				t.Errorf("%s: expected no server and no state, got %d creations", name, *creates)
+			}
+			if len(events.events) != 1 || events.events[0].Type != redis.EventProvisionFailed {
+				t.Errorf("%s: expected one provision failure event, got %+v", name, events.events)
+			}
+		}
+	})
+
+	t.Run("quota reached", func(t *testing.T) {
+		mockRedis := &mockRedisClient{states: map[string]redis.ServerState{
+			"vmmanager:servers:cs101:alice": {WebUserID: "alice", LabID: 42, Tenant: "cs101"},
+			"vmmanager:servers:cs101:bob":   {WebUserID: "bob", LabID: 42, Tenant: "cs101"},
+			"vmmanager:servers:carol":       {WebUserID: "carol", LabID: 42},
+		}}
+		events := &recordingEvents{}
+		mockConn, creates := countingConnector()
+		p := New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond).WithTenants(registry).WithEvents(events)
+		p.ProcessRequest(context.Background(), `{"webuserid":"dave","labId":42,"tenant":"cs101"}`)
+
+		if *creates != 0 {
+			t.Error("expected no server to be created over the tenant quota")
+		}
+		if len(events.events) != 1 || events.events[0].Type != redis.EventRateLimited {
+			t.Errorf("expected one rate-limit event, got %+v", events.events)
+		}
+
+		// A user switching labs does not count against their own quota
+		p.ProcessRequest(context.Background(), `{"webuserid":"alice","labId":43,"tenant":"cs101"}`)
+		if *creates != 1 {
+			t.Errorf("expected the lab switch to be provisioned, got %d creations", *creates)
+		}
+	})
+}
+
+func TestProcessRequest_AdminOverride(t *testing.T) {
+	registry, err := tenant.NewRegistry(map[string]tenant.Tenant{
+		"cs101": {MaxServers: 1, Labs: []int{42}},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+	verifier := override.NewVerifier(nil, []string{"instructor"}, 0).WithSignedPayloads()
+
+	tests := []struct {
+		name        string
+		payload     string
+		created     bool
+		rateLimited bool
+	}{
+		{"granted", `{"webuserid":"bob","labId":42,"tenant":"cs101","admin":true,"adminActor":"instructor"}`, true, false},
+		{"refused", `{"webuserid":"bob","labId":42,"tenant":"cs101","admin":true,"adminActor":"student"}`, false, true},
+		{"not requested", `{"webuserid":"bob","labId":42,"tenant":"cs101"}`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var limits []redis.AdmissionLimits
+			mockRedis := &mockRedisClient{
+				states: map[string]redis.ServerState{
+					"vmmanager:servers:cs101:alice": {WebUserID: "alice", LabID: 42, Tenant: "cs101"},
+				},
+				admitProvisionFunc: func(ctx context.Context, cacheKey string, state redis.ServerState, admissionLimits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+					limits = append(limits, admissionLimits)
+					return &redis.AdmissionResult{Decision: redis.AdmissionAccepted, Version: 1}, nil
+				},
+			}
+			events := &recordingEvents{}
+			mockConn, creates := countingConnector()
+			New(newTestLogger(), mockConn, mockRedis).WithPollInterval(time.Millisecond).WithTenants(registry).
+				WithEvents(events).WithOverrides(verifier).ProcessRequest(context.Background(), tt.payload)
+
+			if created := *creates == 1; created != tt.created {
+				t.Errorf("expected created %v over the quota, got %d creations", tt.created, *creates)
+			}
+			if tt.created && (len(limits) != 1 || limits[0] != (redis.AdmissionLimits{})) {
+				t.Errorf("expected the admission to skip the rate limits, got %v", limits)
+			}
+			var types []string
+			for _, event := range events.events {
+				types = append(types, event.Type)
+			}
+			if rateLimited := slices.Contains(types, redis.EventRateLimited); rateLimited != tt.rateLimited {
+				t.Errorf("expected rate limited %v, got events %v", tt.rateLimited, types)
+			}
+			if overridden := slices.Contains(types, redis.EventAdminOverride); overridden != (tt.name != "not requested") {
+				t.Errorf("expected the override recorded when asked for, got events %v", types)
+			}
+		})
+	}
+}
+
+func TestProcessRequest_Sequence(t *testing.T) {
+	registry, err := tenant.NewRegistry(map[string]tenant.Tenant{"cs101": {}})
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		created bool
+	}{
+		{"overtaken", `{"webuserid":"bob","labId":42,"tenant":"cs101","seq":4}`, false},
+		{"duplicate", `{"webuserid":"bob","labId":42,"tenant":"cs101","seq":5}`, false},
+		{"later", `{"webuserid":"bob","labId":42,"tenant":"cs101","seq":6}`, true},
+		{"unsequenced", `{"webuserid":"bob","labId":42,"tenant":"cs101"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The decommission cleanup numbered 5 was served first
+			sequencer := redistest.New()
+			sequencer.ApplySequence(context.Background(), "cs101:bob", 5)
+
+			events := &recordingEvents{}
+			mockConn, creates := countingConnector()
+			New(newTestLogger(), mockConn, &mockRedisClient{}).WithPollInterval(time.Millisecond).WithTenants(registry).
+				WithEvents(events).WithSequencer(sequencer).ProcessRequest(context.Background(), tt.payload)
+
+			if created := *creates == 1; created != tt.created {
+				t.Errorf("expected created %v, got %d creations", tt.created, *creates)
+			}
+			dropped := len(events.events) == 1 && events.events[0].Type == redis.EventOutOfOrder
+			if dropped == tt.created {
+				t.Errorf("expected an out-of-order event only for a dropped request, got %v", events.events)
+			}
+		})
 	}
 }
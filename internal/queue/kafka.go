@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// kafkaBackend consumes queues from Kafka topics as a member of a consumer group
+type kafkaBackend struct {
+	brokers []string
+	groupID string
+	writer  *kafka.Writer
+
+	mu      sync.Mutex
+	readers map[string]*kafka.Reader
+}
+
+func newKafkaBackend(cfg Config) (*kafkaBackend, error) {
+	if len(cfg.KafkaBrokers) == 0 {
+		return nil, fmt.Errorf("at least one broker is required for the kafka queue backend")
+	}
+	if cfg.KafkaGroupID == "" {
+		return nil, fmt.Errorf("consumer group ID is required for the kafka queue backend")
+	}
+
+	return &kafkaBackend{
+		brokers: cfg.KafkaBrokers,
+		groupID: cfg.KafkaGroupID,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Balancer:     &kafka.LeastBytes{},
+			RequiredAcks: kafka.RequireAll,
+		},
+		readers: make(map[string]*kafka.Reader),
+	}, nil
+}
+
+// reader returns the group reader for a queue, creating it on first use
+func (b *kafkaBackend) reader(queueKey string) *kafka.Reader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r, ok := b.readers[queueKey]; ok {
+		return r
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: b.brokers,
+		GroupID: b.groupID,
+		Topic:   topicName(queueKey),
+	})
+	b.readers[queueKey] = r
+	return r
+}
+
+// PopPayload reads a single message, waiting up to timeout.
+// The offset is committed on receipt, matching the at-most-once semantics of BLPOP.
+func (b *kafkaBackend) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	readCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	msg, err := b.reader(queueKey).ReadMessage(readCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return "", errs.New("no message received", errs.ErrNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to pop from queue: %w", err)
+	}
+
+	return string(msg.Value), nil
+}
+
+// PushPayload writes a payload to the queue topic
+func (b *kafkaBackend) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	return b.PushPayloads(ctx, queueKey, []string{payload})
+}
+
+// PushPayloads writes several payloads in one batch
+func (b *kafkaBackend) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	topic := topicName(queueKey)
+	msgs := make([]kafka.Message, len(payloads))
+	for i, payload := range payloads {
+		msgs[i] = kafka.Message{Topic: topic, Value: []byte(payload)}
+	}
+
+	if err := b.writer.WriteMessages(ctx, msgs...); err != nil {
+		return fmt.Errorf("failed to push to queue: %w", err)
+	}
+	return nil
+}
+
+// Close closes the writer and all readers
+func (b *kafkaBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	errs := []error{b.writer.Close()}
+	for _, r := range b.readers {
+		errs = append(errs, r.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// natsBackend consumes queues from NATS JetStream using one durable pull consumer per queue
+type natsBackend struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	stream jetstream.Stream
+
+	mu        sync.Mutex
+	consumers map[string]jetstream.Consumer
+}
+
+func newNATSBackend(ctx context.Context, cfg Config) (*natsBackend, error) {
+	if cfg.NATSURL == "" {
+		return nil, fmt.Errorf("NATS URL is required for the nats queue backend")
+	}
+	if cfg.NATSStream == "" {
+		return nil, fmt.Errorf("NATS stream is required for the nats queue backend")
+	}
+
+	conn, err := nats.Connect(cfg.NATSURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	// Use an existing stream if ops already provisioned one
+	stream, err := js.Stream(ctx, cfg.NATSStream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:      cfg.NATSStream,
+			Subjects:  []string{natsStreamSubjects()},
+			Retention: jetstream.WorkQueuePolicy,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open stream %s: %w", cfg.NATSStream, err)
+	}
+
+	return &natsBackend{
+		conn:      conn,
+		js:        js,
+		stream:    stream,
+		consumers: make(map[string]jetstream.Consumer),
+	}, nil
+}
+
+// consumer returns the durable consumer for a queue, creating it on first use
+func (b *natsBackend) consumer(ctx context.Context, queueKey string) (jetstream.Consumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if cons, ok := b.consumers[queueKey]; ok {
+		return cons, nil
+	}
+
+	cons, err := b.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       "swim-" + strings.ReplaceAll(queueKey, ":", "-"),
+		FilterSubject: topicName(queueKey),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer for %s: %w", queueKey, err)
+	}
+
+	b.consumers[queueKey] = cons
+	return cons, nil
+}
+
+// PopPayload fetches a single message, waiting up to timeout.
+// The message is acknowledged on receipt, matching the at-most-once semantics of BLPOP.
+func (b *natsBackend) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	cons, err := b.consumer(ctx, queueKey)
+	if err != nil {
+		return "", err
+	}
+
+	batch, err := cons.Fetch(1, jetstream.FetchMaxWait(timeout))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch from queue: %w", err)
+	}
+
+	for msg := range batch.Messages() {
+		if err := msg.Ack(); err != nil {
+			return "", fmt.Errorf("failed to ack message: %w", err)
+		}
+		return string(msg.Data()), nil
+	}
+
+	if err := batch.Error(); err != nil {
+		return "", fmt.Errorf("failed to fetch from queue: %w", err)
+	}
+	return "", errs.New("no message received", errs.ErrNotFound)
+}
+
+// PushPayload publishes a payload to the queue subject
+func (b *natsBackend) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	if _, err := b.js.Publish(ctx, topicName(queueKey), []byte(payload)); err != nil {
+		return fmt.Errorf("failed to push to queue: %w", err)
+	}
+	return nil
+}
+
+// PushPayloads publishes several payloads in order
+func (b *natsBackend) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	for _, payload := range payloads {
+		if err := b.PushPayload(ctx, queueKey, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close drains the NATS connection
+func (b *natsBackend) Close() error {
+	return b.conn.Drain()
+}
+
+// natsStreamSubjects returns the subjects of the stream SWIM creates when it has to: every
+// queue in the key namespace
+func natsStreamSubjects() string {
+	return config.KeyNamespace() + ".>"
+}
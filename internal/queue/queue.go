@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Supported queue backends
+const (
+	BackendRedis = "redis"
+	BackendNATS  = "nats"
+	BackendKafka = "kafka"
+)
+
+// Backend defines the queue operations SWIM needs.
+// *redis.Client satisfies it directly, so the Redis lists remain the default transport.
+type Backend interface {
+	PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error)
+	PushPayload(ctx context.Context, queueKey string, payload string) error
+	PushPayloads(ctx context.Context, queueKey string, payloads []string) error
+	Close() error
+}
+
+// Config contains queue backend settings
+type Config struct {
+	Backend      string   // redis, nats or kafka
+	NATSURL      string   // NATS server URL (nats backend)
+	NATSStream   string   // JetStream stream holding the queue subjects (nats backend)
+	KafkaBrokers []string // Kafka bootstrap brokers (kafka backend)
+	KafkaGroupID string   // Kafka consumer group (kafka backend)
+}
+
+// New creates the configured queue backend.
+// Returns nil for the redis backend: queue operations then stay on the Redis client.
+func New(ctx context.Context, cfg Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", BackendRedis:
+		return nil, nil
+	case BackendNATS:
+		b, err := newNATSBackend(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	case BackendKafka:
+		b, err := newKafkaBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", cfg.Backend)
+	}
+}
+
+// WithBackend returns a client that sends queue operations to backend and
+// everything else (server state cache, rate limits) to cache.
+// The caller keeps ownership of both and closes them separately.
+func WithBackend(cache redis.ClientInterface, backend Backend) redis.ClientInterface {
+	return &routedClient{ClientInterface: cache, backend: backend}
+}
+
+// routedClient overrides the queue methods of a redis client
+type routedClient struct {
+	redis.ClientInterface
+	backend Backend
+}
+
+func (c *routedClient) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	return c.backend.PopPayload(ctx, queueKey, timeout)
+}
+
+// PopAnyPayload tries queueKeys in order, giving each an equal share of timeout, since
+// the external backends can't wait on several queues at once. A payload waiting in an
+// earlier queue is still taken first.
+func (c *routedClient) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	if len(queueKeys) == 0 {
+		return "", "", fmt.Errorf("no queues to pop from")
+	}
+	wait := timeout / time.Duration(len(queueKeys))
+	var err error
+	for _, queueKey := range queueKeys {
+		var payload string
+		if payload, err = c.backend.PopPayload(ctx, queueKey, wait); err == nil {
+			return queueKey, payload, nil
+		}
+		if ctx.Err() != nil {
+			return "", "", ctx.Err()
+		}
+	}
+	return "", "", err
+}
+
+func (c *routedClient) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	return c.backend.PushPayload(ctx, queueKey, payload)
+}
+
+func (c *routedClient) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	return c.backend.PushPayloads(ctx, queueKey, payloads)
+}
+
+// topicName maps a Redis queue key to a NATS subject / Kafka topic.
+// "vmmanager:provision" becomes "vmmanager.provision".
+func topicName(queueKey string) string {
+	return strings.ReplaceAll(queueKey, ":", ".")
+}
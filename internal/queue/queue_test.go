@@ -0,0 +1,164 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// mockBackend records queue operations
+type mockBackend struct {
+	pushed map[string][]string
+	empty  map[string]bool          // queues PopPayload finds nothing in
+	waits  map[string]time.Duration // timeout of the last pop per queue
+}
+
+func (m *mockBackend) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	if m.waits != nil {
+		m.waits[queueKey] = timeout
+	}
+	if m.empty[queueKey] {
+		return "", errors.New("no message received")
+	}
+	return "from-backend:" + queueKey, nil
+}
+
+func (m *mockBackend) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	m.pushed[queueKey] = append(m.pushed[queueKey], payload)
+	return nil
+}
+
+func (m *mockBackend) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	m.pushed[queueKey] = append(m.pushed[queueKey], payloads...)
+	return nil
+}
+
+func (m *mockBackend) Close() error {
+	return nil
+}
+
+// mockCache implements only the cache methods exercised here; queue methods must never reach it
+type mockCache struct {
+	redis.ClientInterface
+	getCalls int
+}
+
+func (m *mockCache) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	m.getCalls++
+	return &redis.ServerState{WebUserID: "user1"}, nil
+}
+
+func TestWithBackend_RoutesQueueOperations(t *testing.T) {
+	backend := &mockBackend{pushed: make(map[string][]string)}
+	cache := &mockCache{}
+	client := WithBackend(cache, backend)
+	ctx := context.Background()
+
+	payload, err := client.PopPayload(ctx, "vmmanager:provision", time.Second)
+	if err != nil {
+		t.Fatalf("PopPayload failed: %v", err)
+	}
+	if payload != "from-backend:vmmanager:provision" {
+		t.Errorf("expected payload from backend, got %q", payload)
+	}
+
+	if err := client.PushPayload(ctx, "vmmanager:decommission", "a"); err != nil {
+		t.Fatalf("PushPayload failed: %v", err)
+	}
+	if err := client.PushPayloads(ctx, "vmmanager:decommission", []string{"b", "c"}); err != nil {
+		t.Fatalf("PushPayloads failed: %v", err)
+	}
+	if got := strings.Join(backend.pushed["vmmanager:decommission"], ","); got != "a,b,c" {
+		t.Errorf("expected a,b,c pushed to backend, got %q", got)
+	}
+
+	// Cache operations still go to Redis
+	if _, err := client.GetServerState(ctx, "vmmanager:servers:user1"); err != nil {
+		t.Fatalf("GetServerState failed: %v", err)
+	}
+	if cache.getCalls != 1 {
+		t.Errorf("expected cache to serve GetServerState, got %d calls", cache.getCalls)
+	}
+}
+
+func TestWithBackend_PopAnyPayload(t *testing.T) {
+	backend := &mockBackend{
+		empty: map[string]bool{"vmmanager:decommission": true},
+		waits: make(map[string]time.Duration),
+	}
+	client := WithBackend(&mockCache{}, backend)
+	ctx := context.Background()
+
+	// The first queue is empty, so the payload comes from the second; each queue gets a share of the timeout
+	queueKey, payload, err := client.PopAnyPayload(ctx, []string{"vmmanager:decommission", "vmmanager:provision", "vmmanager:undo"}, 3*time.Second)
+	if err != nil {
+		t.Fatalf("PopAnyPayload failed: %v", err)
+	}
+	if queueKey != "vmmanager:provision" || payload != "from-backend:vmmanager:provision" {
+		t.Errorf("expected payload from vmmanager:provision, got %q from %q", payload, queueKey)
+	}
+	if backend.waits["vmmanager:decommission"] != time.Second {
+		t.Errorf("expected a 1s wait per queue, got %v", backend.waits["vmmanager:decommission"])
+	}
+	if _, popped := backend.waits["vmmanager:undo"]; popped {
+		t.Error("expected later queues not to be popped once a payload was found")
+	}
+
+	backend.empty["vmmanager:provision"] = true
+	if _, _, err := client.PopAnyPayload(ctx, []string{"vmmanager:decommission", "vmmanager:provision"}, time.Second); err == nil {
+		t.Error("expected an error when every queue is empty")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         Config
+		expectErr   bool
+		expectNilBk bool
+	}{
+		{name: "default is redis", cfg: Config{}, expectNilBk: true},
+		{name: "explicit redis", cfg: Config{Backend: BackendRedis}, expectNilBk: true},
+		{name: "unknown backend", cfg: Config{Backend: "rabbitmq"}, expectErr: true},
+		{name: "nats without URL", cfg: Config{Backend: BackendNATS, NATSStream: "VMMANAGER"}, expectErr: true},
+		{name: "kafka without brokers", cfg: Config{Backend: BackendKafka, KafkaGroupID: "swim"}, expectErr: true},
+		{name: "kafka without group", cfg: Config{Backend: BackendKafka, KafkaBrokers: []string{"localhost:9092"}}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := New(context.Background(), tt.cfg)
+			if tt.expectErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				if backend != nil {
+					t.Error("expected nil backend on error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expectNilBk && backend != nil {
+				t.Errorf("expected nil backend, got %T", backend)
+			}
+		})
+	}
+}
+
+func TestTopicName(t *testing.T) {
+	tests := map[string]string{
+		"vmmanager:provision":    "vmmanager.provision",
+		"vmmanager:decommission": "vmmanager.decommission",
+	}
+	for queueKey, expected := range tests {
+		if got := topicName(queueKey); got != expected {
+			t.Errorf("topicName(%q) = %q, expected %q", queueKey, got, expected)
+		}
+	}
+}
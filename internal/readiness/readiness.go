@@ -0,0 +1,233 @@
+// Package readiness checks whether a server the provider reports running is ready for its
+// student, for labs whose readiness the running status doesn't tell, e.g. a lab serving a
+// web IDE that only starts minutes after boot.
+package readiness
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of the built-in checks
+const (
+	TypeSSH       = "ssh"        // a TCP connection to the SSH port succeeds
+	TypeTCP       = "tcp"        // a TCP connection to port succeeds
+	TypeHTTP      = "http"       // a GET of path on port answers with the expected status
+	TypePhoneHome = "phone-home" // the server set its phone-home key in Redis, e.g. at the end of cloud-init
+)
+
+const (
+	sshPort     = 22
+	httpPort    = 80
+	httpPath    = "/"
+	maxPort     = 65535
+	maxBodySize = 64 << 10
+
+	// probeTimeout bounds one check, so a server that drops packets doesn't hold up the poll
+	probeTimeout = 5 * time.Second
+)
+
+// errNotPhonedHome signals that a server hasn't set its phone-home key yet
+var errNotPhonedHome = errors.New("server hasn't phoned home yet")
+
+// Spec is the readiness check of one lab in the lab catalog, e.g.
+// {"type": "http", "port": 8080, "path": "/healthz"}
+type Spec struct {
+	Type           string `json:"type"`                     // one of the Type constants
+	Port           int    `json:"port,omitempty"`           // ssh: default 22; tcp: required; http: default 80
+	Path           string `json:"path,omitempty"`           // http only: default "/"
+	Status         int    `json:"status,omitempty"`         // http only: expected status, default any 2xx
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // how long a new server is polled until the check passes
+}
+
+// Validate returns an error if s isn't a complete check of a known type
+func (s Spec) Validate() error {
+	switch s.Type {
+	case TypeSSH, TypeTCP, TypeHTTP, TypePhoneHome:
+	case "":
+		return fmt.Errorf("readiness check needs a type")
+	default:
+		return fmt.Errorf("unknown readiness check type %q", s.Type)
+	}
+	if s.Port < 0 || s.Port > maxPort {
+		return fmt.Errorf("readiness check port %d out of range", s.Port)
+	}
+	if s.Type == TypeTCP && s.Port == 0 {
+		return fmt.Errorf("tcp readiness check needs a port")
+	}
+	if s.Type == TypePhoneHome && s.Port != 0 {
+		return fmt.Errorf("phone-home readiness check takes no port")
+	}
+	if s.Type != TypeHTTP && (s.Path != "" || s.Status != 0) {
+		return fmt.Errorf("%s readiness check takes no path or status", s.Type)
+	}
+	if s.Path != "" && !strings.HasPrefix(s.Path, "/") {
+		return fmt.Errorf("readiness check path %q must start with /", s.Path)
+	}
+	if s.Status != 0 && (s.Status < 100 || s.Status > 599) {
+		return fmt.Errorf("readiness check status %d is no HTTP status", s.Status)
+	}
+	if s.TimeoutSeconds < 0 {
+		return fmt.Errorf("readiness check timeout can't be negative")
+	}
+	return nil
+}
+
+// Target is the server a check runs against
+type Target struct {
+	ServerID string // the provider's ID; of the primary node for a composite lab
+	Address  string // IPv6 address
+}
+
+// Checker decides whether a running server is ready for its student
+type Checker interface {
+	// Check returns nil if the server is ready, or why it isn't yet
+	Check(ctx context.Context, target Target) error
+}
+
+// PhoneHomeReader reads whether servers have phoned home
+type PhoneHomeReader interface {
+	PhonedHome(ctx context.Context, serverID string) (bool, error)
+}
+
+// NewChecker creates the built-in checker for spec. phoneHome is only used by phone-home checks.
+func NewChecker(spec Spec, phoneHome PhoneHomeReader) (Checker, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	switch spec.Type {
+	case TypeSSH:
+		return tcpChecker{port: cmp.Or(spec.Port, sshPort)}, nil
+	case TypeTCP:
+		return tcpChecker{port: spec.Port}, nil
+	case TypeHTTP:
+		return httpChecker{
+			port:   cmp.Or(spec.Port, httpPort),
+			path:   cmp.Or(spec.Path, httpPath),
+			status: spec.Status,
+			client: &http.Client{Timeout: probeTimeout},
+		}, nil
+	default:
+		if phoneHome == nil {
+			return nil, fmt.Errorf("phone-home readiness check needs Redis")
+		}
+		return phoneHomeChecker{reader: phoneHome}, nil
+	}
+}
+
+// tcpChecker passes once a TCP connection to port succeeds
+type tcpChecker struct {
+	port int
+}
+
+func (c tcpChecker) Check(ctx context.Context, target Target) error {
+	dialer := net.Dialer{Timeout: probeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(target.Address, strconv.Itoa(c.port)))
+	if err != nil {
+		return fmt.Errorf("port %d: %w", c.port, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// httpChecker passes once a GET of path on port answers with status, or any 2xx without one
+type httpChecker struct {
+	port   int
+	path   string
+	status int
+	client *http.Client
+}
+
+func (c httpChecker) Check(ctx context.Context, target Target) error {
+	url := "http://" + net.JoinHostPort(target.Address, strconv.Itoa(c.port)) + c.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if c.status != 0 {
+		ok = resp.StatusCode == c.status
+	}
+	if !ok {
+		return fmt.Errorf("%s answered %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// phoneHomeChecker passes once the server has set its phone-home key
+type phoneHomeChecker struct {
+	reader PhoneHomeReader
+}
+
+func (c phoneHomeChecker) Check(ctx context.Context, target Target) error {
+	ok, err := c.reader.PhonedHome(ctx, target.ServerID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNotPhonedHome
+	}
+	return nil
+}
+
+// Checks finds and runs the readiness check of each lab in the lab catalog
+type Checks struct {
+	specs     func(labID int) (*Spec, error)
+	phoneHome PhoneHomeReader
+}
+
+// NewChecks creates the checks of the labs specs returns a Spec for, or nil for a lab without
+// a check. phoneHome reads the keys of phone-home checks.
+func NewChecks(specs func(labID int) (*Spec, error), phoneHome PhoneHomeReader) *Checks {
+	return &Checks{specs: specs, phoneHome: phoneHome}
+}
+
+// Check runs the readiness check of labID against target. Returns nil if the server is ready
+// or the lab has no check, or why it isn't ready yet.
+func (c *Checks) Check(ctx context.Context, labID int, target Target) error {
+	spec, err := c.spec(labID)
+	if err != nil || spec == nil {
+		return err
+	}
+	checker, err := NewChecker(*spec, c.phoneHome)
+	if err != nil {
+		return fmt.Errorf("lab %d: %w", labID, err)
+	}
+	return checker.Check(ctx, target)
+}
+
+// Timeout returns how long a new server of labID is polled until its check passes, or 0 for
+// a lab without a check or timeout of its own
+func (c *Checks) Timeout(labID int) time.Duration {
+	spec, err := c.spec(labID)
+	if err != nil || spec == nil {
+		return 0
+	}
+	return time.Duration(spec.TimeoutSeconds) * time.Second
+}
+
+func (c *Checks) spec(labID int) (*Spec, error) {
+	if c == nil || c.specs == nil {
+		return nil, nil
+	}
+	spec, err := c.specs(labID)
+	if err != nil {
+		return nil, fmt.Errorf("lab %d readiness check: %w", labID, err)
+	}
+	return spec, nil
+}
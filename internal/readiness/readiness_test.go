@@ -0,0 +1,153 @@
+package readiness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSpec_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    Spec
+		wantErr bool
+	}{
+		{name: "ssh", spec: Spec{Type: TypeSSH}},
+		{name: "ssh on another port", spec: Spec{Type: TypeSSH, Port: 2222}},
+		{name: "tcp", spec: Spec{Type: TypeTCP, Port: 5901}},
+		{name: "http", spec: Spec{Type: TypeHTTP, Port: 8080, Path: "/healthz", Status: 204, TimeoutSeconds: 900}},
+		{name: "phone-home", spec: Spec{Type: TypePhoneHome}},
+		{name: "no type", spec: Spec{Port: 22}, wantErr: true},
+		{name: "unknown type", spec: Spec{Type: "icmp"}, wantErr: true},
+		{name: "tcp without port", spec: Spec{Type: TypeTCP}, wantErr: true},
+		{name: "port out of range", spec: Spec{Type: TypeTCP, Port: 70000}, wantErr: true},
+		{name: "phone-home with port", spec: Spec{Type: TypePhoneHome, Port: 22}, wantErr: true},
+		{name: "path on tcp", spec: Spec{Type: TypeTCP, Port: 22, Path: "/"}, wantErr: true},
+		{name: "relative path", spec: Spec{Type: TypeHTTP, Path: "healthz"}, wantErr: true},
+		{name: "invalid status", spec: Spec{Type: TypeHTTP, Status: 42}, wantErr: true},
+		{name: "negative timeout", spec: Spec{Type: TypeSSH, TimeoutSeconds: -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTCPChecker(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	target := Target{Address: "127.0.0.1"}
+
+	checker, err := NewChecker(Spec{Type: TypeTCP, Port: port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Check(context.Background(), target); err != nil {
+		t.Errorf("expected the open port to pass, got %v", err)
+	}
+
+	listener.Close()
+	if err := checker.Check(context.Background(), target); err == nil {
+		t.Error("expected the closed port to fail")
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("expected /healthz, got %s", r.URL.Path)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host, portText, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portText)
+	target := Target{Address: host}
+
+	checker, err := NewChecker(Spec{Type: TypeHTTP, Port: port, Path: "/healthz"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Check(context.Background(), target); err == nil {
+		t.Error("expected 503 to fail")
+	}
+	status = http.StatusOK
+	if err := checker.Check(context.Background(), target); err != nil {
+		t.Errorf("expected 200 to pass, got %v", err)
+	}
+
+	// An expected status replaces the 2xx default
+	checker, _ = NewChecker(Spec{Type: TypeHTTP, Port: port, Path: "/healthz", Status: http.StatusNoContent}, nil)
+	if err := checker.Check(context.Background(), target); err == nil {
+		t.Error("expected 200 to fail when 204 is expected")
+	}
+}
+
+// phoneHomes is a phone-home reader of the servers that phoned home
+type phoneHomes map[string]bool
+
+func (p phoneHomes) PhonedHome(ctx context.Context, serverID string) (bool, error) {
+	if serverID == "broken" {
+		return false, errors.New("redis unavailable")
+	}
+	return p[serverID], nil
+}
+
+func TestChecks(t *testing.T) {
+	specs := map[int]*Spec{
+		3: {Type: TypePhoneHome, TimeoutSeconds: 600},
+		4: {Type: "icmp"},
+	}
+	checks := NewChecks(func(labID int) (*Spec, error) {
+		if labID == 5 {
+			return nil, errors.New("catalog unavailable")
+		}
+		return specs[labID], nil
+	}, phoneHomes{"home": true})
+	ctx := context.Background()
+
+	if err := checks.Check(ctx, 1, Target{ServerID: "away"}); err != nil {
+		t.Errorf("expected a lab without a check to pass, got %v", err)
+	}
+	if err := checks.Check(ctx, 3, Target{ServerID: "home"}); err != nil {
+		t.Errorf("expected a server that phoned home to pass, got %v", err)
+	}
+	if err := checks.Check(ctx, 3, Target{ServerID: "away"}); !errors.Is(err, errNotPhonedHome) {
+		t.Errorf("expected a server that didn't phone home to fail, got %v", err)
+	}
+	for _, tt := range []struct {
+		labID    int
+		serverID string
+	}{{3, "broken"}, {4, "home"}, {5, "home"}} {
+		if err := checks.Check(ctx, tt.labID, Target{ServerID: tt.serverID}); err == nil {
+			t.Errorf("lab %d, server %s: expected an error", tt.labID, tt.serverID)
+		}
+	}
+
+	if timeout := checks.Timeout(3); timeout != 10*time.Minute {
+		t.Errorf("expected the lab's timeout, got %v", timeout)
+	}
+	if timeout := checks.Timeout(1); timeout != 0 {
+		t.Errorf("expected no timeout for a lab without a check, got %v", timeout)
+	}
+
+	// Without checks every lab passes
+	var none *Checks
+	if err := none.Check(ctx, 3, Target{ServerID: "away"}); err != nil || none.Timeout(3) != 0 {
+		t.Errorf("expected nil checks to pass, got %v", err)
+	}
+}
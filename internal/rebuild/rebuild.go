@@ -0,0 +1,192 @@
+// Package rebuild resets a user's lab by reinstalling their server from its image instead of
+// deleting it and creating a new one. The server keeps its ID and addresses, so the address
+// LabMan shows stays valid and the reset skips server creation and its rate limits.
+package rebuild
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// CloudStatusRebuilding is the cloud status cached while the provider reinstalls the server
+const CloudStatusRebuilding = "rebuilding"
+
+// Request asks to rebuild the server a user is running
+type Request struct {
+	WebUserID     string `json:"webuserid"`
+	LabID         *int   `json:"labId,omitempty"` // Optional: only rebuild if the cached server runs this lab
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"` // Optional: traces the request through logs
+
+	// Optional: instructor tooling skips the rate limit with a granted admin override
+	override.Fields
+}
+
+// Handler rebuilds the servers of rebuild requests and hands them to resume, which polls
+// each one like a provision until it is available again
+type Handler struct {
+	log         *slog.Logger
+	conn        connector.Connector
+	redisClient redis.ClientInterface
+	resume      func(ctx context.Context, entry redis.HandoffEntry)
+	tenants     *tenant.Registry
+	events      redis.EventRecorder
+	history     redis.HistoryRecorder
+	overrides   *override.Verifier
+}
+
+// New creates a Handler that passes every rebuilt server to resume
+func New(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface, resume func(ctx context.Context, entry redis.HandoffEntry)) *Handler {
+	return &Handler{log: log, conn: conn, redisClient: redisClient, resume: resume}
+}
+
+// WithTenants resolves the tenant of each request for its cache namespace and rate limit.
+// Without a registry only requests for the default tenant are accepted.
+func (h *Handler) WithTenants(registry *tenant.Registry) *Handler {
+	h.tenants = registry
+	return h
+}
+
+// WithEvents records failed rebuilds and rate-limited requests for the status dashboard
+func (h *Handler) WithEvents(recorder redis.EventRecorder) *Handler {
+	h.events = recorder
+	return h
+}
+
+// WithHistory keeps completed and failed rebuilds in the history of each user
+func (h *Handler) WithHistory(recorder redis.HistoryRecorder) *Handler {
+	h.history = recorder
+	return h
+}
+
+// WithOverrides lets requests whose admin override verifier grants skip the rebuild rate
+// limit, so an instructor can reset a student's lab at once. Without a verifier admin
+// overrides are refused.
+func (h *Handler) WithOverrides(verifier *override.Verifier) *Handler {
+	h.overrides = verifier
+	return h
+}
+
+// ProcessRequest handles a single rebuild request from the queue
+func (h *Handler) ProcessRequest(ctx context.Context, payload string) {
+	var req Request
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		h.log.Error("failed to parse rebuild request", "error", err)
+		return
+	}
+	errList := []error{validate.WebUserID(req.WebUserID), validate.CorrelationID(req.CorrelationID),
+		validate.Text("tenant", req.Tenant, validate.MaxLabelLength)}
+	if req.LabID != nil {
+		errList = append(errList, validate.LabID(*req.LabID))
+	}
+	if err := validate.First(errList...); err != nil {
+		h.log.Error("rejecting invalid rebuild request", "error", err)
+		return
+	}
+
+	ctx = tracing.WithCorrelationID(ctx, req.CorrelationID)
+	reqLog := tracing.Logger(ctx, h.log).With("webuserid", req.WebUserID)
+
+	t, err := h.tenants.Get(req.Tenant)
+	if err != nil {
+		reqLog.Error("rejecting rebuild request", "error", err)
+		return
+	}
+	userID := redis.TenantUserID(t.ID, req.WebUserID)
+
+	// A rebuild wipes the disk like a new provision, so it is limited as often, unless an
+	// admin override skips the limit
+	allowed := h.overrideGranted(ctx, reqLog, req, t.ID)
+	if !allowed {
+		allowed, err = h.redisClient.TryAcquireRateLimit(ctx, userID, redis.RateLimitRebuild, t.RebuildRateLimit())
+		if err != nil {
+			reqLog.Error("failed to check rate limit, dropping message", "error", err)
+			return
+		}
+	}
+	if !allowed {
+		reqLog.Warn("rebuild rate limit hit, dropping message")
+		h.recordEvent(ctx, redis.Event{Type: redis.EventRateLimited, WebUserID: req.WebUserID, Tenant: t.ID})
+		return
+	}
+
+	lifecycle.Operation{
+		Name:        redis.OperationRebuild,
+		CloudStatus: CloudStatusRebuilding,
+		Apply: func(ctx context.Context, server connector.Server) error {
+			return server.Rebuild(ctx)
+		},
+		Done: func(ctx context.Context, state *redis.ServerState) *redis.ServerState {
+			h.recordHistory(ctx, redis.Event{Type: redis.EventRebuilt, WebUserID: state.WebUserID, Tenant: state.Tenant,
+				LabID: state.LabID, ServerID: state.ServerID})
+			return state
+		},
+		Failed: h.recordFailure,
+		Resume: h.resume,
+	}.Run(ctx, reqLog, h.redisClient, h.conn, redis.ServerCacheKey(userID), req.LabID)
+}
+
+// recordFailure keeps a failed rebuild for the status dashboard
+func (h *Handler) recordFailure(ctx context.Context, state redis.ServerState, err error) {
+	h.recordEvent(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: state.WebUserID, Tenant: state.Tenant,
+		LabID: state.LabID, ServerID: state.ServerID, Message: err.Error()})
+}
+
+// overrideGranted reports whether the admin override of req is granted. The override is
+// recorded either way; a refused one leaves the request under the usual rate limit.
+func (h *Handler) overrideGranted(ctx context.Context, reqLog *slog.Logger, req Request, tenantID string) bool {
+	var labID int
+	if req.LabID != nil {
+		labID = *req.LabID
+	}
+	granted, err := h.overrides.Check(override.OperationRebuild, req.WebUserID, labID, req.Fields)
+	if err != nil {
+		reqLog.Warn("refusing admin override", "admin_actor", req.Actor, "error", err)
+		h.recordEvent(ctx, redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: tenantID,
+			Message: fmt.Sprintf("override by %q refused: %v", req.Actor, err)})
+		return false
+	}
+	if granted {
+		reqLog.Info("admin override granted, skipping rate limit", "admin_actor", req.Actor)
+		h.recordEvent(ctx, redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: tenantID,
+			Message: fmt.Sprintf("override by %q", req.Actor)})
+	}
+	return granted
+}
+
+// recordEvent keeps an event for the status dashboard and the user's history. Events are
+// informational, so a failure is only logged.
+func (h *Handler) recordEvent(ctx context.Context, event redis.Event) {
+	h.recordHistory(ctx, event)
+	if h.events == nil {
+		return
+	}
+	event.Operation = "rebuild"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := h.events.RecordEvent(ctx, event); err != nil {
+		tracing.Logger(ctx, h.log).Warn("failed to record event", "type", event.Type, "error", err)
+	}
+}
+
+// recordHistory keeps an event in the history of its user.
+// History is informational, so a failure is only logged.
+func (h *Handler) recordHistory(ctx context.Context, event redis.Event) {
+	if h.history == nil {
+		return
+	}
+	event.Operation = "rebuild"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := h.history.RecordHistory(ctx, redis.TenantUserID(event.Tenant, event.WebUserID), event); err != nil {
+		tracing.Logger(ctx, h.log).Warn("failed to record history", "type", event.Type, "error", err)
+	}
+}
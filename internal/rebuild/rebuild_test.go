@@ -0,0 +1,166 @@
+package rebuild
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeCache holds cached states by key and grants every rate limit unless limited
+type fakeCache struct {
+	redis.ClientInterface
+	states  map[string]redis.ServerState
+	limited bool
+}
+
+func (f *fakeCache) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
+	return !f.limited, nil
+}
+
+func (f *fakeCache) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	state, ok := f.states[cacheKey]
+	if !ok {
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
+	}
+	return &state, nil
+}
+
+func (f *fakeCache) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	f.states[cacheKey] = state
+	return nil
+}
+
+func (f *fakeCache) DeleteServerState(ctx context.Context, cacheKey string) error {
+	delete(f.states, cacheKey)
+	return nil
+}
+
+type fakeServer struct {
+	connector.Server
+	rebuildErr error
+	rebuilds   int
+}
+
+func (s *fakeServer) Rebuild(ctx context.Context) error {
+	s.rebuilds++
+	return s.rebuildErr
+}
+
+type fakeConnector struct {
+	connector.Connector
+	server *fakeServer
+}
+
+func (c *fakeConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	if c.server == nil {
+		return nil, connector.NotFound("server %s not found", id)
+	}
+	return c.server, nil
+}
+
+func TestProcessRequest(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	key := redis.ServerCacheKey("user-1")
+	running := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", Status: config.StatusRunning, Available: true, CloudStatus: "running"}
+	quarantined := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", Status: config.StatusRunning, CloudStatus: config.CloudStatusQuarantined}
+
+	tests := []struct {
+		name       string
+		payload    string
+		state      *redis.ServerState
+		limited    bool
+		rebuildErr error
+		rebuilds   int
+		resumed    bool
+		cached     bool // whether an entry is left afterwards
+	}{
+		{name: "rebuilds the running server", payload: `{"webuserid":"user-1"}`, state: &running, rebuilds: 1, resumed: true, cached: true},
+		{name: "matching labId", payload: `{"webuserid":"user-1","labId":5}`, state: &running, rebuilds: 1, resumed: true, cached: true},
+		{name: "stale labId", payload: `{"webuserid":"user-1","labId":6}`, state: &running, cached: true},
+		{name: "no server", payload: `{"webuserid":"user-1"}`},
+		{name: "rate limited", payload: `{"webuserid":"user-1"}`, state: &running, limited: true, cached: true},
+		{
+			name:     "admin override skips the rate limit",
+			payload:  `{"webuserid":"user-1","admin":true,"adminActor":"instructor"}`,
+			state:    &running,
+			limited:  true,
+			rebuilds: 1,
+			resumed:  true,
+			cached:   true,
+		},
+		{name: "refused admin override", payload: `{"webuserid":"user-1","admin":true,"adminActor":"student"}`, state: &running, limited: true, cached: true},
+		{name: "invalid user ID", payload: `{"webuserid":"user 1"}`, state: &running, cached: true},
+		{name: "quarantined server", payload: `{"webuserid":"user-1"}`, state: &quarantined, cached: true},
+		{
+			name:    "server still provisioning",
+			payload: `{"webuserid":"user-1"}`,
+			state:   &redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", Status: config.StatusProvisioning},
+			cached:  true,
+		},
+		{
+			name:       "failed rebuild is polled back",
+			payload:    `{"webuserid":"user-1"}`,
+			state:      &running,
+			rebuildErr: errors.New("boom"),
+			rebuilds:   1,
+			resumed:    true,
+			cached:     true,
+		},
+		{
+			name:       "vanished server is removed",
+			payload:    `{"webuserid":"user-1"}`,
+			state:      &running,
+			rebuildErr: connector.NotFound("server 42 not found"),
+			rebuilds:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &fakeCache{states: map[string]redis.ServerState{}, limited: tt.limited}
+			if tt.state != nil {
+				cache.states[key] = *tt.state
+			}
+			server := &fakeServer{rebuildErr: tt.rebuildErr}
+
+			var resumed []redis.HandoffEntry
+			h := New(log, &fakeConnector{server: server}, cache, func(ctx context.Context, entry redis.HandoffEntry) {
+				resumed = append(resumed, entry)
+			}).WithOverrides(override.NewVerifier(nil, []string{"instructor"}, 0).WithSignedPayloads())
+			h.ProcessRequest(context.Background(), tt.payload)
+
+			if server.rebuilds != tt.rebuilds {
+				t.Errorf("expected %d rebuilds, got %d", tt.rebuilds, server.rebuilds)
+			}
+			if (len(resumed) == 1) != tt.resumed {
+				t.Fatalf("expected resumed=%v, got %d entries", tt.resumed, len(resumed))
+			}
+			if _, ok := cache.states[key]; ok != tt.cached {
+				t.Errorf("expected cached=%v", tt.cached)
+			}
+			if !tt.resumed {
+				return
+			}
+
+			entry := resumed[0]
+			if entry.CacheKey != key || entry.ServerID != "42" {
+				t.Errorf("unexpected handoff entry %+v", entry)
+			}
+			if entry.State.Status != config.StatusProvisioning || entry.State.Available || entry.State.CloudStatus != CloudStatusRebuilding {
+				t.Errorf("expected an unavailable provisioning state, got %+v", entry.State)
+			}
+			if cached := cache.states[key]; cached.Status != config.StatusProvisioning || cached.Available {
+				t.Errorf("expected the cache to show the rebuild, got %+v", cached)
+			}
+		})
+	}
+}
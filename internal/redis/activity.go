@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// ActivityKey returns the key LabMan or the SSH proxy refreshes while a user works in their lab
+func ActivityKey(webUserID string) string {
+	return config.ActivityPrefix + webUserID
+}
+
+// ActivityReader reads when users were last active in their lab
+type ActivityReader interface {
+	LastActivity(ctx context.Context, userIDs []string) (map[string]time.Time, error)
+}
+
+// LastActivity returns the last activity of each tenant-scoped user ID (see TenantUserID)
+// that has an activity key. Users without a key or with an unreadable value are left out.
+func (c *Client) LastActivity(ctx context.Context, userIDs []string) (map[string]time.Time, error) {
+	activity := make(map[string]time.Time, len(userIDs))
+	if len(userIDs) == 0 {
+		return activity, nil
+	}
+
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = ActivityKey(id)
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activity: %w", transient(err))
+	}
+
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.ParseInt(data, 10, 64)
+		if err != nil {
+			continue
+		}
+		activity[userIDs[i]] = time.Unix(seconds, 0)
+	}
+	return activity, nil
+}
+
+// RecordActivity sets the last activity of a tenant-scoped user ID to at, the way LabMan or
+// the SSH proxy do while the user works. The key expires after ttl.
+func (c *Client) RecordActivity(ctx context.Context, userID string, at time.Time, ttl time.Duration) error {
+	if err := c.client.Set(ctx, ActivityKey(userID), at.Unix(), ttl).Err(); err != nil {
+		return fmt.Errorf("failed to record activity: %w", transient(err))
+	}
+	return nil
+}
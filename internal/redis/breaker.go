@@ -0,0 +1,121 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// States of the circuit breaker
+const (
+	CircuitClosed   = "closed"    // calls go to Redis
+	CircuitOpen     = "open"      // calls fail with ErrCircuitOpen without contacting Redis
+	CircuitHalfOpen = "half_open" // the cooldown is over; the next call decides
+)
+
+// ErrCircuitOpen is returned without contacting Redis while the circuit breaker is open.
+// It is transient: the call can be retried once Redis is reachable again.
+var ErrCircuitOpen = errors.New("redis unavailable: circuit breaker open")
+
+// Health is the state of the client's connection to Redis, see Client.Health
+type Health struct {
+	Circuit  string    `json:"circuit"`
+	Failures int       `json:"consecutiveFailures"`
+	RetryAt  time.Time `json:"retryAt,omitzero"` // when an open circuit lets calls through again
+}
+
+// Degraded reports whether Redis calls are failing or short-circuited
+func (h Health) Degraded() bool {
+	return h.Circuit != CircuitClosed
+}
+
+// HealthReporter reports the state of the connection to Redis
+type HealthReporter interface {
+	Health() Health
+}
+
+var circuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "swim_redis_circuit_open",
+	Help: "1 while the Redis circuit breaker is open or half open, 0 while it is closed.",
+})
+
+func init() {
+	prometheus.MustRegister(circuitOpen)
+}
+
+// breaker opens after threshold consecutive calls failed because Redis couldn't be reached,
+// and fails calls for cooldown before letting them through again. Reply errors don't count:
+// Redis answered. Once the cooldown is over, the first call to succeed closes the circuit
+// and the first to fail opens it for another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a call may go to Redis
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures < b.threshold || !b.now().Before(b.openedAt.Add(b.cooldown))
+}
+
+// record counts the outcome of a call that went to Redis and returns the state the
+// circuit changed to, "" if it didn't change
+func (b *breaker) record(err error) string {
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, which says nothing about Redis
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !unavailable(err) {
+		wasOpen := b.failures >= b.threshold
+		b.failures = 0
+		if wasOpen {
+			circuitOpen.Set(0)
+			return CircuitClosed
+		}
+		return ""
+	}
+
+	b.failures++
+	if b.failures < b.threshold {
+		return ""
+	}
+	// Also restarts the cooldown when a call after the previous one failed
+	b.openedAt = b.now()
+	circuitOpen.Set(1)
+	return CircuitOpen
+}
+
+// health returns the current state of the circuit
+func (b *breaker) health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := Health{Circuit: CircuitClosed, Failures: b.failures}
+	if b.failures < b.threshold {
+		return health
+	}
+	retryAt := b.openedAt.Add(b.cooldown)
+	if b.now().Before(retryAt) {
+		health.Circuit = CircuitOpen
+		health.RetryAt = retryAt
+	} else {
+		health.Circuit = CircuitHalfOpen
+	}
+	return health
+}
@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newBreaker(3, 10*time.Second)
+	b.now = func() time.Time { return now }
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// Reply errors and cancelled calls don't count: Redis answered, or nobody waited for it
+	b.record(refused)
+	b.record(refused)
+	b.record(replyError("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	b.record(refused)
+	b.record(refused)
+	b.record(context.Canceled)
+	if health := b.health(); health.Circuit != CircuitClosed || health.Failures != 2 || !b.allow() {
+		t.Fatalf("expected a closed circuit after 2 failures in a row, got %+v", health)
+	}
+
+	if state := b.record(&OpError{Op: "get", Err: context.DeadlineExceeded}); state != CircuitOpen {
+		t.Fatalf("expected the third failure in a row to open the circuit, got %q", state)
+	}
+	if health := b.health(); health.Circuit != CircuitOpen || !health.RetryAt.Equal(now.Add(10*time.Second)) || b.allow() {
+		t.Errorf("expected an open circuit until the cooldown is over, got %+v", health)
+	}
+
+	// After the cooldown calls go through again, and a failure opens the circuit for another cooldown
+	now = now.Add(10 * time.Second)
+	if health := b.health(); health.Circuit != CircuitHalfOpen || !b.allow() {
+		t.Errorf("expected a half open circuit after the cooldown, got %+v", health)
+	}
+	if state := b.record(refused); state != CircuitOpen || b.allow() {
+		t.Errorf("expected a failure after the cooldown to open the circuit again, got %q", state)
+	}
+
+	now = now.Add(10 * time.Second)
+	if state := b.record(nil); state != CircuitClosed {
+		t.Errorf("expected a success to close the circuit, got %q", state)
+	}
+	if health := b.health(); health.Circuit != CircuitClosed || health.Failures != 0 || health.Degraded() {
+		t.Errorf("expected a closed circuit, got %+v", health)
+	}
+}
+
+func TestCallObserver_CircuitOpen(t *testing.T) {
+	client := &Client{breaker: newBreaker(1, time.Minute)}
+	calls := 0
+	process := callObserver{client: client}.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+		calls++
+		err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		cmd.SetErr(err)
+		return err
+	})
+
+	process(context.Background(), redis.NewStringCmd(context.Background(), "get", "k"))
+	err := process(context.Background(), redis.NewStringCmd(context.Background(), "get", "k"))
+
+	if calls != 1 {
+		t.Errorf("expected the open circuit to short-circuit the second call, got %d calls", calls)
+	}
+	if !errors.Is(err, ErrCircuitOpen) || !errors.Is(transient(err), errs.ErrTransient) {
+		t.Errorf("expected a transient ErrCircuitOpen, got %v", err)
+	}
+	if health := client.Health(); !health.Degraded() {
+		t.Errorf("expected degraded health, got %+v", health)
+	}
+}
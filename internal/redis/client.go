@@ -3,27 +3,57 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/tracing"
 )
 
 // ClientInterface defines the interface for Redis operations
 type ClientInterface interface {
 	PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error)
+	PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error)
 	PushPayload(ctx context.Context, queueKey string, payload string) error
+	PushPayloads(ctx context.Context, queueKey string, payloads []string) error
 	PushServerState(ctx context.Context, cacheKey string, state ServerState, ttl time.Duration) error
+	PushServerStates(ctx context.Context, states map[string]ServerState, ttl time.Duration) error
 	GetServerState(ctx context.Context, cacheKey string) (*ServerState, error)
 	GetAllServerStates(ctx context.Context, prefix string) ([]ServerState, error)
+	GetExpiredServerStates(ctx context.Context, now time.Time) ([]ServerState, error)
+	QueryServerStates(ctx context.Context, filter StateFilter) (*StatePage, error)
 	DeleteServerState(ctx context.Context, cacheKey string) error
+	DeleteServerStates(ctx context.Context, cacheKeys []string) error
+	PushUserHash(ctx context.Context, hash string, webUserID string, ttl time.Duration) error
+	GetUserByHash(ctx context.Context, hash string) (string, error)
 	TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error)
+	AdmitProvision(ctx context.Context, cacheKey string, state ServerState, limits AdmissionLimits, cacheTTL time.Duration) (*AdmissionResult, error)
 	Close() error
 }
 
 // Client wraps Redis operations for queue and cache
 type Client struct {
 	client *redis.Client
+	cipher *FieldCipher // encrypts selected state fields; nil stores them in plaintext
+	log    *slog.Logger
+	hooks  []CallHook
+
+	timeout time.Duration // bounds each call; 0 leaves calls to the caller's context
+	breaker *breaker      // nil never short-circuits calls
+
+	idleTimeout time.Duration // idle expiry of the cleanup worker, for the derived deadlines; 0 without
+	maxLifetime time.Duration // longest a server may run, for the derived deadlines; 0 for unbounded
+
+	dryRun bool // marks every state written as one of a rehearsal, see WithDryRun
 }
 
 // Ensure Client implements ClientInterface
@@ -34,24 +64,69 @@ type Config struct {
 	Address  string
 	Password string
 	DB       int
+	Logger   *slog.Logger // receives warnings about entries that can't be read; nil uses slog.Default()
 }
 
-// NewClient creates a new Redis client
-func NewClient(config Config) (*Client, error) {
+// NewClient creates a new Redis client. Errors of its Redis calls are *OpError values
+// naming the operation and key; redis.Nil is returned as is. Each call is bounded by
+// REDIS_OPERATION_TIMEOUT_SECONDS, and calls fail fast with ErrCircuitOpen after
+// REDIS_BREAKER_FAILURES of them in a row couldn't reach Redis, see Health.
+func NewClient(cfg Config) (*Client, error) {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     config.Address,
-		Password: config.Password,
-		DB:       config.DB,
+		Addr:                  cfg.Address,
+		Password:              cfg.Password,
+		DB:                    cfg.DB,
+		ContextTimeoutEnabled: true,
 	})
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	c := &Client{
+		client:  rdb,
+		log:     log,
+		timeout: config.GetRedisOperationTimeout(),
+		breaker: newBreaker(config.GetRedisBreakerFailures(), config.GetRedisBreakerCooldown()),
+	}
+	rdb.AddHook(callObserver{client: c})
 
 	// Test connection
 	ctx := context.Background()
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
-	return &Client{
-		client: rdb,
-	}, nil
+	return c, nil
+}
+
+// WithCallHook calls hook after every Redis call of the client, e.g. RecordCallMetrics
+func (c *Client) WithCallHook(hook CallHook) *Client {
+	c.hooks = append(c.hooks, hook)
+	return c
+}
+
+// WithDryRun marks every state the client writes with dryRun, so LabMan and operators can
+// tell the servers of a rehearsal against a simulated provider from real ones
+func (c *Client) WithDryRun() *Client {
+	c.dryRun = true
+	return c
+}
+
+// Health returns the state of the connection to Redis. It is degraded while the circuit
+// breaker is open, and until a call succeeds after that.
+func (c *Client) Health() Health {
+	if c.breaker == nil {
+		return Health{Circuit: CircuitClosed}
+	}
+	return c.breaker.health()
+}
+
+// logger returns the client's logger with the correlation ID of ctx attached
+func (c *Client) logger(ctx context.Context) *slog.Logger {
+	log := c.log
+	if log == nil {
+		log = slog.Default()
+	}
+	return tracing.Logger(ctx, log)
 }
 
 // Close closes the Redis connection
@@ -64,24 +139,114 @@ func (c *Client) Close() error {
 type ServerState struct {
 	User        string    `json:"user"`        // SSH username (e.g., "student")
 	Address     string    `json:"address"`     // IPv6 address for SSH connection
-	Status      string    `json:"status"`      // "provisioning" | "running" | "stopping" (normalized status)
+	Status      string    `json:"status"`      // "provisioning" | "running" | "stopping" | "deleting" (normalized status)
 	Available   bool      `json:"available"`   // true if server is ready for SSH connections (status == "running" for most providers)
 	CloudStatus string    `json:"cloudStatus"` // Raw cloud provider status (e.g., "running", "starting", "initializing" from Hetzner)
 	ServerID    string    `json:"serverId"`    // Internal: cloud provider server ID for deletion
 	ExpiresAt   time.Time `json:"expiresAt"`   // Internal: timestamp for cleanup worker
+	CreatedAt   time.Time `json:"createdAt"`   // Internal: when the provision was admitted, for idle-based expiry; zero in older entries
 	WebUserID   string    `json:"webUserId"`   // Internal: for cleanup to create decommission request
 	LabID       int       `json:"labId"`       // Internal: for cleanup to create decommission request
+	Version     int64     `json:"version"`     // Internal: optimistic concurrency sequence, bumped on every write
+
+	// Deadlines for LabMan's countdown, derived on every write and read (see WithExpiryPolicy)
+	RemainingSeconds int64     `json:"remainingSeconds"`       // seconds until the server is decommissioned, as of the last write or read
+	HardExpiryAt     time.Time `json:"hardExpiryAt"`           // latest the server may run, however active its user is
+	IdleExpiresAt    time.Time `json:"idleExpiresAt,omitzero"` // when the server expires unless its user is active again; only with idle expiry
+
+	AvailableAt time.Time `json:"availableAt,omitzero"` // Internal: when the server first accepted connections, for session analytics; zero until then
+
+	SchemaVersion int `json:"schemaVersion,omitempty"` // Internal: schema the entry was written with, see SchemaVersion; absent in entries from before schema versions
+
+	CorrelationID string `json:"correlationId,omitempty"` // Internal: correlation ID of the provision request, for tracing
+	ServerType    string `json:"serverType,omitempty"`    // Internal: server type the server was actually created with
+	Hostname      string `json:"hostname,omitempty"`      // Stable DNS name pointing at Address, if DNS registration is enabled
+	SSHHostKey    string `json:"sshHostKey,omitempty"`    // SSH host public key in authorized_keys format, for host key verification
+	Tenant        string `json:"tenant,omitempty"`        // Course or organization the user belongs to; empty for the default tenant
+	Password      string `json:"password,omitempty"`      // Administrator password of a Windows server, for RDP; empty for Linux
+	FailureReason string `json:"failureReason,omitempty"` // Why provisioning failed, with status "failed"; empty otherwise
+	DryRun        bool   `json:"dryRun,omitempty"`        // The server is simulated: written by an instance rehearsing with a simulated provider
+	Operation     string `json:"operation,omitempty"`     // Internal: OperationRebuild or OperationResize if the entry provisions an existing server again; empty for a new server
+
+	Nodes map[string]NodeState `json:"nodes,omitempty"` // Servers of a composite lab by node name, including the primary the fields above describe
+
+	Extension *ExtensionResult `json:"extension,omitempty"` // Outcome of the user's last extension request; nil if there was none
 }
 
+// Operations that put the entry of an existing server back into provisioning, see ServerState.Operation
+const (
+	OperationRebuild = "rebuild"
+	OperationResize  = "resize"
+)
+
+// ExtensionResult is the outcome of an extension request, for LabMan to explain it to the user
+type ExtensionResult struct {
+	Status           string    `json:"status"`           // "granted" or "rejected"
+	Reason           string    `json:"reason,omitempty"` // why the request was rejected or granted in part
+	Minutes          int       `json:"minutes"`          // minutes the expiry moved; 0 if rejected
+	ExtensionsToday  int       `json:"extensionsToday"`  // extensions granted to the user on this UTC day
+	ExtensionsPerDay int       `json:"extensionsPerDay"` // extensions a user is granted per UTC day
+	MaxExpiresAt     time.Time `json:"maxExpiresAt"`     // latest expiry extensions can reach for this server
+	At               time.Time `json:"at"`               // when the request was handled
+}
+
+// NodeState is one server of a composite lab
+type NodeState struct {
+	ServerID   string `json:"serverId"`
+	Address    string `json:"address"`              // IPv6 address for SSH connection
+	ServerType string `json:"serverType,omitempty"` // server type the node was actually created with
+	SSHHostKey string `json:"sshHostKey,omitempty"` // SSH host public key in authorized_keys format
+	Password   string `json:"password,omitempty"`   // Administrator password of a Windows node
+
+	// PrivateAddress is the node's address in the lab's private network, for exercises between nodes
+	PrivateAddress string `json:"privateAddress,omitempty"`
+}
+
+// CacheKey returns the cache key the state is stored under
+func (s ServerState) CacheKey() string {
+	return ServerCacheKey(TenantUserID(s.Tenant, s.WebUserID))
+}
+
+// transient marks connection failures, timeouts, failover replies and short-circuited calls, which may succeed when retried, with errs.ErrTransient
+func transient(err error) error {
+	if unavailable(err) || failingOver(err) || errors.Is(err, ErrCircuitOpen) {
+		return errs.Mark(err, errs.ErrTransient)
+	}
+	return err
+}
+
+// unavailable reports whether err means Redis couldn't be reached or didn't answer in time
+func unavailable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, redis.ErrPoolTimeout)
+}
+
+// failingOver reports whether err is the reply of a server that can't take the command while
+// Sentinel fails over: a demoted master, a replica still loading its data, or a replica that
+// lost its master
+func failingOver(err error) bool {
+	return redis.HasErrorPrefix(err, "READONLY") || redis.HasErrorPrefix(err, "LOADING") || redis.HasErrorPrefix(err, "MASTERDOWN")
+}
+
+// ErrVersionConflict is returned by PushServerState when the cached state was
+// written by someone else since the caller read it
+var ErrVersionConflict = errors.New("server state version conflict")
+
+// maxStateUpdateAttempts bounds how often UpdateServerState re-reads after a conflict
+const maxStateUpdateAttempts = 5
+
+// indexFetchBatchSize is the number of keys fetched per MGET when reading the server index
+const indexFetchBatchSize = 500
+
 // PopPayload pops a payload from the queue (blocking)
 // Returns the raw string payload
 func (c *Client) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
 	result, err := c.client.BLPop(ctx, timeout, queueKey).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return "", fmt.Errorf("no payload available in queue")
+			return "", errs.New("no payload available in queue", errs.ErrNotFound)
 		}
-		return "", fmt.Errorf("failed to pop from queue: %w", err)
+		return "", fmt.Errorf("failed to pop from queue: %w", transient(err))
 	}
 
 	if len(result) < 2 {
@@ -91,6 +256,24 @@ func (c *Client) PopPayload(ctx context.Context, queueKey string, timeout time.D
 	return result[1], nil
 }
 
+// PopAnyPayload pops a payload from the first of queueKeys that holds one (blocking),
+// so earlier queues take priority over later ones. Returns the queue key and the raw payload.
+func (c *Client) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	result, err := c.client.BLPop(ctx, timeout, queueKeys...).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", "", errs.New("no payload available in queues", errs.ErrNotFound)
+		}
+		return "", "", fmt.Errorf("failed to pop from queues: %w", transient(err))
+	}
+
+	if len(result) < 2 {
+		return "", "", fmt.Errorf("unexpected response from Redis")
+	}
+
+	return result[0], result[1], nil
+}
+
 // PushPayload pushes a payload to the queue
 func (c *Client) PushPayload(ctx context.Context, queueKey string, payload string) error {
 	if err := c.client.RPush(ctx, queueKey, payload).Err(); err != nil {
@@ -99,79 +282,376 @@ func (c *Client) PushPayload(ctx context.Context, queueKey string, payload strin
 	return nil
 }
 
+// PushPayloads pushes several payloads to the queue in a single RPUSH, preserving order
+func (c *Client) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(payloads))
+	for i, payload := range payloads {
+		values[i] = payload
+	}
+
+	if err := c.client.RPush(ctx, queueKey, values...).Err(); err != nil {
+		return fmt.Errorf("failed to push to queue: %w", err)
+	}
+	return nil
+}
+
 // ServerCacheKey constructs a cache key for a webuserid
 // Note: labId is stored in the ServerState struct, not in the cache key
 func ServerCacheKey(webuserid string) string {
-	return fmt.Sprintf("vmmanager:servers:%s", webuserid)
+	return config.ServerCachePrefix + webuserid
+}
+
+// TenantUserID scopes a web user ID to its tenant for cache and rate limit keys,
+// so the same user ID in two tenants never shares state. The default tenant is unscoped.
+func TenantUserID(tenant, webUserID string) string {
+	if tenant == "" {
+		return webUserID
+	}
+	return tenant + ":" + webUserID
 }
 
-// PushServerState pushes the provisioned server state to Redis cache
+// pushServerStateScript writes a server state only if the cached version matches,
+// and records the cache key in the server and expiry indexes.
+// A missing entry or an entry without a version counts as version 0.
+// KEYS[1] = cache key, KEYS[2] = server index key, KEYS[3] = expiry index key
+// ARGV[1] = new state JSON, ARGV[2] = expected version, ARGV[3] = TTL (ms, 0 = no expiry), ARGV[4] = expiresAt (unix ms)
+var pushServerStateScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+local version = 0
+if current then
+	local ok, cached = pcall(cjson.decode, current)
+	if ok and cached['version'] then
+		version = tonumber(cached['version'])
+	end
+end
+if version ~= tonumber(ARGV[2]) then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+redis.call('SADD', KEYS[2], KEYS[1])
+redis.call('ZADD', KEYS[3], ARGV[4], KEYS[1])
+return 1
+`)
+
+// PushServerState pushes the provisioned server state to Redis cache.
+// state.Version must be the version the caller last read; the entry is stored with
+// state.Version+1. Returns ErrVersionConflict if another writer got in first.
 func (c *Client) PushServerState(ctx context.Context, cacheKey string, state ServerState, ttl time.Duration) error {
-	data, err := json.Marshal(state)
+	expected := state.Version
+	state.Version++
+
+	data, err := c.marshalState(state)
 	if err != nil {
 		return fmt.Errorf("failed to marshal server state: %w", err)
 	}
 
-	if err := c.client.Set(ctx, cacheKey, data, ttl).Err(); err != nil {
-		return fmt.Errorf("failed to set cache: %w", err)
+	keys := []string{cacheKey, config.ServerIndexKey, config.ExpiryIndexKey}
+	written, err := pushServerStateScript.Run(ctx, c.client, keys, string(data), expected, ttl.Milliseconds(), state.ExpiresAt.UnixMilli()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to set cache: %w", transient(err))
+	}
+	if written == 0 {
+		return ErrVersionConflict
 	}
 
 	return nil
 }
 
+// KeyError is the error of one key of a batch write such as PushServerStates
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// PushServerStates writes several server states in one pipelined round trip.
+// Each state follows the same versioning rules as PushServerState; keys that fail
+// are reported together as *KeyError values, and a conflicting key wraps ErrVersionConflict.
+func (c *Client) PushServerStates(ctx context.Context, states map[string]ServerState, ttl time.Duration) error {
+	if len(states) == 0 {
+		return nil
+	}
+
+	pipe := c.client.Pipeline()
+	cmds := make(map[string]*redis.Cmd, len(states))
+	for cacheKey, state := range states {
+		expected := state.Version
+		state.Version++
+
+		data, err := c.marshalState(state)
+		if err != nil {
+			return &KeyError{Key: cacheKey, Err: fmt.Errorf("failed to marshal server state: %w", err)}
+		}
+
+		keys := []string{cacheKey, config.ServerIndexKey, config.ExpiryIndexKey}
+		// EVAL rather than EVALSHA: a pipeline cannot fall back on NOSCRIPT
+		cmds[cacheKey] = pushServerStateScript.Eval(ctx, pipe, keys, string(data), expected, ttl.Milliseconds(), state.ExpiresAt.UnixMilli())
+	}
+
+	// Per-command errors are inspected below
+	_, _ = pipe.Exec(ctx)
+
+	var errs []error
+	for cacheKey, cmd := range cmds {
+		written, err := cmd.Int()
+		if err != nil {
+			errs = append(errs, &KeyError{Key: cacheKey, Err: fmt.Errorf("failed to set cache: %w", err)})
+			continue
+		}
+		if written == 0 {
+			errs = append(errs, &KeyError{Key: cacheKey, Err: ErrVersionConflict})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// UpdateServerState applies mutate to the cached state and writes it back with optimistic
+// concurrency. On a version conflict the state is re-read and mutate is applied again to the
+// fresh data. An error returned by mutate aborts the update and is returned unchanged.
+// Returns the state as written (with its new version).
+func UpdateServerState(ctx context.Context, client ClientInterface, cacheKey string, ttl time.Duration, mutate func(state *ServerState) error) (*ServerState, error) {
+	for attempt := 1; attempt <= maxStateUpdateAttempts; attempt++ {
+		state, err := client.GetServerState(ctx, cacheKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := mutate(state); err != nil {
+			return nil, err
+		}
+
+		err = client.PushServerState(ctx, cacheKey, *state, ttl)
+		if err == nil {
+			state.Version++
+			return state, nil
+		}
+		if !errors.Is(err, ErrVersionConflict) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("failed to update server state after %d attempts: %w", maxStateUpdateAttempts, ErrVersionConflict)
+}
+
 // GetServerState retrieves server state from cache
 func (c *Client) GetServerState(ctx context.Context, cacheKey string) (*ServerState, error) {
 	data, err := c.client.Get(ctx, cacheKey).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, fmt.Errorf("server state not found in cache")
+			return nil, errs.New("server state not found in cache", errs.ErrNotFound)
 		}
-		return nil, fmt.Errorf("failed to get from cache: %w", err)
+		return nil, fmt.Errorf("failed to get from cache: %w", transient(err))
 	}
 
 	var state ServerState
-	if err := json.Unmarshal([]byte(data), &state); err != nil {
+	if err := c.unmarshalState([]byte(data), &state); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal server state: %w", err)
 	}
 
 	return &state, nil
 }
 
-// GetAllServerStates returns all server states with the given prefix
+// GetAllServerStates returns all server states with the given prefix.
+// Keys come from the server index instead of a keyspace SCAN and are fetched in MGET batches.
 func (c *Client) GetAllServerStates(ctx context.Context, prefix string) ([]ServerState, error) {
-	var states []ServerState
+	members, err := c.client.SMembers(ctx, config.ServerIndexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read server index: %w", err)
+	}
 
-	iter := c.client.Scan(ctx, 0, prefix+"*", 0).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
-		state, err := c.GetServerState(ctx, key)
-		if err != nil {
-			// Log scan error for visibility but continue processing other keys
-			fmt.Printf("warning: failed to get server state for key %s: %v\n", key, err)
-			continue
+	var keys []string
+	for _, key := range members {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
 		}
+	}
 
-		states = append(states, *state)
+	return c.fetchServerStates(ctx, keys)
+}
+
+// GetExpiredServerStates returns the server states whose ExpiresAt is at or before now,
+// using the expiry index instead of loading every state
+func (c *Client) GetExpiredServerStates(ctx context.Context, now time.Time) ([]ServerState, error) {
+	keys, err := c.client.ZRangeByScore(ctx, config.ExpiryIndexKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expiry index: %w", err)
 	}
 
-	if err := iter.Err(); err != nil {
-		return nil, fmt.Errorf("scan failed: %w", err)
+	return c.fetchServerStates(ctx, keys)
+}
+
+// indexedState is a server state together with its cache key
+type indexedState struct {
+	key   string
+	state ServerState
+}
+
+// fetchServerStates loads the given cache keys in MGET batches.
+// Keys whose entry has expired are removed from the indexes.
+func (c *Client) fetchServerStates(ctx context.Context, keys []string) ([]ServerState, error) {
+	indexed, stale, err := c.fetchIndexedStates(ctx, keys)
+	if err != nil {
+		return nil, err
 	}
+	c.pruneServerIndexes(ctx, stale)
 
+	var states []ServerState
+	for _, entry := range indexed {
+		states = append(states, entry.state)
+	}
 	return states, nil
 }
 
-// DeleteServerState removes a server state from Redis cache
+// fetchIndexedStates loads the given cache keys in MGET batches, keeping their order.
+// Keys whose entry has expired are returned as stale.
+func (c *Client) fetchIndexedStates(ctx context.Context, keys []string) ([]indexedState, []interface{}, error) {
+	var states []indexedState
+	var stale []interface{}
+
+	for start := 0; start < len(keys); start += indexFetchBatchSize {
+		end := min(start+indexFetchBatchSize, len(keys))
+		batch := keys[start:end]
+
+		values, err := c.client.MGet(ctx, batch...).Result()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch server states: %w", err)
+		}
+
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				// Entry expired or was deleted without updating the indexes
+				stale = append(stale, batch[i])
+				continue
+			}
+
+			var state ServerState
+			if err := c.unmarshalState([]byte(data), &state); err != nil {
+				// Log decode error for visibility but continue processing other keys
+				c.logger(ctx).Warn("failed to decode server state", "key", batch[i], "operation", "fetch_server_states", "error", err)
+				continue
+			}
+			states = append(states, indexedState{key: batch[i], state: state})
+		}
+	}
+
+	return states, stale, nil
+}
+
+// pruneServerIndexes removes cache keys whose entry is gone from the server and expiry indexes
+func (c *Client) pruneServerIndexes(ctx context.Context, stale []interface{}) {
+	if len(stale) == 0 {
+		return
+	}
+	pipe := c.client.TxPipeline()
+	pipe.SRem(ctx, config.ServerIndexKey, stale...)
+	pipe.ZRem(ctx, config.ExpiryIndexKey, stale...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.logger(ctx).Warn("failed to prune server indexes", "key", config.ServerIndexKey, "operation", "prune_server_indexes", "error", err)
+	}
+}
+
+// DeleteServerState removes a server state from Redis cache and the indexes
 func (c *Client) DeleteServerState(ctx context.Context, cacheKey string) error {
-	if err := c.client.Del(ctx, cacheKey).Err(); err != nil {
+	pipe := c.client.TxPipeline()
+	pipe.Del(ctx, cacheKey)
+	pipe.SRem(ctx, config.ServerIndexKey, cacheKey)
+	pipe.ZRem(ctx, config.ExpiryIndexKey, cacheKey)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to delete cache key: %w", err)
 	}
 	return nil
 }
 
+// DeleteServerStates removes several server states and their index entries in one transaction
+func (c *Client) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	members := make([]interface{}, len(cacheKeys))
+	for i, key := range cacheKeys {
+		members[i] = key
+	}
+
+	pipe := c.client.TxPipeline()
+	pipe.Del(ctx, cacheKeys...)
+	pipe.SRem(ctx, config.ServerIndexKey, members...)
+	pipe.ZRem(ctx, config.ExpiryIndexKey, members...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete cache keys: %w", err)
+	}
+	return nil
+}
+
+// UserHashKey constructs the key mapping a label hash back to its webuserid
+func UserHashKey(hash string) string {
+	return config.UserHashPrefix + hash
+}
+
+// PushUserHash stores the mapping from a provider label hash to the web user ID
+func (c *Client) PushUserHash(ctx context.Context, hash string, webUserID string, ttl time.Duration) error {
+	if err := c.client.Set(ctx, UserHashKey(hash), webUserID, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store user hash: %w", err)
+	}
+	return nil
+}
+
+// GetUserByHash resolves a provider label hash to the web user ID
+func (c *Client) GetUserByHash(ctx context.Context, hash string) (string, error) {
+	webUserID, err := c.client.Get(ctx, UserHashKey(hash)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", errs.New("user hash not found", errs.ErrNotFound)
+		}
+		return "", fmt.Errorf("failed to get user hash: %w", err)
+	}
+	return webUserID, nil
+}
+
+// GetSecret reads a secret stored as a plain string, e.g. a provider token written by a rotation job
+func (c *Client) GetSecret(ctx context.Context, key string) (string, error) {
+	value, err := c.client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", errs.Mark(fmt.Errorf("secret %s not found", key), errs.ErrNotFound)
+		}
+		return "", fmt.Errorf("failed to get secret %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// Rate-limited operations of a user, each with a window of its own
+const (
+	RateLimitStart   = "provision"    // start of a lab while none is cached
+	RateLimitSwitch  = "switch"       // start of another lab than the cached one
+	RateLimitStop    = "decommission" // stop of the user's lab
+	RateLimitExtend  = "extend"       // extension of the user's session
+	RateLimitRebuild = "rebuild"      // reinstall of the user's server
+)
+
 // RateLimitKey constructs a rate limit key for a user and operation
 func RateLimitKey(webUserID string, operation string) string {
-	return fmt.Sprintf("vmmanager:ratelimit:%s:%s", webUserID, operation)
+	return config.RateLimitPrefix + webUserID + ":" + operation
 }
 
 // TryAcquireRateLimit attempts to acquire a rate limit lock atomically.
@@ -184,8 +664,139 @@ func (c *Client) TryAcquireRateLimit(ctx context.Context, webUserID string, oper
 	// Atomic SET NX with TTL - only succeeds if key doesn't exist
 	success, err := c.client.SetNX(ctx, key, "1", ttl).Result()
 	if err != nil {
-		return false, fmt.Errorf("failed to acquire rate limit: %w", err)
+		return false, fmt.Errorf("failed to acquire rate limit: %w", transient(err))
 	}
 
 	return success, nil
 }
+
+// AdmissionDecision is the outcome of an atomic provision admission check
+type AdmissionDecision string
+
+const (
+	AdmissionAccepted    AdmissionDecision = "accepted"     // No cached server, initial state written
+	AdmissionReplaced    AdmissionDecision = "replaced"     // Cached server belongs to another lab, initial state written over it
+	AdmissionDuplicate   AdmissionDecision = "duplicate"    // Cached server already serves the requested lab, nothing written
+	AdmissionRateLimited AdmissionDecision = "rate_limited" // User is inside the start or switch window, nothing written
+)
+
+// AdmissionLimits are the rate limit windows of a provision admission. A window of 0 is
+// not taken, for admin overrides.
+type AdmissionLimits struct {
+	Start  time.Duration // taken when the user has no cached server
+	Switch time.Duration // taken when the cached server runs another lab, and opened by a start
+}
+
+// AdmissionResult is returned by AdmitProvision
+type AdmissionResult struct {
+	Decision AdmissionDecision
+	Existing *ServerState // State that was cached before admission (nil if none)
+	Version  int64        // Version of the written initial state (0 if nothing was written)
+}
+
+// admitProvisionScript performs duplicate detection, rate limiting and the initial state
+// write in one round trip so concurrent requests for the same user can't interleave.
+// A duplicate takes no window; otherwise the start or, over another lab, the switch window.
+// A start also opens the switch window, so the new lab isn't switched away at once.
+// The written state continues the version sequence of the entry it replaces.
+// KEYS[1] = cache key, KEYS[2] = start rate limit key, KEYS[3] = server index key, KEYS[4] = expiry index key,
+// KEYS[5] = switch rate limit key
+// ARGV[1] = initial state JSON, ARGV[2] = labId, ARGV[3] = start window (ms), ARGV[4] = cache TTL (ms),
+// ARGV[5] = expiresAt (unix ms), ARGV[6] = switch window (ms); a window of 0 is not taken
+var admitProvisionScript = redis.NewScript(`
+local existing = redis.call('GET', KEYS[1])
+local version = 0
+local limitKey, window = KEYS[2], ARGV[3]
+if existing then
+	local ok, cached = pcall(cjson.decode, existing)
+	if ok then
+		if tonumber(cached['labId']) == tonumber(ARGV[2]) then
+			return {'duplicate', existing, 0}
+		end
+		version = tonumber(cached['version'] or 0)
+	end
+	limitKey, window = KEYS[5], ARGV[6]
+end
+if tonumber(window) > 0 and not redis.call('SET', limitKey, '1', 'PX', window, 'NX') then
+	return {'rate_limited', existing or '', 0}
+end
+if not existing and tonumber(ARGV[6]) > 0 then
+	redis.call('SET', KEYS[5], '1', 'PX', ARGV[6])
+end
+local state = cjson.decode(ARGV[1])
+state['version'] = version + 1
+redis.call('SET', KEYS[1], cjson.encode(state), 'PX', ARGV[4])
+redis.call('SADD', KEYS[3], KEYS[1])
+redis.call('ZADD', KEYS[4], ARGV[5], KEYS[1])
+if existing then
+	return {'replaced', existing, version + 1}
+end
+return {'accepted', '', version + 1}
+`)
+
+// AdmitProvision atomically decides whether a provision request may proceed.
+// A request for the lab already cached is a duplicate. Any other takes the start window,
+// which also opens the switch window, or the switch window if another lab is cached, and writes the given initial state to
+// cacheKey before the script returns; its version is reported in the result so the caller
+// can continue writing with PushServerState.
+func (c *Client) AdmitProvision(ctx context.Context, cacheKey string, state ServerState, limits AdmissionLimits, cacheTTL time.Duration) (*AdmissionResult, error) {
+	data, err := c.marshalState(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal server state: %w", err)
+	}
+
+	userID := TenantUserID(state.Tenant, state.WebUserID)
+	keys := []string{cacheKey, RateLimitKey(userID, RateLimitStart), config.ServerIndexKey, config.ExpiryIndexKey, RateLimitKey(userID, RateLimitSwitch)}
+	reply, err := admitProvisionScript.Run(ctx, c.client, keys, string(data), state.LabID, limits.Start.Milliseconds(),
+		cacheTTL.Milliseconds(), state.ExpiresAt.UnixMilli(), limits.Switch.Milliseconds()).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run admission script: %w", transient(err))
+	}
+
+	result, err := parseAdmissionReply(reply)
+	if err != nil {
+		return nil, err
+	}
+	if result.Existing != nil {
+		if err := c.decryptState(result.Existing); err != nil {
+			return nil, fmt.Errorf("failed to decrypt existing server state: %w", err)
+		}
+		if err := migrateState(result.Existing); err != nil {
+			return nil, fmt.Errorf("failed to migrate existing server state: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// parseAdmissionReply converts the admission script reply into an AdmissionResult
+func parseAdmissionReply(reply []interface{}) (*AdmissionResult, error) {
+	if len(reply) != 3 {
+		return nil, fmt.Errorf("unexpected admission reply length: %d", len(reply))
+	}
+
+	decision, ok := reply[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected admission decision type: %T", reply[0])
+	}
+
+	result := &AdmissionResult{Decision: AdmissionDecision(decision)}
+	switch result.Decision {
+	case AdmissionAccepted, AdmissionReplaced, AdmissionDuplicate, AdmissionRateLimited:
+	default:
+		return nil, fmt.Errorf("unknown admission decision: %q", decision)
+	}
+
+	if existing, ok := reply[1].(string); ok && existing != "" {
+		var state ServerState
+		if err := json.Unmarshal([]byte(existing), &state); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal existing server state: %w", err)
+		}
+		result.Existing = &state
+	}
+
+	if version, ok := reply[2].(int64); ok {
+		result.Version = version
+	}
+
+	return result, nil
+}
@@ -2,10 +2,16 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
 )
 
 // Integration tests require a running Redis instance
@@ -239,6 +245,36 @@ func TestPopPayloadTimeout(t *testing.T) {
 	}
 }
 
+func TestPopAnyPayload(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	queues := []string{"test:queue:high", "test:queue:low"}
+
+	if err := client.PushPayload(ctx, "test:queue:low", "low"); err != nil {
+		t.Fatalf("Failed to push to queue: %v", err)
+	}
+	if err := client.PushPayload(ctx, "test:queue:high", "high"); err != nil {
+		t.Fatalf("Failed to push to queue: %v", err)
+	}
+
+	// Earlier queues are served first
+	for _, want := range []string{"high", "low"} {
+		queueKey, payload, err := client.PopAnyPayload(ctx, queues, time.Second)
+		if err != nil {
+			t.Fatalf("PopAnyPayload failed: %v", err)
+		}
+		if payload != want || queueKey != "test:queue:"+want {
+			t.Errorf("PopAnyPayload = %q from %q, want %q", payload, queueKey, want)
+		}
+	}
+
+	if _, _, err := client.PopAnyPayload(ctx, queues, time.Second); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected ErrNotFound from empty queues, got %v", err)
+	}
+}
+
 func TestGetAllServerStates(t *testing.T) {
 	client, cleanup := setupTestRedis(t)
 	defer cleanup()
@@ -372,3 +408,961 @@ func TestConcurrentOperations(t *testing.T) {
 		t.Errorf("Expected 10 servers, got %d", len(allStates))
 	}
 }
+
+func TestAdmitProvision(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	cacheKey := ServerCacheKey("admit-user")
+	state := ServerState{
+		User:      "student",
+		Status:    "provisioning",
+		WebUserID: "admit-user",
+		LabID:     5,
+	}
+	limits := AdmissionLimits{Start: 10 * time.Second, Switch: 10 * time.Second}
+
+	// First request is accepted and writes the initial state
+	result, err := client.AdmitProvision(ctx, cacheKey, state, limits, time.Minute)
+	if err != nil {
+		t.Fatalf("AdmitProvision failed: %v", err)
+	}
+	if result.Decision != AdmissionAccepted {
+		t.Errorf("Decision = %v, want %v", result.Decision, AdmissionAccepted)
+	}
+	cached, err := client.GetServerState(ctx, cacheKey)
+	if err != nil {
+		t.Fatalf("GetServerState failed: %v", err)
+	}
+	if cached.LabID != 5 || cached.Status != "provisioning" {
+		t.Errorf("unexpected cached state: %+v", cached)
+	}
+
+	// Same lab is a duplicate, inside the window or not
+	result, err = client.AdmitProvision(ctx, cacheKey, state, limits, time.Minute)
+	if err != nil {
+		t.Fatalf("AdmitProvision failed: %v", err)
+	}
+	if result.Decision != AdmissionDuplicate || result.Existing == nil {
+		t.Errorf("Decision = %v (existing %v), want %v with existing state", result.Decision, result.Existing, AdmissionDuplicate)
+	}
+
+	// The start opened the switch window
+	state.LabID = 7
+	result, err = client.AdmitProvision(ctx, cacheKey, state, limits, time.Minute)
+	if err != nil {
+		t.Fatalf("AdmitProvision failed: %v", err)
+	}
+	if result.Decision != AdmissionRateLimited {
+		t.Errorf("Decision = %v, want %v", result.Decision, AdmissionRateLimited)
+	}
+
+	// Different lab after the switch window replaces the cached state and returns the previous one
+	client.client.Del(ctx, RateLimitKey("admit-user", RateLimitSwitch))
+	result, err = client.AdmitProvision(ctx, cacheKey, state, limits, time.Minute)
+	if err != nil {
+		t.Fatalf("AdmitProvision failed: %v", err)
+	}
+	if result.Decision != AdmissionReplaced {
+		t.Errorf("Decision = %v, want %v", result.Decision, AdmissionReplaced)
+	}
+	if result.Existing == nil || result.Existing.LabID != 5 {
+		t.Errorf("Existing = %+v, want previous state with LabID 5", result.Existing)
+	}
+	cached, err = client.GetServerState(ctx, cacheKey)
+	if err != nil {
+		t.Fatalf("GetServerState failed: %v", err)
+	}
+	if cached.LabID != 7 {
+		t.Errorf("cached LabID = %d, want 7", cached.LabID)
+	}
+
+	// Another switch inside the switch window is rate limited
+	state.LabID = 9
+	result, err = client.AdmitProvision(ctx, cacheKey, state, limits, time.Minute)
+	if err != nil {
+		t.Fatalf("AdmitProvision failed: %v", err)
+	}
+	if result.Decision != AdmissionRateLimited {
+		t.Errorf("Decision = %v, want %v", result.Decision, AdmissionRateLimited)
+	}
+
+	// A restart after a stop is inside the start window
+	client.client.Del(ctx, cacheKey)
+	result, err = client.AdmitProvision(ctx, cacheKey, state, limits, time.Minute)
+	if err != nil {
+		t.Fatalf("AdmitProvision failed: %v", err)
+	}
+	if result.Decision != AdmissionRateLimited {
+		t.Errorf("Decision = %v, want %v", result.Decision, AdmissionRateLimited)
+	}
+}
+
+func TestPushServerState_VersionConflict(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	cacheKey := ServerCacheKey("version-user")
+	state := ServerState{WebUserID: "version-user", LabID: 1, Status: "provisioning"}
+
+	// First write against a missing entry (version 0)
+	if err := client.PushServerState(ctx, cacheKey, state, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+
+	cached, err := client.GetServerState(ctx, cacheKey)
+	if err != nil {
+		t.Fatalf("GetServerState failed: %v", err)
+	}
+	if cached.Version != 1 {
+		t.Errorf("Version = %d, want 1", cached.Version)
+	}
+
+	// Writing with the stale version 0 must be rejected
+	state.Status = "running"
+	err = client.PushServerState(ctx, cacheKey, state, time.Minute)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+
+	// Writing with the fresh version succeeds
+	cached.Status = "running"
+	if err := client.PushServerState(ctx, cacheKey, *cached, time.Minute); err != nil {
+		t.Fatalf("PushServerState with fresh version failed: %v", err)
+	}
+}
+
+func TestUpdateServerState(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	cacheKey := ServerCacheKey("update-user")
+	if err := client.PushServerState(ctx, cacheKey, ServerState{WebUserID: "update-user", LabID: 1}, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+
+	calls := 0
+	updated, err := UpdateServerState(ctx, client, cacheKey, time.Minute, func(state *ServerState) error {
+		calls++
+		if calls == 1 {
+			// Simulate a concurrent writer sneaking in between read and write
+			concurrent := *state
+			concurrent.CloudStatus = "starting"
+			if err := client.PushServerState(ctx, cacheKey, concurrent, time.Minute); err != nil {
+				t.Fatalf("concurrent PushServerState failed: %v", err)
+			}
+		}
+		state.Status = "running"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateServerState failed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("mutate called %d times, want 2", calls)
+	}
+	if updated.Version != 3 {
+		t.Errorf("Version = %d, want 3", updated.Version)
+	}
+
+	// Both the concurrent write and ours are preserved
+	cached, err := client.GetServerState(ctx, cacheKey)
+	if err != nil {
+		t.Fatalf("GetServerState failed: %v", err)
+	}
+	if cached.Status != "running" || cached.CloudStatus != "starting" {
+		t.Errorf("lost update: %+v", cached)
+	}
+}
+
+func TestGetAllServerStates_PrunesStaleIndexEntries(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	liveKey := ServerCacheKey("live-user")
+	goneKey := ServerCacheKey("gone-user")
+
+	if err := client.PushServerState(ctx, liveKey, ServerState{WebUserID: "live-user", LabID: 1}, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+	if err := client.PushServerState(ctx, goneKey, ServerState{WebUserID: "gone-user", LabID: 2}, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+
+	// Simulate TTL expiry: the entry disappears without the index being updated
+	client.client.Del(ctx, goneKey)
+
+	states, err := client.GetAllServerStates(ctx, "vmmanager:servers:")
+	if err != nil {
+		t.Fatalf("GetAllServerStates failed: %v", err)
+	}
+	if len(states) != 1 || states[0].WebUserID != "live-user" {
+		t.Errorf("expected only live-user, got %+v", states)
+	}
+
+	isMember, err := client.client.SIsMember(ctx, "vmmanager:index:servers", goneKey).Result()
+	if err != nil {
+		t.Fatalf("SIsMember failed: %v", err)
+	}
+	if isMember {
+		t.Error("expected expired key to be pruned from the index")
+	}
+}
+
+func TestPrimeServerCache(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// Entries written by an older version are not in the index
+	legacy := `{"user":"student","serverId":"server-1","webUserId":"legacy-user","labId":3}`
+	client.client.Set(ctx, ServerCacheKey("legacy-user"), legacy, time.Minute)
+
+	states, err := client.GetAllServerStates(ctx, "vmmanager:servers:")
+	if err != nil {
+		t.Fatalf("GetAllServerStates failed: %v", err)
+	}
+	if len(states) != 0 {
+		t.Fatalf("expected no indexed states before priming, got %d", len(states))
+	}
+
+	// An index member whose entry is gone
+	goneKey := ServerCacheKey("gone-user")
+	client.client.SAdd(ctx, "vmmanager:index:servers", goneKey)
+
+	summary, err := client.PrimeServerCache(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("PrimeServerCache failed: %v", err)
+	}
+	if len(summary.States) != 1 || summary.Pruned != 1 {
+		t.Errorf("expected 1 entry and 1 pruned member, got %d and %d", len(summary.States), summary.Pruned)
+	}
+	isMember, err := client.client.SIsMember(ctx, "vmmanager:index:servers", goneKey).Result()
+	if err != nil {
+		t.Fatalf("SIsMember failed: %v", err)
+	}
+	if isMember {
+		t.Error("expected the gone key to be pruned from the index")
+	}
+
+	states, err = client.GetAllServerStates(ctx, "vmmanager:servers:")
+	if err != nil {
+		t.Fatalf("GetAllServerStates failed: %v", err)
+	}
+	if len(states) != 1 || states[0].WebUserID != "legacy-user" {
+		t.Errorf("expected legacy-user after priming, got %+v", states)
+	}
+
+	// Once the indexes carry the current version, later startups read them instead of scanning
+	client.client.Set(ctx, ServerCacheKey("unindexed-user"), legacy, time.Minute)
+	client.client.SAdd(ctx, "vmmanager:index:servers", goneKey)
+	again, err := client.PrimeServerCache(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("repeated PrimeServerCache failed: %v", err)
+	}
+	if !summary.Scanned || again.Scanned {
+		t.Errorf("expected only the first startup to scan, got %v and %v", summary.Scanned, again.Scanned)
+	}
+	if len(again.States) != 1 || again.Pruned != 1 {
+		t.Errorf("expected the indexed entry and 1 pruned member, got %d and %d", len(again.States), again.Pruned)
+	}
+
+	// Removing the version key makes the next startup scan again
+	client.client.Del(ctx, "vmmanager:index:version")
+	rescanned, err := client.PrimeServerCache(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("PrimeServerCache after removing the version failed: %v", err)
+	}
+	if !rescanned.Scanned || len(rescanned.States) != 2 {
+		t.Errorf("expected a scan to find both entries, got %+v", rescanned)
+	}
+}
+
+func TestGetExpiredServerStates(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	expired := ServerState{WebUserID: "expired-user", LabID: 1, ExpiresAt: now.Add(-time.Minute)}
+	active := ServerState{WebUserID: "active-user", LabID: 2, ExpiresAt: now.Add(time.Hour)}
+	if err := client.PushServerState(ctx, ServerCacheKey("expired-user"), expired, time.Hour); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+	if err := client.PushServerState(ctx, ServerCacheKey("active-user"), active, time.Hour); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+
+	states, err := client.GetExpiredServerStates(ctx, now)
+	if err != nil {
+		t.Fatalf("GetExpiredServerStates failed: %v", err)
+	}
+	if len(states) != 1 || states[0].WebUserID != "expired-user" {
+		t.Errorf("expected only expired-user, got %+v", states)
+	}
+
+	// Extending the lease moves the entry out of the expired range
+	expired.Version = states[0].Version
+	expired.ExpiresAt = now.Add(time.Hour)
+	if err := client.PushServerState(ctx, ServerCacheKey("expired-user"), expired, time.Hour); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+
+	states, err = client.GetExpiredServerStates(ctx, now)
+	if err != nil {
+		t.Fatalf("GetExpiredServerStates failed: %v", err)
+	}
+	if len(states) != 0 {
+		t.Errorf("expected no expired states after extension, got %+v", states)
+	}
+
+	if err := client.DeleteServerState(ctx, ServerCacheKey("active-user")); err != nil {
+		t.Fatalf("DeleteServerState failed: %v", err)
+	}
+	if _, err := client.client.ZScore(ctx, "vmmanager:expiry", ServerCacheKey("active-user")).Result(); err == nil {
+		t.Error("expected deleted key to be removed from the expiry index")
+	}
+}
+
+func TestQueryServerStates(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	base := time.Now().Truncate(time.Millisecond)
+
+	// Five running lab-1 servers, two of them sharing an expiry, plus other labs and statuses
+	for i := 0; i < 5; i++ {
+		expiresAt := base.Add(time.Duration(i) * time.Minute)
+		if i == 4 {
+			expiresAt = base.Add(3 * time.Minute)
+		}
+		user := fmt.Sprintf("query-user-%d", i)
+		state := ServerState{WebUserID: user, LabID: 1, Status: "running", ExpiresAt: expiresAt}
+		if err := client.PushServerState(ctx, ServerCacheKey(user), state, time.Hour); err != nil {
+			t.Fatalf("PushServerState failed: %v", err)
+		}
+	}
+	others := map[string]ServerState{
+		"query-other-lab":    {WebUserID: "query-other-lab", LabID: 2, Status: "running", ExpiresAt: base},
+		"query-provisioning": {WebUserID: "query-provisioning", LabID: 1, Status: "provisioning", ExpiresAt: base},
+	}
+	for user, state := range others {
+		if err := client.PushServerState(ctx, ServerCacheKey(user), state, time.Hour); err != nil {
+			t.Fatalf("PushServerState failed: %v", err)
+		}
+	}
+
+	// Page through two at a time
+	filter := StateFilter{Status: "running", LabID: 1, Limit: 2}
+	var users []string
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("paging did not terminate")
+		}
+		page, err := client.QueryServerStates(ctx, filter)
+		if err != nil {
+			t.Fatalf("QueryServerStates failed: %v", err)
+		}
+		for _, state := range page.States {
+			users = append(users, state.WebUserID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	want := []string{"query-user-0", "query-user-1", "query-user-2", "query-user-3", "query-user-4"}
+	if strings.Join(users, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v in expiry order, got %v", want, users)
+	}
+
+	// Expiry window
+	page, err := client.QueryServerStates(ctx, StateFilter{
+		LabID:        1,
+		Status:       "running",
+		ExpiresFrom:  base.Add(time.Minute),
+		ExpiresUntil: base.Add(2 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("QueryServerStates failed: %v", err)
+	}
+	if len(page.States) != 2 || page.NextCursor != "" {
+		t.Errorf("expected 2 states in the window on a single page, got %+v", page)
+	}
+
+	if _, err := client.QueryServerStates(ctx, StateFilter{Cursor: "bogus"}); err == nil {
+		t.Error("expected error for invalid cursor")
+	}
+}
+
+func TestPushServerStates(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	states := map[string]ServerState{
+		ServerCacheKey("batch-user-1"): {WebUserID: "batch-user-1", LabID: 1},
+		ServerCacheKey("batch-user-2"): {WebUserID: "batch-user-2", LabID: 2},
+	}
+
+	if err := client.PushServerStates(ctx, states, time.Minute); err != nil {
+		t.Fatalf("PushServerStates failed: %v", err)
+	}
+
+	for key, want := range states {
+		got, err := client.GetServerState(ctx, key)
+		if err != nil {
+			t.Fatalf("GetServerState(%s) failed: %v", key, err)
+		}
+		if got.LabID != want.LabID || got.Version != 1 {
+			t.Errorf("%s: expected labId %d version 1, got labId %d version %d", key, want.LabID, got.LabID, got.Version)
+		}
+	}
+
+	// Re-sending version 0 conflicts for every key
+	err := client.PushServerStates(ctx, states, time.Minute)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected ErrVersionConflict, got %v", err)
+	}
+}
+
+func TestPushPayloadsAndDeleteServerStates(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	queueKey := "test:batch:queue"
+	defer client.client.Del(ctx, queueKey)
+
+	if err := client.PushPayloads(ctx, queueKey, []string{"a", "b", "c"}); err != nil {
+		t.Fatalf("PushPayloads failed: %v", err)
+	}
+	items, err := client.client.LRange(ctx, queueKey, 0, -1).Result()
+	if err != nil {
+		t.Fatalf("LRange failed: %v", err)
+	}
+	if strings.Join(items, ",") != "a,b,c" {
+		t.Errorf("expected payloads in order a,b,c, got %v", items)
+	}
+
+	keys := []string{ServerCacheKey("del-user-1"), ServerCacheKey("del-user-2")}
+	for i, key := range keys {
+		if err := client.PushServerState(ctx, key, ServerState{LabID: i}, time.Minute); err != nil {
+			t.Fatalf("PushServerState failed: %v", err)
+		}
+	}
+
+	if err := client.DeleteServerStates(ctx, keys); err != nil {
+		t.Fatalf("DeleteServerStates failed: %v", err)
+	}
+
+	for _, key := range keys {
+		if _, err := client.GetServerState(ctx, key); err == nil {
+			t.Errorf("expected %s to be deleted", key)
+		}
+		isMember, err := client.client.SIsMember(ctx, "vmmanager:index:servers", key).Result()
+		if err != nil {
+			t.Fatalf("SIsMember failed: %v", err)
+		}
+		if isMember {
+			t.Errorf("expected %s to be removed from the index", key)
+		}
+	}
+}
+
+func TestPushAndGetUserHash(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if _, err := client.GetUserByHash(ctx, "unknown-hash"); err == nil {
+		t.Error("expected error for unknown hash")
+	}
+
+	if err := client.PushUserHash(ctx, "abc123", "user-123", time.Minute); err != nil {
+		t.Fatalf("PushUserHash failed: %v", err)
+	}
+	webUserID, err := client.GetUserByHash(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("GetUserByHash failed: %v", err)
+	}
+	if webUserID != "user-123" {
+		t.Errorf("expected user-123, got %q", webUserID)
+	}
+}
+
+func TestPushAndPopHandoffEntries(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	entries, err := client.PopHandoffEntries(ctx)
+	if err != nil {
+		t.Fatalf("PopHandoffEntries on empty list failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries, got %d", len(entries))
+	}
+
+	pushed := []HandoffEntry{
+		{CacheKey: ServerCacheKey("user1"), ServerID: "1", CloudStatus: "starting", State: ServerState{LabID: 1, Version: 2}},
+		{CacheKey: ServerCacheKey("user2"), ServerID: "2", CloudStatus: "initializing", State: ServerState{LabID: 2, Version: 1}},
+	}
+	if err := client.PushHandoffEntries(ctx, pushed); err != nil {
+		t.Fatalf("PushHandoffEntries failed: %v", err)
+	}
+
+	entries, err = client.PopHandoffEntries(ctx)
+	if err != nil {
+		t.Fatalf("PopHandoffEntries failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].ServerID != "1" || entries[1].State.Version != 1 {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+
+	// Entries are adopted once
+	entries, err = client.PopHandoffEntries(ctx)
+	if err != nil {
+		t.Fatalf("second PopHandoffEntries failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected handoff list to be drained, got %d entries", len(entries))
+	}
+}
+
+func TestPendingCreateJournal(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for _, name := range []string{"lab-1-a", "lab-2-b"} {
+		if err := client.RecordPendingCreate(ctx, PendingCreate{Name: name, WebUserID: "user1", LabID: 1, InstanceID: "swim-a"}); err != nil {
+			t.Fatalf("RecordPendingCreate failed: %v", err)
+		}
+	}
+	if err := client.ClearPendingCreate(ctx, "lab-1-a"); err != nil {
+		t.Fatalf("ClearPendingCreate failed: %v", err)
+	}
+
+	pending, err := client.ListPendingCreates(ctx)
+	if err != nil {
+		t.Fatalf("ListPendingCreates failed: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Name != "lab-2-b" || pending[0].InstanceID != "swim-a" {
+		t.Errorf("unexpected pending creates: %+v", pending)
+	}
+}
+
+func TestPublishAndListInstances(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	started := time.Now().UTC().Truncate(time.Second)
+
+	if err := client.PublishInstance(ctx, InstanceInfo{ID: "swim-b", Status: "running", Version: "1.0.0", Provider: "hcloud", StartedAt: started}, time.Minute); err != nil {
+		t.Fatalf("PublishInstance failed: %v", err)
+	}
+	if err := client.PublishInstance(ctx, InstanceInfo{ID: "swim-a", Status: "draining", StartedAt: started}, time.Minute); err != nil {
+		t.Fatalf("PublishInstance failed: %v", err)
+	}
+	if err := client.PublishInstance(ctx, InstanceInfo{ID: "swim-dead"}, 50*time.Millisecond); err != nil {
+		t.Fatalf("PublishInstance failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	instances, err := client.ListInstances(ctx)
+	if err != nil {
+		t.Fatalf("ListInstances failed: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 live instances, got %d", len(instances))
+	}
+	if instances[0].ID != "swim-a" || instances[1].ID != "swim-b" {
+		t.Errorf("expected instances ordered by ID, got %s, %s", instances[0].ID, instances[1].ID)
+	}
+	if instances[1].Version != "1.0.0" || !instances[1].StartedAt.Equal(started) {
+		t.Errorf("unexpected metadata: %+v", instances[1])
+	}
+
+	isMember, err := client.client.SIsMember(ctx, "vmmanager:index:instances", "swim-dead").Result()
+	if err != nil {
+		t.Fatalf("SIsMember failed: %v", err)
+	}
+	if isMember {
+		t.Error("expected dead instance to be pruned from the index")
+	}
+
+	alive, err := client.IsInstanceAlive(ctx, "swim-b")
+	if err != nil || !alive {
+		t.Errorf("expected swim-b alive, got %v (err %v)", alive, err)
+	}
+	alive, err = client.IsInstanceAlive(ctx, "swim-dead")
+	if err != nil || alive {
+		t.Errorf("expected swim-dead not alive, got %v (err %v)", alive, err)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < config.MaxEvents+5; i++ {
+		event := Event{Type: EventProvisionFailed, WebUserID: fmt.Sprintf("event-user-%d", i)}
+		if err := client.RecordEvent(ctx, event); err != nil {
+			t.Fatalf("RecordEvent failed: %v", err)
+		}
+	}
+
+	events, err := client.RecentEvents(ctx, config.MaxEvents*2)
+	if err != nil {
+		t.Fatalf("RecentEvents failed: %v", err)
+	}
+	if len(events) != config.MaxEvents {
+		t.Fatalf("expected list trimmed to %d events, got %d", config.MaxEvents, len(events))
+	}
+	if events[0].WebUserID != fmt.Sprintf("event-user-%d", config.MaxEvents+4) || events[0].At.IsZero() {
+		t.Errorf("expected newest event first with a timestamp, got %+v", events[0])
+	}
+
+	if err := client.client.RPush(ctx, config.ProvisionQueueKey, "a", "b").Err(); err != nil {
+		t.Fatalf("RPush failed: %v", err)
+	}
+	depths, err := client.QueueDepths(ctx, config.ProvisionQueueKey, config.DecommissionQueueKey)
+	if err != nil {
+		t.Fatalf("QueueDepths failed: %v", err)
+	}
+	if depths[config.ProvisionQueueKey] != 2 || depths[config.DecommissionQueueKey] != 0 {
+		t.Errorf("unexpected queue depths: %v", depths)
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	userID := TenantUserID("acme", "history-user")
+	for i := 0; i < config.MaxHistory+5; i++ {
+		event := Event{Type: EventProvisionStarted, WebUserID: "history-user", Tenant: "acme", LabID: i}
+		if err := client.RecordHistory(ctx, userID, event); err != nil {
+			t.Fatalf("RecordHistory failed: %v", err)
+		}
+	}
+
+	events, err := client.UserHistory(ctx, userID, config.MaxHistory*2)
+	if err != nil {
+		t.Fatalf("UserHistory failed: %v", err)
+	}
+	if len(events) != config.MaxHistory {
+		t.Fatalf("expected history trimmed to %d events, got %d", config.MaxHistory, len(events))
+	}
+	if events[0].LabID != config.MaxHistory+4 || events[0].At.IsZero() {
+		t.Errorf("expected newest event first with a timestamp, got %+v", events[0])
+	}
+	if ttl := client.client.TTL(ctx, HistoryKey(userID)).Val(); ttl <= 0 || ttl > config.HistoryTTL {
+		t.Errorf("expected history to expire within %v, got %v", config.HistoryTTL, ttl)
+	}
+
+	// Other users and tenants keep their own history
+	if events, err := client.UserHistory(ctx, "history-user", 10); err != nil || len(events) != 0 {
+		t.Errorf("expected no history for the default tenant's user, got %+v, %v", events, err)
+	}
+}
+
+func TestTakeCreateToken(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+	ctx := context.Background()
+	client.client.Del(ctx, config.CreateBucketKey)
+
+	// The burst is available at once, then tokens come at the rate
+	for i := 0; i < 3; i++ {
+		wait, err := client.TakeCreateToken(ctx, 2, 3)
+		if err != nil {
+			t.Fatalf("TakeCreateToken failed: %v", err)
+		}
+		if wait != 0 {
+			t.Fatalf("expected token %d of the burst, got a wait of %v", i+1, wait)
+		}
+	}
+	wait, err := client.TakeCreateToken(ctx, 2, 3)
+	if err != nil {
+		t.Fatalf("TakeCreateToken failed: %v", err)
+	}
+	if wait <= 0 || wait > 500*time.Millisecond {
+		t.Fatalf("expected a wait of up to 500ms once the burst is used, got %v", wait)
+	}
+
+	time.Sleep(wait)
+	if wait, err := client.TakeCreateToken(ctx, 2, 3); err != nil || wait != 0 {
+		t.Errorf("expected a token after waiting, got %v, %v", wait, err)
+	}
+}
+
+func TestEncryptedServerState(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+	client.WithEncryption(testCipher(t))
+
+	ctx := context.Background()
+	key := ServerCacheKey("encrypted-user")
+	state := ServerState{Address: "2001:db8::1", Status: config.StatusRunning, WebUserID: "encrypted-user", LabID: 3, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := client.PushServerState(ctx, key, state, time.Hour); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+
+	raw, err := client.client.Get(ctx, key).Result()
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if strings.Contains(raw, "2001:db8::1") {
+		t.Errorf("expected the address to be encrypted in Redis, got %s", raw)
+	}
+
+	got, err := client.GetServerState(ctx, key)
+	if err != nil || got.Address != "2001:db8::1" || got.Version != 1 {
+		t.Errorf("expected decrypted state at version 1, got %+v, %v", got, err)
+	}
+
+	// Version checks in the Lua scripts still work on encrypted entries
+	got.Status = config.StatusStopping
+	if err := client.PushServerState(ctx, key, *got, time.Hour); err != nil {
+		t.Errorf("expected versioned update to succeed, got %v", err)
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	at := time.Now().Add(-5 * time.Minute).Truncate(time.Second)
+	if err := client.RecordActivity(ctx, "user-1", at, time.Hour); err != nil {
+		t.Fatalf("RecordActivity failed: %v", err)
+	}
+	client.client.Set(ctx, ActivityKey("cs101:user-2"), at.Unix(), time.Hour)
+	client.client.Set(ctx, ActivityKey("user-3"), "not a timestamp", time.Hour)
+
+	activity, err := client.LastActivity(ctx, []string{"user-1", "cs101:user-2", "user-3", "user-4"})
+	if err != nil {
+		t.Fatalf("LastActivity failed: %v", err)
+	}
+	if len(activity) != 2 || !activity["user-1"].Equal(at) || !activity["cs101:user-2"].Equal(at) {
+		t.Errorf("expected activity of user-1 and cs101:user-2 at %v, got %v", at, activity)
+	}
+}
+
+func TestAppendSession(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	record := SessionRecord{WebUserID: "user-1", LabID: 5, ServerID: "123", Provider: "hcloud", ExitReason: ExitUser,
+		EndedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := client.AppendSession(ctx, record, 0); err != nil {
+		t.Fatalf("AppendSession failed: %v", err)
+	}
+
+	entries, err := client.client.XRange(ctx, config.SessionsKey, "-", "+").Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one stream entry, got %+v, %v", entries, err)
+	}
+	var archived SessionRecord
+	if err := json.Unmarshal([]byte(entries[0].Values["record"].(string)), &archived); err != nil {
+		t.Fatalf("invalid record: %v", err)
+	}
+	if archived != record {
+		t.Errorf("expected %+v, got %+v", record, archived)
+	}
+
+	read, err := client.ReadSessions(ctx, record.EndedAt.Add(-time.Minute))
+	if err != nil || len(read) != 1 || read[0] != record {
+		t.Errorf("expected ReadSessions to return %+v, got %+v, %v", record, read, err)
+	}
+	if read, err := client.ReadSessions(ctx, record.EndedAt.Add(time.Minute)); err != nil || len(read) != 0 {
+		t.Errorf("expected no sessions ended later, got %+v, %v", read, err)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	tombstone := Tombstone{WebUserID: "user-1", LabID: 5, Tenant: "cs101", ServerID: "123", DeletedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := client.PushTombstone(ctx, tombstone, time.Minute); err != nil {
+		t.Fatalf("PushTombstone failed: %v", err)
+	}
+
+	taken, err := client.TakeTombstone(ctx, "cs101:user-1")
+	if err != nil {
+		t.Fatalf("TakeTombstone failed: %v", err)
+	}
+	if *taken != tombstone {
+		t.Errorf("expected %+v, got %+v", tombstone, *taken)
+	}
+
+	// A tombstone can be taken only once
+	if _, err := client.TakeTombstone(ctx, "cs101:user-1"); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestExtensionCounter(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	at := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	for want := 1; want <= 2; want++ {
+		count, ok, err := client.AcquireExtension(ctx, "cs101:user-1", at, 2)
+		if err != nil || !ok || count != want {
+			t.Fatalf("expected extension %d to be counted, got %d, %v, %v", want, count, ok, err)
+		}
+	}
+	if count, ok, err := client.AcquireExtension(ctx, "cs101:user-1", at, 2); err != nil || ok || count != 2 {
+		t.Errorf("expected the limit to refuse a third extension, got %d, %v, %v", count, ok, err)
+	}
+
+	// A released extension frees its slot, and the count starts over the next day
+	if err := client.ReleaseExtension(ctx, "cs101:user-1", at); err != nil {
+		t.Fatalf("ReleaseExtension failed: %v", err)
+	}
+	if _, ok, err := client.AcquireExtension(ctx, "cs101:user-1", at, 2); err != nil || !ok {
+		t.Errorf("expected the released slot to be counted again, got %v, %v", ok, err)
+	}
+	if count, ok, err := client.AcquireExtension(ctx, "cs101:user-1", at.Add(2*time.Hour), 2); err != nil || !ok || count != 1 {
+		t.Errorf("expected a fresh count the next day, got %d, %v, %v", count, ok, err)
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for want := int64(1); want <= 2; want++ {
+		if seq, err := client.NextSequence(ctx, "cs101:user-1"); err != nil || seq != want {
+			t.Fatalf("expected sequence number %d, got %d, %v", want, seq, err)
+		}
+	}
+
+	// The later request is applied first, the earlier one arrives late
+	if ok, applied, err := client.ApplySequence(ctx, "cs101:user-1", 2); err != nil || !ok || applied != 2 {
+		t.Fatalf("expected 2 to be applied, got %v, %d, %v", ok, applied, err)
+	}
+	for _, seq := range []int64{1, 2} {
+		if ok, applied, err := client.ApplySequence(ctx, "cs101:user-1", seq); err != nil || ok || applied != 2 {
+			t.Errorf("expected %d to be stale after 2, got %v, %d, %v", seq, ok, applied, err)
+		}
+	}
+
+	// A number applied from a producer's own numbering raises the issued counter
+	if ok, _, err := client.ApplySequence(ctx, "cs101:user-1", 10); err != nil || !ok {
+		t.Fatalf("expected 10 to be applied, got %v, %v", ok, err)
+	}
+	if seq, err := client.NextSequence(ctx, "cs101:user-1"); err != nil || seq != 11 {
+		t.Errorf("expected the next number to follow the applied one, got %d, %v", seq, err)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	state := ServerState{WebUserID: "alice", LabID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := client.PushServerState(ctx, ServerCacheKey("alice"), state, time.Hour); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+	client.client.RPush(ctx, config.ProvisionQueueKey, `{"webuserid":"bob","labId":2}`)
+	handoff := HandoffEntry{CacheKey: ServerCacheKey("alice"), ServerID: "srv-1", State: state}
+	if err := client.PushHandoffEntries(ctx, []HandoffEntry{handoff}); err != nil {
+		t.Fatalf("PushHandoffEntries failed: %v", err)
+	}
+
+	// A live instance in the source namespace stops the migration
+	if err := client.PublishInstance(ctx, InstanceInfo{ID: "swim-1"}, time.Minute); err != nil {
+		t.Fatalf("PublishInstance failed: %v", err)
+	}
+	if _, err := client.MigrateKeys(ctx, "vmmanager", "labs-prod", KeyMigrationOptions{}); err == nil {
+		t.Fatal("expected a live heartbeat to stop the migration")
+	}
+	client.client.Del(ctx, InstanceKey("swim-1"))
+
+	// Copy first, then rename: the second run only deletes the originals
+	copied, err := client.MigrateKeys(ctx, "vmmanager", "labs-prod", KeyMigrationOptions{Copy: true})
+	if err != nil {
+		t.Fatalf("MigrateKeys with Copy failed: %v", err)
+	}
+	if copied.Moved == 0 || len(copied.Conflicts) != 0 {
+		t.Fatalf("expected keys copied without conflicts, got %+v", copied)
+	}
+	if exists, _ := client.client.Exists(ctx, ServerCacheKey("alice")).Result(); exists != 1 {
+		t.Error("expected Copy to keep the original cache entry")
+	}
+	again, err := client.MigrateKeys(ctx, "vmmanager", "labs-prod", KeyMigrationOptions{Copy: true})
+	if err != nil {
+		t.Fatalf("repeated MigrateKeys failed: %v", err)
+	}
+	if again.Moved != 0 || again.Skipped != copied.Moved {
+		t.Errorf("expected a repeated copy to skip every key, got %+v", again)
+	}
+
+	renamed, err := client.MigrateKeys(ctx, "vmmanager", "labs-prod", KeyMigrationOptions{})
+	if err != nil {
+		t.Fatalf("MigrateKeys failed: %v", err)
+	}
+	if renamed.Moved != copied.Moved || len(renamed.Conflicts) != 0 {
+		t.Errorf("expected the rename to finish the copied keys, got %+v", renamed)
+	}
+	if left, _ := client.scanKeys(ctx, "vmmanager:*"); len(left) != 0 {
+		t.Errorf("expected no keys left in the old namespace, got %v", left)
+	}
+
+	// The moved entry is found through the indexes of the new namespace
+	if member, _ := client.client.SIsMember(ctx, "labs-prod:index:servers", "labs-prod:servers:alice").Result(); !member {
+		t.Error("expected the server index to name the moved cache key")
+	}
+	if _, err := client.client.ZScore(ctx, "labs-prod:expiry", "labs-prod:servers:alice").Result(); err != nil {
+		t.Errorf("expected the expiry index to name the moved cache key: %v", err)
+	}
+	if ttl, _ := client.client.TTL(ctx, "labs-prod:servers:alice").Result(); ttl <= 0 {
+		t.Errorf("expected the moved entry to keep its TTL, got %s", ttl)
+	}
+
+	// A handed-off provision is resumed against the moved cache key
+	moved, _ := client.client.LRange(ctx, "labs-prod:handoff", 0, -1).Result()
+	if len(moved) != 1 {
+		t.Fatalf("expected the handoff entry to be moved once, got %v", moved)
+	}
+	var entry HandoffEntry
+	if err := json.Unmarshal([]byte(moved[0]), &entry); err != nil || entry.CacheKey != "labs-prod:servers:alice" || entry.ServerID != "srv-1" {
+		t.Errorf("expected the handoff entry to name the moved cache key, got %+v, %v", entry, err)
+	}
+
+	// A key the new namespace has with another value is kept
+	client.client.RPush(ctx, config.ProvisionQueueKey, `{"webuserid":"carol","labId":3}`)
+	conflicting, err := client.MigrateKeys(ctx, "vmmanager", "labs-prod", KeyMigrationOptions{})
+	if err != nil {
+		t.Fatalf("MigrateKeys failed: %v", err)
+	}
+	if len(conflicting.Conflicts) != 1 || conflicting.Conflicts[0] != config.ProvisionQueueKey {
+		t.Errorf("expected the provision queue to conflict, got %+v", conflicting)
+	}
+}
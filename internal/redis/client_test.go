@@ -4,10 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/errs"
 )
 
 // redisOperations is an interface that abstracts the redis.Client operations we use
@@ -179,7 +184,7 @@ func (c *testClient) GetServerState(ctx context.Context, cacheKey string) (*Serv
 	data, err := c.ops.Get(ctx, cacheKey).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, errors.New("server state not found in cache")
+			return nil, errs.New("server state not found in cache", errs.ErrNotFound)
 		}
 		return nil, err
 	}
@@ -460,6 +465,29 @@ func TestGetServerState_NotFound(t *testing.T) {
 	if err.Error() != expectedMsg {
 		t.Errorf("expected error %q, got %q", expectedMsg, err.Error())
 	}
+	if !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected error to be errs.ErrNotFound, got %v", err)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	transientErrs := []error{
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+		io.EOF,
+		fmt.Errorf("read: %w", context.DeadlineExceeded),
+		redis.ErrPoolTimeout,
+		replyError("READONLY You can't write against a read only replica."),
+		replyError("LOADING Redis is loading the dataset in memory"),
+	}
+	for _, err := range transientErrs {
+		marked := transient(err)
+		if !errors.Is(marked, errs.ErrTransient) || !errors.Is(marked, err) || marked.Error() != err.Error() {
+			t.Errorf("%v: expected transient error keeping the original, got %v", err, marked)
+		}
+	}
+	if err := transient(replyError("WRONGTYPE Operation against a key holding the wrong kind of value")); errors.Is(err, errs.ErrTransient) {
+		t.Errorf("expected command error not to be transient, got %v", err)
+	}
 }
 
 func TestGetServerState_RedisError(t *testing.T) {
@@ -849,3 +877,101 @@ func TestRateLimitKey(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAdmissionReply(t *testing.T) {
+	existing := `{"serverId":"server-1","webUserId":"user123","labId":5}`
+
+	tests := []struct {
+		name         string
+		reply        []interface{}
+		wantDecision AdmissionDecision
+		wantExisting bool
+		wantVersion  int64
+		wantErr      bool
+	}{
+		{
+			name:         "accepted without existing state",
+			reply:        []interface{}{"accepted", "", int64(1)},
+			wantDecision: AdmissionAccepted,
+			wantVersion:  1,
+		},
+		{
+			name:         "replaced returns previous state",
+			reply:        []interface{}{"replaced", existing, int64(4)},
+			wantDecision: AdmissionReplaced,
+			wantExisting: true,
+			wantVersion:  4,
+		},
+		{
+			name:         "duplicate returns cached state",
+			reply:        []interface{}{"duplicate", existing, int64(0)},
+			wantDecision: AdmissionDuplicate,
+			wantExisting: true,
+		},
+		{
+			name:         "rate limited",
+			reply:        []interface{}{"rate_limited", "", int64(0)},
+			wantDecision: AdmissionRateLimited,
+		},
+		{
+			name:    "unknown decision",
+			reply:   []interface{}{"maybe", "", int64(0)},
+			wantErr: true,
+		},
+		{
+			name:    "short reply",
+			reply:   []interface{}{"accepted", ""},
+			wantErr: true,
+		},
+		{
+			name:    "invalid existing state",
+			reply:   []interface{}{"replaced", "not-json", int64(1)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseAdmissionReply(tt.reply)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Decision != tt.wantDecision {
+				t.Errorf("expected decision %q, got %q", tt.wantDecision, result.Decision)
+			}
+			if result.Version != tt.wantVersion {
+				t.Errorf("expected version %d, got %d", tt.wantVersion, result.Version)
+			}
+			if (result.Existing != nil) != tt.wantExisting {
+				t.Errorf("expected existing=%v, got %+v", tt.wantExisting, result.Existing)
+			}
+			if result.Existing != nil && result.Existing.ServerID != "server-1" {
+				t.Errorf("expected existing ServerID 'server-1', got %s", result.Existing.ServerID)
+			}
+		})
+	}
+}
+
+func TestTenantUserID(t *testing.T) {
+	if got := TenantUserID("", "user123"); got != "user123" {
+		t.Errorf("expected default tenant to stay unscoped, got %q", got)
+	}
+	if got := TenantUserID("cs101", "user123"); got != "cs101:user123" {
+		t.Errorf("expected tenant-scoped ID, got %q", got)
+	}
+
+	state := ServerState{WebUserID: "user123", Tenant: "cs101"}
+	if got := state.CacheKey(); got != "vmmanager:servers:cs101:user123" {
+		t.Errorf("unexpected cache key %q", got)
+	}
+	state.Tenant = ""
+	if got := state.CacheKey(); got != ServerCacheKey("user123") {
+		t.Errorf("unexpected default tenant cache key %q", got)
+	}
+}
@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// CreateLimiter spreads the server creations of all instances over time, so a whole class
+// starting at once doesn't look like abuse to the provider
+type CreateLimiter interface {
+	TakeCreateToken(ctx context.Context, rate float64, burst int) (time.Duration, error)
+}
+
+// takeCreateTokenScript takes a token from a bucket refilled at rate tokens per second up
+// to burst, using the Redis clock so every instance sees the same bucket.
+// Returns 0 if a token was taken, or else the seconds until one is available.
+// KEYS[1] = bucket key
+// ARGV[1] = rate (tokens per second), ARGV[2] = burst
+var takeCreateTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(bucket[1]) or burst
+local at = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return tostring(wait)
+`)
+
+// TakeCreateToken takes a token from the bucket shared by all instances, refilled at rate
+// tokens per second up to burst. Returns 0 if a token was taken, or else how long until the
+// next one is available; the caller waits and asks again.
+func (c *Client) TakeCreateToken(ctx context.Context, rate float64, burst int) (time.Duration, error) {
+	reply, err := takeCreateTokenScript.Run(ctx, c.client, []string{config.CreateBucketKey}, rate, burst).Text()
+	if err != nil {
+		return 0, fmt.Errorf("failed to take create token: %w", transient(err))
+	}
+	seconds, err := strconv.ParseFloat(reply, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid create token reply %q: %w", reply, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
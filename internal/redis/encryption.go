@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// encryptedPrefix marks an encrypted field value: "enc:v2:" + base64(nonce || ciphertext)
+const encryptedPrefix = "enc:v2:"
+
+// legacyEncryptedPrefix marks a value encrypted before the entry's owner was authenticated
+// along with the field name. Such values are still read, and encrypted anew on the next write.
+const legacyEncryptedPrefix = "enc:v1:"
+
+// sensitiveFields returns the fields of state that can be encrypted, keyed by JSON name
+func sensitiveFields(state *ServerState) map[string]*string {
+	return map[string]*string{
+		"user":       &state.User,
+		"address":    &state.Address,
+		"hostname":   &state.Hostname,
+		"sshHostKey": &state.SSHHostKey,
+		"password":   &state.Password,
+	}
+}
+
+// nodeSensitiveFields returns the fields of node that can be encrypted, keyed by JSON name.
+// The names match the state's own, so selecting "address" covers every node's address too.
+func nodeSensitiveFields(node *NodeState) map[string]*string {
+	return map[string]*string{
+		"address":    &node.Address,
+		"sshHostKey": &node.SSHHostKey,
+		"password":   &node.Password,
+	}
+}
+
+// nodeFieldName is the name a node's field is authenticated with, so values can't be swapped between nodes
+func nodeFieldName(node, field string) string {
+	return "nodes." + node + "." + field
+}
+
+// additionalData is what a field of the entry of owner, its tenant-qualified webuserid, is
+// authenticated with, so values can't be swapped between fields or between users' entries.
+// The owner rather than the cache key is bound, so entries stay readable after their keys
+// move into another namespace.
+func additionalData(owner, field string) []byte {
+	return []byte(owner + "\x00" + field)
+}
+
+// SensitiveFieldNames lists the JSON names of the fields FieldCipher can encrypt
+func SensitiveFieldNames() []string {
+	var names []string
+	for name := range sensitiveFields(&ServerState{}) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FieldCipher encrypts selected ServerState fields with AES-256-GCM before they are
+// written to Redis, so a Redis compromise doesn't leak lab access. The entry's owner and
+// the JSON field name are authenticated along with the value, so values can't be swapped
+// between fields or copied into another user's entry.
+type FieldCipher struct {
+	aead   cipher.AEAD
+	fields []string
+}
+
+// NewFieldCipher creates a cipher with a 32-byte key for the given JSON field names.
+// No fields selects every field in SensitiveFieldNames.
+func NewFieldCipher(key []byte, fields []string) (*FieldCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cache encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		fields = SensitiveFieldNames()
+	}
+	known := sensitiveFields(&ServerState{})
+	for _, field := range fields {
+		if _, ok := known[field]; !ok {
+			return nil, fmt.Errorf("field %q can't be encrypted (supported: %s)", field, strings.Join(SensitiveFieldNames(), ", "))
+		}
+	}
+	return &FieldCipher{aead: aead, fields: fields}, nil
+}
+
+// ParseEncryptionKey decodes a base64-encoded 32-byte key
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("cache encryption key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cache encryption key must decode to 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// encrypt replaces the selected fields of state with their encrypted values.
+// Empty and already encrypted values are left as they are.
+func (f *FieldCipher) encrypt(state *ServerState) error {
+	owner := TenantUserID(state.Tenant, state.WebUserID)
+	values := sensitiveFields(state)
+	for _, field := range f.fields {
+		if err := f.seal(owner, field, values[field]); err != nil {
+			return err
+		}
+	}
+	if state.Nodes == nil {
+		return nil
+	}
+
+	// The caller's state shares the node map, so the encrypted nodes go into a new one
+	nodes := make(map[string]NodeState, len(state.Nodes))
+	for name, node := range state.Nodes {
+		nodeValues := nodeSensitiveFields(&node)
+		for _, field := range f.fields {
+			if value, ok := nodeValues[field]; ok {
+				if err := f.seal(owner, nodeFieldName(name, field), value); err != nil {
+					return err
+				}
+			}
+		}
+		nodes[name] = node
+	}
+	state.Nodes = nodes
+	return nil
+}
+
+// seal encrypts value in place, authenticating it as field of the entry of owner.
+// Empty and already encrypted values are left as they are.
+func (f *FieldCipher) seal(owner, field string, value *string) error {
+	if *value == "" || strings.HasPrefix(*value, encryptedPrefix) || strings.HasPrefix(*value, legacyEncryptedPrefix) {
+		return nil
+	}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+	sealed := f.aead.Seal(nonce, nonce, []byte(*value), additionalData(owner, field))
+	*value = encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// decrypt restores every encrypted field of state. Plaintext values, e.g. in entries
+// written before encryption was enabled, are left as they are.
+func (f *FieldCipher) decrypt(state *ServerState) error {
+	owner := TenantUserID(state.Tenant, state.WebUserID)
+	for field, value := range sensitiveFields(state) {
+		if err := f.open(owner, field, value); err != nil {
+			return err
+		}
+	}
+	for name, node := range state.Nodes {
+		for field, value := range nodeSensitiveFields(&node) {
+			if err := f.open(owner, nodeFieldName(name, field), value); err != nil {
+				return err
+			}
+		}
+		state.Nodes[name] = node
+	}
+	return nil
+}
+
+// open decrypts value in place if it is encrypted, checking it was sealed as field of the
+// entry of owner, or as field alone for a legacy value
+func (f *FieldCipher) open(owner, field string, value *string) error {
+	ad := additionalData(owner, field)
+	encoded, ok := strings.CutPrefix(*value, encryptedPrefix)
+	if !ok {
+		if encoded, ok = strings.CutPrefix(*value, legacyEncryptedPrefix); !ok {
+			return nil
+		}
+		ad = []byte(field)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < f.aead.NonceSize() {
+		return fmt.Errorf("field %s: malformed encrypted value", field)
+	}
+	nonce, ciphertext := sealed[:f.aead.NonceSize()], sealed[f.aead.NonceSize():]
+	plaintext, err := f.aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return fmt.Errorf("field %s: decrypt: %w", field, err)
+	}
+	*value = string(plaintext)
+	return nil
+}
+
+// WithEncryption encrypts the fields selected by cipher in every state written to the
+// cache, and decrypts them transparently on read
+func (c *Client) WithEncryption(cipher *FieldCipher) *Client {
+	c.cipher = cipher
+	return c
+}
+
+// marshalState encodes state for the cache with the current schema version, encrypting its selected fields
+func (c *Client) marshalState(state ServerState) ([]byte, error) {
+	state.SchemaVersion = SchemaVersion
+	state.DryRun = state.DryRun || c.dryRun
+	c.deriveExpiry(&state, time.Now())
+	if c.cipher != nil {
+		if err := c.cipher.encrypt(&state); err != nil {
+			return nil, fmt.Errorf("failed to encrypt server state: %w", err)
+		}
+	}
+	return json.Marshal(state)
+}
+
+// unmarshalState decodes a cached state, decrypting its encrypted fields and upgrading
+// it to the current schema version
+func (c *Client) unmarshalState(data []byte, state *ServerState) error {
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+	if err := c.decryptState(state); err != nil {
+		return err
+	}
+	if err := migrateState(state); err != nil {
+		return err
+	}
+	c.deriveExpiry(state, time.Now())
+	return nil
+}
+
+// decryptState decrypts the encrypted fields of a state read from Redis.
+// An encrypted entry read without a key is an error rather than ciphertext handed to callers.
+func (c *Client) decryptState(state *ServerState) error {
+	if c.cipher == nil {
+		for field, value := range sensitiveFields(state) {
+			if strings.HasPrefix(*value, encryptedPrefix) {
+				return fmt.Errorf("field %s is encrypted but no cache encryption key is configured", field)
+			}
+		}
+		for name, node := range state.Nodes {
+			for field, value := range nodeSensitiveFields(&node) {
+				if strings.HasPrefix(*value, encryptedPrefix) {
+					return fmt.Errorf("field %s is encrypted but no cache encryption key is configured", nodeFieldName(name, field))
+				}
+			}
+		}
+		return nil
+	}
+	return c.cipher.decrypt(state)
+}
@@ -0,0 +1,171 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testCipher(t *testing.T, fields ...string) *FieldCipher {
+	t.Helper()
+	cipher, err := NewFieldCipher(bytes.Repeat([]byte{7}, 32), fields)
+	if err != nil {
+		t.Fatalf("NewFieldCipher failed: %v", err)
+	}
+	return cipher
+}
+
+func TestFieldCipher_RoundTrip(t *testing.T) {
+	client := (&Client{}).WithEncryption(testCipher(t, "address", "sshHostKey"))
+	state := ServerState{User: "student", Address: "2001:db8::1", SSHHostKey: "ssh-ed25519 AAAA", WebUserID: "alice", LabID: 12, Version: 3, SchemaVersion: SchemaVersion}
+
+	data, err := client.marshalState(state)
+	if err != nil {
+		t.Fatalf("marshalState failed: %v", err)
+	}
+	raw := string(data)
+	if strings.Contains(raw, "2001:db8::1") || strings.Contains(raw, "ssh-ed25519") {
+		t.Errorf("expected selected fields to be encrypted, got %s", raw)
+	}
+	// Unselected fields and the fields the Lua scripts read stay in plaintext
+	if !strings.Contains(raw, `"user":"student"`) || !strings.Contains(raw, `"labId":12`) || !strings.Contains(raw, `"version":3`) {
+		t.Errorf("expected other fields in plaintext, got %s", raw)
+	}
+
+	var decoded ServerState
+	if err := client.unmarshalState(data, &decoded); err != nil {
+		t.Fatalf("unmarshalState failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, state) {
+		t.Errorf("expected %+v after round trip, got %+v", state, decoded)
+	}
+
+	// Without the key the entry is unreadable instead of leaking ciphertext
+	if err := (&Client{}).unmarshalState(data, &decoded); err == nil {
+		t.Error("expected error reading an encrypted entry without a key")
+	}
+	other, err := NewFieldCipher(bytes.Repeat([]byte{8}, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Client{}).WithEncryption(other).unmarshalState(data, &decoded); err == nil {
+		t.Error("expected error decrypting with the wrong key")
+	}
+}
+
+func TestFieldCipher_Nodes(t *testing.T) {
+	client := (&Client{}).WithEncryption(testCipher(t, "address"))
+	nodes := map[string]NodeState{
+		"attacker": {ServerID: "1", Address: "2001:db8::1"},
+		"target":   {ServerID: "2", Address: "2001:db8::2", SSHHostKey: "ssh-ed25519 AAAA"},
+	}
+	state := ServerState{Address: "2001:db8::1", ServerID: "1", Nodes: nodes}
+
+	data, err := client.marshalState(state)
+	if err != nil {
+		t.Fatalf("marshalState failed: %v", err)
+	}
+	if raw := string(data); strings.Contains(raw, "2001:db8::2") || !strings.Contains(raw, "ssh-ed25519") {
+		t.Errorf("expected only the selected node fields to be encrypted, got %s", raw)
+	}
+	if nodes["target"].Address != "2001:db8::2" {
+		t.Errorf("expected the caller's nodes to stay in plaintext, got %+v", nodes)
+	}
+
+	var decoded ServerState
+	if err := client.unmarshalState(data, &decoded); err != nil {
+		t.Fatalf("unmarshalState failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Nodes, nodes) {
+		t.Errorf("expected %+v after round trip, got %+v", nodes, decoded.Nodes)
+	}
+
+	// Addresses can't be swapped between nodes
+	encrypted := ServerState{Nodes: map[string]NodeState{"attacker": nodes["attacker"], "target": nodes["target"]}}
+	if err := client.cipher.encrypt(&encrypted); err != nil {
+		t.Fatal(err)
+	}
+	attacker, target := encrypted.Nodes["attacker"], encrypted.Nodes["target"]
+	attacker.Address, target.Address = target.Address, attacker.Address
+	encrypted.Nodes["attacker"], encrypted.Nodes["target"] = attacker, target
+	if err := client.cipher.decrypt(&encrypted); err == nil {
+		t.Error("expected error for addresses moved between nodes")
+	}
+}
+
+func TestFieldCipher_PlaintextEntries(t *testing.T) {
+	// Entries written before encryption was enabled stay readable
+	client := (&Client{}).WithEncryption(testCipher(t))
+	var state ServerState
+	if err := client.unmarshalState([]byte(`{"address":"2001:db8::1","hostname":"lab.example.com"}`), &state); err != nil {
+		t.Fatalf("unmarshalState failed: %v", err)
+	}
+	if state.Address != "2001:db8::1" || state.Hostname != "lab.example.com" {
+		t.Errorf("expected plaintext values kept, got %+v", state)
+	}
+}
+
+func TestFieldCipher_SwappedFields(t *testing.T) {
+	cipher := testCipher(t)
+	state := ServerState{Address: "2001:db8::1", Hostname: "lab.example.com"}
+	if err := cipher.encrypt(&state); err != nil {
+		t.Fatal(err)
+	}
+	state.Address, state.Hostname = state.Hostname, state.Address
+	if err := cipher.decrypt(&state); err == nil {
+		t.Error("expected error for values moved between fields")
+	}
+}
+
+func TestFieldCipher_SwappedEntries(t *testing.T) {
+	cipher := testCipher(t)
+	alice := ServerState{WebUserID: "alice", Tenant: "cs101", Address: "2001:db8::1"}
+	if err := cipher.encrypt(&alice); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value copied into another user's entry, or the same user's in another tenant, can't be read there
+	for _, owner := range []ServerState{{WebUserID: "mallory", Tenant: "cs101"}, {WebUserID: "alice", Tenant: "cs102"}} {
+		owner.Address = alice.Address
+		if err := cipher.decrypt(&owner); err == nil {
+			t.Errorf("expected error for a value moved into the entry of %s", TenantUserID(owner.Tenant, owner.WebUserID))
+		}
+	}
+	if err := cipher.decrypt(&alice); err != nil || alice.Address != "2001:db8::1" {
+		t.Errorf("expected the owner's entry to decrypt, got %q (%v)", alice.Address, err)
+	}
+}
+
+func TestFieldCipher_LegacyValues(t *testing.T) {
+	// Values sealed with the field name alone, before the owner was authenticated, stay readable
+	cipher := testCipher(t)
+	nonce := make([]byte, cipher.aead.NonceSize())
+	sealed := cipher.aead.Seal(nonce, nonce, []byte("2001:db8::1"), []byte("address"))
+	state := ServerState{WebUserID: "alice", Address: legacyEncryptedPrefix + base64.StdEncoding.EncodeToString(sealed)}
+	if err := cipher.decrypt(&state); err != nil || state.Address != "2001:db8::1" {
+		t.Errorf("expected the legacy value to decrypt, got %q (%v)", state.Address, err)
+	}
+}
+
+func TestNewFieldCipher_Invalid(t *testing.T) {
+	if _, err := NewFieldCipher([]byte("short"), nil); err == nil {
+		t.Error("expected error for a short key")
+	}
+	if _, err := NewFieldCipher(bytes.Repeat([]byte{7}, 32), []string{"labId"}); err == nil {
+		t.Error("expected error for a field that can't be encrypted")
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key, err := ParseEncryptionKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)) + "\n")
+	if err != nil || len(key) != 32 {
+		t.Errorf("expected 32-byte key, got %d bytes, %v", len(key), err)
+	}
+	for _, encoded := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("16 bytes long!!!"))} {
+		if _, err := ParseEncryptionKey(encoded); err == nil {
+			t.Errorf("%q: expected error", encoded)
+		}
+	}
+}
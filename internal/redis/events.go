@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// Event types recorded for the status dashboard
+const (
+	EventProvisionFailed    = "provision_failed"
+	EventDecommissionFailed = "decommission_failed"
+	EventRateLimited        = "rate_limited"
+	EventPayloadRejected    = "payload_rejected"
+	EventStaleRequest       = "stale_request"
+	EventAbuseSuspected     = "abuse_suspected"
+	EventAdminOverride      = "admin_override"
+	EventOutOfOrder         = "out_of_order"
+)
+
+// Event is a failure or dropped request worth showing to operators
+type Event struct {
+	Type          string    `json:"type"`
+	Operation     string    `json:"operation,omitempty"` // "provision", "decommission", "rebuild", "resize" or "extend"
+	WebUserID     string    `json:"webUserId,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	LabID         int       `json:"labId,omitempty"`
+	ServerID      string    `json:"serverId,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+// EventRecorder keeps recent events for the status dashboard
+type EventRecorder interface {
+	RecordEvent(ctx context.Context, event Event) error
+}
+
+// RecordEvent prepends an event to the recent events list, keeping the newest config.MaxEvents
+func (c *Client) RecordEvent(ctx context.Context, event Event) error {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	pipe := c.client.TxPipeline()
+	pipe.LPush(ctx, config.EventsKey, data)
+	pipe.LTrim(ctx, config.EventsKey, 0, config.MaxEvents-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record event: %w", err)
+	}
+	return nil
+}
+
+// RecentEvents returns up to limit recent events, newest first
+func (c *Client) RecentEvents(ctx context.Context, limit int) ([]Event, error) {
+	values, err := c.client.LRange(ctx, config.EventsKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+
+	events := make([]Event, 0, len(values))
+	for _, data := range values {
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			c.logger(ctx).Warn("failed to decode event", "key", config.EventsKey, "operation", "recent_events", "error", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// QueueDepths returns the number of messages waiting in each Redis queue
+func (c *Client) QueueDepths(ctx context.Context, queueKeys ...string) (map[string]int64, error) {
+	pipe := c.client.Pipeline()
+	cmds := make(map[string]*redis.IntCmd, len(queueKeys))
+	for _, key := range queueKeys {
+		cmds[key] = pipe.LLen(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read queue depths: %w", err)
+	}
+
+	depths := make(map[string]int64, len(queueKeys))
+	for key, cmd := range cmds {
+		depths[key] = cmd.Val()
+	}
+	return depths, nil
+}
@@ -0,0 +1,40 @@
+package redis
+
+import "time"
+
+// WithExpiryPolicy tells the client how the cleanup worker expires servers, so the
+// deadlines it derives for LabMan match: idleTimeout is the idle expiry (0 when servers
+// expire at expiresAt) and maxLifetime the longest a server may run (0 when unbounded).
+func (c *Client) WithExpiryPolicy(idleTimeout, maxLifetime time.Duration) *Client {
+	c.idleTimeout = idleTimeout
+	c.maxLifetime = maxLifetime
+	return c
+}
+
+// deriveExpiry fills the deadlines LabMan shows a countdown from, as of now. They are
+// derived on every write and read, so remainingSeconds is as fresh as the last of either.
+func (c *Client) deriveExpiry(state *ServerState, now time.Time) {
+	state.HardExpiryAt = state.ExpiresAt
+	if c.maxLifetime > 0 && !state.CreatedAt.IsZero() {
+		state.HardExpiryAt = state.CreatedAt.Add(c.maxLifetime)
+	}
+
+	deadline := state.ExpiresAt
+	if c.idleTimeout > 0 && !state.CreatedAt.IsZero() {
+		// A server counts as active from its creation until the cleanup worker records activity
+		if state.IdleExpiresAt.IsZero() {
+			state.IdleExpiresAt = state.CreatedAt.Add(c.idleTimeout)
+		}
+		deadline = state.IdleExpiresAt
+		if c.maxLifetime > 0 && state.HardExpiryAt.Before(deadline) {
+			deadline = state.HardExpiryAt
+		}
+	} else {
+		state.IdleExpiresAt = time.Time{}
+	}
+
+	state.RemainingSeconds = 0
+	if remaining := deadline.Sub(now); remaining > 0 {
+		state.RemainingSeconds = int64(remaining / time.Second)
+	}
+}
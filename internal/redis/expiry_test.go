@@ -0,0 +1,131 @@
+package redis
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDeriveExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	created := now.Add(-time.Hour)
+	expires := now.Add(30 * time.Minute)
+
+	tests := []struct {
+		name          string
+		client        *Client
+		state         ServerState
+		wantRemaining int64
+		wantHard      time.Time
+		wantIdle      time.Time
+	}{
+		{
+			name:          "fixed ttl",
+			client:        &Client{},
+			state:         ServerState{CreatedAt: created, ExpiresAt: expires},
+			wantRemaining: 1800,
+			wantHard:      expires,
+		},
+		{
+			name:          "expired",
+			client:        &Client{},
+			state:         ServerState{CreatedAt: created, ExpiresAt: now.Add(-time.Minute)},
+			wantRemaining: 0,
+			wantHard:      now.Add(-time.Minute),
+		},
+		{
+			name:          "ttl refresh bounded by max lifetime",
+			client:        (&Client{}).WithExpiryPolicy(0, 4*time.Hour),
+			state:         ServerState{CreatedAt: created, ExpiresAt: expires},
+			wantRemaining: 1800,
+			wantHard:      created.Add(4 * time.Hour),
+		},
+		{
+			name:          "idle expiry counts from creation",
+			client:        (&Client{}).WithExpiryPolicy(90*time.Minute, 4*time.Hour),
+			state:         ServerState{CreatedAt: created, ExpiresAt: expires},
+			wantRemaining: 1800,
+			wantHard:      created.Add(4 * time.Hour),
+			wantIdle:      created.Add(90 * time.Minute),
+		},
+		{
+			name:          "recorded idle expiry capped by max lifetime",
+			client:        (&Client{}).WithExpiryPolicy(90*time.Minute, 2*time.Hour),
+			state:         ServerState{CreatedAt: created, ExpiresAt: expires, IdleExpiresAt: now.Add(85 * time.Minute)},
+			wantRemaining: 3600,
+			wantHard:      created.Add(2 * time.Hour),
+			wantIdle:      now.Add(85 * time.Minute),
+		},
+		{
+			name:          "entry without creation time keeps the fixed ttl",
+			client:        (&Client{}).WithExpiryPolicy(90*time.Minute, 4*time.Hour),
+			state:         ServerState{ExpiresAt: expires},
+			wantRemaining: 1800,
+			wantHard:      expires,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := tt.state
+			tt.client.deriveExpiry(&state, now)
+			if state.RemainingSeconds != tt.wantRemaining {
+				t.Errorf("expected %d seconds remaining, got %d", tt.wantRemaining, state.RemainingSeconds)
+			}
+			if !state.HardExpiryAt.Equal(tt.wantHard) {
+				t.Errorf("expected hard expiry %v, got %v", tt.wantHard, state.HardExpiryAt)
+			}
+			if !state.IdleExpiresAt.Equal(tt.wantIdle) {
+				t.Errorf("expected idle expiry %v, got %v", tt.wantIdle, state.IdleExpiresAt)
+			}
+		})
+	}
+}
+
+func TestMarshalState_DerivesExpiry(t *testing.T) {
+	client := (&Client{}).WithExpiryPolicy(0, 4*time.Hour)
+	created := time.Now().Add(-time.Hour)
+
+	data, err := client.marshalState(ServerState{CreatedAt: created, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := fields["remainingSeconds"].(float64); remaining < 3590 || remaining > 3600 {
+		t.Errorf("expected about an hour remaining in the cached JSON, got %v", fields["remainingSeconds"])
+	}
+	if _, ok := fields["idleExpiresAt"]; ok {
+		t.Errorf("expected no idle expiry without idle expiry, got %v", fields["idleExpiresAt"])
+	}
+
+	var decoded ServerState
+	if err := client.unmarshalState(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.HardExpiryAt.Equal(created.Add(4 * time.Hour)) {
+		t.Errorf("expected hard expiry 4h after creation, got %v", decoded.HardExpiryAt)
+	}
+}
+
+func TestMarshalState_DryRun(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		client := &Client{}
+		if dryRun {
+			client.WithDryRun()
+		}
+		data, err := client.marshalState(ServerState{ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if marked, ok := fields["dryRun"]; dryRun != ok || (ok && marked != true) {
+			t.Errorf("dry run %v: expected dryRun in the cached JSON only for a dry run, got %v", dryRun, fields["dryRun"])
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// extensionsKeyTTL keeps a day's count until the day is over everywhere
+const extensionsKeyTTL = 48 * time.Hour
+
+// ExtensionsKey returns the key counting the extensions of a tenant-scoped user ID
+// (see TenantUserID) on the UTC day of at
+func ExtensionsKey(userID string, at time.Time) string {
+	return config.ExtensionsPrefix + userID + ":" + at.UTC().Format(time.DateOnly)
+}
+
+// ExtensionCounter counts the extensions granted to each user per UTC day
+type ExtensionCounter interface {
+	AcquireExtension(ctx context.Context, userID string, at time.Time, limit int) (int, bool, error)
+	ReleaseExtension(ctx context.Context, userID string, at time.Time) error
+}
+
+// acquireExtensionScript counts an extension unless the limit is reached.
+// Returns {1, count} if it was counted, or {0, count} if the limit was reached.
+// KEYS[1] = extensions key
+// ARGV[1] = limit, ARGV[2] = key TTL (seconds)
+var acquireExtensionScript = redis.NewScript(`
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count >= tonumber(ARGV[1]) then
+	return {0, count}
+end
+count = redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return {1, count}
+`)
+
+// AcquireExtension counts an extension of a tenant-scoped user ID on the UTC day of at,
+// unless the user already has limit extensions that day. Returns the user's extensions that
+// day, including this one if it was counted, and whether it was.
+func (c *Client) AcquireExtension(ctx context.Context, userID string, at time.Time, limit int) (int, bool, error) {
+	reply, err := acquireExtensionScript.Run(ctx, c.client, []string{ExtensionsKey(userID, at)}, limit, int(extensionsKeyTTL.Seconds())).Int64Slice()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to count extension: %w", transient(err))
+	}
+	if len(reply) != 2 {
+		return 0, false, fmt.Errorf("unexpected extension count reply %v", reply)
+	}
+	return int(reply[1]), reply[0] == 1, nil
+}
+
+// ReleaseExtension takes back an extension counted with AcquireExtension that wasn't granted after all
+func (c *Client) ReleaseExtension(ctx context.Context, userID string, at time.Time) error {
+	if err := c.client.Decr(ctx, ExtensionsKey(userID, at)).Err(); err != nil {
+		return fmt.Errorf("failed to release extension: %w", transient(err))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// FlagKey returns the key operators set to toggle the feature flag name at runtime
+func FlagKey(name string) string {
+	return config.FlagPrefix + name
+}
+
+// FlagReader reads the runtime feature flags operators set in Redis
+type FlagReader interface {
+	GetFlag(ctx context.Context, name string) (string, bool, error)
+}
+
+// GetFlag returns the value of the feature flag name and whether it is set
+func (c *Client) GetFlag(ctx context.Context, name string) (string, bool, error) {
+	value, err := c.client.Get(ctx, FlagKey(name)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get flag: %w", transient(err))
+	}
+	return value, true, nil
+}
@@ -0,0 +1,82 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// HandoffEntry is an in-flight provision a draining instance passes on to its replacement
+type HandoffEntry struct {
+	CacheKey    string      `json:"cacheKey"`
+	ServerID    string      `json:"serverId"`
+	CloudStatus string      `json:"cloudStatus"` // last cloud state the previous owner observed
+	State       ServerState `json:"state"`       // last state the previous owner wrote (or tried to write)
+	InstanceID  string      `json:"instanceId"`  // instance that handed the entry off
+	HandedOffAt time.Time   `json:"handedOffAt"`
+}
+
+// PushHandoffEntries appends in-flight provisions to the handoff list and refreshes its TTL
+func (c *Client) PushHandoffEntries(ctx context.Context, entries []HandoffEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		entry.State.SchemaVersion = SchemaVersion
+		if c.cipher != nil {
+			if err := c.cipher.encrypt(&entry.State); err != nil {
+				return fmt.Errorf("failed to encrypt handoff entry for %s: %w", entry.CacheKey, err)
+			}
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal handoff entry for %s: %w", entry.CacheKey, err)
+		}
+		values[i] = string(data)
+	}
+
+	pipe := c.client.TxPipeline()
+	pipe.RPush(ctx, config.HandoffKey, values...)
+	pipe.Expire(ctx, config.HandoffKey, config.HandoffTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to push handoff entries: %w", err)
+	}
+	return nil
+}
+
+// PopHandoffEntries atomically takes every entry from the handoff list,
+// so two instances starting at the same time never adopt the same provision
+func (c *Client) PopHandoffEntries(ctx context.Context) ([]HandoffEntry, error) {
+	pipe := c.client.TxPipeline()
+	rangeCmd := pipe.LRange(ctx, config.HandoffKey, 0, -1)
+	pipe.Del(ctx, config.HandoffKey)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to pop handoff entries: %w", err)
+	}
+
+	var entries []HandoffEntry
+	for _, data := range rangeCmd.Val() {
+		var entry HandoffEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			c.logger(ctx).Warn("failed to decode handoff entry", "key", config.HandoffKey, "operation", "pop_handoff_entries", "error", err)
+			continue
+		}
+		if err := c.decryptState(&entry.State); err != nil {
+			c.logger(ctx).Warn("failed to decrypt handoff entry", "key", entry.CacheKey, "operation", "pop_handoff_entries", "error", err)
+			continue
+		}
+		if err := migrateState(&entry.State); err != nil {
+			c.logger(ctx).Warn("failed to migrate handoff entry", "key", entry.CacheKey, "operation", "pop_handoff_entries", "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,74 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// Event types only recorded in a user's history, next to the failures and dropped requests
+const (
+	EventProvisionStarted = "provision_started" // the request was admitted and a server is being created
+	EventAvailable        = "available"         // the server accepts SSH connections
+	EventExpired          = "expired"           // the cleanup worker queued the server's decommission
+	EventDecommissioned   = "decommissioned"    // the server is deleted and its cache entry removed
+	EventRebuilt          = "rebuilt"           // the server was reinstalled from its image
+	EventResized          = "resized"           // the server was moved to another server type
+	EventExtended         = "extended"          // the user's extension request moved the server's expiry
+	EventExtensionDenied  = "extension_denied"  // the user's extension request was rejected by a limit
+)
+
+// HistoryKey returns the history key of a tenant-scoped user ID (see TenantUserID)
+func HistoryKey(userID string) string {
+	return config.HistoryPrefix + userID
+}
+
+// HistoryRecorder keeps the recent lifecycle events of each user, for support staff
+// asking what happened to a user's lab
+type HistoryRecorder interface {
+	RecordHistory(ctx context.Context, userID string, event Event) error
+}
+
+// RecordHistory prepends an event to the history of a tenant-scoped user ID, keeping the
+// newest config.MaxHistory. A history without new events expires after config.HistoryTTL.
+func (c *Client) RecordHistory(ctx context.Context, userID string, event Event) error {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history event: %w", err)
+	}
+
+	key := HistoryKey(userID)
+	pipe := c.client.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, config.MaxHistory-1)
+	pipe.Expire(ctx, key, config.HistoryTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record history event: %w", transient(err))
+	}
+	return nil
+}
+
+// UserHistory returns up to limit recent events of a tenant-scoped user ID, newest first
+func (c *Client) UserHistory(ctx context.Context, userID string, limit int) ([]Event, error) {
+	values, err := c.client.LRange(ctx, HistoryKey(userID), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", transient(err))
+	}
+
+	events := make([]Event, 0, len(values))
+	for _, data := range values {
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			c.logger(ctx).Warn("failed to decode history event", "key", HistoryKey(userID), "operation", "user_history", "error", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
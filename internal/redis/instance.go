@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// InstanceInfo is the heartbeat record a SWIM instance keeps alive in Redis
+type InstanceInfo struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`   // "running" | "draining"
+	Version   string    `json:"version"`  // SWIM build version
+	Provider  string    `json:"provider"` // cloud provider the instance provisions on
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"` // time of the last heartbeat
+}
+
+// InstanceKey constructs the heartbeat key for a SWIM instance
+func InstanceKey(instanceID string) string {
+	return config.InstancePrefix + instanceID
+}
+
+// PublishInstance writes the heartbeat record for an instance with the given TTL
+// and registers the instance in the instance index
+func (c *Client) PublishInstance(ctx context.Context, info InstanceInfo, ttl time.Duration) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal instance info: %w", err)
+	}
+
+	pipe := c.client.TxPipeline()
+	pipe.Set(ctx, InstanceKey(info.ID), data, ttl)
+	pipe.SAdd(ctx, config.InstanceIndexKey, info.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to publish instance heartbeat: %w", err)
+	}
+	return nil
+}
+
+// ListInstances returns the instances whose heartbeat hasn't expired, ordered by ID.
+// Instances whose heartbeat expired are removed from the index.
+func (c *Client) ListInstances(ctx context.Context) ([]InstanceInfo, error) {
+	ids, err := c.client.SMembers(ctx, config.InstanceIndexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instance index: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = InstanceKey(id)
+	}
+
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch instances: %w", err)
+	}
+
+	var instances []InstanceInfo
+	var dead []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			dead = append(dead, ids[i])
+			continue
+		}
+
+		var info InstanceInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			c.logger(ctx).Warn("failed to decode instance", "key", keys[i], "operation", "list_instances", "error", err)
+			continue
+		}
+		instances = append(instances, info)
+	}
+
+	if len(dead) > 0 {
+		if err := c.client.SRem(ctx, config.InstanceIndexKey, dead...).Err(); err != nil {
+			c.logger(ctx).Warn("failed to prune instance index", "key", config.InstanceIndexKey, "operation", "list_instances", "error", err)
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
+
+// IsInstanceAlive reports whether the instance's heartbeat is still present
+func (c *Client) IsInstanceAlive(ctx context.Context, instanceID string) (bool, error) {
+	n, err := c.client.Exists(ctx, InstanceKey(instanceID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check instance heartbeat: %w", err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,41 @@
+package redis
+
+import (
+	"fmt"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// SchemaVersion is the ServerState schema this version writes. Entries written by older
+// versions are upgraded on read, so instances of different versions can share the cache
+// during a rolling upgrade. Bump it and append a migration whenever a field's meaning
+// changes or a new field needs a default other than its zero value.
+const SchemaVersion = 1
+
+// migrations upgrade a state from schema version i to i+1
+var migrations = []func(state *ServerState){
+	// 0 → 1: entries from before the schema version have no availability or raw provider status
+	func(state *ServerState) {
+		if state.Status == config.StatusRunning {
+			state.Available = true
+		}
+		if state.CloudStatus == "" {
+			state.CloudStatus = "unknown"
+		}
+	},
+}
+
+// migrateState upgrades a state read from the cache to SchemaVersion. A state from a newer
+// version is left as it is: fields are only ever added, so the known ones still read correctly.
+func migrateState(state *ServerState) error {
+	if state.SchemaVersion < 0 {
+		return fmt.Errorf("invalid schema version %d", state.SchemaVersion)
+	}
+	for v := state.SchemaVersion; v < SchemaVersion; v++ {
+		migrations[v](state)
+	}
+	if state.SchemaVersion < SchemaVersion {
+		state.SchemaVersion = SchemaVersion
+	}
+	return nil
+}
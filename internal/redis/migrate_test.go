@@ -0,0 +1,73 @@
+package redis
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+func TestMigrateState_LegacyEntries(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            string
+		expectAvailable bool
+		expectCloud     string
+	}{
+		{"running without availability", `{"status":"running","serverId":"1","webUserId":"user-1"}`, true, "unknown"},
+		{"provisioning without availability", `{"status":"provisioning","serverId":"1","webUserId":"user-1"}`, false, "unknown"},
+		{"warm-up entry keeps its fields", `{"status":"provisioning","available":false,"cloudStatus":"running"}`, false, "running"},
+	}
+
+	client := &Client{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state ServerState
+			if err := client.unmarshalState([]byte(tt.data), &state); err != nil {
+				t.Fatalf("unmarshalState failed: %v", err)
+			}
+			if state.Available != tt.expectAvailable || state.CloudStatus != tt.expectCloud {
+				t.Errorf("got available=%v cloudStatus=%q, want %v %q", state.Available, state.CloudStatus, tt.expectAvailable, tt.expectCloud)
+			}
+			if state.SchemaVersion != SchemaVersion {
+				t.Errorf("expected schema version %d, got %d", SchemaVersion, state.SchemaVersion)
+			}
+		})
+	}
+}
+
+func TestMigrateState_CurrentAndNewer(t *testing.T) {
+	client := &Client{}
+	data, err := client.marshalState(ServerState{Status: config.StatusStopping, CloudStatus: "off"})
+	if err != nil {
+		t.Fatalf("marshalState failed: %v", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["schemaVersion"] != float64(SchemaVersion) {
+		t.Errorf("expected written schemaVersion %d, got %v", SchemaVersion, raw["schemaVersion"])
+	}
+
+	var state ServerState
+	if err := client.unmarshalState(data, &state); err != nil {
+		t.Fatalf("unmarshalState failed: %v", err)
+	}
+	if state.Available || state.CloudStatus != "off" {
+		t.Errorf("current entry was changed by migration: %+v", state)
+	}
+
+	// A newer version's entry is read as is
+	newer := `{"status":"stopping","cloudStatus":"off","schemaVersion":99,"futureField":"x"}`
+	if err := client.unmarshalState([]byte(newer), &state); err != nil {
+		t.Fatalf("unmarshalState failed: %v", err)
+	}
+	if state.SchemaVersion != 99 || state.CloudStatus != "off" {
+		t.Errorf("newer entry was changed: %+v", state)
+	}
+
+	if err := client.unmarshalState([]byte(`{"schemaVersion":-1}`), &state); err == nil {
+		t.Error("expected an error for a negative schema version")
+	}
+}
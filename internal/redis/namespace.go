@@ -0,0 +1,305 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// KeyMigrationOptions selects how MigrateKeys moves keys into another namespace
+type KeyMigrationOptions struct {
+	Copy   bool // copy keys and leave the originals, for a rollback; otherwise rename them
+	DryRun bool // only count the keys that would be moved
+	Force  bool // migrate even while instances in the source namespace have a live heartbeat
+}
+
+// KeyMigration is the outcome of MigrateKeys
+type KeyMigration struct {
+	Moved     int      // keys renamed or copied into the new namespace
+	Skipped   int      // keys the new namespace already has with the same value, copied by an earlier run
+	Conflicts []string // keys left in the old namespace because the new one has them with another value
+	Members   int      // server and expiry index members merged into the new namespace's indexes
+}
+
+// MigrateKeys moves every key of namespace from into namespace to, keeping their TTLs, and
+// merges the server and expiry indexes, whose members name cache keys, into those of
+// namespace to with the members renamed. The handoff list is moved with the cache key of
+// each entry renamed. Each key is moved atomically and never overwrites
+// a key of the new namespace, so a run can be repeated or resumed after an interruption:
+// renamed keys are gone from the old namespace, and keys the new one has with the same
+// value are skipped, or with a rename their original deleted. SWIM must not run in the
+// source namespace meanwhile; unless Force is set, a live heartbeat there stops the migration.
+func (c *Client) MigrateKeys(ctx context.Context, from, to string, opts KeyMigrationOptions) (*KeyMigration, error) {
+	if from == to {
+		return nil, fmt.Errorf("source and target namespace are both %q", from)
+	}
+
+	if !opts.Force {
+		live, err := c.scanKeys(ctx, inNamespace(config.InstancePrefix, from)+"*")
+		if err != nil {
+			return nil, err
+		}
+		if len(live) > 0 {
+			return nil, fmt.Errorf("%d SWIM instances in namespace %q have a live heartbeat; stop them first", len(live), from)
+		}
+	}
+
+	keys, err := c.scanKeys(ctx, from+":*")
+	if err != nil {
+		return nil, err
+	}
+
+	// The indexes and the handoff list name cache keys, so they are rewritten rather than moved as they are
+	serverIndex, expiryIndex := inNamespace(config.ServerIndexKey, from), inNamespace(config.ExpiryIndexKey, from)
+	handoff := inNamespace(config.HandoffKey, from)
+
+	result := &KeyMigration{}
+	for _, key := range keys {
+		if key == serverIndex || key == expiryIndex || key == handoff {
+			continue
+		}
+		target := renameNamespace(key, from, to)
+		moved := false
+		if !opts.DryRun {
+			if moved, err = c.moveKey(ctx, key, target, opts.Copy); err != nil {
+				return result, err
+			}
+		} else {
+			exists, err := c.client.Exists(ctx, target).Result()
+			if err != nil {
+				return result, fmt.Errorf("failed to check key %s: %w", target, err)
+			}
+			moved = exists == 0
+		}
+		if moved {
+			result.Moved++
+			continue
+		}
+
+		// The new namespace has the key already, or it expired since SCAN
+		same, err := c.sameValue(ctx, key, target)
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		switch {
+		case !same:
+			result.Conflicts = append(result.Conflicts, key)
+		case opts.Copy:
+			result.Skipped++
+		default:
+			// Copied by an earlier run with Copy; renaming finishes the move
+			if !opts.DryRun {
+				if err := c.client.Del(ctx, key).Err(); err != nil {
+					return result, fmt.Errorf("failed to delete key %s: %w", key, err)
+				}
+			}
+			result.Moved++
+		}
+	}
+	if result.Members, err = c.mergeServerIndexes(ctx, from, to, opts); err != nil {
+		return result, err
+	}
+	if err := c.moveHandoff(ctx, from, to, opts, result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// moveHandoff moves the handoff list of namespace from into namespace to with the cache key
+// of each entry renamed, so the instance resuming an entry writes to its cache entry in
+// namespace to. Like any other key it never overwrites a handoff list namespace to has: one
+// with the same entries, moved by an earlier run, is skipped, and any other is a conflict.
+func (c *Client) moveHandoff(ctx context.Context, from, to string, opts KeyMigrationOptions, result *KeyMigration) error {
+	source, target := inNamespace(config.HandoffKey, from), inNamespace(config.HandoffKey, to)
+	values, err := c.client.LRange(ctx, source, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read handoff list: %w", err)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	renamed := make([]string, len(values))
+	for i, value := range values {
+		renamed[i] = renameHandoffEntry(value, from, to)
+	}
+
+	existing, err := c.client.LRange(ctx, target, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read handoff list: %w", err)
+	}
+	if len(existing) > 0 {
+		switch {
+		case !slices.Equal(existing, renamed):
+			result.Conflicts = append(result.Conflicts, source)
+		case opts.Copy:
+			result.Skipped++
+		default:
+			// Copied by an earlier run with Copy; deleting the original finishes the move
+			if !opts.DryRun {
+				if err := c.client.Del(ctx, source).Err(); err != nil {
+					return fmt.Errorf("failed to delete key %s: %w", source, err)
+				}
+			}
+			result.Moved++
+		}
+		return nil
+	}
+
+	result.Moved++
+	if opts.DryRun {
+		return nil
+	}
+	ttl, err := c.client.PTTL(ctx, source).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read TTL of %s: %w", source, err)
+	}
+	entries := make([]interface{}, len(renamed))
+	for i, entry := range renamed {
+		entries[i] = entry
+	}
+	pipe := c.client.TxPipeline()
+	pipe.RPush(ctx, target, entries...)
+	if ttl > 0 {
+		pipe.PExpire(ctx, target, ttl)
+	}
+	if !opts.Copy {
+		pipe.Del(ctx, source)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to move handoff list: %w", err)
+	}
+	return nil
+}
+
+// renameHandoffEntry returns the encoded handoff entry value with its cache key, which is in
+// namespace from, in namespace to. The rest of the entry, e.g. its encrypted state, is kept
+// byte for byte; an entry that can't be decoded is returned as it is.
+func renameHandoffEntry(value, from, to string) string {
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		return value
+	}
+	var cacheKey string
+	if err := json.Unmarshal(entry["cacheKey"], &cacheKey); err != nil || !strings.HasPrefix(cacheKey, from+":") {
+		return value
+	}
+	entry["cacheKey"], _ = json.Marshal(renameNamespace(cacheKey, from, to))
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
+
+// mergeServerIndexes adds the members of the server and expiry indexes of namespace from to
+// those of namespace to, naming the cache keys in namespace to, and unless opts.Copy is set
+// deletes the indexes of namespace from. Returns the number of members merged.
+func (c *Client) mergeServerIndexes(ctx context.Context, from, to string, opts KeyMigrationOptions) (int, error) {
+	serverIndex := inNamespace(config.ServerIndexKey, from)
+	members, err := c.client.SMembers(ctx, serverIndex).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read server index: %w", err)
+	}
+	expiryIndex := inNamespace(config.ExpiryIndexKey, from)
+	scheduled, err := c.client.ZRangeWithScores(ctx, expiryIndex, 0, -1).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read expiry index: %w", err)
+	}
+	merged := len(members) + len(scheduled)
+	if opts.DryRun || merged == 0 {
+		return merged, nil
+	}
+
+	pipe := c.client.TxPipeline()
+	if len(members) > 0 {
+		renamed := make([]interface{}, len(members))
+		for i, member := range members {
+			renamed[i] = renameNamespace(member, from, to)
+		}
+		pipe.SAdd(ctx, inNamespace(config.ServerIndexKey, to), renamed...)
+	}
+	if len(scheduled) > 0 {
+		renamed := make([]redis.Z, len(scheduled))
+		for i, z := range scheduled {
+			member, _ := z.Member.(string)
+			renamed[i] = redis.Z{Score: z.Score, Member: renameNamespace(member, from, to)}
+		}
+		pipe.ZAdd(ctx, inNamespace(config.ExpiryIndexKey, to), renamed...)
+	}
+	if !opts.Copy {
+		pipe.Del(ctx, serverIndex, expiryIndex)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to merge server indexes: %w", err)
+	}
+	return merged, nil
+}
+
+// moveKey renames key to target, or with keep copies it, unless target exists. Returns false if it does,
+// or if key no longer exists.
+func (c *Client) moveKey(ctx context.Context, key, target string, keep bool) (bool, error) {
+	if keep {
+		copied, err := c.client.Copy(ctx, key, target, 0, false).Result()
+		if err != nil {
+			return false, fmt.Errorf("failed to copy key %s: %w", key, err)
+		}
+		return copied == 1, nil
+	}
+	renamed, err := c.client.RenameNX(ctx, key, target).Result()
+	if redis.HasErrorPrefix(err, "no such key") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to rename key %s: %w", key, err)
+	}
+	return renamed, nil
+}
+
+// sameValue reports whether keys a and b hold the same value, ignoring their TTLs.
+// Returns redis.Nil if either doesn't exist.
+func (c *Client) sameValue(ctx context.Context, a, b string) (bool, error) {
+	pipe := c.client.Pipeline()
+	dumpA := pipe.Dump(ctx, a)
+	dumpB := pipe.Dump(ctx, b)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return false, redis.Nil
+		}
+		return false, fmt.Errorf("failed to compare keys %s and %s: %w", a, b, err)
+	}
+	return dumpA.Val() == dumpB.Val(), nil
+}
+
+// scanKeys returns every key matching pattern
+func (c *Client) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := c.client.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("scan failed: %w", err)
+	}
+	return keys, nil
+}
+
+// renameNamespace returns key, which is in namespace from, in namespace to
+func renameNamespace(key, from, to string) string {
+	return to + ":" + strings.TrimPrefix(key, from+":")
+}
+
+// inNamespace returns key, one of the keys in package config, in namespace rather than the
+// namespace this process uses
+func inNamespace(key, namespace string) string {
+	return renameNamespace(key, config.KeyNamespace(), namespace)
+}
@@ -0,0 +1,31 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+func TestRenameNamespace(t *testing.T) {
+	if got := renameNamespace("vmmanager:servers:cs101:alice", "vmmanager", "labs-prod"); got != "labs-prod:servers:cs101:alice" {
+		t.Errorf("expected labs-prod:servers:cs101:alice, got %s", got)
+	}
+	if got := inNamespace(config.ExpiryIndexKey, "staging"); got != "staging:expiry" {
+		t.Errorf("expected staging:expiry, got %s", got)
+	}
+}
+
+func TestRenameHandoffEntry(t *testing.T) {
+	entry := `{"cacheKey":"vmmanager:servers:alice","serverId":"srv-1","state":{"address":"enc:v1:abc"}}`
+	want := `{"cacheKey":"labs-prod:servers:alice","serverId":"srv-1","state":{"address":"enc:v1:abc"}}`
+	if got := renameHandoffEntry(entry, "vmmanager", "labs-prod"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	// Entries that aren't in the source namespace or can't be decoded are kept as they are
+	for _, value := range []string{`{"cacheKey":"staging:servers:alice"}`, `not json`} {
+		if got := renameHandoffEntry(value, "vmmanager", "labs-prod"); got != value {
+			t.Errorf("expected %s to be kept, got %s", value, got)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Results of a Redis call
+const (
+	ResultSuccess = "success" // includes a missing key (redis.Nil)
+	ResultError   = "error"
+)
+
+// CallHook observes every Redis call once it completes, e.g. to record metrics. op is the
+// command name ("get", "evalsha", ...) or "pipeline"; err is nil for a missing key.
+type CallHook func(ctx context.Context, op string, duration time.Duration, err error)
+
+// OpError is an error of a Redis call with the operation and key it failed on. It wraps
+// the underlying error, so errors.Is and errors.As see through it.
+type OpError struct {
+	Op  string // command name, e.g. "evalsha"
+	Key string // first key the command touched, "" for none
+	Err error
+}
+
+func (e *OpError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("redis %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("redis %s %s: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	calls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swim_redis_calls_total",
+		Help: "Redis calls by operation and result.",
+	}, []string{"operation", "result"})
+
+	callDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "swim_redis_call_duration_seconds",
+		Help:    "Latency of Redis calls by operation.",
+		Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5},
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(calls, callDuration)
+}
+
+// RecordCallMetrics is a CallHook that counts calls by operation and result and records
+// their latency in Prometheus
+func RecordCallMetrics(ctx context.Context, op string, duration time.Duration, err error) {
+	callDuration.WithLabelValues(op).Observe(duration.Seconds())
+	result := ResultSuccess
+	if err != nil {
+		result = ResultError
+	}
+	calls.WithLabelValues(op, result).Inc()
+}
+
+// callObserver is the go-redis hook behind WithCallHook and OpError
+type callObserver struct {
+	client *Client
+}
+
+func (o callObserver) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (o callObserver) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		started := time.Now()
+		if !o.allow() {
+			err := &OpError{Op: cmd.Name(), Key: commandKey(cmd), Err: ErrCircuitOpen}
+			cmd.SetErr(err)
+			o.observe(ctx, cmd.Name(), time.Since(started), err)
+			return err
+		}
+
+		// A blocking pop waits for its own timeout, which go-redis adds to the read deadline
+		callCtx := ctx
+		if o.client.timeout > 0 && !blocking(cmd) {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(ctx, o.client.timeout)
+			defer cancel()
+		}
+		err := next(callCtx, cmd)
+		o.record(ctx, err)
+		if err != nil && !errors.Is(err, redis.Nil) {
+			err = &OpError{Op: cmd.Name(), Key: commandKey(cmd), Err: err}
+			cmd.SetErr(err)
+		}
+		o.observe(ctx, cmd.Name(), time.Since(started), err)
+		return err
+	}
+}
+
+func (o callObserver) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		started := time.Now()
+		if !o.allow() {
+			err := &OpError{Op: "pipeline", Err: ErrCircuitOpen}
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			o.observe(ctx, "pipeline", time.Since(started), err)
+			return err
+		}
+
+		callCtx := ctx
+		if o.client.timeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(ctx, o.client.timeout)
+			defer cancel()
+		}
+		err := next(callCtx, cmds)
+		o.record(ctx, err)
+		if err == nil {
+			o.observe(ctx, "pipeline", time.Since(started), nil)
+			return nil
+		}
+
+		// Exec returns the first failed command's error, so return it with its context too
+		var first error
+		for _, cmd := range cmds {
+			cmdErr := cmd.Err()
+			if cmdErr == nil || errors.Is(cmdErr, redis.Nil) {
+				continue
+			}
+			cmdErr = &OpError{Op: cmd.Name(), Key: commandKey(cmd), Err: cmdErr}
+			cmd.SetErr(cmdErr)
+			if first == nil {
+				first = cmdErr
+			}
+		}
+		if first == nil {
+			first = err
+			if !errors.Is(err, redis.Nil) {
+				first = &OpError{Op: "pipeline", Err: err}
+			}
+		}
+		o.observe(ctx, "pipeline", time.Since(started), first)
+		return first
+	}
+}
+
+// allow reports whether the circuit breaker lets a call through
+func (o callObserver) allow() bool {
+	return o.client.breaker == nil || o.client.breaker.allow()
+}
+
+// record counts the outcome of a call in the circuit breaker and logs when the circuit opens or closes
+func (o callObserver) record(ctx context.Context, err error) {
+	if o.client.breaker == nil {
+		return
+	}
+	switch o.client.breaker.record(err) {
+	case CircuitOpen:
+		o.client.logger(ctx).Warn("redis unreachable, failing calls until the cooldown is over",
+			"consecutive_failures", o.client.breaker.health().Failures, "cooldown", o.client.breaker.cooldown, "error", err)
+	case CircuitClosed:
+		o.client.logger(ctx).Info("redis reachable again, circuit breaker closed")
+	}
+}
+
+// observe passes a completed call to the call hooks; a missing key counts as success
+func (o callObserver) observe(ctx context.Context, op string, duration time.Duration, err error) {
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	for _, hook := range o.client.hooks {
+		hook(ctx, op, duration, err)
+	}
+}
+
+// blocking reports whether cmd blocks until an element arrives or its own timeout passes
+func blocking(cmd redis.Cmder) bool {
+	switch strings.ToLower(cmd.Name()) {
+	case "blpop", "brpop", "blmove", "brpoplpush", "blmpop", "bzpopmin", "bzpopmax", "bzmpop":
+		return true
+	}
+	return false
+}
+
+// commandKey returns the first key cmd touches, "" if it has none or it can't be told
+func commandKey(cmd redis.Cmder) string {
+	args := cmd.Args()
+	switch strings.ToLower(cmd.Name()) {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro":
+		// eval script numkeys key...
+		if len(args) > 3 {
+			if n, ok := args[2].(int); ok && n > 0 {
+				return fmt.Sprint(args[3])
+			}
+		}
+		return ""
+	case "ping", "multi", "exec", "script":
+		return ""
+	}
+	if len(args) > 1 {
+		if key, ok := args[1].(string); ok {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// replyError is an error reply of the Redis server
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+func (replyError) RedisError() {}
+
+func TestCommandKey(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		cmd  redis.Cmder
+		want string
+	}{
+		{name: "get", cmd: redis.NewStringCmd(ctx, "get", "vmmanager:servers:u1"), want: "vmmanager:servers:u1"},
+		{name: "evalsha with keys", cmd: redis.NewCmd(ctx, "evalsha", "abc", 2, "vmmanager:servers:u1", "vmmanager:ratelimit:u1:create"), want: "vmmanager:servers:u1"},
+		{name: "eval without keys", cmd: redis.NewCmd(ctx, "eval", "return 1", 0), want: ""},
+		{name: "ping", cmd: redis.NewStatusCmd(ctx, "ping"), want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commandKey(tt.cmd); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCallObserver_ProcessHook(t *testing.T) {
+	replyErr := replyError("NOSCRIPT No matching script")
+	tests := []struct {
+		name     string
+		err      error
+		wantOp   bool // the error comes back as an *OpError
+		wantHook error
+	}{
+		{name: "success"},
+		{name: "missing key is returned as is", err: redis.Nil},
+		{name: "error gets operation and key", err: replyErr, wantOp: true, wantHook: replyErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hookOp string
+			var hookErr error
+			client := (&Client{}).WithCallHook(func(ctx context.Context, op string, duration time.Duration, err error) {
+				hookOp, hookErr = op, err
+			})
+			process := callObserver{client: client}.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+				cmd.SetErr(tt.err)
+				return tt.err
+			})
+
+			cmd := redis.NewStringCmd(context.Background(), "get", "vmmanager:servers:u1")
+			err := process(context.Background(), cmd)
+
+			if hookOp != "get" || !errors.Is(hookErr, tt.wantHook) || (tt.wantHook == nil && hookErr != nil) {
+				t.Errorf("expected hook call get/%v, got %s/%v", tt.wantHook, hookOp, hookErr)
+			}
+			if !tt.wantOp {
+				if err != tt.err || cmd.Err() != tt.err {
+					t.Errorf("expected %v unchanged, got %v", tt.err, err)
+				}
+				return
+			}
+			var opErr *OpError
+			if !errors.As(err, &opErr) || opErr.Op != "get" || opErr.Key != "vmmanager:servers:u1" {
+				t.Fatalf("expected an OpError for get vmmanager:servers:u1, got %v", err)
+			}
+			if !errors.Is(cmd.Err(), replyErr) || !redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+				t.Errorf("expected the command error to wrap the reply error, got %v", cmd.Err())
+			}
+		})
+	}
+}
+
+func TestCallObserver_ProcessPipelineHook(t *testing.T) {
+	ctx := context.Background()
+	replyErr := replyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	process := callObserver{client: &Client{}}.ProcessPipelineHook(func(ctx context.Context, cmds []redis.Cmder) error {
+		cmds[1].SetErr(replyErr)
+		return replyErr
+	})
+
+	cmds := []redis.Cmder{
+		redis.NewIntCmd(ctx, "srem", "vmmanager:index:servers", "k"),
+		redis.NewIntCmd(ctx, "zrem", "vmmanager:index:expiry", "k"),
+	}
+	err := process(ctx, cmds)
+
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != "zrem" || opErr.Key != "vmmanager:index:expiry" || !errors.Is(err, replyErr) {
+		t.Errorf("expected an OpError for the failed zrem, got %v", err)
+	}
+	if cmds[0].Err() != nil || !errors.As(cmds[1].Err(), &opErr) {
+		t.Errorf("expected only the failed command's error to be wrapped, got %v, %v", cmds[0].Err(), cmds[1].Err())
+	}
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// PendingCreate is a server creation recorded before the provider is called,
+// so a server whose creation failed half-way can still be found by name
+type PendingCreate struct {
+	Name          string    `json:"name"` // generated server name
+	WebUserID     string    `json:"webUserId"`
+	LabID         int       `json:"labId"`
+	Tenant        string    `json:"tenant,omitempty"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	InstanceID    string    `json:"instanceId"` // instance that started the creation
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// RecordPendingCreate adds a creation to the pending-create journal
+func (c *Client) RecordPendingCreate(ctx context.Context, pending PendingCreate) error {
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending create for %s: %w", pending.Name, err)
+	}
+
+	if err := c.client.HSet(ctx, config.PendingCreatesKey, pending.Name, data).Err(); err != nil {
+		return fmt.Errorf("failed to record pending create: %w", err)
+	}
+	return nil
+}
+
+// ClearPendingCreate removes a finished creation from the pending-create journal
+func (c *Client) ClearPendingCreate(ctx context.Context, name string) error {
+	if err := c.client.HDel(ctx, config.PendingCreatesKey, name).Err(); err != nil {
+		return fmt.Errorf("failed to clear pending create: %w", err)
+	}
+	return nil
+}
+
+// ListPendingCreates returns every creation in the pending-create journal
+func (c *Client) ListPendingCreates(ctx context.Context) ([]PendingCreate, error) {
+	values, err := c.client.HGetAll(ctx, config.PendingCreatesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending creates: %w", err)
+	}
+
+	pending := make([]PendingCreate, 0, len(values))
+	for name, data := range values {
+		var entry PendingCreate
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			c.logger(ctx).Warn("failed to decode pending create", "key", config.PendingCreatesKey, "field", name, "operation", "list_pending_creates", "error", err)
+			continue
+		}
+		pending = append(pending, entry)
+	}
+	return pending, nil
+}
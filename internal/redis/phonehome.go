@@ -0,0 +1,23 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// PhoneHomeKey returns the key a server, or a relay receiving its cloud-init phone_home
+// post, sets once the server is ready for its student
+func PhoneHomeKey(serverID string) string {
+	return config.PhoneHomePrefix + serverID
+}
+
+// PhonedHome reports whether the server has set its phone-home key
+func (c *Client) PhonedHome(ctx context.Context, serverID string) (bool, error) {
+	n, err := c.client.Exists(ctx, PhoneHomeKey(serverID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to read phone-home key: %w", transient(err))
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,143 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// indexVersion is the version of the server and expiry indexes this build keeps. Bumping it
+// makes the next startup scan the keyspace and build the indexes again.
+const indexVersion = "1"
+
+// CacheSummary describes the server cache as found by PrimeServerCache
+type CacheSummary struct {
+	States   []ServerState  // every readable entry
+	ByStatus map[string]int // entries by status
+	Expired  int            // entries past their expiresAt, waiting for the cleanup worker
+	Pruned   int            // index members whose entry was gone
+	Scanned  bool           // the keyspace was scanned to build the indexes
+}
+
+// Count returns the number of entries in any of statuses
+func (s *CacheSummary) Count(statuses ...string) int {
+	count := 0
+	for _, status := range statuses {
+		count += s.ByStatus[status]
+	}
+	return count
+}
+
+// add counts state, which expires at or before now counts as expired
+func (s *CacheSummary) add(state ServerState, now time.Time) {
+	s.States = append(s.States, state)
+	s.ByStatus[state.Status]++
+	if state.Status == config.StatusExpired || (!state.ExpiresAt.IsZero() && !state.ExpiresAt.After(now)) {
+		s.Expired++
+	}
+}
+
+// PrimeServerCache reads every server cache entry at startup, and removes index members whose
+// entry is gone, so the cleanup worker and the admin API start from the actual cache. Until
+// the indexes are marked with the current version, the keyspace is scanned and each entry
+// added to the server and expiry indexes, which also indexes entries written by versions that
+// predate them; afterwards the entries are read through the server index.
+func (c *Client) PrimeServerCache(ctx context.Context, now time.Time) (*CacheSummary, error) {
+	version, err := c.client.Get(ctx, config.IndexVersionKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to read index version: %w", err)
+	}
+	if version == indexVersion {
+		return c.readIndexedCache(ctx, now)
+	}
+
+	summary, err := c.scanServerCache(ctx, now)
+	if err != nil {
+		return summary, err
+	}
+	if err := c.client.Set(ctx, config.IndexVersionKey, indexVersion, 0).Err(); err != nil {
+		return summary, fmt.Errorf("failed to mark index version: %w", err)
+	}
+	return summary, nil
+}
+
+// readIndexedCache reads the entries of the server index, pruning members whose entry is gone
+func (c *Client) readIndexedCache(ctx context.Context, now time.Time) (*CacheSummary, error) {
+	summary := &CacheSummary{ByStatus: make(map[string]int)}
+	keys, err := c.client.SMembers(ctx, config.ServerIndexKey).Result()
+	if err != nil {
+		return summary, fmt.Errorf("failed to read server index: %w", err)
+	}
+	indexed, stale, err := c.fetchIndexedStates(ctx, keys)
+	if err != nil {
+		return summary, err
+	}
+	c.pruneServerIndexes(ctx, stale)
+	summary.Pruned = len(stale)
+	for _, entry := range indexed {
+		summary.add(entry.state, now)
+	}
+	return summary, nil
+}
+
+// scanServerCache scans the keyspace for server cache entries, adds each to the indexes and
+// removes index members whose entry is gone
+func (c *Client) scanServerCache(ctx context.Context, now time.Time) (*CacheSummary, error) {
+	summary := &CacheSummary{ByStatus: make(map[string]int), Scanned: true}
+	found := make(map[string]bool)
+	iter := c.client.Scan(ctx, 0, config.ServerCachePrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		state, err := c.GetServerState(ctx, key)
+		if err != nil {
+			// Entry expired between SCAN and GET, or is unreadable
+			continue
+		}
+
+		pipe := c.client.TxPipeline()
+		pipe.SAdd(ctx, config.ServerIndexKey, key)
+		pipe.ZAdd(ctx, config.ExpiryIndexKey, redis.Z{Score: float64(state.ExpiresAt.UnixMilli()), Member: key})
+		if _, err := pipe.Exec(ctx); err != nil {
+			return summary, fmt.Errorf("failed to index key %s: %w", key, err)
+		}
+		found[key] = true
+		summary.add(*state, now)
+	}
+	if err := iter.Err(); err != nil {
+		return summary, fmt.Errorf("scan failed: %w", err)
+	}
+
+	indexed, err := c.client.SMembers(ctx, config.ServerIndexKey).Result()
+	if err != nil {
+		return summary, fmt.Errorf("failed to read server index: %w", err)
+	}
+	scheduled, err := c.client.ZRange(ctx, config.ExpiryIndexKey, 0, -1).Result()
+	if err != nil {
+		return summary, fmt.Errorf("failed to read expiry index: %w", err)
+	}
+	var stale []interface{}
+	for _, key := range append(indexed, scheduled...) {
+		if found[key] {
+			continue
+		}
+		// Members of both indexes are checked once
+		found[key] = true
+		// The entry may have been written by another instance since the scan
+		exists, err := c.client.Exists(ctx, key).Result()
+		if err != nil {
+			return summary, fmt.Errorf("failed to check key %s: %w", key, err)
+		}
+		if exists == 0 {
+			stale = append(stale, key)
+		}
+	}
+	c.pruneServerIndexes(ctx, stale)
+	summary.Pruned = len(stale)
+
+	return summary, nil
+}
@@ -0,0 +1,36 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+func TestCacheSummary_Counts(t *testing.T) {
+	now := time.Now()
+	summary := &CacheSummary{ByStatus: make(map[string]int)}
+	for _, state := range []ServerState{
+		{WebUserID: "a", Status: config.StatusRunning, ExpiresAt: now.Add(time.Hour)},
+		{WebUserID: "b", Status: config.StatusRunning, ExpiresAt: now.Add(-time.Minute)},
+		{WebUserID: "c", Status: config.StatusExpired, ExpiresAt: now.Add(time.Hour)},
+		{WebUserID: "d", Status: config.StatusQueued},
+		{WebUserID: "e", Status: config.StatusProvisioning, ExpiresAt: now.Add(time.Hour)},
+	} {
+		summary.add(state, now)
+	}
+
+	if len(summary.States) != 5 {
+		t.Errorf("expected 5 states, got %d", len(summary.States))
+	}
+	if got := summary.Count(config.StatusRunning); got != 2 {
+		t.Errorf("expected 2 running, got %d", got)
+	}
+	if got := summary.Count(config.StatusQueued, config.StatusProvisioning); got != 2 {
+		t.Errorf("expected 2 provisioning, got %d", got)
+	}
+	// Past its expiresAt or already marked expired; no expiresAt yet doesn't count
+	if summary.Expired != 2 {
+		t.Errorf("expected 2 expired, got %d", summary.Expired)
+	}
+}
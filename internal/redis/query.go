@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// defaultQueryLimit is the page size of QueryServerStates when the filter sets none
+const defaultQueryLimit = 100
+
+// StateFilter selects server states for QueryServerStates. Zero values match everything.
+type StateFilter struct {
+	Status       string    // normalized status, e.g. "running"
+	LabID        int       // lab ID; 0 matches every lab
+	Tenant       string    // tenant ID; empty matches every tenant
+	ExpiresFrom  time.Time // only states expiring at or after this time
+	ExpiresUntil time.Time // only states expiring at or before this time
+	Cursor       string    // NextCursor of the previous page; empty starts at the beginning
+	Limit        int       // maximum states per page (default: 100)
+}
+
+// Matches reports whether state passes the status, lab and expiry filters
+func (f StateFilter) Matches(state ServerState) bool {
+	if f.Status != "" && state.Status != f.Status {
+		return false
+	}
+	if f.LabID != 0 && state.LabID != f.LabID {
+		return false
+	}
+	if f.Tenant != "" && state.Tenant != f.Tenant {
+		return false
+	}
+	if !f.ExpiresFrom.IsZero() && state.ExpiresAt.Before(f.ExpiresFrom) {
+		return false
+	}
+	if !f.ExpiresUntil.IsZero() && state.ExpiresAt.After(f.ExpiresUntil) {
+		return false
+	}
+	return true
+}
+
+// StatePage is one page of QueryServerStates results, ordered by expiry
+type StatePage struct {
+	States     []ServerState
+	NextCursor string // empty on the last page; a non-empty cursor may still lead to an empty page
+}
+
+// QueryServerStates returns a page of the server states matching filter, in expiry order.
+// It walks the expiry index in batches, so only the current batch is held in memory.
+// Pass NextCursor back in the filter to get the following page. Stale index entries
+// are pruned once the walk is done, so they don't shift the offsets mid-walk.
+func (c *Client) QueryServerStates(ctx context.Context, filter StateFilter) (*StatePage, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+
+	min, max := "-inf", "+inf"
+	if !filter.ExpiresFrom.IsZero() {
+		min = strconv.FormatInt(filter.ExpiresFrom.UnixMilli(), 10)
+	}
+	if !filter.ExpiresUntil.IsZero() {
+		max = strconv.FormatInt(filter.ExpiresUntil.UnixMilli(), 10)
+	}
+
+	// Resume at the cursor's score; members with the same score sort by key
+	var afterScore int64
+	var afterKey string
+	if filter.Cursor != "" {
+		var err error
+		afterScore, afterKey, err = parseStateCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if filter.ExpiresFrom.IsZero() || afterScore > filter.ExpiresFrom.UnixMilli() {
+			min = strconv.FormatInt(afterScore, 10)
+		}
+	}
+
+	page := &StatePage{}
+	var stale []interface{}
+	defer func() { c.pruneServerIndexes(ctx, stale) }()
+
+	for offset := int64(0); ; {
+		entries, err := c.client.ZRangeByScoreWithScores(ctx, config.ExpiryIndexKey, &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: offset,
+			Count:  indexFetchBatchSize,
+		}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read expiry index: %w", err)
+		}
+		offset += int64(len(entries))
+
+		var keys []string
+		scores := make(map[string]int64, len(entries))
+		for _, entry := range entries {
+			key, _ := entry.Member.(string)
+			score := int64(entry.Score)
+			if filter.Cursor != "" && score == afterScore && key <= afterKey {
+				continue
+			}
+			keys = append(keys, key)
+			scores[key] = score
+		}
+
+		states, batchStale, err := c.fetchIndexedStates(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, batchStale...)
+		for _, indexed := range states {
+			if !filter.Matches(indexed.state) {
+				continue
+			}
+			page.States = append(page.States, indexed.state)
+			if len(page.States) == limit {
+				page.NextCursor = formatStateCursor(scores[indexed.key], indexed.key)
+				return page, nil
+			}
+		}
+
+		if len(entries) < indexFetchBatchSize {
+			return page, nil
+		}
+	}
+}
+
+// formatStateCursor encodes a position in the expiry index as "{score}:{key}"
+func formatStateCursor(score int64, key string) string {
+	return strconv.FormatInt(score, 10) + ":" + key
+}
+
+// parseStateCursor decodes a cursor made by formatStateCursor
+func parseStateCursor(cursor string) (int64, string, error) {
+	scoreStr, key, ok := strings.Cut(cursor, ":")
+	if !ok || key == "" {
+		return 0, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	score, err := strconv.ParseInt(scoreStr, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid cursor %q: %w", cursor, err)
+	}
+	return score, key, nil
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateFilter_Matches(t *testing.T) {
+	now := time.Now()
+	state := ServerState{Status: "running", LabID: 12, Tenant: "cs101", ExpiresAt: now}
+
+	tests := []struct {
+		name   string
+		filter StateFilter
+		want   bool
+	}{
+		{"empty filter", StateFilter{}, true},
+		{"status match", StateFilter{Status: "running"}, true},
+		{"status mismatch", StateFilter{Status: "provisioning"}, false},
+		{"lab match", StateFilter{LabID: 12}, true},
+		{"lab mismatch", StateFilter{LabID: 13}, false},
+		{"tenant match", StateFilter{Tenant: "cs101"}, true},
+		{"tenant mismatch", StateFilter{Tenant: "cs202"}, false},
+		{"inside expiry window", StateFilter{ExpiresFrom: now.Add(-time.Minute), ExpiresUntil: now.Add(time.Minute)}, true},
+		{"window bounds are inclusive", StateFilter{ExpiresFrom: now, ExpiresUntil: now}, true},
+		{"expires before window", StateFilter{ExpiresFrom: now.Add(time.Minute)}, false},
+		{"expires after window", StateFilter{ExpiresUntil: now.Add(-time.Minute)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(state); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateCursor(t *testing.T) {
+	cursor := formatStateCursor(-62135596800000, "vmmanager:servers:user:1")
+	score, key, err := parseStateCursor(cursor)
+	if err != nil {
+		t.Fatalf("parseStateCursor failed: %v", err)
+	}
+	if score != -62135596800000 || key != "vmmanager:servers:user:1" {
+		t.Errorf("cursor round trip gave %d %q", score, key)
+	}
+
+	for _, invalid := range []string{"", "123", "abc:key", "123:"} {
+		if _, _, err := parseStateCursor(invalid); err == nil {
+			t.Errorf("expected error for cursor %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+// Package redistest provides an in-memory stand-in for the Redis client, for unit tests and
+// for running SWIM's workers without a Redis server. It keeps the semantics callers rely on:
+// blocking queue pops, versioned state writes, key TTLs, rate limits and provision admission.
+package redistest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// extensionsTTL keeps a day's extension count like the Redis client
+const extensionsTTL = 48 * time.Hour
+
+// sequenceTTL keeps a user's operation sequence like the Redis client
+const sequenceTTL = 7 * 24 * time.Hour
+
+// Store is an in-memory Redis. It is safe for concurrent use. TTLs are measured with its
+// clock, so a test can expire entries and rate limits by advancing a clock.Fake; queue pops
+// still wait in real time.
+type Store struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	queues     map[string][]string
+	pushed     chan struct{} // closed and replaced whenever a payload is pushed
+	states     map[string]expiring[redis.ServerState]
+	rateLimits map[string]expiring[struct{}]
+	userHashes map[string]expiring[string]
+	activity   map[string]expiring[time.Time]
+	extensions map[string]expiring[int] // extensions key -> count
+	sequences  map[string]expiring[sequence]
+	flags      map[string]string
+	statusSubs map[chan redis.StatusNotice]struct{}
+	sessions   []redis.SessionRecord
+}
+
+// sequence is the operation sequence of a user
+type sequence struct{ issued, applied int64 }
+
+// expiring is a value with its expiry
+type expiring[T any] struct {
+	value     T
+	expiresAt time.Time // zero = no expiry
+}
+
+// New creates an empty store on the system clock
+func New() *Store {
+	return &Store{
+		clock:      clock.Real,
+		queues:     make(map[string][]string),
+		pushed:     make(chan struct{}),
+		states:     make(map[string]expiring[redis.ServerState]),
+		rateLimits: make(map[string]expiring[struct{}]),
+		userHashes: make(map[string]expiring[string]),
+		activity:   make(map[string]expiring[time.Time]),
+		extensions: make(map[string]expiring[int]),
+		sequences:  make(map[string]expiring[sequence]),
+		flags:      make(map[string]string),
+		statusSubs: make(map[chan redis.StatusNotice]struct{}),
+	}
+}
+
+var (
+	_ redis.ClientInterface  = (*Store)(nil)
+	_ redis.ActivityReader   = (*Store)(nil)
+	_ redis.ExtensionCounter = (*Store)(nil)
+	_ redis.Sequencer        = (*Store)(nil)
+	_ redis.FlagReader       = (*Store)(nil)
+	_ redis.StatusBus        = (*Store)(nil)
+	_ redis.SessionStream    = (*Store)(nil)
+)
+
+// WithClock measures TTLs with c instead of the system clock
+func (s *Store) WithClock(c clock.Clock) *Store {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+	return s
+}
+
+// expiry returns the expiry of a key set now for ttl. Must be called with s.mu held.
+func (s *Store) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return s.clock.Now().Add(ttl)
+}
+
+// live reports whether a key expiring at expiresAt still exists. Must be called with s.mu held.
+func (s *Store) live(expiresAt time.Time) bool {
+	return expiresAt.IsZero() || s.clock.Now().Before(expiresAt)
+}
+
+// PopPayload pops a payload from the queue, waiting up to timeout
+func (s *Store) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	_, payload, err := s.PopAnyPayload(ctx, []string{queueKey}, timeout)
+	return payload, err
+}
+
+// PopAnyPayload pops a payload from the first of queueKeys that holds one, waiting up to timeout
+func (s *Store) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mu.Lock()
+		for _, queueKey := range queueKeys {
+			if queue := s.queues[queueKey]; len(queue) > 0 {
+				s.queues[queueKey] = queue[1:]
+				s.mu.Unlock()
+				return queueKey, queue[0], nil
+			}
+		}
+		pushed := s.pushed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-deadline.C:
+			return "", "", errs.New("no payload available in queues", errs.ErrNotFound)
+		case <-pushed:
+		}
+	}
+}
+
+// PushPayload appends a payload to the queue
+func (s *Store) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	return s.PushPayloads(ctx, queueKey, []string{payload})
+}
+
+// PushPayloads appends several payloads to the queue
+func (s *Store) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queues[queueKey] = append(s.queues[queueKey], payloads...)
+	close(s.pushed)
+	s.pushed = make(chan struct{})
+	return nil
+}
+
+// Queue returns the payloads waiting in the queue, oldest first
+func (s *Store) Queue(queueKey string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queues[queueKey]...)
+}
+
+// QueueLength returns the number of payloads waiting in the queue
+func (s *Store) QueueLength(queueKey string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queues[queueKey])
+}
+
+// PushServerState writes state if the cached version matches state.Version, like the Redis client
+func (s *Store) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pushState(cacheKey, state, ttl)
+}
+
+// PushServerStates writes several states, reporting every conflicting key
+func (s *Store) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conflicts []string
+	for cacheKey, state := range states {
+		if err := s.pushState(cacheKey, state, ttl); err != nil {
+			conflicts = append(conflicts, cacheKey)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("%s: %w", strings.Join(conflicts, ", "), redis.ErrVersionConflict)
+	}
+	return nil
+}
+
+// pushState writes one versioned state. Must be called with s.mu held.
+func (s *Store) pushState(cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	var version int64
+	if existing, ok := s.state(cacheKey); ok {
+		version = existing.Version
+	}
+	if version != state.Version {
+		return redis.ErrVersionConflict
+	}
+
+	state.Version++
+	state.SchemaVersion = redis.SchemaVersion
+	s.states[cacheKey] = expiring[redis.ServerState]{value: state, expiresAt: s.expiry(ttl)}
+	return nil
+}
+
+// state returns the live state of cacheKey, dropping it if it expired. Must be called with s.mu held.
+func (s *Store) state(cacheKey string) (redis.ServerState, bool) {
+	entry, ok := s.states[cacheKey]
+	if ok && !s.live(entry.expiresAt) {
+		delete(s.states, cacheKey)
+		return redis.ServerState{}, false
+	}
+	return entry.value, ok
+}
+
+// GetServerState returns the cached state of cacheKey
+func (s *Store) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.state(cacheKey)
+	if !ok {
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
+	}
+	return &state, nil
+}
+
+// GetAllServerStates returns every cached state whose key starts with prefix
+func (s *Store) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+	var states []redis.ServerState
+	for _, entry := range s.sortedEntries() {
+		if strings.HasPrefix(entry.key, prefix) {
+			states = append(states, entry.state)
+		}
+	}
+	return states, nil
+}
+
+// GetExpiredServerStates returns the cached states whose ExpiresAt is at or before now
+func (s *Store) GetExpiredServerStates(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+	var states []redis.ServerState
+	for _, entry := range s.sortedEntries() {
+		if !entry.state.ExpiresAt.After(now) {
+			states = append(states, entry.state)
+		}
+	}
+	return states, nil
+}
+
+// QueryServerStates returns a page of the states matching filter in expiry order.
+// The cursor is the number of matching states already returned.
+func (s *Store) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	offset := 0
+	if filter.Cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(filter.Cursor); err != nil {
+			return nil, fmt.Errorf("invalid cursor %q", filter.Cursor)
+		}
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	var matching []redis.ServerState
+	for _, entry := range s.sortedEntries() {
+		if filter.Matches(entry.state) {
+			matching = append(matching, entry.state)
+		}
+	}
+
+	page := &redis.StatePage{}
+	if offset >= len(matching) {
+		return page, nil
+	}
+	end := min(offset+limit, len(matching))
+	page.States = matching[offset:end]
+	if end < len(matching) {
+		page.NextCursor = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+// keyedState is a cached state with its key
+type keyedState struct {
+	key   string
+	state redis.ServerState
+}
+
+// sortedEntries returns the live states ordered by expiry, then key
+func (s *Store) sortedEntries() []keyedState {
+	s.mu.Lock()
+	entries := make([]keyedState, 0, len(s.states))
+	for key := range s.states {
+		if state, ok := s.state(key); ok {
+			entries = append(entries, keyedState{key: key, state: state})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].state.ExpiresAt.Equal(entries[j].state.ExpiresAt) {
+			return entries[i].state.ExpiresAt.Before(entries[j].state.ExpiresAt)
+		}
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+// ServerCount returns the number of cached states
+func (s *Store) ServerCount() int {
+	return len(s.sortedEntries())
+}
+
+// DeleteServerState removes a cached state
+func (s *Store) DeleteServerState(ctx context.Context, cacheKey string) error {
+	return s.DeleteServerStates(ctx, []string{cacheKey})
+}
+
+// DeleteServerStates removes several cached states
+func (s *Store) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range cacheKeys {
+		delete(s.states, key)
+	}
+	return nil
+}
+
+// PushUserHash stores the mapping from a label hash to its web user ID for ttl
+func (s *Store) PushUserHash(ctx context.Context, hash string, webUserID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userHashes[hash] = expiring[string]{value: webUserID, expiresAt: s.expiry(ttl)}
+	return nil
+}
+
+// GetUserByHash resolves a label hash to its web user ID
+func (s *Store) GetUserByHash(ctx context.Context, hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.userHashes[hash]
+	if !ok || !s.live(entry.expiresAt) {
+		return "", errs.New("user hash not found", errs.ErrNotFound)
+	}
+	return entry.value, nil
+}
+
+// TryAcquireRateLimit takes the rate limit of the user's operation for ttl unless it is held
+func (s *Store) TryAcquireRateLimit(ctx context.Context, webUserID string, operation string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acquire(redis.RateLimitKey(webUserID, operation), ttl), nil
+}
+
+// acquire sets key for ttl unless it is already set. Must be called with s.mu held.
+func (s *Store) acquire(key string, ttl time.Duration) bool {
+	if entry, ok := s.rateLimits[key]; ok && s.live(entry.expiresAt) {
+		return false
+	}
+	s.rateLimits[key] = expiring[struct{}]{expiresAt: s.expiry(ttl)}
+	return true
+}
+
+// AdmitProvision decides on a provision request like the Redis admission script: a request
+// for the cached lab is a duplicate, any other takes the start or switch window unless it is 0,
+// and a start opens the switch window
+func (s *Store) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := &redis.AdmissionResult{}
+	existing, found := s.state(cacheKey)
+	operation, window := redis.RateLimitStart, limits.Start
+	var version int64
+	if found {
+		result.Existing = &existing
+		if existing.LabID == state.LabID {
+			result.Decision = redis.AdmissionDuplicate
+			return result, nil
+		}
+		operation, window = redis.RateLimitSwitch, limits.Switch
+		version = existing.Version
+	}
+
+	userID := redis.TenantUserID(state.Tenant, state.WebUserID)
+	if window > 0 && !s.acquire(redis.RateLimitKey(userID, operation), window) {
+		result.Decision = redis.AdmissionRateLimited
+		return result, nil
+	}
+	if !found && limits.Switch > 0 {
+		s.rateLimits[redis.RateLimitKey(userID, redis.RateLimitSwitch)] = expiring[struct{}]{expiresAt: s.expiry(limits.Switch)}
+	}
+
+	state.Version = version + 1
+	state.SchemaVersion = redis.SchemaVersion
+	s.states[cacheKey] = expiring[redis.ServerState]{value: state, expiresAt: s.expiry(cacheTTL)}
+	result.Version = state.Version
+	result.Decision = redis.AdmissionAccepted
+	if found {
+		result.Decision = redis.AdmissionReplaced
+	}
+	return result, nil
+}
+
+// RecordActivity sets the last activity of a tenant-scoped user ID for ttl, like LabMan's heartbeat
+func (s *Store) RecordActivity(ctx context.Context, userID string, at time.Time, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activity[userID] = expiring[time.Time]{value: at.Truncate(time.Second), expiresAt: s.expiry(ttl)}
+	return nil
+}
+
+// LastActivity returns the last activity of each user ID that has one
+func (s *Store) LastActivity(ctx context.Context, userIDs []string) (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity := make(map[string]time.Time, len(userIDs))
+	for _, id := range userIDs {
+		if entry, ok := s.activity[id]; ok && s.live(entry.expiresAt) {
+			activity[id] = entry.value
+		}
+	}
+	return activity, nil
+}
+
+// AcquireExtension counts an extension of the user on the UTC day of at unless limit is reached
+func (s *Store) AcquireExtension(ctx context.Context, userID string, at time.Time, limit int) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := redis.ExtensionsKey(userID, at)
+	count := 0
+	if entry, ok := s.extensions[key]; ok && s.live(entry.expiresAt) {
+		count = entry.value
+	}
+	if count >= limit {
+		return count, false, nil
+	}
+	count++
+	s.extensions[key] = expiring[int]{value: count, expiresAt: s.expiry(extensionsTTL)}
+	return count, true, nil
+}
+
+// ReleaseExtension takes back an extension counted with AcquireExtension
+func (s *Store) ReleaseExtension(ctx context.Context, userID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := redis.ExtensionsKey(userID, at)
+	entry := s.extensions[key]
+	entry.value--
+	s.extensions[key] = entry
+	return nil
+}
+
+// NextSequence issues the next operation sequence number of the user
+func (s *Store) NextSequence(ctx context.Context, userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.sequence(userID)
+	seq.issued++
+	s.sequences[userID] = expiring[sequence]{value: seq, expiresAt: s.expiry(sequenceTTL)}
+	return seq.issued, nil
+}
+
+// ApplySequence records seq as applied unless the same or a later number was applied first
+func (s *Store) ApplySequence(ctx context.Context, userID string, seq int64) (bool, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.sequence(userID)
+	if seq <= current.applied {
+		return false, current.applied, nil
+	}
+	current.applied = seq
+	current.issued = max(current.issued, seq)
+	s.sequences[userID] = expiring[sequence]{value: current, expiresAt: s.expiry(sequenceTTL)}
+	return true, seq, nil
+}
+
+// sequence returns the live sequence of the user. Must be called with s.mu held.
+func (s *Store) sequence(userID string) sequence {
+	if entry, ok := s.sequences[userID]; ok && s.live(entry.expiresAt) {
+		return entry.value
+	}
+	return sequence{}
+}
+
+// SetFlag sets the feature flag name to value, the way an operator does with SET
+func (s *Store) SetFlag(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flags[name] = value
+}
+
+// GetFlag returns the value of the feature flag name and whether it is set
+func (s *Store) GetFlag(ctx context.Context, name string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.flags[name]
+	return value, ok, nil
+}
+
+// PublishStatus hands notice to every subscription, dropping it for full ones like Redis
+// drops messages for clients that fall behind
+func (s *Store) PublishStatus(ctx context.Context, notice redis.StatusNotice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.statusSubs {
+		select {
+		case sub <- notice:
+		default:
+		}
+	}
+	return nil
+}
+
+// SubscribeStatus returns the notices published until ctx is done
+func (s *Store) SubscribeStatus(ctx context.Context) (<-chan redis.StatusNotice, error) {
+	sub := make(chan redis.StatusNotice, 64)
+	s.mu.Lock()
+	s.statusSubs[sub] = struct{}{}
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.statusSubs, sub)
+		close(sub)
+		s.mu.Unlock()
+	}()
+	return sub, nil
+}
+
+// AppendSession adds record to the session stream, keeping the newest maxLen records (0 keeps all)
+func (s *Store) AppendSession(ctx context.Context, record redis.SessionRecord, maxLen int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = append(s.sessions, record)
+	if maxLen > 0 && int64(len(s.sessions)) > maxLen {
+		s.sessions = s.sessions[int64(len(s.sessions))-maxLen:]
+	}
+	return nil
+}
+
+// ReadSessions returns the records in the session stream that ended at or after since, oldest first
+func (s *Store) ReadSessions(ctx context.Context, since time.Time) ([]redis.SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []redis.SessionRecord
+	for _, record := range s.sessions {
+		if !record.EndedAt.Before(since) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Sessions returns the records in the session stream, oldest first
+func (s *Store) Sessions() []redis.SessionRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.sessions)
+}
+
+// Close does nothing; the store lives as long as the process
+func (s *Store) Close() error {
+	return nil
+}
@@ -0,0 +1,227 @@
+package redistest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/clock"
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+func TestStore_PushServerStateVersion(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	key := redis.ServerCacheKey("user")
+
+	if err := store.PushServerState(ctx, key, redis.ServerState{Status: config.StatusProvisioning}, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+	state, err := store.GetServerState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetServerState failed: %v", err)
+	}
+
+	// A write based on the read version wins; a second write from the same version conflicts
+	state.Status = config.StatusRunning
+	if err := store.PushServerState(ctx, key, *state, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+	if err := store.PushServerState(ctx, key, *state, time.Minute); !errors.Is(err, redis.ErrVersionConflict) {
+		t.Errorf("expected a version conflict for a stale write, got %v", err)
+	}
+}
+
+func TestStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	now := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	store := New().WithClock(now)
+	key := redis.ServerCacheKey("user")
+
+	if err := store.PushServerState(ctx, key, redis.ServerState{WebUserID: "user"}, time.Minute); err != nil {
+		t.Fatalf("PushServerState failed: %v", err)
+	}
+	if err := store.PushUserHash(ctx, "hash", "user", time.Minute); err != nil {
+		t.Fatalf("PushUserHash failed: %v", err)
+	}
+	if err := store.RecordActivity(ctx, "user", now.Now(), time.Minute); err != nil {
+		t.Fatalf("RecordActivity failed: %v", err)
+	}
+
+	now.Advance(59 * time.Second)
+	if _, err := store.GetServerState(ctx, key); err != nil {
+		t.Errorf("expected the state before its TTL, got %v", err)
+	}
+
+	now.Advance(time.Second)
+	if _, err := store.GetServerState(ctx, key); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected the state to expire with its TTL, got %v", err)
+	}
+	if _, err := store.GetUserByHash(ctx, "hash"); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected the user hash to expire with its TTL, got %v", err)
+	}
+	if activity, _ := store.LastActivity(ctx, []string{"user"}); len(activity) != 0 {
+		t.Errorf("expected the activity to expire with its TTL, got %v", activity)
+	}
+	if store.ServerCount() != 0 {
+		t.Errorf("expected no states, got %d", store.ServerCount())
+	}
+}
+
+func TestStore_RateLimit(t *testing.T) {
+	ctx := context.Background()
+	now := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	store := New().WithClock(now)
+
+	acquire := func() bool {
+		ok, err := store.TryAcquireRateLimit(ctx, "user", "decommission", 15*time.Second)
+		if err != nil {
+			t.Fatalf("TryAcquireRateLimit failed: %v", err)
+		}
+		return ok
+	}
+	if !acquire() {
+		t.Fatal("expected the first acquisition to succeed")
+	}
+	now.Advance(14 * time.Second)
+	if acquire() {
+		t.Error("expected the rate limit to hold within its TTL")
+	}
+	now.Advance(time.Second)
+	if !acquire() {
+		t.Error("expected the rate limit to be free after its TTL")
+	}
+}
+
+func TestStore_AdmitProvision(t *testing.T) {
+	ctx := context.Background()
+	now := clock.NewFake(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	store := New().WithClock(now)
+	key := redis.ServerCacheKey("user")
+	limits := redis.AdmissionLimits{Start: 15 * time.Second, Switch: time.Minute}
+
+	admit := func(labID int, limits redis.AdmissionLimits) redis.AdmissionDecision {
+		result, err := store.AdmitProvision(ctx, key, redis.ServerState{WebUserID: "user", LabID: labID}, limits, time.Hour)
+		if err != nil {
+			t.Fatalf("AdmitProvision failed: %v", err)
+		}
+		return result.Decision
+	}
+
+	if got := admit(1, limits); got != redis.AdmissionAccepted {
+		t.Errorf("expected the first request accepted, got %s", got)
+	}
+	if got := admit(1, limits); got != redis.AdmissionDuplicate {
+		t.Errorf("expected a request for the same lab to be a duplicate, got %s", got)
+	}
+
+	// A start opens the switch window; a switch takes it, independent of the start window
+	now.Advance(15 * time.Second)
+	if got := admit(2, limits); got != redis.AdmissionRateLimited {
+		t.Errorf("expected a switch inside the switch window opened by the start rate limited, got %s", got)
+	}
+	now.Advance(45 * time.Second)
+	if got := admit(2, limits); got != redis.AdmissionReplaced {
+		t.Errorf("expected a switch after the switch window to replace the entry, got %s", got)
+	}
+	if got := admit(3, limits); got != redis.AdmissionRateLimited {
+		t.Errorf("expected a second switch inside the switch window rate limited, got %s", got)
+	}
+	now.Advance(time.Minute)
+	if got := admit(3, limits); got != redis.AdmissionReplaced {
+		t.Errorf("expected a switch after the switch window to replace the entry, got %s", got)
+	}
+	if state, _ := store.GetServerState(ctx, key); state == nil || state.LabID != 3 || state.Version != 3 {
+		t.Errorf("expected the replacing state at version 3, got %+v", state)
+	}
+
+	// Windows of 0, for admin overrides, admit inside the window
+	if got := admit(4, redis.AdmissionLimits{}); got != redis.AdmissionReplaced {
+		t.Errorf("expected an admission without rate limit, got %s", got)
+	}
+
+	// A start after a stop takes the start window again
+	store.DeleteServerState(ctx, key)
+	now.Advance(15 * time.Second)
+	if got := admit(1, limits); got != redis.AdmissionAccepted {
+		t.Errorf("expected a start after the start window accepted, got %s", got)
+	}
+	store.DeleteServerState(ctx, key)
+	if got := admit(1, limits); got != redis.AdmissionRateLimited {
+		t.Errorf("expected a restart inside the start window rate limited, got %s", got)
+	}
+}
+
+func TestStore_PopAnyPayload(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+
+	if _, _, err := store.PopAnyPayload(ctx, []string{"a", "b"}, 10*time.Millisecond); !errors.Is(err, errs.ErrNotFound) {
+		t.Fatalf("expected not found from empty queues, got %v", err)
+	}
+
+	// A pop waiting on empty queues returns the payload pushed meanwhile
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.PushPayloads(ctx, "b", []string{"1", "2"})
+	}()
+	queueKey, payload, err := store.PopAnyPayload(ctx, []string{"a", "b"}, time.Second)
+	if err != nil || queueKey != "b" || payload != "1" {
+		t.Fatalf("expected payload 1 from b, got %q from %q (%v)", payload, queueKey, err)
+	}
+	store.PushPayload(ctx, "a", "3")
+	if queueKey, payload, _ := store.PopAnyPayload(ctx, []string{"a", "b"}, time.Second); queueKey != "a" || payload != "3" {
+		t.Errorf("expected queues popped in priority order, got %q from %q", payload, queueKey)
+	}
+	if queue := store.Queue("b"); len(queue) != 1 || queue[0] != "2" {
+		t.Errorf("expected payload 2 left in b, got %v", queue)
+	}
+}
+
+func TestStore_Extensions(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 1; i <= 2; i++ {
+		if count, ok, _ := store.AcquireExtension(ctx, "user", day, 2); !ok || count != i {
+			t.Fatalf("expected extension %d granted, got %d (%v)", i, count, ok)
+		}
+	}
+	if count, ok, _ := store.AcquireExtension(ctx, "user", day, 2); ok || count != 2 {
+		t.Errorf("expected the limit reached at 2, got %d (%v)", count, ok)
+	}
+	store.ReleaseExtension(ctx, "user", day)
+	if _, ok, _ := store.AcquireExtension(ctx, "user", day, 2); !ok {
+		t.Error("expected a released extension to be available again")
+	}
+	if count, ok, _ := store.AcquireExtension(ctx, "user", day.Add(24*time.Hour), 2); !ok || count != 1 {
+		t.Errorf("expected the count to start over the next day, got %d (%v)", count, ok)
+	}
+}
+
+func TestStore_Sequence(t *testing.T) {
+	ctx := context.Background()
+	store := New()
+
+	first, _ := store.NextSequence(ctx, "user")
+	second, _ := store.NextSequence(ctx, "user")
+	if first != 1 || second != 2 {
+		t.Fatalf("expected numbers 1 and 2, got %d and %d", first, second)
+	}
+	if ok, _, _ := store.ApplySequence(ctx, "user", second); !ok {
+		t.Fatal("expected the later number to be applied")
+	}
+	if ok, applied, _ := store.ApplySequence(ctx, "user", first); ok || applied != second {
+		t.Errorf("expected the earlier number to be stale, got %v (applied %d)", ok, applied)
+	}
+	if ok, _, _ := store.ApplySequence(ctx, "user", 10); !ok {
+		t.Fatal("expected a producer's own number to be applied")
+	}
+	if next, _ := store.NextSequence(ctx, "user"); next != 11 {
+		t.Errorf("expected the next number to follow the applied one, got %d", next)
+	}
+}
@@ -0,0 +1,75 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// sequenceKeyTTL forgets the sequence of a user who has been gone for a week. Producers
+// that number from the issued counter start over at 1 along with it.
+const sequenceKeyTTL = 7 * 24 * time.Hour
+
+// SequenceKey returns the key holding the operation sequence of a tenant-scoped user ID
+// (see TenantUserID): the last number issued by NextSequence and the last one applied
+func SequenceKey(userID string) string {
+	return config.SequencePrefix + userID
+}
+
+// Sequencer orders the provision and decommission requests of each user. Producers number
+// their requests with NextSequence; the consumer applies each number once, in increasing
+// order, and drops a request whose number was overtaken as stale.
+type Sequencer interface {
+	NextSequence(ctx context.Context, userID string) (int64, error)
+	ApplySequence(ctx context.Context, userID string, seq int64) (bool, int64, error)
+}
+
+// applySequenceScript records seq as applied unless a request with the same or a later
+// number was applied first. Returns {1, seq} if it was recorded, or {0, applied} if not.
+// The issued counter is raised to seq, so numbers issued later by NextSequence stay above
+// those of producers that number their requests themselves.
+// KEYS[1] = sequence key
+// ARGV[1] = seq, ARGV[2] = key TTL (seconds)
+var applySequenceScript = redis.NewScript(`
+local seq = tonumber(ARGV[1])
+local applied = tonumber(redis.call('HGET', KEYS[1], 'applied') or '0')
+if seq <= applied then
+	return {0, applied}
+end
+redis.call('HSET', KEYS[1], 'applied', seq)
+if tonumber(redis.call('HGET', KEYS[1], 'issued') or '0') < seq then
+	redis.call('HSET', KEYS[1], 'issued', seq)
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return {1, seq}
+`)
+
+// NextSequence issues the next operation sequence number of a tenant-scoped user ID
+func (c *Client) NextSequence(ctx context.Context, userID string) (int64, error) {
+	key := SequenceKey(userID)
+	pipe := c.client.TxPipeline()
+	next := pipe.HIncrBy(ctx, key, "issued", 1)
+	pipe.Expire(ctx, key, sequenceKeyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to issue sequence number: %w", transient(err))
+	}
+	return next.Val(), nil
+}
+
+// ApplySequence records seq as the last applied operation of a tenant-scoped user ID,
+// unless a request numbered seq or later was applied already. Returns whether it was
+// recorded and the last applied number.
+func (c *Client) ApplySequence(ctx context.Context, userID string, seq int64) (bool, int64, error) {
+	reply, err := applySequenceScript.Run(ctx, c.client, []string{SequenceKey(userID)}, seq, int(sequenceKeyTTL.Seconds())).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to apply sequence number: %w", transient(err))
+	}
+	if len(reply) != 2 {
+		return false, 0, fmt.Errorf("unexpected sequence reply %v", reply)
+	}
+	return reply[0] == 1, reply[1], nil
+}
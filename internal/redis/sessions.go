@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// Exit reasons of sessions ended by a decommission request. Sessions the cleanup worker or
+// watchdog ended carry the reason they were queued with, e.g. "ttl", "idle" or "stuck".
+const (
+	ExitUser     = "user"      // the user's decommission request
+	ExitSwitch   = "switch"    // the user switched to another lab
+	ExitLabReset = "lab_reset" // an ops request decommissioned every server of the lab
+	ExitOps      = "ops"       // an ops request targeted the server by name or label
+
+	// ExitProvisionFailed ends the sessions whose provision failed before the server was available
+	ExitProvisionFailed = "provision_failed"
+)
+
+// SessionRecord is the immutable record of a completed lab session, kept for course
+// analytics after the cache entry is gone
+type SessionRecord struct {
+	WebUserID        string    `json:"webUserId"`
+	Tenant           string    `json:"tenant,omitempty"`
+	LabID            int       `json:"labId"`
+	ServerID         string    `json:"serverId"`
+	ServerType       string    `json:"serverType,omitempty"`
+	Provider         string    `json:"provider"`
+	StartedAt        time.Time `json:"startedAt,omitzero"`         // when the provision was admitted; zero for entries from before createdAt
+	EndedAt          time.Time `json:"endedAt"`                    // when the server was deleted
+	DurationSeconds  int64     `json:"durationSeconds"`            // from StartedAt to EndedAt; 0 without StartedAt
+	ProvisionSeconds int64     `json:"provisionSeconds,omitempty"` // from StartedAt until the server was available; 0 if it never was
+	ExitReason       string    `json:"exitReason"`
+	CorrelationID    string    `json:"correlationId,omitempty"`
+}
+
+// sessionPageSize is the number of records read from the stream at once
+const sessionPageSize = 1000
+
+// SessionStream keeps the records of completed sessions in a Redis stream
+type SessionStream interface {
+	AppendSession(ctx context.Context, record SessionRecord, maxLen int64) error
+	ReadSessions(ctx context.Context, since time.Time) ([]SessionRecord, error)
+}
+
+// AppendSession adds record to config.SessionsKey, trimming the stream to about maxLen
+// records (0 keeps all). Consumers read it with XREAD or a consumer group.
+func (c *Client) AppendSession(ctx context.Context, record SessionRecord, maxLen int64) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session record: %w", err)
+	}
+	args := &redis.XAddArgs{
+		Stream: config.SessionsKey,
+		Values: []any{"record", data},
+	}
+	if maxLen > 0 {
+		args.MaxLen = maxLen
+		args.Approx = true
+	}
+	if err := c.client.XAdd(ctx, args).Err(); err != nil {
+		return fmt.Errorf("failed to archive session: %w", transient(err))
+	}
+	return nil
+}
+
+// ReadSessions returns the records in config.SessionsKey of the sessions that ended at or
+// after since, oldest first
+func (c *Client) ReadSessions(ctx context.Context, since time.Time) ([]SessionRecord, error) {
+	var records []SessionRecord
+	start := strconv.FormatInt(since.UnixMilli(), 10)
+	for {
+		entries, err := c.client.XRangeN(ctx, config.SessionsKey, start, "+", sessionPageSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sessions: %w", transient(err))
+		}
+		for _, entry := range entries {
+			data, _ := entry.Values["record"].(string)
+			var record SessionRecord
+			if err := json.Unmarshal([]byte(data), &record); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal session record %s: %w", entry.ID, err)
+			}
+			// Entries are appended a moment after their session ended
+			if !record.EndedAt.Before(since) {
+				records = append(records, record)
+			}
+		}
+		if len(entries) < sessionPageSize {
+			return records, nil
+		}
+		// Continue after the last entry read
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
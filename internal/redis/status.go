@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// statusBuffer is the number of notices a subscription holds for a slow reader
+const statusBuffer = 256
+
+// StatusNotice announces that the server state under CacheKey was written or removed.
+// It carries no state, whose fields may be encrypted: subscribers read it from the cache.
+type StatusNotice struct {
+	Event    string `json:"event"` // "updated" or "deleted"
+	CacheKey string `json:"cacheKey"`
+}
+
+// StatusBus announces server state changes to every instance, so an instance can stream
+// the changes another instance writes
+type StatusBus interface {
+	PublishStatus(ctx context.Context, notice StatusNotice) error
+	SubscribeStatus(ctx context.Context) (<-chan StatusNotice, error)
+}
+
+// PublishStatus announces a state change on the status channel
+func (c *Client) PublishStatus(ctx context.Context, notice StatusNotice) error {
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return fmt.Errorf("failed to marshal status notice: %w", err)
+	}
+	if err := c.client.Publish(ctx, config.StatusChannel, data).Err(); err != nil {
+		return fmt.Errorf("failed to publish status notice: %w", transient(err))
+	}
+	return nil
+}
+
+// SubscribeStatus returns the notices published on the status channel until ctx is done,
+// when the channel is closed. The subscription reconnects by itself after a connection
+// loss; notices published meanwhile are missed.
+func (c *Client) SubscribeStatus(ctx context.Context) (<-chan StatusNotice, error) {
+	pubsub := c.client.Subscribe(ctx, config.StatusChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to status notices: %w", transient(err))
+	}
+
+	notices := make(chan StatusNotice, statusBuffer)
+	go func() {
+		defer close(notices)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var notice StatusNotice
+				if err := json.Unmarshal([]byte(msg.Payload), &notice); err != nil {
+					c.logger(ctx).Warn("ignoring malformed status notice", "channel", config.StatusChannel, "error", err)
+					continue
+				}
+				select {
+				case notices <- notice:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return notices, nil
+}
@@ -0,0 +1,66 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// Tombstone remembers a decommissioned lab for a short while, so a user who stopped
+// it by mistake can have it restored
+type Tombstone struct {
+	WebUserID     string    `json:"webUserId"`
+	LabID         int       `json:"labId"`
+	Tenant        string    `json:"tenant,omitempty"`
+	ServerID      string    `json:"serverId"` // the deleted server
+	CorrelationID string    `json:"correlationId,omitempty"`
+	DeletedAt     time.Time `json:"deletedAt"`
+}
+
+// TombstoneKey returns the tombstone key of a tenant-scoped user ID (see TenantUserID)
+func TombstoneKey(webUserID string) string {
+	return config.TombstonePrefix + webUserID
+}
+
+// TombstoneStore keeps the tombstones of decommissioned labs
+type TombstoneStore interface {
+	PushTombstone(ctx context.Context, tombstone Tombstone, ttl time.Duration) error
+	TakeTombstone(ctx context.Context, userID string) (*Tombstone, error)
+}
+
+// PushTombstone records the tombstone of a user's decommissioned lab for ttl, replacing an older one
+func (c *Client) PushTombstone(ctx context.Context, tombstone Tombstone, ttl time.Duration) error {
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tombstone: %w", err)
+	}
+	key := TombstoneKey(TenantUserID(tombstone.Tenant, tombstone.WebUserID))
+	if err := c.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to record tombstone: %w", transient(err))
+	}
+	return nil
+}
+
+// TakeTombstone removes and returns the tombstone of a tenant-scoped user ID, so a lab is
+// restored at most once. Returns an errs.ErrNotFound error if there is none (or it expired).
+func (c *Client) TakeTombstone(ctx context.Context, userID string) (*Tombstone, error) {
+	data, err := c.client.GetDel(ctx, TombstoneKey(userID)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, errs.New("tombstone not found", errs.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to take tombstone: %w", transient(err))
+	}
+
+	var tombstone Tombstone
+	if err := json.Unmarshal([]byte(data), &tombstone); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tombstone: %w", err)
+	}
+	return &tombstone, nil
+}
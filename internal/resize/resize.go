@@ -0,0 +1,211 @@
+// Package resize moves a user's running server to another server type, e.g. when a lab hits
+// its memory limit mid-course. The server is switched off for the change and keeps its disk,
+// ID and addresses, so the student continues where they left off.
+package resize
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/lifecycle"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// CloudStatusResizing is the cloud status cached while the provider changes the server type
+const CloudStatusResizing = "resizing"
+
+// Request asks to move the server a user is running to serverType
+type Request struct {
+	WebUserID     string `json:"webuserid"`
+	ServerType    string `json:"serverType"`
+	LabID         *int   `json:"labId,omitempty"` // Optional: only resize if the cached server runs this lab
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"` // Optional: traces the request through logs
+
+	// Resizing is an instructor action, so a request needs a granted admin override
+	override.Fields
+}
+
+// Handler resizes the servers of resize requests and hands them to resume, which polls
+// each one like a provision until it is available again
+type Handler struct {
+	log         *slog.Logger
+	conn        connector.Connector
+	redisClient redis.ClientInterface
+	resume      func(ctx context.Context, entry redis.HandoffEntry)
+	tenants     *tenant.Registry
+	events      redis.EventRecorder
+	history     redis.HistoryRecorder
+	overrides   *override.Verifier
+}
+
+// New creates a Handler that passes every resized server to resume
+func New(log *slog.Logger, conn connector.Connector, redisClient redis.ClientInterface, resume func(ctx context.Context, entry redis.HandoffEntry)) *Handler {
+	return &Handler{log: log, conn: conn, redisClient: redisClient, resume: resume}
+}
+
+// WithTenants resolves the tenant of each request for its cache namespace.
+// Without a registry only requests for the default tenant are accepted.
+func (h *Handler) WithTenants(registry *tenant.Registry) *Handler {
+	h.tenants = registry
+	return h
+}
+
+// WithEvents records failed resizes for the status dashboard
+func (h *Handler) WithEvents(recorder redis.EventRecorder) *Handler {
+	h.events = recorder
+	return h
+}
+
+// WithHistory keeps completed and failed resizes in the history of each user
+func (h *Handler) WithHistory(recorder redis.HistoryRecorder) *Handler {
+	h.history = recorder
+	return h
+}
+
+// WithOverrides grants resize requests with an admin override this verifier grants. Without
+// a verifier every request is refused.
+func (h *Handler) WithOverrides(verifier *override.Verifier) *Handler {
+	h.overrides = verifier
+	return h
+}
+
+// ProcessRequest handles a single resize request from the queue
+func (h *Handler) ProcessRequest(ctx context.Context, payload string) {
+	var req Request
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		h.log.Error("failed to parse resize request", "error", err)
+		return
+	}
+	errList := []error{validate.WebUserID(req.WebUserID), validate.ServerType(req.ServerType),
+		validate.CorrelationID(req.CorrelationID), validate.Text("tenant", req.Tenant, validate.MaxLabelLength)}
+	if req.LabID != nil {
+		errList = append(errList, validate.LabID(*req.LabID))
+	}
+	if err := validate.First(errList...); err != nil {
+		h.log.Error("rejecting invalid resize request", "error", err)
+		return
+	}
+
+	ctx = tracing.WithCorrelationID(ctx, req.CorrelationID)
+	reqLog := tracing.Logger(ctx, h.log).With("webuserid", req.WebUserID, "server_type", req.ServerType)
+
+	t, err := h.tenants.Get(req.Tenant)
+	if err != nil {
+		reqLog.Error("rejecting resize request", "error", err)
+		return
+	}
+	if !h.overrideGranted(ctx, reqLog, req, t.ID) {
+		reqLog.Warn("resize request without a granted admin override, dropping message")
+		return
+	}
+
+	cacheKey := redis.ServerCacheKey(redis.TenantUserID(t.ID, req.WebUserID))
+	lifecycle.Operation{
+		Name:        redis.OperationResize,
+		CloudStatus: CloudStatusResizing,
+		Skip: func(state *redis.ServerState) string {
+			if state.ServerType == req.ServerType {
+				return "server already has the requested type"
+			}
+			if !connector.AllowsServerType(h.conn, state.LabID, req.ServerType) {
+				return "server type is not allowed for the lab"
+			}
+			return ""
+		},
+		Apply: func(ctx context.Context, server connector.Server) error {
+			return server.Resize(ctx, req.ServerType)
+		},
+		Done: func(ctx context.Context, state *redis.ServerState) *redis.ServerState {
+			return h.recordResized(ctx, reqLog, cacheKey, state, req.ServerType)
+		},
+		Failed: h.recordFailure,
+		Resume: h.resume,
+	}.Run(ctx, reqLog, h.redisClient, h.conn, cacheKey, req.LabID)
+}
+
+// recordResized caches the new server type of a resized server and returns the state to
+// resume polling with. A failure is only logged, polling still brings the entry back.
+func (h *Handler) recordResized(ctx context.Context, reqLog *slog.Logger, cacheKey string, state *redis.ServerState, serverType string) *redis.ServerState {
+	serverID := state.ServerID
+	resized, err := lifecycle.Transition(ctx, h.redisClient, cacheKey, config.StatusProvisioning, func(fresh *redis.ServerState) error {
+		if fresh.ServerID != serverID {
+			return lifecycle.ErrSuperseded
+		}
+		fresh.ServerType = serverType
+		return nil
+	})
+	if err != nil {
+		// Polling won't overwrite a decommission
+		reqLog.Warn("failed to record new server type", "server_id", serverID, "error", err)
+		updated := *state
+		updated.ServerType = serverType
+		resized = &updated
+	}
+	h.recordHistory(ctx, redis.Event{Type: redis.EventResized, WebUserID: resized.WebUserID, Tenant: resized.Tenant,
+		LabID: resized.LabID, ServerID: serverID, Message: "resized to " + serverType})
+	return resized
+}
+
+// overrideGranted reports whether the admin override of req is granted. The override is
+// recorded either way.
+func (h *Handler) overrideGranted(ctx context.Context, reqLog *slog.Logger, req Request, tenantID string) bool {
+	var labID int
+	if req.LabID != nil {
+		labID = *req.LabID
+	}
+	granted, err := h.overrides.Check(override.OperationResize, req.WebUserID, labID, req.Fields)
+	if err != nil {
+		reqLog.Warn("refusing admin override", "admin_actor", req.Actor, "error", err)
+		h.recordEvent(ctx, redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: tenantID,
+			Message: fmt.Sprintf("override by %q refused: %v", req.Actor, err)})
+		return false
+	}
+	if granted {
+		reqLog.Info("admin override granted", "admin_actor", req.Actor)
+		h.recordEvent(ctx, redis.Event{Type: redis.EventAdminOverride, WebUserID: req.WebUserID, Tenant: tenantID,
+			Message: fmt.Sprintf("override by %q", req.Actor)})
+	}
+	return granted
+}
+
+// recordFailure keeps a failed resize for the status dashboard
+func (h *Handler) recordFailure(ctx context.Context, state redis.ServerState, err error) {
+	h.recordEvent(ctx, redis.Event{Type: redis.EventProvisionFailed, WebUserID: state.WebUserID, Tenant: state.Tenant,
+		LabID: state.LabID, ServerID: state.ServerID, Message: err.Error()})
+}
+
+// recordEvent keeps an event for the status dashboard and the user's history. Events are
+// informational, so a failure is only logged.
+func (h *Handler) recordEvent(ctx context.Context, event redis.Event) {
+	h.recordHistory(ctx, event)
+	if h.events == nil {
+		return
+	}
+	event.Operation = "resize"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := h.events.RecordEvent(ctx, event); err != nil {
+		tracing.Logger(ctx, h.log).Warn("failed to record event", "type", event.Type, "error", err)
+	}
+}
+
+// recordHistory keeps an event in the history of its user.
+// History is informational, so a failure is only logged.
+func (h *Handler) recordHistory(ctx context.Context, event redis.Event) {
+	if h.history == nil {
+		return
+	}
+	event.Operation = "resize"
+	event.CorrelationID = tracing.CorrelationID(ctx)
+	if err := h.history.RecordHistory(ctx, redis.TenantUserID(event.Tenant, event.WebUserID), event); err != nil {
+		tracing.Logger(ctx, h.log).Warn("failed to record history", "type", event.Type, "error", err)
+	}
+}
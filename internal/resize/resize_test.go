@@ -0,0 +1,156 @@
+package resize
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/override"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeCache holds cached states by key
+type fakeCache struct {
+	redis.ClientInterface
+	states map[string]redis.ServerState
+}
+
+func (f *fakeCache) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	state, ok := f.states[cacheKey]
+	if !ok {
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
+	}
+	return &state, nil
+}
+
+func (f *fakeCache) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	f.states[cacheKey] = state
+	return nil
+}
+
+func (f *fakeCache) DeleteServerState(ctx context.Context, cacheKey string) error {
+	delete(f.states, cacheKey)
+	return nil
+}
+
+type fakeServer struct {
+	connector.Server
+	resizeErr error
+	resizedTo []string
+}
+
+func (s *fakeServer) Resize(ctx context.Context, serverType string) error {
+	s.resizedTo = append(s.resizedTo, serverType)
+	return s.resizeErr
+}
+
+type fakeConnector struct {
+	connector.Connector
+	server *fakeServer
+}
+
+// LabServerTypes lets lab 5 run on cx22 and cx32
+func (c *fakeConnector) LabServerTypes(labID int) []string {
+	if labID == 5 {
+		return []string{"cx22", "cx32"}
+	}
+	return nil
+}
+
+func (c *fakeConnector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	return c.server, nil
+}
+
+func TestProcessRequest(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	key := redis.ServerCacheKey("user-1")
+	running := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", ServerType: "cx22", Status: config.StatusRunning, Available: true}
+	quarantined := redis.ServerState{WebUserID: "user-1", LabID: 5, ServerID: "42", ServerType: "cx22", Status: config.StatusRunning, CloudStatus: config.CloudStatusQuarantined}
+
+	tests := []struct {
+		name      string
+		payload   string
+		state     *redis.ServerState
+		resizeErr error
+		resized   bool
+		resumed   bool
+		wantType  string // cached server type afterwards, "" if no entry is left
+	}{
+		{name: "resizes the running server", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32"}`, state: &running, resized: true, resumed: true, wantType: "cx32"},
+		{name: "same type", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx22"}`, state: &running, wantType: "cx22"},
+		{name: "stale labId", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32","labId":6}`, state: &running, wantType: "cx22"},
+		{name: "missing server type", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor"}`, state: &running, wantType: "cx22"},
+		{name: "invalid server type", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"CX 32"}`, state: &running, wantType: "cx22"},
+		{name: "no admin override", payload: `{"webuserid":"user-1","serverType":"cx32"}`, state: &running, wantType: "cx22"},
+		{name: "refused admin override", payload: `{"webuserid":"user-1","admin":true,"adminActor":"student","serverType":"cx32"}`, state: &running, wantType: "cx22"},
+		{name: "type outside the lab's catalog", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"ccx63"}`, state: &running, wantType: "cx22"},
+		{name: "no server", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32"}`},
+		{name: "quarantined server", payload: `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32"}`, state: &quarantined, wantType: "cx22"},
+		{
+			name:     "resize in progress",
+			payload:  `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32"}`,
+			state:    &redis.ServerState{WebUserID: "user-1", ServerID: "42", ServerType: "cx22", Status: config.StatusProvisioning},
+			wantType: "cx22",
+		},
+		{
+			name:      "failed resize keeps the old type",
+			payload:   `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32"}`,
+			state:     &running,
+			resizeErr: errors.New("boom"),
+			resized:   true,
+			resumed:   true,
+			wantType:  "cx22",
+		},
+		{
+			name:      "vanished server is removed",
+			payload:   `{"webuserid":"user-1","admin":true,"adminActor":"instructor","serverType":"cx32"}`,
+			state:     &running,
+			resizeErr: connector.NotFound("server 42 not found"),
+			resized:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &fakeCache{states: map[string]redis.ServerState{}}
+			if tt.state != nil {
+				cache.states[key] = *tt.state
+			}
+			server := &fakeServer{resizeErr: tt.resizeErr}
+
+			var resumed []redis.HandoffEntry
+			h := New(log, &fakeConnector{server: server}, cache, func(ctx context.Context, entry redis.HandoffEntry) {
+				resumed = append(resumed, entry)
+			}).WithOverrides(override.NewVerifier(nil, []string{"instructor"}, 0).WithSignedPayloads())
+			h.ProcessRequest(context.Background(), tt.payload)
+
+			if (len(server.resizedTo) == 1) != tt.resized {
+				t.Errorf("expected resized=%v, got %v", tt.resized, server.resizedTo)
+			}
+			if (len(resumed) == 1) != tt.resumed {
+				t.Fatalf("expected resumed=%v, got %d entries", tt.resumed, len(resumed))
+			}
+			cached, ok := cache.states[key]
+			if ok != (tt.wantType != "") || cached.ServerType != tt.wantType {
+				t.Errorf("expected cached server type %q, got %+v", tt.wantType, cached)
+			}
+			if !tt.resumed {
+				return
+			}
+
+			entry := resumed[0]
+			if entry.CacheKey != key || entry.ServerID != "42" || entry.State.ServerType != tt.wantType {
+				t.Errorf("unexpected handoff entry %+v", entry)
+			}
+			if entry.State.Status != config.StatusProvisioning || entry.State.Available || entry.State.CloudStatus != CloudStatusResizing {
+				t.Errorf("expected an unavailable provisioning state, got %+v", entry.State)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Package retry provides named retry policies with exponential backoff and jitter. Each
+// policy has defaults that RETRY_POLICY_<NAME> overrides, e.g.
+//
+//	RETRY_POLICY_PROVIDER_CALL=attempts=5,delay=5s,max=60s,multiplier=2,jitter=0.2
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy names
+const (
+	ProviderCall    = "provider-call"    // provider calls rejected because another action holds the server
+	RedisCall       = "redis-call"       // Redis calls a request can't go on without
+	ProvisionCreate = "provision-create" // server creations throttled by the provider
+	StatusWebhook   = "status-webhook"   // state changes posted to LabMan's callback URL
+	DeleteRecheck   = "delete-recheck"   // server lookups and deletions the provider reports locked or rate limited
+	InventoryCall   = "inventory-call"   // registrations and deregistrations of servers in the external inventory
+	PollState       = "poll-state"       // state lookups of servers being provisioned
+)
+
+// Policy describes how often and how fast a failed call is retried
+type Policy struct {
+	Name         string
+	MaxAttempts  int           // calls in total, including the first
+	InitialDelay time.Duration // wait after the first failed call
+	MaxDelay     time.Duration // longest wait between calls (0 = no limit)
+	Multiplier   float64       // growth of the wait after each failed call
+	Jitter       float64       // each wait varies randomly by up to this fraction either way
+}
+
+// defaults are the policies used without RETRY_POLICY_<NAME>
+var defaults = map[string]Policy{
+	ProviderCall:    {Name: ProviderCall, MaxAttempts: 5, InitialDelay: 5 * time.Second, MaxDelay: 60 * time.Second, Multiplier: 2, Jitter: 0.2},
+	RedisCall:       {Name: RedisCall, MaxAttempts: 3, InitialDelay: 1 * time.Second, MaxDelay: 4 * time.Second, Multiplier: 2, Jitter: 0.2},
+	ProvisionCreate: {Name: ProvisionCreate, MaxAttempts: 3, InitialDelay: 10 * time.Second, MaxDelay: 60 * time.Second, Multiplier: 2, Jitter: 0.2},
+	StatusWebhook:   {Name: StatusWebhook, MaxAttempts: 4, InitialDelay: 500 * time.Millisecond, MaxDelay: 5 * time.Second, Multiplier: 2, Jitter: 0.2},
+	DeleteRecheck:   {Name: DeleteRecheck, MaxAttempts: 4, InitialDelay: 2 * time.Second, MaxDelay: 15 * time.Second, Multiplier: 2, Jitter: 0.2},
+	InventoryCall:   {Name: InventoryCall, MaxAttempts: 6, InitialDelay: 5 * time.Second, MaxDelay: 60 * time.Second, Multiplier: 2, Jitter: 0.2},
+	PollState:       {Name: PollState, MaxAttempts: 5, InitialDelay: 2 * time.Second, MaxDelay: 15 * time.Second, Multiplier: 2, Jitter: 0.2},
+}
+
+// Get returns the named policy with the fields set in RETRY_POLICY_<NAME> applied.
+// Invalid fields keep their default; an unknown name gets a single attempt.
+func Get(name string) Policy {
+	policy, ok := defaults[name]
+	if !ok {
+		policy = Policy{Name: name, MaxAttempts: 1}
+	}
+	if value := os.Getenv(EnvKey(name)); value != "" {
+		policy = policy.apply(value)
+	}
+	return policy
+}
+
+// EnvKey returns the environment variable that overrides the named policy
+func EnvKey(name string) string {
+	return "RETRY_POLICY_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// apply overrides the fields listed in value, a comma-separated list of key=value pairs
+func (p Policy) apply(value string) Policy {
+	for _, field := range strings.Split(value, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "attempts":
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				p.MaxAttempts = n
+			}
+		case "delay":
+			if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+				p.InitialDelay = d
+			}
+		case "max":
+			if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+				p.MaxDelay = d
+			}
+		case "multiplier":
+			if f, err := strconv.ParseFloat(val, 64); err == nil && f >= 1 {
+				p.Multiplier = f
+			}
+		case "jitter":
+			if f, err := strconv.ParseFloat(val, 64); err == nil && f >= 0 && f <= 1 {
+				p.Jitter = f
+			}
+		}
+	}
+	return p
+}
+
+// Delay returns the wait after the given failed attempt, counted from 1
+func (p Policy) Delay(attempt int) time.Duration {
+	multiplier := max(p.Multiplier, 1)
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// Do calls op until it succeeds, fails with an error retryable rejects, or has been called
+// MaxAttempts times, and returns op's last error. A nil retryable retries every error.
+// onRetry, if set, is called before each wait, e.g. to log the failed attempt.
+// Cancelling ctx ends the wait and returns ctx's error.
+func (p Policy) Do(ctx context.Context, op func() error, retryable func(error) bool, onRetry func(attempt int, delay time.Duration, err error)) error {
+	attempts := max(p.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= attempts || (retryable != nil && !retryable(err)) {
+			return err
+		}
+
+		delay := p.Delay(attempt)
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
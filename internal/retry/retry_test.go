@@ -0,0 +1,90 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	if got := Get(ProviderCall); got != defaults[ProviderCall] {
+		t.Errorf("expected the default policy, got %+v", got)
+	}
+
+	t.Setenv("RETRY_POLICY_REDIS_CALL", "attempts=7, delay=50ms,max=1s,multiplier=3,jitter=0,bogus=1")
+	want := Policy{Name: RedisCall, MaxAttempts: 7, InitialDelay: 50 * time.Millisecond, MaxDelay: time.Second, Multiplier: 3}
+	if got := Get(RedisCall); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// Invalid fields keep their default
+	t.Setenv("RETRY_POLICY_PROVISION_CREATE", "attempts=0,delay=soon,multiplier=0.5,jitter=2")
+	if got := Get(ProvisionCreate); got != defaults[ProvisionCreate] {
+		t.Errorf("expected the default policy, got %+v", got)
+	}
+
+	if got := Get("unknown"); got.MaxAttempts != 1 {
+		t.Errorf("expected a single attempt for an unknown policy, got %+v", got)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{InitialDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := p.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if got := p.Delay(1); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("Delay(1) with jitter = %v, want within 50%% of 1s", got)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	p := Policy{MaxAttempts: 3, InitialDelay: time.Millisecond, Multiplier: 2}
+	errTransient := errors.New("transient")
+	errFatal := errors.New("fatal")
+
+	calls, retries := 0, 0
+	err := p.Do(ctx, func() error {
+		calls++
+		return errTransient
+	}, nil, func(attempt int, delay time.Duration, err error) { retries++ })
+	if !errors.Is(err, errTransient) || calls != 3 || retries != 2 {
+		t.Errorf("expected 3 calls and 2 retries ending in the last error, got %d, %d, %v", calls, retries, err)
+	}
+
+	calls = 0
+	err = p.Do(ctx, func() error {
+		calls++
+		if calls == 2 {
+			return nil
+		}
+		return errTransient
+	}, nil, nil)
+	if err != nil || calls != 2 {
+		t.Errorf("expected success on the second call, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = p.Do(ctx, func() error {
+		calls++
+		return errFatal
+	}, func(err error) bool { return !errors.Is(err, errFatal) }, nil)
+	if !errors.Is(err, errFatal) || calls != 1 {
+		t.Errorf("expected no retry of a fatal error, got %d calls and %v", calls, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	slow := Policy{MaxAttempts: 3, InitialDelay: time.Hour}
+	if err := slow.Do(cancelled, func() error { return errTransient }, nil, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package shard
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// Client routes the queue payloads of a redis client by shard. Payloads pushed to one of
+// Queues go to the queue of their webuserid's shard, and pops of those queues take from
+// the queues of the owned shards instead. Payloads without a webuserid, such as ops
+// decommissions of a whole lab, stay on the unsharded queue, which the owner of shard 0 reads.
+type Client struct {
+	redis.ClientInterface
+	shards *Set
+}
+
+// Wrap returns a client that only consumes the queues of shards
+func Wrap(client redis.ClientInterface, shards *Set) *Client {
+	return &Client{ClientInterface: client, shards: shards}
+}
+
+// PopPayload pops the next payload of queueKey for the owned shards
+func (c *Client) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	_, payload, err := c.PopAnyPayload(ctx, []string{queueKey}, timeout)
+	return payload, err
+}
+
+// PopAnyPayload pops the next payload from the first of queueKeys that holds one for the
+// owned shards, and returns the unsharded key of the queue it came from
+func (c *Client) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	var keys []string
+	for _, queueKey := range queueKeys {
+		keys = append(keys, c.queueKeys(queueKey)...)
+	}
+	popped, payload, err := c.ClientInterface.PopAnyPayload(ctx, keys, timeout)
+	if err != nil {
+		return "", "", err
+	}
+	return unsharded(popped), payload, nil
+}
+
+// queueKeys returns the queues holding the payloads of queueKey for the owned shards
+func (c *Client) queueKeys(queueKey string) []string {
+	if !slices.Contains(Queues(), queueKey) {
+		return []string{queueKey}
+	}
+	keys := make([]string, 0, len(c.shards.owned)+1)
+	for _, shard := range c.shards.owned {
+		keys = append(keys, config.ShardQueueKey(queueKey, shard))
+	}
+	if c.shards.Owns(0) {
+		keys = append(keys, queueKey)
+	}
+	return keys
+}
+
+// unsharded returns the queue a shard queue key belongs to
+func unsharded(queueKey string) string {
+	if i := strings.LastIndex(queueKey, ":shard:"); i >= 0 {
+		return queueKey[:i]
+	}
+	return queueKey
+}
+
+// PushPayload pushes a payload to the queue of its user's shard
+func (c *Client) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	return c.ClientInterface.PushPayload(ctx, c.route(queueKey, payload), payload)
+}
+
+// PushPayloads pushes several payloads, each to the queue of its user's shard, keeping
+// the order of the payloads of each shard
+func (c *Client) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	var keys []string
+	byKey := make(map[string][]string)
+	for _, payload := range payloads {
+		key := c.route(queueKey, payload)
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], payload)
+	}
+	for _, key := range keys {
+		if err := c.ClientInterface.PushPayloads(ctx, key, byKey[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route returns the queue a payload for queueKey goes to
+func (c *Client) route(queueKey, payload string) string {
+	if !slices.Contains(Queues(), queueKey) {
+		return queueKey
+	}
+	var request struct {
+		WebUserID string `json:"webuserid"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil || request.WebUserID == "" {
+		return queueKey
+	}
+	return config.ShardQueueKey(queueKey, Of(request.WebUserID, c.shards.count))
+}
+
+var _ redis.ClientInterface = (*Client)(nil)
@@ -0,0 +1,87 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+func TestClient_Push(t *testing.T) {
+	store := redistest.New()
+	shards, _ := Parse(4, "0-3")
+	client := Wrap(store, shards)
+	ctx := context.Background()
+
+	payloads := []string{
+		`{"webuserid":"student-1","labId":1}`,
+		`{"webuserid":"alice@example.org","labId":1}`,
+		`{"webuserid":"student-1","labId":2}`,
+		`{"labId":12,"allUsers":true}`,
+	}
+	if err := client.PushPayloads(ctx, config.CleanupQueueKey, payloads); err != nil {
+		t.Fatal(err)
+	}
+	studentQueue := config.ShardQueueKey(config.CleanupQueueKey, Of("student-1", 4))
+	if got := store.Queue(studentQueue); !slices.Equal(got, []string{payloads[0], payloads[2]}) {
+		t.Errorf("expected student-1's payloads in order on %s, got %q", studentQueue, got)
+	}
+	aliceQueue := config.ShardQueueKey(config.CleanupQueueKey, Of("alice@example.org", 4))
+	if got := store.Queue(aliceQueue); !slices.Equal(got, []string{payloads[1]}) {
+		t.Errorf("expected alice's payload on %s, got %q", aliceQueue, got)
+	}
+	if got := store.Queue(config.CleanupQueueKey); !slices.Equal(got, []string{payloads[3]}) {
+		t.Errorf("expected the payload without a user on the unsharded queue, got %q", got)
+	}
+
+	// Queues that aren't per user are left alone
+	deadLetterKey := config.DeadLetterQueueKey(config.ProvisionQueueKey)
+	if err := client.PushPayload(ctx, deadLetterKey, payloads[0]); err != nil {
+		t.Fatal(err)
+	}
+	if store.QueueLength(deadLetterKey) != 1 {
+		t.Errorf("expected the dead-letter queue unsharded, got %v", store.Queue(deadLetterKey))
+	}
+}
+
+func TestClient_Pop(t *testing.T) {
+	store := redistest.New()
+	ctx := context.Background()
+
+	// Find users of shards 0 and 1 out of 2
+	users := make(map[int]string)
+	for i := 0; len(users) < 2; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		if _, ok := users[Of(user, 2)]; !ok {
+			users[Of(user, 2)] = user
+		}
+	}
+	for shard, user := range users {
+		payload := fmt.Sprintf(`{"webuserid":%q}`, user)
+		store.PushPayload(ctx, config.ShardQueueKey(config.ProvisionQueueKey, shard), payload)
+	}
+	store.PushPayload(ctx, config.ProvisionQueueKey, `{"labId":12}`)
+
+	second, _ := Parse(2, "1")
+	client := Wrap(store, second)
+	queueKey, payload, err := client.PopAnyPayload(ctx, []string{config.DecommissionQueueKey, config.ProvisionQueueKey}, 10*time.Millisecond)
+	if err != nil || queueKey != config.ProvisionQueueKey || payload != fmt.Sprintf(`{"webuserid":%q}`, users[1]) {
+		t.Fatalf("expected shard 1's payload from %s, got %s %s, %v", config.ProvisionQueueKey, queueKey, payload, err)
+	}
+	// Shard 0's queue and the unsharded one belong to another replica
+	if _, err := client.PopPayload(ctx, config.ProvisionQueueKey, 10*time.Millisecond); err == nil {
+		t.Fatal("expected nothing left for shard 1")
+	}
+
+	first, _ := Parse(2, "0")
+	client = Wrap(store, first)
+	for _, want := range []string{fmt.Sprintf(`{"webuserid":%q}`, users[0]), `{"labId":12}`} {
+		if payload, err := client.PopPayload(ctx, config.ProvisionQueueKey, 10*time.Millisecond); err != nil || payload != want {
+			t.Errorf("expected %s, got %s, %v", want, payload, err)
+		}
+	}
+}
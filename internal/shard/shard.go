@@ -0,0 +1,126 @@
+// Package shard splits users between SWIM replicas. Each webuserid hashes to one of a fixed
+// number of shards, every shard has its own queues, and each replica only consumes the queues
+// of the shards it owns, so two replicas never handle requests of the same user at once.
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alex-sviridov/swim/internal/config"
+)
+
+// MaxShards bounds the number of shards, and with it the queues a replica pops from
+const MaxShards = 256
+
+// Queues returns the queues split by shard: every queue holding requests for a single user
+func Queues() []string {
+	return []string{
+		config.DecommissionQueueKey,
+		config.ProvisionQueueKey,
+		config.RebuildQueueKey,
+		config.ResizeQueueKey,
+		config.ExtendQueueKey,
+		config.UndoQueueKey,
+		config.CleanupQueueKey,
+	}
+}
+
+// Of returns the shard of webUserID among count shards: the jump consistent hash of the
+// 64-bit FNV-1a hash of the webuserid. Producers routing requests must compute the same.
+// Going from count to count+1 shards moves only 1/(count+1) of the users.
+func Of(webUserID string, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(webUserID))
+	return jump(h.Sum64(), count)
+}
+
+// jump is the jump consistent hash of Lamping and Veach
+func jump(key uint64, buckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Set is the shards a replica owns out of all shards
+type Set struct {
+	count int
+	owned []int // ascending
+}
+
+// Parse reads the shards a replica owns out of count, listed like "0-3,8"
+func Parse(count int, spec string) (*Set, error) {
+	if count < 1 || count > MaxShards {
+		return nil, fmt.Errorf("shard count must be 1-%d, got %d", MaxShards, count)
+	}
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("no shards owned")
+	}
+
+	owned := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		low, high, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			high = low
+		}
+		first, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard %q", part)
+		}
+		last, err := strconv.Atoi(high)
+		if err != nil || first < 0 || last >= count || first > last {
+			return nil, fmt.Errorf("invalid shard %q, shards are 0-%d", part, count-1)
+		}
+		for shard := first; shard <= last; shard++ {
+			owned[shard] = true
+		}
+	}
+
+	set := &Set{count: count}
+	for shard := range owned {
+		set.owned = append(set.owned, shard)
+	}
+	slices.Sort(set.owned)
+	return set, nil
+}
+
+// Count returns the number of shards
+func (s *Set) Count() int {
+	return s.count
+}
+
+// Owned returns the shards of s in ascending order
+func (s *Set) Owned() []int {
+	return slices.Clone(s.owned)
+}
+
+// Owns reports whether shard is one of s
+func (s *Set) Owns(shard int) bool {
+	_, found := slices.BinarySearch(s.owned, shard)
+	return found
+}
+
+// String lists the shards of s like "0-3,8 of 16"
+func (s *Set) String() string {
+	var parts []string
+	for i := 0; i < len(s.owned); {
+		j := i
+		for j+1 < len(s.owned) && s.owned[j+1] == s.owned[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(s.owned[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", s.owned[i], s.owned[j]))
+		}
+		i = j + 1
+	}
+	return fmt.Sprintf("%s of %d", strings.Join(parts, ","), s.count)
+}
@@ -0,0 +1,77 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	// Producers reimplementing the hash can check against these
+	tests := []struct {
+		webUserID string
+		count     int
+		want      int
+	}{
+		{"keycloak-user-id", 16, 0},
+		{"student-1", 4, 2},
+		{"alice@example.org", 16, 5},
+		{"alice@example.org", 1, 0},
+	}
+	for _, tt := range tests {
+		if got := Of(tt.webUserID, tt.count); got != tt.want {
+			t.Errorf("Of(%q, %d) = %d, want %d", tt.webUserID, tt.count, got, tt.want)
+		}
+	}
+
+	// Adding a shard only moves users to the new shard, about 1/count of them
+	moved := 0
+	for i := range 10000 {
+		user := fmt.Sprintf("user-%d", i)
+		before, after := Of(user, 8), Of(user, 9)
+		if before != after {
+			if after != 8 {
+				t.Fatalf("user %s moved from shard %d to %d", user, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 900 || moved > 1300 {
+		t.Errorf("expected about 1/9 of the users moved, got %d of 10000", moved)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		count   int
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{count: 16, spec: "0-3", want: "0-3 of 16"},
+		{count: 16, spec: "8, 0-1,3,2", want: "0-3,8 of 16"},
+		{count: 1, spec: "0", want: "0 of 1"},
+		{count: 16, spec: "", wantErr: true},
+		{count: 16, spec: "16", wantErr: true},
+		{count: 16, spec: "3-1", wantErr: true},
+		{count: 16, spec: "a", wantErr: true},
+		{count: 0, spec: "0", wantErr: true},
+		{count: MaxShards + 1, spec: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			shards, err := Parse(tt.count, tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", shards)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := shards.String(); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
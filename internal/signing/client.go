@@ -0,0 +1,126 @@
+package signing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// errRejected is returned by PopPayload for a message that failed verification.
+// The message has already been moved to the dead-letter queue.
+var errRejected = errors.New("payload rejected")
+
+// Client signs every payload SWIM pushes and verifies every payload it pops.
+// Messages that fail verification are moved to the queue's dead-letter queue.
+type Client struct {
+	redis.ClientInterface
+	log           *slog.Logger
+	signer        *Signer
+	events        redis.EventRecorder
+	allowUnsigned bool
+	rejected      atomic.Int64
+}
+
+// Wrap returns a client that signs and verifies the queue payloads of client
+func Wrap(log *slog.Logger, client redis.ClientInterface, signer *Signer) *Client {
+	return &Client{ClientInterface: client, log: log, signer: signer}
+}
+
+// WithEvents records rejected payloads for the status dashboard
+func (c *Client) WithEvents(recorder redis.EventRecorder) *Client {
+	c.events = recorder
+	return c
+}
+
+// AllowUnsigned passes unsigned payloads through unchanged, so producers can be switched
+// to signing one at a time. Payloads with an invalid signature are still rejected.
+func (c *Client) AllowUnsigned() *Client {
+	c.allowUnsigned = true
+	return c
+}
+
+// Rejected returns the number of payloads rejected by this client
+func (c *Client) Rejected() int64 {
+	return c.rejected.Load()
+}
+
+// PopPayload pops the next payload and verifies its signature
+func (c *Client) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	message, err := c.ClientInterface.PopPayload(ctx, queueKey, timeout)
+	if err != nil {
+		return "", err
+	}
+	return c.verify(ctx, queueKey, message)
+}
+
+// PopAnyPayload pops the next payload from the first of queueKeys that holds one and verifies its signature
+func (c *Client) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	queueKey, message, err := c.ClientInterface.PopAnyPayload(ctx, queueKeys, timeout)
+	if err != nil {
+		return "", "", err
+	}
+	payload, err := c.verify(ctx, queueKey, message)
+	return queueKey, payload, err
+}
+
+// verify returns the payload of a message popped from queueKey, or rejects the message
+func (c *Client) verify(ctx context.Context, queueKey, message string) (string, error) {
+	payload, err := c.signer.Verify(message)
+	if err == nil {
+		return payload, nil
+	}
+	if errors.Is(err, ErrUnsigned) && c.allowUnsigned {
+		return message, nil
+	}
+
+	c.reject(ctx, queueKey, message, err)
+	return "", fmt.Errorf("%w: %w", errRejected, err)
+}
+
+// PushPayload signs and pushes a payload
+func (c *Client) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	signed, err := c.signer.Sign(payload)
+	if err != nil {
+		return err
+	}
+	return c.ClientInterface.PushPayload(ctx, queueKey, signed)
+}
+
+// PushPayloads signs and pushes several payloads
+func (c *Client) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	signed := make([]string, len(payloads))
+	for i, payload := range payloads {
+		var err error
+		if signed[i], err = c.signer.Sign(payload); err != nil {
+			return err
+		}
+	}
+	return c.ClientInterface.PushPayloads(ctx, queueKey, signed)
+}
+
+// reject counts a message that failed verification, moves it to the dead-letter
+// queue as it arrived, and records an event
+func (c *Client) reject(ctx context.Context, queueKey, message string, reason error) {
+	total := c.rejected.Add(1)
+	deadLetterKey := config.DeadLetterQueueKey(queueKey)
+	c.log.Warn("rejecting queue payload", "queue", queueKey, "reason", reason, "rejected_total", total)
+
+	// The raw message goes to the dead-letter queue unsigned, so it is never popped as valid
+	if err := c.ClientInterface.PushPayload(ctx, deadLetterKey, message); err != nil {
+		c.log.Error("failed to move rejected payload to dead-letter queue", "queue", deadLetterKey, "error", err)
+	}
+	if c.events != nil {
+		event := redis.Event{Type: redis.EventPayloadRejected, Message: fmt.Sprintf("%s: %v", queueKey, reason)}
+		if err := c.events.RecordEvent(ctx, event); err != nil {
+			c.log.Warn("failed to record event", "type", event.Type, "error", err)
+		}
+	}
+}
+
+var _ redis.ClientInterface = (*Client)(nil)
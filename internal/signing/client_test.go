@@ -0,0 +1,142 @@
+package signing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeQueues keeps queue contents in memory
+type fakeQueues struct {
+	redis.ClientInterface
+	queues map[string][]string
+}
+
+func (f *fakeQueues) PopPayload(ctx context.Context, queueKey string, timeout time.Duration) (string, error) {
+	queue := f.queues[queueKey]
+	if len(queue) == 0 {
+		return "", errors.New("queue is empty")
+	}
+	f.queues[queueKey] = queue[1:]
+	return queue[0], nil
+}
+
+func (f *fakeQueues) PopAnyPayload(ctx context.Context, queueKeys []string, timeout time.Duration) (string, string, error) {
+	for _, queueKey := range queueKeys {
+		if payload, err := f.PopPayload(ctx, queueKey, timeout); err == nil {
+			return queueKey, payload, nil
+		}
+	}
+	return "", "", errors.New("queues are empty")
+}
+
+func (f *fakeQueues) PushPayload(ctx context.Context, queueKey string, payload string) error {
+	f.queues[queueKey] = append(f.queues[queueKey], payload)
+	return nil
+}
+
+func (f *fakeQueues) PushPayloads(ctx context.Context, queueKey string, payloads []string) error {
+	f.queues[queueKey] = append(f.queues[queueKey], payloads...)
+	return nil
+}
+
+type recordingEvents struct {
+	events []redis.Event
+}
+
+func (r *recordingEvents) RecordEvent(ctx context.Context, event redis.Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestClient(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	queue := config.ProvisionQueueKey
+	signer := NewSigner([]byte("shared-secret"), 0)
+	backend := &fakeQueues{queues: make(map[string][]string)}
+	events := &recordingEvents{}
+	client := Wrap(log, backend, signer).WithEvents(events)
+
+	// Payloads SWIM pushes itself are signed and pass verification
+	if err := client.PushPayloads(ctx, queue, []string{`{"webuserid":"alice","labId":1}`}); err != nil {
+		t.Fatal(err)
+	}
+	if backend.queues[queue][0] == `{"webuserid":"alice","labId":1}` {
+		t.Fatal("expected pushed payload to be signed")
+	}
+	if payload, err := client.PopPayload(ctx, queue, time.Second); err != nil || payload != `{"webuserid":"alice","labId":1}` {
+		t.Errorf("expected verified payload, got %q, %v", payload, err)
+	}
+
+	// Unsigned and forged payloads are dead-lettered as they arrived
+	forged, _ := NewSigner([]byte("guessed"), 0).Sign(`{"webuserid":"mallory","labId":1}`)
+	backend.queues[queue] = []string{`{"webuserid":"mallory","labId":1}`, forged}
+	for range 2 {
+		if _, err := client.PopPayload(ctx, queue, time.Second); err == nil {
+			t.Error("expected rejected payload to return an error")
+		}
+	}
+	dlq := backend.queues[config.DeadLetterQueueKey(queue)]
+	if len(dlq) != 2 || dlq[0] != `{"webuserid":"mallory","labId":1}` || dlq[1] != forged {
+		t.Errorf("expected both messages in the dead-letter queue, got %q", dlq)
+	}
+	if client.Rejected() != 2 || len(events.events) != 2 || events.events[0].Type != redis.EventPayloadRejected {
+		t.Errorf("expected 2 rejections counted and recorded, got %d and %+v", client.Rejected(), events.events)
+	}
+}
+
+func TestClient_PopAnyPayload(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	signer := NewSigner([]byte("shared-secret"), 0)
+	backend := &fakeQueues{queues: make(map[string][]string)}
+	client := Wrap(log, backend, signer)
+	queues := []string{config.DecommissionQueueKey, config.ProvisionQueueKey}
+
+	if err := client.PushPayload(ctx, config.ProvisionQueueKey, `{"webuserid":"alice","labId":2}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PushPayload(ctx, config.DecommissionQueueKey, `{"webuserid":"alice","labId":1}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queues are served in the given order, and payloads are verified
+	queueKey, payload, err := client.PopAnyPayload(ctx, queues, time.Second)
+	if err != nil || queueKey != config.DecommissionQueueKey || payload != `{"webuserid":"alice","labId":1}` {
+		t.Errorf("expected verified decommission payload, got %q from %q, %v", payload, queueKey, err)
+	}
+
+	// A forged payload is dead-lettered next to the queue it came from
+	backend.queues[config.ProvisionQueueKey] = []string{`{"webuserid":"mallory","labId":1}`}
+	if _, _, err := client.PopAnyPayload(ctx, queues, time.Second); err == nil {
+		t.Error("expected rejected payload to return an error")
+	}
+	if dlq := backend.queues[config.DeadLetterQueueKey(config.ProvisionQueueKey)]; len(dlq) != 1 {
+		t.Errorf("expected the payload in the provision dead-letter queue, got %q", dlq)
+	}
+}
+
+func TestClient_AllowUnsigned(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	queue := config.DecommissionQueueKey
+	backend := &fakeQueues{queues: make(map[string][]string)}
+	client := Wrap(log, backend, NewSigner([]byte("shared-secret"), 0)).AllowUnsigned()
+
+	forged, _ := NewSigner([]byte("guessed"), 0).Sign(`{"webuserid":"bob"}`)
+	backend.queues[queue] = []string{`{"webuserid":"alice"}`, forged}
+
+	if payload, err := client.PopPayload(ctx, queue, time.Second); err != nil || payload != `{"webuserid":"alice"}` {
+		t.Errorf("expected unsigned payload to pass, got %q, %v", payload, err)
+	}
+	if _, err := client.PopPayload(ctx, queue, time.Second); err == nil {
+		t.Error("expected a bad signature to be rejected even when unsigned payloads are allowed")
+	}
+}
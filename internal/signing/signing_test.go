@@ -0,0 +1,55 @@
+package signing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	signer := NewSigner([]byte("shared-secret"), 0)
+	payload := `{"webuserid":"alice","labId":12}`
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	got, err := signer.Verify(signed)
+	if err != nil || got != payload {
+		t.Errorf("expected payload back, got %q, %v", got, err)
+	}
+
+	tampered := strings.Replace(signed, "alice", "mallory", 1)
+	if _, err := signer.Verify(tampered); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected bad signature for tampered payload, got %v", err)
+	}
+	if _, err := NewSigner([]byte("other-secret"), 0).Verify(signed); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected bad signature under another secret, got %v", err)
+	}
+	for _, message := range []string{payload, "not json", `{"payload":"x"}`} {
+		if _, err := signer.Verify(message); !errors.Is(err, ErrUnsigned) {
+			t.Errorf("%q: expected unsigned error, got %v", message, err)
+		}
+	}
+}
+
+func TestVerify_MaxAge(t *testing.T) {
+	signer := NewSigner([]byte("shared-secret"), time.Hour)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	signer.now = func() time.Time { return now }
+
+	signed, err := signer.Sign("{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(59 * time.Minute)
+	if _, err := signer.Verify(signed); err != nil {
+		t.Errorf("expected payload within max age to verify, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := signer.Verify(signed); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected expired error, got %v", err)
+	}
+}
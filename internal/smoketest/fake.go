@@ -0,0 +1,88 @@
+package smoketest
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/decommissioner"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/extend"
+	"github.com/alex-sviridov/swim/internal/loadtest"
+	"github.com/alex-sviridov/swim/internal/provisioner"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// popTimeout bounds each queue pop, so the fake service notices when it is stopped
+const popTimeout = 1 * time.Second
+
+// Store is the cache and queues the fake service runs against: *redis.Client or a redistest.Store
+type Store interface {
+	redis.ClientInterface
+	redis.ExtensionCounter
+}
+
+// FakeService runs the provisioner, decommissioner and extension handler in-process against
+// a fake provider, so the cycle can be checked without a deployment or provider credentials
+type FakeService struct {
+	Conn *loadtest.FakeConnector // the fake provider, for WithProvider
+
+	cancel   context.CancelFunc
+	consumed chan struct{}
+	handlers sync.WaitGroup
+	decomm   *decommissioner.Decommissioner
+}
+
+// StartFake starts consuming the provision, extension and decommission queues of store.
+// Fake servers boot in bootDelay; the provisioner polls them every pollInterval.
+func StartFake(log *slog.Logger, store Store, bootDelay, pollInterval time.Duration) *FakeService {
+	conn := loadtest.NewFakeConnector(bootDelay, bootDelay/2)
+	prov := provisioner.New(log, conn, store).WithPollInterval(pollInterval)
+	ext := extend.New(log, store, store, extend.Limits{MaxSession: config.GetMaxSessionLength(), PerDay: config.GetMaxExtensionsPerDay()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &FakeService{
+		Conn:     conn,
+		cancel:   cancel,
+		consumed: make(chan struct{}),
+		decomm:   decommissioner.New(log, conn, store).WithAsyncDeletes(),
+	}
+	queues := map[string]func(context.Context, string){
+		config.DecommissionQueueKey: s.decomm.ProcessRequest,
+		config.ProvisionQueueKey:    prov.ProcessRequest,
+		config.ExtendQueueKey:       ext.ProcessRequest,
+	}
+	go s.consume(ctx, log, store, queues)
+	return s
+}
+
+// Stop stops consuming and waits for the requests in flight
+func (s *FakeService) Stop() {
+	s.cancel()
+	<-s.consumed
+	s.handlers.Wait()
+	s.decomm.Wait()
+}
+
+// consume pops the queues in priority order and runs their handlers until ctx is done
+func (s *FakeService) consume(ctx context.Context, log *slog.Logger, store Store, queues map[string]func(context.Context, string)) {
+	defer close(s.consumed)
+	keys := []string{config.DecommissionQueueKey, config.ProvisionQueueKey, config.ExtendQueueKey}
+	for ctx.Err() == nil {
+		queueKey, payload, err := store.PopAnyPayload(ctx, keys, popTimeout)
+		if err != nil {
+			if !errors.Is(err, errs.ErrNotFound) && ctx.Err() == nil {
+				log.Warn("failed to pop payload", "error", err)
+			}
+			continue
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			queues[queueKey](ctx, payload)
+		}()
+	}
+}
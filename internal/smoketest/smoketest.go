@@ -0,0 +1,343 @@
+// Package smoketest runs one lab through provision, availability, extension and decommission
+// against a SWIM deployment, through the same queues and cache entry LabMan uses, as a gate
+// after a deploy. The cycle runs as a user of its own, so it never touches students' labs.
+package smoketest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/extend"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// Steps of the cycle, in order
+const (
+	StepLeftover     = "leftover"     // decommission a lab left behind by an earlier run of the same user
+	StepProvision    = "provision"    // request to server available
+	StepProvider     = "provider"     // the server exists at the provider
+	StepExtend       = "extend"       // extension request to granted
+	StepDecommission = "decommission" // request to cache entry removed
+	StepDeleted      = "deleted"      // the server is gone at the provider
+)
+
+// Config describes the cycle
+type Config struct {
+	WebUserID     string        // user the cycle runs as; pick one no student has
+	LabID         int           // lab provisioned
+	Tenant        string        // tenant of the user; empty for the default tenant
+	ExtendMinutes int           // minutes requested on the extension queue
+	ReadyTimeout  time.Duration // longest the server may take to become available
+	StepTimeout   time.Duration // longest each of the other steps may take
+	PollInterval  time.Duration // time between reads of the cache entry
+}
+
+// DefaultConfig returns a cycle of lab 1 that allows 10 minutes for the server to boot
+func DefaultConfig() Config {
+	return Config{
+		WebUserID:     "smoketest",
+		LabID:         1,
+		ExtendMinutes: extend.DefaultMinutes,
+		ReadyTimeout:  10 * time.Minute,
+		StepTimeout:   5 * time.Minute,
+		PollInterval:  2 * time.Second,
+	}
+}
+
+// Validate checks that the cycle can run
+func (c Config) Validate() error {
+	errList := []error{validate.WebUserID(c.WebUserID), validate.LabID(c.LabID), validate.Text("tenant", c.Tenant, validate.MaxLabelLength)}
+	switch {
+	case c.ExtendMinutes < 1 || c.ExtendMinutes > extend.MaxMinutes:
+		errList = append(errList, fmt.Errorf("extend minutes must be between 1 and %d", extend.MaxMinutes))
+	case c.ReadyTimeout <= 0 || c.StepTimeout <= 0 || c.PollInterval <= 0:
+		errList = append(errList, errors.New("timeouts and poll interval must be positive"))
+	}
+	return validate.First(errList...)
+}
+
+// Step is the outcome of one step of the cycle
+type Step struct {
+	Name     string
+	Duration time.Duration
+	Err      error // nil if the step passed
+}
+
+// Report lists the steps that ran, in order, and the server the cycle provisioned
+type Report struct {
+	Steps    []Step
+	ServerID string
+}
+
+// Failed reports whether a step failed
+func (r *Report) Failed() bool {
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Runner pushes the requests of the cycle and watches the cache entry of its user
+type Runner struct {
+	log         *slog.Logger
+	redisClient redis.ClientInterface
+	conn        connector.Connector
+	cfg         Config
+	cacheKey    string
+	report      *Report
+
+	lastDecommission time.Time // a second decommission waits out the rate limit of the first
+}
+
+// New creates a Runner that pushes requests to and reads the cache entry from redisClient
+func New(log *slog.Logger, redisClient redis.ClientInterface, cfg Config) *Runner {
+	return &Runner{
+		log:         log,
+		redisClient: redisClient,
+		cfg:         cfg,
+		cacheKey:    redis.ServerCacheKey(redis.TenantUserID(cfg.Tenant, cfg.WebUserID)),
+	}
+}
+
+// WithProvider also checks that the server exists at the provider once it is available,
+// and that it is gone after the decommission
+func (r *Runner) WithProvider(conn connector.Connector) *Runner {
+	r.conn = conn
+	return r
+}
+
+// Run runs the cycle and returns its report, with the first failure as error. A failed
+// provision or extension still decommissions the lab, so the gate leaves nothing behind.
+func (r *Runner) Run(ctx context.Context) (*Report, error) {
+	if err := r.cfg.Validate(); err != nil {
+		return nil, err
+	}
+	r.report = &Report{}
+
+	if state, err := r.redisClient.GetServerState(ctx, r.cacheKey); err == nil {
+		r.step(ctx, StepLeftover, r.cfg.StepTimeout, func(ctx context.Context) error {
+			r.log.Warn("decommissioning lab left behind by an earlier run", "server_id", state.ServerID, "labid", state.LabID)
+			return r.decommission(ctx)
+		})
+	}
+
+	provisioned := r.step(ctx, StepProvision, r.cfg.ReadyTimeout, r.provision)
+	if provisioned && r.conn != nil {
+		r.step(ctx, StepProvider, r.cfg.StepTimeout, r.serverExists)
+	}
+	if provisioned {
+		r.step(ctx, StepExtend, r.cfg.StepTimeout, r.extend)
+	}
+	decommissioned := r.step(ctx, StepDecommission, r.cfg.StepTimeout, r.decommission)
+	if decommissioned && r.conn != nil && r.report.ServerID != "" {
+		r.step(ctx, StepDeleted, r.cfg.StepTimeout, r.serverGone)
+	}
+
+	for _, step := range r.report.Steps {
+		if step.Err != nil {
+			return r.report, fmt.Errorf("%s: %w", step.Name, step.Err)
+		}
+	}
+	return r.report, nil
+}
+
+// step runs fn within timeout and adds its outcome to the report. Returns whether it passed.
+func (r *Runner) step(ctx context.Context, name string, timeout time.Duration, fn func(ctx context.Context) error) bool {
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	started := time.Now()
+	err := fn(stepCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	r.report.Steps = append(r.report.Steps, Step{Name: name, Duration: time.Since(started), Err: err})
+	if err != nil {
+		r.log.Error("smoke test step failed", "step", name, "error", err)
+		return false
+	}
+	r.log.Info("smoke test step passed", "step", name, "duration", time.Since(started))
+	return true
+}
+
+// provision requests the lab and waits until its server is available
+func (r *Runner) provision(ctx context.Context) error {
+	if err := r.push(ctx, config.ProvisionQueueKey, map[string]any{
+		"webuserid":     r.cfg.WebUserID,
+		"labId":         r.cfg.LabID,
+		"tenant":        r.cfg.Tenant,
+		"correlationId": r.correlationID(StepProvision),
+		"enqueuedAt":    time.Now().UTC(),
+	}); err != nil {
+		return err
+	}
+
+	seen := false
+	return r.poll(ctx, func(state *redis.ServerState) (bool, error) {
+		if state == nil {
+			if seen {
+				return false, errors.New("cache entry removed before the server was available")
+			}
+			return false, nil
+		}
+		seen = true
+		if state.ServerID != "" {
+			r.report.ServerID = state.ServerID
+		}
+		switch {
+		case state.LabID != r.cfg.LabID:
+			return false, nil
+		case state.Status == config.StatusFailed:
+			return false, fmt.Errorf("provisioning failed (cloud status %q)", state.CloudStatus)
+		case state.Status == config.StatusRunning && state.Available:
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// extend requests more time and waits until the extension is granted
+func (r *Runner) extend(ctx context.Context) error {
+	before, err := r.redisClient.GetServerState(ctx, r.cacheKey)
+	if err != nil {
+		return fmt.Errorf("read server state: %w", err)
+	}
+	if err := r.push(ctx, config.ExtendQueueKey, map[string]any{
+		"webuserid":     r.cfg.WebUserID,
+		"minutes":       r.cfg.ExtendMinutes,
+		"labId":         r.cfg.LabID,
+		"tenant":        r.cfg.Tenant,
+		"correlationId": r.correlationID(StepExtend),
+	}); err != nil {
+		return err
+	}
+
+	return r.poll(ctx, func(state *redis.ServerState) (bool, error) {
+		if state == nil {
+			return false, errors.New("cache entry removed before the extension was handled")
+		}
+		result := state.Extension
+		if result == nil || (before.Extension != nil && !result.At.After(before.Extension.At)) {
+			return false, nil
+		}
+		if result.Status != extend.StatusGranted {
+			return false, fmt.Errorf("extension %s: %s", result.Status, result.Reason)
+		}
+		if !state.ExpiresAt.After(before.ExpiresAt) {
+			return false, fmt.Errorf("extension granted, but expiry stayed at %s", state.ExpiresAt)
+		}
+		return true, nil
+	})
+}
+
+// decommission requests the lab's removal and waits until its cache entry is gone
+func (r *Runner) decommission(ctx context.Context) error {
+	if !r.lastDecommission.IsZero() {
+		wait := time.Until(r.lastDecommission.Add(config.GetDecommissionRateLimitDuration()))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	r.lastDecommission = time.Now()
+	if err := r.push(ctx, config.DecommissionQueueKey, map[string]any{
+		"webuserid":     r.cfg.WebUserID,
+		"tenant":        r.cfg.Tenant,
+		"correlationId": r.correlationID(StepDecommission),
+	}); err != nil {
+		return err
+	}
+	return r.poll(ctx, func(state *redis.ServerState) (bool, error) {
+		if state != nil && state.Status == config.StatusFailed {
+			return false, fmt.Errorf("deletion failed (cloud status %q)", state.CloudStatus)
+		}
+		return state == nil, nil
+	})
+}
+
+// serverExists checks that the provisioned server exists at the provider
+func (r *Runner) serverExists(ctx context.Context) error {
+	if _, err := r.conn.GetServerByID(ctx, r.report.ServerID); err != nil {
+		return fmt.Errorf("server %s: %w", r.report.ServerID, err)
+	}
+	return nil
+}
+
+// serverGone waits until the provisioned server is gone at the provider
+func (r *Runner) serverGone(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := r.conn.GetServerByID(ctx, r.report.ServerID)
+		if errors.Is(err, errs.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			r.log.Warn("failed to get server", "server_id", r.report.ServerID, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads the cache entry every poll interval until done returns true or an error.
+// done gets nil while there is no entry.
+func (r *Runner) poll(ctx context.Context, done func(state *redis.ServerState) (bool, error)) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		state, err := r.redisClient.GetServerState(ctx, r.cacheKey)
+		switch {
+		case errors.Is(err, errs.ErrNotFound):
+			state = nil
+		case err != nil:
+			r.log.Warn("failed to read server state", "error", err)
+		}
+		if err == nil || errors.Is(err, errs.ErrNotFound) {
+			ok, err := done(state)
+			if err != nil || ok {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// push marshals request and appends it to queueKey
+func (r *Runner) push(ctx context.Context, queueKey string, request map[string]any) error {
+	if request["tenant"] == "" {
+		delete(request, "tenant")
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	if err := r.redisClient.PushPayload(ctx, queueKey, string(payload)); err != nil {
+		return fmt.Errorf("push to %s: %w", queueKey, err)
+	}
+	return nil
+}
+
+// correlationID names a step's request in SWIM's logs
+func (r *Runner) correlationID(step string) string {
+	return "smoketest-" + r.cfg.WebUserID + "-" + step
+}
@@ -0,0 +1,105 @@
+package smoketest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+)
+
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.WebUserID = "smoketest-1"
+	cfg.ReadyTimeout = 5 * time.Second
+	cfg.StepTimeout = 5 * time.Second
+	cfg.PollInterval = 10 * time.Millisecond
+	return cfg
+}
+
+func TestRun_Fake(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := redistest.New()
+	service := StartFake(log, store, 20*time.Millisecond, 10*time.Millisecond)
+	defer service.Stop()
+
+	report, err := New(log, store, testConfig()).WithProvider(service.Conn).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	var steps []string
+	for _, step := range report.Steps {
+		steps = append(steps, step.Name)
+	}
+	want := []string{StepProvision, StepProvider, StepExtend, StepDecommission, StepDeleted}
+	if len(steps) != len(want) {
+		t.Fatalf("expected steps %v, got %v", want, steps)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Fatalf("expected steps %v, got %v", want, steps)
+		}
+	}
+	if report.ServerID == "" {
+		t.Error("expected the provisioned server in the report")
+	}
+	if created, existing := service.Conn.Counts(); created != 1 || existing != 0 {
+		t.Errorf("expected 1 server created and none left, got %d created and %d left", created, existing)
+	}
+}
+
+func TestRun_FailedProvisionStillDecommissions(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := redistest.New()
+	cfg := testConfig()
+	cfg.ReadyTimeout = 100 * time.Millisecond
+
+	// Nothing consumes the provision request, so the server never becomes available;
+	// the cached entry stands in for a server stuck provisioning
+	key := redis.ServerCacheKey(cfg.WebUserID)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.PushServerState(context.Background(), key, redis.ServerState{WebUserID: cfg.WebUserID, LabID: cfg.LabID, ServerID: "1",
+			Status: config.StatusProvisioning}, time.Minute)
+		time.Sleep(200 * time.Millisecond)
+		store.DeleteServerState(context.Background(), key)
+	}()
+
+	report, err := New(log, store, cfg).Run(context.Background())
+	if err == nil {
+		t.Fatal("expected the provision step to fail")
+	}
+	if !report.Failed() {
+		t.Error("expected a failed report")
+	}
+	if len(report.Steps) != 2 || report.Steps[0].Name != StepProvision || report.Steps[1].Name != StepDecommission {
+		t.Fatalf("expected provision and decommission steps, got %+v", report.Steps)
+	}
+	if report.Steps[1].Err != nil {
+		t.Errorf("expected the decommission to pass, got %v", report.Steps[1].Err)
+	}
+	if store.QueueLength(config.DecommissionQueueKey) != 1 {
+		t.Errorf("expected a decommission request, got %d", store.QueueLength(config.DecommissionQueueKey))
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := testConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected a valid config, got %v", err)
+	}
+	cfg.ExtendMinutes = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for 0 extend minutes")
+	}
+	cfg = testConfig()
+	cfg.PollInterval = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for a 0 poll interval")
+	}
+}
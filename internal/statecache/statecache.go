@@ -0,0 +1,371 @@
+// Package statecache keeps the server states an instance reads and writes in memory and
+// writes them to Redis in batches, for deployments whose pollers update states every few
+// seconds. Several writes of a state between two flushes cost one Redis write.
+//
+// Redis stays the source of truth: the cache starts empty, an entry read from Redis is
+// served from memory for MaxAge at most, scans such as GetAllServerStates flush first and
+// read Redis, and a pending write that loses to a concurrent writer is dropped.
+package statecache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// finalFlushTimeout bounds the flush of pending writes at shutdown
+const finalFlushTimeout = 10 * time.Second
+
+// Config tunes the cache
+type Config struct {
+	FlushInterval time.Duration // how often pending writes are sent to Redis
+	MaxAge        time.Duration // how long a state read from Redis is served from memory
+}
+
+// entry is the cached state of one cache key. Versions handed to callers count the writes
+// made through the cache, while base counts those that reached Redis: several writes
+// coalesced into one flush bump the entry's version several times but base once.
+type entry struct {
+	state  redis.ServerState
+	base   int64 // version of the entry in Redis, which the next flush expects
+	ttl    time.Duration
+	dirty  bool      // state has writes Redis doesn't have yet
+	writes int64     // counts writes, so a flush can tell whether more arrived meanwhile
+	loaded time.Time // when state was last known to match Redis
+	used   time.Time // when a caller last read or wrote the entry
+}
+
+// Client serves server states from memory and writes them behind to the client it wraps.
+// Everything else goes to the wrapped client unchanged.
+type Client struct {
+	redis.ClientInterface
+	log *slog.Logger
+	cfg Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// Wrap returns a client caching the server states of client. Run must be running for
+// writes to reach Redis.
+func Wrap(log *slog.Logger, client redis.ClientInterface, cfg Config) *Client {
+	return &Client{
+		ClientInterface: client,
+		log:             log,
+		cfg:             cfg,
+		now:             time.Now,
+		entries:         make(map[string]*entry),
+	}
+}
+
+// Run flushes pending writes every FlushInterval until ctx is done, then flushes once more
+func (c *Client) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalFlushTimeout)
+			if err := c.Flush(flushCtx); err != nil {
+				c.log.Error("failed to flush cached server states at shutdown", "pending", c.Pending(), "error", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				c.log.Warn("failed to flush cached server states, retrying at the next flush", "error", err)
+			}
+			c.evictIdle()
+		}
+	}
+}
+
+// GetServerState returns the cached state, reading it from Redis if it isn't cached or
+// older than MaxAge
+func (c *Client) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[cacheKey]; ok && (e.dirty || c.now().Sub(e.loaded) < c.cfg.MaxAge) {
+		e.used = c.now()
+		state := clone(e.state)
+		c.mu.Unlock()
+		return &state, nil
+	}
+	c.mu.Unlock()
+
+	state, err := c.ClientInterface.GetServerState(ctx, cacheKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	e, ok := c.entries[cacheKey]
+	switch {
+	case ok && e.dirty:
+		// Written meanwhile; Redis doesn't have that write yet
+	case ok && e.base == state.Version:
+		// Unchanged in Redis: keep the version callers already hold
+		e.loaded = now
+	default:
+		e = &entry{state: clone(*state), base: state.Version, loaded: now}
+		c.entries[cacheKey] = e
+	}
+	e.used = now
+	cached := clone(e.state)
+	return &cached, nil
+}
+
+// PushServerState stores the state in memory for the next flush. state.Version must be the
+// version the caller last read. A state that isn't cached is written to Redis at once, so
+// the cache learns its version there.
+func (c *Client) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	c.mu.Lock()
+	if e, ok := c.entries[cacheKey]; ok {
+		defer c.mu.Unlock()
+		return c.write(e, state, ttl)
+	}
+	c.mu.Unlock()
+
+	if err := c.ClientInterface.PushServerState(ctx, cacheKey, state, ttl); err != nil {
+		return err
+	}
+	state.Version++
+	c.cache(cacheKey, state, ttl)
+	return nil
+}
+
+// PushServerStates stores the cached states in memory for the next flush and writes the
+// others to Redis at once
+func (c *Client) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	var errs []error
+	uncached := make(map[string]redis.ServerState, len(states))
+	c.mu.Lock()
+	for cacheKey, state := range states {
+		e, ok := c.entries[cacheKey]
+		if !ok {
+			uncached[cacheKey] = state
+			continue
+		}
+		if err := c.write(e, state, ttl); err != nil {
+			errs = append(errs, &redis.KeyError{Key: cacheKey, Err: err})
+		}
+	}
+	c.mu.Unlock()
+
+	if len(uncached) > 0 {
+		err := c.ClientInterface.PushServerStates(ctx, uncached, ttl)
+		failed, known := keyErrors(err)
+		for cacheKey, state := range uncached {
+			if _, bad := failed[cacheKey]; known && !bad {
+				state.Version++
+				c.cache(cacheKey, state, ttl)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AdmitProvision runs the admission in Redis, which may write the state, so the cached
+// state is dropped
+func (c *Client) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	result, err := c.ClientInterface.AdmitProvision(ctx, cacheKey, state, limits, cacheTTL)
+	c.evict(cacheKey)
+	return result, err
+}
+
+// DeleteServerState drops the cached state, including pending writes, and removes the entry from Redis
+func (c *Client) DeleteServerState(ctx context.Context, cacheKey string) error {
+	c.evict(cacheKey)
+	return c.ClientInterface.DeleteServerState(ctx, cacheKey)
+}
+
+// DeleteServerStates drops the cached states, including pending writes, and removes the entries from Redis
+func (c *Client) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	c.evict(cacheKeys...)
+	return c.ClientInterface.DeleteServerStates(ctx, cacheKeys)
+}
+
+// GetAllServerStates flushes pending writes and reads the states from Redis
+func (c *Client) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+	c.flushBeforeScan(ctx)
+	return c.ClientInterface.GetAllServerStates(ctx, prefix)
+}
+
+// GetExpiredServerStates flushes pending writes and reads the states from Redis
+func (c *Client) GetExpiredServerStates(ctx context.Context, now time.Time) ([]redis.ServerState, error) {
+	c.flushBeforeScan(ctx)
+	return c.ClientInterface.GetExpiredServerStates(ctx, now)
+}
+
+// QueryServerStates flushes pending writes and reads the states from Redis
+func (c *Client) QueryServerStates(ctx context.Context, filter redis.StateFilter) (*redis.StatePage, error) {
+	c.flushBeforeScan(ctx)
+	return c.ClientInterface.QueryServerStates(ctx, filter)
+}
+
+// Flush writes the pending writes to Redis in one pipelined round trip per TTL. A write
+// that loses to a concurrent writer is dropped together with the cached state; other
+// failed writes stay pending for the next flush.
+func (c *Client) Flush(ctx context.Context) error {
+	// The entries as they were sent, to tell which were deleted or written again meanwhile
+	type sent struct {
+		entry  *entry
+		writes int64
+	}
+	batches := make(map[time.Duration]map[string]redis.ServerState)
+	sentEntries := make(map[string]sent)
+	c.mu.Lock()
+	for cacheKey, e := range c.entries {
+		if !e.dirty {
+			continue
+		}
+		if batches[e.ttl] == nil {
+			batches[e.ttl] = make(map[string]redis.ServerState)
+		}
+		state := clone(e.state)
+		state.Version = e.base
+		batches[e.ttl][cacheKey] = state
+		sentEntries[cacheKey] = sent{entry: e, writes: e.writes}
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for ttl, states := range batches {
+		err := c.ClientInterface.PushServerStates(ctx, states, ttl)
+		failed, known := keyErrors(err)
+		if !known {
+			errs = append(errs, err)
+			continue
+		}
+
+		c.mu.Lock()
+		now := c.now()
+		for cacheKey := range states {
+			sent := sentEntries[cacheKey]
+			if c.entries[cacheKey] != sent.entry {
+				// Deleted meanwhile; the version check kept the write from recreating it
+				continue
+			}
+			if keyErr, bad := failed[cacheKey]; bad {
+				if errors.Is(keyErr, redis.ErrVersionConflict) {
+					delete(c.entries, cacheKey)
+					c.log.Warn("cached server state changed in redis meanwhile, dropping pending write", "cache_key", cacheKey)
+				} else {
+					errs = append(errs, &redis.KeyError{Key: cacheKey, Err: keyErr})
+				}
+				continue
+			}
+			sent.entry.base++
+			sent.entry.loaded = now
+			if sent.entry.writes == sent.writes {
+				sent.entry.dirty = false
+			}
+		}
+		c.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Pending returns the number of states with writes Redis doesn't have yet
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := 0
+	for _, e := range c.entries {
+		if e.dirty {
+			pending++
+		}
+	}
+	return pending
+}
+
+// write applies a write to a cached state, under c.mu
+func (c *Client) write(e *entry, state redis.ServerState, ttl time.Duration) error {
+	// A clean entry matches Redis, so the version of a state read from Redis directly works too
+	if state.Version != e.state.Version && (e.dirty || state.Version != e.base) {
+		return redis.ErrVersionConflict
+	}
+	state.Version = e.state.Version + 1
+	e.state = clone(state)
+	e.ttl = ttl
+	e.dirty = true
+	e.writes++
+	e.used = c.now()
+	return nil
+}
+
+// cache stores a state just written to Redis, unless a write of it arrived meanwhile
+func (c *Client) cache(cacheKey string, state redis.ServerState, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[cacheKey]; ok {
+		return
+	}
+	now := c.now()
+	c.entries[cacheKey] = &entry{state: clone(state), base: state.Version, ttl: ttl, loaded: now, used: now}
+}
+
+// evict drops the cached states of cacheKeys
+func (c *Client) evict(cacheKeys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cacheKey := range cacheKeys {
+		delete(c.entries, cacheKey)
+	}
+}
+
+// evictIdle drops the states without pending writes that no caller used for MaxAge
+func (c *Client) evictIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cacheKey, e := range c.entries {
+		if !e.dirty && c.now().Sub(e.used) >= c.cfg.MaxAge {
+			delete(c.entries, cacheKey)
+		}
+	}
+}
+
+// flushBeforeScan flushes pending writes so a read from Redis sees them. A failed flush is
+// only logged: the scan then sees the states as of the last flush.
+func (c *Client) flushBeforeScan(ctx context.Context) {
+	if err := c.Flush(ctx); err != nil {
+		c.log.Warn("failed to flush cached server states before reading redis", "error", err)
+	}
+}
+
+// keyErrors returns the failed keys of a batch write by key. known is false if err
+// doesn't tell which keys failed, e.g. because the whole batch failed.
+func keyErrors(err error) (failed map[string]error, known bool) {
+	failed = make(map[string]error)
+	if err == nil {
+		return failed, true
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return failed, false
+	}
+	for _, err := range joined.Unwrap() {
+		var keyErr *redis.KeyError
+		if !errors.As(err, &keyErr) {
+			return failed, false
+		}
+		failed[keyErr.Key] = keyErr.Err
+	}
+	return failed, true
+}
+
+// clone returns a copy of state that shares no map with it
+func clone(state redis.ServerState) redis.ServerState {
+	state.Nodes = maps.Clone(state.Nodes)
+	return state
+}
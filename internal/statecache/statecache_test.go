@@ -0,0 +1,190 @@
+package statecache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+)
+
+// fakeRedis stores states with the versioning rules of the Redis client
+type fakeRedis struct {
+	redis.ClientInterface
+	states map[string]redis.ServerState
+	writes int
+	reads  int
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{states: make(map[string]redis.ServerState)}
+}
+
+func (f *fakeRedis) GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	f.reads++
+	state, ok := f.states[cacheKey]
+	if !ok {
+		return nil, errs.New("server state not found in cache", errs.ErrNotFound)
+	}
+	return &state, nil
+}
+
+func (f *fakeRedis) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	f.writes++
+	if f.states[cacheKey].Version != state.Version {
+		return redis.ErrVersionConflict
+	}
+	state.Version++
+	f.states[cacheKey] = state
+	return nil
+}
+
+func (f *fakeRedis) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	var errs []error
+	for cacheKey, state := range states {
+		if err := f.PushServerState(ctx, cacheKey, state, ttl); err != nil {
+			errs = append(errs, &redis.KeyError{Key: cacheKey, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fakeRedis) DeleteServerState(ctx context.Context, cacheKey string) error {
+	delete(f.states, cacheKey)
+	return nil
+}
+
+func (f *fakeRedis) GetAllServerStates(ctx context.Context, prefix string) ([]redis.ServerState, error) {
+	var states []redis.ServerState
+	for _, state := range f.states {
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func newTestCache(backend *fakeRedis) *Client {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return Wrap(log, backend, Config{FlushInterval: time.Second, MaxAge: time.Minute})
+}
+
+// update reads the state through the cache and writes it back with status
+func update(t *testing.T, c *Client, cacheKey, status string) {
+	t.Helper()
+	state, err := c.GetServerState(context.Background(), cacheKey)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	state.Status = status
+	if err := c.PushServerState(context.Background(), cacheKey, *state, time.Hour); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+}
+
+func TestClient_WriteBehind(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRedis()
+	backend.states["k"] = redis.ServerState{Status: "provisioning", Version: 3}
+	c := newTestCache(backend)
+
+	update(t, c, "k", "provisioning")
+	update(t, c, "k", "provisioning")
+	update(t, c, "k", "running")
+	if backend.writes != 0 || backend.reads != 1 || c.Pending() != 1 {
+		t.Fatalf("expected one read, no writes and one pending state, got %d reads, %d writes, %d pending", backend.reads, backend.writes, c.Pending())
+	}
+
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if backend.writes != 1 || backend.states["k"].Status != "running" || backend.states["k"].Version != 4 || c.Pending() != 0 {
+		t.Errorf("expected the three writes as one, got %d writes of %+v", backend.writes, backend.states["k"])
+	}
+
+	// Callers keep the version they hold, and the next flush expects Redis' version
+	update(t, c, "k", "stopping")
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if backend.states["k"].Status != "stopping" || backend.states["k"].Version != 5 {
+		t.Errorf("expected the next write to reach Redis, got %+v", backend.states["k"])
+	}
+
+	// A state read from Redis directly matches a cached state without pending writes
+	stale := redis.ServerState{Status: "deleting", Version: 5}
+	if err := c.PushServerState(ctx, "k", stale, time.Hour); err != nil {
+		t.Errorf("expected Redis' version to be accepted, got %v", err)
+	}
+	stale.Version = 4
+	if err := c.PushServerState(ctx, "k", stale, time.Hour); !errors.Is(err, redis.ErrVersionConflict) {
+		t.Errorf("expected a version conflict for an outdated version, got %v", err)
+	}
+}
+
+func TestClient_ConcurrentWriter(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRedis()
+	backend.states["k"] = redis.ServerState{Status: "running", Version: 1}
+	c := newTestCache(backend)
+
+	update(t, c, "k", "running")
+	// Another instance decommissions the server meanwhile
+	backend.states["k"] = redis.ServerState{Status: "deleting", Version: 2}
+
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("expected the lost write to be dropped quietly, got %v", err)
+	}
+	state, err := c.GetServerState(ctx, "k")
+	if err != nil || state.Status != "deleting" || state.Version != 2 {
+		t.Errorf("expected the other writer's state, got %+v, %v", state, err)
+	}
+}
+
+func TestClient_Delete(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRedis()
+	backend.states["k"] = redis.ServerState{Status: "running", Version: 1}
+	c := newTestCache(backend)
+
+	update(t, c, "k", "stopping")
+	if err := c.DeleteServerState(ctx, "k"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if _, ok := backend.states["k"]; ok || backend.writes != 0 {
+		t.Errorf("expected the pending write to be dropped with the entry, got %d writes", backend.writes)
+	}
+	if _, err := c.GetServerState(ctx, "k"); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestClient_UncachedWriteAndScan(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeRedis()
+	backend.states["k"] = redis.ServerState{Status: "running", Version: 1}
+	c := newTestCache(backend)
+
+	// Not cached: written at once, so the cache learns its version
+	if err := c.PushServerState(ctx, "k", redis.ServerState{Status: "stopping", Version: 1}, time.Hour); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if backend.writes != 1 || c.Pending() != 0 {
+		t.Fatalf("expected a write-through, got %d writes and %d pending", backend.writes, c.Pending())
+	}
+
+	// Scans read Redis after flushing pending writes
+	update(t, c, "k", "deleting")
+	states, err := c.GetAllServerStates(ctx, "")
+	if err != nil || len(states) != 1 || states[0].Status != "deleting" {
+		t.Errorf("expected the scan to see the pending write, got %+v, %v", states, err)
+	}
+	if backend.reads != 0 {
+		t.Errorf("expected reads from memory after the write-through, got %d Redis reads", backend.reads)
+	}
+}
@@ -0,0 +1,239 @@
+// Package statushook posts every server state change to LabMan's callback URL, signed with
+// an HMAC, so the UI updates as soon as a state is written instead of at its next cache poll.
+// Delivery is best effort: updates are retried, then dropped, and LabMan keeps reading the
+// cache as before.
+package statushook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/retry"
+	"github.com/alex-sviridov/swim/internal/signing"
+)
+
+// Update events
+const (
+	EventUpdated = "updated" // the state was written
+	EventDeleted = "deleted" // the cache entry was removed
+)
+
+// Headers of every callback. The signature is the hex HMAC-SHA256 of "{timestamp}.{body}"
+// under the shared secret, the same scheme as signed queue payloads.
+const (
+	TimestampHeader = "X-Swim-Timestamp"
+	SignatureHeader = "X-Swim-Signature"
+)
+
+const (
+	defaultQueueSize = 1000
+	defaultTimeout   = 5 * time.Second
+)
+
+// Update is the body of a callback
+type Update struct {
+	Event    string             `json:"event"`
+	CacheKey string             `json:"cacheKey"`
+	State    *redis.ServerState `json:"state,omitempty"` // the written state; absent once deleted
+	At       time.Time          `json:"at"`
+}
+
+// Hook delivers updates to the callback URL in the order they were written
+type Hook struct {
+	log     *slog.Logger
+	url     string
+	signer  *signing.Signer
+	client  *http.Client
+	policy  retry.Policy
+	updates chan Update
+	dropped atomic.Int64
+}
+
+// New creates a hook posting to url, signed with signer
+func New(log *slog.Logger, url string, signer *signing.Signer) *Hook {
+	return &Hook{
+		log:     log,
+		url:     url,
+		signer:  signer,
+		client:  &http.Client{Timeout: defaultTimeout},
+		policy:  retry.Get(retry.StatusWebhook),
+		updates: make(chan Update, defaultQueueSize),
+	}
+}
+
+// WithHTTPClient sets the client callbacks are sent with (default: 5 second timeout)
+func (h *Hook) WithHTTPClient(client *http.Client) *Hook {
+	h.client = client
+	return h
+}
+
+// Dropped returns the number of updates dropped because the queue was full or delivery failed
+func (h *Hook) Dropped() int64 {
+	return h.dropped.Load()
+}
+
+// Run delivers queued updates until ctx is done
+func (h *Hook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-h.updates:
+			if err := h.deliver(ctx, update); err != nil && ctx.Err() == nil {
+				h.dropped.Add(1)
+				h.log.Warn("failed to deliver status update", "cache_key", update.CacheKey, "event", update.Event, "error", err)
+			}
+		}
+	}
+}
+
+// Send queues an update without blocking the cache write that caused it
+func (h *Hook) Send(update Update) {
+	select {
+	case h.updates <- update:
+	default:
+		h.dropped.Add(1)
+		h.log.Warn("status update queue full, dropping update", "cache_key", update.CacheKey, "event", update.Event)
+	}
+}
+
+// deliver posts an update under the status-webhook retry policy. Network errors, 429 and
+// 5xx responses are retried; other rejections are not.
+func (h *Hook) deliver(ctx context.Context, update Update) error {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("marshal update: %w", err)
+	}
+	return h.policy.Do(ctx, func() error {
+		return h.post(ctx, body)
+	}, func(err error) bool {
+		var statusErr *statusError
+		return !errors.As(err, &statusErr) || statusErr.retryable()
+	}, nil)
+}
+
+// post signs and sends one callback
+func (h *Hook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, h.signer.Signature(timestamp, string(body)))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// statusError is a non-2xx callback response
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
+
+// retryable reports whether the callback may succeed later
+func (e *statusError) retryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+// Sink receives the updates of a Client. Send must not block the cache write.
+type Sink interface {
+	Send(update Update)
+}
+
+// Client sends an update to its sink after every successful cache write of the client it wraps
+type Client struct {
+	redis.ClientInterface
+	sink Sink
+}
+
+// Wrap returns a client that reports the state changes written through client to sink,
+// e.g. a Hook
+func Wrap(client redis.ClientInterface, sink Sink) *Client {
+	return &Client{ClientInterface: client, sink: sink}
+}
+
+// PushServerState writes the state and reports it with the version it was written with
+func (c *Client) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	if err := c.ClientInterface.PushServerState(ctx, cacheKey, state, ttl); err != nil {
+		return err
+	}
+	state.Version++
+	c.updated(cacheKey, state)
+	return nil
+}
+
+// PushServerStates writes the states and reports them. If any write fails, none is
+// reported, since the error doesn't tell which were written.
+func (c *Client) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	if err := c.ClientInterface.PushServerStates(ctx, states, ttl); err != nil {
+		return err
+	}
+	for cacheKey, state := range states {
+		state.Version++
+		c.updated(cacheKey, state)
+	}
+	return nil
+}
+
+// AdmitProvision runs the admission and reports the initial state if it was written
+func (c *Client) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	result, err := c.ClientInterface.AdmitProvision(ctx, cacheKey, state, limits, cacheTTL)
+	if err == nil && result.Version > 0 {
+		state.Version = result.Version
+		c.updated(cacheKey, state)
+	}
+	return result, err
+}
+
+// DeleteServerState removes the entry and reports the deletion
+func (c *Client) DeleteServerState(ctx context.Context, cacheKey string) error {
+	if err := c.ClientInterface.DeleteServerState(ctx, cacheKey); err != nil {
+		return err
+	}
+	c.deleted(cacheKey)
+	return nil
+}
+
+// DeleteServerStates removes the entries and reports each deletion
+func (c *Client) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	if err := c.ClientInterface.DeleteServerStates(ctx, cacheKeys); err != nil {
+		return err
+	}
+	for _, cacheKey := range cacheKeys {
+		c.deleted(cacheKey)
+	}
+	return nil
+}
+
+func (c *Client) updated(cacheKey string, state redis.ServerState) {
+	c.sink.Send(Update{Event: EventUpdated, CacheKey: cacheKey, State: &state, At: time.Now().UTC()})
+}
+
+func (c *Client) deleted(cacheKey string) {
+	c.sink.Send(Update{Event: EventDeleted, CacheKey: cacheKey, At: time.Now().UTC()})
+}
@@ -0,0 +1,182 @@
+package statushook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/signing"
+)
+
+// fakeCache accepts every write, or fails them with err
+type fakeCache struct {
+	redis.ClientInterface
+	err       error
+	admission *redis.AdmissionResult
+}
+
+func (f *fakeCache) PushServerState(ctx context.Context, cacheKey string, state redis.ServerState, ttl time.Duration) error {
+	return f.err
+}
+
+func (f *fakeCache) PushServerStates(ctx context.Context, states map[string]redis.ServerState, ttl time.Duration) error {
+	return f.err
+}
+
+func (f *fakeCache) AdmitProvision(ctx context.Context, cacheKey string, state redis.ServerState, limits redis.AdmissionLimits, cacheTTL time.Duration) (*redis.AdmissionResult, error) {
+	return f.admission, f.err
+}
+
+func (f *fakeCache) DeleteServerState(ctx context.Context, cacheKey string) error {
+	return f.err
+}
+
+func (f *fakeCache) DeleteServerStates(ctx context.Context, cacheKeys []string) error {
+	return f.err
+}
+
+// receiver records the callbacks it accepts and answers with the queued status codes first
+type receiver struct {
+	mu       sync.Mutex
+	signer   *signing.Signer
+	statuses []int
+	updates  []Update
+	calls    int
+	received chan struct{}
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	timestamp, _ := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if req.Header.Get(SignatureHeader) != r.signer.Signature(timestamp, string(body)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var update Update
+	json.Unmarshal(body, &update)
+	r.updates = append(r.updates, update)
+	r.received <- struct{}{}
+}
+
+func newTestHook(t *testing.T, statuses ...int) (*Hook, *receiver) {
+	t.Helper()
+	signer := signing.NewSigner([]byte("secret"), 0)
+	recv := &receiver{signer: signer, statuses: statuses, received: make(chan struct{}, 10)}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+
+	hook := New(slog.New(slog.NewTextHandler(io.Discard, nil)), srv.URL, signer)
+	hook.policy.InitialDelay = time.Millisecond
+	return hook, recv
+}
+
+func waitForUpdates(t *testing.T, recv *receiver, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-recv.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for status updates")
+		}
+	}
+}
+
+func TestClient_ReportsWrites(t *testing.T) {
+	hook, recv := newTestHook(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hook.Run(ctx)
+
+	cache := &fakeCache{admission: &redis.AdmissionResult{Decision: redis.AdmissionAccepted, Version: 1}}
+	client := Wrap(cache, hook)
+	key := redis.ServerCacheKey("alice")
+
+	client.AdmitProvision(ctx, key, redis.ServerState{WebUserID: "alice", Status: config.StatusProvisioning}, redis.AdmissionLimits{Start: time.Second}, time.Hour)
+	client.PushServerState(ctx, key, redis.ServerState{WebUserID: "alice", Status: config.StatusRunning, Available: true, Version: 1}, time.Hour)
+	client.DeleteServerState(ctx, key)
+	waitForUpdates(t, recv, 3)
+
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	updates := recv.updates
+	if updates[0].Event != EventUpdated || updates[0].State.Status != config.StatusProvisioning || updates[0].State.Version != 1 {
+		t.Errorf("expected the admitted state at version 1 first, got %+v", updates[0])
+	}
+	if updates[1].Event != EventUpdated || updates[1].State.Status != config.StatusRunning || updates[1].State.Version != 2 {
+		t.Errorf("expected the running state at version 2 second, got %+v", updates[1])
+	}
+	if updates[2].Event != EventDeleted || updates[2].CacheKey != key || updates[2].State != nil {
+		t.Errorf("expected the deletion last, got %+v", updates[2])
+	}
+}
+
+func TestClient_SkipsFailedWrites(t *testing.T) {
+	hook, _ := newTestHook(t)
+	key := redis.ServerCacheKey("alice")
+
+	failing := Wrap(&fakeCache{err: errors.New("redis down")}, hook)
+	failing.PushServerState(context.Background(), key, redis.ServerState{}, time.Hour)
+	failing.DeleteServerStates(context.Background(), []string{key})
+
+	// Admissions that wrote nothing aren't reported either
+	duplicate := Wrap(&fakeCache{admission: &redis.AdmissionResult{Decision: redis.AdmissionDuplicate}}, hook)
+	duplicate.AdmitProvision(context.Background(), key, redis.ServerState{}, redis.AdmissionLimits{Start: time.Second}, time.Hour)
+
+	if queued := len(hook.updates); queued != 0 {
+		t.Errorf("expected no updates queued, got %d", queued)
+	}
+}
+
+func TestDeliver_Retries(t *testing.T) {
+	ctx := context.Background()
+	update := Update{Event: EventDeleted, CacheKey: "key"}
+
+	// Server errors and rate limits are retried
+	hook, recv := newTestHook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	if err := hook.deliver(ctx, update); err != nil {
+		t.Fatalf("expected delivery after retries, got %v", err)
+	}
+	if recv.calls != 3 || len(recv.updates) != 1 {
+		t.Errorf("expected 3 calls and 1 delivery, got %d and %d", recv.calls, len(recv.updates))
+	}
+
+	// Other rejections are not
+	hook, recv = newTestHook(t, http.StatusBadRequest)
+	if err := hook.deliver(ctx, update); err == nil {
+		t.Fatal("expected a rejected delivery to fail")
+	}
+	if recv.calls != 1 {
+		t.Errorf("expected no retry of a 400, got %d calls", recv.calls)
+	}
+}
+
+func TestEnqueue_DropsWhenFull(t *testing.T) {
+	hook, _ := newTestHook(t)
+	hook.updates = make(chan Update, 1)
+
+	hook.Send(Update{CacheKey: "a"})
+	hook.Send(Update{CacheKey: "b"})
+	if hook.Dropped() != 1 {
+		t.Errorf("expected 1 dropped update, got %d", hook.Dropped())
+	}
+}
@@ -0,0 +1,305 @@
+// Package statusstream streams the server state changes of a user to LabMan as server-sent
+// events, so LabMan can subscribe instead of polling the cache. Every instance announces the
+// changes it writes on a Redis channel, so a stream served by one instance follows the
+// writes of all of them.
+package statusstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/statushook"
+)
+
+// EventSnapshot is the first event of every stream: the state when the stream started,
+// without a state if the user has no server
+const EventSnapshot = "snapshot"
+
+const (
+	publishQueueSize = 1000
+	publishTimeout   = 5 * time.Second
+
+	// subscriberBuffer is the number of changes a stream may fall behind before it is closed
+	subscriberBuffer = 16
+
+	defaultKeepAlive = 15 * time.Second
+	resubscribeDelay = 5 * time.Second
+)
+
+// Publisher announces the updates of a statushook.Client on the status bus
+type Publisher struct {
+	log     *slog.Logger
+	bus     redis.StatusBus
+	notices chan redis.StatusNotice
+	dropped atomic.Int64
+}
+
+// NewPublisher creates a publisher announcing updates on bus
+func NewPublisher(log *slog.Logger, bus redis.StatusBus) *Publisher {
+	return &Publisher{log: log, bus: bus, notices: make(chan redis.StatusNotice, publishQueueSize)}
+}
+
+// Send queues the announcement of update without blocking the cache write that caused it
+func (p *Publisher) Send(update statushook.Update) {
+	select {
+	case p.notices <- redis.StatusNotice{Event: update.Event, CacheKey: update.CacheKey}:
+	default:
+		p.dropped.Add(1)
+		p.log.Warn("status notice queue full, dropping notice", "cache_key", update.CacheKey, "event", update.Event)
+	}
+}
+
+// Dropped returns the number of notices dropped because the queue was full or publishing failed
+func (p *Publisher) Dropped() int64 {
+	return p.dropped.Load()
+}
+
+// Run publishes queued notices until ctx is done
+func (p *Publisher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notice := <-p.notices:
+			publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+			err := p.bus.PublishStatus(publishCtx, notice)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				p.dropped.Add(1)
+				p.log.Warn("failed to publish status notice", "cache_key", notice.CacheKey, "event", notice.Event, "error", err)
+			}
+		}
+	}
+}
+
+// StateReader reads the current state of a cache entry
+type StateReader interface {
+	GetServerState(ctx context.Context, cacheKey string) (*redis.ServerState, error)
+}
+
+// Broker hands the notices of the status bus to the streams this instance serves
+type Broker struct {
+	log       *slog.Logger
+	bus       redis.StatusBus
+	states    StateReader
+	keepAlive time.Duration
+
+	mu          sync.Mutex
+	subscribers map[string]map[*subscriber]struct{} // by cache key
+}
+
+// subscriber is one open stream
+type subscriber struct {
+	notices chan redis.StatusNotice
+	dropped chan struct{} // closed when the stream fell too far behind
+}
+
+// NewBroker creates a broker for the notices on bus, serving states read from states
+func NewBroker(log *slog.Logger, bus redis.StatusBus, states StateReader) *Broker {
+	return &Broker{
+		log:         log,
+		bus:         bus,
+		states:      states,
+		keepAlive:   defaultKeepAlive,
+		subscribers: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+// WithKeepAlive sets how often an idle stream gets a comment, so proxies keep it open
+// (default: 15 seconds)
+func (b *Broker) WithKeepAlive(interval time.Duration) *Broker {
+	b.keepAlive = interval
+	return b
+}
+
+// Run receives the notices of the status bus until ctx is done. After the subscription
+// was lost, every stream reads its state again, since notices may have been missed.
+func (b *Broker) Run(ctx context.Context) {
+	resubscribed := false
+	for {
+		notices, err := b.bus.SubscribeStatus(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			b.log.Warn("failed to subscribe to status notices, retrying", "retry_in", resubscribeDelay, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(resubscribeDelay):
+			}
+			continue
+		}
+		if resubscribed {
+			b.refreshAll()
+		}
+		for notice := range notices {
+			b.dispatch(notice)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		resubscribed = true
+	}
+}
+
+// dispatch hands notice to the streams of its cache key. A stream that can't take it is
+// closed, so its client reconnects and starts again from a snapshot.
+func (b *Broker) dispatch(notice redis.StatusNotice) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers[notice.CacheKey] {
+		select {
+		case sub.notices <- notice:
+		default:
+			close(sub.dropped)
+			delete(b.subscribers[notice.CacheKey], sub)
+		}
+	}
+}
+
+// refreshAll makes every stream read its state again
+func (b *Broker) refreshAll() {
+	b.mu.Lock()
+	var keys []string
+	for cacheKey := range b.subscribers {
+		keys = append(keys, cacheKey)
+	}
+	b.mu.Unlock()
+	for _, cacheKey := range keys {
+		b.dispatch(redis.StatusNotice{Event: statushook.EventUpdated, CacheKey: cacheKey})
+	}
+}
+
+func (b *Broker) subscribe(cacheKey string) *subscriber {
+	sub := &subscriber{notices: make(chan redis.StatusNotice, subscriberBuffer), dropped: make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[cacheKey] == nil {
+		b.subscribers[cacheKey] = make(map[*subscriber]struct{})
+	}
+	b.subscribers[cacheKey][sub] = struct{}{}
+	return sub
+}
+
+func (b *Broker) unsubscribe(cacheKey string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers[cacheKey], sub)
+	if len(b.subscribers[cacheKey]) == 0 {
+		delete(b.subscribers, cacheKey)
+	}
+}
+
+// Stream serves the changes of the cache entry cacheKey as server-sent events until the
+// client disconnects. The first event is a snapshot of the entry; each change is then sent
+// as an event named after its statushook event, with the statushook.Update as data.
+func (b *Broker) Stream(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before the snapshot, so no change between the two is missed
+	sub := b.subscribe(cacheKey)
+	defer b.unsubscribe(cacheKey, sub)
+
+	ctx := r.Context()
+	state, err := b.read(ctx, cacheKey)
+	if err != nil {
+		b.log.Error("failed to read server state for status stream", "cache_key", cacheKey, "error", err)
+		http.Error(w, "failed to read server state", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, EventSnapshot, statushook.Update{Event: EventSnapshot, CacheKey: cacheKey, State: state, At: time.Now().UTC()}); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(b.keepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.dropped:
+			b.log.Warn("status stream fell behind, closing it", "cache_key", cacheKey)
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case notice := <-sub.notices:
+			update, changed, err := b.update(ctx, notice, state)
+			if err != nil {
+				// The client reconnects and starts again from a snapshot
+				b.log.Error("failed to read server state for status stream", "cache_key", cacheKey, "error", err)
+				return
+			}
+			if !changed {
+				continue
+			}
+			state = update.State
+			if err := writeEvent(w, update.Event, update); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// update returns the update to send for notice, and whether it differs from the last sent state
+func (b *Broker) update(ctx context.Context, notice redis.StatusNotice, last *redis.ServerState) (statushook.Update, bool, error) {
+	update := statushook.Update{Event: statushook.EventDeleted, CacheKey: notice.CacheKey, At: time.Now().UTC()}
+	if notice.Event != statushook.EventDeleted {
+		state, err := b.read(ctx, notice.CacheKey)
+		if err != nil {
+			return update, false, err
+		}
+		if state != nil {
+			update.Event = statushook.EventUpdated
+			update.State = state
+		}
+	}
+
+	if update.State == nil {
+		return update, last != nil, nil
+	}
+	// Notices of writes already sent, e.g. after a refresh, change nothing
+	return update, last == nil || last.Version != update.State.Version, nil
+}
+
+// read returns the state under cacheKey, or nil if there is none
+func (b *Broker) read(ctx context.Context, cacheKey string) (*redis.ServerState, error) {
+	state, err := b.states.GetServerState(ctx, cacheKey)
+	if errors.Is(err, errs.ErrNotFound) {
+		return nil, nil
+	}
+	return state, err
+}
+
+// writeEvent writes one server-sent event with data as JSON
+func writeEvent(w http.ResponseWriter, event string, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	return err
+}
@@ -0,0 +1,188 @@
+package statusstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/redis/redistest"
+	"github.com/alex-sviridov/swim/internal/statushook"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestPublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := redistest.New()
+	notices, _ := store.SubscribeStatus(ctx)
+	publisher := NewPublisher(testLogger(), store)
+	go publisher.Run(ctx)
+	client := statushook.Wrap(store, publisher)
+
+	if err := client.PushServerState(ctx, "k", redis.ServerState{Status: "running"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteServerState(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []redis.StatusNotice{
+		{Event: statushook.EventUpdated, CacheKey: "k"},
+		{Event: statushook.EventDeleted, CacheKey: "k"},
+	} {
+		select {
+		case got := <-notices:
+			if got != want {
+				t.Errorf("expected notice %+v, got %+v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("notice %+v not published", want)
+		}
+	}
+}
+
+// readEvent reads the next server-sent event, skipping comments
+func readEvent(t *testing.T, r *bufio.Reader) (string, statushook.Update) {
+	t.Helper()
+	var event string
+	var update statushook.Update
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, update
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &update); err != nil {
+				t.Fatalf("invalid data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestBroker_Stream(t *testing.T) {
+	ctx := context.Background()
+	store := redistest.New()
+	store.PushServerState(ctx, "k", redis.ServerState{Status: "provisioning"}, 0)
+
+	broker := NewBroker(testLogger(), store, store).WithKeepAlive(10 * time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		broker.Stream(w, r, "k")
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %q", ct)
+	}
+	body := bufio.NewReader(resp.Body)
+
+	event, update := readEvent(t, body)
+	if event != EventSnapshot || update.State == nil || update.State.Status != "provisioning" {
+		t.Fatalf("expected a snapshot of the provisioning state, got %s %+v", event, update)
+	}
+
+	// The stream is subscribed once the snapshot is sent
+	store.PushServerState(ctx, "k", redis.ServerState{Status: "running", Version: 1}, 0)
+	broker.dispatch(redis.StatusNotice{Event: statushook.EventUpdated, CacheKey: "k"})
+	event, update = readEvent(t, body)
+	if event != statushook.EventUpdated || update.State == nil || update.State.Status != "running" {
+		t.Fatalf("expected the running state, got %s %+v", event, update)
+	}
+
+	// A notice of a state already sent is skipped, and notices of other users never arrive
+	broker.dispatch(redis.StatusNotice{Event: statushook.EventUpdated, CacheKey: "k"})
+	broker.dispatch(redis.StatusNotice{Event: statushook.EventDeleted, CacheKey: "other"})
+	store.DeleteServerState(ctx, "k")
+	broker.dispatch(redis.StatusNotice{Event: statushook.EventDeleted, CacheKey: "k"})
+	event, update = readEvent(t, body)
+	if event != statushook.EventDeleted || update.CacheKey != "k" || update.State != nil {
+		t.Fatalf("expected the deletion of k, got %s %+v", event, update)
+	}
+}
+
+func TestBroker_Snapshot_NoServer(t *testing.T) {
+	broker := NewBroker(testLogger(), redistest.New(), redistest.New())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		broker.Stream(w, r, "missing")
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if event, update := readEvent(t, bufio.NewReader(resp.Body)); event != EventSnapshot || update.State != nil {
+		t.Errorf("expected a snapshot without a state, got %s %+v", event, update)
+	}
+}
+
+func TestBroker_DropsSlowStream(t *testing.T) {
+	broker := NewBroker(testLogger(), redistest.New(), redistest.New())
+	slow := broker.subscribe("k")
+	for range subscriberBuffer + 1 {
+		broker.dispatch(redis.StatusNotice{Event: statushook.EventUpdated, CacheKey: "k"})
+	}
+	select {
+	case <-slow.dropped:
+	default:
+		t.Fatal("expected the stream that fell behind to be dropped")
+	}
+
+	// Further notices go nowhere instead of closing the stream again
+	broker.dispatch(redis.StatusNotice{Event: statushook.EventUpdated, CacheKey: "k"})
+	broker.unsubscribe("k", slow)
+}
+
+func TestBroker_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := redistest.New()
+	broker := NewBroker(testLogger(), store, store)
+	sub := broker.subscribe("k")
+	done := make(chan struct{})
+	go func() {
+		broker.Run(ctx)
+		close(done)
+	}()
+
+	// Publish until the broker's subscription takes the notice
+	deadline := time.After(time.Second)
+	for received := false; !received; {
+		store.PublishStatus(ctx, redis.StatusNotice{Event: statushook.EventDeleted, CacheKey: "k"})
+		select {
+		case notice := <-sub.notices:
+			received = notice.Event == statushook.EventDeleted
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("notice not received")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
@@ -0,0 +1,154 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+// Connector routes provider calls to the account of the tenant they belong to.
+// Creations go to the tenant named in the payload; lookups and listings cover every account.
+type Connector struct {
+	fallback connector.Connector
+	tenants  map[string]connector.Connector
+	order    []string // tenant IDs in a fixed order, so lookups are deterministic
+}
+
+// NewConnector creates a routing connector. Tenants without an entry in byTenant,
+// including the default tenant, use fallback.
+func NewConnector(fallback connector.Connector, byTenant map[string]connector.Connector) *Connector {
+	c := &Connector{fallback: fallback, tenants: byTenant}
+	for id := range byTenant {
+		c.order = append(c.order, id)
+	}
+	sort.Strings(c.order)
+	return c
+}
+
+// all returns every distinct connector, the fallback first
+func (c *Connector) all() []connector.Connector {
+	conns := []connector.Connector{c.fallback}
+	for _, id := range c.order {
+		conns = append(conns, c.tenants[id])
+	}
+	return conns
+}
+
+// forTenant returns the connector of a tenant
+func (c *Connector) forTenant(id string) connector.Connector {
+	if conn, ok := c.tenants[id]; ok {
+		return conn
+	}
+	return c.fallback
+}
+
+// CreateServer creates the server in the account of the payload's tenant
+func (c *Connector) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
+	var req struct {
+		Tenant string `json:"tenant"`
+	}
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		return nil, fmt.Errorf("unmarshal payload: %w", err)
+	}
+	return c.forTenant(req.Tenant).CreateServer(ctx, payload)
+}
+
+// ListServers lists the servers of every account
+func (c *Connector) ListServers(ctx context.Context) ([]connector.Server, error) {
+	var servers []connector.Server
+	for _, conn := range c.all() {
+		found, err := conn.ListServers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, found...)
+	}
+	return servers, nil
+}
+
+// GetServersByLabel lists the matching servers of every account. An error in any
+// account fails the call, so callers never act on a partial list.
+func (c *Connector) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	var servers []connector.Server
+	for _, conn := range c.all() {
+		found, err := conn.GetServersByLabel(ctx, key, value)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, found...)
+	}
+	return servers, nil
+}
+
+// GetServerByID returns the server from the first account that has it
+func (c *Connector) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	return first(c, func(conn connector.Connector) (connector.Server, error) {
+		return conn.GetServerByID(ctx, id)
+	})
+}
+
+// GetServerByName returns the server from the first account that has it
+func (c *Connector) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	return first(c, func(conn connector.Connector) (connector.Server, error) {
+		return conn.GetServerByName(ctx, name)
+	})
+}
+
+// GetConsoleURL requests the console from the first account that has the server
+func (c *Connector) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return first(c, func(conn connector.Connector) (*connector.Console, error) {
+		return conn.GetConsoleURL(ctx, id)
+	})
+}
+
+// MapState maps states with the fallback account's connector; every account uses the same provider
+func (c *Connector) MapState(cloudState string) (string, bool) {
+	return c.fallback.MapState(cloudState)
+}
+
+// ProvisionFailed classifies states with the fallback account's connector, like MapState
+func (c *Connector) ProvisionFailed(cloudState string) bool {
+	return connector.ProvisionFailed(c.fallback, cloudState)
+}
+
+// LabServerTypes returns the server types of the fallback account's connector; every account
+// shares the lab catalog
+func (c *Connector) LabServerTypes(labID int) []string {
+	if types, ok := c.fallback.(connector.ServerTypes); ok {
+		return types.LabServerTypes(labID)
+	}
+	return nil
+}
+
+// first returns the result of lookup in the first account that has the server. The error is
+// not found only if every account reported not found, so a failing account is never
+// mistaken for a deleted server.
+func first[T any](c *Connector, lookup func(conn connector.Connector) (T, error)) (T, error) {
+	var zero T
+	var notFound, failed []error
+	for _, conn := range c.all() {
+		result, err := lookup(conn)
+		switch {
+		case err == nil:
+			return result, nil
+		case errors.Is(err, errs.ErrNotFound):
+			notFound = append(notFound, err)
+		default:
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return zero, errors.Join(failed...)
+	}
+	return zero, connector.NewError(connector.CodeNotFound, errors.Join(notFound...))
+}
+
+var (
+	_ connector.Connector     = (*Connector)(nil)
+	_ connector.FailureStates = (*Connector)(nil)
+)
@@ -0,0 +1,133 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alex-sviridov/swim/internal/connector"
+	"github.com/alex-sviridov/swim/internal/errs"
+)
+
+type fakeServer struct {
+	id string
+}
+
+func (s *fakeServer) GetID() string                                { return s.id }
+func (s *fakeServer) GetName() string                              { return "server-" + s.id }
+func (s *fakeServer) GetIPv6Address() string                       { return "" }
+func (s *fakeServer) GetLabels() map[string]string                 { return nil }
+func (s *fakeServer) GetServerType() string                        { return "" }
+func (s *fakeServer) GetSSHHostKey() string                        { return "" }
+func (s *fakeServer) GetState(ctx context.Context) (string, error) { return "running", nil }
+func (s *fakeServer) Delete(ctx context.Context) error             { return nil }
+func (s *fakeServer) Rebuild(ctx context.Context) error            { return nil }
+func (s *fakeServer) Resize(ctx context.Context, t string) error   { return nil }
+func (s *fakeServer) String() string                               { return s.id }
+
+// fakeAccount is a provider account holding a fixed set of servers
+type fakeAccount struct {
+	servers []connector.Server
+	created []string
+	err     error // returned by lookups, like an unreachable account
+}
+
+func (a *fakeAccount) ListServers(ctx context.Context) ([]connector.Server, error) {
+	return a.servers, nil
+}
+
+// GetConsoleURL implements connector.Connector.GetConsoleURL
+func (a *fakeAccount) GetConsoleURL(ctx context.Context, id string) (*connector.Console, error) {
+	return nil, errors.New("not implemented")
+}
+
+// MapState implements connector.Connector.MapState
+func (a *fakeAccount) MapState(cloudState string) (string, bool) {
+	return cloudState, cloudState == "running"
+}
+
+func (a *fakeAccount) GetServerByID(ctx context.Context, id string) (connector.Server, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	for _, s := range a.servers {
+		if s.GetID() == id {
+			return s, nil
+		}
+	}
+	return nil, connector.NotFound("server %s not found", id)
+}
+
+func (a *fakeAccount) GetServerByName(ctx context.Context, name string) (connector.Server, error) {
+	for _, s := range a.servers {
+		if s.GetName() == name {
+			return s, nil
+		}
+	}
+	return nil, connector.NotFound("server %s not found", name)
+}
+
+func (a *fakeAccount) GetServersByLabel(ctx context.Context, key, value string) ([]connector.Server, error) {
+	return a.servers, nil
+}
+
+func (a *fakeAccount) CreateServer(ctx context.Context, payload string) (connector.Server, error) {
+	a.created = append(a.created, payload)
+	return &fakeServer{id: "new"}, nil
+}
+
+func TestConnector_CreateServerRoutesByTenant(t *testing.T) {
+	fallback, cs101 := &fakeAccount{}, &fakeAccount{}
+	c := NewConnector(fallback, map[string]connector.Connector{"cs101": cs101})
+
+	if _, err := c.CreateServer(context.Background(), `{"webuserid": "alice", "labId": 1, "tenant": "cs101"}`); err != nil {
+		t.Fatalf("CreateServer returned error: %v", err)
+	}
+	if _, err := c.CreateServer(context.Background(), `{"webuserid": "bob", "labId": 1}`); err != nil {
+		t.Fatalf("CreateServer returned error: %v", err)
+	}
+	if _, err := c.CreateServer(context.Background(), `{"webuserid": "carol", "labId": 1, "tenant": "cs202"}`); err != nil {
+		t.Fatalf("CreateServer returned error: %v", err)
+	}
+	if len(cs101.created) != 1 || len(fallback.created) != 2 {
+		t.Errorf("expected 1 creation in the tenant account and 2 in the fallback, got %d and %d",
+			len(cs101.created), len(fallback.created))
+	}
+
+	if _, err := c.CreateServer(context.Background(), `{invalid`); err == nil {
+		t.Error("expected error for invalid payload")
+	}
+}
+
+func TestConnector_LookupsCoverEveryAccount(t *testing.T) {
+	fallback := &fakeAccount{servers: []connector.Server{&fakeServer{id: "1"}}}
+	cs101 := &fakeAccount{servers: []connector.Server{&fakeServer{id: "2"}, &fakeServer{id: "3"}}}
+	c := NewConnector(fallback, map[string]connector.Connector{"cs101": cs101})
+
+	servers, err := c.ListServers(context.Background())
+	if err != nil || len(servers) != 3 {
+		t.Errorf("expected 3 servers across accounts, got %d, %v", len(servers), err)
+	}
+	servers, err = c.GetServersByLabel(context.Background(), connector.LabelTenant, "cs101")
+	if err != nil || len(servers) != 3 {
+		t.Errorf("expected 3 labelled servers across accounts, got %d, %v", len(servers), err)
+	}
+
+	server, err := c.GetServerByID(context.Background(), "3")
+	if err != nil || server.GetID() != "3" {
+		t.Errorf("expected server 3 from the tenant account, got %v, %v", server, err)
+	}
+	server, err = c.GetServerByName(context.Background(), "server-1")
+	if err != nil || server.GetID() != "1" {
+		t.Errorf("expected server 1 from the fallback account, got %v, %v", server, err)
+	}
+	if _, err := c.GetServerByID(context.Background(), "4"); !errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected not found for a server no account has, got %v", err)
+	}
+
+	// A failing account might hold the server, so the lookup must not report not found
+	cs101.err = errors.New("connection refused")
+	if _, err := c.GetServerByID(context.Background(), "4"); err == nil || errors.Is(err, errs.ErrNotFound) {
+		t.Errorf("expected the account error instead of not found, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Package tenant lets one SWIM instance serve several courses or organizations. Each
+// tenant gets its own cache namespace, quota, rate limits, lab catalog and provider account.
+package tenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/config"
+	"github.com/alex-sviridov/swim/internal/credentials"
+)
+
+// DefaultID names the registry entry applied to requests without a tenant
+const DefaultID = "default"
+
+// validID matches tenant IDs that are usable as provider label values and key segments
+var validID = regexp.MustCompile(`^[a-z0-9]([a-z0-9_.-]{0,61}[a-z0-9])?$`)
+
+// Tenant holds the limits and settings of one course or organization
+type Tenant struct {
+	ID                           string `json:"-"`
+	MaxServers                   int    `json:"maxServers"`                   // servers cached at once; 0 is unlimited
+	ProvisionRateLimitSeconds    int    `json:"provisionRateLimitSeconds"`    // 0 uses PROVISION_RATE_LIMIT_SECONDS
+	SwitchRateLimitSeconds       int    `json:"switchRateLimitSeconds"`       // 0 uses SWITCH_RATE_LIMIT_SECONDS
+	DecommissionRateLimitSeconds int    `json:"decommissionRateLimitSeconds"` // 0 uses DECOMMISSION_RATE_LIMIT_SECONDS
+	ExtendRateLimitSeconds       int    `json:"extendRateLimitSeconds"`       // 0 uses EXTEND_RATE_LIMIT_SECONDS
+	RebuildRateLimitSeconds      int    `json:"rebuildRateLimitSeconds"`      // 0 uses the provision window
+	Labs                         []int  `json:"labs"`                         // lab IDs the tenant may provision; empty allows every lab
+	HCloudTokenEnv               string `json:"hcloudTokenEnv"`               // environment variable with the tenant's Hetzner token
+	HCloudTokenFile              string `json:"hcloudTokenFile"`              // file with the tenant's Hetzner token, reloaded on rotation
+	HCloudTokenRedisKey          string `json:"hcloudTokenRedisKey"`          // Redis key with the tenant's Hetzner token, reloaded on rotation
+	HCloudTokenVault             string `json:"hcloudTokenVault"`             // Vault secret ("path#field") with the tenant's Hetzner token, reloaded on rotation
+}
+
+// HCloudTokenSource returns where the tenant's own Hetzner token is read from,
+// or nil if the tenant uses the global token
+func (t *Tenant) HCloudTokenSource(secrets credentials.SecretReader, vault *credentials.VaultClient) credentials.Source {
+	switch {
+	case t.HCloudTokenFile != "":
+		return credentials.File(t.HCloudTokenFile)
+	case t.HCloudTokenVault != "":
+		return credentials.Vault(vault, t.HCloudTokenVault)
+	case t.HCloudTokenRedisKey != "":
+		return credentials.RedisKey(secrets, t.HCloudTokenRedisKey)
+	case t.HCloudTokenEnv != "":
+		return credentials.Env(t.HCloudTokenEnv)
+	}
+	return nil
+}
+
+// AllowsLab reports whether labID is in the tenant's lab catalog
+func (t *Tenant) AllowsLab(labID int) bool {
+	if len(t.Labs) == 0 {
+		return true
+	}
+	for _, id := range t.Labs {
+		if id == labID {
+			return true
+		}
+	}
+	return false
+}
+
+// ProvisionRateLimit returns the tenant's provision rate limit window, taken by the start of
+// a lab while the user has none
+func (t *Tenant) ProvisionRateLimit() time.Duration {
+	if t.ProvisionRateLimitSeconds > 0 {
+		return time.Duration(t.ProvisionRateLimitSeconds) * time.Second
+	}
+	return config.GetProvisionRateLimitDuration()
+}
+
+// SwitchRateLimit returns the tenant's window for switching to another lab, which falls
+// back to the provision window when neither the tenant nor SWITCH_RATE_LIMIT_SECONDS set one
+func (t *Tenant) SwitchRateLimit() time.Duration {
+	if t.SwitchRateLimitSeconds > 0 {
+		return time.Duration(t.SwitchRateLimitSeconds) * time.Second
+	}
+	if window := config.GetSwitchRateLimitDuration(); window > 0 {
+		return window
+	}
+	return t.ProvisionRateLimit()
+}
+
+// DecommissionRateLimit returns the tenant's decommission rate limit window
+func (t *Tenant) DecommissionRateLimit() time.Duration {
+	if t.DecommissionRateLimitSeconds > 0 {
+		return time.Duration(t.DecommissionRateLimitSeconds) * time.Second
+	}
+	return config.GetDecommissionRateLimitDuration()
+}
+
+// ExtendRateLimit returns the tenant's session extension rate limit window
+func (t *Tenant) ExtendRateLimit() time.Duration {
+	if t.ExtendRateLimitSeconds > 0 {
+		return time.Duration(t.ExtendRateLimitSeconds) * time.Second
+	}
+	return config.GetExtendRateLimitDuration()
+}
+
+// RebuildRateLimit returns the tenant's rebuild rate limit window. A rebuild wipes the disk
+// like a new provision, so it falls back to the provision window.
+func (t *Tenant) RebuildRateLimit() time.Duration {
+	if t.RebuildRateLimitSeconds > 0 {
+		return time.Duration(t.RebuildRateLimitSeconds) * time.Second
+	}
+	return t.ProvisionRateLimit()
+}
+
+// Registry resolves tenant IDs from requests to their settings.
+// A nil registry serves the default tenant only, without limits.
+type Registry struct {
+	tenants map[string]*Tenant
+}
+
+// Load reads a registry file mapping tenant IDs to their settings, e.g.
+// {"cs101": {"maxServers": 40, "labs": [1, 2, 3], "hcloudTokenEnv": "HCLOUD_TOKEN_CS101"}}.
+// Returns nil if path is empty.
+func Load(path string) (*Registry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read tenant registry: %w", err)
+	}
+	var tenants map[string]Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("parse tenant registry %s: %w", path, err)
+	}
+	return NewRegistry(tenants)
+}
+
+// NewRegistry creates a registry from tenant settings keyed by tenant ID
+func NewRegistry(tenants map[string]Tenant) (*Registry, error) {
+	r := &Registry{tenants: make(map[string]*Tenant, len(tenants))}
+	for id, t := range tenants {
+		if !validID.MatchString(id) {
+			return nil, fmt.Errorf("invalid tenant ID %q: use lowercase letters, digits, '-', '_' and '.'", id)
+		}
+		if t.MaxServers < 0 {
+			return nil, fmt.Errorf("tenant %s: maxServers must not be negative", id)
+		}
+		sources := 0
+		for _, setting := range []string{t.HCloudTokenEnv, t.HCloudTokenFile, t.HCloudTokenRedisKey, t.HCloudTokenVault} {
+			if setting != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return nil, fmt.Errorf("tenant %s: set only one of hcloudTokenEnv, hcloudTokenFile, hcloudTokenRedisKey and hcloudTokenVault", id)
+		}
+		if id == DefaultID && sources > 0 {
+			return nil, fmt.Errorf("tenant %s always uses the global Hetzner token, remove its token setting", id)
+		}
+		t.ID = id
+		r.tenants[id] = &t
+	}
+	return r, nil
+}
+
+// Get returns the tenant with id. An empty id or "default" is the default tenant: the
+// "default" entry if the registry has one, otherwise a tenant without limits. The default
+// tenant's ID is always empty, so its users keep the unscoped cache keys.
+func (r *Registry) Get(id string) (*Tenant, error) {
+	if id == "" || id == DefaultID {
+		if r != nil {
+			if t, ok := r.tenants[DefaultID]; ok {
+				defaults := *t
+				defaults.ID = ""
+				return &defaults, nil
+			}
+		}
+		return &Tenant{}, nil
+	}
+	if r != nil {
+		if t, ok := r.tenants[id]; ok {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tenant %q", id)
+}
+
+// All returns every registered tenant, ordered by ID
+func (r *Registry) All() []*Tenant {
+	if r == nil {
+		return nil
+	}
+	tenants := make([]*Tenant, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants
+}
@@ -0,0 +1,136 @@
+package tenant
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	if r, err := Load(""); r != nil || err != nil {
+		t.Errorf("expected nil registry without a file, got %+v, %v", r, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	data := `{
+		"cs101": {"maxServers": 40, "provisionRateLimitSeconds": 60, "labs": [1, 2], "hcloudTokenEnv": "HCLOUD_TOKEN_CS101"},
+		"default": {"maxServers": 10}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	cs101, err := r.Get("cs101")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if cs101.ID != "cs101" || cs101.MaxServers != 40 || cs101.HCloudTokenEnv != "HCLOUD_TOKEN_CS101" {
+		t.Errorf("unexpected tenant: %+v", cs101)
+	}
+	if cs101.ProvisionRateLimit() != time.Minute {
+		t.Errorf("expected tenant provision rate limit of 1m, got %v", cs101.ProvisionRateLimit())
+	}
+	if len(r.All()) != 2 || r.All()[0].ID != "cs101" {
+		t.Errorf("expected tenants ordered by ID, got %+v", r.All())
+	}
+
+	// Requests without a tenant get the default entry, but keep the unscoped ID
+	for _, id := range []string{"", DefaultID} {
+		defaults, err := r.Get(id)
+		if err != nil || defaults.ID != "" || defaults.MaxServers != 10 {
+			t.Errorf("Get(%q): expected default entry with empty ID, got %+v, %v", id, defaults, err)
+		}
+	}
+
+	if _, err := r.Get("cs202"); err == nil || !strings.Contains(err.Error(), "cs202") {
+		t.Errorf("expected unknown tenant error, got %v", err)
+	}
+}
+
+func TestSwitchRateLimit(t *testing.T) {
+	tenant := Tenant{ProvisionRateLimitSeconds: 60}
+	if got := tenant.SwitchRateLimit(); got != time.Minute {
+		t.Errorf("expected the switch window to fall back to the provision window, got %v", got)
+	}
+	t.Setenv("SWITCH_RATE_LIMIT_SECONDS", "30")
+	if got := tenant.SwitchRateLimit(); got != 30*time.Second {
+		t.Errorf("expected SWITCH_RATE_LIMIT_SECONDS, got %v", got)
+	}
+	tenant.SwitchRateLimitSeconds = 5
+	if got := tenant.SwitchRateLimit(); got != 5*time.Second {
+		t.Errorf("expected the tenant's own switch window, got %v", got)
+	}
+}
+
+func TestRebuildRateLimit(t *testing.T) {
+	tenant := Tenant{ProvisionRateLimitSeconds: 60}
+	if got := tenant.RebuildRateLimit(); got != time.Minute {
+		t.Errorf("expected the rebuild window to fall back to the provision window, got %v", got)
+	}
+	tenant.RebuildRateLimitSeconds = 300
+	if got := tenant.RebuildRateLimit(); got != 5*time.Minute {
+		t.Errorf("expected the tenant's own rebuild window, got %v", got)
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	defaults, err := r.Get("")
+	if err != nil || defaults.MaxServers != 0 || !defaults.AllowsLab(99) {
+		t.Errorf("expected unrestricted default tenant, got %+v, %v", defaults, err)
+	}
+	if _, err := r.Get("cs101"); err == nil {
+		t.Error("expected named tenants to be rejected without a registry")
+	}
+	if r.All() != nil {
+		t.Error("expected no tenants without a registry")
+	}
+}
+
+func TestNewRegistry_Invalid(t *testing.T) {
+	for name, tenants := range map[string]map[string]Tenant{
+		"uppercase ID":        {"CS101": {}},
+		"colon in ID":         {"cs:101": {}},
+		"negative quota":      {"cs101": {MaxServers: -1}},
+		"default with token":  {DefaultID: {HCloudTokenEnv: "HCLOUD_TOKEN_OTHER"}},
+		"default with file":   {DefaultID: {HCloudTokenFile: "/run/secrets/hcloud"}},
+		"two token sources":   {"cs101": {HCloudTokenEnv: "HCLOUD_TOKEN_CS101", HCloudTokenRedisKey: "swim:token:cs101"}},
+		"leading punctuation": {"-cs101": {}},
+	} {
+		if _, err := NewRegistry(tenants); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestAllowsLab(t *testing.T) {
+	catalog := &Tenant{Labs: []int{1, 2}}
+	if !catalog.AllowsLab(2) || catalog.AllowsLab(3) {
+		t.Error("expected only labs 1 and 2 to be allowed")
+	}
+	if !(&Tenant{}).AllowsLab(3) {
+		t.Error("expected an empty catalog to allow every lab")
+	}
+}
+
+func TestHCloudTokenSource(t *testing.T) {
+	if (&Tenant{}).HCloudTokenSource(nil, nil) != nil {
+		t.Error("expected no source for a tenant using the global token")
+	}
+	for want, tenant := range map[string]*Tenant{
+		"environment variable HCLOUD_TOKEN_CS101": {HCloudTokenEnv: "HCLOUD_TOKEN_CS101"},
+		"file /run/secrets/cs101":                 {HCloudTokenFile: "/run/secrets/cs101"},
+		"redis key swim:token:cs101":              {HCloudTokenRedisKey: "swim:token:cs101"},
+		"vault secret secret/data/cs101#hcloud":   {HCloudTokenVault: "secret/data/cs101#hcloud"},
+	} {
+		if got := tenant.HCloudTokenSource(nil, nil).String(); got != want {
+			t.Errorf("expected source %q, got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Package tracing carries the correlation ID of a LabMan request through SWIM,
+// so one request can be followed across queue messages, logs and provider resources.
+package tracing
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogKey is the slog attribute holding the correlation ID
+const LogKey = "correlation_id"
+
+// maxIDLength keeps the ID usable as a provider label value
+const maxIDLength = 63
+
+type contextKey struct{}
+
+// WithCorrelationID returns a context carrying id. An empty id leaves ctx unchanged.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, or "" if there is none
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger returns log with the correlation ID of ctx attached, or log itself if ctx has none
+func Logger(ctx context.Context, log *slog.Logger) *slog.Logger {
+	if id := CorrelationID(ctx); id != "" {
+		return log.With(LogKey, id)
+	}
+	return log
+}
+
+// Valid reports whether id can be propagated to provider labels: at most 63 characters
+// of letters, digits, '-', '_' and '.', starting and ending with a letter or digit
+func Valid(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	if !alphanumeric(rune(id[0])) || !alphanumeric(rune(id[len(id)-1])) {
+		return false
+	}
+	for _, r := range id {
+		if !alphanumeric(r) && r != '-' && r != '_' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func alphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
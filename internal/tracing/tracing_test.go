@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestWithCorrelationID(t *testing.T) {
+	ctx := context.Background()
+	if got := CorrelationID(ctx); got != "" {
+		t.Errorf("expected no correlation ID, got %q", got)
+	}
+
+	if WithCorrelationID(ctx, "") != ctx {
+		t.Error("expected empty ID to leave the context unchanged")
+	}
+
+	ctx = WithCorrelationID(ctx, "req-123")
+	if got := CorrelationID(ctx); got != "req-123" {
+		t.Errorf("expected req-123, got %q", got)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+
+	Logger(context.Background(), log).Info("without")
+	Logger(WithCorrelationID(context.Background(), "req-123"), log).Info("with")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(lines))
+	}
+	if strings.Contains(lines[0], LogKey) {
+		t.Errorf("expected no correlation ID attribute, got %q", lines[0])
+	}
+	if !strings.Contains(lines[1], LogKey+"=req-123") {
+		t.Errorf("expected correlation ID attribute, got %q", lines[1])
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"req-123", true},
+		{"550e8400-e29b-41d4-a716-446655440000", true},
+		{"a.b_c", true},
+		{"", false},
+		{"has space", false},
+		{"slash/inside", false},
+		{"a", true},
+		{"-leading", false},
+		{"trailing_", false},
+		{".dotted.", false},
+		{"_", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.id); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
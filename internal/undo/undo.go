@@ -0,0 +1,102 @@
+// Package undo restores labs that were decommissioned by mistake. The decommissioner
+// leaves a tombstone for each deleted lab; an undo request within the tombstone window
+// provisions the same lab again.
+package undo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+	"github.com/alex-sviridov/swim/internal/tracing"
+	"github.com/alex-sviridov/swim/internal/validate"
+)
+
+// Request asks to restore the lab a user decommissioned last
+type Request struct {
+	WebUserID     string `json:"webuserid"`
+	Tenant        string `json:"tenant,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"` // Optional: traces the request through logs
+}
+
+// Handler turns undo requests into provision requests for the tombstoned lab
+type Handler struct {
+	log        *slog.Logger
+	tombstones redis.TombstoneStore
+	provision  func(payload string)
+	tenants    *tenant.Registry
+}
+
+// New creates a Handler that passes the provision request of each restored lab to provision
+func New(log *slog.Logger, tombstones redis.TombstoneStore, provision func(payload string)) *Handler {
+	return &Handler{log: log, tombstones: tombstones, provision: provision}
+}
+
+// WithTenants resolves the tenant of each request for its tombstone namespace.
+// Without a registry only requests for the default tenant are accepted.
+func (h *Handler) WithTenants(registry *tenant.Registry) *Handler {
+	h.tenants = registry
+	return h
+}
+
+// ProcessRequest handles a single undo request from the queue
+func (h *Handler) ProcessRequest(ctx context.Context, payload string) {
+	var req Request
+	if err := json.Unmarshal([]byte(payload), &req); err != nil {
+		h.log.Error("failed to parse undo request", "error", err)
+		return
+	}
+	if err := validate.First(validate.WebUserID(req.WebUserID), validate.CorrelationID(req.CorrelationID),
+		validate.Text("tenant", req.Tenant, validate.MaxLabelLength)); err != nil {
+		h.log.Error("rejecting invalid undo request", "error", err)
+		return
+	}
+
+	ctx = tracing.WithCorrelationID(ctx, req.CorrelationID)
+	reqLog := tracing.Logger(ctx, h.log).With("webuserid", req.WebUserID)
+
+	t, err := h.tenants.Get(req.Tenant)
+	if err != nil {
+		reqLog.Error("rejecting undo request", "error", err)
+		return
+	}
+
+	// Taking the tombstone makes a repeated undo a no-op instead of a second server
+	tombstone, err := h.tombstones.TakeTombstone(ctx, redis.TenantUserID(t.ID, req.WebUserID))
+	if errors.Is(err, errs.ErrNotFound) {
+		reqLog.Warn("nothing to undo, no recently decommissioned lab")
+		return
+	}
+	if err != nil {
+		reqLog.Error("failed to read tombstone", "error", err)
+		return
+	}
+
+	correlationID := req.CorrelationID
+	if correlationID == "" {
+		correlationID = tombstone.CorrelationID
+	}
+	provisionReq := map[string]interface{}{
+		"webuserid": tombstone.WebUserID,
+		"labId":     tombstone.LabID,
+	}
+	if tombstone.Tenant != "" {
+		provisionReq["tenant"] = tombstone.Tenant
+	}
+	if correlationID != "" {
+		provisionReq["correlationId"] = correlationID
+	}
+	data, err := json.Marshal(provisionReq)
+	if err != nil {
+		reqLog.Error("failed to marshal provision request", "error", err)
+		return
+	}
+
+	reqLog.Info("restoring decommissioned lab", "labid", tombstone.LabID, "deleted_server_id", tombstone.ServerID,
+		"deleted_at", tombstone.DeletedAt)
+	h.provision(string(data))
+}
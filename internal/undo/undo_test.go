@@ -0,0 +1,123 @@
+package undo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/swim/internal/errs"
+	"github.com/alex-sviridov/swim/internal/redis"
+	"github.com/alex-sviridov/swim/internal/tenant"
+)
+
+// fakeTombstones keeps tombstones by tenant-scoped user ID
+type fakeTombstones struct {
+	tombstones map[string]redis.Tombstone
+	err        error
+}
+
+func (f *fakeTombstones) PushTombstone(ctx context.Context, tombstone redis.Tombstone, ttl time.Duration) error {
+	f.tombstones[redis.TenantUserID(tombstone.Tenant, tombstone.WebUserID)] = tombstone
+	return nil
+}
+
+func (f *fakeTombstones) TakeTombstone(ctx context.Context, userID string) (*redis.Tombstone, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	tombstone, ok := f.tombstones[userID]
+	if !ok {
+		return nil, errs.New("tombstone not found", errs.ErrNotFound)
+	}
+	delete(f.tombstones, userID)
+	return &tombstone, nil
+}
+
+func TestProcessRequest(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	registry, err := tenant.NewRegistry(map[string]tenant.Tenant{"cs101": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected []string // provision payloads
+	}{
+		{
+			name:     "restores the tombstoned lab",
+			payload:  `{"webuserid":"user-1"}`,
+			expected: []string{`{"correlationId":"corr-old","labId":5,"webuserid":"user-1"}`},
+		},
+		{
+			name:     "request correlation ID wins",
+			payload:  `{"webuserid":"user-1","correlationId":"corr-new"}`,
+			expected: []string{`{"correlationId":"corr-new","labId":5,"webuserid":"user-1"}`},
+		},
+		{
+			name:     "tenant tombstone",
+			payload:  `{"webuserid":"user-1","tenant":"cs101"}`,
+			expected: []string{`{"labId":7,"tenant":"cs101","webuserid":"user-1"}`},
+		},
+		{
+			name:    "no tombstone",
+			payload: `{"webuserid":"user-2"}`,
+		},
+		{
+			name:    "unknown tenant",
+			payload: `{"webuserid":"user-1","tenant":"cs999"}`,
+		},
+		{
+			name:    "invalid user ID",
+			payload: `{"webuserid":"user 1"}`,
+		},
+		{
+			name:    "malformed JSON",
+			payload: `{"webuserid":`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeTombstones{tombstones: map[string]redis.Tombstone{
+				"user-1":       {WebUserID: "user-1", LabID: 5, ServerID: "123", CorrelationID: "corr-old"},
+				"cs101:user-1": {WebUserID: "user-1", LabID: 7, Tenant: "cs101", ServerID: "456"},
+			}}
+			var provisioned []string
+			handler := New(log, store, func(payload string) {
+				provisioned = append(provisioned, payload)
+			}).WithTenants(registry)
+
+			handler.ProcessRequest(context.Background(), tt.payload)
+
+			if len(provisioned) != len(tt.expected) {
+				t.Fatalf("expected %d provision requests, got %v", len(tt.expected), provisioned)
+			}
+			for i, payload := range provisioned {
+				if payload != tt.expected[i] {
+					t.Errorf("expected provision request %s, got %s", tt.expected[i], payload)
+				}
+			}
+
+			// A repeated undo finds no tombstone
+			handler.ProcessRequest(context.Background(), tt.payload)
+			if len(provisioned) != len(tt.expected) {
+				t.Errorf("expected a repeated undo to do nothing, got %v", provisioned)
+			}
+		})
+	}
+}
+
+func TestProcessRequest_StoreError(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := &fakeTombstones{err: errors.New("connection refused")}
+
+	handler := New(log, store, func(payload string) {
+		t.Errorf("expected no provision request, got %s", payload)
+	})
+	handler.ProcessRequest(context.Background(), `{"webuserid":"user-1"}`)
+}
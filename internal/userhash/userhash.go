@@ -0,0 +1,40 @@
+// Package userhash derives pseudonymous user identifiers for cloud provider labels,
+// so raw web user IDs never leave SWIM and Redis.
+package userhash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
+
+// Provider label keys identifying the owning user
+const (
+	LabelWebUserID   = "webuserid"
+	LabelWebUserHash = "webuserhash"
+)
+
+// hashLength keeps the hex digest within the 63 character label value limit
+const hashLength = 32
+
+// SecretFromEnv returns the HMAC key from LABEL_USER_HMAC_SECRET.
+// An empty secret disables hashing and labels servers with the raw web user ID.
+func SecretFromEnv() string {
+	return os.Getenv("LABEL_USER_HMAC_SECRET")
+}
+
+// Hash returns the hex-encoded HMAC-SHA256 of webUserID keyed by secret, truncated to 128 bits
+func Hash(secret, webUserID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(webUserID))
+	return hex.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// Label returns the label key and value that identify webUserID on provider resources
+func Label(secret, webUserID string) (key, value string) {
+	if secret == "" {
+		return LabelWebUserID, webUserID
+	}
+	return LabelWebUserHash, Hash(secret, webUserID)
+}
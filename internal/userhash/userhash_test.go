@@ -0,0 +1,43 @@
+package userhash
+
+import (
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	h1 := Hash("secret", "user-123")
+	h2 := Hash("secret", "user-123")
+	if h1 != h2 {
+		t.Errorf("expected deterministic hash, got %q and %q", h1, h2)
+	}
+	if len(h1) != hashLength {
+		t.Errorf("expected hash length %d, got %d", hashLength, len(h1))
+	}
+	if Hash("other-secret", "user-123") == h1 {
+		t.Error("expected different secrets to produce different hashes")
+	}
+	if Hash("secret", "user-456") == h1 {
+		t.Error("expected different users to produce different hashes")
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		name          string
+		secret        string
+		expectedKey   string
+		expectedValue string
+	}{
+		{"hashing disabled", "", LabelWebUserID, "user-123"},
+		{"hashing enabled", "secret", LabelWebUserHash, Hash("secret", "user-123")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, value := Label(tt.secret, "user-123")
+			if key != tt.expectedKey || value != tt.expectedValue {
+				t.Errorf("Label() = (%q, %q), expected (%q, %q)", key, value, tt.expectedKey, tt.expectedValue)
+			}
+		})
+	}
+}
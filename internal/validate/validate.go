@@ -0,0 +1,142 @@
+// Package validate checks request fields from the queues before they flow into cache keys,
+// provider labels and logs.
+package validate
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+)
+
+// Field limits
+const (
+	MaxWebUserIDLength     = 128       // Keycloak IDs are 36 characters, usernames and emails stay well below this
+	MaxLabID               = 1_000_000 // lab IDs are positive and below this
+	MaxServerIDLength      = 64
+	MaxServerTypeLength    = 32
+	MaxCorrelationIDLength = 128
+	MaxLabelLength         = 63 // Hetzner label key and value limit, also the hostname label limit
+	MaxLabels              = 16
+	MaxNodeNameLength      = 15 // node names end up in server names and labels
+)
+
+var (
+	// validWebUserID excludes ':' (the cache key separator), whitespace and control characters
+	validWebUserID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@+-]*$`)
+	validServerID  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+	// validServerType matches provider server type names such as "cx32" or "ccx13"
+	validServerType = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	// validNodeName matches node names of composite labs such as "attacker" or "db-1"
+	validNodeName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+)
+
+// WebUserID checks a web user ID: 1 to 128 letters, digits, '.', '_', '@', '+' and '-',
+// starting with a letter or digit
+func WebUserID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("webuserid is required")
+	case len(id) > MaxWebUserIDLength:
+		return fmt.Errorf("webuserid is longer than %d characters", MaxWebUserIDLength)
+	case !validWebUserID.MatchString(id):
+		return fmt.Errorf("webuserid may only contain letters, digits, '.', '_', '@', '+' and '-'")
+	}
+	return nil
+}
+
+// LabID checks that a lab ID is between 1 and MaxLabID
+func LabID(id int) error {
+	if id < 1 || id > MaxLabID {
+		return fmt.Errorf("labId %d is out of range 1-%d", id, MaxLabID)
+	}
+	return nil
+}
+
+// ServerID checks a provider server ID: up to 64 letters, digits, '_' and '-'
+func ServerID(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("serverId is required")
+	case len(id) > MaxServerIDLength:
+		return fmt.Errorf("serverId is longer than %d characters", MaxServerIDLength)
+	case !validServerID.MatchString(id):
+		return fmt.Errorf("serverId may only contain letters, digits, '_' and '-'")
+	}
+	return nil
+}
+
+// ServerType checks a server type name: up to 32 lowercase letters, digits and '-'
+func ServerType(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("serverType is required")
+	case len(name) > MaxServerTypeLength:
+		return fmt.Errorf("serverType is longer than %d characters", MaxServerTypeLength)
+	case !validServerType.MatchString(name):
+		return fmt.Errorf("serverType may only contain lowercase letters, digits and '-'")
+	}
+	return nil
+}
+
+// NodeName checks the name of a node of a composite lab: up to 15 lowercase letters, digits
+// and '-', starting with a letter
+func NodeName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("node name is required")
+	case len(name) > MaxNodeNameLength:
+		return fmt.Errorf("node name %q is longer than %d characters", name, MaxNodeNameLength)
+	case !validNodeName.MatchString(name):
+		return fmt.Errorf("node name %q may only contain lowercase letters, digits and '-', starting with a letter", name)
+	}
+	return nil
+}
+
+// CorrelationID checks an optional correlation ID, which is written to every log line of a request
+func CorrelationID(id string) error {
+	return Text("correlationId", id, MaxCorrelationIDLength)
+}
+
+// Labels checks a label selector: at most MaxLabels labels with non-empty keys,
+// keys and values of printable text within MaxLabelLength
+func Labels(field string, labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("%s has more than %d labels", field, MaxLabels)
+	}
+	for key, value := range labels {
+		if key == "" {
+			return fmt.Errorf("%s has an empty label key", field)
+		}
+		if err := Text(field+" key", key, MaxLabelLength); err != nil {
+			return err
+		}
+		if err := Text(field+" value", value, MaxLabelLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Text checks an optional free-form string: at most max bytes and no control characters,
+// so it cannot forge log lines
+func Text(field, value string, max int) error {
+	if len(value) > max {
+		return fmt.Errorf("%s is longer than %d characters", field, max)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return fmt.Errorf("%s contains control or invalid characters", field)
+		}
+	}
+	return nil
+}
+
+// First returns the first non-nil error, so a request is rejected with one single-line message
+func First(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
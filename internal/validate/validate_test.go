@@ -0,0 +1,110 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWebUserID(t *testing.T) {
+	for _, id := range []string{"user-123", "3f2a9c1e-7b44-4c1d-9a0e-1b2c3d4e5f60", "Alice@Uni.edu", "a.b_c+d"} {
+		if err := WebUserID(id); err != nil {
+			t.Errorf("%q: unexpected error %v", id, err)
+		}
+	}
+	invalid := []string{"", "tenant:user", "user 123", "user\nlevel=ERROR", "-user", "user\x00", "usér", strings.Repeat("a", MaxWebUserIDLength+1)}
+	for _, id := range invalid {
+		if err := WebUserID(id); err == nil {
+			t.Errorf("%q: expected error", id)
+		}
+	}
+}
+
+func TestLabID(t *testing.T) {
+	for _, id := range []int{1, 42, MaxLabID} {
+		if err := LabID(id); err != nil {
+			t.Errorf("%d: unexpected error %v", id, err)
+		}
+	}
+	for _, id := range []int{0, -1, MaxLabID + 1} {
+		if err := LabID(id); err == nil {
+			t.Errorf("%d: expected error", id)
+		}
+	}
+}
+
+func TestServerID(t *testing.T) {
+	for _, id := range []string{"12345678", "server-123", "srv_1"} {
+		if err := ServerID(id); err != nil {
+			t.Errorf("%q: unexpected error %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "../1", "12 34", "12:34", strings.Repeat("1", MaxServerIDLength+1)} {
+		if err := ServerID(id); err == nil {
+			t.Errorf("%q: expected error", id)
+		}
+	}
+}
+
+func TestServerType(t *testing.T) {
+	for _, name := range []string{"cx32", "ccx13", "cax11", "cpx-21"} {
+		if err := ServerType(name); err != nil {
+			t.Errorf("%q: unexpected error %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "CX32", "cx 32", "-cx32", "cx32\n", strings.Repeat("c", MaxServerTypeLength+1)} {
+		if err := ServerType(name); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+}
+
+func TestNodeName(t *testing.T) {
+	for _, name := range []string{"attacker", "target", "db-1", "a"} {
+		if err := NodeName(name); err != nil {
+			t.Errorf("%q: unexpected error %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Attacker", "1st", "node 1", "-node", strings.Repeat("n", MaxNodeNameLength+1)} {
+		if err := NodeName(name); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	if err := Text("correlationId", "", 10); err != nil {
+		t.Errorf("expected empty value to be valid, got %v", err)
+	}
+	if err := Text("correlationId", "req-1 from LabMan ✓", 64); err != nil {
+		t.Errorf("expected printable value to be valid, got %v", err)
+	}
+	for _, value := range []string{"req-1\r\nforged", "req\t1", "\xff", strings.Repeat("x", 11)} {
+		if err := Text("correlationId", value, 10); err == nil || !strings.HasPrefix(err.Error(), "correlationId ") {
+			t.Errorf("%q: expected correlationId error, got %v", value, err)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if err := Labels("labelSelector", map[string]string{"lab": "5", "course": ""}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	tooMany := make(map[string]string)
+	for i := 0; i <= MaxLabels; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	for _, labels := range []map[string]string{tooMany, {"": "v"}, {"lab": "5\nforged"}, {strings.Repeat("k", 64): "v"}} {
+		if err := Labels("labelSelector", labels); err == nil {
+			t.Errorf("%v: expected error", labels)
+		}
+	}
+}
+
+func TestFirst(t *testing.T) {
+	if err := First(nil, nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if err := First(nil, WebUserID(""), LabID(0)); err == nil || err.Error() != "webuserid is required" {
+		t.Errorf("expected the first error, got %v", err)
+	}
+}
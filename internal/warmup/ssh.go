@@ -0,0 +1,122 @@
+package warmup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshPort = "22"
+
+	// sshRetryInterval paces connection attempts while sshd is still starting
+	sshRetryInterval = 5 * time.Second
+	sshDialTimeout   = 10 * time.Second
+)
+
+// sshExecutor runs commands over SSH with the provisioning key
+type sshExecutor struct {
+	user          string
+	signer        ssh.Signer
+	port          string
+	retryInterval time.Duration
+}
+
+func newSSHExecutor(user string, signer ssh.Signer) *sshExecutor {
+	return &sshExecutor{user: user, signer: signer, port: sshPort, retryInterval: sshRetryInterval}
+}
+
+// Run implements Executor. It keeps retrying the connection until ctx is done,
+// since a server reported as running may not accept SSH yet.
+func (e *sshExecutor) Run(ctx context.Context, address string, hostKey string, command string) error {
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if hostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return fmt.Errorf("parse host key: %w", err)
+		}
+		hostKeyCallback = ssh.FixedHostKey(key)
+	}
+	cfg := &ssh.ClientConfig{
+		User:            e.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(e.signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}
+
+	client, err := e.dial(ctx, net.JoinHostPort(address, e.port), cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("open ssh session: %w", err)
+	}
+	defer session.Close()
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := session.CombinedOutput(command)
+		done <- result{output, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return fmt.Errorf("command failed: %w: %s", res.err, bytes.TrimSpace(res.output))
+		}
+		return nil
+	case <-ctx.Done():
+		// Closing the client aborts the command
+		client.Close()
+		return fmt.Errorf("command interrupted: %w", ctx.Err())
+	}
+}
+
+// dial connects to addr, retrying until the server accepts the connection or ctx is done
+func (e *sshExecutor) dial(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	var lastErr error
+	for {
+		client, err := e.dialOnce(ctx, addr, cfg)
+		if err == nil {
+			return client, nil
+		}
+		lastErr = err
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connect to %s: %w (last error: %v)", addr, ctx.Err(), lastErr)
+		case <-time.After(e.retryInterval):
+		}
+	}
+}
+
+func (e *sshExecutor) dialOnce(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake has no context of its own, so bound it with a deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
@@ -0,0 +1,226 @@
+package warmup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testSSHServer accepts the client key and answers exec requests:
+// "fail" exits with status 1, "hang" never returns, anything else exits 0
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func startSSHServer(t *testing.T, clientKey ssh.PublicKey) *testSSHServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testSSHServer{listener: listener, hostKey: newSigner(t)}
+	t.Cleanup(func() { listener.Close() })
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "root" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	cfg.AddHostKey(srv.hostKey)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn, cfg)
+		}
+	}()
+	return srv
+}
+
+func (s *testSSHServer) port() string {
+	return strings.TrimPrefix(s.listener.Addr().String(), "127.0.0.1:")
+}
+
+func (s *testSSHServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				command := string(req.Payload[4:])
+				s.mu.Lock()
+				s.commands = append(s.commands, command)
+				s.mu.Unlock()
+				req.Reply(true, nil)
+
+				if command == "hang" {
+					continue
+				}
+				status := uint32(0)
+				if command == "fail" {
+					channel.Write([]byte("no space left on device"))
+					status = 1
+				}
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, status)
+				channel.SendRequest("exit-status", false, payload)
+				channel.Close()
+			}
+		}()
+	}
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func testExecutor(t *testing.T, srv *testSSHServer, signer ssh.Signer) *sshExecutor {
+	executor := newSSHExecutor("root", signer)
+	executor.port = srv.port()
+	executor.retryInterval = 10 * time.Millisecond
+	return executor
+}
+
+func TestSSHExecutor_RunsCommand(t *testing.T) {
+	clientKey := newSigner(t)
+	srv := startSSHServer(t, clientKey.PublicKey())
+	executor := testExecutor(t, srv, clientKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := executor.Run(ctx, "127.0.0.1", authorizedKey(srv.hostKey.PublicKey()), "docker pull lab"); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(srv.commands) != 1 || srv.commands[0] != "docker pull lab" {
+		t.Errorf("expected command to run once, got %v", srv.commands)
+	}
+}
+
+func TestSSHExecutor_CommandFails(t *testing.T) {
+	clientKey := newSigner(t)
+	srv := startSSHServer(t, clientKey.PublicKey())
+	executor := testExecutor(t, srv, clientKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := executor.Run(ctx, "127.0.0.1", "", "fail")
+	if err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Errorf("expected failure with command output, got %v", err)
+	}
+}
+
+func TestSSHExecutor_Timeout(t *testing.T) {
+	clientKey := newSigner(t)
+	srv := startSSHServer(t, clientKey.PublicKey())
+	executor := testExecutor(t, srv, clientKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := executor.Run(ctx, "127.0.0.1", "", "hang"); err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("expected interrupted command, got %v", err)
+	}
+}
+
+func TestSSHExecutor_RejectsUnexpectedHostKey(t *testing.T) {
+	clientKey := newSigner(t)
+	srv := startSSHServer(t, clientKey.PublicKey())
+	executor := testExecutor(t, srv, clientKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := executor.Run(ctx, "127.0.0.1", authorizedKey(newSigner(t).PublicKey()), "true"); err == nil {
+		t.Fatal("expected host key mismatch to fail")
+	}
+	if len(srv.commands) != 0 {
+		t.Errorf("expected no command on a server with the wrong host key, got %v", srv.commands)
+	}
+}
+
+func TestSSHExecutor_RetriesUntilServerListens(t *testing.T) {
+	clientKey := newSigner(t)
+
+	// Reserve a port with nothing listening on it yet
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	executor := newSSHExecutor("root", clientKey)
+	executor.port = strings.TrimPrefix(addr, "127.0.0.1:")
+	executor.retryInterval = 10 * time.Millisecond
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		srv := &testSSHServer{listener: listener, hostKey: newSigner(t)}
+		cfg := &ssh.ServerConfig{NoClientAuth: true}
+		cfg.AddHostKey(srv.hostKey)
+		t.Cleanup(func() { listener.Close() })
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn, cfg)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := executor.Run(ctx, "127.0.0.1", "", "true"); err != nil {
+		t.Fatalf("expected Run to succeed once sshd is up, got %v", err)
+	}
+}
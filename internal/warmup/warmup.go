@@ -0,0 +1,132 @@
+// Package warmup runs a per-lab command on a freshly booted server, e.g. to pull a
+// container image or download a dataset, before the student is let in.
+package warmup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultTimeout = 10 * time.Minute
+	defaultUser    = "root"
+)
+
+// Executor runs a command on a server
+type Executor interface {
+	// Run runs command on the server at address. hostKey, in authorized_keys format,
+	// pins the server's SSH host key; an empty hostKey accepts any key.
+	Run(ctx context.Context, address string, hostKey string, command string) error
+}
+
+// Lab is the warm-up step of one lab in the catalog
+type Lab struct {
+	Command        string `json:"command"`
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // overrides the default timeout
+}
+
+// Catalog holds the warm-up steps by lab ID
+type Catalog map[int]Lab
+
+// LoadCatalog reads a catalog from a JSON file keyed by lab ID:
+// {"12": {"command": "docker pull registry.example.com/lab12", "timeoutSeconds": 900}}
+func LoadCatalog(path string) (Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read warm-up catalog: %w", err)
+	}
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("parse warm-up catalog %s: %w", path, err)
+	}
+	return catalog, nil
+}
+
+// Config contains warm-up settings
+type Config struct {
+	CatalogFile string        // JSON catalog of warm-up commands; empty disables warm-up
+	KeyFile     string        // private key matching the provisioning SSH key
+	Key         []byte        // private key in PEM, used instead of KeyFile (e.g. fetched from Vault)
+	User        string        // SSH user (default: root)
+	Timeout     time.Duration // default per-lab timeout, including waiting for SSH (default: 10m)
+}
+
+// Runner runs the warm-up step of a lab
+type Runner struct {
+	executor Executor
+	catalog  Catalog
+	timeout  time.Duration
+}
+
+// New creates the runner for the configured catalog.
+// Returns nil if no catalog is configured.
+func New(cfg Config) (*Runner, error) {
+	if cfg.CatalogFile == "" {
+		return nil, nil
+	}
+	if cfg.KeyFile == "" && len(cfg.Key) == 0 {
+		return nil, fmt.Errorf("warm-up catalog set but no SSH key")
+	}
+
+	catalog, err := LoadCatalog(cfg.CatalogFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData := cfg.Key
+	if len(keyData) == 0 {
+		if keyData, err = os.ReadFile(cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("read warm-up SSH key: %w", err)
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("parse warm-up SSH key: %w", err)
+	}
+
+	user := cfg.User
+	if user == "" {
+		user = defaultUser
+	}
+	return NewRunner(newSSHExecutor(user, signer), catalog, cfg.Timeout), nil
+}
+
+// NewRunner creates a runner that runs catalog commands with executor; a timeout of 0 uses the default
+func NewRunner(executor Executor, catalog Catalog, timeout time.Duration) *Runner {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Runner{executor: executor, catalog: catalog, timeout: timeout}
+}
+
+// Has reports whether labID has a warm-up step
+func (r *Runner) Has(labID int) bool {
+	lab, ok := r.catalog[labID]
+	return ok && lab.Command != ""
+}
+
+// Run runs the warm-up step of labID on the server at address.
+// Labs without a warm-up step succeed immediately.
+func (r *Runner) Run(ctx context.Context, labID int, address string, hostKey string) error {
+	if !r.Has(labID) {
+		return nil
+	}
+	lab := r.catalog[labID]
+
+	timeout := r.timeout
+	if lab.TimeoutSeconds > 0 {
+		timeout = time.Duration(lab.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := r.executor.Run(ctx, address, hostKey, lab.Command); err != nil {
+		return fmt.Errorf("warm-up for lab %d: %w", labID, err)
+	}
+	return nil
+}
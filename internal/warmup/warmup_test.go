@@ -0,0 +1,126 @@
+package warmup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeExecutor records commands and returns err
+type fakeExecutor struct {
+	commands []string
+	deadline time.Duration
+	err      error
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, address string, hostKey string, command string) error {
+	f.commands = append(f.commands, address+" "+command)
+	if deadline, ok := ctx.Deadline(); ok {
+		f.deadline = time.Until(deadline).Round(time.Minute)
+	}
+	return f.err
+}
+
+func TestLoadCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	data := `{"12": {"command": "docker pull lab12", "timeoutSeconds": 900}, "13": {"command": "true"}}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := LoadCatalog(path)
+	if err != nil {
+		t.Fatalf("LoadCatalog returned error: %v", err)
+	}
+	if catalog[12].Command != "docker pull lab12" || catalog[12].TimeoutSeconds != 900 || catalog[13].Command != "true" {
+		t.Errorf("unexpected catalog: %+v", catalog)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"twelve": {}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCatalog(path); err == nil {
+		t.Error("expected error for non-numeric lab ID")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if runner, err := New(Config{}); runner != nil || err != nil {
+		t.Errorf("expected nil runner without catalog, got %v, %v", runner, err)
+	}
+	if _, err := New(Config{CatalogFile: "catalog.json"}); err == nil {
+		t.Error("expected error without SSH key file")
+	}
+
+	// A key passed in memory, e.g. fetched from Vault, replaces the key file
+	dir := t.TempDir()
+	catalogPath := filepath.Join(dir, "catalog.json")
+	if err := os.WriteFile(catalogPath, []byte(`{"12": {"command": "true"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner, err := New(Config{CatalogFile: catalogPath, Key: pem.EncodeToMemory(block)})
+	if err != nil || !runner.Has(12) {
+		t.Errorf("expected runner from in-memory key, got %v, %v", runner, err)
+	}
+	if _, err := New(Config{CatalogFile: catalogPath, Key: []byte("not a key")}); err == nil {
+		t.Error("expected error for an invalid key")
+	}
+}
+
+func TestRunner_Run(t *testing.T) {
+	catalog := Catalog{
+		12: {Command: "docker pull lab12", TimeoutSeconds: 1800},
+		13: {Command: "true"},
+	}
+
+	t.Run("lab without warm-up", func(t *testing.T) {
+		executor := &fakeExecutor{}
+		runner := NewRunner(executor, catalog, 0)
+		if runner.Has(99) {
+			t.Error("expected lab 99 to have no warm-up")
+		}
+		if err := runner.Run(context.Background(), 99, "2001:db8::1", ""); err != nil || len(executor.commands) != 0 {
+			t.Errorf("expected nothing to run, got %v, %v", executor.commands, err)
+		}
+	})
+
+	t.Run("timeouts", func(t *testing.T) {
+		executor := &fakeExecutor{}
+		runner := NewRunner(executor, catalog, 5*time.Minute)
+
+		runner.Run(context.Background(), 12, "2001:db8::1", "")
+		if executor.deadline != 30*time.Minute {
+			t.Errorf("expected lab timeout of 30m, got %v", executor.deadline)
+		}
+		runner.Run(context.Background(), 13, "2001:db8::1", "")
+		if executor.deadline != 5*time.Minute {
+			t.Errorf("expected default timeout of 5m, got %v", executor.deadline)
+		}
+		if len(executor.commands) != 2 || executor.commands[0] != "2001:db8::1 docker pull lab12" {
+			t.Errorf("unexpected commands: %v", executor.commands)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		runner := NewRunner(&fakeExecutor{err: errors.New("exit status 1")}, catalog, 0)
+		if err := runner.Run(context.Background(), 13, "2001:db8::1", ""); err == nil {
+			t.Error("expected warm-up failure")
+		}
+	})
+}